@@ -45,6 +45,13 @@ var (
 type ecrBase struct {
 	client  ecrAPI
 	ecrSpec ECRSpec
+	events  EventHandler
+	// transport transfers blobs, and is nil if the default transport is
+	// used.
+	transport BlobTransport
+	// mediaTypes are the manifest media types accepted from BatchGetImage,
+	// and are nil if all supported media types are accepted.
+	mediaTypes []string
 }
 
 // ecrAPI contains only the ECR APIs that are called by the resolver
@@ -58,16 +65,34 @@ type ecrAPI interface {
 	UploadLayerPart(*ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error)
 	CompleteLayerUpload(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error)
 	PutImageWithContext(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error)
+	DescribeRepositoriesWithContext(aws.Context, *ecr.DescribeRepositoriesInput, ...request.Option) (*ecr.DescribeRepositoriesOutput, error)
+	GetRepositoryPolicyWithContext(aws.Context, *ecr.GetRepositoryPolicyInput, ...request.Option) (*ecr.GetRepositoryPolicyOutput, error)
+	DescribeRegistryWithContext(aws.Context, *ecr.DescribeRegistryInput, ...request.Option) (*ecr.DescribeRegistryOutput, error)
+	GetAuthorizationTokenWithContext(aws.Context, *ecr.GetAuthorizationTokenInput, ...request.Option) (*ecr.GetAuthorizationTokenOutput, error)
+	DescribeImagesWithContext(aws.Context, *ecr.DescribeImagesInput, ...request.Option) (*ecr.DescribeImagesOutput, error)
+	ListImagesWithContext(aws.Context, *ecr.ListImagesInput, ...request.Option) (*ecr.ListImagesOutput, error)
+	CreateRepositoryWithContext(aws.Context, *ecr.CreateRepositoryInput, ...request.Option) (*ecr.CreateRepositoryOutput, error)
+	DescribePullThroughCacheRulesWithContext(aws.Context, *ecr.DescribePullThroughCacheRulesInput, ...request.Option) (*ecr.DescribePullThroughCacheRulesOutput, error)
+	DescribeImageScanFindingsWithContext(aws.Context, *ecr.DescribeImageScanFindingsInput, ...request.Option) (*ecr.DescribeImageScanFindingsOutput, error)
 }
 
 // getImage fetches the reference's image from ECR.
 func (b *ecrBase) getImage(ctx context.Context) (*ecr.Image, error) {
 	return b.runGetImage(ctx, ecr.BatchGetImageInput{
 		ImageIds:           []*ecr.ImageIdentifier{b.ecrSpec.ImageID()},
-		AcceptedMediaTypes: aws.StringSlice(supportedImageMediaTypes),
+		AcceptedMediaTypes: aws.StringSlice(acceptedMediaTypes(b.mediaTypes)),
 	})
 }
 
+// acceptedMediaTypes returns the manifest media types to accept from
+// BatchGetImage, which are mediaTypes if configured.
+func acceptedMediaTypes(mediaTypes []string) []string {
+	if len(mediaTypes) > 0 {
+		return mediaTypes
+	}
+	return supportedImageMediaTypes
+}
+
 // getImageByDescriptor retrieves an image from ECR for a given OCI descriptor.
 func (b *ecrBase) getImageByDescriptor(ctx context.Context, desc ocispec.Descriptor) (*ecr.Image, error) {
 	// If the reference includes both a digest & tag for an image and that
@@ -105,7 +130,7 @@ func (b *ecrBase) getImageByDescriptor(ctx context.Context, desc ocispec.Descrip
 	if desc.MediaType != "" {
 		input.AcceptedMediaTypes = []*string{aws.String(desc.MediaType)}
 	} else {
-		input.AcceptedMediaTypes = aws.StringSlice(supportedImageMediaTypes)
+		input.AcceptedMediaTypes = aws.StringSlice(acceptedMediaTypes(b.mediaTypes))
 	}
 
 	return b.runGetImage(ctx, input)
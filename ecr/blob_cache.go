@@ -0,0 +1,455 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// BlobCacheOptions configures the BlobCache returned by NewBlobCache.  One of
+// Dir or Content must be specified.
+type BlobCacheOptions struct {
+	// Dir is the directory holding the cached blobs, which may be shared by
+	// the processes of a host.  It is created if it does not exist, and
+	// belongs to the cache: any blob in it may be evicted.
+	Dir string
+	// Content is the content store holding the cached blobs, such as
+	// containerd's.  Only the blobs stored by the cache are evicted from it.
+	Content content.Store
+	// MaxSize bounds the bytes of the cached blobs, evicting the least
+	// recently used blobs first.  If not specified, the size is not bounded.
+	MaxSize int64
+	// TTL is how long a blob is kept once last used.  If not specified,
+	// blobs are kept until evicted to bound the size.
+	TTL time.Duration
+	// Verify re-hashes each cached blob the first time the cache reads it,
+	// such as the first time after a restart, so that blobs corrupted on disk
+	// are not read by pulls.  A blob which no longer matches its digest is
+	// quarantined and downloaded again.  Blobs stored by the cache were
+	// verified as they were downloaded.  If not specified, cached blobs are
+	// read as they are.
+	Verify bool
+	// VerifyInterval is the time between the verification passes of Run.
+	// If not specified, Run verifies the cached blobs every hour.
+	VerifyInterval time.Duration
+	// QuarantineDir is the directory corrupt blobs are moved to, as for
+	// ContentVerifierOptions.  If not specified, corrupt blobs are deleted.
+	QuarantineDir string
+	// Clock times the use of blobs.  If not specified, SystemClock is used.
+	Clock Clock
+}
+
+// BlobCache keeps the layers and configs downloaded by resolvers, so that
+// pulls of images sharing base layers on a host download each layer once.
+// Blobs found in the cache are read from it without requesting their download
+// URLs from ECR.  A blob is only cached once it has been downloaded in full
+// and matches its digest.  A BlobCache is safe for concurrent use, and may be
+// given to several resolvers.
+type BlobCache struct {
+	options BlobCacheOptions
+	store   content.Store
+	// owned reports whether every blob in store belongs to the cache.
+	owned bool
+
+	lock sync.Mutex
+	// used holds when the blobs known to the cache were last used.  Blobs
+	// not yet used by this cache were last used when stored.
+	used map[digest.Digest]time.Time
+	// ingesting holds the blobs being cached by fetches.  Other fetches of
+	// them download them without caching them.
+	ingesting map[digest.Digest]bool
+	// verifier re-hashes the cached blobs, and quarantines corrupt ones.
+	verifier *ContentVerifier
+	// evicting serializes evictions.
+	evicting sync.Mutex
+}
+
+// NewBlobCache returns a BlobCache, to be given to resolvers with
+// WithBlobCache.
+func NewBlobCache(options BlobCacheOptions) (*BlobCache, error) {
+	if (options.Dir == "") == (options.Content == nil) {
+		return nil, errors.New("blob cache requires one of a directory or a content store")
+	}
+	if options.MaxSize < 0 {
+		return nil, errors.New("blob cache size must not be negative")
+	}
+	if options.TTL < 0 {
+		return nil, errors.New("blob cache TTL must not be negative")
+	}
+	if options.VerifyInterval < 0 {
+		return nil, errors.New("blob cache verification interval must not be negative")
+	}
+	if options.VerifyInterval == 0 {
+		options.VerifyInterval = defaultVerifyInterval
+	}
+	if options.Clock == nil {
+		options.Clock = SystemClock
+	}
+	cache := &BlobCache{
+		options:   options,
+		store:     options.Content,
+		used:      map[digest.Digest]time.Time{},
+		ingesting: map[digest.Digest]bool{},
+	}
+	if options.Dir != "" {
+		store, err := local.NewStore(options.Dir)
+		if err != nil {
+			return nil, err
+		}
+		cache.store, cache.owned = store, true
+	}
+	verifier, err := NewContentVerifier(cache.store, ContentVerifierOptions{QuarantineDir: options.QuarantineDir})
+	if err != nil {
+		return nil, err
+	}
+	cache.verifier = verifier
+	return cache, nil
+}
+
+// fetch returns the content of the blob desc from the cache, or with
+// download, caching the content downloaded once read in full.  c may be nil,
+// in which case download is called at once.
+func (c *BlobCache) fetch(ctx context.Context, desc ocispec.Descriptor, download func(context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if c == nil || desc.Digest.Validate() != nil {
+		return download(ctx)
+	}
+	if rc, ok := c.get(ctx, desc); ok {
+		return rc, nil
+	}
+	rc, err := download(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !c.startIngest(desc.Digest) {
+		return rc, nil
+	}
+	ref := "ecr-blob-cache-" + desc.Digest.String()
+	w, err := c.store.Writer(ctx, content.WithRef(ref), content.WithDescriptor(desc))
+	if err != nil {
+		// Another process is caching the blob, or has just cached it.
+		log.G(ctx).WithError(err).Debug("ecr.cache.blob: not caching")
+		c.endIngest(desc.Digest)
+		return rc, nil
+	}
+	cw := &cachingReader{ReadCloser: rc, ctx: ctx, cache: c, desc: desc, ref: ref, w: w}
+	// An ingest left by an interrupted fetch is started again.
+	if status, err := w.Status(); err != nil || status.Offset != 0 {
+		if err == nil {
+			err = w.Truncate(0)
+		}
+		if err != nil {
+			cw.abandon(err)
+		}
+	}
+	return cw, nil
+}
+
+// startIngest reports whether the caller is to cache dgst, which it must
+// follow with endIngest.  It is false while another fetch is caching dgst.
+func (c *BlobCache) startIngest(dgst digest.Digest) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.ingesting[dgst] {
+		return false
+	}
+	c.ingesting[dgst] = true
+	return true
+}
+
+func (c *BlobCache) endIngest(dgst digest.Digest) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.ingesting, dgst)
+}
+
+// get returns the content of desc if it is cached and has not expired.
+func (c *BlobCache) get(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, bool) {
+	info, err := c.store.Info(ctx, desc.Digest)
+	if err != nil {
+		return nil, false
+	}
+	now := c.options.Clock.Now()
+	c.lock.Lock()
+	used, known := c.used[desc.Digest]
+	if !known {
+		used = info.CreatedAt
+	}
+	// Content in a store given to the cache which the cache did not store is
+	// read all the same, but neither expires nor is evicted.
+	tracked := known || c.owned
+	expired := tracked && c.options.TTL > 0 && now.Sub(used) > c.options.TTL
+	if tracked && !expired {
+		c.used[desc.Digest] = now
+	}
+	c.lock.Unlock()
+	if expired {
+		c.remove(ctx, desc.Digest)
+		return nil, false
+	}
+	if desc.Size > 0 && info.Size != desc.Size {
+		return nil, false
+	}
+	if c.options.Verify {
+		if err := c.verifier.VerifyOnce(ctx, desc.Digest); err != nil {
+			log.G(ctx).WithError(err).WithField("digest", desc.Digest).Debug("ecr.cache.blob: not reading unverified blob")
+			c.forget(desc.Digest)
+			return nil, false
+		}
+	}
+	ra, err := c.store.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, false
+	}
+	log.G(ctx).WithField("digest", desc.Digest).Debug("ecr.cache.blob: hit")
+	return &readerAtCloser{Reader: io.NewSectionReader(ra, 0, ra.Size()), closer: ra}, true
+}
+
+// Verify makes a single verification pass over the cached blobs, returning
+// the digests of the blobs quarantined.  Blobs in a store given to the cache
+// which the cache did not store are not verified.
+func (c *BlobCache) Verify(ctx context.Context) ([]digest.Digest, error) {
+	c.lock.Lock()
+	known := make(map[digest.Digest]bool, len(c.used))
+	for dgst := range c.used {
+		known[dgst] = true
+	}
+	c.lock.Unlock()
+	var digests []digest.Digest
+	if err := c.store.Walk(ctx, func(info content.Info) error {
+		if known[info.Digest] || c.owned {
+			digests = append(digests, info.Digest)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	var corrupt []digest.Digest
+	for _, dgst := range digests {
+		err := c.verifier.Verify(ctx, dgst)
+		switch {
+		case errors.Is(err, ErrCorruptBlob):
+			c.forget(dgst)
+			corrupt = append(corrupt, dgst)
+		case errdefs.IsNotFound(err):
+			// The blob was evicted since the store was listed.
+		case err != nil:
+			return corrupt, err
+		}
+	}
+	return corrupt, nil
+}
+
+// Run verifies the cached blobs every VerifyInterval until ctx is done, and
+// returns the context's error.  Failures are logged and retried on the next
+// pass.
+func (c *BlobCache) Run(ctx context.Context) error {
+	for {
+		corrupt, err := c.Verify(ctx)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("ecr.cache.blob: verification failed")
+		} else if len(corrupt) > 0 {
+			log.G(ctx).WithField("corrupt", len(corrupt)).Warn("ecr.cache.blob: quarantined corrupt blobs")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.options.Clock.After(c.options.VerifyInterval):
+		}
+	}
+}
+
+// stored records that the blob dgst was stored, and so verified, by the
+// cache, and evicts blobs to keep the cache within its size.
+func (c *BlobCache) stored(ctx context.Context, dgst digest.Digest) {
+	c.lock.Lock()
+	c.used[dgst] = c.options.Clock.Now()
+	c.lock.Unlock()
+	c.verifier.trust(dgst)
+	c.evict(ctx)
+}
+
+// evict removes expired blobs, then the least recently used blobs until the
+// cache is within its size.
+func (c *BlobCache) evict(ctx context.Context) {
+	if c.options.TTL == 0 && c.options.MaxSize == 0 {
+		return
+	}
+	c.evicting.Lock()
+	defer c.evicting.Unlock()
+
+	type entry struct {
+		digest digest.Digest
+		size   int64
+		used   time.Time
+	}
+	c.lock.Lock()
+	usedAt := make(map[digest.Digest]time.Time, len(c.used))
+	for dgst, used := range c.used {
+		usedAt[dgst] = used
+	}
+	c.lock.Unlock()
+	var entries []entry
+	err := c.store.Walk(ctx, func(info content.Info) error {
+		used, known := usedAt[info.Digest]
+		if !known {
+			if !c.owned {
+				return nil
+			}
+			used = info.CreatedAt
+		}
+		entries = append(entries, entry{digest: info.Digest, size: info.Size, used: used})
+		return nil
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("ecr.cache.blob: failed to list blobs")
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].used.Before(entries[j].used)
+	})
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	now := c.options.Clock.Now()
+	for _, e := range entries {
+		expired := c.options.TTL > 0 && now.Sub(e.used) > c.options.TTL
+		oversize := c.options.MaxSize > 0 && total > c.options.MaxSize
+		if !expired && !oversize {
+			continue
+		}
+		c.remove(ctx, e.digest)
+		total -= e.size
+	}
+}
+
+func (c *BlobCache) remove(ctx context.Context, dgst digest.Digest) {
+	log.G(ctx).WithField("digest", dgst).Debug("ecr.cache.blob: evicting")
+	if err := c.store.Delete(ctx, dgst); err != nil && !errdefs.IsNotFound(err) {
+		log.G(ctx).WithError(err).WithField("digest", dgst).Warn("ecr.cache.blob: failed to evict")
+	}
+	c.forget(dgst)
+}
+
+// forget stops tracking the blob dgst, which is no longer in the store.
+func (c *BlobCache) forget(dgst digest.Digest) {
+	c.lock.Lock()
+	delete(c.used, dgst)
+	c.lock.Unlock()
+	c.verifier.forget(dgst)
+}
+
+// cachingReader writes the content read from a download to the cache,
+// committing it once the download has been read in full.  Failures to cache
+// the content do not fail reads.
+type cachingReader struct {
+	io.ReadCloser
+	ctx   context.Context
+	cache *BlobCache
+	desc  ocispec.Descriptor
+	ref   string
+	// w is nil once the content is committed or abandoned.
+	w content.Writer
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.write(p[:n])
+	if err == io.EOF {
+		r.commit()
+	}
+	return n, err
+}
+
+// WriteTo copies the download to w with its WriteTo, if it has one, caching
+// the content copied.
+func (r *cachingReader) WriteTo(w io.Writer) (int64, error) {
+	n, err := copyPooled(io.MultiWriter(w, cacheWriter{r}), r.ReadCloser)
+	if err == nil {
+		r.commit()
+	}
+	return n, err
+}
+
+func (r *cachingReader) Close() error {
+	if r.w != nil {
+		r.abandon(nil)
+	}
+	return r.ReadCloser.Close()
+}
+
+func (r *cachingReader) write(p []byte) {
+	if r.w == nil || len(p) == 0 {
+		return
+	}
+	if _, err := r.w.Write(p); err != nil {
+		r.abandon(err)
+	}
+}
+
+func (r *cachingReader) commit() {
+	if r.w == nil {
+		return
+	}
+	w := r.w
+	r.w = nil
+	err := w.Commit(r.ctx, r.desc.Size, r.desc.Digest)
+	w.Close()
+	r.cache.endIngest(r.desc.Digest)
+	switch {
+	case err == nil, errdefs.IsAlreadyExists(err):
+		r.cache.stored(r.ctx, r.desc.Digest)
+	default:
+		log.G(r.ctx).WithError(err).Debug("ecr.cache.blob: failed to cache")
+		r.cache.store.Abort(r.ctx, r.ref)
+	}
+}
+
+// abandon discards the content written so far, logging err if set.
+func (r *cachingReader) abandon(err error) {
+	if err != nil {
+		log.G(r.ctx).WithError(err).Debug("ecr.cache.blob: failed to cache")
+	}
+	r.w.Close()
+	r.w = nil
+	r.cache.store.Abort(r.ctx, r.ref)
+	r.cache.endIngest(r.desc.Digest)
+}
+
+// cacheWriter writes to the cache of a cachingReader, never failing.
+type cacheWriter struct {
+	r *cachingReader
+}
+
+func (w cacheWriter) Write(p []byte) (int, error) {
+	w.r.write(p)
+	return len(p), nil
+}
@@ -0,0 +1,261 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blobCacheFetcher returns a fetcher using cache, serving each layer named by
+// its digest from layers and counting the download URLs requested.
+func blobCacheFetcher(t *testing.T, cache *BlobCache, layers map[digest.Digest]string, requests *int) *ecrFetcher {
+	var lock sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, layers[digest.Digest(r.URL.Query().Get("digest"))])
+	}))
+	t.Cleanup(ts.Close)
+	return &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(_ aws.Context, input *ecr.GetDownloadUrlForLayerInput, _ ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					lock.Lock()
+					*requests++
+					lock.Unlock()
+					return &ecr.GetDownloadUrlForLayerOutput{
+						DownloadUrl: aws.String(ts.URL + "?digest=" + aws.StringValue(input.LayerDigest)),
+					}, nil
+				},
+			},
+		},
+		blobCache: cache,
+	}
+}
+
+func layerDescriptor(data string) ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString(data),
+		Size:      int64(len(data)),
+	}
+}
+
+func readLayer(t *testing.T, fetcher *ecrFetcher, desc ocispec.Descriptor) string {
+	rc, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestBlobCache(t *testing.T) {
+	const layer = "base layer"
+	desc := layerDescriptor(layer)
+	cache, err := NewBlobCache(BlobCacheOptions{Dir: t.TempDir()})
+	require.NoError(t, err)
+	requests := 0
+	fetcher := blobCacheFetcher(t, cache, map[digest.Digest]string{desc.Digest: layer}, &requests)
+
+	assert.Equal(t, layer, readLayer(t, fetcher, desc))
+	assert.Equal(t, 1, requests)
+	// Another fetcher sharing the cache reads the layer from it.
+	other := blobCacheFetcher(t, cache, nil, &requests)
+	assert.Equal(t, layer, readLayer(t, other, desc))
+	assert.Equal(t, 1, requests, "cached layer should not be downloaded again")
+}
+
+func TestBlobCachePartialRead(t *testing.T) {
+	const layer = "base layer"
+	desc := layerDescriptor(layer)
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	cache, err := NewBlobCache(BlobCacheOptions{Content: store})
+	require.NoError(t, err)
+	requests := 0
+	fetcher := blobCacheFetcher(t, cache, map[digest.Digest]string{desc.Digest: layer}, &requests)
+
+	rc, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	_, err = rc.Read(make([]byte, 4))
+	require.NoError(t, err)
+	rc.Close()
+	_, err = store.Info(context.Background(), desc.Digest)
+	assert.Error(t, err, "partially read layer should not be cached")
+
+	assert.Equal(t, layer, readLayer(t, fetcher, desc))
+	assert.Equal(t, 2, requests)
+	_, err = content.ReadBlob(context.Background(), store, desc)
+	assert.NoError(t, err, "layer read in full should be cached")
+}
+
+func TestBlobCacheEviction(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	first, second := layerDescriptor("first layer"), layerDescriptor("second layer")
+	layers := map[digest.Digest]string{first.Digest: "first layer", second.Digest: "second layer"}
+
+	t.Run("size", func(t *testing.T) {
+		cache, err := NewBlobCache(BlobCacheOptions{Dir: t.TempDir(), MaxSize: first.Size + second.Size - 1, Clock: clock})
+		require.NoError(t, err)
+		requests := 0
+		fetcher := blobCacheFetcher(t, cache, layers, &requests)
+		readLayer(t, fetcher, first)
+		clock.advance(time.Second)
+		readLayer(t, fetcher, second)
+		clock.advance(time.Second)
+		readLayer(t, fetcher, second)
+		assert.Equal(t, 2, requests, "most recent layer should be kept")
+		readLayer(t, fetcher, first)
+		assert.Equal(t, 3, requests, "least recently used layer should be evicted")
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		cache, err := NewBlobCache(BlobCacheOptions{Dir: t.TempDir(), TTL: time.Minute, Clock: clock})
+		require.NoError(t, err)
+		requests := 0
+		fetcher := blobCacheFetcher(t, cache, layers, &requests)
+		readLayer(t, fetcher, first)
+		clock.advance(30 * time.Second)
+		readLayer(t, fetcher, first)
+		clock.advance(45 * time.Second)
+		readLayer(t, fetcher, first)
+		assert.Equal(t, 1, requests, "use should extend the TTL")
+		clock.advance(2 * time.Minute)
+		readLayer(t, fetcher, first)
+		assert.Equal(t, 2, requests, "expired layer should be downloaded again")
+	})
+}
+
+func TestBlobCacheVerify(t *testing.T) {
+	const layer = "base layer"
+	desc := layerDescriptor(layer)
+	layers := map[digest.Digest]string{desc.Digest: layer}
+
+	t.Run("first use", func(t *testing.T) {
+		dir := t.TempDir()
+		quarantine := filepath.Join(t.TempDir(), "quarantine")
+		cache, err := NewBlobCache(BlobCacheOptions{Dir: dir})
+		require.NoError(t, err)
+		requests := 0
+		assert.Equal(t, layer, readLayer(t, blobCacheFetcher(t, cache, layers, &requests), desc))
+		corruptStoredBlob(t, dir, desc.Digest)
+
+		// A cache opened on the directory again, as after a restart,
+		// verifies the blob before reading it.
+		restarted, err := NewBlobCache(BlobCacheOptions{Dir: dir, Verify: true, QuarantineDir: quarantine})
+		require.NoError(t, err)
+		fetcher := blobCacheFetcher(t, restarted, layers, &requests)
+		assert.Equal(t, layer, readLayer(t, fetcher, desc))
+		assert.Equal(t, 2, requests, "corrupt layer should be downloaded again")
+		assert.FileExists(t, filepath.Join(quarantine, "blobs", "sha256", desc.Digest.Encoded()), "corrupt layer should be quarantined")
+		assert.Equal(t, layer, readLayer(t, fetcher, desc))
+		assert.Equal(t, 2, requests, "layer downloaded again should be cached")
+	})
+
+	t.Run("pass", func(t *testing.T) {
+		dir := t.TempDir()
+		cache, err := NewBlobCache(BlobCacheOptions{Dir: dir})
+		require.NoError(t, err)
+		requests := 0
+		fetcher := blobCacheFetcher(t, cache, layers, &requests)
+		assert.Equal(t, layer, readLayer(t, fetcher, desc))
+		corrupt, err := cache.Verify(context.Background())
+		require.NoError(t, err)
+		assert.Empty(t, corrupt)
+
+		corruptStoredBlob(t, dir, desc.Digest)
+		corrupt, err = cache.Verify(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []digest.Digest{desc.Digest}, corrupt)
+		assert.Equal(t, layer, readLayer(t, fetcher, desc))
+		assert.Equal(t, 2, requests, "corrupt layer should be downloaded again")
+	})
+
+	t.Run("run", func(t *testing.T) {
+		dir := t.TempDir()
+		cache, err := NewBlobCache(BlobCacheOptions{Dir: dir, VerifyInterval: 10 * time.Millisecond})
+		require.NoError(t, err)
+		requests := 0
+		assert.Equal(t, layer, readLayer(t, blobCacheFetcher(t, cache, layers, &requests), desc))
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- cache.Run(ctx) }()
+
+		corruptStoredBlob(t, dir, desc.Digest)
+		assert.Eventually(t, func() bool {
+			_, err := cache.store.Info(context.Background(), desc.Digest)
+			return errdefs.IsNotFound(err)
+		}, 5*time.Second, 10*time.Millisecond, "corrupt layer should be quarantined by a later pass")
+		cancel()
+		assert.Equal(t, context.Canceled, <-done)
+	})
+}
+
+func TestBlobCacheConcurrent(t *testing.T) {
+	const layer = "base layer"
+	desc := layerDescriptor(layer)
+	cache, err := NewBlobCache(BlobCacheOptions{Dir: t.TempDir()})
+	require.NoError(t, err)
+	requests := 0
+	fetcher := blobCacheFetcher(t, cache, map[digest.Digest]string{desc.Digest: layer}, &requests)
+
+	// Fetches of a layer being cached download it without caching it.
+	first, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	assert.Equal(t, layer, readLayer(t, fetcher, desc))
+	data, err := ioutil.ReadAll(first)
+	require.NoError(t, err)
+	first.Close()
+	assert.Equal(t, layer, string(data))
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, layer, readLayer(t, fetcher, desc))
+	assert.Equal(t, 2, requests, "layer should be cached by the first fetch")
+}
+
+func TestNewBlobCacheInvalid(t *testing.T) {
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	for _, options := range []BlobCacheOptions{
+		{},
+		{Dir: t.TempDir(), Content: store},
+		{Dir: t.TempDir(), MaxSize: -1},
+		{Dir: t.TempDir(), TTL: -time.Second},
+		{Dir: t.TempDir(), VerifyInterval: -time.Second},
+	} {
+		_, err := NewBlobCache(options)
+		assert.Error(t, err, "%+v", options)
+	}
+	_, err = NewResolver(WithBlobCache(nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+)
+
+// layerAvailabilityBatchSize is the maximum number of digests accepted by a
+// BatchCheckLayerAvailability request.
+const layerAvailabilityBatchSize = 100
+
+// BlobProber is implemented by resolvers able to report which blobs are
+// absent from a repository without transferring them.  The resolver returned
+// by NewResolver implements it.
+type BlobProber interface {
+	// MissingBlobs returns the digests, in the order given, of the blobs not
+	// available in the repository named by ref.
+	MissingBlobs(ctx context.Context, ref string, digests []digest.Digest) ([]digest.Digest, error)
+}
+
+var _ BlobProber = (*ecrResolver)(nil)
+
+// BlobSizer is implemented by resolvers able to report the sizes of blobs
+// without transferring them.  The resolver returned by NewResolver implements
+// it.
+type BlobSizer interface {
+	// BlobSizes returns the sizes of the blobs among digests which are
+	// available in the repository named by ref, keyed by digest.
+	BlobSizes(ctx context.Context, ref string, digests []digest.Digest) (map[digest.Digest]int64, error)
+}
+
+var _ BlobSizer = (*ecrResolver)(nil)
+
+// MissingBlobs checks the availability of blobs in the repository named by
+// ref, allowing copy and mirroring tools to plan transfers before moving any
+// data.  Availability is checked in batches of up to 100 digests per request.
+// Duplicate digests are reported once.
+func (r *ecrResolver) MissingBlobs(ctx context.Context, ref string, digests []digest.Digest) ([]digest.Digest, error) {
+	ecrSpec, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	sizes, err := layerSizes(ctx, r.getClient(ecrSpec.Region(), ecrSpec.Registry()), ecrSpec, digests)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[digest.Digest]bool{}
+	var missing []digest.Digest
+	for _, dgst := range digests {
+		if _, ok := sizes[dgst]; !ok && !seen[dgst] {
+			missing = append(missing, dgst)
+		}
+		seen[dgst] = true
+	}
+	log.G(ctx).
+		WithField("ref", ref).
+		WithField("checked", len(seen)).
+		WithField("missing", len(missing)).
+		Debug("ecr.resolver.blobs: checked blob availability")
+	return missing, nil
+}
+
+// BlobSizes returns the sizes recorded by ECR of the blobs available in the
+// repository named by ref, keyed by digest.  Blobs which are not available
+// are omitted.  Sizes are looked up in batches of up to 100 digests per
+// request.
+func (r *ecrResolver) BlobSizes(ctx context.Context, ref string, digests []digest.Digest) (map[digest.Digest]int64, error) {
+	ecrSpec, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	return layerSizes(ctx, r.getClient(ecrSpec.Region(), ecrSpec.Registry()), ecrSpec, digests)
+}
+
+// layerSizes returns the sizes of the layers of ecrSpec's repository among
+// digests which are available, keyed by digest.
+func layerSizes(ctx context.Context, client ecrAPI, ecrSpec ECRSpec, digests []digest.Digest) (map[digest.Digest]int64, error) {
+	seen := map[digest.Digest]bool{}
+	var unique []digest.Digest
+	for _, dgst := range digests {
+		if !seen[dgst] {
+			seen[dgst] = true
+			unique = append(unique, dgst)
+		}
+	}
+
+	sizes := map[digest.Digest]int64{}
+	for start := 0; start < len(unique); start += layerAvailabilityBatchSize {
+		end := start + layerAvailabilityBatchSize
+		if end > len(unique) {
+			end = len(unique)
+		}
+		batch := make([]*string, 0, end-start)
+		for _, dgst := range unique[start:end] {
+			batch = append(batch, aws.String(dgst.String()))
+		}
+		output, err := client.BatchCheckLayerAvailabilityWithContext(ctx, &ecr.BatchCheckLayerAvailabilityInput{
+			RegistryId:     aws.String(ecrSpec.Registry()),
+			RepositoryName: aws.String(ecrSpec.Repository),
+			LayerDigests:   batch,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, failure := range output.Failures {
+			if aws.StringValue(failure.FailureCode) == ecr.LayerFailureCodeInvalidLayerDigest {
+				return nil, fmt.Errorf("%s: %s: %w", aws.StringValue(failure.LayerDigest), aws.StringValue(failure.FailureReason), errdefs.ErrInvalidArgument)
+			}
+		}
+		for _, layer := range output.Layers {
+			if aws.StringValue(layer.LayerAvailability) == ecr.LayerAvailabilityAvailable {
+				sizes[digest.Digest(aws.StringValue(layer.LayerDigest))] = aws.Int64Value(layer.LayerSize)
+			}
+		}
+	}
+	return sizes, nil
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMissingBlobs(t *testing.T) {
+	var digests []digest.Digest
+	for i := 0; i < 150; i++ {
+		digests = append(digests, digest.FromString(fmt.Sprint(i)))
+	}
+	// Every third blob is missing, reported alternately as a failure and as
+	// unavailable.
+	var expected []digest.Digest
+	for i := 0; i < len(digests); i += 3 {
+		expected = append(expected, digests[i])
+	}
+
+	var batches []int
+	fakeClient := &fakeECRClient{
+		BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			assert.Equal(t, "123456789012", aws.StringValue(input.RegistryId))
+			assert.Equal(t, "foo/bar", aws.StringValue(input.RepositoryName))
+			batches = append(batches, len(input.LayerDigests))
+			output := &ecr.BatchCheckLayerAvailabilityOutput{}
+			for _, d := range input.LayerDigests {
+				var i int
+				for i = range digests {
+					if digests[i].String() == aws.StringValue(d) {
+						break
+					}
+				}
+				switch {
+				case i%6 == 0:
+					output.Failures = append(output.Failures, &ecr.LayerFailure{
+						LayerDigest: d,
+						FailureCode: aws.String(ecr.LayerFailureCodeMissingLayerDigest),
+					})
+				case i%3 == 0:
+					output.Layers = append(output.Layers, &ecr.Layer{
+						LayerDigest:       d,
+						LayerAvailability: aws.String(ecr.LayerAvailabilityUnavailable),
+					})
+				default:
+					output.Layers = append(output.Layers, &ecr.Layer{
+						LayerDigest:       d,
+						LayerAvailability: aws.String(ecr.LayerAvailabilityAvailable),
+					})
+				}
+			}
+			return output, nil
+		},
+	}
+	resolver := &ecrResolver{clients: map[string]ecrAPI{"fake": fakeClient}}
+
+	missing, err := resolver.MissingBlobs(context.Background(),
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest",
+		append(digests, digests[0], digests[1]))
+	require.NoError(t, err)
+	assert.Equal(t, expected, missing)
+	assert.Equal(t, []int{100, 50}, batches, "duplicates should not be checked")
+}
+
+func TestMissingBlobsInvalidDigest(t *testing.T) {
+	fakeClient := &fakeECRClient{
+		BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			return &ecr.BatchCheckLayerAvailabilityOutput{Failures: []*ecr.LayerFailure{{
+				LayerDigest: input.LayerDigests[0],
+				FailureCode: aws.String(ecr.LayerFailureCodeInvalidLayerDigest),
+			}}}, nil
+		},
+	}
+	resolver := &ecrResolver{clients: map[string]ecrAPI{"fake": fakeClient}}
+
+	_, err := resolver.MissingBlobs(context.Background(),
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest",
+		[]digest.Digest{digest.FromString("invalid")})
+	assert.True(t, errdefs.IsInvalidArgument(err))
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DescriptorCache stores the descriptors resolved for references by digest.
+// As the content named by a digest cannot change, cached descriptors remain
+// valid for as long as the image exists, allowing resolution results to be
+// shared between resolvers, processes, or nodes.  Implementations backed by
+// shared storage, such as Redis or a file system, may be used to reduce the
+// ECR API requests made by large fleets.
+//
+// Keys are canonical references including the repository's ARN and the
+// image's digest.  Implementations must be safe for concurrent use.
+type DescriptorCache interface {
+	// Get returns the descriptor stored for key, reporting whether one was
+	// found.
+	Get(ctx context.Context, key string) (ocispec.Descriptor, bool, error)
+	// Put stores the descriptor for key.
+	Put(ctx context.Context, key string, desc ocispec.Descriptor) error
+}
+
+type memoryDescriptorCache struct {
+	mu      sync.Mutex
+	size    int
+	clock   Clock
+	entries map[string]*list.Element
+	// recent orders entries from most to least recently used.
+	recent *list.List
+}
+
+type memoryDescriptorCacheEntry struct {
+	key  string
+	desc ocispec.Descriptor
+	// expires is the time after which the entry is no longer returned, or
+	// the zero time if it does not expire.
+	expires time.Time
+}
+
+// NewMemoryDescriptorCache returns a DescriptorCache holding up to size
+// descriptors in memory, evicting the least recently used descriptors first.
+func NewMemoryDescriptorCache(size int) DescriptorCache {
+	return newMemoryDescriptorCache(size, SystemClock)
+}
+
+func newMemoryDescriptorCache(size int, clock Clock) *memoryDescriptorCache {
+	return &memoryDescriptorCache{
+		size:    size,
+		clock:   clock,
+		entries: map[string]*list.Element{},
+		recent:  list.New(),
+	}
+}
+
+func (c *memoryDescriptorCache) Get(_ context.Context, key string) (ocispec.Descriptor, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return ocispec.Descriptor{}, false, nil
+	}
+	entry := element.Value.(*memoryDescriptorCacheEntry)
+	if !entry.expires.IsZero() && c.clock.Now().After(entry.expires) {
+		c.remove(element)
+		return ocispec.Descriptor{}, false, nil
+	}
+	c.recent.MoveToFront(element)
+	return entry.desc, true, nil
+}
+
+func (c *memoryDescriptorCache) Put(_ context.Context, key string, desc ocispec.Descriptor) error {
+	c.put(key, desc, time.Time{})
+	return nil
+}
+
+// put stores desc for key until expires, or indefinitely if expires is the
+// zero time.
+func (c *memoryDescriptorCache) put(key string, desc ocispec.Descriptor, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*memoryDescriptorCacheEntry)
+		entry.desc, entry.expires = desc, expires
+		c.recent.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.recent.PushFront(&memoryDescriptorCacheEntry{key: key, desc: desc, expires: expires})
+	for c.recent.Len() > c.size {
+		c.remove(c.recent.Back())
+	}
+}
+
+// invalidate removes the entry for key, if any.
+func (c *memoryDescriptorCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+// remove removes element, which must be called with mu held.
+func (c *memoryDescriptorCache) remove(element *list.Element) {
+	c.recent.Remove(element)
+	delete(c.entries, element.Value.(*memoryDescriptorCacheEntry).key)
+}
+
+// ResolveCache stores the descriptors resolved for references by tag.  Tags
+// may be moved to other images at any time, so each descriptor is only
+// returned until its TTL passes, and the resolver invalidates the descriptors
+// of tags it pushes or moves.  Caches which persist descriptors, such as
+// NewFileResolveCache, allow node agents to keep resolving tags without ECR
+// requests across restarts.
+//
+// Keys are canonical references including the repository's ARN and the
+// image's tag.  Implementations must be safe for concurrent use.
+type ResolveCache interface {
+	// Get returns the descriptor stored for key, reporting whether one was
+	// found whose TTL has not passed.
+	Get(ctx context.Context, key string) (ocispec.Descriptor, bool, error)
+	// Set stores the descriptor for key for ttl.
+	Set(ctx context.Context, key string, desc ocispec.Descriptor, ttl time.Duration) error
+	// Invalidate removes the descriptor stored for key, if any.
+	Invalidate(ctx context.Context, key string) error
+}
+
+type memoryResolveCache struct {
+	cache *memoryDescriptorCache
+}
+
+// NewMemoryResolveCache returns a ResolveCache holding up to size
+// descriptors in memory, evicting the least recently used descriptors first.
+func NewMemoryResolveCache(size int) ResolveCache {
+	return NewMemoryResolveCacheWithClock(size, SystemClock)
+}
+
+// NewMemoryResolveCacheWithClock returns a ResolveCache like
+// NewMemoryResolveCache whose descriptors expire according to clock.
+func NewMemoryResolveCacheWithClock(size int, clock Clock) ResolveCache {
+	return &memoryResolveCache{cache: newMemoryDescriptorCache(size, clock)}
+}
+
+func (c *memoryResolveCache) Get(ctx context.Context, key string) (ocispec.Descriptor, bool, error) {
+	return c.cache.Get(ctx, key)
+}
+
+func (c *memoryResolveCache) Set(_ context.Context, key string, desc ocispec.Descriptor, ttl time.Duration) error {
+	c.cache.put(key, desc, c.cache.clock.Now().Add(ttl))
+	return nil
+}
+
+func (c *memoryResolveCache) Invalidate(_ context.Context, key string) error {
+	c.cache.invalidate(key)
+	return nil
+}
+
+// fileResolveCache stores each descriptor as a JSON file in dir.
+type fileResolveCache struct {
+	dir   string
+	clock Clock
+}
+
+// fileResolveCacheEntry is the content of a file of a fileResolveCache.
+type fileResolveCacheEntry struct {
+	Key        string             `json:"key"`
+	Descriptor ocispec.Descriptor `json:"descriptor"`
+	Expires    time.Time          `json:"expires"`
+}
+
+// NewFileResolveCache returns a ResolveCache storing each descriptor in a
+// file of dir, which is created if it does not exist.  Files are replaced
+// atomically, so the cache may be shared by processes on the same node.
+// Files whose TTL has passed are removed when they are next read.
+func NewFileResolveCache(dir string) (ResolveCache, error) {
+	return NewFileResolveCacheWithClock(dir, SystemClock)
+}
+
+// NewFileResolveCacheWithClock returns a ResolveCache like
+// NewFileResolveCache whose descriptors expire according to clock, or to
+// SystemClock if clock is nil.
+func NewFileResolveCacheWithClock(dir string, clock Clock) (ResolveCache, error) {
+	if clock == nil {
+		clock = SystemClock
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileResolveCache{dir: dir, clock: clock}, nil
+}
+
+func (c *fileResolveCache) Get(_ context.Context, key string) (ocispec.Descriptor, bool, error) {
+	path := c.path(key)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ocispec.Descriptor{}, false, nil
+	}
+	if err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+	var entry fileResolveCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return ocispec.Descriptor{}, false, err
+	}
+	if entry.Key != key {
+		return ocispec.Descriptor{}, false, nil
+	}
+	if c.clock.Now().After(entry.Expires) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return ocispec.Descriptor{}, false, err
+		}
+		return ocispec.Descriptor{}, false, nil
+	}
+	return entry.Descriptor, true, nil
+}
+
+func (c *fileResolveCache) Set(_ context.Context, key string, desc ocispec.Descriptor, ttl time.Duration) error {
+	data, err := json.Marshal(fileResolveCacheEntry{Key: key, Descriptor: desc, Expires: c.clock.Now().Add(ttl)})
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), c.path(key))
+}
+
+func (c *fileResolveCache) Invalidate(_ context.Context, key string) error {
+	if err := os.Remove(c.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// path returns the path of the file storing the descriptor for key.  Keys
+// are hashed as they contain characters which may not be used in file
+// names.
+func (c *fileResolveCache) path(key string) string {
+	return filepath.Join(c.dir, digest.FromString(key).Encoded()+".json")
+}
@@ -0,0 +1,352 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+)
+
+func TestMemoryDescriptorCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	cache := NewMemoryDescriptorCache(2)
+	for _, key := range []string{"a", "b"} {
+		require.NoError(t, cache.Put(ctx, key, ocispec.Descriptor{MediaType: key}))
+	}
+	// Reading a makes b the least recently used.
+	_, ok, err := cache.Get(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	require.NoError(t, cache.Put(ctx, "c", ocispec.Descriptor{MediaType: "c"}))
+
+	_, ok, _ = cache.Get(ctx, "b")
+	assert.False(t, ok, "least recently used descriptor should be evicted")
+	for _, key := range []string{"a", "c"} {
+		desc, ok, _ := cache.Get(ctx, key)
+		assert.True(t, ok)
+		assert.Equal(t, key, desc.MediaType)
+	}
+}
+
+// countingBatchGetImage returns a fake BatchGetImage counting its calls.
+func countingBatchGetImage(calls *int) func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+	return func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+		*calls++
+		return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+			ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(testdata.ImageDigest.String())},
+			ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+			ImageManifest:          aws.String(`{"schemaVersion": 2}`),
+		}}}, nil
+	}
+}
+
+func TestResolveDescriptorCache(t *testing.T) {
+	calls := 0
+	cache := NewMemoryDescriptorCache(10)
+	resolver := &ecrResolver{
+		clients:         map[string]ecrAPI{"fake": &fakeECRClient{BatchGetImageFn: countingBatchGetImage(&calls)}},
+		descriptorCache: cache,
+	}
+	byDigest := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar@" + testdata.ImageDigest.String()
+	byTag := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	for i := 0; i < 2; i++ {
+		name, desc, err := resolver.Resolve(context.Background(), byDigest)
+		require.NoError(t, err)
+		assert.Equal(t, byDigest, name)
+		assert.Equal(t, testdata.ImageDigest, desc.Digest)
+		assert.Equal(t, ocispec.MediaTypeImageManifest, desc.MediaType)
+	}
+	assert.Equal(t, 1, calls, "reference by digest should be resolved from the cache")
+
+	for i := 0; i < 2; i++ {
+		_, _, err := resolver.Resolve(context.Background(), byTag)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 3, calls, "references by tag should not be cached")
+}
+
+type failingDescriptorCache struct{}
+
+func (failingDescriptorCache) Get(context.Context, string) (ocispec.Descriptor, bool, error) {
+	return ocispec.Descriptor{}, false, errors.New("unavailable")
+}
+
+func (failingDescriptorCache) Put(context.Context, string, ocispec.Descriptor) error {
+	return errors.New("unavailable")
+}
+
+func TestResolveDescriptorCacheError(t *testing.T) {
+	calls := 0
+	resolver := &ecrResolver{
+		clients:         map[string]ecrAPI{"fake": &fakeECRClient{BatchGetImageFn: countingBatchGetImage(&calls)}},
+		descriptorCache: failingDescriptorCache{},
+	}
+	_, desc, err := resolver.Resolve(context.Background(),
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar@"+testdata.ImageDigest.String())
+	require.NoError(t, err, "cache errors should not prevent resolution")
+	assert.Equal(t, testdata.ImageDigest, desc.Digest)
+	assert.Equal(t, 1, calls)
+}
+
+func TestMemoryResolveCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	cache := NewMemoryResolveCache(10)
+	require.NoError(t, cache.Set(ctx, "short", ocispec.Descriptor{MediaType: "short"}, time.Millisecond))
+	require.NoError(t, cache.Set(ctx, "long", ocispec.Descriptor{MediaType: "long"}, time.Hour))
+	require.NoError(t, cache.Set(ctx, "invalidated", ocispec.Descriptor{MediaType: "invalidated"}, time.Hour))
+	require.NoError(t, cache.Invalidate(ctx, "invalidated"))
+	time.Sleep(5 * time.Millisecond)
+
+	_, ok, err := cache.Get(ctx, "short")
+	require.NoError(t, err)
+	assert.False(t, ok, "descriptor should expire after its TTL")
+	_, ok, _ = cache.Get(ctx, "invalidated")
+	assert.False(t, ok, "invalidated descriptor should not be returned")
+	desc, ok, _ := cache.Get(ctx, "long")
+	assert.True(t, ok)
+	assert.Equal(t, "long", desc.MediaType)
+}
+
+func TestFileResolveCache(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	clock := &fakeClock{now: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	cache, err := NewFileResolveCacheWithClock(dir, clock)
+	require.NoError(t, err)
+	key := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	require.NoError(t, cache.Set(ctx, key, ocispec.Descriptor{Digest: testdata.ImageDigest}, time.Hour))
+	require.NoError(t, cache.Set(ctx, "short", ocispec.Descriptor{}, time.Millisecond))
+
+	// A cache opened on the same directory, as after a restart, shares the
+	// descriptors.
+	reopened, err := NewFileResolveCacheWithClock(dir, clock)
+	require.NoError(t, err)
+	desc, ok, err := reopened.Get(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, testdata.ImageDigest, desc.Digest)
+
+	clock.advance(time.Millisecond)
+	_, ok, err = reopened.Get(ctx, "short")
+	require.NoError(t, err)
+	assert.True(t, ok, "descriptor should not expire before its TTL has passed")
+	clock.advance(time.Nanosecond)
+	_, ok, err = reopened.Get(ctx, "short")
+	require.NoError(t, err)
+	assert.False(t, ok, "descriptor should expire after its TTL")
+
+	require.NoError(t, reopened.Invalidate(ctx, key))
+	require.NoError(t, reopened.Invalidate(ctx, key), "invalidating a missing key should succeed")
+	_, ok, _ = cache.Get(ctx, key)
+	assert.False(t, ok, "invalidated descriptor should not be returned")
+}
+
+func TestResolveResolveCache(t *testing.T) {
+	calls := 0
+	client := &fakeECRClient{
+		BatchGetImageFn: countingBatchGetImage(&calls),
+		PutImageFn: func(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error) {
+			return &ecr.PutImageOutput{}, nil
+		},
+	}
+	resolver, err := NewResolver(WithResolveCache(NewMemoryResolveCache(10), time.Hour))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	byTag := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	for i := 0; i < 2; i++ {
+		name, desc, err := resolver.Resolve(context.Background(), byTag)
+		require.NoError(t, err)
+		assert.Equal(t, byTag, name)
+		assert.Equal(t, testdata.ImageDigest, desc.Digest)
+	}
+	assert.Equal(t, 1, calls, "reference by tag should be resolved from the cache")
+
+	_, err = resolver.(TagMover).MoveTag(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar", "latest", testdata.ImageDigest)
+	require.NoError(t, err)
+	calls = 0
+	_, _, err = resolver.Resolve(context.Background(), byTag)
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls, "moved tag should be resolved with ECR")
+
+	_, err = NewResolver(WithResolveCache(NewMemoryResolveCache(10), 0))
+	assert.Error(t, err, "TTL should be positive")
+}
+
+func TestResolveResolveCacheStaleness(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		calls   int
+		current = digest.FromString("first")
+	)
+	client := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			if current == "" {
+				return &ecr.BatchGetImageOutput{Failures: []*ecr.ImageFailure{{
+					FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound),
+				}}}, nil
+			}
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(current.String())},
+				ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+				ImageManifest:          aws.String(`{"schemaVersion": 2}`),
+			}}}, nil
+		},
+	}
+	getCalls := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+	cache := NewMemoryResolveCache(10)
+	resolver, err := NewResolver(
+		WithResolveCache(cache, 10*time.Millisecond),
+		WithResolveCacheStaleness(time.Hour))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	byTag := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	_, desc, err := resolver.Resolve(context.Background(), byTag)
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromString("first"), desc.Digest)
+	_, _, err = resolver.Resolve(context.Background(), byTag)
+	require.NoError(t, err)
+	assert.Equal(t, 1, getCalls(), "fresh tag should be resolved from the cache")
+
+	// The tag is moved by another client.
+	mu.Lock()
+	current = digest.FromString("second")
+	mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	_, desc, err = resolver.Resolve(context.Background(), byTag)
+	require.NoError(t, err)
+	assert.Equal(t, digest.FromString("first"), desc.Digest, "stale tag should be served from the cache")
+	require.Eventually(t, func() bool {
+		_, desc, err := resolver.Resolve(context.Background(), byTag)
+		return err == nil && desc.Digest == digest.FromString("second")
+	}, time.Second, time.Millisecond, "stale tag should be refreshed in the background")
+	assert.Equal(t, 2, getCalls(), "refreshed tag should be fresh again")
+
+	_, ok, _ := cache.Get(context.Background(), byTag)
+	require.True(t, ok, "tag should be cached by its canonical reference")
+
+	// The tag is deleted by another client.
+	mu.Lock()
+	current = ""
+	mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	_, _, err = resolver.Resolve(context.Background(), byTag)
+	require.NoError(t, err, "stale tag should be served before the refresh")
+	require.Eventually(t, func() bool {
+		_, ok, _ := cache.Get(context.Background(), byTag)
+		return !ok
+	}, time.Second, time.Millisecond, "deleted tag should be removed from the cache")
+
+	_, err = NewResolver(WithResolveCacheStaleness(time.Hour))
+	assert.Error(t, err, "staleness should require a resolve cache")
+	_, err = NewResolver(WithResolveCache(cache, time.Hour), WithResolveCacheStaleness(0))
+	assert.Error(t, err, "staleness should be positive")
+}
+
+func TestResolveNotFoundCache(t *testing.T) {
+	calls := 0
+	moved := false
+	client := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			if aws.StringValue(input.ImageIds[0].ImageTag) == "latest" {
+				calls++
+				if !moved {
+					return &ecr.BatchGetImageOutput{Failures: []*ecr.ImageFailure{{
+						FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound),
+					}}}, nil
+				}
+			}
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(testdata.ImageDigest.String())},
+				ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+				ImageManifest:          aws.String(`{"schemaVersion": 2}`),
+			}}}, nil
+		},
+		PutImageFn: func(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error) {
+			moved = true
+			return &ecr.PutImageOutput{}, nil
+		},
+	}
+	resolver, err := NewResolver(WithNotFoundCache(10 * time.Millisecond))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	byTag := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	for i := 0; i < 3; i++ {
+		_, _, err := resolver.Resolve(context.Background(), byTag)
+		assert.True(t, errdefs.IsNotFound(err), "unexpected error %v", err)
+	}
+	assert.Equal(t, 1, calls, "missing tag should be reported from the cache")
+
+	time.Sleep(20 * time.Millisecond)
+	_, _, err = resolver.Resolve(context.Background(), byTag)
+	assert.True(t, errdefs.IsNotFound(err))
+	assert.Equal(t, 2, calls, "missing tag should be resolved with ECR once the TTL passes")
+
+	// The tag is created by moving it with the resolver.
+	_, err = resolver.(TagMover).MoveTag(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar", "latest", testdata.ImageDigest)
+	require.NoError(t, err)
+	_, desc, err := resolver.Resolve(context.Background(), byTag)
+	require.NoError(t, err, "moved tag should be visible immediately")
+	assert.Equal(t, testdata.ImageDigest, desc.Digest)
+
+	_, err = NewResolver(WithNotFoundCache(0))
+	assert.Error(t, err, "TTL should be positive")
+}
+
+func TestResolveNotFoundCacheMissingRepository(t *testing.T) {
+	describeCount := 0
+	client := &fakeECRClient{
+		DescribeRepositoriesFn: func(aws.Context, *ecr.DescribeRepositoriesInput, ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+			describeCount++
+			return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "not found", nil)
+		},
+	}
+	resolver, err := NewResolver(WithNotFoundCache(time.Minute), WithRepositoryCheck())
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	for i := 0; i < 2; i++ {
+		_, _, err := resolver.Resolve(context.Background(), ref)
+		assert.True(t, errors.Is(err, ErrRepositoryNotFound), "unexpected error %v", err)
+	}
+	assert.Equal(t, 2, describeCount, "missing repositories should not be remembered")
+}
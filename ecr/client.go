@@ -0,0 +1,65 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/containerd/containerd/errdefs"
+)
+
+// ClientProvider is implemented by resolvers able to share the ECR clients
+// they use.  The resolver returned by NewResolver implements it.
+type ClientProvider interface {
+	// ClientForRegion returns the ECR client used for the region.
+	ClientForRegion(region string) (ecriface.ECRAPI, error)
+	// ClientForRef returns the ECR client used for the repository named by
+	// ref, which is configured for its registry when the resolver is
+	// configured with WithRegistryConfig.
+	ClientForRef(ref string) (ecriface.ECRAPI, error)
+}
+
+var _ ClientProvider = (*ecrResolver)(nil)
+
+// ClientForRegion returns the resolver's ECR client for the region, creating
+// it if needed, so that callers can make API calls not covered by the
+// resolver, such as DescribeImages, with the resolver's session, HTTP client,
+// and request handlers.
+func (r *ecrResolver) ClientForRegion(region string) (ecriface.ECRAPI, error) {
+	if region == "" {
+		return nil, fmt.Errorf("region must not be empty: %w", errdefs.ErrInvalidArgument)
+	}
+	return r.clientFor(region, "")
+}
+
+// ClientForRef returns the resolver's ECR client for the region of the
+// repository named by ref.
+func (r *ecrResolver) ClientForRef(ref string) (ecriface.ECRAPI, error) {
+	ecrSpec, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	return r.clientFor(ecrSpec.Region(), ecrSpec.Registry())
+}
+
+func (r *ecrResolver) clientFor(region, registryID string) (ecriface.ECRAPI, error) {
+	client, ok := r.getClient(region, registryID).(ecriface.ECRAPI)
+	if !ok {
+		return nil, fmt.Errorf("ecr client for %s: %w", region, errdefs.ErrNotImplemented)
+	}
+	return client, nil
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientForRef(t *testing.T) {
+	resolver, err := NewResolver(WithSession(unit.Session))
+	require.NoError(t, err)
+	provider := resolver.(ClientProvider)
+
+	client, err := provider.ClientForRef("ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	sdkClient, ok := client.(*ecr.ECR)
+	require.True(t, ok, "expected *ecr.ECR, got %T", client)
+	assert.Equal(t, "us-west-2", aws.StringValue(sdkClient.Config.Region))
+
+	regionClient, err := provider.ClientForRegion("us-west-2")
+	require.NoError(t, err)
+	assert.Same(t, sdkClient, regionClient, "should share the resolver's client")
+}
+
+func TestClientForRefInvalid(t *testing.T) {
+	resolver, err := NewResolver(WithSession(unit.Session))
+	require.NoError(t, err)
+	provider := resolver.(ClientProvider)
+
+	_, err = provider.ClientForRef("docker.io/library/alpine:latest")
+	assert.Error(t, err)
+	_, err = provider.ClientForRegion("")
+	assert.True(t, errdefs.IsInvalidArgument(err))
+}
+
+func TestClientForRegionFake(t *testing.T) {
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{"fake": &fakeECRClient{}},
+	}
+	_, err := resolver.ClientForRegion("fake")
+	assert.True(t, errdefs.IsNotImplemented(err))
+}
+
+func TestClientForRefWithRegistryConfig(t *testing.T) {
+	crossAccount := credentials.NewStaticCredentials("id", "secret", "")
+	var configured []string
+	resolver, err := NewResolver(
+		WithSession(unit.Session),
+		WithRegistryConfig(func(registryID, region string) *aws.Config {
+			configured = append(configured, registryID+"/"+region)
+			if registryID == "210987654321" {
+				return &aws.Config{Credentials: crossAccount}
+			}
+			return nil
+		}))
+	require.NoError(t, err)
+	provider := resolver.(ClientProvider)
+
+	client, err := provider.ClientForRef("ecr.aws/arn:aws:ecr:us-west-2:210987654321:repository/foo/bar:latest")
+	require.NoError(t, err)
+	assert.Same(t, crossAccount, client.(*ecr.ECR).Config.Credentials)
+	again, err := provider.ClientForRef("ecr.aws/arn:aws:ecr:us-west-2:210987654321:repository/baz:latest")
+	require.NoError(t, err)
+	assert.Same(t, client, again, "should reuse the registry's client")
+
+	ownClient, err := provider.ClientForRef("ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	assert.Same(t, unit.Session.Config.Credentials, ownClient.(*ecr.ECR).Config.Credentials)
+	regionClient, err := provider.ClientForRegion("us-west-2")
+	require.NoError(t, err)
+	assert.NotSame(t, client, regionClient)
+	assert.Same(t, unit.Session.Config.Credentials, regionClient.(*ecr.ECR).Config.Credentials)
+
+	assert.Equal(t, []string{"210987654321/us-west-2", "123456789012/us-west-2"}, configured)
+}
+
+func TestWithRegistryConfig(t *testing.T) {
+	_, err := NewResolver(WithSession(unit.Session), WithRegistryConfig(nil))
+	assert.Error(t, err)
+}
+
+func TestClientForRefRepositoryPolicy(t *testing.T) {
+	resolver, err := NewResolver(
+		WithSession(unit.Session),
+		WithRegistryConfig(func(registryID, region string) *aws.Config {
+			return nil
+		}))
+	require.NoError(t, err)
+	provider := resolver.(ClientProvider)
+
+	// Registries reached with the session's identity, as granted by their
+	// repository policies, share the clients of the region.
+	regionClient, err := provider.ClientForRegion("us-west-2")
+	require.NoError(t, err)
+	for _, ref := range []string{
+		"ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest",
+		"ecr.aws/arn:aws:ecr:us-west-2:210987654321:repository/foo/bar:latest",
+	} {
+		client, err := provider.ClientForRef(ref)
+		require.NoError(t, err)
+		assert.Same(t, regionClient, client, ref)
+	}
+}
+
+func TestCrossAccountRegistryID(t *testing.T) {
+	const registry = "210987654321"
+	layer := `{"architecture":"amd64","os":"linux"}`
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`
+	var registryIDs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, layer)
+	}))
+	defer ts.Close()
+	client := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			registryIDs = append(registryIDs, aws.StringValue(input.RegistryId))
+			return &ecr.BatchGetImageOutput{
+				Images: []*ecr.Image{{
+					ImageId: &ecr.ImageIdentifier{
+						ImageDigest: aws.String(digest.FromString(manifest).String()),
+					},
+					ImageManifest:          aws.String(manifest),
+					ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+				}},
+			}, nil
+		},
+		GetDownloadUrlForLayerFn: func(_ aws.Context, input *ecr.GetDownloadUrlForLayerInput, _ ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			registryIDs = append(registryIDs, aws.StringValue(input.RegistryId))
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+		},
+		BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			registryIDs = append(registryIDs, aws.StringValue(input.RegistryId))
+			return &ecr.BatchCheckLayerAvailabilityOutput{
+				Layers: []*ecr.Layer{{LayerAvailability: aws.String(ecr.LayerAvailabilityAvailable)}},
+			}, nil
+		},
+	}
+	resolver, err := NewResolver()
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+
+	// The repository is in another account whose repository policy grants
+	// the session's identity access, so the region's client is used and
+	// each call names the repository's registry.
+	ref := "ecr.aws/arn:aws:ecr:fake:" + registry + ":repository/foo/bar:latest"
+	ctx := context.Background()
+	_, desc, err := resolver.Resolve(ctx, ref)
+	require.NoError(t, err)
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(ctx, desc)
+	require.NoError(t, err)
+	rc.Close()
+	layerDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.FromString(layer),
+		Size:      int64(len(layer)),
+	}
+	rc, err = fetcher.Fetch(ctx, layerDesc)
+	require.NoError(t, err)
+	rc.Close()
+	pusher, err := resolver.Pusher(ctx, ref+"@"+desc.Digest.String())
+	require.NoError(t, err)
+	_, err = pusher.Push(ctx, layerDesc)
+	assert.True(t, errdefs.IsAlreadyExists(err), "expected already exists, got %v", err)
+
+	require.Len(t, registryIDs, 4, "resolve, manifest, layer, and push calls")
+	for _, registryID := range registryIDs {
+		assert.Equal(t, registry, registryID)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import "time"
+
+// Clock provides the time to the resolver's retry and cache logic.  Tests of
+// integrations may configure a Clock they advance themselves, with
+// WithClock, to control when cached results expire and when retries are
+// made.  Implementations must be safe for concurrent use.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After returns a channel receiving the current time once d has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock reading the system time, used if no other Clock is
+// configured.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Backoff returns the delay before the retry attempt of an operation, where
+// the first retry is attempt 1.
+type Backoff func(attempt int) time.Duration
+
+// ExponentialBackoff returns a Backoff delaying the first retry by base and
+// doubling the delay with each further retry.
+func ExponentialBackoff(base time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		return base << (attempt - 1)
+	}
+}
+
+// defaultBackoff delays the retries of layer downloads if no other Backoff is
+// configured.
+var defaultBackoff = ExponentialBackoff(layerFetchBackoff)
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a Clock advanced only by its tests.  Waits complete
+// immediately and are recorded.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waits = append(c.waits, d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now.Add(d)
+	return ch
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(time.Second)
+	assert.Equal(t, time.Second, backoff(1))
+	assert.Equal(t, 2*time.Second, backoff(2))
+	assert.Equal(t, 4*time.Second, backoff(3))
+}
+
+func TestWithClock(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	calls := 0
+	client := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			calls++
+			return &ecr.BatchGetImageOutput{Failures: []*ecr.ImageFailure{{
+				FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound),
+			}}}, nil
+		},
+	}
+	resolver, err := NewResolver(WithClock(clock), WithNotFoundCache(time.Minute))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	for i := 0; i < 2; i++ {
+		_, _, err := resolver.Resolve(context.Background(), ref)
+		assert.True(t, errdefs.IsNotFound(err), "unexpected error %v", err)
+	}
+	assert.Equal(t, 1, calls, "missing tag should be reported from the cache")
+	clock.advance(time.Minute + time.Second)
+	_, _, err = resolver.Resolve(context.Background(), ref)
+	assert.True(t, errdefs.IsNotFound(err), "unexpected error %v", err)
+	assert.Equal(t, 2, calls, "missing tag should be resolved once the clock passes the TTL")
+
+	cache := NewMemoryResolveCacheWithClock(10, clock)
+	require.NoError(t, cache.Set(context.Background(), "key", ocispec.Descriptor{Digest: digest.FromString("manifest")}, time.Hour))
+	_, ok, _ := cache.Get(context.Background(), "key")
+	assert.True(t, ok)
+	clock.advance(time.Hour + time.Second)
+	_, ok, _ = cache.Get(context.Background(), "key")
+	assert.False(t, ok, "descriptor should expire once the clock passes its TTL")
+
+	_, err = NewResolver(WithClock(nil))
+	assert.Error(t, err, "clock should not be nil")
+}
+
+func TestWithBackoff(t *testing.T) {
+	const layerData = "layer"
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < layerFetchAttempts {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, layerData)
+	}))
+	defer server.Close()
+	client := &fakeECRClient{
+		GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(server.URL)}, nil
+		},
+	}
+	clock := &fakeClock{}
+	var retried []int
+	resolver, err := NewResolver(WithClock(clock), WithBackoff(func(attempt int) time.Duration {
+		retried = append(retried, attempt)
+		return time.Duration(attempt) * time.Hour
+	}))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString(layerData),
+		Size:      int64(len(layerData)),
+	})
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	rc.Close()
+	assert.Equal(t, layerData, string(data))
+	assert.Equal(t, []int{1, 2}, retried)
+	assert.Equal(t, []time.Duration{time.Hour, 2 * time.Hour}, clock.waits, "retries should wait on the clock")
+
+	_, err = NewResolver(WithBackoff(nil))
+	assert.Error(t, err, "backoff should not be nil")
+}
@@ -0,0 +1,257 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrCorruptBlob is returned by ContentVerifier for a blob which no longer
+// matches its digest.  The blob has been taken out of the content store, so
+// it wraps errdefs.ErrNotFound.
+var ErrCorruptBlob = fmt.Errorf("ecr: cached blob does not match its digest: %w", errdefs.ErrNotFound)
+
+// defaultVerifyInterval is the time between the passes of a ContentVerifier
+// if no other interval is configured.
+const defaultVerifyInterval = time.Hour
+
+// ContentVerifierOptions configures the ContentVerifier returned by
+// NewContentVerifier.
+type ContentVerifierOptions struct {
+	// QuarantineDir is the directory corrupt blobs are moved to, under
+	// blobs/<algorithm>/<encoded digest> as in a content store, so that they
+	// can be inspected.  It is created if it does not exist.  If not
+	// specified, corrupt blobs are deleted.
+	QuarantineDir string
+	// Interval is the time between the passes of Run.  If not specified,
+	// blobs are verified every hour.
+	Interval time.Duration
+}
+
+// ContentVerifier re-hashes the blobs of a local blob cache, such as the
+// content store pulls are unpacked from, so that blobs corrupted on disk
+// cannot silently poison later pulls.  Blobs which no longer match their
+// digests are quarantined: they are moved out of the store, and are
+// downloaded again by the next pull needing them.  A ContentVerifier is safe
+// for concurrent use.
+type ContentVerifier struct {
+	store   content.Store
+	options ContentVerifierOptions
+
+	lock sync.Mutex
+	// verified holds the blobs verified since the verifier was created.
+	verified map[digest.Digest]bool
+}
+
+// NewContentVerifier returns a ContentVerifier of the blobs in store.
+func NewContentVerifier(store content.Store, options ContentVerifierOptions) (*ContentVerifier, error) {
+	if store == nil {
+		return nil, errors.New("content verifier requires a content store")
+	}
+	if options.Interval < 0 {
+		return nil, errors.New("content verification interval must not be negative")
+	}
+	if options.Interval == 0 {
+		options.Interval = defaultVerifyInterval
+	}
+	if options.QuarantineDir != "" {
+		if err := os.MkdirAll(options.QuarantineDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &ContentVerifier{
+		store:    store,
+		options:  options,
+		verified: map[digest.Digest]bool{},
+	}, nil
+}
+
+// Verify re-hashes the blob dgst, returning an error wrapping ErrCorruptBlob
+// if it has been quarantined.
+func (v *ContentVerifier) Verify(ctx context.Context, dgst digest.Digest) error {
+	info, err := v.store.Info(ctx, dgst)
+	if err != nil {
+		return err
+	}
+	ok, err := v.matches(ctx, info)
+	if err != nil {
+		return err
+	}
+	v.lock.Lock()
+	v.verified[dgst] = ok
+	v.lock.Unlock()
+	if ok {
+		return nil
+	}
+
+	log.G(ctx).
+		WithField("digest", dgst).
+		WithField("quarantine", v.options.QuarantineDir).
+		Warn("ecr.content.verify: quarantining corrupt blob")
+	if err := v.quarantine(ctx, info); err != nil {
+		return fmt.Errorf("failed to quarantine %s: %w", dgst, err)
+	}
+	return fmt.Errorf("%s: %w", dgst, ErrCorruptBlob)
+}
+
+// VerifyOnce verifies the blob dgst the first time it is called for the blob,
+// such as on the blob's first use after a restart.  Blobs already verified by
+// v are not hashed again.
+func (v *ContentVerifier) VerifyOnce(ctx context.Context, dgst digest.Digest) error {
+	v.lock.Lock()
+	verified := v.verified[dgst]
+	v.lock.Unlock()
+	if verified {
+		return nil
+	}
+	return v.Verify(ctx, dgst)
+}
+
+// trust records that the blob dgst was verified as it was stored.
+func (v *ContentVerifier) trust(dgst digest.Digest) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.verified[dgst] = true
+}
+
+// forget discards the verification of the blob dgst, which has been removed.
+func (v *ContentVerifier) forget(dgst digest.Digest) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	delete(v.verified, dgst)
+}
+
+// VerifyAll verifies every blob in the store, returning the digests of the
+// blobs quarantined.
+func (v *ContentVerifier) VerifyAll(ctx context.Context) ([]digest.Digest, error) {
+	var digests []digest.Digest
+	if err := v.store.Walk(ctx, func(info content.Info) error {
+		digests = append(digests, info.Digest)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	var corrupt []digest.Digest
+	for _, dgst := range digests {
+		err := v.Verify(ctx, dgst)
+		switch {
+		case errors.Is(err, ErrCorruptBlob):
+			corrupt = append(corrupt, dgst)
+		case errdefs.IsNotFound(err):
+			// The blob was removed since the store was listed.
+		case err != nil:
+			return corrupt, err
+		}
+	}
+	return corrupt, nil
+}
+
+// Run verifies every blob in the store each interval until ctx is done, and
+// returns the context's error.  Failures are logged and retried on the next
+// pass.
+func (v *ContentVerifier) Run(ctx context.Context) error {
+	for {
+		corrupt, err := v.VerifyAll(ctx)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("ecr.content.verify: pass failed")
+		} else if len(corrupt) > 0 {
+			log.G(ctx).WithField("corrupt", len(corrupt)).Warn("ecr.content.verify: quarantined corrupt blobs")
+		}
+		timer := time.NewTimer(v.options.Interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// matches reports whether the content of the blob info still matches its
+// digest.
+func (v *ContentVerifier) matches(ctx context.Context, info content.Info) (bool, error) {
+	if err := info.Digest.Validate(); err != nil {
+		return false, err
+	}
+	ra, err := v.store.ReaderAt(ctx, ocispec.Descriptor{Digest: info.Digest, Size: info.Size})
+	if err != nil {
+		return false, err
+	}
+	defer ra.Close()
+	verifier := info.Digest.Verifier()
+	if _, err := io.Copy(verifier, io.NewSectionReader(ra, 0, ra.Size())); err != nil {
+		return false, err
+	}
+	return verifier.Verified(), nil
+}
+
+// quarantine moves the blob info out of the store, keeping a copy in the
+// quarantine directory if there is one.
+func (v *ContentVerifier) quarantine(ctx context.Context, info content.Info) error {
+	if v.options.QuarantineDir != "" {
+		if err := v.copyToQuarantine(ctx, info); err != nil {
+			return err
+		}
+	}
+	if err := v.store.Delete(ctx, info.Digest); err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (v *ContentVerifier) copyToQuarantine(ctx context.Context, info content.Info) error {
+	dir := filepath.Join(v.options.QuarantineDir, "blobs", info.Digest.Algorithm().String())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	ra, err := v.store.ReaderAt(ctx, ocispec.Descriptor{Digest: info.Digest, Size: info.Size})
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	f, err := ioutil.TempFile(dir, ".quarantine-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, io.NewSectionReader(ra, 0, ra.Size()))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, info.Digest.Encoded()))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeBlob stores data in store, returning its descriptor.
+func writeBlob(t *testing.T, store content.Store, data string) ocispec.Descriptor {
+	desc := ocispec.Descriptor{Digest: digest.FromString(data), Size: int64(len(data))}
+	require.NoError(t, content.WriteBlob(context.Background(), store, desc.Digest.String(), strings.NewReader(data), desc))
+	return desc
+}
+
+// corruptStoredBlob flips the bytes of the blob dgst in the local content
+// store at dir.
+func corruptStoredBlob(t *testing.T, dir string, dgst digest.Digest) {
+	path := filepath.Join(dir, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+	require.NoError(t, os.Chmod(path, 0644))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	for i := range data {
+		data[i] ^= 0xff
+	}
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+}
+
+func TestContentVerifier(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	quarantine := filepath.Join(t.TempDir(), "quarantine")
+	store, err := local.NewStore(dir)
+	require.NoError(t, err)
+	good := writeBlob(t, store, "good")
+	bad := writeBlob(t, store, "bad")
+	corruptStoredBlob(t, dir, bad.Digest)
+
+	verifier, err := NewContentVerifier(store, ContentVerifierOptions{QuarantineDir: quarantine})
+	require.NoError(t, err)
+	assert.NoError(t, verifier.Verify(ctx, good.Digest))
+	err = verifier.Verify(ctx, bad.Digest)
+	assert.True(t, errors.Is(err, ErrCorruptBlob), "unexpected error %v", err)
+	assert.True(t, errdefs.IsNotFound(err), "corrupt blobs should be reported as missing")
+
+	_, err = store.Info(ctx, bad.Digest)
+	assert.True(t, errdefs.IsNotFound(err), "corrupt blob should be removed from the store")
+	quarantined, err := ioutil.ReadFile(filepath.Join(quarantine, "blobs", "sha256", bad.Digest.Encoded()))
+	require.NoError(t, err, "corrupt blob should be quarantined")
+	assert.NotEqual(t, "bad", string(quarantined))
+	assert.Len(t, quarantined, len("bad"))
+	_, err = store.Info(ctx, good.Digest)
+	assert.NoError(t, err)
+
+	_, err = NewContentVerifier(store, ContentVerifierOptions{Interval: -time.Second})
+	assert.Error(t, err)
+}
+
+func TestContentVerifierVerifyOnce(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := local.NewStore(dir)
+	require.NoError(t, err)
+	desc := writeBlob(t, store, "layer")
+
+	verifier, err := NewContentVerifier(store, ContentVerifierOptions{})
+	require.NoError(t, err)
+	require.NoError(t, verifier.VerifyOnce(ctx, desc.Digest))
+	corruptStoredBlob(t, dir, desc.Digest)
+	assert.NoError(t, verifier.VerifyOnce(ctx, desc.Digest), "verified blobs should not be hashed again")
+
+	// The first use after a restart verifies the blob.
+	verifier, err = NewContentVerifier(store, ContentVerifierOptions{})
+	require.NoError(t, err)
+	err = verifier.VerifyOnce(ctx, desc.Digest)
+	assert.True(t, errors.Is(err, ErrCorruptBlob), "unexpected error %v", err)
+	_, err = store.Info(ctx, desc.Digest)
+	assert.True(t, errdefs.IsNotFound(err), "corrupt blob without a quarantine directory should be deleted")
+}
+
+func TestContentVerifierRun(t *testing.T) {
+	dir := t.TempDir()
+	store, err := local.NewStore(dir)
+	require.NoError(t, err)
+	good := writeBlob(t, store, "good")
+	bad := writeBlob(t, store, "bad")
+
+	verifier, err := NewContentVerifier(store, ContentVerifierOptions{Interval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- verifier.Run(ctx) }()
+
+	// The blob is corrupted after the first pass may have verified it.
+	corruptStoredBlob(t, dir, bad.Digest)
+	assert.Eventually(t, func() bool {
+		_, err := store.Info(context.Background(), bad.Digest)
+		return errdefs.IsNotFound(err)
+	}, 5*time.Second, 10*time.Millisecond, "corrupt blob should be quarantined by a later pass")
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	_, err = store.Info(context.Background(), good.Digest)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,734 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/semaphore"
+)
+
+// CopyOption represents a functional option for configuring Copy.
+type CopyOption func(*CopyOptions) error
+
+// CopyOptions represents available options for configuring Copy.
+type CopyOptions struct {
+	// Platforms restricts the manifests copied from an image index to those
+	// matching the platform.  The copied index is rewritten to list only the
+	// copied manifests.  If not specified, all manifests are copied.
+	Platforms platforms.Matcher
+	// SkipReferrers disables copying artifacts, such as signatures, SBOMs,
+	// and SOCI indexes, that refer to the copied manifests.
+	SkipReferrers bool
+	// ReferrerTypes restricts the referrers copied to those of the artifact
+	// types listed.  If not specified, referrers of any type are copied.
+	ReferrerTypes []string
+	// ExcludeReferrerTypes lists artifact types of referrers not to copy.
+	ExcludeReferrerTypes []string
+	// Lenient configures whether malformed non-essential fields of
+	// manifests and indexes, such as annotations with values which are not
+	// strings, are logged and ignored.  If not specified, they fail the copy.
+	Lenient bool
+	// ManifestsOnly configures whether only manifests and indexes are
+	// copied, for destinations which already hold the blobs, such as through
+	// replication.  The destination must implement BlobProber.
+	ManifestsOnly bool
+	// VerifyPull configures whether PullAll confirms that all of the pulled
+	// content is present in the ingester with the sizes of its descriptors
+	// before returning.  The ingester must implement content.Manager.
+	VerifyPull bool
+	// Concurrency bounds the number of blobs and image manifests pushed, or
+	// ingested by PullAll, at once.  If not specified, content is
+	// transferred one item at a time.
+	Concurrency int
+	// Transfers records the content pushed or ingested.  If not specified,
+	// transfers are not recorded.
+	Transfers *TransferReport
+}
+
+// WithCopyPlatforms is a CopyOption to copy only the manifests of an image
+// index for the specified platforms, such as "linux/amd64".
+func WithCopyPlatforms(specifiers ...string) CopyOption {
+	return func(options *CopyOptions) error {
+		var ps []ocispec.Platform
+		for _, specifier := range specifiers {
+			p, err := platforms.Parse(specifier)
+			if err != nil {
+				return err
+			}
+			ps = append(ps, p)
+		}
+		options.Platforms = platforms.Any(ps...)
+		return nil
+	}
+}
+
+// WithoutCopyReferrers is a CopyOption to copy only the image, leaving behind
+// any signatures or other artifacts that refer to it.
+func WithoutCopyReferrers() CopyOption {
+	return func(options *CopyOptions) error {
+		options.SkipReferrers = true
+		return nil
+	}
+}
+
+// WithCopyReferrerTypes is a CopyOption to copy only the referrers of the
+// specified artifact types, such as "application/vnd.amazon.soci.index.v1+json".
+// The artifact type of a referrer is its manifest's artifactType, or failing
+// that its config's media type unless it is a plain image config, or failing
+// that the media type of its first layer, such as
+// "application/vnd.dev.cosign.simplesigning.v1+json" for cosign signatures.
+// Referrers with none of these have the media type of their manifest or index.
+func WithCopyReferrerTypes(artifactTypes ...string) CopyOption {
+	return func(options *CopyOptions) error {
+		options.ReferrerTypes = append(options.ReferrerTypes, artifactTypes...)
+		return nil
+	}
+}
+
+// WithoutCopyReferrerTypes is a CopyOption to leave behind referrers of the
+// specified artifact types, such as SBOMs.  Artifact types are determined as
+// for WithCopyReferrerTypes.
+func WithoutCopyReferrerTypes(artifactTypes ...string) CopyOption {
+	return func(options *CopyOptions) error {
+		options.ExcludeReferrerTypes = append(options.ExcludeReferrerTypes, artifactTypes...)
+		return nil
+	}
+}
+
+// WithLenientManifests is a CopyOption to log and ignore malformed fields of
+// manifests and indexes which do not affect the content copied, such as
+// annotations, rather than failing the copy.  Manifests are copied unmodified,
+// so their digests are preserved.
+func WithLenientManifests() CopyOption {
+	return func(options *CopyOptions) error {
+		options.Lenient = true
+		return nil
+	}
+}
+
+// WithManifestsOnly is a CopyOption to copy only the manifests and indexes of
+// an image, promoting it to a destination which already holds its layers and
+// configs.  The presence of every blob is verified before any manifest is
+// pushed, and a *MissingBlobsError is returned listing those absent.
+func WithManifestsOnly() CopyOption {
+	return func(options *CopyOptions) error {
+		options.ManifestsOnly = true
+		return nil
+	}
+}
+
+// WithCopyConcurrency is a CopyOption to push up to concurrency blobs, and
+// then up to concurrency image manifests, at once, such as the manifests of
+// each platform of a multi-arch image.  Image indexes are pushed last, one at
+// a time, so that every manifest an index lists is pushed before it.
+func WithCopyConcurrency(concurrency int) CopyOption {
+	return func(options *CopyOptions) error {
+		if concurrency <= 0 {
+			return errors.New("copy concurrency must be positive")
+		}
+		options.Concurrency = concurrency
+		return nil
+	}
+}
+
+// WithPullVerification is a CopyOption for PullAll to check, once the images
+// are ingested, that every manifest, index, config, and layer they reference
+// is in the ingester with the size given by its descriptor.  This guards
+// against content lost by an ingester which crashed or was retried part way,
+// such as content reported as present which was never committed.  A
+// *IncompletePullError is returned listing the content found missing or of
+// the wrong size.
+func WithPullVerification() CopyOption {
+	return func(options *CopyOptions) error {
+		options.VerifyPull = true
+		return nil
+	}
+}
+
+// WithTransferReport is a CopyOption recording the bytes, duration, and
+// retries of each manifest, config, and layer transferred in report, and
+// whether it was skipped as already present at the destination.
+func WithTransferReport(report *TransferReport) CopyOption {
+	return func(options *CopyOptions) error {
+		if report == nil {
+			return errors.New("transfer report must not be nil")
+		}
+		options.Transfers = report
+		return nil
+	}
+}
+
+// MissingBlobsError is returned by Copy with WithManifestsOnly when blobs
+// referenced by the copied manifests are not present at the destination.
+type MissingBlobsError struct {
+	// Ref is the destination reference.
+	Ref string
+	// Digests of the missing blobs.
+	Digests []digest.Digest
+}
+
+func (e *MissingBlobsError) Error() string {
+	digests := make([]string, len(e.Digests))
+	for i, dgst := range e.Digests {
+		digests[i] = dgst.String()
+	}
+	return fmt.Sprintf("ecr: %d blobs missing from %s: %s", len(e.Digests), e.Ref, strings.Join(digests, ", "))
+}
+
+// Unwrap returns errdefs.ErrFailedPrecondition so that missing blobs are
+// categorized as a verification failure.
+func (e *MissingBlobsError) Unwrap() error {
+	return errdefs.ErrFailedPrecondition
+}
+
+// Copy copies the image referenced by sourceRef, resolved with source, to
+// destinationRef using destination.  Content is streamed from the source
+// fetcher to the destination pusher without being stored locally, and
+// content already present at the destination is not transferred.  Any
+// remotes.Resolver may be used as the source or destination.
+//
+// Artifacts attached to the copied manifests under the tags used by cosign and
+// the OCI referrers tag schema, such as signatures, SBOMs, and SOCI indexes,
+// are copied under the same tags so that the destination remains verifiable.
+// Artifacts listed by a source implementing ReferrerLister are copied by
+// digest.
+// Use WithoutCopyReferrers to copy the image alone.
+//
+// The descriptor of the copied root manifest or index is returned.  It
+// differs from the source's descriptor when the copy is filtered.  Blobs and
+// manifests which cannot be pushed do not stop the others from being pushed;
+// the failures are returned together in an *AggregateError.
+func Copy(ctx context.Context, source remotes.Resolver, sourceRef string, destination remotes.Resolver, destinationRef string, opts ...CopyOption) (ocispec.Descriptor, error) {
+	options, err := newCopyOptions(opts)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	name, desc, err := source.Resolve(ctx, sourceRef)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	fetcher, err := source.Fetcher(ctx, name)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	c := newCopier(options, fetcher)
+	root, err := c.copy(ctx, desc, destination, destinationRef)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if !options.SkipReferrers {
+		if err := c.copyReferrers(ctx, source, name, destination, destinationRef); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	return root, nil
+}
+
+func newCopyOptions(opts []CopyOption) (CopyOptions, error) {
+	var options CopyOptions
+	for _, opt := range opts {
+		if err := opt(&options); err != nil {
+			return CopyOptions{}, err
+		}
+	}
+	return options, nil
+}
+
+func newCopier(options CopyOptions, fetcher remotes.Fetcher) *copier {
+	return &copier{
+		options: options,
+		fetcher: fetcher,
+		seen:    map[digest.Digest]ocispec.Descriptor{},
+	}
+}
+
+// copy plans the graph rooted at desc and pushes it to destinationRef.
+func (c *copier) copy(ctx context.Context, desc ocispec.Descriptor, destination remotes.Resolver, destinationRef string) (ocispec.Descriptor, error) {
+	root, err := c.plan(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	// The root descriptor's digest identifies which manifest is to be tagged.
+	if !strings.Contains(destinationRef, "@") {
+		destinationRef = destinationRef + "@" + root.Digest.String()
+	}
+	if c.options.ManifestsOnly {
+		if err := c.verifyBlobs(ctx, destination, destinationRef); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	c.pusher, err = destination.Pusher(ctx, destinationRef)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var nodes []copyNode
+	for _, node := range c.nodes {
+		if c.options.ManifestsOnly && node.content == nil {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	if err := c.pushAll(ctx, nodes); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return root, nil
+}
+
+// pushAll pushes nodes, which list children ahead of their parents.  With
+// concurrency configured, blobs are pushed in parallel, then image manifests,
+// then indexes in order, so that no content is pushed before its children.
+// Failures are returned in an *AggregateError.  Once any push has failed, no
+// further manifests are pushed, as their children may be missing, but the
+// remaining blobs are.
+func (c *copier) pushAll(ctx context.Context, nodes []copyNode) error {
+	if c.options.Concurrency <= 1 {
+		var failed aggregateErrors
+		for _, node := range nodes {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if node.content != nil && failed.err() != nil {
+				continue
+			}
+			if err := c.push(ctx, node); err != nil {
+				failed.add("push", node.desc.Digest, err)
+			}
+		}
+		return failed.err()
+	}
+
+	blobs, manifests, indexes := splitNodes(nodes)
+	for _, group := range [][]copyNode{blobs, manifests} {
+		if err := c.pushConcurrently(ctx, group); err != nil {
+			return err
+		}
+	}
+	for _, node := range indexes {
+		if err := c.push(ctx, node); err != nil {
+			var failed aggregateErrors
+			failed.add("push", node.desc.Digest, err)
+			return failed.err()
+		}
+	}
+	return nil
+}
+
+// splitNodes splits nodes into blobs, image manifests, and indexes, keeping
+// their order.
+func splitNodes(nodes []copyNode) (blobs, manifests, indexes []copyNode) {
+	for _, node := range nodes {
+		switch {
+		case node.content == nil:
+			blobs = append(blobs, node)
+		case isIndex(node.desc.MediaType):
+			indexes = append(indexes, node)
+		default:
+			manifests = append(manifests, node)
+		}
+	}
+	return blobs, manifests, indexes
+}
+
+// pushConcurrently pushes nodes, which must not depend on each other, up to
+// the configured concurrency at a time.  A failed push does not stop the
+// others, and every failure is returned in an *AggregateError.
+func (c *copier) pushConcurrently(ctx context.Context, nodes []copyNode) error {
+	var (
+		wg     sync.WaitGroup
+		failed aggregateErrors
+	)
+	limiter := semaphore.NewWeighted(int64(c.options.Concurrency))
+	for _, node := range nodes {
+		node := node
+		if err := limiter.Acquire(ctx, 1); err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer limiter.Release(1)
+			if err := c.push(ctx, node); err != nil {
+				failed.add("push", node.desc.Digest, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := failed.err(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// verifyBlobs checks that the blobs planned by c are present at
+// destinationRef, returning a *MissingBlobsError if any are not.
+func (c *copier) verifyBlobs(ctx context.Context, destination remotes.Resolver, destinationRef string) error {
+	prober, ok := destination.(BlobProber)
+	if !ok {
+		return fmt.Errorf("copying manifests only requires a destination able to probe blobs: %w", errdefs.ErrNotImplemented)
+	}
+	var digests []digest.Digest
+	for _, node := range c.nodes {
+		if node.content == nil {
+			digests = append(digests, node.desc.Digest)
+		}
+	}
+	missing, err := prober.MissingBlobs(ctx, destinationRef, digests)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return &MissingBlobsError{Ref: destinationRef, Digests: missing}
+	}
+	log.G(ctx).
+		WithField("blobs", len(digests)).
+		Debug("ecr.copy: blobs present at destination")
+	return nil
+}
+
+// copyReferrers copies the referrers of the content copied by c, as found by
+// c.referrers.
+func (c *copier) copyReferrers(ctx context.Context, source remotes.Resolver, sourceName string, destination remotes.Resolver, destinationRef string) error {
+	referrers, err := c.referrers(ctx, source, sourceName)
+	if err != nil {
+		return err
+	}
+	for _, r := range referrers {
+		log.G(ctx).
+			WithField("tag", r.tag).
+			WithField("digest", r.desc.Digest).
+			Debug("ecr.copy: copying referrer")
+		referrer := newCopier(CopyOptions{
+			SkipReferrers: true,
+			Lenient:       c.options.Lenient,
+			ManifestsOnly: c.options.ManifestsOnly,
+		}, c.fetcher)
+		ref := withTag(destinationRef, r.tag)
+		if r.tag == "" {
+			ref = withDigest(destinationRef, r.desc.Digest)
+		}
+		if _, err := referrer.copy(ctx, r.desc, destination, ref); err != nil {
+			return fmt.Errorf("failed to copy referrer %s: %w", ref, err)
+		}
+	}
+	return nil
+}
+
+// referrer is an artifact referring to other content, with the tag it is
+// stored under, if any.  Untagged referrers are copied by digest.
+type referrer struct {
+	tag  string
+	desc ocispec.Descriptor
+}
+
+// referrers finds the artifacts tagged as referring to the manifests and
+// indexes planned unmodified by c, along with those listed by the source if
+// it is a ReferrerLister.  Manifests rewritten by the copy have a new
+// digest, so artifacts referring to the source digest would not apply to
+// them and are not included.  Referrers of referrers are not followed.
+func (c *copier) referrers(ctx context.Context, source remotes.Resolver, sourceName string) ([]referrer, error) {
+	var referrers []referrer
+	for _, node := range c.nodes {
+		if node.content == nil || node.source != node.desc.Digest {
+			continue
+		}
+		found := map[digest.Digest]bool{}
+		for _, tag := range referrerTags(node.desc.Digest) {
+			_, desc, err := source.Resolve(ctx, withTag(sourceName, tag))
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			log.G(ctx).
+				WithField("subject", node.desc.Digest).
+				WithField("tag", tag).
+				WithField("digest", desc.Digest).
+				Debug("ecr.copy: found referrer")
+			if ok, err := c.copiesReferrer(ctx, desc); err != nil {
+				return nil, err
+			} else if !ok {
+				continue
+			}
+			found[desc.Digest] = true
+			referrers = append(referrers, referrer{tag: tag, desc: desc})
+		}
+		lister, ok := source.(ReferrerLister)
+		if !ok {
+			continue
+		}
+		listed, err := lister.Referrers(ctx, sourceName, node.desc)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range listed {
+			if found[r.Digest] {
+				continue
+			}
+			found[r.Digest] = true
+			log.G(ctx).
+				WithField("subject", node.desc.Digest).
+				WithField("digest", r.Digest).
+				Debug("ecr.copy: found referrer")
+			if ok, err := c.copiesReferrer(ctx, r.Descriptor); err != nil {
+				return nil, err
+			} else if !ok {
+				continue
+			}
+			referrers = append(referrers, referrer{desc: r.Descriptor})
+		}
+	}
+	return referrers, nil
+}
+
+// copiesReferrer reports whether the referrer desc is of an artifact type to
+// be copied.
+func (c *copier) copiesReferrer(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
+	if len(c.options.ReferrerTypes) == 0 && len(c.options.ExcludeReferrerTypes) == 0 {
+		return true, nil
+	}
+	data, err := c.fetch(ctx, desc)
+	if err != nil {
+		return false, err
+	}
+	artifactType, err := referrerArtifactType(ctx, data, desc.MediaType, c.options.Lenient)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse referrer %v: %w", desc.Digest, ErrInvalidManifest)
+	}
+	copied := len(c.options.ReferrerTypes) == 0 || containsString(c.options.ReferrerTypes, artifactType)
+	if containsString(c.options.ExcludeReferrerTypes, artifactType) {
+		copied = false
+	}
+	if !copied {
+		log.G(ctx).
+			WithField("digest", desc.Digest).
+			WithField("artifactType", artifactType).
+			Debug("ecr.copy: skipping referrer")
+	}
+	return copied, nil
+}
+
+// copyNode is a descriptor to be copied along with its content when the
+// content is a manifest or index.
+type copyNode struct {
+	desc    ocispec.Descriptor
+	content []byte
+	// source is the digest of the source content, which differs from that
+	// of desc when the content is rewritten.
+	source digest.Digest
+}
+
+type copier struct {
+	options CopyOptions
+	fetcher remotes.Fetcher
+	pusher  remotes.Pusher
+	// nodes lists the content to copy, with children ahead of their parents.
+	nodes []copyNode
+	// seen maps the digests of planned source content to the descriptors of
+	// the content to be copied.
+	seen map[digest.Digest]ocispec.Descriptor
+}
+
+// plan walks the image graph rooted at desc, adding the content to copy to
+// the copier's nodes.  The descriptor of the content to be copied in place of
+// desc is returned.
+func (c *copier) plan(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	if planned, ok := c.seen[desc.Digest]; ok {
+		return planned, nil
+	}
+
+	var (
+		planned = desc
+		data    []byte
+		err     error
+	)
+	switch {
+	case images.IsIndexType(desc.MediaType):
+		planned, data, err = c.planIndex(ctx, desc)
+	case images.IsManifestType(desc.MediaType):
+		planned, data, err = c.planManifest(ctx, desc)
+	case desc.MediaType == images.MediaTypeDockerSchema1Manifest:
+		err = fmt.Errorf("copy %v: %w", desc.MediaType, errdefs.ErrNotImplemented)
+	}
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	c.seen[desc.Digest] = planned
+	c.nodes = append(c.nodes, copyNode{desc: planned, content: data, source: desc.Digest})
+	return planned, nil
+}
+
+func (c *copier) planManifest(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, []byte, error) {
+	data, err := c.fetch(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	var manifest ocispec.Manifest
+	if err := decodeManifest(ctx, data, &manifest, c.options.Lenient); err != nil {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("failed to parse manifest %v: %w", desc.Digest, ErrInvalidManifest)
+	}
+	for _, child := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		if _, err := c.plan(ctx, child); err != nil {
+			return ocispec.Descriptor{}, nil, err
+		}
+	}
+	return desc, data, nil
+}
+
+func (c *copier) planIndex(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, []byte, error) {
+	data, err := c.fetch(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	// The index is decoded generically so that fields unknown to this
+	// package are preserved if the index has to be rewritten.
+	var index map[string]json.RawMessage
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &index); err != nil {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("failed to parse index %v: %w", desc.Digest, ErrInvalidManifest)
+	}
+	if err := json.Unmarshal(index["manifests"], &entries); err != nil {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("failed to parse index %v: %w", desc.Digest, ErrInvalidManifest)
+	}
+
+	modified := false
+	var copied []json.RawMessage
+	for _, entry := range entries {
+		var child ocispec.Descriptor
+		if err := decodeManifest(ctx, entry, &child, c.options.Lenient); err != nil {
+			return ocispec.Descriptor{}, nil, fmt.Errorf("failed to parse index %v: %w", desc.Digest, ErrInvalidManifest)
+		}
+		if c.options.Platforms != nil && (child.Platform == nil || !c.options.Platforms.Match(*child.Platform)) {
+			log.G(ctx).
+				WithField("digest", child.Digest).
+				WithField("platform", child.Platform).
+				Debug("ecr.copy: skipping manifest for unrequested platform")
+			modified = true
+			continue
+		}
+		planned, err := c.plan(ctx, child)
+		if err != nil {
+			return ocispec.Descriptor{}, nil, err
+		}
+		if planned.Digest != child.Digest {
+			entry, err = replaceDescriptor(entry, planned)
+			if err != nil {
+				return ocispec.Descriptor{}, nil, err
+			}
+			modified = true
+		}
+		copied = append(copied, entry)
+	}
+	if !modified {
+		return desc, data, nil
+	}
+	if len(copied) == 0 {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("no manifests in index %v match the requested platforms: %w", desc.Digest, errdefs.ErrNotFound)
+	}
+
+	index["manifests"], err = json.Marshal(copied)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	data, err = json.Marshal(index)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	rewritten := desc
+	rewritten.Digest = digest.FromBytes(data)
+	rewritten.Size = int64(len(data))
+	log.G(ctx).
+		WithField("source", desc.Digest).
+		WithField("rewritten", rewritten.Digest).
+		Debug("ecr.copy: rewrote index")
+	return rewritten, data, nil
+}
+
+// replaceDescriptor updates the digest and size of the descriptor encoded in
+// entry, preserving its other fields.
+func replaceDescriptor(entry json.RawMessage, desc ocispec.Descriptor) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(entry, &fields); err != nil {
+		return nil, err
+	}
+	var err error
+	if fields["digest"], err = json.Marshal(desc.Digest); err != nil {
+		return nil, err
+	}
+	if fields["size"], err = json.Marshal(desc.Size); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+func (c *copier) fetch(ctx context.Context, desc ocispec.Descriptor) ([]byte, error) {
+	rc, err := c.fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// push copies node to the destination unless it is already present.
+func (c *copier) push(ctx context.Context, node copyNode) (err error) {
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("desc", node.desc))
+	ctx, t := c.options.Transfers.start(ctx, node.desc)
+	defer func() { t.done(err) }()
+	cw, err := c.pusher.Push(ctx, node.desc)
+	if err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			log.G(ctx).Debug("ecr.copy: content exists at destination")
+			t.existing()
+			return nil
+		}
+		return err
+	}
+	defer cw.Close()
+	cw = t.writer(cw)
+
+	if node.content != nil {
+		log.G(ctx).Debug("ecr.copy: copying manifest")
+		return content.Copy(ctx, cw, bytes.NewReader(node.content), node.desc.Size, node.desc.Digest)
+	}
+	log.G(ctx).Debug("ecr.copy: copying blob")
+	rc, err := c.fetcher.Fetch(ctx, node.desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return content.Copy(ctx, cw, rc, node.desc.Size, node.desc.Digest)
+}
@@ -0,0 +1,417 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// putMultiArchImage stores an index of linux/amd64 and linux/arm64 images
+// tagged as name.
+func putMultiArchImage(r *fakeRegistry, name string) (ocispec.Descriptor, []ocispec.Descriptor) {
+	manifests := []ocispec.Descriptor{
+		r.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"}),
+		r.putImage(ocispec.Platform{OS: "linux", Architecture: "arm64"}),
+	}
+	index := r.putJSON(ocispec.MediaTypeImageIndex, ocispec.Index{
+		MediaType:   ocispec.MediaTypeImageIndex,
+		Manifests:   manifests,
+		Annotations: map[string]string{"org.opencontainers.image.version": "1.0"},
+	})
+	r.tag(name, index)
+	return index, manifests
+}
+
+func TestCopy(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	index, manifests := putMultiArchImage(source, "source")
+
+	desc, err := Copy(context.Background(), source, "source", destination, "destination")
+	require.NoError(t, err)
+	assert.Equal(t, index.Digest, desc.Digest, "unfiltered index should be copied as-is")
+
+	for dgst := range source.blob {
+		assert.True(t, destination.has(dgst), "destination should have %s", dgst)
+	}
+	_, tagged, err := destination.Resolve(context.Background(), "destination")
+	require.NoError(t, err)
+	assert.Equal(t, index.Digest, tagged.Digest)
+
+	// Copying again transfers nothing but the manifests needed to plan.
+	_, err = Copy(context.Background(), source, "source", destination, "destination")
+	require.NoError(t, err)
+	for _, manifest := range manifests {
+		assert.Equal(t, 1, destination.pushes[manifest.Digest])
+	}
+}
+
+func TestCopyAggregatesFailures(t *testing.T) {
+	for _, concurrency := range []int{1, 4} {
+		t.Run(fmt.Sprint(concurrency), func(t *testing.T) {
+			source, destination := newFakeRegistry(), newFakeRegistry()
+			_, manifests := putMultiArchImage(source, "source")
+			var missing []digest.Digest
+			for _, manifest := range manifests {
+				var image ocispec.Manifest
+				require.NoError(t, json.Unmarshal(source.blob[manifest.Digest], &image))
+				missing = append(missing, image.Layers[0].Digest)
+				delete(source.blob, image.Layers[0].Digest)
+			}
+
+			_, err := Copy(context.Background(), source, "source", destination, "destination", WithCopyConcurrency(concurrency))
+			var aggregate *AggregateError
+			require.True(t, errors.As(err, &aggregate), "expected *AggregateError, got %v", err)
+			var failed []digest.Digest
+			for _, contentErr := range aggregate.Errors {
+				assert.Equal(t, "push", contentErr.Op)
+				failed = append(failed, contentErr.Digest)
+			}
+			assert.ElementsMatch(t, missing, failed, "every failure should be reported")
+			assert.True(t, errdefs.IsNotFound(err))
+			for _, manifest := range manifests {
+				assert.False(t, destination.has(manifest.Digest), "manifests should not be pushed without their layers")
+			}
+		})
+	}
+}
+
+func TestCopyPlatforms(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	index, manifests := putMultiArchImage(source, "source")
+
+	desc, err := Copy(context.Background(), source, "source", destination, "destination",
+		WithCopyPlatforms("linux/amd64"))
+	require.NoError(t, err)
+	assert.NotEqual(t, index.Digest, desc.Digest, "filtered index should be rewritten")
+	assert.Equal(t, ocispec.MediaTypeImageIndex, desc.MediaType)
+
+	var copied ocispec.Index
+	require.NoError(t, json.Unmarshal(destination.get(desc.Digest), &copied))
+	require.Len(t, copied.Manifests, 1)
+	assert.Equal(t, manifests[0].Digest, copied.Manifests[0].Digest)
+	assert.Equal(t, "amd64", copied.Manifests[0].Platform.Architecture)
+	assert.Equal(t, "1.0", copied.Annotations["org.opencontainers.image.version"],
+		"index fields should be preserved")
+
+	assert.True(t, destination.has(manifests[0].Digest))
+	assert.False(t, destination.has(manifests[1].Digest), "arm64 manifest should not be copied")
+	assert.Equal(t, 0, source.fetches[manifests[1].Digest], "arm64 manifest should not be fetched")
+}
+
+func TestCopyPlatformsNoMatch(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	putMultiArchImage(source, "source")
+
+	_, err := Copy(context.Background(), source, "source", destination, "destination",
+		WithCopyPlatforms("windows/amd64"))
+	assert.True(t, errdefs.IsNotFound(err))
+}
+
+func TestCopyInvalidPlatform(t *testing.T) {
+	_, err := Copy(context.Background(), newFakeRegistry(), "source", newFakeRegistry(), "destination",
+		WithCopyPlatforms("not/a/valid/platform"))
+	assert.Error(t, err)
+}
+
+// putSignature stores a signature-like artifact for subject, tagged using the
+// cosign tag schema.
+func putSignature(r *fakeRegistry, name string, subject ocispec.Descriptor) ocispec.Descriptor {
+	config := r.putJSON(ocispec.MediaTypeImageConfig, ocispec.Image{})
+	payload := r.put("application/vnd.dev.cosign.simplesigning.v1+json", []byte("signed "+subject.Digest.String()))
+	signature := r.putJSON(ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{payload},
+	})
+	r.tag(withTag(name, "sha256-"+subject.Digest.Encoded()+".sig"), signature)
+	return signature
+}
+
+func TestCopyReferrers(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	index, manifests := putMultiArchImage(source, "example.com/source:latest")
+	indexSignature := putSignature(source, "example.com/source", index)
+	manifestSignature := putSignature(source, "example.com/source", manifests[0])
+
+	_, err := Copy(context.Background(), source, "example.com/source:latest", destination, "example.com/destination:latest")
+	require.NoError(t, err)
+
+	for _, signature := range []ocispec.Descriptor{indexSignature, manifestSignature} {
+		assert.True(t, destination.has(signature.Digest))
+	}
+	_, tagged, err := destination.Resolve(context.Background(), "example.com/destination:sha256-"+index.Digest.Encoded()+".sig")
+	require.NoError(t, err)
+	assert.Equal(t, indexSignature.Digest, tagged.Digest)
+	_, tagged, err = destination.Resolve(context.Background(), "example.com/destination:latest")
+	require.NoError(t, err)
+	assert.Equal(t, index.Digest, tagged.Digest, "referrers should not replace the image tag")
+}
+
+func TestCopyReferrersRewritten(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	index, manifests := putMultiArchImage(source, "example.com/source:latest")
+	indexSignature := putSignature(source, "example.com/source", index)
+	manifestSignature := putSignature(source, "example.com/source", manifests[0])
+
+	_, err := Copy(context.Background(), source, "example.com/source:latest", destination, "example.com/destination:latest",
+		WithCopyPlatforms("linux/amd64"))
+	require.NoError(t, err)
+	assert.False(t, destination.has(indexSignature.Digest), "signature of the source index does not apply to the rewritten index")
+	assert.True(t, destination.has(manifestSignature.Digest))
+}
+
+// referrerListingRegistry is a fakeRegistry listing referrers as if through
+// the OCI referrers API.
+type referrerListingRegistry struct {
+	*fakeRegistry
+	referrers map[digest.Digest][]Referrer
+}
+
+func (r referrerListingRegistry) Referrers(_ context.Context, _ string, desc ocispec.Descriptor) ([]Referrer, error) {
+	return r.referrers[desc.Digest], nil
+}
+
+func TestCopyListedReferrers(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	manifest := source.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	source.tag("example.com/source:latest", manifest)
+	tagged := putSignature(source, "example.com/source", manifest)
+	sbom := source.putJSON(ocispec.MediaTypeImageManifest, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ocispec.MediaTypeImageManifest,
+		"artifactType":  "application/spdx+json",
+		"config":        source.put("application/vnd.oci.empty.v1+json", []byte("{}")),
+		"layers":        []ocispec.Descriptor{source.put("application/spdx+json", []byte("sbom"))},
+		"subject":       manifest,
+	})
+	lister := referrerListingRegistry{fakeRegistry: source, referrers: map[digest.Digest][]Referrer{
+		manifest.Digest: {
+			{Descriptor: tagged},
+			{Descriptor: sbom, ArtifactType: "application/spdx+json"},
+		},
+	}}
+
+	_, err := Copy(context.Background(), lister, "example.com/source:latest", destination, "example.com/destination:latest")
+	require.NoError(t, err)
+
+	assert.True(t, destination.has(sbom.Digest), "listed referrer should be copied")
+	assert.Equal(t, source.get(sbom.Digest), destination.get(sbom.Digest))
+	assert.Equal(t, 1, destination.pushes[tagged.Digest], "referrers both tagged and listed should be copied once")
+	_, desc, err := destination.Resolve(context.Background(), "example.com/destination:latest")
+	require.NoError(t, err)
+	assert.Equal(t, manifest.Digest, desc.Digest, "referrers should not replace the image tag")
+
+	filtered := newFakeRegistry()
+	_, err = Copy(context.Background(), lister, "example.com/source:latest", filtered, "example.com/destination:latest",
+		WithoutCopyReferrerTypes("application/spdx+json"))
+	require.NoError(t, err)
+	assert.False(t, filtered.has(sbom.Digest), "listed referrers should be filtered by type")
+	assert.True(t, filtered.has(tagged.Digest))
+}
+
+func TestCopyWithoutReferrers(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	index, _ := putMultiArchImage(source, "example.com/source:latest")
+	signature := putSignature(source, "example.com/source", index)
+
+	_, err := Copy(context.Background(), source, "example.com/source:latest", destination, "example.com/destination:latest",
+		WithoutCopyReferrers())
+	require.NoError(t, err)
+	assert.False(t, destination.has(signature.Digest))
+}
+
+func TestCopyReferrerTypes(t *testing.T) {
+	const sociIndex = "application/vnd.amazon.soci.index.v1+json"
+	source := newFakeRegistry()
+	manifest := source.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	source.tag("example.com/source:latest", manifest)
+	signature := putSignature(source, "example.com/source", manifest)
+	sbomLayer := source.put("text/spdx+json", []byte("sbom"))
+	sbom := source.putJSON(ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    source.putJSON(ocispec.MediaTypeImageConfig, ocispec.Image{}),
+		Layers:    []ocispec.Descriptor{sbomLayer},
+	})
+	source.tag(withTag("example.com/source", "sha256-"+manifest.Digest.Encoded()+".sbom"), sbom)
+	soci := source.put(ocispec.MediaTypeImageManifest, []byte(fmt.Sprintf(
+		`{"schemaVersion":2,"mediaType":%q,"artifactType":%q,"config":{"mediaType":"application/vnd.oci.empty.v1+json","digest":%q,"size":2},"layers":[]}`,
+		ocispec.MediaTypeImageManifest, sociIndex, source.put("application/vnd.oci.empty.v1+json", []byte("{}")).Digest)))
+	source.tag(withTag("example.com/source", "sha256-"+manifest.Digest.Encoded()), soci)
+
+	for name, opt := range map[string]CopyOption{
+		"include": WithCopyReferrerTypes("application/vnd.dev.cosign.simplesigning.v1+json", sociIndex),
+		"exclude": WithoutCopyReferrerTypes("text/spdx+json"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			destination := newFakeRegistry()
+			_, err := Copy(context.Background(), source, "example.com/source:latest", destination, "example.com/destination:latest", opt)
+			require.NoError(t, err)
+			assert.True(t, destination.has(signature.Digest), "signature should be copied")
+			assert.True(t, destination.has(soci.Digest), "SOCI index should be copied")
+			assert.False(t, destination.has(sbom.Digest), "SBOM should be left behind")
+		})
+	}
+}
+
+func TestCopyLenientManifests(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	config := source.putJSON(ocispec.MediaTypeImageConfig, ocispec.Image{OS: "linux"})
+	layer := source.put(ocispec.MediaTypeImageLayerGzip, []byte("layer"))
+	// Annotations must have string values.
+	manifest := source.put(ocispec.MediaTypeImageManifest, []byte(fmt.Sprintf(
+		`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":%d},"layers":[{"mediaType":%q,"digest":%q,"size":%d,"annotations":{"build":1}}],"annotations":["unexpected"]}`,
+		ocispec.MediaTypeImageManifest,
+		config.MediaType, config.Digest, config.Size,
+		layer.MediaType, layer.Digest, layer.Size)))
+	index := source.put(ocispec.MediaTypeImageIndex, []byte(fmt.Sprintf(
+		`{"schemaVersion":2,"manifests":[{"mediaType":%q,"digest":%q,"size":%d,"annotations":{"count":2},"extra":true}]}`,
+		manifest.MediaType, manifest.Digest, manifest.Size)))
+	source.tag("source", index)
+
+	_, err := Copy(context.Background(), source, "source", destination, "destination")
+	assert.True(t, errors.Is(err, ErrInvalidManifest), "malformed annotations should fail a strict copy: %v", err)
+
+	desc, err := Copy(context.Background(), source, "source", destination, "destination", WithLenientManifests())
+	require.NoError(t, err)
+	assert.Equal(t, index.Digest, desc.Digest, "manifests should be copied unmodified")
+	for dgst := range source.blob {
+		assert.True(t, destination.has(dgst), "destination should have %s", dgst)
+	}
+}
+
+func TestCopyManifestsOnly(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	index, manifests := putMultiArchImage(source, "source")
+	missing := digest.FromString("layer for arm64")
+	for dgst, data := range source.blob {
+		if dgst != missing && dgst != index.Digest && dgst != manifests[0].Digest && dgst != manifests[1].Digest {
+			destination.put("", data)
+		}
+	}
+
+	_, err := Copy(context.Background(), source, "source", destination, "destination", WithManifestsOnly())
+	var missingErr *MissingBlobsError
+	require.True(t, errors.As(err, &missingErr), "unexpected error %v", err)
+	assert.Equal(t, []digest.Digest{missing}, missingErr.Digests)
+	assert.Equal(t, ErrorCategoryVerification, Categorize(err))
+	assert.False(t, destination.has(index.Digest), "no manifest should be pushed when blobs are missing")
+
+	destination.put("", source.get(missing))
+	desc, err := Copy(context.Background(), source, "source", destination, "destination", WithManifestsOnly())
+	require.NoError(t, err)
+	assert.Equal(t, index.Digest, desc.Digest)
+	assert.Zero(t, source.fetches[missing], "blobs should not be transferred")
+	for dgst := range source.blob {
+		assert.True(t, destination.has(dgst), "destination should have %s", dgst)
+	}
+	_, tagged, err := destination.Resolve(context.Background(), "destination")
+	require.NoError(t, err)
+	assert.Equal(t, index.Digest, tagged.Digest)
+}
+
+func TestWithTag(t *testing.T) {
+	for ref, expected := range map[string]string{
+		"ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest": "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:tag",
+		"ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar":        "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:tag",
+		"123456789012.dkr.ecr.us-west-2.amazonaws.com/foo@sha256:abc":          "123456789012.dkr.ecr.us-west-2.amazonaws.com/foo:tag",
+		"123456789012.dkr.ecr.us-west-2.amazonaws.com/foo:latest@sha256:abc":   "123456789012.dkr.ecr.us-west-2.amazonaws.com/foo:tag",
+		"registry.example.com:5000/foo":                                        "registry.example.com:5000/foo:tag",
+	} {
+		assert.Equal(t, expected, withTag(ref, "tag"), ref)
+	}
+}
+
+// orderCheckingRegistry fails pushes of manifests and indexes whose children
+// are not yet stored, and holds the first blob pushed until a second starts.
+type orderCheckingRegistry struct {
+	*fakeRegistry
+	children map[digest.Digest][]digest.Digest
+	started  chan struct{}
+}
+
+func (r *orderCheckingRegistry) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	pusher, err := r.fakeRegistry.Pusher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &orderCheckingPusher{Pusher: pusher, registry: r}, nil
+}
+
+type orderCheckingPusher struct {
+	remotes.Pusher
+	registry *orderCheckingRegistry
+}
+
+func (p *orderCheckingPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	children, ok := p.registry.children[desc.Digest]
+	if !ok {
+		select {
+		case p.registry.started <- struct{}{}:
+		case <-p.registry.started:
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("blobs not pushed concurrently")
+		}
+	}
+	for _, child := range children {
+		if !p.registry.has(child) {
+			return nil, fmt.Errorf("%s pushed before its child %s", desc.Digest, child)
+		}
+	}
+	return p.Pusher.Push(ctx, desc)
+}
+
+func TestCopyConcurrency(t *testing.T) {
+	source := newFakeRegistry()
+	index, manifests := putMultiArchImage(source, "source")
+	children := map[digest.Digest][]digest.Digest{}
+	for _, desc := range manifests {
+		children[index.Digest] = append(children[index.Digest], desc.Digest)
+		var manifest ocispec.Manifest
+		require.NoError(t, json.Unmarshal(source.get(desc.Digest), &manifest))
+		children[desc.Digest] = []digest.Digest{manifest.Config.Digest, manifest.Layers[0].Digest}
+	}
+	destination := &orderCheckingRegistry{
+		fakeRegistry: newFakeRegistry(),
+		children:     children,
+		started:      make(chan struct{}),
+	}
+
+	desc, err := Copy(context.Background(), source, "source", destination, "destination", WithCopyConcurrency(4))
+	require.NoError(t, err)
+	assert.Equal(t, index.Digest, desc.Digest)
+	for dgst := range source.blob {
+		assert.True(t, destination.has(dgst), "destination should have %s", dgst)
+	}
+	_, tagged, err := destination.Resolve(context.Background(), "destination")
+	require.NoError(t, err)
+	assert.Equal(t, index.Digest, tagged.Digest)
+
+	_, err = newCopyOptions([]CopyOption{WithCopyConcurrency(0)})
+	assert.Error(t, err)
+}
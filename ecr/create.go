@@ -0,0 +1,107 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/log"
+)
+
+// CreateRepositoryOptions configures the repositories created by a resolver
+// configured with WithCreateRepositoryOnPush.  Settings left empty take ECR's
+// defaults.
+type CreateRepositoryOptions struct {
+	// ImageTagMutability is either ecr.ImageTagMutabilityMutable or
+	// ecr.ImageTagMutabilityImmutable.  If not specified, tags are mutable.
+	ImageTagMutability string
+	// EncryptionType is either ecr.EncryptionTypeAes256 or
+	// ecr.EncryptionTypeKms.  If not specified, layers are encrypted with
+	// AES-256.
+	EncryptionType string
+	// KMSKey is the key used when EncryptionType is ecr.EncryptionTypeKms.
+	// If not specified, the AWS managed key for ECR is used.
+	KMSKey string
+	// ScanOnPush configures whether images are scanned when pushed.
+	ScanOnPush bool
+	// Tags are the resource tags of the repository.
+	Tags map[string]string
+}
+
+// repositoryCreator creates the repositories found missing when pushing.
+type repositoryCreator struct {
+	options CreateRepositoryOptions
+}
+
+// createMissing creates the repository of base if err is ECR reporting that
+// it does not exist, and reports whether it did so, in which case the call
+// which failed with err can be made again.  A repository created concurrently
+// by another push is treated as created.  The creator may be nil, in which
+// case repositories are never created.
+func (c *repositoryCreator) createMissing(ctx context.Context, base *ecrBase, err error) (bool, error) {
+	if c == nil || !isRepositoryNotFound(err) {
+		return false, nil
+	}
+	ecrSpec := base.ecrSpec
+	input := &ecr.CreateRepositoryInput{
+		RegistryId:     aws.String(ecrSpec.Registry()),
+		RepositoryName: aws.String(ecrSpec.Repository),
+		ImageScanningConfiguration: &ecr.ImageScanningConfiguration{
+			ScanOnPush: aws.Bool(c.options.ScanOnPush),
+		},
+	}
+	if c.options.ImageTagMutability != "" {
+		input.ImageTagMutability = aws.String(c.options.ImageTagMutability)
+	}
+	if c.options.EncryptionType != "" {
+		input.EncryptionConfiguration = &ecr.EncryptionConfiguration{
+			EncryptionType: aws.String(c.options.EncryptionType),
+		}
+		if c.options.KMSKey != "" {
+			input.EncryptionConfiguration.KmsKey = aws.String(c.options.KMSKey)
+		}
+	}
+	keys := make([]string, 0, len(c.options.Tags))
+	for key := range c.options.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		input.Tags = append(input.Tags, &ecr.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(c.options.Tags[key]),
+		})
+	}
+
+	_, err = base.client.CreateRepositoryWithContext(ctx, input)
+	switch {
+	case isAWSErrorCode(err, ecr.ErrCodeRepositoryAlreadyExistsException):
+		log.G(ctx).
+			WithField("repository", ecrSpec.Repository).
+			Debug("ecr.pusher.repository: repository created by another push")
+	case err != nil:
+		return false, fmt.Errorf("ecr: failed to create repository %s: %w", ecrSpec.Repository, err)
+	default:
+		log.G(ctx).
+			WithField("repository", ecrSpec.Repository).
+			Info("ecr.pusher.repository: created repository")
+	}
+	return true, nil
+}
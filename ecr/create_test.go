@@ -0,0 +1,185 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/remotes/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+)
+
+func TestPushCreatesMissingRepository(t *testing.T) {
+	created := 0
+	client := &fakeECRClient{
+		BatchCheckLayerAvailabilityFn: func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "not found", nil)
+		},
+		CreateRepositoryFn: func(_ aws.Context, input *ecr.CreateRepositoryInput, _ ...request.Option) (*ecr.CreateRepositoryOutput, error) {
+			created++
+			assert.Equal(t, &ecr.CreateRepositoryInput{
+				RegistryId:         aws.String("123456789012"),
+				RepositoryName:     aws.String("foo/bar"),
+				ImageTagMutability: aws.String(ecr.ImageTagMutabilityImmutable),
+				EncryptionConfiguration: &ecr.EncryptionConfiguration{
+					EncryptionType: aws.String(ecr.EncryptionTypeKms),
+					KmsKey:         aws.String("alias/images"),
+				},
+				ImageScanningConfiguration: &ecr.ImageScanningConfiguration{ScanOnPush: aws.Bool(true)},
+				Tags: []*ecr.Tag{
+					{Key: aws.String("service"), Value: aws.String("api")},
+					{Key: aws.String("team"), Value: aws.String("platform")},
+				},
+			}, input)
+			return &ecr.CreateRepositoryOutput{}, nil
+		},
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{UploadId: aws.String("upload"), PartSize: aws.Int64(1024)}, nil
+		},
+	}
+	resolver, err := NewResolver(WithCreateRepositoryOnPush(CreateRepositoryOptions{
+		ImageTagMutability: ecr.ImageTagMutabilityImmutable,
+		EncryptionType:     ecr.EncryptionTypeKms,
+		KMSKey:             "alias/images",
+		ScanOnPush:         true,
+		Tags:               map[string]string{"team": "platform", "service": "api"},
+	}))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	pusher, err := resolver.Pusher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest@"+testdata.InsignificantDigest.String())
+	require.NoError(t, err)
+
+	writer, err := pusher.Push(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    testdata.LayerDigest,
+		Size:      1,
+	})
+	require.NoError(t, err, "layer should be uploaded to the created repository")
+	require.NotNil(t, writer)
+	writer.Close()
+	assert.Equal(t, 1, created)
+}
+
+func TestManifestWriterCreatesMissingRepository(t *testing.T) {
+	imageDesc := ocispec.Descriptor{
+		Digest:    testdata.InsignificantDigest,
+		MediaType: ocispec.MediaTypeImageManifest,
+	}
+	puts, creates := 0, 0
+	client := &fakeECRClient{
+		PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+			puts++
+			if creates == 0 {
+				return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "not found", nil)
+			}
+			return &ecr.PutImageOutput{Image: &ecr.Image{ImageId: &ecr.ImageIdentifier{
+				ImageDigest: aws.String(imageDesc.Digest.String()),
+			}}}, nil
+		},
+		CreateRepositoryFn: func(aws.Context, *ecr.CreateRepositoryInput, ...request.Option) (*ecr.CreateRepositoryOutput, error) {
+			creates++
+			// Another push created the repository first.
+			return nil, awserr.New(ecr.ErrCodeRepositoryAlreadyExistsException, "exists", nil)
+		},
+	}
+	mw := &manifestWriter{
+		desc: imageDesc,
+		base: &ecrBase{
+			client: client,
+			ecrSpec: ECRSpec{
+				arn:        arn.ARN{AccountID: "registry"},
+				Repository: "repository",
+				Object:     "tag@" + imageDesc.Digest.String(),
+			},
+		},
+		tracker: docker.NewInMemoryTracker(),
+		ctx:     context.Background(),
+		creator: &repositoryCreator{},
+	}
+
+	_, err := mw.Write([]byte("manifest content"))
+	require.NoError(t, err)
+	err = mw.Commit(context.Background(), int64(len("manifest content")), imageDesc.Digest)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, puts, "PutImage should be retried once the repository exists")
+	assert.Equal(t, 1, creates)
+}
+
+func TestPushMissingRepositoryWithoutCreate(t *testing.T) {
+	client := &fakeECRClient{
+		BatchCheckLayerAvailabilityFn: func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "not found", nil)
+		},
+	}
+	pusher := &ecrPusher{
+		ecrBase: ecrBase{client: client},
+		tracker: docker.NewInMemoryTracker(),
+	}
+
+	_, err := pusher.Push(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    testdata.LayerDigest,
+	})
+	assert.True(t, isRepositoryNotFound(err), "push should fail: %v", err)
+}
+
+func TestPushRepositoryCreateFails(t *testing.T) {
+	denied := awserr.New("AccessDeniedException", "denied", nil)
+	client := &fakeECRClient{
+		BatchCheckLayerAvailabilityFn: func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "not found", nil)
+		},
+		CreateRepositoryFn: func(aws.Context, *ecr.CreateRepositoryInput, ...request.Option) (*ecr.CreateRepositoryOutput, error) {
+			return nil, denied
+		},
+	}
+	pusher := &ecrPusher{
+		ecrBase: ecrBase{client: client},
+		tracker: docker.NewInMemoryTracker(),
+		creator: &repositoryCreator{},
+	}
+
+	_, err := pusher.Push(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    testdata.LayerDigest,
+	})
+	assert.True(t, errors.Is(err, denied), "push should fail with the creation error: %v", err)
+}
+
+func TestWithCreateRepositoryOnPush(t *testing.T) {
+	for _, opts := range []CreateRepositoryOptions{
+		{ImageTagMutability: "SOMETIMES"},
+		{EncryptionType: "ROT13"},
+		{KMSKey: "alias/images"},
+		{EncryptionType: ecr.EncryptionTypeAes256, KMSKey: "alias/images"},
+	} {
+		_, err := NewResolver(WithCreateRepositoryOnPush(opts))
+		assert.Error(t, err, "%+v", opts)
+	}
+	_, err := NewResolver(WithCreateRepositoryOnPush(CreateRepositoryOptions{}))
+	assert.NoError(t, err)
+}
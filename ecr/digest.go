@@ -0,0 +1,162 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrDigestMismatch is wrapped by the errors of fetches whose content does not
+// match the digest or size of its descriptor, such as a download corrupted in
+// transit.  It wraps errdefs.ErrFailedPrecondition.
+var ErrDigestMismatch = fmt.Errorf("ecr: content digest mismatch: %w", errdefs.ErrFailedPrecondition)
+
+// digestFetchAttempts is the number of times content found not to match its
+// digest is fetched before ErrDigestMismatch is returned.
+const digestFetchAttempts = 2
+
+// digestBufferSize is the size up to which fetched blobs are verified in
+// memory rather than in a temporary file.
+const digestBufferSize = 1 << 20
+
+// mediaTypeDockerSchema1SignedManifest is the media type with which registries
+// serve signed Docker Schema 1 manifests.
+const mediaTypeDockerSchema1SignedManifest = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+
+// verifiesDigest reports whether the content fetched for desc is verified
+// against its digest.  The digests of Docker Schema 1 manifests do not cover
+// the signatures returned with them, so they are not verified.
+func verifiesDigest(desc ocispec.Descriptor) bool {
+	return desc.Digest.Validate() == nil &&
+		desc.MediaType != images.MediaTypeDockerSchema1Manifest &&
+		desc.MediaType != mediaTypeDockerSchema1SignedManifest
+}
+
+// verifyContent returns an error wrapping ErrDigestMismatch unless data
+// matches the digest and size of desc.
+func verifyContent(desc ocispec.Descriptor, data []byte) error {
+	return verifyDigest(desc, desc.Digest.Algorithm().FromBytes(data), int64(len(data)))
+}
+
+func verifyDigest(desc ocispec.Descriptor, actual digest.Digest, size int64) error {
+	if desc.Size > 0 && size != desc.Size {
+		return fmt.Errorf("%s: fetched %d bytes, expected %d: %w", desc.Digest, size, desc.Size, ErrDigestMismatch)
+	}
+	if actual != desc.Digest {
+		return fmt.Errorf("%s: fetched content has digest %s: %w", desc.Digest, actual, ErrDigestMismatch)
+	}
+	return nil
+}
+
+// fetchVerified fetches the blob desc with fetch, verifying its content
+// against its digest before it is returned.  A download which does not match
+// is fetched again from the start, once.  Blobs at or below the small blob
+// threshold, or up to digestBufferSize, are read into memory; larger blobs are
+// downloaded to a temporary file, removed when the returned reader is closed.
+func (f *ecrFetcher) fetchVerified(ctx context.Context, desc ocispec.Descriptor, fetch func(context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	rc, err := fetch(ctx)
+	if err != nil || !verifiesDigest(desc) {
+		return rc, err
+	}
+	for attempt := 1; ; attempt++ {
+		verified, err := f.readVerified(desc, rc)
+		if err == nil {
+			return verified, nil
+		}
+		if !errors.Is(err, ErrDigestMismatch) || attempt == digestFetchAttempts {
+			return nil, err
+		}
+		log.G(ctx).
+			WithError(err).
+			WithField("attempt", attempt).
+			Warn("ecr.fetcher.layer: retrying corrupt download")
+		f.events.emit(ctx, &LayerFetchRetry{
+			Repository: f.ecrSpec.Repository,
+			Digest:     desc.Digest,
+			Attempt:    attempt,
+			Err:        err,
+		})
+		if rc, err = fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readVerified reads the blob desc from rc, which it closes, and returns its
+// content once it has been verified against its digest.
+func (f *ecrFetcher) readVerified(desc ocispec.Descriptor, rc io.ReadCloser) (io.ReadCloser, error) {
+	defer rc.Close()
+	// A blob longer than its descriptor is read one byte past its size, so
+	// that the mismatch is found without reading the rest of it.
+	r := io.Reader(rc)
+	if desc.Size > 0 {
+		r = io.LimitReader(rc, desc.Size+1)
+	}
+	if isSmallBlob(desc, f.smallBlobThreshold) || isSmallBlob(desc, digestBufferSize) {
+		data, err := ioutil.ReadAll(r)
+		if err == nil {
+			err = verifyContent(desc, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	file, err := ioutil.TempFile("", "ecr-blob-")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &spooledBlob{File: file}
+	digester := desc.Digest.Algorithm().Digester()
+	n, err := copyPooled(io.MultiWriter(file, digester.Hash()), r)
+	if err == nil {
+		err = verifyDigest(desc, digester.Digest(), n)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	return spooled, nil
+}
+
+// spooledBlob is a verified blob downloaded to a temporary file, which is
+// removed when it is closed.
+type spooledBlob struct {
+	*os.File
+}
+
+func (b *spooledBlob) Close() error {
+	err := b.File.Close()
+	if removeErr := os.Remove(b.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
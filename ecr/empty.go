@@ -0,0 +1,170 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// mediaTypeEmptyJSON is the media type of the OCI empty descriptor, used as
+// the config of artifacts which have none.  Its content is emptyJSON.
+const mediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
+
+var emptyJSON = []byte("{}")
+
+// knownContent returns the content of desc without fetching it if its
+// digest is that of zero-length content or of emptyJSON.
+func knownContent(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, bool) {
+	if desc.Digest.Validate() != nil || !desc.Digest.Algorithm().Available() {
+		return nil, false
+	}
+	for _, data := range [][]byte{nil, emptyJSON} {
+		if desc.Digest == desc.Digest.Algorithm().FromBytes(data) {
+			log.G(ctx).Debug("ecr.fetcher: returning known content")
+			return ioutil.NopCloser(bytes.NewReader(data)), true
+		}
+	}
+	return nil, false
+}
+
+// isEmptyBlob reports whether desc describes zero-length content.  Its
+// digest is checked rather than its size, as descriptors in some older
+// manifests have no size.
+func isEmptyBlob(desc ocispec.Descriptor) bool {
+	return desc.Digest.Validate() == nil &&
+		desc.Digest.Algorithm().Available() &&
+		desc.Digest == desc.Digest.Algorithm().FromBytes(nil)
+}
+
+// emptyBlobWriter pushes a zero-length blob.  ECR's UploadLayerPart API does
+// not accept empty parts, so the blob is uploaded in a single request through
+// the registry's Docker Registry HTTP API instead.
+type emptyBlobWriter struct {
+	ctx     context.Context
+	base    *ecrBase
+	api     *registryAPI
+	desc    ocispec.Descriptor
+	tracker docker.StatusTracker
+	ref     string
+	written int64
+}
+
+var _ content.Writer = (*emptyBlobWriter)(nil)
+
+func (w *emptyBlobWriter) Write(b []byte) (int, error) {
+	w.written += int64(len(b))
+	return len(b), nil
+}
+
+func (w *emptyBlobWriter) Close() error {
+	return nil
+}
+
+func (w *emptyBlobWriter) Digest() digest.Digest {
+	return w.desc.Digest
+}
+
+func (w *emptyBlobWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if w.written != 0 || size > 0 {
+		return fmt.Errorf("empty blob %v: %d bytes written: %w", w.desc.Digest, w.written, errdefs.ErrFailedPrecondition)
+	}
+	if expected != "" && expected != w.desc.Digest {
+		return fmt.Errorf("empty blob %v: expected %v: %w", w.desc.Digest, expected, errdefs.ErrFailedPrecondition)
+	}
+	if err := w.api.putEmptyBlob(ctx, w.base.client, w.base.ecrSpec, w.desc.Digest); err != nil {
+		return err
+	}
+	log.G(w.ctx).Debug("ecr.pusher.blob.empty: uploaded")
+	if status, err := w.tracker.GetStatus(w.ref); err == nil {
+		status.UpdatedAt = time.Now()
+		w.tracker.SetStatus(w.ref, status)
+	}
+	return nil
+}
+
+func (w *emptyBlobWriter) Status() (content.Status, error) {
+	status, err := w.tracker.GetStatus(w.ref)
+	if err != nil {
+		return content.Status{}, err
+	}
+	return status.Status, nil
+}
+
+func (w *emptyBlobWriter) Truncate(size int64) error {
+	if size != 0 {
+		return errors.New("ecr.pusher.blob.empty: truncate not supported")
+	}
+	w.written = 0
+	return nil
+}
+
+// putEmptyBlob uploads the zero-length blob dgst to ecrSpec's repository in
+// a single request, as a monolithic upload.
+func (a *registryAPI) putEmptyBlob(ctx context.Context, client ecrAPI, ecrSpec ECRSpec, dgst digest.Digest) error {
+	endpoint, token, err := a.authorize(ctx, client, ecrSpec)
+	if err != nil {
+		return err
+	}
+	uploadURL := fmt.Sprintf("%s/v2/%s/blobs/uploads/", endpoint, ecrSpec.Repository)
+	req, err := http.NewRequest(http.MethodPost, uploadURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.do(ctx, req, token)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("ecr.pusher.blob.empty: unexpected status code %v: %v", uploadURL, resp.Status)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("ecr.pusher.blob.empty: %v: %w", uploadURL, err)
+	}
+	query := location.Query()
+	query.Set("digest", dgst.String())
+	location.RawQuery = query.Encode()
+
+	req, err = http.NewRequest(http.MethodPut, location.String(), http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = a.do(ctx, req, token)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("ecr.pusher.blob.empty: unexpected status code %v: %v", location, resp.Status)
+	}
+	return nil
+}
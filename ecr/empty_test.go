@@ -0,0 +1,100 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+	"github.com/containerd/containerd/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchKnownContent(t *testing.T) {
+	// The fake client has no functions set, so any request to ECR panics.
+	fetcher := &ecrFetcher{ecrBase: ecrBase{client: &fakeECRClient{}}}
+	for _, test := range []struct {
+		desc     ocispec.Descriptor
+		expected string
+	}{
+		{
+			desc:     ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: testdata.EmptyDigest},
+			expected: "",
+		},
+		{
+			desc:     ocispec.Descriptor{MediaType: mediaTypeEmptyJSON, Digest: testdata.EmptyJSONDigest, Size: 2},
+			expected: "{}",
+		},
+	} {
+		t.Run(test.desc.MediaType, func(t *testing.T) {
+			rc, err := fetcher.Fetch(context.Background(), test.desc)
+			require.NoError(t, err)
+			defer rc.Close()
+			data, err := ioutil.ReadAll(rc)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, string(data))
+		})
+	}
+}
+
+func TestPushEmptyBlob(t *testing.T) {
+	var requests []string
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		assert.Equal(t, "Basic token", r.Header.Get("Authorization"))
+		switch r.Method {
+		case http.MethodPost:
+			w.Header().Set("Location", "/v2/team/b/blobs/uploads/session?state=1")
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPut:
+			assert.Equal(t, testdata.EmptyDigest.String(), r.URL.Query().Get("digest"))
+			assert.Equal(t, "1", r.URL.Query().Get("state"), "upload state should be kept")
+			assert.Zero(t, r.ContentLength)
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer registry.Close()
+	client := newMountTestClient(registry)
+	client.InitiateLayerUploadFn = func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+		t.Error("empty layer should not be uploaded in parts")
+		return nil, errors.New("unexpected upload")
+	}
+	pusher := newMountTestPusher(t, client)
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: testdata.EmptyDigest}
+
+	writer, err := pusher.Push(context.Background(), desc)
+	require.NoError(t, err)
+	require.NoError(t, writer.Commit(context.Background(), 0, desc.Digest))
+	assert.Equal(t, []string{
+		"POST /v2/team/b/blobs/uploads/",
+		"PUT /v2/team/b/blobs/uploads/session",
+	}, requests)
+
+	writer, err = pusher.Push(context.Background(), desc)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("data"))
+	require.NoError(t, err)
+	err = writer.Commit(context.Background(), 4, desc.Digest)
+	assert.True(t, errdefs.IsFailedPrecondition(err), "content written to an empty blob should be rejected: %v", err)
+}
@@ -0,0 +1,394 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+// FetchError is returned when a layer cannot be fetched.  Transient failures,
+// such as throttling, server errors, and dropped connections, are retried
+// before being returned.  Permanent failures, such as a layer missing from the
+// repository, are returned immediately.
+type FetchError struct {
+	// Digest of the layer being fetched.
+	Digest digest.Digest
+	// Code is the error code returned by ECR, if any.
+	Code string
+	// StatusCode is the HTTP status of the failed response, if any.
+	StatusCode int
+	// Transient reports whether the failure may succeed if retried later.
+	Transient bool
+	Err       error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("ecr: failed to fetch %s: %v", e.Digest, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports layers and repositories which ECR reports as missing as
+// errdefs.ErrNotFound.
+func (e *FetchError) Is(target error) bool {
+	if target != errdefs.ErrNotFound {
+		return false
+	}
+	switch e.Code {
+	case ecr.ErrCodeLayersNotFoundException,
+		ecr.ErrCodeRepositoryNotFoundException,
+		ecr.ErrCodeImageNotFoundException:
+		return true
+	}
+	return false
+}
+
+// IsTransientError reports whether err is a failure which may succeed if
+// retried later.
+func IsTransientError(err error) bool {
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		return fetchErr.Transient
+	}
+	return isTransient(err)
+}
+
+func newFetchError(dgst digest.Digest, err error) *FetchError {
+	fetchErr := &FetchError{
+		Digest:    dgst,
+		Transient: isTransient(err),
+		Err:       err,
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		fetchErr.Code = awsErr.Code()
+	}
+	var requestErr awserr.RequestFailure
+	var statusErr *httpStatusError
+	if errors.As(err, &requestErr) {
+		fetchErr.StatusCode = requestErr.StatusCode()
+	} else if errors.As(err, &statusErr) {
+		fetchErr.StatusCode = statusErr.statusCode
+	}
+	return fetchErr
+}
+
+// ContentError is the failure of an operation on a single manifest or blob,
+// as listed by an AggregateError.
+type ContentError struct {
+	// Op is the operation which failed, such as "push" or "pull".
+	Op string
+	// Digest of the manifest or blob.
+	Digest digest.Digest
+	Err    error
+}
+
+func (e *ContentError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Digest, e.Err)
+}
+
+func (e *ContentError) Unwrap() error {
+	return e.Err
+}
+
+// AggregateError is returned by operations on several manifests and blobs,
+// such as Copy and PullAll, when any of them fail.  Every failure is kept, so
+// that a failure common to all the content, such as a lack of permission, is
+// told apart from one affecting a single layer.  errors.Is and errors.As
+// match the errors of any of its members.
+type AggregateError struct {
+	// Errors lists the failures in the order in which they occurred.
+	Errors []*ContentError
+}
+
+// aggregateErrorGroups bounds the distinct failures described by Error.
+const aggregateErrorGroups = 3
+
+// Error summarizes the failures, describing failures of the same operation
+// with the same error once.
+func (e *AggregateError) Error() string {
+	if len(e.Errors) == 1 {
+		return "ecr: " + e.Errors[0].Error()
+	}
+	type group struct {
+		first *ContentError
+		count int
+	}
+	var groups []*group
+	seen := map[string]*group{}
+	for _, err := range e.Errors {
+		key := err.Op + "\x00" + err.Err.Error()
+		if g, ok := seen[key]; ok {
+			g.count++
+			continue
+		}
+		seen[key] = &group{first: err, count: 1}
+		groups = append(groups, seen[key])
+	}
+	summaries := make([]string, 0, aggregateErrorGroups+1)
+	for i, g := range groups {
+		if i == aggregateErrorGroups {
+			summaries = append(summaries, fmt.Sprintf("%d more distinct failures", len(groups)-i))
+			break
+		}
+		summary := g.first.Error()
+		if g.count > 1 {
+			summary += fmt.Sprintf(" (and %d more)", g.count-1)
+		}
+		summaries = append(summaries, summary)
+	}
+	return fmt.Sprintf("ecr: %d operations failed: %s", len(e.Errors), strings.Join(summaries, "; "))
+}
+
+// Is reports whether the error of any member matches target.
+func (e *AggregateError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first member whose error matches target.
+func (e *AggregateError) As(target interface{}) bool {
+	for _, err := range e.Errors {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregateErrors collects the failures of operations on content, which may
+// run concurrently.
+type aggregateErrors struct {
+	lock   sync.Mutex
+	errors []*ContentError
+}
+
+func (a *aggregateErrors) add(op string, dgst digest.Digest, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.errors = append(a.errors, &ContentError{Op: op, Digest: dgst, Err: err})
+}
+
+// err returns an *AggregateError of the failures collected, or nil if there
+// were none.
+func (a *aggregateErrors) err() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.errors) == 0 {
+		return nil
+	}
+	return &AggregateError{Errors: a.errors}
+}
+
+// isTransient classifies errors from ECR and from layer download URLs.  Only
+// errors known to be transient are reported as such: unlike the AWS SDK's
+// retry classification, errors which are not recognized are not retried.
+func isTransient(err error) bool {
+	if errors.Is(err, ErrTransferStalled) {
+		return true
+	}
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrOffline) {
+		return false
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return isTransientStatus(statusErr.statusCode)
+	}
+	var requestErr awserr.RequestFailure
+	if errors.As(err, &requestErr) && isTransientStatus(requestErr.StatusCode()) {
+		return true
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case request.ErrCodeRequestError, request.ErrCodeResponseTimeout:
+			return true
+		}
+		return request.IsErrorThrottle(awsErr)
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func isTransientStatus(statusCode int) bool {
+	return statusCode >= 500 ||
+		statusCode == http.StatusTooManyRequests ||
+		statusCode == http.StatusRequestTimeout
+}
+
+// httpStatusError is returned for unsuccessful responses from layer URLs.
+type httpStatusError struct {
+	url        string
+	statusCode int
+	status     string
+	// code and message are those of the Amazon S3 error in the response
+	// body, if any.
+	code    string
+	message string
+}
+
+// s3ErrorBodyLimit bounds the bytes of response bodies read for the errors
+// returned by Amazon S3.
+const s3ErrorBodyLimit = 4096
+
+// readS3Error returns the code and message of the Amazon S3 error document
+// in body, or empty strings if body does not hold one.
+func readS3Error(body io.Reader) (string, string) {
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(body, s3ErrorBodyLimit)).Decode(&s3Err); err != nil {
+		return "", ""
+	}
+	return s3Err.Code, s3Err.Message
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("ecr.fetcher.layer.url: unexpected status code %v: %v", e.url, e.status)
+}
+
+// ErrorCategory is a class of failure, allowing programs built on this
+// package to react to failures without inspecting each error type.
+type ErrorCategory int
+
+const (
+	// ErrorCategoryUnknown is any failure not in another category.
+	ErrorCategoryUnknown ErrorCategory = iota
+	// ErrorCategoryAuth is a failure to authenticate, or a lack of
+	// permission for the requested operation.
+	ErrorCategoryAuth
+	// ErrorCategoryNotFound is a missing repository, image, or layer.
+	ErrorCategoryNotFound
+	// ErrorCategoryThrottled is a request rejected by request rate limits.
+	ErrorCategoryThrottled
+	// ErrorCategoryVerification is content which does not match its
+	// descriptor, such as a layer with the wrong digest or a manifest which
+	// cannot be parsed.
+	ErrorCategoryVerification
+	// ErrorCategoryTimeout is an operation which did not complete by its
+	// deadline, or a transfer which stalled.
+	ErrorCategoryTimeout
+)
+
+func (c ErrorCategory) String() string {
+	switch c {
+	case ErrorCategoryAuth:
+		return "auth"
+	case ErrorCategoryNotFound:
+		return "not found"
+	case ErrorCategoryThrottled:
+		return "throttled"
+	case ErrorCategoryVerification:
+		return "verification"
+	case ErrorCategoryTimeout:
+		return "timeout"
+	}
+	return "unknown"
+}
+
+// ExitCode returns the exit status used for the category by the example
+// programs.  The values are stable, so that scripts may branch on them: 1 for
+// unknown failures, then 3 through 7 for the other categories in the order
+// in which they are declared.
+func (c ErrorCategory) ExitCode() int {
+	switch c {
+	case ErrorCategoryAuth:
+		return 3
+	case ErrorCategoryNotFound:
+		return 4
+	case ErrorCategoryThrottled:
+		return 5
+	case ErrorCategoryVerification:
+		return 6
+	case ErrorCategoryTimeout:
+		return 7
+	}
+	return 1
+}
+
+// authErrorCodes are the AWS error codes of failures to authenticate or
+// authorize requests.
+var authErrorCodes = map[string]bool{
+	"AccessDeniedException":       true,
+	"ExpiredTokenException":       true,
+	"InvalidSignatureException":   true,
+	"NoCredentialProviders":       true,
+	"UnrecognizedClientException": true,
+}
+
+// Categorize returns the category of err.
+func Categorize(err error) ErrorCategory {
+	var (
+		awsErr     awserr.Error
+		requestErr awserr.RequestFailure
+		statusErr  *httpStatusError
+		corruptErr *LayerCorruptionError
+		rateErr    *PublicRateLimitError
+		statusCode int
+	)
+	if errors.As(err, &requestErr) {
+		statusCode = requestErr.StatusCode()
+	} else if errors.As(err, &statusErr) {
+		statusCode = statusErr.statusCode
+	}
+	switch {
+	case err == nil:
+		return ErrorCategoryUnknown
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrTransferStalled):
+		return ErrorCategoryTimeout
+	case errors.As(err, &awsErr) && authErrorCodes[awsErr.Code()],
+		statusCode == http.StatusUnauthorized,
+		statusCode == http.StatusForbidden:
+		return ErrorCategoryAuth
+	case errors.As(err, &awsErr) && request.IsErrorThrottle(awsErr),
+		errors.As(err, &rateErr),
+		errors.Is(err, ErrAPICallBudgetExceeded),
+		statusCode == http.StatusTooManyRequests:
+		return ErrorCategoryThrottled
+	case errors.Is(err, ErrRepositoryNotFound),
+		errdefs.IsNotFound(err),
+		isAWSErrorCode(err, ecr.ErrCodeRepositoryNotFoundException),
+		isAWSErrorCode(err, ecr.ErrCodeImageNotFoundException),
+		isAWSErrorCode(err, ecr.ErrCodeLayersNotFoundException):
+		return ErrorCategoryNotFound
+	case errors.As(err, &corruptErr),
+		errors.Is(err, ErrInvalidManifest),
+		errdefs.IsFailedPrecondition(err):
+		return ErrorCategoryVerification
+	}
+	return ErrorCategoryUnknown
+}
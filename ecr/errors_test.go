@@ -0,0 +1,222 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsTransientError(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{name: "throttled", err: awserr.New("ThrottlingException", "Rate exceeded", nil), transient: true},
+		{name: "server error", err: awserr.NewRequestFailure(awserr.New("ServerException", "", nil), 500, ""), transient: true},
+		{name: "request error", err: awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("reset")), transient: true},
+		{name: "layers not found", err: awserr.NewRequestFailure(awserr.New(ecr.ErrCodeLayersNotFoundException, "", nil), 400, "")},
+		{name: "layer inaccessible", err: awserr.New(ecr.ErrCodeLayerInaccessibleException, "", nil)},
+		{name: "status 503", err: &httpStatusError{statusCode: http.StatusServiceUnavailable}, transient: true},
+		{name: "status 429", err: &httpStatusError{statusCode: http.StatusTooManyRequests}, transient: true},
+		{name: "status 403", err: &httpStatusError{statusCode: http.StatusForbidden}},
+		{name: "network", err: fmt.Errorf("failed to do request: %w", &net.OpError{Op: "read", Err: errors.New("reset")}), transient: true},
+		{name: "canceled", err: fmt.Errorf("failed to do request: %w", context.Canceled)},
+		{name: "unknown", err: errors.New("unknown")},
+		{name: "fetch error", err: &FetchError{Transient: true, Err: errors.New("unknown")}, transient: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.transient, IsTransientError(tc.err))
+		})
+	}
+}
+
+func TestCategorize(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		category ErrorCategory
+	}{
+		{name: "access denied", err: awserr.NewRequestFailure(awserr.New("AccessDeniedException", "", nil), 400, ""), category: ErrorCategoryAuth},
+		{name: "no credentials", err: awserr.New("NoCredentialProviders", "no valid providers in chain", nil), category: ErrorCategoryAuth},
+		{name: "status 403", err: &httpStatusError{statusCode: http.StatusForbidden}, category: ErrorCategoryAuth},
+		{name: "repository not found", err: fmt.Errorf("foo: %w", ErrRepositoryNotFound), category: ErrorCategoryNotFound},
+		{name: "layers not found", err: &FetchError{Code: ecr.ErrCodeLayersNotFoundException}, category: ErrorCategoryNotFound},
+		{name: "image not found", err: awserr.New(ecr.ErrCodeImageNotFoundException, "", nil), category: ErrorCategoryNotFound},
+		{name: "throttled", err: awserr.New("ThrottlingException", "Rate exceeded", nil), category: ErrorCategoryThrottled},
+		{name: "API call budget", err: fmt.Errorf("BatchGetImage: 1 calls: %w", ErrAPICallBudgetExceeded), category: ErrorCategoryThrottled},
+		{name: "status 429", err: &FetchError{Err: &httpStatusError{statusCode: http.StatusTooManyRequests}}, category: ErrorCategoryThrottled},
+		{name: "corrupt layer", err: &LayerCorruptionError{}, category: ErrorCategoryVerification},
+		{name: "invalid manifest", err: fmt.Errorf("failed to parse: %w", ErrInvalidManifest), category: ErrorCategoryVerification},
+		{name: "digest mismatch", err: fmt.Errorf("unexpected digest: %w", errdefs.ErrFailedPrecondition), category: ErrorCategoryVerification},
+		{name: "deadline", err: fmt.Errorf("failed to pull: %w", context.DeadlineExceeded), category: ErrorCategoryTimeout},
+		{name: "unknown", err: errors.New("unknown")},
+		{name: "nil"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			category := Categorize(tc.err)
+			assert.Equal(t, tc.category, category)
+			assert.Equal(t, tc.category.ExitCode() == 1, category == ErrorCategoryUnknown)
+		})
+	}
+}
+
+// newRetryTestFetcher returns a fetcher downloading layers from url.
+func newRetryTestFetcher(url string, events EventHandler) *ecrFetcher {
+	return &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(url)}, nil
+				},
+			},
+			ecrSpec: ECRSpec{Repository: "foo/bar"},
+			events:  events,
+		},
+	}
+}
+
+func TestFetchLayerRetriesTransientErrors(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "layer")
+	}))
+	defer ts.Close()
+	recorder := &eventRecorder{}
+	fetcher := newRetryTestFetcher(ts.URL, recorder.handle)
+
+	rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    testdata.LayerDigest,
+	})
+	require.NoError(t, err)
+	rc.Close()
+	assert.Equal(t, int32(2), requests)
+	require.Len(t, recorder.events, 3, "retry should be followed by the download's progress")
+	assert.Equal(t, 1, recorder.events[0].(*LayerFetchRetry).Attempt)
+	assert.Equal(t, ProgressStarted, recorder.events[1].(*Progress).State)
+	assert.Equal(t, ProgressCompleted, recorder.events[2].(*Progress).State)
+}
+
+func TestFetchLayerRetriesExhausted(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	fetcher := newRetryTestFetcher(ts.URL, nil)
+
+	_, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    testdata.LayerDigest,
+	})
+	var fetchErr *FetchError
+	require.True(t, errors.As(err, &fetchErr), "expected *FetchError, got %v", err)
+	assert.True(t, fetchErr.Transient)
+	assert.Equal(t, http.StatusInternalServerError, fetchErr.StatusCode)
+	assert.Equal(t, int32(layerFetchAttempts), requests)
+}
+
+func TestFetchLayerPermanentErrorNotRetried(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+	fetcher := newRetryTestFetcher(ts.URL, nil)
+
+	_, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    testdata.LayerDigest,
+	})
+	var fetchErr *FetchError
+	require.True(t, errors.As(err, &fetchErr), "expected *FetchError, got %v", err)
+	assert.False(t, fetchErr.Transient)
+	assert.Equal(t, http.StatusForbidden, fetchErr.StatusCode)
+	assert.Equal(t, testdata.LayerDigest, fetchErr.Digest)
+	assert.Equal(t, int32(1), requests, "permanent errors should not be retried")
+}
+
+func TestFetchLayerNotFound(t *testing.T) {
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					return nil, awserr.NewRequestFailure(awserr.New(ecr.ErrCodeLayersNotFoundException, "not found", nil), 400, "")
+				},
+			},
+		},
+	}
+
+	_, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    testdata.LayerDigest,
+	})
+	assert.True(t, errdefs.IsNotFound(err))
+	var fetchErr *FetchError
+	require.True(t, errors.As(err, &fetchErr))
+	assert.Equal(t, ecr.ErrCodeLayersNotFoundException, fetchErr.Code)
+	assert.Equal(t, 400, fetchErr.StatusCode)
+	assert.False(t, fetchErr.Transient)
+}
+
+func TestAggregateError(t *testing.T) {
+	denied := awserr.New("AccessDeniedException", "denied", nil)
+	err := &AggregateError{Errors: []*ContentError{
+		{Op: "push", Digest: "sha256:a", Err: denied},
+		{Op: "push", Digest: "sha256:b", Err: denied},
+		{Op: "push", Digest: "sha256:c", Err: &FetchError{Digest: "sha256:c", Err: errdefs.ErrNotFound}},
+	}}
+	assert.Equal(t, "ecr: 3 operations failed: push sha256:a: AccessDeniedException: denied (and 1 more); push sha256:c: ecr: failed to fetch sha256:c: not found", err.Error())
+	assert.True(t, errdefs.IsNotFound(err), "should match any member")
+	var fetchErr *FetchError
+	require.True(t, errors.As(err, &fetchErr))
+	assert.Equal(t, digest.Digest("sha256:c"), fetchErr.Digest)
+	var contentErr *ContentError
+	require.True(t, errors.As(err, &contentErr))
+	assert.Equal(t, digest.Digest("sha256:a"), contentErr.Digest, "should find the first member")
+	assert.Equal(t, ErrorCategoryAuth, Categorize(err))
+
+	single := &AggregateError{Errors: err.Errors[:1]}
+	assert.Equal(t, "ecr: push sha256:a: AccessDeniedException: denied", single.Error())
+
+	var collected aggregateErrors
+	assert.NoError(t, collected.err())
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Event is implemented by the events delivered to an EventHandler:
+// *ResolveStarted, *ResolveCompleted, *LayerFetchRetry, *PushManifestPut,
+// *Throttled, and *Progress.  Handlers should ignore events of other types, as
+// further events may be added.
+type Event interface {
+	isEvent()
+}
+
+// EventHandler receives the events of a resolver and the fetchers and pushers
+// created by it.  Handlers are called synchronously from the goroutine
+// performing the operation, possibly from several goroutines concurrently, and
+// should return quickly.
+type EventHandler func(ctx context.Context, event Event)
+
+// ResolveStarted is delivered when Resolve is called.
+type ResolveStarted struct {
+	Ref string
+}
+
+// ResolveCompleted is delivered when Resolve returns.  Err is set if the
+// reference could not be resolved, otherwise Name and Descriptor hold the
+// values returned by Resolve.
+type ResolveCompleted struct {
+	Ref        string
+	Name       string
+	Descriptor ocispec.Descriptor
+	Err        error
+	Duration   time.Duration
+}
+
+// LayerFetchRetry is delivered when an attempt to fetch a layer fails and is
+// to be retried: when ECR returns a retryable error for the layer's download
+// URL, when downloading from the URL fails with a transient error, when a
+// blob's download does not match its digest, or when a foreign layer is
+// to be fetched from its next URL.  Attempt is the number of
+// the failed attempt, starting at 1.
+type LayerFetchRetry struct {
+	Repository string
+	Digest     digest.Digest
+	Attempt    int
+	Err        error
+}
+
+// PushManifestPut is delivered when a manifest has been put to ECR.  Tag is
+// set if the put tagged the manifest.
+type PushManifestPut struct {
+	Ref        string
+	Descriptor ocispec.Descriptor
+	Tag        string
+}
+
+// Throttled is delivered when a request to ECR fails because the request rate
+// was exceeded.  Throttled requests are retried by the AWS SDK unless its
+// retries are exhausted.
+type Throttled struct {
+	Operation string
+	Region    string
+	Err       error
+}
+
+func (*ResolveStarted) isEvent()   {}
+func (*ResolveCompleted) isEvent() {}
+func (*LayerFetchRetry) isEvent()  {}
+func (*PushManifestPut) isEvent()  {}
+func (*Throttled) isEvent()        {}
+
+// emit delivers event to h, if set, and to the handler of ctx, if any.
+func (h EventHandler) emit(ctx context.Context, event Event) {
+	if h != nil {
+		h(ctx, event)
+	}
+	if observer, ok := ctx.Value(eventHandlerKey{}).(EventHandler); ok {
+		observer(ctx, event)
+	}
+}
+
+type eventHandlerKey struct{}
+
+// withEventHandler returns a context whose operations also deliver their
+// events to h, in addition to any handler of ctx.
+func withEventHandler(ctx context.Context, h EventHandler) context.Context {
+	if observer, ok := ctx.Value(eventHandlerKey{}).(EventHandler); ok {
+		inner := h
+		h = func(ctx context.Context, event Event) {
+			observer(ctx, event)
+			inner(ctx, event)
+		}
+	}
+	return context.WithValue(ctx, eventHandlerKey{}, h)
+}
+
+// retryHandler is added to the Retry handlers of ECR clients to deliver the
+// events for failed requests.  The Retry handlers run before the SDK
+// decides whether to retry the request and clears its error.
+func (h EventHandler) retryHandler(req *request.Request) {
+	if req.Error == nil {
+		return
+	}
+	ctx := req.Context()
+	if request.IsErrorThrottle(req.Error) {
+		h.emit(ctx, &Throttled{
+			Operation: req.Operation.Name,
+			Region:    aws.StringValue(req.Config.Region),
+			Err:       req.Error,
+		})
+	}
+	input, ok := req.Params.(*ecr.GetDownloadUrlForLayerInput)
+	if !ok || !req.ShouldRetry(req) || req.RetryCount >= req.MaxRetries() {
+		return
+	}
+	h.emit(ctx, &LayerFetchRetry{
+		Repository: aws.StringValue(input.RepositoryName),
+		Digest:     digest.Digest(aws.StringValue(input.LayerDigest)),
+		Attempt:    req.RetryCount + 1,
+		Err:        req.Error,
+	})
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eventRecorder is an EventHandler recording the events delivered to it.
+type eventRecorder struct {
+	lock   sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) handle(_ context.Context, event Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, event)
+}
+
+func TestResolveEvents(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	imageManifest := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	clock := &fakeClock{now: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			clock.advance(time.Second)
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(testdata.ImageDigest.String())},
+				ImageManifest: aws.String(imageManifest),
+			}}}, nil
+		},
+	}
+	recorder := &eventRecorder{}
+	resolver := &ecrResolver{
+		clients:      map[string]ecrAPI{"fake": fakeClient},
+		eventHandler: recorder.handle,
+		clock:        clock,
+	}
+
+	name, desc, err := resolver.Resolve(context.Background(), ref)
+	require.NoError(t, err)
+	require.Len(t, recorder.events, 2)
+	assert.Equal(t, &ResolveStarted{Ref: ref}, recorder.events[0])
+	completed, ok := recorder.events[1].(*ResolveCompleted)
+	require.True(t, ok, "expected ResolveCompleted, got %T", recorder.events[1])
+	assert.Equal(t, ref, completed.Ref)
+	assert.Equal(t, name, completed.Name)
+	assert.Equal(t, desc, completed.Descriptor)
+	assert.NoError(t, completed.Err)
+	assert.Equal(t, time.Second, completed.Duration, "resolves should be timed by the resolver's clock")
+}
+
+func TestResolveEventsError(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	expectedError := errors.New("expected")
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return nil, expectedError
+		},
+	}
+	recorder := &eventRecorder{}
+	resolver := &ecrResolver{
+		clients:      map[string]ecrAPI{"fake": fakeClient},
+		eventHandler: recorder.handle,
+	}
+
+	_, _, err := resolver.Resolve(context.Background(), ref)
+	assert.ErrorIs(t, err, expectedError)
+	require.Len(t, recorder.events, 2)
+	completed, ok := recorder.events[1].(*ResolveCompleted)
+	require.True(t, ok, "expected ResolveCompleted, got %T", recorder.events[1])
+	assert.ErrorIs(t, completed.Err, expectedError)
+}
+
+func TestFetchForeignLayerRetryEvent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, "layer")
+	}))
+	defer ts.Close()
+
+	recorder := &eventRecorder{}
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			ecrSpec: ECRSpec{Repository: "foo/bar"},
+			events:  recorder.handle,
+		},
+	}
+	desc := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2LayerForeignGzip,
+		Digest:    testdata.LayerDigest,
+		URLs:      []string{ts.URL + "/missing", ts.URL + "/ok"},
+	}
+
+	reader, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	reader.Close()
+
+	require.Len(t, recorder.events, 3, "retry should be followed by the download's progress")
+	retry, ok := recorder.events[0].(*LayerFetchRetry)
+	require.True(t, ok, "expected LayerFetchRetry, got %T", recorder.events[0])
+	assert.Equal(t, "foo/bar", retry.Repository)
+	assert.Equal(t, testdata.LayerDigest, retry.Digest)
+	assert.Equal(t, 1, retry.Attempt)
+	assert.Error(t, retry.Err)
+	assert.Equal(t, ProgressStarted, recorder.events[1].(*Progress).State)
+	assert.Equal(t, ProgressCompleted, recorder.events[2].(*Progress).State)
+}
+
+func TestPushManifestPutEvent(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest@" + testdata.InsignificantDigest.String()
+	ecrSpec, err := ParseRef(ref)
+	require.NoError(t, err)
+	desc := ocispec.Descriptor{
+		Digest:    testdata.InsignificantDigest,
+		MediaType: ocispec.MediaTypeImageManifest,
+	}
+	client := &fakeECRClient{
+		PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+			return &ecr.PutImageOutput{
+				Image: &ecr.Image{ImageId: &ecr.ImageIdentifier{ImageDigest: input.ImageDigest}},
+			}, nil
+		},
+	}
+	recorder := &eventRecorder{}
+	mw := &manifestWriter{
+		desc: desc,
+		base: &ecrBase{
+			client:  client,
+			ecrSpec: ecrSpec,
+			events:  recorder.handle,
+		},
+		tracker: docker.NewInMemoryTracker(),
+		ref:     ref,
+		ctx:     context.Background(),
+	}
+
+	_, err = mw.Write([]byte("manifest"))
+	require.NoError(t, err)
+	require.NoError(t, mw.Commit(context.Background(), int64(len("manifest")), desc.Digest))
+
+	assert.Equal(t, []Event{&PushManifestPut{
+		Ref:        ref,
+		Descriptor: desc,
+		Tag:        "latest",
+	}}, recorder.events)
+}
+
+func TestThrottledEvents(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"__type":"ThrottlingException","message":"Rate exceeded"}`)
+	}))
+	defer ts.Close()
+
+	config := request.WithRetryer(&aws.Config{
+		Endpoint:    aws.String(ts.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}, client.DefaultRetryer{
+		NumMaxRetries:    1,
+		MinRetryDelay:    time.Millisecond,
+		MaxRetryDelay:    time.Millisecond,
+		MinThrottleDelay: time.Millisecond,
+		MaxThrottleDelay: time.Millisecond,
+	})
+	recorder := &eventRecorder{}
+	resolver, err := NewResolver(
+		WithSession(session.Must(session.NewSession(config))),
+		WithEventHandler(recorder.handle))
+	require.NoError(t, err)
+
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	_, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    testdata.LayerDigest,
+	})
+	require.Error(t, err)
+	assert.Equal(t, 2, requests, "should retry once")
+
+	var throttled []*Throttled
+	var retries []*LayerFetchRetry
+	for _, event := range recorder.events {
+		switch e := event.(type) {
+		case *Throttled:
+			throttled = append(throttled, e)
+		case *LayerFetchRetry:
+			retries = append(retries, e)
+		}
+	}
+	require.Len(t, throttled, 2, "both attempts were throttled")
+	assert.Equal(t, "GetDownloadUrlForLayer", throttled[0].Operation)
+	assert.Equal(t, "fake", throttled[0].Region)
+	require.Len(t, retries, 1, "only the first attempt is retried")
+	assert.Equal(t, "foo/bar", retries[0].Repository)
+	assert.Equal(t, testdata.LayerDigest, retries[0].Digest)
+	assert.Equal(t, 1, retries[0].Attempt)
+}
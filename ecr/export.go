@@ -0,0 +1,199 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Export writes the image referenced by ref, resolved with source, to w as a
+// tar archive in the OCI image layout format.  Content is streamed from the
+// source fetcher to w without being stored locally, so w may be, for example,
+// the writer of a multipart upload.
+//
+// The archive's index.json lists the image, annotated with the tag of ref,
+// followed by its referrers annotated with their tags.  Of the options of
+// Copy, Export honours WithCopyPlatforms, WithoutCopyReferrers,
+// WithCopyReferrerTypes, WithoutCopyReferrerTypes, and WithLenientManifests.
+// The other options do not apply to an archive and are ignored: the whole
+// image is written, one blob at a time, and transfers are not reported.  The
+// descriptor of the exported root manifest or index is returned.
+func Export(ctx context.Context, source remotes.Resolver, ref string, w io.Writer, opts ...CopyOption) (ocispec.Descriptor, error) {
+	options, err := newCopyOptions(opts)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	name, desc, err := source.Resolve(ctx, ref)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	fetcher, err := source.Fetcher(ctx, name)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	c := newCopier(options, fetcher)
+	root, err := c.plan(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	_, tag := splitTag(ref)
+	manifests := []ocispec.Descriptor{withRefName(root, tag)}
+	nodes := c.nodes
+
+	if !options.SkipReferrers {
+		referrers, err := c.referrers(ctx, source, name)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		for _, r := range referrers {
+			referrer := newCopier(CopyOptions{SkipReferrers: true, Lenient: options.Lenient}, fetcher)
+			planned, err := referrer.plan(ctx, r.desc)
+			if err != nil {
+				return ocispec.Descriptor{}, fmt.Errorf("failed to export referrer %s: %w", r.tag, err)
+			}
+			manifests = append(manifests, withRefName(planned, r.tag))
+			nodes = append(nodes, referrer.nodes...)
+		}
+	}
+
+	layout := &layoutWriter{
+		tar:     tar.NewWriter(w),
+		fetcher: fetcher,
+		written: map[digest.Digest]struct{}{},
+	}
+	if err := layout.writeIndex(manifests); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	for _, node := range nodes {
+		if err := layout.writeNode(ctx, node); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	if err := layout.tar.Close(); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return root, nil
+}
+
+// withRefName returns desc annotated with the OCI layout reference name.
+func withRefName(desc ocispec.Descriptor, name string) ocispec.Descriptor {
+	if name == "" {
+		return desc
+	}
+	annotations := map[string]string{}
+	for k, v := range desc.Annotations {
+		annotations[k] = v
+	}
+	annotations[ocispec.AnnotationRefName] = name
+	desc.Annotations = annotations
+	return desc
+}
+
+// layoutWriter writes an OCI image layout to a tar stream.
+type layoutWriter struct {
+	tar     *tar.Writer
+	fetcher remotes.Fetcher
+	written map[digest.Digest]struct{}
+}
+
+// writeIndex writes the oci-layout file and an index.json listing manifests.
+// These are written ahead of the blobs so that readers of the stream learn
+// the layout's contents before reaching them.
+func (l *layoutWriter) writeIndex(manifests []ocispec.Descriptor) error {
+	layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := l.writeFile(ocispec.ImageLayoutFile, layout); err != nil {
+		return err
+	}
+	index, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: manifests,
+	})
+	if err != nil {
+		return err
+	}
+	return l.writeFile("index.json", index)
+}
+
+func (l *layoutWriter) writeFile(name string, data []byte) error {
+	if err := l.tar.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	_, err := l.tar.Write(data)
+	return err
+}
+
+// writeNode writes the content of node to the blobs directory, streaming it
+// from the fetcher unless the content is held by node.
+func (l *layoutWriter) writeNode(ctx context.Context, node copyNode) error {
+	if _, ok := l.written[node.desc.Digest]; ok {
+		return nil
+	}
+	if err := node.desc.Digest.Validate(); err != nil {
+		return err
+	}
+	if err := l.tar.WriteHeader(&tar.Header{
+		Name:     path.Join("blobs", node.desc.Digest.Algorithm().String(), node.desc.Digest.Encoded()),
+		Mode:     0444,
+		Size:     node.desc.Size,
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	l.written[node.desc.Digest] = struct{}{}
+
+	if node.content != nil {
+		_, err := l.tar.Write(node.content)
+		return err
+	}
+	log.G(ctx).WithField("desc", node.desc).Debug("ecr.export: writing blob")
+	rc, err := l.fetcher.Fetch(ctx, node.desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	verifier := node.desc.Digest.Verifier()
+	n, err := io.Copy(l.tar, io.TeeReader(io.LimitReader(rc, node.desc.Size), verifier))
+	if err != nil {
+		return err
+	}
+	if n != node.desc.Size || !verifier.Verified() {
+		return fmt.Errorf("content of %s does not match descriptor: %w", node.desc.Digest, errdefs.ErrFailedPrecondition)
+	}
+	return nil
+}
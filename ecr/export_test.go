@@ -0,0 +1,98 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readLayout reads the files of a tar archive, in order.
+func readLayout(t *testing.T, r io.Reader) ([]string, map[string][]byte) {
+	var names []string
+	files := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names, files
+		}
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		files[hdr.Name] = data
+	}
+}
+
+func TestExport(t *testing.T) {
+	source := newFakeRegistry()
+	index, _ := putMultiArchImage(source, "example.com/source:latest")
+	signature := putSignature(source, "example.com/source", index)
+
+	var buf bytes.Buffer
+	desc, err := Export(context.Background(), source, "example.com/source:latest", &buf)
+	require.NoError(t, err)
+	assert.Equal(t, index.Digest, desc.Digest)
+
+	names, files := readLayout(t, &buf)
+	require.True(t, len(names) > 2)
+	assert.Equal(t, []string{ocispec.ImageLayoutFile, "index.json"}, names[:2],
+		"layout metadata should precede blobs")
+	assert.JSONEq(t, `{"imageLayoutVersion":"1.0.0"}`, string(files[ocispec.ImageLayoutFile]))
+
+	var layoutIndex ocispec.Index
+	require.NoError(t, json.Unmarshal(files["index.json"], &layoutIndex))
+	require.Len(t, layoutIndex.Manifests, 2)
+	assert.Equal(t, index.Digest, layoutIndex.Manifests[0].Digest)
+	assert.Equal(t, "latest", layoutIndex.Manifests[0].Annotations[ocispec.AnnotationRefName])
+	assert.Equal(t, signature.Digest, layoutIndex.Manifests[1].Digest)
+	assert.Equal(t, "sha256-"+index.Digest.Encoded()+".sig", layoutIndex.Manifests[1].Annotations[ocispec.AnnotationRefName])
+
+	for dgst, data := range source.blob {
+		exported, ok := files["blobs/sha256/"+dgst.Encoded()]
+		if assert.True(t, ok, "layout should contain %s", dgst) {
+			assert.Equal(t, dgst, digest.FromBytes(exported))
+			assert.Equal(t, data, exported)
+		}
+	}
+	assert.Len(t, names, 2+len(source.blob), "blobs should be written once")
+}
+
+func TestExportPlatforms(t *testing.T) {
+	source := newFakeRegistry()
+	_, manifests := putMultiArchImage(source, "example.com/source:latest")
+
+	var buf bytes.Buffer
+	desc, err := Export(context.Background(), source, "example.com/source:latest", &buf,
+		WithCopyPlatforms("linux/arm64"), WithoutCopyReferrers())
+	require.NoError(t, err)
+
+	_, files := readLayout(t, &buf)
+	assert.Contains(t, files, "blobs/sha256/"+desc.Digest.Encoded())
+	assert.Contains(t, files, "blobs/sha256/"+manifests[1].Digest.Encoded())
+	assert.NotContains(t, files, "blobs/sha256/"+manifests[0].Digest.Encoded())
+}
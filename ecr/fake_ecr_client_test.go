@@ -25,13 +25,22 @@ import (
 // Each method is backed by a function contained in the struct.  Nil functions
 // will cause panics when invoked.
 type fakeECRClient struct {
-	BatchGetImageFn               func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error)
-	GetDownloadUrlForLayerFn      func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error)
-	BatchCheckLayerAvailabilityFn func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error)
-	InitiateLayerUploadFn         func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error)
-	UploadLayerPartFn             func(*ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error)
-	CompleteLayerUploadFn         func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error)
-	PutImageFn                    func(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error)
+	BatchGetImageFn                 func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error)
+	GetDownloadUrlForLayerFn        func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error)
+	BatchCheckLayerAvailabilityFn   func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error)
+	InitiateLayerUploadFn           func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error)
+	UploadLayerPartFn               func(*ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error)
+	CompleteLayerUploadFn           func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error)
+	PutImageFn                      func(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error)
+	DescribeRepositoriesFn          func(aws.Context, *ecr.DescribeRepositoriesInput, ...request.Option) (*ecr.DescribeRepositoriesOutput, error)
+	GetRepositoryPolicyFn           func(aws.Context, *ecr.GetRepositoryPolicyInput, ...request.Option) (*ecr.GetRepositoryPolicyOutput, error)
+	DescribeRegistryFn              func(aws.Context, *ecr.DescribeRegistryInput, ...request.Option) (*ecr.DescribeRegistryOutput, error)
+	GetAuthorizationTokenFn         func(aws.Context, *ecr.GetAuthorizationTokenInput, ...request.Option) (*ecr.GetAuthorizationTokenOutput, error)
+	DescribeImagesFn                func(aws.Context, *ecr.DescribeImagesInput, ...request.Option) (*ecr.DescribeImagesOutput, error)
+	ListImagesFn                    func(aws.Context, *ecr.ListImagesInput, ...request.Option) (*ecr.ListImagesOutput, error)
+	CreateRepositoryFn              func(aws.Context, *ecr.CreateRepositoryInput, ...request.Option) (*ecr.CreateRepositoryOutput, error)
+	DescribePullThroughCacheRulesFn func(aws.Context, *ecr.DescribePullThroughCacheRulesInput, ...request.Option) (*ecr.DescribePullThroughCacheRulesOutput, error)
+	DescribeImageScanFindingsFn     func(aws.Context, *ecr.DescribeImageScanFindingsInput, ...request.Option) (*ecr.DescribeImageScanFindingsOutput, error)
 }
 
 var _ ecrAPI = (*fakeECRClient)(nil)
@@ -63,3 +72,39 @@ func (f *fakeECRClient) CompleteLayerUpload(arg *ecr.CompleteLayerUploadInput) (
 func (f *fakeECRClient) PutImageWithContext(ctx aws.Context, arg *ecr.PutImageInput, opts ...request.Option) (*ecr.PutImageOutput, error) {
 	return f.PutImageFn(ctx, arg, opts...)
 }
+
+func (f *fakeECRClient) DescribeRepositoriesWithContext(ctx aws.Context, arg *ecr.DescribeRepositoriesInput, opts ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+	return f.DescribeRepositoriesFn(ctx, arg, opts...)
+}
+
+func (f *fakeECRClient) GetRepositoryPolicyWithContext(ctx aws.Context, arg *ecr.GetRepositoryPolicyInput, opts ...request.Option) (*ecr.GetRepositoryPolicyOutput, error) {
+	return f.GetRepositoryPolicyFn(ctx, arg, opts...)
+}
+
+func (f *fakeECRClient) DescribeRegistryWithContext(ctx aws.Context, arg *ecr.DescribeRegistryInput, opts ...request.Option) (*ecr.DescribeRegistryOutput, error) {
+	return f.DescribeRegistryFn(ctx, arg, opts...)
+}
+
+func (f *fakeECRClient) GetAuthorizationTokenWithContext(ctx aws.Context, arg *ecr.GetAuthorizationTokenInput, opts ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+	return f.GetAuthorizationTokenFn(ctx, arg, opts...)
+}
+
+func (f *fakeECRClient) DescribeImagesWithContext(ctx aws.Context, arg *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	return f.DescribeImagesFn(ctx, arg, opts...)
+}
+
+func (f *fakeECRClient) ListImagesWithContext(ctx aws.Context, arg *ecr.ListImagesInput, opts ...request.Option) (*ecr.ListImagesOutput, error) {
+	return f.ListImagesFn(ctx, arg, opts...)
+}
+
+func (f *fakeECRClient) CreateRepositoryWithContext(ctx aws.Context, arg *ecr.CreateRepositoryInput, opts ...request.Option) (*ecr.CreateRepositoryOutput, error) {
+	return f.CreateRepositoryFn(ctx, arg, opts...)
+}
+
+func (f *fakeECRClient) DescribePullThroughCacheRulesWithContext(ctx aws.Context, arg *ecr.DescribePullThroughCacheRulesInput, opts ...request.Option) (*ecr.DescribePullThroughCacheRulesOutput, error) {
+	return f.DescribePullThroughCacheRulesFn(ctx, arg, opts...)
+}
+
+func (f *fakeECRClient) DescribeImageScanFindingsWithContext(ctx aws.Context, arg *ecr.DescribeImageScanFindingsInput, opts ...request.Option) (*ecr.DescribeImageScanFindingsOutput, error) {
+	return f.DescribeImageScanFindingsFn(ctx, arg, opts...)
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeRegistry is an in-memory remotes.Resolver that can be used as the
+// source or destination of operations spanning registries.
+type fakeRegistry struct {
+	mu   sync.Mutex
+	refs map[string]ocispec.Descriptor
+	blob map[digest.Digest][]byte
+	// fetches and pushes count the transfers of each digest.
+	fetches map[digest.Digest]int
+	pushes  map[digest.Digest]int
+}
+
+var (
+	_ remotes.Resolver = (*fakeRegistry)(nil)
+	_ BlobProber       = (*fakeRegistry)(nil)
+)
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		refs:    map[string]ocispec.Descriptor{},
+		blob:    map[digest.Digest][]byte{},
+		fetches: map[digest.Digest]int{},
+		pushes:  map[digest.Digest]int{},
+	}
+}
+
+// put stores data and returns its descriptor.
+func (r *fakeRegistry) put(mediaType string, data []byte) ocispec.Descriptor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	r.blob[desc.Digest] = data
+	return desc
+}
+
+// putJSON stores the JSON encoding of v and returns its descriptor.
+func (r *fakeRegistry) putJSON(mediaType string, v interface{}) ocispec.Descriptor {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return r.put(mediaType, data)
+}
+
+// putImage stores a single-layer image manifest for platform.
+func (r *fakeRegistry) putImage(platform ocispec.Platform) ocispec.Descriptor {
+	config := r.putJSON(ocispec.MediaTypeImageConfig, ocispec.Image{
+		Architecture: platform.Architecture,
+		OS:           platform.OS,
+	})
+	layer := r.put(ocispec.MediaTypeImageLayerGzip, []byte("layer for "+platform.Architecture))
+	manifest := r.putJSON(ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	manifest.Platform = &platform
+	return manifest
+}
+
+// tag points name at desc.
+func (r *fakeRegistry) tag(name string, desc ocispec.Descriptor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refs[name] = desc
+}
+
+func (r *fakeRegistry) has(dgst digest.Digest) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.blob[dgst]
+	return ok
+}
+
+func (r *fakeRegistry) get(dgst digest.Digest) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.blob[dgst]
+}
+
+func (r *fakeRegistry) Resolve(_ context.Context, ref string) (string, ocispec.Descriptor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	desc, ok := r.refs[ref]
+	if !ok {
+		// Content is resolved by digest regardless of the name.
+		if i := strings.LastIndex(ref, "@"); i >= 0 {
+			if data, ok := r.blob[digest.Digest(ref[i+1:])]; ok {
+				return ref, ocispec.Descriptor{Digest: digest.Digest(ref[i+1:]), Size: int64(len(data))}, nil
+			}
+		}
+		return "", ocispec.Descriptor{}, fmt.Errorf("%s: %w", ref, errdefs.ErrNotFound)
+	}
+	return ref, desc, nil
+}
+
+func (r *fakeRegistry) Fetcher(context.Context, string) (remotes.Fetcher, error) {
+	return r, nil
+}
+
+func (r *fakeRegistry) Fetch(_ context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, ok := r.blob[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", desc.Digest, errdefs.ErrNotFound)
+	}
+	r.fetches[desc.Digest]++
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (r *fakeRegistry) Pusher(_ context.Context, ref string) (remotes.Pusher, error) {
+	return &fakeRegistryPusher{registry: r, ref: ref}, nil
+}
+
+type fakeRegistryPusher struct {
+	registry *fakeRegistry
+	ref      string
+}
+
+func (p *fakeRegistryPusher) Push(_ context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	if p.registry.has(desc.Digest) && !p.retags(desc) {
+		return nil, fmt.Errorf("%s: %w", desc.Digest, errdefs.ErrAlreadyExists)
+	}
+	return &fakeRegistryWriter{pusher: p, desc: desc}, nil
+}
+
+// retags reports whether pushing desc moves the name of the push reference to
+// it, in which case the push proceeds even if desc is already stored.
+func (p *fakeRegistryPusher) retags(desc ocispec.Descriptor) bool {
+	i := strings.LastIndex(p.ref, "@")
+	if i < 0 || p.ref[i+1:] != desc.Digest.String() {
+		return false
+	}
+	p.registry.mu.Lock()
+	defer p.registry.mu.Unlock()
+	tagged, ok := p.registry.refs[p.ref[:i]]
+	return !ok || tagged.Digest != desc.Digest
+}
+
+type fakeRegistryWriter struct {
+	pusher *fakeRegistryPusher
+	desc   ocispec.Descriptor
+	buf    bytes.Buffer
+}
+
+func (w *fakeRegistryWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+func (w *fakeRegistryWriter) Close() error                { return nil }
+func (w *fakeRegistryWriter) Digest() digest.Digest       { return digest.FromBytes(w.buf.Bytes()) }
+func (w *fakeRegistryWriter) Truncate(int64) error        { return errdefs.ErrNotImplemented }
+
+func (w *fakeRegistryWriter) Status() (content.Status, error) {
+	return content.Status{Ref: w.desc.Digest.String(), Offset: int64(w.buf.Len())}, nil
+}
+
+func (w *fakeRegistryWriter) Commit(_ context.Context, size int64, expected digest.Digest, _ ...content.Opt) error {
+	if actual := w.Digest(); actual != expected {
+		return fmt.Errorf("digest mismatch %s != %s: %w", actual, expected, errdefs.ErrFailedPrecondition)
+	}
+	r := w.pusher.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blob[expected] = append([]byte(nil), w.buf.Bytes()...)
+	r.pushes[expected]++
+	// Tag the root descriptor named by the push reference.
+	if i := strings.LastIndex(w.pusher.ref, "@"); i >= 0 && w.pusher.ref[i+1:] == expected.String() {
+		desc := w.desc
+		desc.Platform = nil
+		r.refs[w.pusher.ref[:i]] = desc
+	}
+	return nil
+}
+
+func (r *fakeRegistry) MissingBlobs(_ context.Context, _ string, digests []digest.Digest) ([]digest.Digest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var missing []digest.Digest
+	for _, dgst := range digests {
+		if _, ok := r.blob[dgst]; !ok {
+			missing = append(missing, dgst)
+		}
+	}
+	return missing, nil
+}
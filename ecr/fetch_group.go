@@ -0,0 +1,448 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// sharedFetchWindow is how much of a shared fetch is kept for its readers.
+// Fetches may join a fetch until more than the window has been read from it,
+// and readers falling further behind than the window download the blob
+// again.
+const sharedFetchWindow = 8 << 20
+
+var errSharedFetchClosed = errors.New("ecr: shared fetch closed")
+
+// fetchGroup coalesces the fetches of a resolver's fetchers, so that blobs
+// fetched by several pulls at once, such as the pulls of an image started
+// together on a host, are requested from ECR and downloaded once.  Fetches
+// are shared by registry and digest.
+type fetchGroup struct {
+	mu       sync.Mutex
+	inflight map[string]*sharedFetch
+}
+
+func newFetchGroup() *fetchGroup {
+	return &fetchGroup{inflight: map[string]*sharedFetch{}}
+}
+
+// fetchKey returns the key sharing the fetches of desc from the fetcher's
+// registry, or an empty key if desc has no digest.
+func (f *ecrFetcher) fetchKey(desc ocispec.Descriptor) string {
+	if desc.Digest == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%s:%s@%s", f.ecrSpec.arn.Partition, f.ecrSpec.arn.Region, f.ecrSpec.arn.AccountID, desc.Digest)
+}
+
+// fetch returns a reader of the content identified by key, joining the fetch
+// of another caller in progress if there is one.  Otherwise open is called
+// to fetch the content, and its stream is shared with the callers joining
+// it.  open is called with a context carrying the values of ctx, which is
+// cancelled once every caller sharing the fetch has closed its reader or had
+// its context cancelled.  A nil group, or an empty key, calls open for every
+// fetch.
+func (g *fetchGroup) fetch(ctx context.Context, key string, open func(context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if g == nil || key == "" {
+		return open(ctx)
+	}
+	g.mu.Lock()
+	s := g.inflight[key]
+	var r *sharedReader
+	if s != nil {
+		r = s.join(ctx)
+	}
+	if r == nil {
+		s = newSharedFetch(ctx, g, key, open)
+		g.inflight[key] = s
+		r = s.join(ctx)
+		go s.start()
+	}
+	g.mu.Unlock()
+	return r.wait()
+}
+
+// remove stops fetches from joining s.
+func (g *fetchGroup) remove(key string, s *sharedFetch) {
+	g.mu.Lock()
+	if g.inflight[key] == s {
+		delete(g.inflight, key)
+	}
+	g.mu.Unlock()
+}
+
+// sharedFetch is a fetch read by several readers.  The reader furthest ahead
+// reads from the fetched stream, and the data it reads is kept for the
+// others until they have read it, or until they fall behind by more than
+// sharedFetchWindow.
+type sharedFetch struct {
+	group  *fetchGroup
+	key    string
+	open   func(context.Context) (io.ReadCloser, error)
+	ctx    context.Context
+	cancel context.CancelFunc
+	// opened is closed once open has returned.
+	opened chan struct{}
+
+	mu  sync.Mutex
+	src io.ReadCloser
+	// err is the error returned by open or by the last read of src.
+	err error
+	// chunks hold the data read from src from offset base to end.
+	chunks [][]byte
+	base   int64
+	end    int64
+	// readers are the open readers reading from chunks, and members counts
+	// every open reader.
+	readers  map[*sharedReader]struct{}
+	members  int
+	reading  bool
+	joinable bool
+	// changed is closed, and replaced, when data is read from src.
+	changed chan struct{}
+}
+
+func newSharedFetch(ctx context.Context, g *fetchGroup, key string, open func(context.Context) (io.ReadCloser, error)) *sharedFetch {
+	fetchCtx, cancel := context.WithCancel(detachedContext{ctx})
+	return &sharedFetch{
+		group:    g,
+		key:      key,
+		open:     open,
+		ctx:      fetchCtx,
+		cancel:   cancel,
+		opened:   make(chan struct{}),
+		readers:  map[*sharedReader]struct{}{},
+		joinable: true,
+		changed:  make(chan struct{}),
+	}
+}
+
+func (s *sharedFetch) start() {
+	src, err := s.open(s.ctx)
+	s.mu.Lock()
+	s.src, s.err = src, err
+	abandoned := s.members == 0
+	if err != nil {
+		s.joinable = false
+	}
+	s.mu.Unlock()
+	if err != nil || abandoned {
+		s.group.remove(s.key, s)
+	}
+	if src != nil && abandoned {
+		src.Close()
+	}
+	close(s.opened)
+}
+
+// join returns a new reader of s, or nil if s may no longer be joined.
+func (s *sharedFetch) join(ctx context.Context) *sharedReader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.joinable {
+		return nil
+	}
+	r := &sharedReader{s: s, ctx: ctx, attached: true, done: make(chan struct{})}
+	s.readers[r] = struct{}{}
+	s.members++
+	return r
+}
+
+// next returns up to max bytes of the data following r's offset, reading
+// from src if r is the furthest ahead.
+func (s *sharedFetch) next(r *sharedReader, max int) ([]byte, error) {
+	for {
+		s.mu.Lock()
+		switch {
+		case r.closed:
+			s.mu.Unlock()
+			if err := r.ctx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, errSharedFetchClosed
+		case !r.attached:
+			s.mu.Unlock()
+			return nil, nil
+		case r.off < s.end:
+			data := s.chunk(r.off)
+			if len(data) > max {
+				data = data[:max]
+			}
+			r.off += int64(len(data))
+			s.trim()
+			s.mu.Unlock()
+			return data, nil
+		case s.err != nil:
+			s.mu.Unlock()
+			return nil, s.err
+		case !s.reading:
+			s.reading = true
+			s.mu.Unlock()
+			left := s.read()
+			if left {
+				s.group.remove(s.key, s)
+			}
+			continue
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-r.ctx.Done():
+			return nil, r.ctx.Err()
+		}
+	}
+}
+
+// read reads the next chunk from src, and reports whether the fetch stopped
+// being joinable.
+func (s *sharedFetch) read() bool {
+	buffer := copyBufferPool.Get().(*[]byte)
+	n, err := s.src.Read(*buffer)
+	chunk := make([]byte, n)
+	copy(chunk, *buffer)
+	copyBufferPool.Put(buffer)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > 0 {
+		s.chunks = append(s.chunks, chunk)
+		s.end += int64(n)
+	}
+	if err != nil {
+		// A fetch joined once finished would not be concurrent, and a
+		// failed one would fail the callers joining it.
+		s.err = err
+		s.joinable = false
+	}
+	s.reading = false
+	close(s.changed)
+	s.changed = make(chan struct{})
+	joinable := s.joinable
+	s.trim()
+	return joinable && !s.joinable
+}
+
+// chunk returns the data kept from offset off.
+func (s *sharedFetch) chunk(off int64) []byte {
+	pos := s.base
+	for _, chunk := range s.chunks {
+		if off < pos+int64(len(chunk)) {
+			return chunk[off-pos:]
+		}
+		pos += int64(len(chunk))
+	}
+	return nil
+}
+
+// trim releases the data every reader has read once more than
+// sharedFetchWindow has been read from src, after which no fetch may join
+// s.  Readers further behind than the window are detached, to download the
+// blob again.
+func (s *sharedFetch) trim() {
+	if s.end <= sharedFetchWindow {
+		return
+	}
+	s.joinable = false
+	lowest := s.end
+	for r := range s.readers {
+		if r.off < s.end-sharedFetchWindow {
+			r.attached = false
+			delete(s.readers, r)
+			continue
+		}
+		if r.off < lowest {
+			lowest = r.off
+		}
+	}
+	for len(s.chunks) > 0 && s.base+int64(len(s.chunks[0])) <= lowest {
+		s.base += int64(len(s.chunks[0]))
+		s.chunks[0] = nil
+		s.chunks = s.chunks[1:]
+	}
+}
+
+// leave closes r, closing src and cancelling the fetch when r was its last
+// reader.
+func (s *sharedFetch) leave(r *sharedReader) {
+	s.mu.Lock()
+	if r.closed {
+		s.mu.Unlock()
+		return
+	}
+	r.closed = true
+	close(r.done)
+	own := r.own
+	delete(s.readers, r)
+	s.members--
+	last := s.members == 0
+	var src io.ReadCloser
+	if last {
+		s.joinable = false
+		s.chunks = nil
+		src = s.src
+	}
+	s.mu.Unlock()
+	if own != nil {
+		own.Close()
+	}
+	if last {
+		s.cancel()
+		s.group.remove(s.key, s)
+		if src != nil {
+			src.Close()
+		}
+	}
+}
+
+// sharedReader reads a shared fetch from its offset.  A reader detached from
+// the fetch for falling behind downloads the blob again with its own
+// context, skipping the data it has already read.
+type sharedReader struct {
+	s   *sharedFetch
+	ctx context.Context
+	// done is closed once the reader is closed.
+	done chan struct{}
+
+	// The following fields are guarded by the fetch's mutex, other than
+	// off and own, which are only used by reads.
+	off      int64
+	attached bool
+	closed   bool
+	own      io.ReadCloser
+}
+
+// wait waits for the fetch to open, and returns r once it has.
+func (r *sharedReader) wait() (io.ReadCloser, error) {
+	select {
+	case <-r.s.opened:
+	case <-r.ctx.Done():
+		r.Close()
+		return nil, r.ctx.Err()
+	}
+	if r.s.src == nil {
+		r.Close()
+		return nil, r.s.err
+	}
+	go func() {
+		select {
+		case <-r.ctx.Done():
+			r.Close()
+		case <-r.done:
+		}
+	}()
+	return r, nil
+}
+
+func (r *sharedReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if r.own != nil {
+			return r.own.Read(p)
+		}
+		data, err := r.s.next(r, len(p))
+		if err != nil || len(data) > 0 {
+			return copy(p, data), err
+		}
+		if err := r.reopen(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// WriteTo writes the data kept for the readers to w without copying it.
+func (r *sharedReader) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for {
+		if r.own != nil {
+			n, err := copyPooled(w, r.own)
+			return written + n, err
+		}
+		data, err := r.s.next(r, copyBufferSize)
+		if len(data) > 0 {
+			n, writeErr := w.Write(data)
+			written += int64(n)
+			if writeErr != nil {
+				return written, writeErr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		if len(data) == 0 {
+			if err := r.reopen(); err != nil {
+				return written, err
+			}
+		}
+	}
+}
+
+// reopen fetches the blob again for a reader detached from the shared
+// fetch.
+func (r *sharedReader) reopen() error {
+	rc, err := r.s.open(r.ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(ioutil.Discard, rc, r.off); err != nil {
+		rc.Close()
+		return err
+	}
+	r.s.mu.Lock()
+	closed := r.closed
+	if !closed {
+		r.own = rc
+	}
+	r.s.mu.Unlock()
+	if closed {
+		rc.Close()
+		return errSharedFetchClosed
+	}
+	return nil
+}
+
+func (r *sharedReader) Close() error {
+	r.s.leave(r)
+	return nil
+}
+
+// detachedContext carries the values of a context without its deadline or
+// cancellation, so that a shared fetch outlives the caller starting it.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForMembers waits until n callers share the fetch of key.
+func waitForMembers(t *testing.T, g *fetchGroup, key string, n int) {
+	assert.Eventually(t, func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		s := g.inflight[key]
+		if s == nil {
+			return false
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.members == n
+	}, time.Second, time.Millisecond)
+}
+
+func TestFetchGroupSharesFetch(t *testing.T) {
+	data := make([]byte, 3<<20)
+	rand.Read(data)
+	var opens int32
+	release := make(chan struct{})
+	g := newFetchGroup()
+	open := func(context.Context) (io.ReadCloser, error) {
+		atomic.AddInt32(&opens, 1)
+		<-release
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	const fetches = 4
+	results := make(chan []byte, fetches)
+	var wg sync.WaitGroup
+	for i := 0; i < fetches; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rc, err := g.fetch(context.Background(), "key", open)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer rc.Close()
+			var body bytes.Buffer
+			if i%2 == 0 {
+				_, err = io.Copy(&body, rc)
+			} else {
+				_, err = io.Copy(&body, struct{ io.Reader }{rc})
+			}
+			assert.NoError(t, err)
+			results <- body.Bytes()
+		}(i)
+	}
+	waitForMembers(t, g, "key", fetches)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&opens), "the fetch should be opened once")
+	for body := range results {
+		assert.Equal(t, data, body)
+	}
+	assert.Empty(t, g.inflight, "finished fetches should not be joined")
+}
+
+func TestFetchGroupSharesError(t *testing.T) {
+	expected := errors.New("expected")
+	var opens int32
+	release := make(chan struct{})
+	g := newFetchGroup()
+	open := func(context.Context) (io.ReadCloser, error) {
+		atomic.AddInt32(&opens, 1)
+		<-release
+		return nil, expected
+	}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := g.fetch(context.Background(), "key", open)
+			errs <- err
+		}()
+	}
+	waitForMembers(t, g, "key", 2)
+	close(release)
+	assert.Equal(t, expected, <-errs)
+	assert.Equal(t, expected, <-errs)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&opens))
+
+	_, err := g.fetch(context.Background(), "key", open)
+	assert.Equal(t, expected, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&opens), "a failed fetch should not be joined")
+}
+
+func TestFetchGroupDetachesLaggingReader(t *testing.T) {
+	data := make([]byte, 2*sharedFetchWindow+12345)
+	rand.Read(data)
+	var opens int32
+	g := newFetchGroup()
+	open := func(context.Context) (io.ReadCloser, error) {
+		atomic.AddInt32(&opens, 1)
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	leader, err := g.fetch(context.Background(), "key", open)
+	require.NoError(t, err)
+	defer leader.Close()
+	lagging, err := g.fetch(context.Background(), "key", open)
+	require.NoError(t, err)
+	defer lagging.Close()
+
+	head := make([]byte, 100)
+	_, err = io.ReadFull(lagging, head)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(leader)
+	require.NoError(t, err)
+	assert.Equal(t, data, body)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&opens))
+
+	rest, err := ioutil.ReadAll(lagging)
+	require.NoError(t, err)
+	assert.Equal(t, data, append(head, rest...), "the lagging reader should read the blob again")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&opens))
+}
+
+func TestFetchGroupCancel(t *testing.T) {
+	g := newFetchGroup()
+	opened := make(chan context.Context, 1)
+	release := make(chan struct{})
+	open := func(ctx context.Context) (io.ReadCloser, error) {
+		opened <- ctx
+		<-release
+		return ioutil.NopCloser(bytes.NewReader([]byte("blob"))), nil
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := g.fetch(leaderCtx, "key", open)
+		leaderErr <- err
+	}()
+	fetchCtx := <-opened
+	followerCtx, cancelFollower := context.WithCancel(context.Background())
+	followerErr := make(chan error, 1)
+	go func() {
+		rc, err := g.fetch(followerCtx, "key", open)
+		if err == nil {
+			defer rc.Close()
+			var body []byte
+			body, err = ioutil.ReadAll(rc)
+			assert.Equal(t, "blob", string(body))
+		}
+		followerErr <- err
+	}()
+	waitForMembers(t, g, "key", 2)
+
+	cancelLeader()
+	assert.Equal(t, context.Canceled, <-leaderErr)
+	assert.NoError(t, fetchCtx.Err(), "the fetch should continue for the follower")
+	close(release)
+	assert.NoError(t, <-followerErr)
+	cancelFollower()
+
+	// A fetch is cancelled once every caller has gone.
+	release = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := g.fetch(ctx, "key", open)
+		errs <- err
+	}()
+	fetchCtx = <-opened
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+	assert.Equal(t, context.Canceled, fetchCtx.Err())
+	close(release)
+}
+
+func TestFetcherSharesConcurrentFetches(t *testing.T) {
+	manifest := []byte("image manifest")
+	layer := make([]byte, 1<<20)
+	rand.Read(layer)
+	var downloads int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		w.Write(layer)
+	}))
+	defer ts.Close()
+
+	var batchGetImageCalls, getDownloadURLCalls int32
+	release := make(chan struct{})
+	client := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			atomic.AddInt32(&batchGetImageCalls, 1)
+			<-release
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{ImageManifest: aws.String(string(manifest))}}}, nil
+		},
+		GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			atomic.AddInt32(&getDownloadURLCalls, 1)
+			<-release
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+		},
+	}
+	resolver, err := NewResolver()
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+
+	for _, desc := range []ocispec.Descriptor{
+		{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifest), Size: int64(len(manifest))},
+		{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(layer), Size: int64(len(layer))},
+	} {
+		t.Run(desc.MediaType, func(t *testing.T) {
+			const pulls = 3
+			var wg sync.WaitGroup
+			for i := 0; i < pulls; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+					if !assert.NoError(t, err) {
+						return
+					}
+					rc, err := fetcher.Fetch(context.Background(), desc)
+					if !assert.NoError(t, err) {
+						return
+					}
+					defer rc.Close()
+					body, err := ioutil.ReadAll(rc)
+					assert.NoError(t, err)
+					assert.Equal(t, desc.Digest, digest.FromBytes(body))
+				}()
+			}
+			key := "aws:fake:123456789012@" + desc.Digest.String()
+			waitForMembers(t, resolver.(*ecrResolver).fetches, key, pulls)
+			release <- struct{}{}
+			wg.Wait()
+		})
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&batchGetImageCalls))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&getDownloadURLCalls))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&downloads))
+}
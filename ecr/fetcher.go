@@ -17,6 +17,7 @@ package ecr
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
@@ -25,16 +26,19 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/stream"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/remotes"
 	"github.com/htcat/htcat"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
-	"golang.org/x/net/context/ctxhttp"
 )
 
 // ecrFetcher implements the containerd remotes.Fetcher interface and can be
@@ -42,15 +46,115 @@ import (
 type ecrFetcher struct {
 	ecrBase
 	parallelism int
-	httpClient  *http.Client
+	// chunkSize is the size of the ranges in which layers are downloaded in
+	// parallel, or zero if they are downloaded with htcat.
+	chunkSize  int64
+	httpClient *http.Client
+	scheduler  *transferScheduler
+	// decompressionBlocks is the number of blocks buffered between each
+	// stage of FetchUncompressed.
+	decompressionBlocks int
+	stats               *statsRecorder
+	// order records the unpack order of fetched manifests to prioritize
+	// scheduled layer downloads, and is nil if downloads are not scheduled.
+	order    *unpackOrder
+	priority LayerPriority
+	// schedulingKey groups scheduled layer downloads for fair sharing.
+	schedulingKey SchedulingKey
+	// smallBlobThreshold is the size at or below which layers and configs
+	// are fetched without waiting for a slot or downloading in parallel.
+	smallBlobThreshold int64
+	// sizeBackfill is whether the sizes of blobs fetched without one are
+	// looked up first.
+	sizeBackfill bool
+	// stallTimeout is how long layer downloads may receive no data before
+	// they are abandoned and retried, or zero if they are never abandoned.
+	stallTimeout time.Duration
+	// getClient returns the ECR client for a registry, to fetch layers whose
+	// URLs reference repositories in other regions or registries, and is nil
+	// if only repositories in the fetcher's registry are fetched through ECR.
+	getClient func(region, registryID string) ecrAPI
+	// clock and backoff time the retries of layer downloads, and are nil if
+	// SystemClock and the default backoff are used.
+	clock   Clock
+	backoff Backoff
+	// kms records the repositories whose KMS keys the fetcher was denied
+	// access to, and is nil if denials are not recorded.
+	kms *kmsDenials
+	// schema1 holds the manifests and configs converted from Docker Schema
+	// 1, and is nil if images are not converted.
+	schema1 *schema1Conversions
+	// runtime holds the resolver's settings which may change while fetching,
+	// and is nil if they are the defaults.
+	runtime *runtimeSettings
+	// telemetry reports the metrics and spans of layer downloads, and is nil
+	// if they are not reported.
+	telemetry *telemetry
+	// missing records the image resolved again once layers are reported
+	// missing, and is nil if it is resolved again for each missing layer.
+	missing *missingLayersCheck
+	// pullThrough fetches content not yet cached in repositories of
+	// pull-through cache rules, and is nil if it is not fetched.
+	pullThrough *pullThroughCache
+	// host coordinates layer downloads with other processes on the host,
+	// and is nil if they are not coordinated.
+	host *HostCoordinator
+	// blobCache keeps downloaded layers and configs, and is nil if they
+	// are not cached.
+	blobCache *BlobCache
+	// fetches is shared by the fetchers of the resolver, so that concurrent
+	// fetches of a blob share its download.  It is nil if fetches are not
+	// shared.
+	fetches *fetchGroup
+	// logURLs configures whether the URLs layers are downloaded from are
+	// written to logs and errors as they are, rather than redacted.
+	logURLs bool
 }
 
 var _ remotes.Fetcher = (*ecrFetcher)(nil)
 
+const (
+	// layerFetchAttempts bounds the attempts to download a layer from its
+	// URL when downloads fail with transient errors.
+	layerFetchAttempts = 3
+	// layerFetchBackoff is the delay before the first retry of a download,
+	// doubling with each further attempt.
+	layerFetchBackoff = 100 * time.Millisecond
+)
+
+// UncompressedFetcher is implemented by fetchers that are able to decompress
+// layers as they are downloaded.
+type UncompressedFetcher interface {
+	// FetchUncompressed fetches the gzip-compressed layer described by desc
+	// and returns its decompressed content along with the media type of the
+	// uncompressed layer.  The digest of the uncompressed content is the
+	// layer's diff ID, as listed in the image configuration.
+	FetchUncompressed(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, string, error)
+}
+
+var (
+	_ UncompressedFetcher = (*ecrFetcher)(nil)
+	_ layerDecompressor   = (*ecrFetcher)(nil)
+)
+
 func (f *ecrFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	ctx = f.runtime.logContext(ctx)
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("desc", desc))
+	if f.logURLs {
+		ctx = withURLLogging(ctx)
+	}
 	log.G(ctx).Debug("ecr.fetch")
 
+	if rc, ok := embeddedContent(ctx, desc); ok {
+		return rc, nil
+	}
+	if rc, ok := knownContent(ctx, desc); ok {
+		return rc, nil
+	}
+	if rc, ok := f.schema1.fetch(ctx, desc); ok {
+		return rc, nil
+	}
+
 	// need to do different things based on the media type
 	switch desc.MediaType {
 	case
@@ -59,7 +163,10 @@ func (f *ecrFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.Rea
 		images.MediaTypeDockerSchema2ManifestList,
 		ocispec.MediaTypeImageIndex,
 		ocispec.MediaTypeImageManifest:
-		return f.fetchManifest(ctx, desc)
+		f.stats.manifestFetched()
+		return f.fetches.fetch(ctx, f.fetchKey(desc), func(ctx context.Context) (io.ReadCloser, error) {
+			return f.fetchManifest(ctx, desc)
+		})
 	case
 		images.MediaTypeDockerSchema2Layer,
 		images.MediaTypeDockerSchema2LayerGzip,
@@ -67,12 +174,40 @@ func (f *ecrFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.Rea
 		ocispec.MediaTypeImageLayerGzip,
 		ocispec.MediaTypeImageLayerZstd,
 		ocispec.MediaTypeImageLayer,
-		ocispec.MediaTypeImageConfig:
-		return f.fetchLayer(ctx, desc)
+		ocispec.MediaTypeImageConfig,
+		mediaTypeEmptyJSON:
+		desc = f.backfillSize(ctx, desc)
+		rc, err := f.fetches.fetch(ctx, f.fetchKey(desc), func(ctx context.Context) (io.ReadCloser, error) {
+			return f.telemetry.fetchLayer(ctx, desc, f.ecrSpec.Repository, func(ctx context.Context) (io.ReadCloser, error) {
+				return f.blobCache.fetch(ctx, desc, func(ctx context.Context) (io.ReadCloser, error) {
+					return f.fetchVerified(ctx, desc, func(ctx context.Context) (io.ReadCloser, error) {
+						// The download is throttled, rather than the verified
+						// content read from memory or disk.
+						if isSmallBlob(desc, f.smallBlobThreshold) {
+							return f.limitedLayer(ctx, desc)
+						}
+						return f.host.fetch(ctx, desc, func(ctx context.Context) (io.ReadCloser, error) {
+							return f.limitedLayer(ctx, desc)
+						})
+					})
+				})
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+		return f.stats.blob(f.withProgress(ctx, desc, rc)), nil
 	case
 		images.MediaTypeDockerSchema2LayerForeign,
-		images.MediaTypeDockerSchema2LayerForeignGzip:
-		return f.fetchForeignLayer(ctx, desc)
+		images.MediaTypeDockerSchema2LayerForeignGzip,
+		ocispec.MediaTypeImageLayerNonDistributable,
+		ocispec.MediaTypeImageLayerNonDistributableGzip,
+		ocispec.MediaTypeImageLayerNonDistributableZstd:
+		rc, err := f.fetchForeignLayer(ctx, desc)
+		if err != nil {
+			return nil, err
+		}
+		return f.stats.blob(f.withProgress(ctx, desc, rc)), nil
 	default:
 		log.G(ctx).
 			WithField("media type", desc.MediaType).
@@ -81,7 +216,142 @@ func (f *ecrFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.Rea
 	}
 }
 
+func (f *ecrFetcher) FetchUncompressed(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, string, error) {
+	mediaType, err := uncompressedMediaType(desc)
+	if err != nil {
+		return nil, "", err
+	}
+	rc, err := f.Fetch(ctx, desc)
+	if err != nil {
+		return nil, "", err
+	}
+	uncompressed, err := f.decompress(ctx, rc)
+	if err != nil {
+		rc.Close()
+		return nil, "", err
+	}
+	return uncompressed, mediaType, nil
+}
+
+// uncompressedMediaType returns the media type of the decompressed content of
+// the gzip-compressed layer desc.
+func uncompressedMediaType(desc ocispec.Descriptor) (string, error) {
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2LayerGzip:
+		return images.MediaTypeDockerSchema2Layer, nil
+	case images.MediaTypeDockerSchema2LayerForeignGzip:
+		return images.MediaTypeDockerSchema2LayerForeign, nil
+	case ocispec.MediaTypeImageLayerGzip:
+		return ocispec.MediaTypeImageLayer, nil
+	case ocispec.MediaTypeImageLayerNonDistributableGzip:
+		return ocispec.MediaTypeImageLayerNonDistributable, nil
+	default:
+		return "", fmt.Errorf("decompress %v: %w", desc.MediaType, errdefs.ErrNotImplemented)
+	}
+}
+
+// decompress returns a reader of the decompressed content of the gzip stream
+// rc, which is closed with it.
+func (f *ecrFetcher) decompress(ctx context.Context, rc io.ReadCloser) (io.ReadCloser, error) {
+	log.G(ctx).
+		WithField("blocks", f.decompressionBlocks).
+		Debug("ecr.fetcher.layer.decompress")
+	if f.decompressionBlocks > 0 {
+		return stream.PipelinedGzipReader(rc, stream.DefaultBlockSize, f.decompressionBlocks)
+	}
+	return newGzipReadCloser(rc)
+}
+
+// decompresses reports whether layers pulled as desc are decompressed as they
+// are ingested, which they are when they are gzip-compressed and the fetcher
+// decompresses layers in a pipeline.
+func (f *ecrFetcher) decompresses(desc ocispec.Descriptor) bool {
+	if f.decompressionBlocks <= 0 {
+		return false
+	}
+	_, err := uncompressedMediaType(desc)
+	return err == nil
+}
+
+// decompressLayer returns a reader of the decompressed content of the layer
+// read from compressed.
+func (f *ecrFetcher) decompressLayer(ctx context.Context, compressed io.Reader) (io.ReadCloser, error) {
+	return f.decompress(ctx, ioutil.NopCloser(compressed))
+}
+
+// gzipReadCloser decompresses a gzip stream in the caller's goroutine and
+// closes the compressed stream on Close.
+type gzipReadCloser struct {
+	*gzip.Reader
+	compressed io.Closer
+}
+
+func newGzipReadCloser(rc io.ReadCloser) (io.ReadCloser, error) {
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: gz, compressed: rc}, nil
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.compressed.Close()
+}
+
+// WriteTo decompresses the layer into w using a pooled buffer, rather than
+// the buffer io.Copy would allocate for each layer.
+func (g *gzipReadCloser) WriteTo(w io.Writer) (int64, error) {
+	return copyPooled(w, g.Reader)
+}
+
+// copyBufferSize is the size of the buffers used to copy layers.  Large
+// buffers reduce the number of writes, and system calls, made for each layer.
+const copyBufferSize = 1 << 20
+
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, copyBufferSize)
+		return &buffer
+	},
+}
+
+// copyPooled copies r to w with a pooled buffer, unless r implements
+// io.WriterTo or w implements io.ReaderFrom, in which case no buffer is
+// needed.
+func copyPooled(w io.Writer, r io.Reader) (int64, error) {
+	buffer := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buffer)
+	return io.CopyBuffer(w, r, *buffer)
+}
+
 func (f *ecrFetcher) fetchManifest(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	for attempt := 1; ; attempt++ {
+		manifest, err := f.fetchManifestContent(ctx, desc)
+		if err != nil || !verifiesDigest(desc) {
+			return manifest, err
+		}
+		// The manifest is read whole, so that content which does not match
+		// its digest is fetched again.
+		data, err := ioutil.ReadAll(manifest)
+		manifest.Close()
+		if err == nil {
+			err = verifyContent(desc, data)
+		}
+		if err == nil {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+		if !errors.Is(err, ErrDigestMismatch) || attempt == digestFetchAttempts {
+			return nil, err
+		}
+		log.G(ctx).
+			WithError(err).
+			WithField("attempt", attempt).
+			Warn("ecr.fetcher.manifest: retrying corrupt manifest")
+	}
+}
+
+func (f *ecrFetcher) fetchManifestContent(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
 	var (
 		image *ecr.Image
 		err   error
@@ -96,6 +366,9 @@ func (f *ecrFetcher) fetchManifest(ctx context.Context, desc ocispec.Descriptor)
 		log.G(ctx).Debug("ecr.fetcher.manifest: fetch image by digest")
 		image, err = f.getImageByDescriptor(ctx, desc)
 	}
+	if desc.Digest != "" && f.pullThrough.pullsThrough(ctx, f.client, f.ecrSpec, err) {
+		return f.fetchPullThrough(ctx, desc, true)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -103,26 +376,175 @@ func (f *ecrFetcher) fetchManifest(ctx context.Context, desc ocispec.Descriptor)
 		return nil, errors.New("fetchManifest: nil image")
 	}
 
-	return ioutil.NopCloser(bytes.NewReader([]byte(aws.StringValue(image.ImageManifest)))), nil
+	manifest := aws.StringValue(image.ImageManifest)
+	if f.order != nil {
+		f.order.record(manifest)
+	}
+	return ioutil.NopCloser(strings.NewReader(manifest)), nil
+}
+
+// embeddedContent returns the content embedded in desc, if it has any and it
+// matches the descriptor's digest and size, so that it need not be fetched.
+func embeddedContent(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, bool) {
+	if desc.Data == nil {
+		return nil, false
+	}
+	if int64(len(desc.Data)) != desc.Size ||
+		desc.Digest.Validate() != nil ||
+		desc.Digest.Algorithm().FromBytes(desc.Data) != desc.Digest {
+		log.G(ctx).Warn("ecr.fetcher: embedded data does not match descriptor, fetching")
+		return nil, false
+	}
+	log.G(ctx).Debug("ecr.fetcher: returning embedded data")
+	return ioutil.NopCloser(bytes.NewReader(desc.Data)), true
+}
+
+// isSmallBlob reports whether desc is at or below the small blob threshold.
+// The download of a small blob is dominated by the latency of its requests,
+// so it does not wait behind larger layers for a download slot and is not
+// split into parallel requests.
+func isSmallBlob(desc ocispec.Descriptor, threshold int64) bool {
+	return desc.Size > 0 && desc.Size <= threshold
+}
+
+// blobTransport returns the transport used to download blobs.
+func (f *ecrFetcher) blobTransport() BlobTransport {
+	transport := &defaultBlobTransport{
+		client:             f.client,
+		httpClient:         f.httpClient,
+		parallelism:        f.parallelism,
+		chunkSize:          f.chunkSize,
+		smallBlobThreshold: f.smallBlobThreshold,
+	}
+	if f.transport != nil {
+		return &fallbackBlobTransport{transport: f.transport, fallback: transport}
+	}
+	return transport
+}
+
+// limitedLayer downloads desc with fetchLayer, throttled to the resolver's
+// layer download bandwidth.
+func (f *ecrFetcher) limitedLayer(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	rc, err := f.fetchLayer(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return f.runtime.limitReader(ctx, rc), nil
 }
 
 func (f *ecrFetcher) fetchLayer(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
 	log.G(ctx).Debug("ecr.fetcher.layer")
+	if f.scheduler == nil || isSmallBlob(desc, f.smallBlobThreshold) {
+		return f.fetchLayerUnscheduled(ctx, desc)
+	}
+	release, err := f.scheduler.acquire(ctx, f.layerSchedulingKey(ctx), f.layerPriority(ctx, desc))
+	if err != nil {
+		return nil, err
+	}
+	rc, err := f.fetchLayerUnscheduled(ctx, desc)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &releaseOnClose{ReadCloser: rc, release: release}, nil
+}
+
+// fetchLayerUnscheduled fetches desc from the fetcher's repository.  Layers
+// missing from it are fetched from the other ECR repositories listed in their
+// URLs, if any.
+func (f *ecrFetcher) fetchLayerUnscheduled(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	rc, err := f.fetchLayerFrom(ctx, desc, f.client, f.ecrSpec)
+	if err == nil || !errdefs.IsNotFound(err) {
+		return rc, err
+	}
+	for _, layerURL := range desc.URLs {
+		spec, client, ok := f.urlSource(layerURL)
+		if !ok || spec.ARN() == f.ecrSpec.ARN() {
+			continue
+		}
+		log.G(ctx).WithField("url", loggedURL(ctx, layerURL)).Debug("ecr.fetcher.layer: fetching from repository in URL")
+		rc, urlErr := f.fetchLayerFrom(ctx, desc, client, spec)
+		if urlErr == nil {
+			return rc, nil
+		}
+		log.G(ctx).WithField("url", loggedURL(ctx, layerURL)).WithError(urlErr).Warn("ecr.fetcher.layer: unable to fetch from repository in URL")
+	}
+	if f.pullThrough.pullsThrough(ctx, f.client, f.ecrSpec, err) {
+		return f.fetchPullThrough(ctx, desc, false)
+	}
+	if isLayersNotFound(err) {
+		return nil, f.missingLayersError(ctx, desc.Digest, err)
+	}
+	return nil, err
+}
+
+// fetchLayerFrom fetches desc from the repository of spec with client.
+func (f *ecrFetcher) fetchLayerFrom(ctx context.Context, desc ocispec.Descriptor, client ecrAPI, spec ECRSpec) (io.ReadCloser, error) {
+	if err := f.kms.get(spec, desc.Digest); err != nil {
+		return nil, newFetchError(desc.Digest, err)
+	}
 	getDownloadUrlForLayerInput := &ecr.GetDownloadUrlForLayerInput{
-		RegistryId:     aws.String(f.ecrSpec.Registry()),
-		RepositoryName: aws.String(f.ecrSpec.Repository),
+		RegistryId:     aws.String(spec.Registry()),
+		RepositoryName: aws.String(spec.Repository),
 		LayerDigest:    aws.String(desc.Digest.String()),
 	}
-	output, err := f.client.GetDownloadUrlForLayerWithContext(ctx, getDownloadUrlForLayerInput)
+	var requestOptions []request.Option
+	if !logsURLs(ctx) {
+		requestOptions = append(requestOptions, withoutBodyLogging)
+	}
+	// Transient errors from ECR are retried by the AWS SDK.
+	output, err := client.GetDownloadUrlForLayerWithContext(ctx, getDownloadUrlForLayerInput, requestOptions...)
 	if err != nil {
-		return nil, err
+		return nil, newFetchError(desc.Digest, err)
 	}
 
 	downloadURL := aws.StringValue(output.DownloadUrl)
-	if f.parallelism > 0 {
-		return f.fetchLayerHtcat(ctx, desc, downloadURL)
+	transport := f.blobTransport()
+	for attempt := 1; ; attempt++ {
+		rc, err := f.downloadWithStallTimeout(ctx, desc, func(ctx context.Context) (io.ReadCloser, error) {
+			rc, err := transport.Download(ctx, desc, downloadURL)
+			return rc, redactError(ctx, err, downloadURL)
+		})
+		if err == nil {
+			return rc, nil
+		}
+		if kmsErr := f.kmsAccessDenied(ctx, client, spec, desc.Digest, err); kmsErr != nil {
+			f.kms.add(spec, kmsErr)
+			return nil, newFetchError(desc.Digest, kmsErr)
+		}
+		fetchErr := newFetchError(desc.Digest, err)
+		if !fetchErr.Transient || attempt == layerFetchAttempts {
+			return nil, fetchErr
+		}
+		log.G(ctx).
+			WithError(err).
+			WithField("attempt", attempt).
+			Warn("ecr.fetcher.layer: retrying download")
+		f.events.emit(ctx, &LayerFetchRetry{
+			Repository: spec.Repository,
+			Digest:     desc.Digest,
+			Attempt:    attempt,
+			Err:        err,
+		})
+		select {
+		case <-f.retryAfter(attempt):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
-	return f.fetchLayerURL(ctx, desc, downloadURL)
+}
+
+// retryAfter returns a channel receiving once the delay before the retry
+// attempt of a layer download has passed.
+func (f *ecrFetcher) retryAfter(attempt int) <-chan time.Time {
+	clock, backoff := f.clock, f.backoff
+	if clock == nil {
+		clock = SystemClock
+	}
+	if backoff == nil {
+		backoff = defaultBackoff
+	}
+	return clock.After(backoff(attempt))
 }
 
 func (f *ecrFetcher) fetchForeignLayer(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
@@ -130,80 +552,137 @@ func (f *ecrFetcher) fetchForeignLayer(ctx context.Context, desc ocispec.Descrip
 	if len(desc.URLs) < 1 {
 		log.G(ctx).Error("cannot pull foreign layer without URL")
 	}
+	transport := f.blobTransport()
 	var err error
-	for _, layerURL := range desc.URLs {
-		log.G(ctx).WithField("url", layerURL).Debug("ecr.fetcher.layer.foreign: fetching from URL")
+	for i, layerURL := range desc.URLs {
+		log.G(ctx).WithField("url", loggedURL(ctx, layerURL)).Debug("ecr.fetcher.layer.foreign: fetching from URL")
 		var rdc io.ReadCloser
-		rdc, err = f.fetchLayerURL(ctx, desc, layerURL)
+		if spec, client, ok := f.urlSource(layerURL); ok {
+			rdc, err = f.fetchLayerFrom(ctx, desc, client, spec)
+		} else {
+			rdc, err = f.downloadWithStallTimeout(ctx, desc, func(ctx context.Context) (io.ReadCloser, error) {
+				rc, err := transport.Download(ctx, desc, layerURL)
+				return rc, redactError(ctx, err, layerURL)
+			})
+		}
 		if err == nil {
 			return rdc, nil
 		}
-		log.G(ctx).WithField("url", layerURL).WithError(err).Warn("ecr.fetcher.layer.foreign: unable to fetch from URL")
+		log.G(ctx).WithField("url", loggedURL(ctx, layerURL)).WithError(err).Warn("ecr.fetcher.layer.foreign: unable to fetch from URL")
+		if i+1 < len(desc.URLs) {
+			f.events.emit(ctx, &LayerFetchRetry{
+				Repository: f.ecrSpec.Repository,
+				Digest:     desc.Digest,
+				Attempt:    i + 1,
+				Err:        err,
+			})
+		}
 	}
 	return nil, err
 }
 
-func (f *ecrFetcher) fetchLayerURL(ctx context.Context, desc ocispec.Descriptor, downloadURL string) (io.ReadCloser, error) {
-	req, err := http.NewRequest(http.MethodGet, downloadURL, nil)
-	if err != nil {
-		log.G(ctx).
-			WithError(err).
-			WithField("url", downloadURL).
-			Error("ecr.fetcher.layer.url: failed to create HTTP request")
-		return nil, err
-	}
-	log.G(ctx).WithField("url", downloadURL).Debug("ecr.fetcher.layer.url")
+// htcatReader downloads a layer with htcat once it is first read.  When the
+// layer is copied with io.Copy, as by containerd's content.Copy, htcat writes
+// the downloaded parts directly to the destination.  Otherwise, the layer is
+// read through a pipe written by a separate goroutine.
+type htcatReader struct {
+	ctx         context.Context
+	client      *http.Client
+	url         *url.URL
+	parallelism int
 
-	req.Header.Set("Accept", strings.Join([]string{desc.MediaType, `*`}, ", "))
-	resp, err := f.doRequest(ctx, req)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode > 299 {
-		resp.Body.Close()
-		if resp.StatusCode == http.StatusNotFound {
-			return nil, fmt.Errorf("content at %v not found: %w", downloadURL, errdefs.ErrNotFound)
-		}
-		return nil, fmt.Errorf("ecr.fetcher.layer.url: unexpected status code %v: %v", downloadURL, resp.Status)
-	}
-	log.G(ctx).WithField("desc", desc).Debug("ecr.fetcher.layer.url: returning body")
-	return resp.Body, nil
+	once sync.Once
+	// pipe is set if the download was started by Read.
+	pipe *io.PipeReader
 }
 
-func (f *ecrFetcher) doRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
-	client := f.httpClient
-	resp, err := ctxhttp.Do(ctx, client, req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to do request: %w", err)
-	}
-	return resp, nil
-}
+var errHtcatConsumed = errors.New("ecr.fetcher.layer.htcat: layer already written or closed")
 
-func (f *ecrFetcher) fetchLayerHtcat(ctx context.Context, desc ocispec.Descriptor, downloadURL string) (io.ReadCloser, error) {
-	log.G(ctx).WithField("url", downloadURL).Debug("ecr.fetcher.layer.htcat")
-	parsedURL, err := url.Parse(downloadURL)
-	if err != nil {
-		log.G(ctx).
-			WithError(err).
-			WithField("url", downloadURL).
-			Error("ecr.fetcher.layer.htcat: failed to parse URL")
-		return nil, err
-	}
-	hc := f.httpClient
-	if hc == nil {
-		hc = http.DefaultClient
-	}
-	htc := htcat.New(hc, parsedURL, f.parallelism)
+func (h *htcatReader) startPipe() {
+	htc := htcat.New(h.client, h.url, h.parallelism)
 	pr, pw := io.Pipe()
 	go func() {
-		defer pw.Close()
 		_, err := htc.WriteTo(pw)
 		if err != nil {
-			log.G(ctx).
+			err = redactError(h.ctx, err, h.url.String())
+			log.G(h.ctx).
 				WithError(err).
-				WithField("url", downloadURL).
+				WithField("url", loggedURL(h.ctx, h.url.String())).
 				Error("ecr.fetcher.layer.htcat: failed to download layer")
 		}
+		pw.CloseWithError(err)
 	}()
-	return pr, nil
+	h.pipe = pr
+}
+
+func (h *htcatReader) Read(p []byte) (int, error) {
+	h.once.Do(h.startPipe)
+	if h.pipe == nil {
+		return 0, errHtcatConsumed
+	}
+	return h.pipe.Read(p)
+}
+
+func (h *htcatReader) WriteTo(w io.Writer) (int64, error) {
+	direct := false
+	h.once.Do(func() { direct = true })
+	if direct {
+		// htcat does not report the number of bytes it writes, which
+		// callers such as content.Copy check.
+		counter := &countingWriter{Writer: w}
+		_, err := htcat.New(h.client, h.url, h.parallelism).WriteTo(counter)
+		return counter.n, redactError(h.ctx, err, h.url.String())
+	}
+	if h.pipe == nil {
+		return 0, errHtcatConsumed
+	}
+	return copyPooled(w, h.pipe)
+}
+
+// contextClient returns a copy of client whose requests are bound to ctx.
+// htcat does not take a context, so without it a download would continue past
+// the cancellation or deadline of the fetch.
+func contextClient(ctx context.Context, client *http.Client) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	bound := *client
+	bound.Transport = &contextTransport{ctx: ctx, base: client.Transport}
+	return &bound
+}
+
+// contextTransport sends requests with its context.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req.WithContext(t.ctx))
+}
+
+// countingWriter counts the bytes written to the wrapped Writer.
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Close stops a download being read through the pipe.  A download written
+// directly by WriteTo stops when the destination returns an error.
+func (h *htcatReader) Close() error {
+	h.once.Do(func() {})
+	if h.pipe != nil {
+		return h.pipe.Close()
+	}
+	return nil
 }
@@ -17,13 +17,16 @@ package ecr
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 	"time"
 
@@ -59,6 +62,9 @@ func TestFetchForeignLayer(t *testing.T) {
 	for _, mediaType := range []string{
 		images.MediaTypeDockerSchema2LayerForeign,
 		images.MediaTypeDockerSchema2LayerForeignGzip,
+		ocispec.MediaTypeImageLayerNonDistributable,
+		ocispec.MediaTypeImageLayerNonDistributableGzip,
+		ocispec.MediaTypeImageLayerNonDistributableZstd,
 	} {
 		t.Run(mediaType, func(t *testing.T) {
 			requests := 0
@@ -116,7 +122,7 @@ func TestFetchManifest(t *testing.T) {
 		registry       = "registry"
 		repository     = "repository"
 		imageManifest  = "image manifest"
-		imageDigest    = "sha256:18019fb68413973fcde9ff917d333bbaa228c4aaebba9ad0ca5ffec26e4f3541"
+		imageDigest    = "sha256:e0f1a497a93630605f20f99b839c253e526b5eeac63ec567913167dbb6861719"
 		imageTag       = "tag"
 		imageTagDigest = "tag@" + imageDigest
 	)
@@ -367,3 +373,371 @@ func TestFetchLayerHtcat(t *testing.T) {
 	assert.Equal(t, expectedBody, body)
 	assert.True(t, handlerCallCount > 1, "ServeContent should be called more than once: %d", handlerCallCount)
 }
+
+func TestFetchLayerHtcatWriteTo(t *testing.T) {
+	expectedBody := make([]byte, 10<<20)
+	rand.Read(expectedBody)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(expectedBody))
+	}))
+	defer ts.Close()
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+				},
+			},
+		},
+		parallelism: 2,
+	}
+
+	reader, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2Layer,
+		Digest:    testdata.LayerDigest,
+	})
+	require.NoError(t, err)
+	defer reader.Close()
+	_, ok := reader.(io.WriterTo)
+	require.True(t, ok, "layer should be written directly by io.Copy")
+
+	var body bytes.Buffer
+	n, err := io.Copy(&body, reader)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(expectedBody)), n)
+	assert.Equal(t, expectedBody, body.Bytes())
+
+	_, err = reader.Read(make([]byte, 1))
+	assert.Error(t, err, "layer should not be read after being written")
+}
+
+func TestFetchLayerHtcatDeadline(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Send part of the layer, then stall.
+		w.Header().Set("Content-Length", strconv.Itoa(8<<20))
+		w.Write(make([]byte, 1024))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+				},
+			},
+		},
+		parallelism: 2,
+	}
+
+	for name, copyLayer := range map[string]func(io.Reader) error{
+		"WriteTo": func(r io.Reader) error {
+			_, err := io.Copy(ioutil.Discard, r)
+			return err
+		},
+		"Read": func(r io.Reader) error {
+			_, err := ioutil.ReadAll(r)
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			reader, err := fetcher.Fetch(ctx, ocispec.Descriptor{
+				MediaType: images.MediaTypeDockerSchema2Layer,
+				Digest:    testdata.LayerDigest,
+			})
+			require.NoError(t, err)
+			defer reader.Close()
+
+			done := make(chan error, 1)
+			go func() { done <- copyLayer(reader) }()
+			select {
+			case err := <-done:
+				assert.Error(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("download should stop at the deadline")
+			}
+		})
+	}
+}
+
+func TestFetchEmbeddedData(t *testing.T) {
+	const config = `{"architecture":"amd64","os":"linux"}`
+	calls := 0
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					calls++
+					return nil, errors.New("expected")
+				},
+			},
+		},
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.FromString(config),
+		Size:      int64(len(config)),
+		Data:      []byte(config),
+	}
+
+	reader, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	require.NoError(t, err)
+	assert.Equal(t, config, string(data))
+	assert.Equal(t, 0, calls, "embedded data should not be fetched")
+
+	desc.Data = []byte("tampered")
+	_, err = fetcher.Fetch(context.Background(), desc)
+	assert.EqualError(t, errors.Unwrap(err), "expected")
+	assert.Equal(t, 1, calls, "mismatched embedded data should be fetched")
+}
+
+func TestFetchSmallBlob(t *testing.T) {
+	const config = `{"architecture":"amd64","os":"linux"}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, config)
+	}))
+	defer ts.Close()
+	scheduler := newTransferScheduler(1, SchedulingGreedy)
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+				},
+			},
+		},
+		parallelism:        4,
+		scheduler:          scheduler,
+		smallBlobThreshold: 1024,
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.FromString(config),
+		Size:      int64(len(config)),
+	}
+
+	// Occupy the only download slot, as a large layer would.
+	release, err := scheduler.acquire(context.Background(), "large", 0)
+	require.NoError(t, err)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reader, err := fetcher.Fetch(ctx, desc)
+	require.NoError(t, err, "small blob should not wait for a download slot")
+	defer reader.Close()
+	_, parallel := reader.(*htcatReader)
+	assert.False(t, parallel, "small blob should be fetched with a single request")
+	data, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, config, string(data))
+
+	desc.Size = 2048
+	_, err = fetcher.Fetch(ctx, desc)
+	assert.Equal(t, context.DeadlineExceeded, err, "larger blob should wait for a download slot")
+}
+
+func TestFetchManifestDigestMismatch(t *testing.T) {
+	const manifest = `{"schemaVersion":2}`
+	for _, tc := range []struct {
+		name     string
+		corrupt  int
+		expected error
+	}{
+		{name: "retried", corrupt: 1},
+		{name: "persistent", corrupt: 2, expected: ErrDigestMismatch},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			callCount := 0
+			fetcher := &ecrFetcher{
+				ecrBase: ecrBase{
+					client: &fakeECRClient{
+						BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+							callCount++
+							content := manifest
+							if callCount <= tc.corrupt {
+								content = `{"schemaVersion":3}`
+							}
+							return &ecr.BatchGetImageOutput{
+								Images: []*ecr.Image{{ImageManifest: aws.String(content)}},
+							}, nil
+						},
+					},
+					ecrSpec: ECRSpec{Repository: "repository"},
+				},
+			}
+			desc := ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    digest.FromString(manifest),
+				Size:      int64(len(manifest)),
+			}
+			reader, err := fetcher.Fetch(context.Background(), desc)
+			assert.Equal(t, 2, callCount, "corrupt manifest should be fetched again")
+			if tc.expected != nil {
+				assert.True(t, errors.Is(err, tc.expected), "expected %v, got %v", tc.expected, err)
+				assert.True(t, errdefs.IsFailedPrecondition(err))
+				return
+			}
+			require.NoError(t, err)
+			defer reader.Close()
+			data, err := ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, manifest, string(data))
+		})
+	}
+}
+
+func TestFetchLayerDigestMismatch(t *testing.T) {
+	large := make([]byte, 2*digestBufferSize)
+	rand.Read(large)
+	for _, tc := range []struct {
+		name     string
+		layer    []byte
+		corrupt  int
+		expected error
+	}{
+		{name: "buffered", layer: []byte("hello this is dog"), corrupt: 1},
+		{name: "spooled", layer: large, corrupt: 1},
+		{name: "persistent", layer: large, corrupt: 2, expected: ErrDigestMismatch},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			downloads := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				downloads++
+				content := tc.layer
+				if downloads <= tc.corrupt {
+					content = append([]byte(nil), tc.layer...)
+					content[len(content)-1]++
+				}
+				w.Write(content)
+			}))
+			defer ts.Close()
+			var retries []*LayerFetchRetry
+			fetcher := &ecrFetcher{
+				ecrBase: ecrBase{
+					client: &fakeECRClient{
+						GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+							return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+						},
+					},
+					events: func(_ context.Context, event Event) {
+						if retry, ok := event.(*LayerFetchRetry); ok {
+							retries = append(retries, retry)
+						}
+					},
+				},
+			}
+			desc := ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Digest:    digest.FromBytes(tc.layer),
+				Size:      int64(len(tc.layer)),
+			}
+
+			reader, err := fetcher.Fetch(context.Background(), desc)
+			assert.Equal(t, 2, downloads, "corrupt layer should be fetched again")
+			require.Len(t, retries, 1)
+			assert.True(t, errors.Is(retries[0].Err, ErrDigestMismatch))
+			if tc.expected != nil {
+				assert.True(t, errors.Is(err, tc.expected), "expected %v, got %v", tc.expected, err)
+				return
+			}
+			require.NoError(t, err)
+			defer reader.Close()
+			data, err := ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(tc.layer, data), "verified layer should be returned")
+		})
+	}
+}
+
+// BenchmarkFetchLayer measures copying a layer from the fetcher with io.Copy,
+// as containerd's content store does.
+func BenchmarkFetchLayer(b *testing.B) {
+	layer := make([]byte, 64<<20)
+	rand.Read(layer)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(layer))
+	}))
+	defer ts.Close()
+	client := &fakeECRClient{
+		GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+		},
+	}
+	desc := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2Layer,
+		Digest:    testdata.LayerDigest,
+	}
+
+	for _, parallelism := range []int{0, 4} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			fetcher := &ecrFetcher{
+				ecrBase:     ecrBase{client: client},
+				parallelism: parallelism,
+				httpClient:  ts.Client(),
+			}
+			b.SetBytes(int64(len(layer)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				reader, err := fetcher.Fetch(context.Background(), desc)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+					b.Fatal(err)
+				}
+				reader.Close()
+			}
+		})
+	}
+}
+
+func TestFetchUncompressed(t *testing.T) {
+	const expectedBody = "hello, this is dog"
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write([]byte(expectedBody))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(compressed.Bytes())
+	}))
+	defer ts.Close()
+
+	for _, blocks := range []int{0, 2} {
+		t.Run(fmt.Sprintf("blocks=%d", blocks), func(t *testing.T) {
+			fetcher := &ecrFetcher{decompressionBlocks: blocks}
+			rc, mediaType, err := fetcher.FetchUncompressed(context.Background(), ocispec.Descriptor{
+				MediaType: images.MediaTypeDockerSchema2LayerForeignGzip,
+				URLs:      []string{ts.URL},
+			})
+			require.NoError(t, err)
+			defer rc.Close()
+			assert.Equal(t, images.MediaTypeDockerSchema2LayerForeign, mediaType)
+
+			output, err := ioutil.ReadAll(rc)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedBody, string(output))
+		})
+	}
+}
+
+func TestFetchUncompressedUnsupported(t *testing.T) {
+	fetcher := &ecrFetcher{}
+	_, _, err := fetcher.FetchUncompressed(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerZstd,
+	})
+	assert.True(t, errors.Is(err, errdefs.ErrNotImplemented))
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LabelGCRoot is the content label marking content as a root for containerd's
+// garbage collector, which never collects it or the content it references.
+const LabelGCRoot = "containerd.io/gc.root"
+
+// GCLabelWrapper returns an image handler wrapper protecting the image rooted
+// at root from containerd's garbage collector while it is pulled into store
+// with the wrapped handler, which must return the children of each
+// descriptor, as images.ChildrenHandler does.  The root is labeled
+// LabelGCRoot once fetched, and each manifest and index is labeled with
+// references to its children before they are fetched, so content already
+// pulled is not collected while the rest of the image is pulled and unpacked.
+//
+// Pulls with containerd's client label content themselves; the wrapper is
+// for pulls wired with remotes.FetchHandler.  Content is not protected between
+// being written and being labeled, so pulls should still hold a lease.  Once
+// the image is recorded, or if the pull is abandoned, ReleaseGCRoot removes
+// the root label.
+func GCLabelWrapper(store content.Manager, root ocispec.Descriptor) func(images.Handler) images.Handler {
+	return func(handler images.Handler) images.Handler {
+		labeled := images.SetChildrenLabels(store, handler.Handle)
+		return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			children, err := labeled(ctx, desc)
+			if err != nil {
+				return children, err
+			}
+			if desc.Digest == root.Digest {
+				if _, err := store.Update(ctx, content.Info{
+					Digest: desc.Digest,
+					Labels: map[string]string{LabelGCRoot: time.Now().UTC().Format(time.RFC3339)},
+				}, "labels."+LabelGCRoot); err != nil {
+					return nil, err
+				}
+				log.G(ctx).
+					WithField("digest", desc.Digest).
+					Debug("ecr.gc: labeled root")
+			}
+			return children, nil
+		})
+	}
+}
+
+// ReleaseGCRoot removes the LabelGCRoot label added by GCLabelWrapper from
+// root, so that the image is collected once nothing else references it.
+func ReleaseGCRoot(ctx context.Context, store content.Manager, root ocispec.Descriptor) error {
+	_, err := store.Update(ctx, content.Info{Digest: root.Digest}, "labels."+LabelGCRoot)
+	return err
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryLabelStore is a local.LabelStore holding labels in memory.
+type memoryLabelStore struct {
+	mu     sync.Mutex
+	labels map[digest.Digest]map[string]string
+}
+
+func (s *memoryLabelStore) Get(dgst digest.Digest) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.labels[dgst], nil
+}
+
+func (s *memoryLabelStore) Set(dgst digest.Digest, labels map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labels[dgst] = labels
+	return nil
+}
+
+func (s *memoryLabelStore) Update(dgst digest.Digest, update map[string]string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	labels := s.labels[dgst]
+	if labels == nil {
+		labels = map[string]string{}
+		s.labels[dgst] = labels
+	}
+	for key, value := range update {
+		if value == "" {
+			delete(labels, key)
+		} else {
+			labels[key] = value
+		}
+	}
+	return labels, nil
+}
+
+func TestGCLabelWrapper(t *testing.T) {
+	ctx := context.Background()
+	source := newFakeRegistry()
+	index, manifests := putMultiArchImage(source, "source")
+	labels := &memoryLabelStore{labels: map[digest.Digest]map[string]string{}}
+	store, err := local.NewLabeledStore(t.TempDir(), labels)
+	require.NoError(t, err)
+
+	handler := GCLabelWrapper(store, index)(images.Handlers(
+		remotes.FetchHandler(store, source),
+		images.ChildrenHandler(store)))
+	require.NoError(t, images.Dispatch(ctx, handler, nil, index))
+
+	info, err := store.Info(ctx, index.Digest)
+	require.NoError(t, err)
+	assert.NotEmpty(t, info.Labels[LabelGCRoot], "root should be labeled as a GC root")
+	assert.Equal(t, manifests[0].Digest.String(), info.Labels["containerd.io/gc.ref.content.m.0"])
+	assert.Equal(t, manifests[1].Digest.String(), info.Labels["containerd.io/gc.ref.content.m.1"])
+	for _, manifest := range manifests {
+		info, err := store.Info(ctx, manifest.Digest)
+		require.NoError(t, err)
+		assert.NotContains(t, info.Labels, LabelGCRoot, "only the root should be a GC root")
+		refs := 0
+		for key := range info.Labels {
+			if strings.HasPrefix(key, "containerd.io/gc.ref.content.") {
+				refs++
+			}
+		}
+		assert.Equal(t, 2, refs, "manifest should reference its config and layer")
+	}
+
+	require.NoError(t, ReleaseGCRoot(ctx, store, index))
+	info, err = store.Info(ctx, index.Digest)
+	require.NoError(t, err)
+	assert.NotContains(t, info.Labels, LabelGCRoot, "released root should not be a GC root")
+	assert.Contains(t, info.Labels, "containerd.io/gc.ref.content.m.0", "released root should keep its references")
+}
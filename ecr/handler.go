@@ -0,0 +1,138 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/semaphore"
+)
+
+// FetchHandlerOption represents a functional option for configuring
+// FetchHandler.
+type FetchHandlerOption func(*FetchHandlerOptions) error
+
+// FetchHandlerOptions represents available options for configuring
+// FetchHandler.
+type FetchHandlerOptions struct {
+	// Platforms restricts the manifests fetched from an image index to those
+	// matching the platform.  If not specified, all manifests are fetched.
+	Platforms platforms.MatchComparer
+	// ManifestLimit bounds the number of manifests fetched from each image
+	// index, preferring those ranked first by Platforms.  If not specified,
+	// all matching manifests are fetched.
+	ManifestLimit int
+	// Concurrency bounds the number of descriptors fetched at once by the
+	// handler.  If not specified, fetches are not limited.
+	Concurrency int
+}
+
+// WithFetchPlatforms is a FetchHandlerOption to fetch only the manifests of
+// an image index for the specified platforms, such as "linux/amd64", ranked
+// in the order given.
+func WithFetchPlatforms(specifiers ...string) FetchHandlerOption {
+	return func(options *FetchHandlerOptions) error {
+		var ps []ocispec.Platform
+		for _, specifier := range specifiers {
+			p, err := platforms.Parse(specifier)
+			if err != nil {
+				return err
+			}
+			ps = append(ps, p)
+		}
+		options.Platforms = platforms.Ordered(ps...)
+		return nil
+	}
+}
+
+// WithFetchManifestLimit is a FetchHandlerOption to fetch at most limit
+// manifests from each image index, such as the single best match for the
+// platforms given with WithFetchPlatforms.
+func WithFetchManifestLimit(limit int) FetchHandlerOption {
+	return func(options *FetchHandlerOptions) error {
+		if limit <= 0 {
+			return errors.New("manifest limit must be positive")
+		}
+		options.ManifestLimit = limit
+		return nil
+	}
+}
+
+// WithFetchConcurrency is a FetchHandlerOption to bound the number of
+// descriptors fetched at once by the handler.
+func WithFetchConcurrency(concurrency int) FetchHandlerOption {
+	return func(options *FetchHandlerOptions) error {
+		if concurrency <= 0 {
+			return errors.New("fetch concurrency must be positive")
+		}
+		options.Concurrency = concurrency
+		return nil
+	}
+}
+
+// FetchHandler returns an image handler fetching content into store with
+// fetcher and returning the children of each manifest and index, for use
+// with images.Dispatch by consumers composing their own pull pipelines.  It
+// combines remotes.FetchHandler and images.ChildrenHandler with the platform
+// filtering and limits configured by opts, which images.Dispatch would
+// otherwise leave to the caller.  The fetcher should be created by the same
+// resolver as the descriptors dispatched, so that layer download limits and
+// retries set on the resolver apply.
+//
+// The handler may be wrapped, such as by GCLabelWrapper or
+// DescriptorHookWrapper, before being dispatched.
+func FetchHandler(store content.Store, fetcher remotes.Fetcher, opts ...FetchHandlerOption) (images.Handler, error) {
+	var options FetchHandlerOptions
+	for _, opt := range opts {
+		if err := opt(&options); err != nil {
+			return nil, err
+		}
+	}
+
+	fetch := remotes.FetchHandler(store, fetcher)
+	if options.Concurrency > 0 {
+		fetch = limitHandler(fetch, semaphore.NewWeighted(int64(options.Concurrency)))
+	}
+	children := images.ChildrenHandler(store)
+	if options.Platforms != nil {
+		children = images.FilterPlatforms(children, options.Platforms)
+	}
+	if options.ManifestLimit > 0 {
+		platform := options.Platforms
+		if platform == nil {
+			platform = platforms.All
+		}
+		children = images.LimitManifests(children, platform, options.ManifestLimit)
+	}
+	return images.Handlers(fetch, children), nil
+}
+
+// limitHandler returns handler run while holding a slot of limiter.
+func limitHandler(handler images.HandlerFunc, limiter *semaphore.Weighted) images.HandlerFunc {
+	return func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if err := limiter.Acquire(ctx, 1); err != nil {
+			return nil, err
+		}
+		defer limiter.Release(1)
+		return handler(ctx, desc)
+	}
+}
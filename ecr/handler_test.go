@@ -0,0 +1,60 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchHandler(t *testing.T) {
+	registry := newFakeRegistry()
+	index, manifests := putMultiArchImage(registry, "image")
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	handler, err := FetchHandler(store, registry, WithFetchPlatforms("linux/arm64"), WithFetchConcurrency(1))
+	require.NoError(t, err)
+	require.NoError(t, images.Dispatch(context.Background(), handler, nil, index))
+
+	has := func(dgst digest.Digest) bool {
+		_, err := store.Info(context.Background(), dgst)
+		return err == nil
+	}
+	assert.True(t, has(index.Digest))
+	assert.True(t, has(manifests[1].Digest))
+	assert.True(t, has(digest.FromString("layer for arm64")))
+	assert.False(t, has(manifests[0].Digest), "other platforms should not be fetched")
+	assert.False(t, has(digest.FromString("layer for amd64")))
+}
+
+func TestFetchHandlerInvalidOptions(t *testing.T) {
+	registry := newFakeRegistry()
+	for name, opt := range map[string]FetchHandlerOption{
+		"platform":    WithFetchPlatforms("not/a/valid/platform"),
+		"limit":       WithFetchManifestLimit(0),
+		"concurrency": WithFetchConcurrency(-1),
+	} {
+		_, err := FetchHandler(nil, registry, opt)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DescriptorHook is invoked with descriptors resolved for ref and returns the
+// descriptor to use in their place.  Hooks are typically used to add
+// annotations, such as tenant or billing metadata, which are then recorded by
+// containerd alongside the image.  Returning an error aborts the operation.
+type DescriptorHook func(ctx context.Context, ref string, desc ocispec.Descriptor) (ocispec.Descriptor, error)
+
+// DescriptorHookWrapper returns an image handler wrapper that applies hook to
+// the children of each descriptor visited by the wrapped handler.  It is
+// suitable for use with containerd.WithImageHandlerWrapper so that the hook
+// sees every descriptor produced while walking an image, in addition to the
+// root descriptor returned by Resolve.
+func DescriptorHookWrapper(ref string, hook DescriptorHook) func(images.Handler) images.Handler {
+	return func(handler images.Handler) images.Handler {
+		return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			children, err := handler.Handle(ctx, desc)
+			if err != nil {
+				return children, err
+			}
+			for i := range children {
+				children[i], err = hook(ctx, ref, children[i])
+				if err != nil {
+					return nil, err
+				}
+			}
+			return children, nil
+		})
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+)
+
+func tenantHook(_ context.Context, ref string, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	annotations := map[string]string{"example.com/tenant": "team-a"}
+	for k, v := range desc.Annotations {
+		annotations[k] = v
+	}
+	desc.Annotations = annotations
+	return desc, nil
+}
+
+func TestResolveDescriptorHook(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(testdata.ImageDigest.String())},
+				ImageManifest: aws.String(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`),
+			}}}, nil
+		},
+	}
+	var hookRef string
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{"fake": fakeClient},
+		descriptorHook: func(ctx context.Context, ref string, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+			hookRef = ref
+			return tenantHook(ctx, ref, desc)
+		},
+	}
+
+	_, desc, err := resolver.Resolve(context.Background(), ref)
+	require.NoError(t, err)
+	assert.Equal(t, ref, hookRef)
+	assert.Equal(t, "team-a", desc.Annotations["example.com/tenant"])
+	assert.Equal(t, testdata.ImageDigest, desc.Digest)
+}
+
+func TestResolveDescriptorHookError(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	expected := errors.New("expected")
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(testdata.ImageDigest.String())},
+				ImageManifest: aws.String(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`),
+			}}}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{"fake": fakeClient},
+		descriptorHook: func(context.Context, string, ocispec.Descriptor) (ocispec.Descriptor, error) {
+			return ocispec.Descriptor{}, expected
+		},
+	}
+
+	_, _, err := resolver.Resolve(context.Background(), ref)
+	assert.Equal(t, expected, err)
+}
+
+func TestDescriptorHookWrapper(t *testing.T) {
+	children := []ocispec.Descriptor{
+		{MediaType: ocispec.MediaTypeImageConfig},
+		{MediaType: ocispec.MediaTypeImageLayerGzip, Annotations: map[string]string{"existing": "value"}},
+	}
+	handler := images.HandlerFunc(func(context.Context, ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		return children, nil
+	})
+
+	wrapped := DescriptorHookWrapper("ref", tenantHook)(handler)
+	actual, err := wrapped.Handle(context.Background(), ocispec.Descriptor{})
+	require.NoError(t, err)
+	require.Len(t, actual, 2)
+	for _, child := range actual {
+		assert.Equal(t, "team-a", child.Annotations["example.com/tenant"])
+	}
+	assert.Equal(t, "value", actual[1].Annotations["existing"])
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// defaultHostPollInterval is how often a HostCoordinator retries the locks
+// held by other processes if no other interval is configured.
+const defaultHostPollInterval = 100 * time.Millisecond
+
+// HostCoordinatorOptions configures the HostCoordinator returned by
+// NewHostCoordinator.
+type HostCoordinatorOptions struct {
+	// Dir is the directory holding the lock files, shared by every process
+	// coordinating its downloads.  It is created if it does not exist.
+	Dir string
+	// Slots bounds the number of layers downloaded at once by all of the
+	// processes together, to share the host's bandwidth.  If not specified,
+	// downloads are not bounded.
+	Slots int
+	// Content is the content store shared by the processes, such as
+	// containerd's.  A layer found in it, such as once another process has
+	// downloaded it, is read from it rather than downloaded.  If not
+	// specified, each process downloads the layer in turn.
+	Content content.Provider
+	// PollInterval is how often locks held by other processes are tried
+	// again.  If not specified, they are tried every 100ms.
+	PollInterval time.Duration
+	// Clock times the waits for locks.  If not specified, SystemClock is
+	// used.
+	Clock Clock
+}
+
+// HostCoordinator coordinates the layer downloads of several processes on a
+// host, such as an agent and a CLI pulling with this package at the same
+// time.  A layer is downloaded by one process at a time: a process finding
+// that another has started to download the layer waits for it to finish,
+// deferring to whichever started first.  Downloads hold the locks they take
+// until the readers returned by Fetch are closed.
+//
+// The processes coordinate with file locks in a shared directory, which are
+// released by the operating system if a process exits.  The lock files are
+// left in the directory.  File locks are not implemented on every platform;
+// NewHostCoordinator returns an error wrapping errdefs.ErrNotImplemented
+// where they are not.
+type HostCoordinator struct {
+	options HostCoordinatorOptions
+}
+
+// NewHostCoordinator returns a HostCoordinator, to be given to the resolvers
+// of each process with WithHostCoordinator.
+func NewHostCoordinator(options HostCoordinatorOptions) (*HostCoordinator, error) {
+	if options.Dir == "" {
+		return nil, errors.New("host coordinator directory must not be empty")
+	}
+	if options.Slots < 0 {
+		return nil, errors.New("host coordinator slots must not be negative")
+	}
+	if options.PollInterval < 0 {
+		return nil, errors.New("host coordinator poll interval must not be negative")
+	}
+	if err := checkFileLocks(); err != nil {
+		return nil, err
+	}
+	if options.PollInterval == 0 {
+		options.PollInterval = defaultHostPollInterval
+	}
+	if options.Clock == nil {
+		options.Clock = SystemClock
+	}
+	for _, dir := range []string{filepath.Join(options.Dir, "layers"), filepath.Join(options.Dir, "slots")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &HostCoordinator{options: options}, nil
+}
+
+// fetch returns the content of the layer desc from the shared content store
+// or with download, once no other download of the layer is in progress and a
+// slot is free.  c may be nil, in which case download is called at once.
+func (c *HostCoordinator) fetch(ctx context.Context, desc ocispec.Descriptor, download func(context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if c == nil {
+		return download(ctx)
+	}
+	unlockLayer, err := c.lockLayer(ctx, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if rc, ok := c.stored(ctx, desc); ok {
+		unlockLayer()
+		return rc, nil
+	}
+	unlockSlot, err := c.acquireSlot(ctx)
+	if err != nil {
+		unlockLayer()
+		return nil, err
+	}
+	release := func() {
+		unlockSlot()
+		unlockLayer()
+	}
+	rc, err := download(ctx)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &releaseOnClose{ReadCloser: rc, release: release}, nil
+}
+
+// lockLayer waits until no other download of dgst holds its lock, and takes
+// the lock.  The returned function releases it.
+func (c *HostCoordinator) lockLayer(ctx context.Context, dgst digest.Digest) (func(), error) {
+	path := filepath.Join(c.options.Dir, "layers", dgst.Algorithm().String()+"-"+dgst.Encoded()+".lock")
+	for waiting := false; ; waiting = true {
+		f, ok, err := tryLock(path)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return func() { f.Close() }, nil
+		}
+		if !waiting {
+			log.G(ctx).Debug("ecr.host: waiting for download of layer by another process")
+		}
+		if err := c.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// acquireSlot waits until one of the download slots is free, and takes it.
+// The returned function releases it.
+func (c *HostCoordinator) acquireSlot(ctx context.Context) (func(), error) {
+	if c.options.Slots == 0 {
+		return func() {}, nil
+	}
+	for {
+		for i := 0; i < c.options.Slots; i++ {
+			f, ok, err := tryLock(filepath.Join(c.options.Dir, "slots", fmt.Sprintf("%d.lock", i)))
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return func() { f.Close() }, nil
+			}
+		}
+		if err := c.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *HostCoordinator) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.options.Clock.After(c.options.PollInterval):
+		return nil
+	}
+}
+
+// stored returns a reader of desc from the shared content store, if it holds
+// desc in full.
+func (c *HostCoordinator) stored(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, bool) {
+	if c.options.Content == nil {
+		return nil, false
+	}
+	ra, err := c.options.Content.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, false
+	}
+	if desc.Size > 0 && ra.Size() != desc.Size {
+		ra.Close()
+		return nil, false
+	}
+	log.G(ctx).Debug("ecr.host: reading layer from shared content store")
+	return &readerAtCloser{Reader: content.NewReader(ra), closer: ra}, true
+}
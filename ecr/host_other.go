@@ -0,0 +1,35 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/containerd/containerd/errdefs"
+)
+
+func checkFileLocks() error {
+	return fmt.Errorf("host coordinator file locks on %s: %w", runtime.GOOS, errdefs.ErrNotImplemented)
+}
+
+func tryLock(string) (*os.File, bool, error) {
+	return nil, false, checkFileLocks()
+}
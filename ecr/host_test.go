@@ -0,0 +1,136 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestHostCoordinator(t *testing.T, dir string, slots int, provider content.Provider) *HostCoordinator {
+	coordinator, err := NewHostCoordinator(HostCoordinatorOptions{
+		Dir:          dir,
+		Slots:        slots,
+		Content:      provider,
+		PollInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+	return coordinator
+}
+
+// startHostFetch fetches desc with coordinator in the background, sending
+// the reader returned once the download starts.
+func startHostFetch(coordinator *HostCoordinator, desc ocispec.Descriptor, data []byte, downloads chan<- digest.Digest) <-chan io.ReadCloser {
+	started := make(chan io.ReadCloser, 1)
+	go func() {
+		rc, err := coordinator.fetch(context.Background(), desc, func(context.Context) (io.ReadCloser, error) {
+			downloads <- desc.Digest
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		})
+		if err == nil {
+			started <- rc
+		}
+	}()
+	return started
+}
+
+func TestHostCoordinatorLayerLock(t *testing.T) {
+	dir := t.TempDir()
+	// Coordinators sharing a directory stand for processes on a host.
+	first := newTestHostCoordinator(t, dir, 0, nil)
+	second := newTestHostCoordinator(t, dir, 0, nil)
+	data := []byte("layer")
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	downloads := make(chan digest.Digest, 3)
+
+	rc := <-startHostFetch(first, desc, data, downloads)
+	waiting := startHostFetch(second, desc, data, downloads)
+	select {
+	case <-waiting:
+		t.Fatal("layer should not be downloaded while another download holds its lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	other := []byte("other")
+	otherDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(other), Size: int64(len(other))}
+	(<-startHostFetch(second, otherDesc, other, downloads)).Close()
+
+	require.NoError(t, rc.Close())
+	rc = <-waiting
+	fetched, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, data, fetched)
+	require.NoError(t, rc.Close())
+	assert.Len(t, downloads, 3)
+}
+
+func TestHostCoordinatorSlots(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestHostCoordinator(t, dir, 1, nil)
+	second := newTestHostCoordinator(t, dir, 1, nil)
+	downloads := make(chan digest.Digest, 2)
+
+	data := []byte("first")
+	rc := <-startHostFetch(first, ocispec.Descriptor{Digest: digest.FromBytes(data)}, data, downloads)
+	data = []byte("second")
+	waiting := startHostFetch(second, ocispec.Descriptor{Digest: digest.FromBytes(data)}, data, downloads)
+	select {
+	case <-waiting:
+		t.Fatal("download should wait for a free slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, rc.Close())
+	(<-waiting).Close()
+}
+
+func TestHostCoordinatorSharedContent(t *testing.T) {
+	ctx := context.Background()
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	coordinator := newTestHostCoordinator(t, t.TempDir(), 0, store)
+	data := []byte("layer")
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	require.NoError(t, content.WriteBlob(ctx, store, "layer", bytes.NewReader(data), desc))
+
+	rc, err := coordinator.fetch(ctx, desc, func(context.Context) (io.ReadCloser, error) {
+		t.Error("layer in the shared content store should not be downloaded")
+		return nil, nil
+	})
+	require.NoError(t, err)
+	fetched, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, data, fetched)
+	require.NoError(t, rc.Close())
+}
+
+func TestNewHostCoordinatorInvalid(t *testing.T) {
+	_, err := NewHostCoordinator(HostCoordinatorOptions{})
+	assert.Error(t, err)
+	_, err = NewHostCoordinator(HostCoordinatorOptions{Dir: t.TempDir(), Slots: -1})
+	assert.Error(t, err)
+	_, err = NewResolver(WithHostCoordinator(nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"net/http"
+	"strings"
+)
+
+// userAgentTransport is an http.RoundTripper that appends a caller-provided
+// token to the User-Agent of each request. It is installed on the HTTP client
+// shared by the ECR API clients and layer downloads so that both are
+// identified consistently.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+var _ http.RoundTripper = (*userAgentTransport)(nil)
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ua := req.Header.Get("User-Agent")
+	if !strings.Contains(ua, t.userAgent) {
+		// Requests must not be modified by a RoundTripper.
+		req = req.Clone(req.Context())
+		if ua == "" {
+			req.Header.Set("User-Agent", t.userAgent)
+		} else {
+			req.Header.Set("User-Agent", ua+" "+t.userAgent)
+		}
+	}
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
+
+// withUserAgent returns a shallow copy of client whose transport appends
+// userAgent to every request.
+func withUserAgent(client *http.Client, userAgent string) *http.Client {
+	wrapped := *client
+	wrapped.Transport = &userAgentTransport{
+		base:      client.Transport,
+		userAgent: userAgent,
+	}
+	return &wrapped
+}
+
+// HeaderFunc returns headers to add to an HTTP request sent by the resolver,
+// such as a tenant identifier taken from the request's context.
+type HeaderFunc func(req *http.Request) http.Header
+
+// headerTransport is an http.RoundTripper that adds caller-provided headers
+// to each request, for egress proxies requiring them.  It is installed on the
+// HTTP client shared by the ECR API clients and layer downloads.  Headers
+// already set on a request, Authorization, and X-Amz-* headers are never
+// added, as they are covered by request signatures and presigned URLs.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+	fn      HeaderFunc
+}
+
+var _ http.RoundTripper = (*headerTransport)(nil)
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	headers := t.headers
+	if t.fn != nil {
+		headers = headers.Clone()
+		if headers == nil {
+			headers = http.Header{}
+		}
+		for name, values := range t.fn(req) {
+			for _, value := range values {
+				headers.Add(name, value)
+			}
+		}
+	}
+	var cloned bool
+	for name, values := range headers {
+		name = http.CanonicalHeaderKey(name)
+		if !addableHeader(name) || req.Header.Get(name) != "" {
+			continue
+		}
+		if !cloned {
+			// Requests must not be modified by a RoundTripper.
+			req = req.Clone(req.Context())
+			cloned = true
+		}
+		req.Header[name] = append([]string(nil), values...)
+	}
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
+
+// addableHeader reports whether the canonical header name may be added to
+// requests without invalidating their signatures.
+func addableHeader(name string) bool {
+	return name != "Authorization" && name != "Host" && !strings.HasPrefix(name, "X-Amz-")
+}
+
+// withHeaders returns a shallow copy of client whose transport adds headers,
+// and those returned by fn if it is not nil, to every request.
+func withHeaders(client *http.Client, headers http.Header, fn HeaderFunc) *http.Client {
+	wrapped := *client
+	wrapped.Transport = &headerTransport{
+		base:    client.Transport,
+		headers: headers,
+		fn:      fn,
+	}
+	return &wrapped
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserAgentTransport(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		existing string
+		expected string
+	}{
+		{name: "unset", existing: "", expected: "tool/1.0"},
+		{name: "appended", existing: "aws-sdk-go/1.44", expected: "aws-sdk-go/1.44 tool/1.0"},
+		{name: "idempotent", existing: "aws-sdk-go/1.44 tool/1.0", expected: "aws-sdk-go/1.44 tool/1.0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var actual string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				actual = r.Header.Get("User-Agent")
+			}))
+			defer ts.Close()
+
+			client := withUserAgent(ts.Client(), "tool/1.0")
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			require.NoError(t, err)
+			if tc.existing != "" {
+				req.Header.Set("User-Agent", tc.existing)
+			}
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, tc.expected, actual)
+			assert.Equal(t, tc.existing, req.Header.Get("User-Agent"), "caller's request should not be modified")
+		})
+	}
+}
+
+func TestWithUserAgentFetch(t *testing.T) {
+	var userAgent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+	}))
+	defer ts.Close()
+
+	resolver, err := NewResolver(
+		WithSession(unit.Session),
+		WithHTTPClient(ts.Client()),
+		WithUserAgent("tool", "1.0"))
+	require.NoError(t, err)
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+
+	rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2LayerForeignGzip,
+		URLs:      []string{ts.URL},
+	})
+	require.NoError(t, err)
+	rc.Close()
+	assert.Contains(t, userAgent, "tool/1.0")
+}
+
+func TestWithUserAgentRequiresName(t *testing.T) {
+	_, err := NewResolver(WithSession(unit.Session), WithUserAgent("", "1.0"))
+	assert.Error(t, err)
+}
+
+func TestHeaderTransport(t *testing.T) {
+	var actual http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actual = r.Header
+	}))
+	defer ts.Close()
+
+	client := withHeaders(ts.Client(), http.Header{"X-Proxy": {"static"}, "X-Existing": {"added"}},
+		func(req *http.Request) http.Header {
+			return http.Header{
+				"X-Tenant":       {fmt.Sprint(req.Context().Value(tenantKey{}))},
+				"X-Amz-Security": {"unsigned"},
+			}
+		})
+	req, err := http.NewRequestWithContext(WithTenant(context.Background(), "tenant"), http.MethodGet, ts.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Existing", "original")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, "static", actual.Get("X-Proxy"))
+	assert.Equal(t, "tenant", actual.Get("X-Tenant"), "should add headers derived from the request")
+	assert.Equal(t, "original", actual.Get("X-Existing"), "should not replace headers set on the request")
+	assert.Empty(t, actual.Get("X-Amz-Security"), "should not add signed headers")
+	assert.Empty(t, req.Header.Get("X-Proxy"), "caller's request should not be modified")
+}
+
+func TestWithHeaders(t *testing.T) {
+	var proxy string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxy = r.Header.Get("X-Proxy")
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		fmt.Fprint(w, `{"images":[],"failures":[]}`)
+	}))
+	defer ts.Close()
+
+	resolver, err := NewResolver(
+		WithSession(unit.Session.Copy(&aws.Config{Endpoint: aws.String(ts.URL)})),
+		WithHeaders(http.Header{"X-Proxy": {"tenant"}}))
+	require.NoError(t, err)
+	_, _, _ = resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	assert.Equal(t, "tenant", proxy, "should add headers to ECR API requests")
+
+	_, err = NewResolver(WithHeaders(http.Header{"x-amz-date": {"now"}}))
+	assert.Error(t, err, "signed headers should be rejected")
+	_, err = NewResolver(WithHeaderFunc(nil))
+	assert.Error(t, err)
+}
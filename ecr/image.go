@@ -0,0 +1,203 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// AnnotationImagePushedAt is the annotation returned by
+	// ImageInfo.Annotations for the time an image was pushed, formatted as
+	// RFC 3339.
+	AnnotationImagePushedAt = "com.amazonaws.ecr.image.pushed-at"
+	// AnnotationImageLastRecordedPullTime is the annotation returned by
+	// ImageInfo.Annotations for the time ECR last recorded a pull of an
+	// image, formatted as RFC 3339.
+	AnnotationImageLastRecordedPullTime = "com.amazonaws.ecr.image.last-recorded-pull-time"
+	// AnnotationImageSize is the annotation returned by ImageInfo.Annotations
+	// for the size of an image in bytes, as reported by ECR.
+	AnnotationImageSize = "com.amazonaws.ecr.image.size"
+)
+
+// ImageInspector is implemented by resolvers able to describe the images
+// stored in a repository, including when they were last pulled, so that
+// cleanup tools can find stale images.  The resolver returned by NewResolver
+// implements it.
+type ImageInspector interface {
+	// InspectImage describes the image named by ref.
+	InspectImage(ctx context.Context, ref string) (*ImageInfo, error)
+	// InspectImages describes every image in the repository named by ref,
+	// ignoring its tag or digest.
+	InspectImages(ctx context.Context, ref string) ([]ImageInfo, error)
+}
+
+var _ ImageInspector = (*ecrResolver)(nil)
+
+// ImageProber is implemented by resolvers able to report whether an image
+// exists without fetching its manifest.  The resolver returned by NewResolver
+// implements it.
+type ImageProber interface {
+	// Exists reports whether the image named by ref exists, and if so its
+	// descriptor.
+	Exists(ctx context.Context, ref string) (bool, ocispec.Descriptor, error)
+}
+
+var _ ImageProber = (*ecrResolver)(nil)
+
+// ImageInfo describes an image as recorded by ECR.  ECR does not report how
+// many times an image has been pulled, only when it was last pulled.
+type ImageInfo struct {
+	// Digest of the image manifest.
+	Digest digest.Digest
+	// Tags of the image, if any.
+	Tags []string
+	// MediaType of the image manifest.
+	MediaType string
+	// Size of the image in bytes, as reported by ECR.
+	Size int64
+	// PushedAt is the time the image was pushed.
+	PushedAt time.Time
+	// LastRecordedPullTime is the time ECR last recorded a pull of the
+	// image, or the zero time if it has not recorded one.  ECR refreshes it
+	// at most once every 24 hours, so it is only suitable for finding images
+	// which have not been pulled for days.
+	LastRecordedPullTime time.Time
+}
+
+// Annotations returns the image's metadata as annotations, suitable for
+// adding to descriptors with a DescriptorHook.  Times which are not known are
+// omitted.
+func (i ImageInfo) Annotations() map[string]string {
+	annotations := map[string]string{
+		AnnotationImageSize: strconv.FormatInt(i.Size, 10),
+	}
+	if !i.PushedAt.IsZero() {
+		annotations[AnnotationImagePushedAt] = i.PushedAt.UTC().Format(time.RFC3339)
+	}
+	if !i.LastRecordedPullTime.IsZero() {
+		annotations[AnnotationImageLastRecordedPullTime] = i.LastRecordedPullTime.UTC().Format(time.RFC3339)
+	}
+	return annotations
+}
+
+// InspectImage describes the image named by ref.  An error wrapping
+// errdefs.ErrNotFound is returned if the image does not exist, and
+// ErrRepositoryNotFound if its repository does not exist.
+func (r *ecrResolver) InspectImage(ctx context.Context, ref string) (*ImageInfo, error) {
+	ecrSpec, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	if ecrSpec.Object == "" {
+		return nil, fmt.Errorf("%s: reference names no image: %w", ref, errdefs.ErrInvalidArgument)
+	}
+	images, err := r.describeImages(ctx, ecrSpec, []*ecr.ImageIdentifier{ecrSpec.ImageID()})
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("%s: %w", ref, errdefs.ErrNotFound)
+	}
+	return &images[0], nil
+}
+
+// Exists reports whether the image named by ref exists using DescribeImages,
+// which is cheaper than resolving it for controllers which only need to know
+// whether a tag or digest is present.  ECR does not report the size of the
+// manifest itself, so the descriptor returned has no size; its annotations
+// carry the image's metadata instead.  ErrRepositoryNotFound is returned if
+// the repository does not exist.
+func (r *ecrResolver) Exists(ctx context.Context, ref string) (bool, ocispec.Descriptor, error) {
+	info, err := r.InspectImage(ctx, ref)
+	if err != nil {
+		if errdefs.IsNotFound(err) && !errors.Is(err, ErrRepositoryNotFound) {
+			return false, ocispec.Descriptor{}, nil
+		}
+		return false, ocispec.Descriptor{}, err
+	}
+	return true, ocispec.Descriptor{
+		MediaType:   info.MediaType,
+		Digest:      info.Digest,
+		Annotations: info.Annotations(),
+	}, nil
+}
+
+// InspectImages describes every image in the repository named by ref.
+// ErrRepositoryNotFound is returned if the repository does not exist.
+func (r *ecrResolver) InspectImages(ctx context.Context, ref string) ([]ImageInfo, error) {
+	ecrSpec, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	return r.describeImages(ctx, ecrSpec, nil)
+}
+
+// describeImages describes the images of ecrSpec's repository identified by
+// imageIDs, or all of its images if imageIDs is empty, following every page
+// of results.
+func (r *ecrResolver) describeImages(ctx context.Context, ecrSpec ECRSpec, imageIDs []*ecr.ImageIdentifier) ([]ImageInfo, error) {
+	client := r.getClient(ecrSpec.Region(), ecrSpec.Registry())
+	input := &ecr.DescribeImagesInput{
+		RegistryId:     aws.String(ecrSpec.Registry()),
+		RepositoryName: aws.String(ecrSpec.Repository),
+		ImageIds:       imageIDs,
+	}
+	var images []ImageInfo
+	for {
+		output, err := client.DescribeImagesWithContext(ctx, input)
+		if err != nil {
+			switch {
+			case isRepositoryNotFound(err):
+				return nil, fmt.Errorf("%s: %w", ecrSpec.Repository, ErrRepositoryNotFound)
+			case isAWSErrorCode(err, ecr.ErrCodeImageNotFoundException):
+				return nil, fmt.Errorf("%s: %v: %w", ecrSpec.Canonical(), err, errdefs.ErrNotFound)
+			}
+			return nil, err
+		}
+		for _, detail := range output.ImageDetails {
+			images = append(images, ImageInfo{
+				Digest:               digest.Digest(aws.StringValue(detail.ImageDigest)),
+				Tags:                 aws.StringValueSlice(detail.ImageTags),
+				MediaType:            aws.StringValue(detail.ImageManifestMediaType),
+				Size:                 aws.Int64Value(detail.ImageSizeInBytes),
+				PushedAt:             aws.TimeValue(detail.ImagePushedAt),
+				LastRecordedPullTime: aws.TimeValue(detail.LastRecordedPullTime),
+			})
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			break
+		}
+		input.NextToken = output.NextToken
+	}
+
+	log.G(ctx).
+		WithField("repository", ecrSpec.Repository).
+		WithField("images", len(images)).
+		Debug("ecr.resolver.image: inspected images")
+	return images, nil
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type imageStoreResolver struct {
+	images   images.Store
+	provider content.Provider
+}
+
+var _ remotes.Resolver = (*imageStoreResolver)(nil)
+
+// NewImageStoreResolver returns a read-only resolver for the images of a
+// containerd image store, whose content is read from provider.  Refs are the
+// names of the images, as listed by `ctr images ls`.  Using it as the source
+// of Copy pushes images from containerd; PushImage does so by name.
+func NewImageStoreResolver(store images.Store, provider content.Provider) remotes.Resolver {
+	return &imageStoreResolver{images: store, provider: provider}
+}
+
+// PushImage pushes the image named name in a containerd image store, whose
+// content is read from provider, to ref with destination, as `ctr images
+// push` does.  Content already present at the destination is not pushed, and
+// options are applied as with Copy.
+//
+// Images pulled by containerd for a single platform only hold the content of
+// that platform, so images with an index should be pushed with
+// WithCopyPlatforms naming the platforms present; the pushed index then lists
+// only those platforms.  The descriptor of the pushed root manifest or index
+// is returned.
+func PushImage(ctx context.Context, store images.Store, provider content.Provider, name string, destination remotes.Resolver, ref string, opts ...CopyOption) (ocispec.Descriptor, error) {
+	return Copy(ctx, NewImageStoreResolver(store, provider), name, destination, ref, opts...)
+}
+
+func (r *imageStoreResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	image, err := r.images.Get(ctx, ref)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	return ref, image.Target, nil
+}
+
+func (r *imageStoreResolver) Fetcher(context.Context, string) (remotes.Fetcher, error) {
+	return r, nil
+}
+
+func (r *imageStoreResolver) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	ra, err := r.provider.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return &readerAtCloser{Reader: io.NewSectionReader(ra, 0, ra.Size()), closer: ra}, nil
+}
+
+func (r *imageStoreResolver) Pusher(context.Context, string) (remotes.Pusher, error) {
+	return nil, fmt.Errorf("image stores are read-only: %w", errdefs.ErrNotImplemented)
+}
+
+// readerAtCloser reads the content of a content.ReaderAt sequentially,
+// closing it when closed.
+type readerAtCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *readerAtCloser) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeImageStore is an images.Store supporting only Get.
+type fakeImageStore struct {
+	images.Store
+	images map[string]images.Image
+}
+
+func (s *fakeImageStore) Get(_ context.Context, name string) (images.Image, error) {
+	image, ok := s.images[name]
+	if !ok {
+		return images.Image{}, fmt.Errorf("image %q: %w", name, errdefs.ErrNotFound)
+	}
+	return image, nil
+}
+
+func TestPushImage(t *testing.T) {
+	ctx := context.Background()
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	index, manifests := putMultiArchImage(source, "multi")
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	_, err = PullAll(ctx, store, []PullImage{{Source: source, Ref: "multi"}})
+	require.NoError(t, err)
+	imageStore := &fakeImageStore{images: map[string]images.Image{
+		"docker.io/library/multi:latest": {Name: "docker.io/library/multi:latest", Target: index},
+	}}
+
+	desc, err := PushImage(ctx, imageStore, store, "docker.io/library/multi:latest", destination, "pushed", WithCopyPlatforms("linux/arm64"))
+	require.NoError(t, err)
+	assert.NotEqual(t, index.Digest, desc.Digest, "filtered index should be rewritten")
+	_, tagged, err := destination.Resolve(ctx, "pushed")
+	require.NoError(t, err)
+	assert.Equal(t, desc.Digest, tagged.Digest)
+	assert.True(t, destination.has(manifests[1].Digest), "arm64 manifest should be pushed")
+	assert.False(t, destination.has(manifests[0].Digest), "amd64 manifest should not be pushed")
+
+	_, err = PushImage(ctx, imageStore, store, "docker.io/library/missing:latest", destination, "pushed")
+	assert.True(t, errdefs.IsNotFound(err), "unexpected error %v", err)
+}
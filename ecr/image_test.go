@@ -0,0 +1,164 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectImage(t *testing.T) {
+	pushed := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	pulled := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+	dgst := digest.FromString("manifest")
+	fakeClient := &fakeECRClient{
+		DescribeImagesFn: func(_ aws.Context, input *ecr.DescribeImagesInput, _ ...request.Option) (*ecr.DescribeImagesOutput, error) {
+			assert.Equal(t, "123456789012", aws.StringValue(input.RegistryId))
+			assert.Equal(t, "foo/bar", aws.StringValue(input.RepositoryName))
+			require.Len(t, input.ImageIds, 1)
+			assert.Equal(t, "latest", aws.StringValue(input.ImageIds[0].ImageTag))
+			return &ecr.DescribeImagesOutput{ImageDetails: []*ecr.ImageDetail{{
+				ImageDigest:            aws.String(dgst.String()),
+				ImageTags:              aws.StringSlice([]string{"latest", "stable"}),
+				ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+				ImageSizeInBytes:       aws.Int64(1234),
+				ImagePushedAt:          aws.Time(pushed),
+				LastRecordedPullTime:   aws.Time(pulled),
+			}}}, nil
+		},
+	}
+	resolver := &ecrResolver{clients: map[string]ecrAPI{"fake": fakeClient}}
+
+	info, err := resolver.InspectImage(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	assert.Equal(t, &ImageInfo{
+		Digest:               dgst,
+		Tags:                 []string{"latest", "stable"},
+		MediaType:            ocispec.MediaTypeImageManifest,
+		Size:                 1234,
+		PushedAt:             pushed,
+		LastRecordedPullTime: pulled,
+	}, info)
+	assert.Equal(t, map[string]string{
+		AnnotationImagePushedAt:             "2020-01-02T03:04:05Z",
+		AnnotationImageLastRecordedPullTime: "2020-02-03T04:05:06Z",
+		AnnotationImageSize:                 "1234",
+	}, info.Annotations())
+
+	info.LastRecordedPullTime = time.Time{}
+	assert.NotContains(t, info.Annotations(), AnnotationImageLastRecordedPullTime, "images never pulled should have no pull time")
+}
+
+func TestInspectImageNotFound(t *testing.T) {
+	for _, tc := range []struct {
+		code string
+		is   error
+	}{
+		{ecr.ErrCodeImageNotFoundException, errdefs.ErrNotFound},
+		{ecr.ErrCodeRepositoryNotFoundException, ErrRepositoryNotFound},
+	} {
+		t.Run(tc.code, func(t *testing.T) {
+			fakeClient := &fakeECRClient{
+				DescribeImagesFn: func(aws.Context, *ecr.DescribeImagesInput, ...request.Option) (*ecr.DescribeImagesOutput, error) {
+					return nil, awserr.New(tc.code, "not found", nil)
+				},
+			}
+			resolver := &ecrResolver{clients: map[string]ecrAPI{"fake": fakeClient}}
+
+			_, err := resolver.InspectImage(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+			assert.True(t, errors.Is(err, tc.is), "unexpected error %v", err)
+		})
+	}
+}
+
+func TestInspectImages(t *testing.T) {
+	var tokens []string
+	fakeClient := &fakeECRClient{
+		DescribeImagesFn: func(_ aws.Context, input *ecr.DescribeImagesInput, _ ...request.Option) (*ecr.DescribeImagesOutput, error) {
+			assert.Empty(t, input.ImageIds, "all images should be described")
+			tokens = append(tokens, aws.StringValue(input.NextToken))
+			if input.NextToken == nil {
+				return &ecr.DescribeImagesOutput{
+					ImageDetails: []*ecr.ImageDetail{{ImageDigest: aws.String(digest.FromString("first").String())}},
+					NextToken:    aws.String("next"),
+				}, nil
+			}
+			return &ecr.DescribeImagesOutput{
+				ImageDetails: []*ecr.ImageDetail{{ImageDigest: aws.String(digest.FromString("second").String())}},
+			}, nil
+		},
+	}
+	resolver := &ecrResolver{clients: map[string]ecrAPI{"fake": fakeClient}}
+
+	images, err := resolver.InspectImages(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+	assert.Equal(t, digest.FromString("first"), images[0].Digest)
+	assert.Equal(t, digest.FromString("second"), images[1].Digest)
+	assert.True(t, images[1].LastRecordedPullTime.IsZero())
+	assert.Equal(t, []string{"", "next"}, tokens, "every page should be requested")
+}
+
+func TestExists(t *testing.T) {
+	dgst := digest.FromString("manifest")
+	var code string
+	fakeClient := &fakeECRClient{
+		DescribeImagesFn: func(aws.Context, *ecr.DescribeImagesInput, ...request.Option) (*ecr.DescribeImagesOutput, error) {
+			if code != "" {
+				return nil, awserr.New(code, "not found", nil)
+			}
+			return &ecr.DescribeImagesOutput{ImageDetails: []*ecr.ImageDetail{{
+				ImageDigest:            aws.String(dgst.String()),
+				ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+				ImageSizeInBytes:       aws.Int64(1234),
+			}}}, nil
+		},
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			t.Fatal("manifest should not be fetched")
+			return nil, nil
+		},
+	}
+	resolver := &ecrResolver{clients: map[string]ecrAPI{"fake": fakeClient}}
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	exists, desc, err := resolver.Exists(context.Background(), ref)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, ocispec.MediaTypeImageManifest, desc.MediaType)
+	assert.Equal(t, dgst, desc.Digest)
+	assert.Equal(t, "1234", desc.Annotations[AnnotationImageSize])
+
+	code = ecr.ErrCodeImageNotFoundException
+	exists, _, err = resolver.Exists(context.Background(), ref)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	code = ecr.ErrCodeRepositoryNotFoundException
+	_, _, err = resolver.Exists(context.Background(), ref)
+	assert.True(t, errors.Is(err, ErrRepositoryNotFound), "unexpected error %v", err)
+}
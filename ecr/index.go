@@ -0,0 +1,125 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// MissingManifestsError is returned when pushing an image index or manifest
+// list whose manifests are not in the repository, with a resolver configured
+// with WithIndexManifestCheck.
+type MissingManifestsError struct {
+	// Ref is the reference of the index.
+	Ref string
+	// Digests of the missing manifests.
+	Digests []digest.Digest
+}
+
+func (e *MissingManifestsError) Error() string {
+	digests := make([]string, len(e.Digests))
+	for i, dgst := range e.Digests {
+		digests[i] = dgst.String()
+	}
+	return fmt.Sprintf("ecr: %d manifests of %s missing: %s", len(e.Digests), e.Ref, strings.Join(digests, ", "))
+}
+
+// Unwrap returns errdefs.ErrFailedPrecondition so that missing manifests are
+// categorized as a verification failure.
+func (e *MissingManifestsError) Unwrap() error {
+	return errdefs.ErrFailedPrecondition
+}
+
+// isIndex reports whether mediaType is that of an image index or manifest
+// list.
+func isIndex(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageIndex || mediaType == images.MediaTypeDockerSchema2ManifestList
+}
+
+// checkIndexManifests confirms that the manifests listed by the index
+// manifest are in the repository of base, returning a *MissingManifestsError
+// listing any which are not.
+func checkIndexManifests(ctx context.Context, base *ecrBase, manifest []byte) error {
+	var index ocispec.Index
+	if err := json.Unmarshal(manifest, &index); err != nil {
+		return fmt.Errorf("failed to parse index: %v: %w", err, ErrInvalidManifest)
+	}
+	var (
+		ids        []*ecr.ImageIdentifier
+		mediaTypes []string
+		listed     = map[digest.Digest]bool{}
+		accepted   = map[string]bool{}
+		missing    []digest.Digest
+	)
+	for _, child := range index.Manifests {
+		if listed[child.Digest] {
+			continue
+		}
+		listed[child.Digest] = true
+		ids = append(ids, &ecr.ImageIdentifier{ImageDigest: aws.String(child.Digest.String())})
+		if child.MediaType != "" && !accepted[child.MediaType] {
+			accepted[child.MediaType] = true
+			mediaTypes = append(mediaTypes, child.MediaType)
+		}
+	}
+	if len(mediaTypes) == 0 {
+		mediaTypes = acceptedMediaTypes(base.mediaTypes)
+	}
+
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > batchGetImageLimit {
+			batch = batch[:batchGetImageLimit]
+		}
+		ids = ids[len(batch):]
+		output, err := base.client.BatchGetImageWithContext(ctx, &ecr.BatchGetImageInput{
+			RegistryId:         aws.String(base.ecrSpec.Registry()),
+			RepositoryName:     aws.String(base.ecrSpec.Repository),
+			ImageIds:           batch,
+			AcceptedMediaTypes: aws.StringSlice(mediaTypes),
+		})
+		if err != nil {
+			return err
+		}
+		for _, failure := range output.Failures {
+			if aws.StringValue(failure.FailureCode) != ecr.ImageFailureCodeImageNotFound {
+				return fmt.Errorf("ecr: failed to check manifest %s: %s: %s",
+					aws.StringValue(failure.ImageId.ImageDigest),
+					aws.StringValue(failure.FailureCode),
+					aws.StringValue(failure.FailureReason))
+			}
+			missing = append(missing, digest.Digest(aws.StringValue(failure.ImageId.ImageDigest)))
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingManifestsError{Ref: base.ecrSpec.Canonical(), Digests: missing}
+	}
+	log.G(ctx).
+		WithField("manifests", len(listed)).
+		Debug("ecr.manifest.commit: index manifests present")
+	return nil
+}
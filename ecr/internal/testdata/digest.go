@@ -10,4 +10,10 @@ const (
 	LayerDigest digest.Digest = "layer-digest"
 	// ImageDigest is used for consistent, placeholder image digests in tests.
 	ImageDigest digest.Digest = "image-digest"
+	// EmptyDigest is the digest of zero-length content, such as an empty
+	// layer.
+	EmptyDigest digest.Digest = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// EmptyJSONDigest is the digest of the OCI empty descriptor's content,
+	// the JSON document {}.
+	EmptyJSONDigest digest.Digest = "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
 )
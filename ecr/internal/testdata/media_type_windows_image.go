@@ -0,0 +1,72 @@
+package testdata
+
+import "github.com/containerd/containerd/images"
+
+// WindowsManifestList provides a Docker manifest list for a Windows image
+// built for several Windows Server releases, distinguished by os.version.
+var WindowsManifestList MediaTypeSample = &mediaTypeSample{
+	mediaType: images.MediaTypeDockerSchema2ManifestList,
+	content: `
+{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+  "manifests": [
+    {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "size": 1161,
+      "digest": "sha256:9ac02e9398047bc437a721a09bc14c3b627d94f29dc7abfdd80d02221c3346db",
+      "platform": {
+        "architecture": "amd64",
+        "os": "windows",
+        "os.version": "10.0.17763.3650",
+        "os.features": ["win32k"]
+      }
+    },
+    {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "size": 1161,
+      "digest": "sha256:ce2798613971850845750bdc7413578e0297a94cea1620a65e16377925a9a45e",
+      "platform": {
+        "architecture": "amd64",
+        "os": "windows",
+        "os.version": "10.0.20348.1249",
+        "os.features": ["win32k"]
+      }
+    }
+  ]
+}
+`,
+}
+
+// WindowsManifest provides a Docker v2 schema 2 manifest for a Windows image.
+// The base layer is a foreign layer that is distributed from its listed URLs
+// rather than from the registry.
+var WindowsManifest MediaTypeSample = &mediaTypeSample{
+	mediaType: images.MediaTypeDockerSchema2Manifest,
+	content: `
+{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+  "config": {
+    "mediaType": "application/vnd.docker.container.image.v1+json",
+    "size": 1784,
+    "digest": "sha256:6994af158bf2ef548cdc7d668f9073c2405fed748eb380a0737078508753ca34"
+  },
+  "layers": [
+    {
+      "mediaType": "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip",
+      "size": 1560123456,
+      "digest": "sha256:f4c7a58e22fe73feba3bb30b425816e487805311147bb8c5426daa7e773201fd",
+      "urls": [
+        "https://mcr.microsoft.com/v2/windows/servercore/blobs/sha256:f4c7a58e22fe73feba3bb30b425816e487805311147bb8c5426daa7e773201fd"
+      ]
+    },
+    {
+      "mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+      "size": 1234567,
+      "digest": "sha256:15e6fb0ae1e8de1df5d99b8249b1fa72357a7b696bca3123b4b77d8dc090250f"
+    }
+  ]
+}
+`,
+}
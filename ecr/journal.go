@@ -0,0 +1,89 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// journalKey returns the key under which desc is recorded in the push
+// journal once it is in the pusher's repository.  The root manifest is
+// recorded with the tag pushed, as the tag is only in place once it is
+// committed.
+func (p ecrPusher) journalKey(desc ocispec.Descriptor) string {
+	spec := p.ecrSpec
+	spec.Object = "@" + desc.Digest.String()
+	if desc.Digest == p.ecrSpec.Spec().Digest() {
+		if tag, _ := p.ecrSpec.TagDigest(); tag != "" {
+			spec.Object = tag + spec.Object
+		}
+	}
+	return spec.Canonical()
+}
+
+// journaled reports whether desc is recorded in the push journal as already
+// pushed.  Content is reported as not pushed if there is no journal or it
+// returns an error, so that it is checked with ECR instead.
+func (p ecrPusher) journaled(ctx context.Context, desc ocispec.Descriptor) bool {
+	if p.journal == nil {
+		return false
+	}
+	_, ok, err := p.journal.Get(ctx, p.journalKey(desc))
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("ecr.pusher.journal: failed to read journal")
+		return false
+	}
+	return ok
+}
+
+// record records desc in the push journal as pushed.
+func (p ecrPusher) record(ctx context.Context, desc ocispec.Descriptor) {
+	if p.journal == nil {
+		return
+	}
+	if err := p.journal.Set(ctx, p.journalKey(desc), desc, p.journalTTL); err != nil {
+		log.G(ctx).WithError(err).Warn("ecr.pusher.journal: failed to write journal")
+	}
+}
+
+// journalWriter records its content in the push journal once committed.
+type journalWriter struct {
+	content.Writer
+	pusher ecrPusher
+	desc   ocispec.Descriptor
+}
+
+func (w *journalWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if err := w.Writer.Commit(ctx, size, expected, opts...); err != nil {
+		return err
+	}
+	w.pusher.record(ctx, w.desc)
+	return nil
+}
+
+// journalWriter returns writer, recording desc in the push journal once it is
+// committed if there is a journal.
+func (p ecrPusher) journalWriter(writer content.Writer, desc ocispec.Descriptor) content.Writer {
+	if p.journal == nil {
+		return writer
+	}
+	return &journalWriter{Writer: writer, pusher: p, desc: desc}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushJournal(t *testing.T) {
+	const manifest = "manifest content"
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString(manifest),
+		Size:      int64(len(manifest)),
+	}
+	layer := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("layer"),
+	}
+	calls := 0
+	client := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			calls++
+			return &ecr.BatchGetImageOutput{
+				Failures: []*ecr.ImageFailure{{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)}},
+			}, nil
+		},
+		PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+			calls++
+			return &ecr.PutImageOutput{Image: &ecr.Image{ImageId: &ecr.ImageIdentifier{ImageDigest: input.ImageDigest}}}, nil
+		},
+		BatchCheckLayerAvailabilityFn: func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			calls++
+			return &ecr.BatchCheckLayerAvailabilityOutput{
+				Layers: []*ecr.Layer{{LayerAvailability: aws.String(ecr.LayerAvailabilityAvailable)}},
+			}, nil
+		},
+	}
+	journal := NewMemoryResolveCache(10)
+	newPusher := func(tag string) ecrPusher {
+		return ecrPusher{
+			ecrBase: ecrBase{
+				client: client,
+				ecrSpec: ECRSpec{
+					arn:        arn.ARN{AccountID: "registry"},
+					Repository: "repository",
+					Object:     tag + "@" + desc.Digest.String(),
+				},
+			},
+			tracker:    docker.NewInMemoryTracker(),
+			journal:    journal,
+			journalTTL: time.Minute,
+		}
+	}
+
+	pusher := newPusher("tag")
+	writer, err := pusher.Push(context.Background(), desc)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte(manifest))
+	require.NoError(t, err)
+	require.NoError(t, writer.Commit(context.Background(), desc.Size, desc.Digest))
+	_, err = pusher.Push(context.Background(), layer)
+	assert.True(t, errors.Is(err, errdefs.ErrAlreadyExists))
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	retry := newPusher("tag")
+	for _, d := range []ocispec.Descriptor{desc, layer} {
+		_, err = retry.Push(context.Background(), d)
+		assert.True(t, errors.Is(err, errdefs.ErrAlreadyExists), "retried push of %s should be skipped: %v", d.Digest, err)
+	}
+	assert.Zero(t, calls, "retried push should not check existence with ECR")
+
+	other := newPusher("other")
+	_, err = other.Push(context.Background(), desc)
+	assert.NoError(t, err, "manifest pushed to another tag should be pushed")
+	assert.Equal(t, 1, calls)
+}
+
+func TestWithPushJournal(t *testing.T) {
+	_, err := NewResolver(WithPushJournal(NewMemoryResolveCache(10), 0))
+	assert.Error(t, err)
+
+	resolver, err := NewResolver(WithPushJournal(NewMemoryResolveCache(10), time.Minute))
+	require.NoError(t, err)
+	pusher, err := resolver.Pusher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest@"+digest.FromString("manifest").String())
+	require.NoError(t, err)
+	assert.NotNil(t, pusher.(*ecrPusher).journal)
+}
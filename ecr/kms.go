@@ -0,0 +1,144 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+)
+
+// KMSAccessDeniedError is wrapped by the FetchError returned when a layer
+// cannot be downloaded because the caller is not allowed to decrypt it with
+// the KMS key encrypting the repository's layers.  Pulling from the
+// repository requires kms:Decrypt on Key.  Once the error is returned, the
+// fetcher fails the other layers of the repository immediately rather than
+// attempting each of them.
+type KMSAccessDeniedError struct {
+	// Repository whose layer could not be downloaded.
+	Repository string
+	// Digest of the layer.
+	Digest digest.Digest
+	// Key is the ARN of the KMS key, or empty if it could not be
+	// determined.
+	Key string
+	Err error
+}
+
+func (e *KMSAccessDeniedError) Error() string {
+	key := "the KMS key"
+	if e.Key != "" {
+		key = "KMS key " + e.Key
+	}
+	return fmt.Sprintf("ecr: access denied to %s encrypting layer %s of %s: %v", key, e.Digest, e.Repository, e.Err)
+}
+
+func (e *KMSAccessDeniedError) Unwrap() error {
+	return e.Err
+}
+
+// kmsKeyPattern matches the ARNs of KMS keys and aliases in the messages of
+// Amazon S3 errors.
+var kmsKeyPattern = regexp.MustCompile(`arn:aws[a-z-]*:kms:[a-z0-9-]+:[0-9]{12}:(key|alias)/[A-Za-z0-9/_-]+`)
+
+// isKMSAccessDenied reports whether statusErr is Amazon S3 refusing a download
+// because the caller may not use the KMS key the content is encrypted with.
+func isKMSAccessDenied(statusErr *httpStatusError) bool {
+	if statusErr.statusCode != http.StatusForbidden && statusErr.statusCode != http.StatusBadRequest {
+		return false
+	}
+	return strings.HasPrefix(statusErr.code, "KMS.") ||
+		strings.Contains(statusErr.message, "kms:") ||
+		strings.Contains(statusErr.message, "KMS")
+}
+
+// kmsAccessDenied returns err as a *KMSAccessDeniedError if it is a download
+// of desc from spec's repository refused for lack of access to its KMS key,
+// or nil otherwise.  The key is named from the error message, or else from
+// the repository's encryption configuration if the caller may describe it.
+func (f *ecrFetcher) kmsAccessDenied(ctx context.Context, client ecrAPI, spec ECRSpec, dgst digest.Digest, err error) *KMSAccessDeniedError {
+	var statusErr *httpStatusError
+	if !errors.As(err, &statusErr) || !isKMSAccessDenied(statusErr) {
+		return nil
+	}
+	kmsErr := &KMSAccessDeniedError{
+		Repository: spec.Repository,
+		Digest:     dgst,
+		Key:        kmsKeyPattern.FindString(statusErr.message),
+		Err:        err,
+	}
+	if kmsErr.Key == "" {
+		output, err := client.DescribeRepositoriesWithContext(ctx, &ecr.DescribeRepositoriesInput{
+			RegistryId:      aws.String(spec.Registry()),
+			RepositoryNames: []*string{aws.String(spec.Repository)},
+		})
+		if err == nil && len(output.Repositories) > 0 && output.Repositories[0].EncryptionConfiguration != nil {
+			kmsErr.Key = aws.StringValue(output.Repositories[0].EncryptionConfiguration.KmsKey)
+		}
+	}
+	log.G(ctx).
+		WithField("repository", spec.Repository).
+		WithField("key", kmsErr.Key).
+		Warn("ecr.fetcher.layer: access denied to KMS key")
+	return kmsErr
+}
+
+// kmsDenials records the repositories whose KMS keys a fetcher was denied
+// access to, so that their other layers are not attempted.
+type kmsDenials struct {
+	mu     sync.Mutex
+	denied map[string]*KMSAccessDeniedError
+}
+
+func newKMSDenials() *kmsDenials {
+	return &kmsDenials{denied: map[string]*KMSAccessDeniedError{}}
+}
+
+// get returns the error recorded for the repository of spec, for the layer
+// dgst, or nil if none is recorded.  Denials may be nil, in which case
+// nothing is recorded.
+func (d *kmsDenials) get(spec ECRSpec, dgst digest.Digest) error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	denied, ok := d.denied[spec.ARN()]
+	if !ok {
+		return nil
+	}
+	kmsErr := *denied
+	kmsErr.Digest = dgst
+	return &kmsErr
+}
+
+func (d *kmsDenials) add(spec ECRSpec, kmsErr *KMSAccessDeniedError) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.denied[spec.ARN()] = kmsErr
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const kmsKey = "arn:aws:kms:us-west-2:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+
+func TestFetchLayerKMSAccessDenied(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		message string
+		key     string
+	}{
+		{
+			name:    "key in message",
+			message: "User: arn:aws:sts::123456789012:assumed-role/node is not authorized to perform: kms:Decrypt on resource: " + kmsKey,
+			key:     kmsKey,
+		},
+		{
+			name:    "key from repository",
+			message: "The ciphertext refers to a customer master key that does not exist, does not exist in this region, or you are not allowed to access. (KMS)",
+			key:     "arn:aws:kms:us-west-2:123456789012:key/repository",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var downloads int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&downloads, 1)
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>%s</Message></Error>`, tc.message)
+			}))
+			defer server.Close()
+			var urlRequests int32
+			client := &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					atomic.AddInt32(&urlRequests, 1)
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(server.URL)}, nil
+				},
+				DescribeRepositoriesFn: func(aws.Context, *ecr.DescribeRepositoriesInput, ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+					return &ecr.DescribeRepositoriesOutput{Repositories: []*ecr.Repository{{
+						EncryptionConfiguration: &ecr.EncryptionConfiguration{
+							EncryptionType: aws.String(ecr.EncryptionTypeKms),
+							KmsKey:         aws.String("arn:aws:kms:us-west-2:123456789012:key/repository"),
+						},
+					}}}, nil
+				},
+			}
+			resolver, err := NewResolver()
+			require.NoError(t, err)
+			resolver.(*ecrResolver).clients["fake"] = client
+			fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+			require.NoError(t, err)
+
+			for i, layer := range []string{"first", "second"} {
+				_, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+					MediaType: ocispec.MediaTypeImageLayerGzip,
+					Digest:    digest.FromString(layer),
+				})
+				var kmsErr *KMSAccessDeniedError
+				require.True(t, errors.As(err, &kmsErr), "unexpected error %v", err)
+				assert.Equal(t, tc.key, kmsErr.Key)
+				assert.Equal(t, "foo/bar", kmsErr.Repository)
+				assert.Equal(t, digest.FromString(layer), kmsErr.Digest)
+				assert.Contains(t, err.Error(), tc.key, "error should name the key")
+				assert.Equal(t, ErrorCategoryAuth, Categorize(err))
+				assert.False(t, IsTransientError(err))
+				assert.Equal(t, int32(1), atomic.LoadInt32(&downloads), "layer %d: download should not be retried or repeated", i)
+				assert.Equal(t, int32(1), atomic.LoadInt32(&urlRequests), "layer %d: other layers should not be attempted", i)
+			}
+		})
+	}
+}
+
+func TestFetchLayerAccessDeniedNotKMS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>Request has expired</Message></Error>`)
+	}))
+	defer server.Close()
+	fetcher := newRetryTestFetcher(server.URL, nil)
+
+	_, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("layer"),
+	})
+	var kmsErr *KMSAccessDeniedError
+	assert.False(t, errors.As(err, &kmsErr), "unexpected KMS error %v", err)
+	assert.Equal(t, ErrorCategoryAuth, Categorize(err))
+}
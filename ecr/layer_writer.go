@@ -18,6 +18,7 @@ package ecr
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"strings"
 	"time"
@@ -33,6 +34,21 @@ import (
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// LayerCorruptionError is returned when a part of a layer is found to be
+// corrupt while being uploaded.
+type LayerCorruptionError struct {
+	// Digest of the layer being uploaded.
+	Digest digest.Digest
+	// Part of the layer found to be corrupt, starting at 0.
+	Part int64
+	// Reason describes how the corruption was detected.
+	Reason string
+}
+
+func (e *LayerCorruptionError) Error() string {
+	return fmt.Sprintf("ecr: part %d of layer %s is corrupt: %s", e.Part, e.Digest, e.Reason)
+}
+
 type layerWriter struct {
 	ctx      context.Context
 	base     *ecrBase
@@ -41,16 +57,49 @@ type layerWriter struct {
 	tracker  docker.StatusTracker
 	ref      string
 	uploadID string
+	// offset is the number of bytes of the layer ECR had accepted when the
+	// writer resumed the upload.
+	offset   int64
 	err      chan error
+	progress *progressReporter
 }
 
 var _ content.Writer = (*layerWriter)(nil)
 
 const (
 	layerQueueSize = 5
+	// layerPartAttempts bounds the attempts to upload a part of a layer
+	// when uploads fail with transient errors.
+	layerPartAttempts = 3
 )
 
-func newLayerWriter(base *ecrBase, tracker docker.StatusTracker, ref string, desc ocispec.Descriptor) (content.Writer, error) {
+// layerUploadOptions configures how layers are uploaded.
+type layerUploadOptions struct {
+	// checksums configures whether each part is verified.  The SHA-256 of
+	// each part is computed as the part is read and verified before the part
+	// is uploaded, and ECR's acknowledgement of the bytes received is checked
+	// after.  ECR's API does not accept checksums itself, but the payload of
+	// each request is covered by its signature.
+	checksums bool
+	// minPartSize and maxPartSize bound the part size when it is adapted to
+	// the measured throughput.  If maxPartSize is 0, the part size returned
+	// by InitiateLayerUpload is used for every part.
+	minPartSize int64
+	maxPartSize int64
+	// clock and backoff time the retries of parts, and are nil if
+	// SystemClock and the default backoff are used.
+	clock   Clock
+	backoff Backoff
+	// creator creates the repository if it is found missing when the upload
+	// is initiated, and is nil if the upload fails instead.
+	creator *repositoryCreator
+}
+
+// newLayerWriter starts uploading a layer, or resumes the upload of the layer
+// recorded by tracker under ref when ECR accepted some of its parts before the
+// upload was interrupted.  A resumed writer reports the bytes already accepted
+// in its status, so content.Copy writes only the rest of the layer.
+func newLayerWriter(base *ecrBase, tracker docker.StatusTracker, ref string, desc ocispec.Descriptor, options layerUploadOptions) (content.Writer, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("desc", desc))
 	reader, writer := io.Pipe()
@@ -64,31 +113,82 @@ func newLayerWriter(base *ecrBase, tracker docker.StatusTracker, ref string, des
 		err:     make(chan error),
 	}
 
-	// call InitiateLayerUpload and get upload ID
-	initiateLayerUploadInput := &ecr.InitiateLayerUploadInput{
-		RegistryId:     aws.String(base.ecrSpec.Registry()),
-		RepositoryName: aws.String(base.ecrSpec.Repository),
+	var partSize int64
+	status, statusErr := tracker.GetStatus(ref)
+	if statusErr == nil && resumableUpload(status, desc) {
+		lw.uploadID = status.UploadUUID
+		lw.offset = status.Offset
+		log.G(ctx).
+			WithField("digest", desc.Digest.String()).
+			WithField("uploadID", lw.uploadID).
+			WithField("offset", lw.offset).
+			Info("ecr.blob.resume")
+	} else {
+		// call InitiateLayerUpload and get upload ID
+		initiateLayerUploadInput := &ecr.InitiateLayerUploadInput{
+			RegistryId:     aws.String(base.ecrSpec.Registry()),
+			RepositoryName: aws.String(base.ecrSpec.Repository),
+		}
+		initiateLayerUploadOutput, err := base.client.InitiateLayerUpload(initiateLayerUploadInput)
+		if created, createErr := options.creator.createMissing(ctx, base, err); createErr != nil {
+			err = createErr
+		} else if created {
+			initiateLayerUploadOutput, err = base.client.InitiateLayerUpload(initiateLayerUploadInput)
+		}
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		lw.uploadID = aws.StringValue(initiateLayerUploadOutput.UploadId)
+		partSize = aws.Int64Value(initiateLayerUploadOutput.PartSize)
+		if statusErr == nil {
+			// Record the upload so that it can be resumed if interrupted.
+			status.UploadUUID = lw.uploadID
+			status.Offset = 0
+			status.Committed = false
+			tracker.SetStatus(ref, status)
+		}
 	}
-	initiateLayerUploadOutput, err := base.client.InitiateLayerUpload(initiateLayerUploadInput)
-	if err != nil {
-		cancel()
-		return nil, err
+	if partSize <= 0 {
+		// Without a part size, the layer would be read into empty parts
+		// forever.  ECR returns the part size only when the upload is
+		// initiated.
+		partSize = options.minPartSize
+		if partSize <= 0 {
+			partSize = MinimumLayerPartSize
+		}
 	}
-	lw.uploadID = aws.StringValue(initiateLayerUploadOutput.UploadId)
-	partSize := aws.Int64Value(initiateLayerUploadOutput.PartSize)
 	log.G(ctx).
 		WithField("digest", desc.Digest.String()).
 		WithField("uploadID", lw.uploadID).
 		WithField("partSize", partSize).
 		Debug("ecr.blob.init")
+	lw.progress = newProgressReporter(ctx, base.events, base.ecrSpec.Canonical(), desc, ProgressPush)
+	if lw.offset > 0 {
+		lw.progress.add(lw.offset)
+	}
 
+	var transport BlobTransport = &defaultBlobTransport{client: base.client}
+	if base.transport != nil {
+		transport = &fallbackBlobTransport{transport: base.transport, fallback: transport}
+	}
+	checksums := options.checksums
+	var sizer *partSizer
+	chunkSize := func() int64 { return partSize }
+	if options.maxPartSize > 0 {
+		sizer = newPartSizer(partSize, options.minPartSize, options.maxPartSize)
+		chunkSize = sizer.next
+	}
 	go func() {
 		defer cancel()
 		defer close(lw.err)
-		_, err := stream.ChunkedProcessor(reader, partSize, layerQueueSize,
+		_, err := stream.ChunkedProcessorWithSizer(reader, chunkSize, layerQueueSize, checksums,
 			func(layerChunk *stream.Chunk) error {
-				begin := layerChunk.BytesBegin
-				end := layerChunk.BytesEnd
+				// Chunks are read from the bytes after those ECR has
+				// already accepted.  The chunk is shared with the reading
+				// goroutine, so it is not modified.
+				begin := layerChunk.BytesBegin + lw.offset
+				end := layerChunk.BytesEnd + lw.offset
 				bytesRead := end - begin
 				log.G(ctx).
 					WithField("digest", desc.Digest.String()).
@@ -98,6 +198,14 @@ func newLayerWriter(base *ecrBase, tracker docker.StatusTracker, ref string, des
 					WithField("bytes", bytesRead).
 					Debug("ecr.layer.callback")
 
+				if checksums && digest.SHA256.FromBytes(layerChunk.Bytes) != layerChunk.Checksum {
+					return &LayerCorruptionError{
+						Digest: desc.Digest,
+						Part:   layerChunk.Part,
+						Reason: fmt.Sprintf("checksum changed from %s after being read", layerChunk.Checksum),
+					}
+				}
+
 				uploadLayerPartInput := &ecr.UploadLayerPartInput{
 					RegistryId:     aws.String(base.ecrSpec.Registry()),
 					RepositoryName: aws.String(base.ecrSpec.Repository),
@@ -107,7 +215,14 @@ func newLayerWriter(base *ecrBase, tracker docker.StatusTracker, ref string, des
 					LayerPartBlob:  layerChunk.Bytes,
 				}
 
-				_, err := base.client.UploadLayerPart(uploadLayerPartInput)
+				start := time.Now()
+				uploadLayerPartOutput, err := uploadLayerPart(ctx, transport, base.ecrSpec.Region(), uploadLayerPartInput, options)
+				if err == nil && sizer != nil {
+					sizer.observe(int64(len(layerChunk.Bytes)), time.Since(start))
+				}
+				if err == nil && checksums {
+					err = verifyLayerPartUpload(desc, layerChunk.Part, end, lw.uploadID, uploadLayerPartOutput)
+				}
 				log.G(ctx).
 					WithField("digest", desc.Digest.String()).
 					WithField("part", layerChunk.Part).
@@ -116,6 +231,7 @@ func newLayerWriter(base *ecrBase, tracker docker.StatusTracker, ref string, des
 					WithField("bytes", bytesRead).
 					Debug("ecr.layer.callback end")
 				if err == nil {
+					lw.progress.add(int64(bytesRead) + 1)
 					var status docker.Status
 					status, err = lw.tracker.GetStatus(lw.ref)
 					if err == nil {
@@ -123,6 +239,8 @@ func newLayerWriter(base *ecrBase, tracker docker.StatusTracker, ref string, des
 						status.UpdatedAt = time.Now()
 						lw.tracker.SetStatus(lw.ref, status)
 					}
+				} else if uploadInvalid(err) {
+					lw.forgetUpload()
 				}
 				return err
 			})
@@ -134,6 +252,136 @@ func newLayerWriter(base *ecrBase, tracker docker.StatusTracker, ref string, des
 	return lw, nil
 }
 
+// uploadLayerPart uploads a part of a layer with transport, retrying it within
+// the same upload when it fails transiently.  ECR accepts the parts of an
+// upload only in order, so a failed part holds up the rest of the layer
+// rather than restarting it.  A retried part which ECR reports it had already
+// received, because the response to an earlier attempt was lost, is treated
+// as uploaded.
+func uploadLayerPart(ctx context.Context, transport BlobTransport, region string, input *ecr.UploadLayerPartInput, options layerUploadOptions) (*ecr.UploadLayerPartOutput, error) {
+	for attempt := 1; ; attempt++ {
+		output, err := transport.UploadPart(ctx, region, input)
+		if err == nil {
+			return output, nil
+		}
+		if attempt > 1 && layerPartReceived(err, input) {
+			log.G(ctx).
+				WithField("begin", aws.Int64Value(input.PartFirstByte)).
+				Debug("ecr.layer: part already received")
+			return &ecr.UploadLayerPartOutput{
+				RegistryId:       input.RegistryId,
+				RepositoryName:   input.RepositoryName,
+				UploadId:         input.UploadId,
+				LastByteReceived: input.PartLastByte,
+			}, nil
+		}
+		if !isTransient(err) || attempt >= layerPartAttempts {
+			return nil, err
+		}
+		log.G(ctx).
+			WithError(err).
+			WithField("begin", aws.Int64Value(input.PartFirstByte)).
+			WithField("attempt", attempt).
+			Warn("ecr.layer: retrying part upload")
+		clock, backoff := options.clock, options.backoff
+		if clock == nil {
+			clock = SystemClock
+		}
+		if backoff == nil {
+			backoff = defaultBackoff
+		}
+		select {
+		case <-clock.After(backoff(attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// uploadInvalid reports whether err shows that the upload can no longer be
+// continued, because it expired or ECR holds different bytes for it.
+func uploadInvalid(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	switch awsErr.Code() {
+	case ecr.ErrCodeUploadNotFoundException, ecr.ErrCodeInvalidLayerPartException:
+		return true
+	}
+	return false
+}
+
+// resumableUpload reports whether status records an upload of desc which ECR
+// accepted some, but not all, of the bytes of.
+func resumableUpload(status docker.Status, desc ocispec.Descriptor) bool {
+	return status.UploadUUID != "" && !status.Committed &&
+		status.Expected == desc.Digest &&
+		status.Offset > 0 && status.Offset < desc.Size
+}
+
+// forgetUpload clears the upload from the tracker, so that the next push of
+// the layer starts a new upload instead of resuming it.
+func (lw *layerWriter) forgetUpload() {
+	if lw.tracker == nil {
+		return
+	}
+	status, err := lw.tracker.GetStatus(lw.ref)
+	if err != nil || status.UploadUUID != lw.uploadID {
+		return
+	}
+	status.UploadUUID = ""
+	status.Offset = 0
+	status.UpdatedAt = time.Now()
+	lw.tracker.SetStatus(lw.ref, status)
+}
+
+// commitUpload records in the tracker that the upload is complete.
+func (lw *layerWriter) commitUpload() {
+	if lw.tracker == nil {
+		return
+	}
+	status, err := lw.tracker.GetStatus(lw.ref)
+	if err != nil || status.UploadUUID != lw.uploadID {
+		return
+	}
+	status.Committed = true
+	status.UpdatedAt = time.Now()
+	lw.tracker.SetStatus(lw.ref, status)
+}
+
+// layerPartReceived reports whether err rejects the part uploaded by input
+// because ECR has already received it.
+func layerPartReceived(err error, input *ecr.UploadLayerPartInput) bool {
+	var invalidPart *ecr.InvalidLayerPartException
+	return errors.As(err, &invalidPart) &&
+		aws.StringValue(invalidPart.UploadId) == aws.StringValue(input.UploadId) &&
+		aws.Int64Value(invalidPart.LastValidByteReceived) >= aws.Int64Value(input.PartLastByte)
+}
+
+// verifyLayerPartUpload checks that ECR acknowledged receiving the whole of
+// the uploaded part, ending at the layer's byte end.
+func verifyLayerPartUpload(desc ocispec.Descriptor, part int64, end int64, uploadID string, output *ecr.UploadLayerPartOutput) error {
+	if output == nil {
+		return &LayerCorruptionError{Digest: desc.Digest, Part: part, Reason: "no response to upload"}
+	}
+	if received := aws.Int64Value(output.LastByteReceived); received != end {
+		return &LayerCorruptionError{
+			Digest: desc.Digest,
+			Part:   part,
+			Reason: fmt.Sprintf("ECR received bytes through %d, expected %d", received, end),
+		}
+	}
+	if id := aws.StringValue(output.UploadId); id != uploadID {
+		return &LayerCorruptionError{
+			Digest: desc.Digest,
+			Part:   part,
+			Reason: fmt.Sprintf("ECR received part for upload %s, expected %s", id, uploadID),
+		}
+	}
+	return nil
+}
+
 func (lw *layerWriter) Write(b []byte) (int, error) {
 	log.G(lw.ctx).WithField("len(b)", len(b)).Debug("ecr.layer.write")
 	select {
@@ -154,8 +402,9 @@ func (lw *layerWriter) Digest() digest.Digest {
 	return lw.desc.Digest
 }
 
-func (lw *layerWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+func (lw *layerWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) (err error) {
 	log.G(lw.ctx).WithField("size", size).WithField("expected", expected).Debug("ecr.layer.commit")
+	defer func() { lw.progress.finish(err) }()
 	lw.buf.Close()
 	select {
 	case err := <-lw.err:
@@ -186,8 +435,12 @@ func (lw *layerWriter) Commit(ctx context.Context, size int64, expected digest.D
 		awsErr, ok := err.(awserr.Error)
 		if ok && awsErr.Code() == "LayerAlreadyExistsException" && strings.HasPrefix(expected.String(), "sha256:") {
 			log.G(lw.ctx).Debug("ecr.layer.commit: layer already exists")
+			lw.commitUpload()
 			return nil
 		} else {
+			if uploadInvalid(err) {
+				lw.forgetUpload()
+			}
 			return err
 		}
 	}
@@ -199,6 +452,7 @@ func (lw *layerWriter) Commit(ctx context.Context, size int64, expected digest.D
 		WithField("expected", expected).
 		WithField("actual", actualDigest).
 		Debug("ecr.layer.commit: complete")
+	lw.commitUpload()
 	return nil
 }
 
@@ -206,7 +460,8 @@ func (lw *layerWriter) Status() (content.Status, error) {
 	log.G(lw.ctx).Debug("ecr.layer.status")
 
 	return content.Status{
-		Ref: lw.desc.Digest.String(),
+		Ref:    lw.desc.Digest.String(),
+		Offset: lw.offset,
 	}, nil
 }
 
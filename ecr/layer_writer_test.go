@@ -17,14 +17,18 @@ package ecr
 
 import (
 	"context"
+	"errors"
 	"io"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -90,7 +94,7 @@ func TestLayerWriter(t *testing.T) {
 	refKey := "refKey"
 	tracker.SetStatus(refKey, docker.Status{})
 
-	lw, err := newLayerWriter(ecrBase, tracker, "refKey", desc)
+	lw, err := newLayerWriter(ecrBase, tracker, "refKey", desc, layerUploadOptions{})
 	assert.NoError(t, err)
 	assert.Equal(t, 1, initiateLayerUploadCount)
 	assert.Equal(t, 0, uploadLayerPartCount)
@@ -150,3 +154,243 @@ func TestLayerWriterCommitExists(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 1, callCount)
 }
+
+func TestLayerWriterChecksums(t *testing.T) {
+	layerData := "layer"
+	for _, tc := range []struct {
+		name string
+		// lastByte returns the LastByteReceived reported for a part.
+		lastByte func(input *ecr.UploadLayerPartInput) int64
+		corrupt  bool
+	}{
+		{
+			name:     "acknowledged",
+			lastByte: func(input *ecr.UploadLayerPartInput) int64 { return aws.Int64Value(input.PartLastByte) },
+		},
+		{
+			name: "short",
+			lastByte: func(input *ecr.UploadLayerPartInput) int64 {
+				// Only the final part is reported short so that the
+				// whole layer can be written before the failure.
+				if aws.Int64Value(input.PartLastByte) == int64(len(layerData)-1) {
+					return aws.Int64Value(input.PartFirstByte) - 1
+				}
+				return aws.Int64Value(input.PartLastByte)
+			},
+			corrupt: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			completeLayerUploadCount := 0
+			client := &fakeECRClient{
+				InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+					return &ecr.InitiateLayerUploadOutput{
+						UploadId: aws.String("upload"),
+						PartSize: aws.Int64(1),
+					}, nil
+				},
+				UploadLayerPartFn: func(input *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+					return &ecr.UploadLayerPartOutput{
+						UploadId:         input.UploadId,
+						LastByteReceived: aws.Int64(tc.lastByte(input)),
+					}, nil
+				},
+				CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+					completeLayerUploadCount++
+					return &ecr.CompleteLayerUploadOutput{
+						LayerDigest: aws.String(testdata.InsignificantDigest.String()),
+					}, nil
+				},
+			}
+			desc := ocispec.Descriptor{Digest: testdata.InsignificantDigest}
+			tracker := docker.NewInMemoryTracker()
+			tracker.SetStatus("refKey", docker.Status{})
+
+			lw, err := newLayerWriter(&ecrBase{client: client}, tracker, "refKey", desc, layerUploadOptions{checksums: true})
+			require.NoError(t, err)
+			_, err = lw.Write([]byte(layerData))
+			require.NoError(t, err)
+
+			err = lw.Commit(context.Background(), int64(len(layerData)), desc.Digest)
+			if !tc.corrupt {
+				assert.NoError(t, err)
+				assert.Equal(t, 1, completeLayerUploadCount)
+				return
+			}
+			var corruption *LayerCorruptionError
+			require.True(t, errors.As(err, &corruption), "unexpected error %v", err)
+			assert.Equal(t, testdata.InsignificantDigest, corruption.Digest)
+			assert.Equal(t, int64(len(layerData)-1), corruption.Part)
+			assert.Equal(t, 0, completeLayerUploadCount, "corrupt layer should not be completed")
+		})
+	}
+}
+
+func TestLayerWriterRetriesParts(t *testing.T) {
+	const layerData = "layer"
+	uploadID := "upload"
+	transient := awserr.NewRequestFailure(awserr.New("InternalFailure", "internal failure", nil), 500, "")
+	var attempts []int64
+	var received []byte
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{UploadId: aws.String(uploadID), PartSize: aws.Int64(2)}, nil
+		},
+		UploadLayerPartFn: func(input *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+			first := aws.Int64Value(input.PartFirstByte)
+			attempts = append(attempts, first)
+			retry := len(attempts) > 1 && attempts[len(attempts)-2] == first
+			switch {
+			case first == 0 && !retry:
+				return nil, transient
+			case first == 2 && !retry:
+				// ECR receives the part but the response is lost.
+				received = append(received, input.LayerPartBlob...)
+				return nil, transient
+			case first == 2 && retry:
+				return nil, &ecr.InvalidLayerPartException{
+					UploadId:              aws.String(uploadID),
+					LastValidByteReceived: aws.Int64(3),
+				}
+			}
+			received = append(received, input.LayerPartBlob...)
+			return &ecr.UploadLayerPartOutput{UploadId: input.UploadId, LastByteReceived: input.PartLastByte}, nil
+		},
+		CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+			return &ecr.CompleteLayerUploadOutput{LayerDigest: aws.String(digest.FromString(layerData).String())}, nil
+		},
+	}
+	tracker := docker.NewInMemoryTracker()
+	tracker.SetStatus("refKey", docker.Status{})
+	options := layerUploadOptions{
+		checksums: true,
+		backoff:   func(int) time.Duration { return 0 },
+	}
+
+	lw, err := newLayerWriter(&ecrBase{client: client}, tracker, "refKey", ocispec.Descriptor{Digest: digest.FromString(layerData)}, options)
+	require.NoError(t, err)
+	_, err = lw.Write([]byte(layerData))
+	require.NoError(t, err)
+	require.NoError(t, lw.Commit(context.Background(), int64(len(layerData)), digest.FromString(layerData)))
+	assert.Equal(t, []int64{0, 0, 2, 2, 4}, attempts, "failed parts should be retried in the same upload")
+	assert.Equal(t, layerData, string(received))
+}
+
+func TestLayerWriterPartNotRetried(t *testing.T) {
+	attempts := 0
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{UploadId: aws.String("upload"), PartSize: aws.Int64(5)}, nil
+		},
+		UploadLayerPartFn: func(*ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+			attempts++
+			return nil, awserr.New(ecr.ErrCodeUploadNotFoundException, "upload not found", nil)
+		},
+	}
+	tracker := docker.NewInMemoryTracker()
+	tracker.SetStatus("refKey", docker.Status{})
+
+	lw, err := newLayerWriter(&ecrBase{client: client}, tracker, "refKey", ocispec.Descriptor{Digest: digest.FromString("layer")}, layerUploadOptions{})
+	require.NoError(t, err)
+	_, err = lw.Write([]byte("layer"))
+	require.NoError(t, err)
+	assert.Error(t, lw.Commit(context.Background(), 5, digest.FromString("layer")))
+	assert.Equal(t, 1, attempts, "errors which are not transient should not be retried")
+}
+
+func TestLayerWriterResumesUpload(t *testing.T) {
+	const layerData = "layer"
+	uploadID := "upload"
+	transient := awserr.NewRequestFailure(awserr.New("InternalFailure", "internal failure", nil), 500, "")
+	interrupted := true
+	initiated := 0
+	var attempts []int64
+	var received []byte
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			initiated++
+			return &ecr.InitiateLayerUploadOutput{UploadId: aws.String(uploadID), PartSize: aws.Int64(2)}, nil
+		},
+		UploadLayerPartFn: func(input *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+			assert.Equal(t, uploadID, aws.StringValue(input.UploadId))
+			first := aws.Int64Value(input.PartFirstByte)
+			attempts = append(attempts, first)
+			if first == 2 && interrupted {
+				return nil, transient
+			}
+			received = append(received, input.LayerPartBlob...)
+			return &ecr.UploadLayerPartOutput{UploadId: input.UploadId, LastByteReceived: input.PartLastByte}, nil
+		},
+		CompleteLayerUploadFn: func(input *ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+			assert.Equal(t, uploadID, aws.StringValue(input.UploadId))
+			return &ecr.CompleteLayerUploadOutput{LayerDigest: aws.String(digest.FromString(layerData).String())}, nil
+		},
+	}
+	desc := ocispec.Descriptor{Digest: digest.FromString(layerData), Size: int64(len(layerData))}
+	pusher := ecrPusher{ecrBase: ecrBase{client: client}, tracker: docker.NewInMemoryTracker()}
+	pusher.layerUpload.backoff = func(int) time.Duration { return 0 }
+	pusher.layerUpload.checksums = true
+	// ECR returns the part size only when the upload is initiated, so the
+	// rest of the layer is uploaded in parts of the minimum size.
+	pusher.layerUpload.minPartSize = 1
+	ctx := context.Background()
+
+	ref := pusher.markStatusStarted(ctx, desc)
+	lw, err := newLayerWriter(&pusher.ecrBase, pusher.tracker, ref, desc, pusher.layerUpload)
+	require.NoError(t, err)
+	assert.Error(t, content.Copy(ctx, lw, strings.NewReader(layerData), desc.Size, desc.Digest))
+	status, err := pusher.tracker.GetStatus(ref)
+	require.NoError(t, err)
+	assert.Equal(t, uploadID, status.UploadUUID)
+	assert.Equal(t, int64(2), status.Offset)
+
+	interrupted = false
+	attempts = nil
+	ref = pusher.markStatusStarted(ctx, desc)
+	lw, err = newLayerWriter(&pusher.ecrBase, pusher.tracker, ref, desc, pusher.layerUpload)
+	require.NoError(t, err)
+	ws, err := lw.Status()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), ws.Offset, "accepted bytes should not be written again")
+	require.NoError(t, content.Copy(ctx, lw, strings.NewReader(layerData), desc.Size, desc.Digest))
+	assert.Equal(t, 1, initiated, "the interrupted upload should be resumed")
+	assert.Equal(t, []int64{2, 3, 4}, attempts, "parts should continue from the accepted offset")
+	assert.Equal(t, layerData, string(received))
+	status, err = pusher.tracker.GetStatus(ref)
+	require.NoError(t, err)
+	assert.True(t, status.Committed)
+}
+
+func TestLayerWriterForgetsExpiredUpload(t *testing.T) {
+	const layerData = "layer"
+	initiated := 0
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			initiated++
+			return &ecr.InitiateLayerUploadOutput{UploadId: aws.String("new"), PartSize: aws.Int64(5)}, nil
+		},
+		UploadLayerPartFn: func(input *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+			return nil, awserr.New(ecr.ErrCodeUploadNotFoundException, "upload not found", nil)
+		},
+	}
+	desc := ocispec.Descriptor{Digest: digest.FromString(layerData), Size: int64(len(layerData))}
+	tracker := docker.NewInMemoryTracker()
+	tracker.SetStatus("refKey", docker.Status{
+		Status:     content.Status{Ref: "refKey", Offset: 2, Total: desc.Size, Expected: desc.Digest},
+		UploadUUID: "expired",
+	})
+	ctx := context.Background()
+
+	lw, err := newLayerWriter(&ecrBase{client: client}, tracker, "refKey", desc, layerUploadOptions{})
+	require.NoError(t, err)
+	assert.Error(t, content.Copy(ctx, lw, strings.NewReader(layerData), desc.Size, desc.Digest))
+	assert.Equal(t, 0, initiated)
+	status, err := tracker.GetStatus("refKey")
+	require.NoError(t, err)
+	assert.Empty(t, status.UploadUUID, "an expired upload should not be resumed")
+	assert.Zero(t, status.Offset)
+
+	_, err = newLayerWriter(&ecrBase{client: client}, tracker, "refKey", desc, layerUploadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, initiated, "a new upload should be started")
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrInvalidLayout is returned when an archive is not in the OCI image layout
+// format.
+var ErrInvalidLayout = errors.New("invalid OCI image layout")
+
+// layoutEntry locates the content of a file within an archive.
+type layoutEntry struct {
+	offset int64
+	size   int64
+}
+
+type layoutResolver struct {
+	r     io.ReaderAt
+	blobs map[digest.Digest]layoutEntry
+	index ocispec.Index
+}
+
+var _ remotes.Resolver = (*layoutResolver)(nil)
+
+// NewLayoutResolver returns a read-only resolver for the images in a tar
+// archive in the OCI image layout format, such as one written by Export.
+// Using it as the source of Copy imports the archive's images into a
+// registry.
+//
+// The archive is read with random access: only the tar headers are read when
+// the resolver is created, and content is read as it is fetched.  r may
+// therefore be backed by remote storage supporting ranged reads, such as an
+// object in Amazon S3, allowing images to be imported without being staged
+// on disk.
+//
+// Refs are resolved by matching the ref, or its tag, against the
+// org.opencontainers.image.ref.name annotations of the layout's index.json.
+// A ref without a tag resolves to the layout's image when the layout contains
+// a single image other than referrers.
+func NewLayoutResolver(r io.ReaderAt, size int64) (remotes.Resolver, error) {
+	files, err := readLayoutEntries(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	var layout ocispec.ImageLayout
+	if err := readLayoutJSON(r, files, ocispec.ImageLayoutFile, &layout); err != nil {
+		return nil, err
+	}
+	if layout.Version != ocispec.ImageLayoutVersion {
+		return nil, fmt.Errorf("unsupported layout version %q: %w", layout.Version, ErrInvalidLayout)
+	}
+	resolver := &layoutResolver{
+		r:     r,
+		blobs: map[digest.Digest]layoutEntry{},
+	}
+	if err := readLayoutJSON(r, files, "index.json", &resolver.index); err != nil {
+		return nil, err
+	}
+
+	for name, entry := range files {
+		parts := strings.Split(name, "/")
+		if len(parts) != 3 || parts[0] != "blobs" {
+			continue
+		}
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(parts[1]), parts[2])
+		if err := dgst.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v: %w", name, err, ErrInvalidLayout)
+		}
+		resolver.blobs[dgst] = entry
+	}
+	return resolver, nil
+}
+
+// readLayoutEntries reads the tar headers of the archive, returning the
+// location of each regular file.  Seeking past the content of each file
+// avoids reading it.
+func readLayoutEntries(r io.ReaderAt, size int64) (map[string]layoutEntry, error) {
+	section := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(section)
+	files := map[string]layoutEntry{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", err, ErrInvalidLayout)
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		offset, err := section.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		files[path.Clean(hdr.Name)] = layoutEntry{offset: offset, size: hdr.Size}
+	}
+}
+
+func readLayoutJSON(r io.ReaderAt, files map[string]layoutEntry, name string, v interface{}) error {
+	entry, ok := files[name]
+	if !ok {
+		return fmt.Errorf("missing %s: %w", name, ErrInvalidLayout)
+	}
+	data, err := ioutil.ReadAll(io.NewSectionReader(r, entry.offset, entry.size))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %v: %w", name, err, ErrInvalidLayout)
+	}
+	return nil
+}
+
+func (r *layoutResolver) Resolve(_ context.Context, ref string) (string, ocispec.Descriptor, error) {
+	var dgst digest.Digest
+	if i := strings.Index(ref, "@"); i >= 0 {
+		dgst = digest.Digest(ref[i+1:])
+	}
+	_, tag := splitTag(ref)
+
+	var images []ocispec.Descriptor
+	for _, desc := range r.index.Manifests {
+		refName := desc.Annotations[ocispec.AnnotationRefName]
+		matched := false
+		switch {
+		case dgst != "":
+			matched = desc.Digest == dgst
+		case refName != "" && (refName == ref || refName == tag):
+			matched = true
+		case tag == "" && !isReferrerTag(refName):
+			images = append(images, desc)
+		}
+		if matched {
+			return ref, layoutDescriptor(desc), nil
+		}
+	}
+	if tag == "" && dgst == "" && len(images) == 1 {
+		return ref, layoutDescriptor(images[0]), nil
+	}
+	return "", ocispec.Descriptor{}, fmt.Errorf("%s: %w", ref, errdefs.ErrNotFound)
+}
+
+// layoutDescriptor returns the descriptor of the content listed by desc,
+// without the fields describing the listing.
+func layoutDescriptor(desc ocispec.Descriptor) ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType: desc.MediaType,
+		Digest:    desc.Digest,
+		Size:      desc.Size,
+	}
+}
+
+func (r *layoutResolver) Fetcher(context.Context, string) (remotes.Fetcher, error) {
+	return r, nil
+}
+
+func (r *layoutResolver) Fetch(_ context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	entry, ok := r.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", desc.Digest, errdefs.ErrNotFound)
+	}
+	return ioutil.NopCloser(io.NewSectionReader(r.r, entry.offset, entry.size)), nil
+}
+
+func (r *layoutResolver) Pusher(context.Context, string) (remotes.Pusher, error) {
+	return nil, fmt.Errorf("layout archives are read-only: %w", errdefs.ErrNotImplemented)
+}
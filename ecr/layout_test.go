@@ -0,0 +1,88 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayoutRoundTrip(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	index, _ := putMultiArchImage(source, "example.com/source:latest")
+	signature := putSignature(source, "example.com/source", index)
+
+	var buf bytes.Buffer
+	_, err := Export(context.Background(), source, "example.com/source:latest", &buf)
+	require.NoError(t, err)
+
+	archive := bytes.NewReader(buf.Bytes())
+	layout, err := NewLayoutResolver(archive, archive.Size())
+	require.NoError(t, err)
+
+	for _, ref := range []string{"latest", "layout:latest", "layout", "layout@" + index.Digest.String()} {
+		_, desc, err := layout.Resolve(context.Background(), ref)
+		if assert.NoError(t, err, ref) {
+			assert.Equal(t, index.Digest, desc.Digest, ref)
+			assert.Empty(t, desc.Annotations, ref)
+		}
+	}
+	_, _, err = layout.Resolve(context.Background(), "layout:missing")
+	assert.True(t, errdefs.IsNotFound(err))
+
+	desc, err := Copy(context.Background(), layout, "layout:latest", destination, "example.com/destination:latest")
+	require.NoError(t, err)
+	assert.Equal(t, index.Digest, desc.Digest)
+	for dgst := range source.blob {
+		assert.True(t, destination.has(dgst), "destination should have %s", dgst)
+	}
+	_, tagged, err := destination.Resolve(context.Background(), "example.com/destination:sha256-"+index.Digest.Encoded()+".sig")
+	require.NoError(t, err)
+	assert.Equal(t, signature.Digest, tagged.Digest)
+}
+
+func TestLayoutInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "index.json", Mode: 0644, Size: 2, Typeflag: tar.TypeReg}))
+	_, err := tw.Write([]byte("{}"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	archive := bytes.NewReader(buf.Bytes())
+	_, err = NewLayoutResolver(archive, archive.Size())
+	assert.ErrorIs(t, err, ErrInvalidLayout)
+}
+
+func TestIsReferrerTag(t *testing.T) {
+	dgst := "sha256-6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b"
+	for tag, expected := range map[string]bool{
+		dgst:           true,
+		dgst + ".sig":  true,
+		dgst + ".sbom": true,
+		dgst + ".txt":  false,
+		"sha256-abc":   false,
+		"latest":       false,
+	} {
+		assert.Equal(t, expected, isReferrerTag(tag), tag)
+	}
+}
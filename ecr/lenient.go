@@ -0,0 +1,95 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/containerd/containerd/log"
+)
+
+// nonEssentialFields are the fields of manifests, indexes, and descriptors
+// which do not affect the content copied, mapped to functions returning a
+// value of the type the field must decode to.  Unknown fields are always
+// ignored when decoding.
+var nonEssentialFields = map[string]func() interface{}{
+	"annotations":  func() interface{} { return &map[string]string{} },
+	"artifactType": func() interface{} { return new(string) },
+	"data":         func() interface{} { return new([]byte) },
+}
+
+// decodeManifest decodes the manifest, index, or descriptor in data into v.
+// If lenient, non-essential fields which cannot be decoded are logged and
+// ignored rather than failing the decode.
+func decodeManifest(ctx context.Context, data []byte, v interface{}, lenient bool) error {
+	err := json.Unmarshal(data, v)
+	if err == nil || !lenient {
+		return err
+	}
+	sanitized, ok := dropMalformedFields(ctx, data, "")
+	if !ok {
+		return err
+	}
+	return json.Unmarshal(sanitized, v)
+}
+
+// dropMalformedFields returns the JSON object in data without the
+// non-essential fields, of the object or of the descriptors it contains,
+// which cannot be decoded.  path prefixes the names of the fields logged.  It
+// reports false if data is not an object.
+func dropMalformedFields(ctx context.Context, data []byte, path string) ([]byte, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return nil, false
+	}
+	for name, value := range fields {
+		if newValue, ok := nonEssentialFields[name]; ok {
+			if err := json.Unmarshal(value, newValue()); err != nil {
+				log.G(ctx).
+					WithField("field", path+name).
+					WithError(err).
+					Warn("ecr.manifest: ignoring malformed field")
+				delete(fields, name)
+			}
+			continue
+		}
+		switch name {
+		case "config", "subject":
+			if sanitized, ok := dropMalformedFields(ctx, value, path+name+"."); ok {
+				fields[name] = sanitized
+			}
+		case "layers", "manifests":
+			var descriptors []json.RawMessage
+			if err := json.Unmarshal(value, &descriptors); err != nil {
+				continue
+			}
+			for i, descriptor := range descriptors {
+				if sanitized, ok := dropMalformedFields(ctx, descriptor, path+name+"[]."); ok {
+					descriptors[i] = sanitized
+				}
+			}
+			if sanitized, err := json.Marshal(descriptors); err == nil {
+				fields[name] = sanitized
+			}
+		}
+	}
+	sanitized, err := json.Marshal(fields)
+	if err != nil {
+		return nil, false
+	}
+	return sanitized, true
+}
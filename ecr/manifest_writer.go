@@ -25,6 +25,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/opencontainers/go-digest"
@@ -38,6 +39,15 @@ type manifestWriter struct {
 	buf     bytes.Buffer
 	tracker docker.StatusTracker
 	ref     string
+	// invalidate removes the results cached by the resolver for the pushed
+	// manifest and tag, and is nil if results are not cached.
+	invalidate func(context.Context, ECRSpec)
+	// creator creates the repository if it is found missing when the
+	// manifest is put, and is nil if the put fails instead.
+	creator *repositoryCreator
+	// checkIndex configures whether the manifests listed by an index are
+	// confirmed to be in the repository before the index is put.
+	checkIndex bool
 }
 
 var _ content.Writer = (*manifestWriter)(nil)
@@ -73,9 +83,16 @@ func (mw *manifestWriter) Commit(ctx context.Context, size int64, expected diges
 		ImageDigest:            aws.String(expected.String()),
 	}
 
+	if mw.checkIndex && isIndex(mw.desc.MediaType) {
+		if err := checkIndexManifests(ctx, mw.base, mw.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
 	// Tag only if this push is the image's root descriptor, as indicated by the
 	// parsed ECRSpec.
 	rootDigest := ecrSpec.Spec().Digest()
+	var tagged string
 	if mw.desc.Digest == rootDigest {
 		if tag, _ := ecrSpec.TagDigest(); tag != "" {
 			log.G(ctx).
@@ -83,11 +100,21 @@ func (mw *manifestWriter) Commit(ctx context.Context, size int64, expected diges
 				WithField("ref", rootDigest.String()).
 				Debug("ecr.manifest.commit: tag set on push")
 			putImageInput.ImageTag = aws.String(tag)
+			tagged = tag
 		}
 	}
 
 	output, err := mw.base.client.PutImageWithContext(ctx, putImageInput)
-	if err != nil {
+	if created, createErr := mw.creator.createMissing(ctx, mw.base, err); createErr != nil {
+		err = createErr
+	} else if created {
+		output, err = mw.base.client.PutImageWithContext(ctx, putImageInput)
+	}
+	// ECR rejects putting an image which is already in the repository with
+	// the same manifest and tag, such as when a push whose response was lost
+	// is retried.  The image is as requested, so the put has succeeded.
+	alreadyPut := isAWSErrorCode(err, ecr.ErrCodeImageAlreadyExistsException)
+	if err != nil && !alreadyPut {
 		return fmt.Errorf("ecr: failed to put manifest: %v: %w", ecrSpec, err)
 	}
 
@@ -99,14 +126,32 @@ func (mw *manifestWriter) Commit(ctx context.Context, size int64, expected diges
 	} else {
 		log.G(mw.ctx).WithError(err).WithField("ref", mw.ref).Warn("Failed to update status")
 	}
-	if output == nil {
+	if output == nil && !alreadyPut {
 		return fmt.Errorf("ecr: failed to put manifest, nil output: %v", ecrSpec)
 	}
 
-	actual := aws.StringValue(output.Image.ImageId.ImageDigest)
-	if actual != expected.String() {
-		return fmt.Errorf("digest mismatch: ECR returned %s, expected %s", actual, expected)
+	if mw.invalidate != nil {
+		pushed := ecrSpec
+		pushed.Object = "@" + expected.String()
+		mw.invalidate(ctx, pushed)
+		if tagged != "" {
+			pushed.Object = tagged
+			mw.invalidate(ctx, pushed)
+		}
+	}
+
+	if alreadyPut {
+		log.G(ctx).
+			WithField("tag", tagged).
+			Debug("ecr.manifest.commit: image already put")
+	} else if actual := aws.StringValue(output.Image.ImageId.ImageDigest); actual != expected.String() {
+		return fmt.Errorf("digest mismatch: ECR returned %s, expected %s: %w", actual, expected, errdefs.ErrFailedPrecondition)
 	}
+	mw.base.events.emit(ctx, &PushManifestPut{
+		Ref:        ecrSpec.Canonical(),
+		Descriptor: mw.desc,
+		Tag:        tagged,
+	})
 
 	return nil
 }
@@ -17,15 +17,20 @@ package ecr
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -199,3 +204,111 @@ func TestManifestWriterNoTagCommit(t *testing.T) {
 	require.NoError(t, err, "failed to commit")
 	assert.Equal(t, 1, callCount, "PutImage should be called once")
 }
+
+func TestManifestWriterCommitAlreadyPut(t *testing.T) {
+	imageDesc := ocispec.Descriptor{
+		Digest:    testdata.InsignificantDigest,
+		MediaType: ocispec.MediaTypeImageManifest,
+	}
+	callCount := 0
+	client := &fakeECRClient{
+		PutImageFn: func(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error) {
+			callCount++
+			return nil, awserr.New(ecr.ErrCodeImageAlreadyExistsException, "already exists", nil)
+		},
+	}
+	mw := &manifestWriter{
+		desc: imageDesc,
+		base: &ecrBase{
+			client: client,
+			ecrSpec: ECRSpec{
+				arn:        arn.ARN{AccountID: "registry"},
+				Repository: "repository",
+				Object:     "tag@" + imageDesc.Digest.String(),
+			},
+		},
+		tracker: docker.NewInMemoryTracker(),
+		ctx:     context.Background(),
+	}
+
+	_, err := mw.Write([]byte("manifest content"))
+	require.NoError(t, err)
+	err = mw.Commit(context.Background(), int64(len("manifest content")), imageDesc.Digest)
+	assert.NoError(t, err, "retried put of an identical image should succeed")
+	assert.Equal(t, 1, callCount, "PutImage should be called once")
+}
+
+func TestManifestWriterCommitChecksIndexManifests(t *testing.T) {
+	present := digest.FromString("amd64")
+	absent := digest.FromString("arm64")
+	index, err := json.Marshal(ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: present},
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: absent},
+		},
+	})
+	require.NoError(t, err)
+	indexDesc := ocispec.Descriptor{
+		Digest:    digest.FromBytes(index),
+		MediaType: ocispec.MediaTypeImageIndex,
+	}
+
+	stored := map[digest.Digest]bool{present: true}
+	puts := 0
+	client := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			assert.Len(t, input.ImageIds, 2)
+			assert.Equal(t, []string{ocispec.MediaTypeImageManifest}, aws.StringValueSlice(input.AcceptedMediaTypes))
+			output := &ecr.BatchGetImageOutput{}
+			for _, id := range input.ImageIds {
+				if stored[digest.Digest(aws.StringValue(id.ImageDigest))] {
+					output.Images = append(output.Images, &ecr.Image{ImageId: id})
+					continue
+				}
+				output.Failures = append(output.Failures, &ecr.ImageFailure{
+					ImageId:     id,
+					FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound),
+				})
+			}
+			return output, nil
+		},
+		PutImageFn: func(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error) {
+			puts++
+			return &ecr.PutImageOutput{Image: &ecr.Image{ImageId: &ecr.ImageIdentifier{
+				ImageDigest: aws.String(indexDesc.Digest.String()),
+			}}}, nil
+		},
+	}
+	newWriter := func() *manifestWriter {
+		mw := &manifestWriter{
+			desc: indexDesc,
+			base: &ecrBase{
+				client: client,
+				ecrSpec: ECRSpec{
+					arn:        arn.ARN{Region: "fake", AccountID: "123456789012", Resource: "repository/repository"},
+					Repository: "repository",
+					Object:     "tag@" + indexDesc.Digest.String(),
+				},
+			},
+			tracker:    docker.NewInMemoryTracker(),
+			ctx:        context.Background(),
+			checkIndex: true,
+		}
+		_, err := mw.Write(index)
+		require.NoError(t, err)
+		return mw
+	}
+
+	err = newWriter().Commit(context.Background(), int64(len(index)), indexDesc.Digest)
+	var missing *MissingManifestsError
+	require.True(t, errors.As(err, &missing), "expected missing manifests, got %v", err)
+	assert.Equal(t, []digest.Digest{absent}, missing.Digests)
+	assert.True(t, errdefs.IsFailedPrecondition(err))
+	assert.Equal(t, 0, puts, "index should not be put")
+
+	stored[absent] = true
+	err = newWriter().Commit(context.Background(), int64(len(index)), indexDesc.Digest)
+	require.NoError(t, err)
+	assert.Equal(t, 1, puts)
+}
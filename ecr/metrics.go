@@ -0,0 +1,279 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The metrics reported to Metrics, with the labels of each.  Durations are
+// observed in seconds.
+const (
+	// MetricAPICalls counts ECR API calls by "operation", "region", and
+	// "code", the error code the call failed with or "" if it succeeded.
+	MetricAPICalls = "ecr_api_calls_total"
+	// MetricAPICallDuration observes the duration of ECR API calls, including
+	// their retries, by "operation" and "region".
+	MetricAPICallDuration = "ecr_api_call_duration_seconds"
+	// MetricAPIRetries counts the ECR API requests retried by the AWS SDK by
+	// "operation" and "region".
+	MetricAPIRetries = "ecr_api_retries_total"
+	// MetricThrottles counts the ECR API requests rejected because the
+	// request rate was exceeded by "operation" and "region".
+	MetricThrottles = "ecr_api_throttles_total"
+	// MetricResolveDuration observes the duration of calls to Resolve by
+	// "result", "ok" or "error".
+	MetricResolveDuration = "ecr_resolve_duration_seconds"
+	// MetricLayerFetchDuration observes the time from fetching a layer or
+	// config until it is closed by "result", "ok" or "error".
+	MetricLayerFetchDuration = "ecr_layer_fetch_duration_seconds"
+	// MetricLayerFetchRetries counts the attempts to fetch a layer which
+	// failed and were retried.  It has no labels.
+	MetricLayerFetchRetries = "ecr_layer_fetch_retries_total"
+	// MetricBytesDownloaded counts the bytes read from fetched layers and
+	// configs when they are closed.  It has no labels.
+	MetricBytesDownloaded = "ecr_downloaded_bytes_total"
+	// MetricBytesUploaded counts the bytes of layer parts uploaded to ECR.
+	// It has no labels.
+	MetricBytesUploaded = "ecr_uploaded_bytes_total"
+	// MetricManifestsPushed counts the manifests put to ECR.  It has no
+	// labels.
+	MetricManifestsPushed = "ecr_manifests_pushed_total"
+)
+
+// Metrics receives the measurements of a resolver and the fetchers and
+// pushers created by it, to be exported to a monitoring system such as
+// Prometheus or OpenTelemetry.  Each metric, such as MetricAPICalls, is
+// reported with the same labels every time.  Implementations must be safe for
+// concurrent use and should return quickly.
+type Metrics interface {
+	// Count adds delta to the counter name.
+	Count(name string, delta int64, labels map[string]string)
+	// Observe records value in the histogram name.
+	Observe(name string, value float64, labels map[string]string)
+}
+
+// Tracer starts spans around the ECR API calls and layer downloads of a
+// resolver and the fetchers and pushers created by it, to be exported to a
+// tracing system such as OpenTelemetry.  Spans of API calls are named after
+// the operation, such as "ecr.BatchGetImage", and layer downloads are spanned
+// by "ecr.layer.download".  Implementations must be safe for concurrent use.
+type Tracer interface {
+	// Start starts the span name with attributes as a child of any span in
+	// ctx.  It returns the context of the new span and a function ending it
+	// with the error the operation failed with, if any.
+	Start(ctx context.Context, name string, attributes map[string]string) (context.Context, func(err error))
+}
+
+// telemetry reports to the Metrics and Tracer of a resolver, either of which
+// may be nil.  A nil telemetry reports nothing.
+type telemetry struct {
+	metrics Metrics
+	tracer  Tracer
+}
+
+func newTelemetry(metrics Metrics, tracer Tracer) *telemetry {
+	if metrics == nil && tracer == nil {
+		return nil
+	}
+	return &telemetry{metrics: metrics, tracer: tracer}
+}
+
+func (t *telemetry) count(name string, delta int64, labels map[string]string) {
+	if t == nil || t.metrics == nil {
+		return
+	}
+	t.metrics.Count(name, delta, labels)
+}
+
+func (t *telemetry) observe(name string, value float64, labels map[string]string) {
+	if t == nil || t.metrics == nil {
+		return
+	}
+	t.metrics.Observe(name, value, labels)
+}
+
+// start starts a span if a Tracer is configured.  The returned function is
+// never nil.
+func (t *telemetry) start(ctx context.Context, name string, attributes map[string]string) (context.Context, func(err error)) {
+	if t == nil || t.tracer == nil {
+		return ctx, func(error) {}
+	}
+	return t.tracer.Start(ctx, name, attributes)
+}
+
+func resultLabel(err error) map[string]string {
+	if err != nil {
+		return map[string]string{"result": "error"}
+	}
+	return map[string]string{"result": "ok"}
+}
+
+// eventHandler returns an EventHandler recording the metrics of the events
+// it receives before passing them to next, which may be nil.
+func (t *telemetry) eventHandler(next EventHandler) EventHandler {
+	if t == nil || t.metrics == nil {
+		return next
+	}
+	return func(ctx context.Context, event Event) {
+		switch e := event.(type) {
+		case *ResolveCompleted:
+			t.observe(MetricResolveDuration, e.Duration.Seconds(), resultLabel(e.Err))
+		case *LayerFetchRetry:
+			t.count(MetricLayerFetchRetries, 1, nil)
+		case *Throttled:
+			t.count(MetricThrottles, 1, map[string]string{"operation": e.Operation, "region": e.Region})
+		case *PushManifestPut:
+			t.count(MetricManifestsPushed, 1, nil)
+		}
+		if next != nil {
+			next(ctx, event)
+		}
+	}
+}
+
+type apiSpanKey struct{}
+
+// addAPIHandlers adds handlers to an ECR client's handlers recording the
+// metrics and spans of its API calls.
+func (t *telemetry) addAPIHandlers(handlers *request.Handlers) {
+	if t == nil {
+		return
+	}
+	handlers.Validate.PushFrontNamed(request.NamedHandler{
+		Name: "ecr.telemetry.start",
+		Fn: func(r *request.Request) {
+			if t.tracer == nil {
+				return
+			}
+			ctx, end := t.tracer.Start(r.Context(), "ecr."+r.Operation.Name, map[string]string{
+				"operation": r.Operation.Name,
+				"region":    aws.StringValue(r.Config.Region),
+			})
+			r.SetContext(context.WithValue(ctx, apiSpanKey{}, end))
+		},
+	})
+	handlers.Send.PushFrontNamed(request.NamedHandler{
+		Name: "ecr.telemetry.retries",
+		Fn: func(r *request.Request) {
+			if r.RetryCount > 0 {
+				t.count(MetricAPIRetries, 1, apiLabels(r))
+			}
+		},
+	})
+	handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "ecr.telemetry.complete",
+		Fn: func(r *request.Request) {
+			labels := apiLabels(r)
+			t.observe(MetricAPICallDuration, time.Since(r.Time).Seconds(), labels)
+			code := ""
+			var aerr awserr.Error
+			if errors.As(r.Error, &aerr) {
+				code = aerr.Code()
+			} else if r.Error != nil {
+				code = "Unknown"
+			}
+			t.count(MetricAPICalls, 1, map[string]string{
+				"operation": labels["operation"],
+				"region":    labels["region"],
+				"code":      code,
+			})
+			if input, ok := r.Params.(*ecr.UploadLayerPartInput); ok && r.Error == nil {
+				t.count(MetricBytesUploaded, int64(len(input.LayerPartBlob)), nil)
+			}
+			if end, ok := r.Context().Value(apiSpanKey{}).(func(error)); ok {
+				end(r.Error)
+			}
+		},
+	})
+}
+
+func apiLabels(r *request.Request) map[string]string {
+	return map[string]string{
+		"operation": r.Operation.Name,
+		"region":    aws.StringValue(r.Config.Region),
+	}
+}
+
+// fetchLayer calls fetch within a span, returning the layer it fetches
+// wrapped to record its metrics and end the span when it is closed.
+func (t *telemetry) fetchLayer(ctx context.Context, desc ocispec.Descriptor, repository string, fetch func(context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if t == nil {
+		return fetch(ctx)
+	}
+	start := time.Now()
+	ctx, end := t.start(ctx, "ecr.layer.download", map[string]string{
+		"repository": repository,
+		"digest":     desc.Digest.String(),
+	})
+	rc, err := fetch(ctx)
+	if err != nil {
+		t.observe(MetricLayerFetchDuration, time.Since(start).Seconds(), resultLabel(err))
+		end(err)
+		return nil, err
+	}
+	return &telemetryReader{ReadCloser: rc, telemetry: t, start: start, end: end}, nil
+}
+
+// telemetryReader counts the bytes read from a layer and records them when
+// it is closed.
+type telemetryReader struct {
+	io.ReadCloser
+	telemetry *telemetry
+	start     time.Time
+	end       func(error)
+	bytes     int64
+	err       error
+	once      sync.Once
+}
+
+func (r *telemetryReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// WriteTo preserves the WriteTo method of the wrapped ReadCloser, if any.
+func (r *telemetryReader) WriteTo(w io.Writer) (int64, error) {
+	n, err := copyPooled(w, r.ReadCloser)
+	r.bytes += n
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *telemetryReader) Close() error {
+	r.once.Do(func() {
+		r.telemetry.count(MetricBytesDownloaded, r.bytes, nil)
+		r.telemetry.observe(MetricLayerFetchDuration, time.Since(r.start).Seconds(), resultLabel(r.err))
+		r.end(r.err)
+	})
+	return r.ReadCloser.Close()
+}
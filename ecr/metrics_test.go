@@ -0,0 +1,177 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMetrics records the metrics reported to it.
+type fakeMetrics struct {
+	lock         sync.Mutex
+	counts       map[string]int64
+	observations map[string]int
+}
+
+func metricKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s%v", name, labels)
+}
+
+func (m *fakeMetrics) Count(name string, delta int64, labels map[string]string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.counts[metricKey(name, labels)] += delta
+}
+
+func (m *fakeMetrics) Observe(name string, value float64, labels map[string]string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.observations[metricKey(name, labels)]++
+}
+
+// fakeTracer records the spans started with it, by name, along with the name
+// of their parent span.
+type fakeTracer struct {
+	lock    sync.Mutex
+	parents map[string]string
+	ended   map[string]error
+}
+
+type fakeSpanKey struct{}
+
+func (t *fakeTracer) Start(ctx context.Context, name string, _ map[string]string) (context.Context, func(error)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	parent, _ := ctx.Value(fakeSpanKey{}).(string)
+	t.parents[name] = parent
+	return context.WithValue(ctx, fakeSpanKey{}, name), func(err error) {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		t.ended[name] = err
+	}
+}
+
+func TestMetricsAndTracing(t *testing.T) {
+	const layerData = "layer"
+	manifest := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	throttled := false
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layer" {
+			fmt.Fprint(w, layerData)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch r.Header.Get("X-Amz-Target") {
+		case "AmazonEC2ContainerRegistry_V20150921.BatchGetImage":
+			if !throttled {
+				throttled = true
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"__type":"ThrottlingException"}`)
+				return
+			}
+			fmt.Fprintf(w, `{"images":[{"imageId":{"imageDigest":%q},"imageManifest":%q,"imageManifestMediaType":%q}],"failures":[]}`,
+				digest.FromString(manifest), manifest, ocispec.MediaTypeImageManifest)
+		case "AmazonEC2ContainerRegistry_V20150921.GetDownloadUrlForLayer":
+			fmt.Fprintf(w, `{"downloadUrl":%q}`, ts.URL+"/layer")
+		case "AmazonEC2ContainerRegistry_V20150921.UploadLayerPart":
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer ts.Close()
+
+	metrics := &fakeMetrics{counts: map[string]int64{}, observations: map[string]int{}}
+	tracer := &fakeTracer{parents: map[string]string{}, ended: map[string]error{}}
+	resolver, err := NewResolver(
+		WithSession(unit.Session.Copy(&aws.Config{
+			Endpoint:   aws.String(ts.URL),
+			SleepDelay: func(time.Duration) {},
+		})),
+		WithMetrics(metrics),
+		WithTracer(tracer))
+	require.NoError(t, err)
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	_, _, err = resolver.Resolve(context.Background(), ref)
+	require.NoError(t, err)
+	fetcher, err := resolver.Fetcher(context.Background(), ref)
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString(layerData),
+		Size:      int64(len(layerData)),
+	})
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+
+	client := resolver.(*ecrResolver).getClient("fake", "123456789012")
+	_, err = client.UploadLayerPart(&ecr.UploadLayerPartInput{
+		RepositoryName: aws.String("foo/bar"),
+		UploadId:       aws.String("upload"),
+		PartFirstByte:  aws.Int64(0),
+		PartLastByte:   aws.Int64(2),
+		LayerPartBlob:  []byte("abc"),
+	})
+	require.NoError(t, err)
+
+	api := map[string]string{"operation": "BatchGetImage", "region": "fake"}
+	assert.Equal(t, int64(1), metrics.counts[metricKey(MetricAPICalls, map[string]string{"operation": "BatchGetImage", "region": "fake", "code": ""})])
+	assert.Equal(t, int64(1), metrics.counts[metricKey(MetricAPIRetries, api)])
+	assert.Equal(t, int64(1), metrics.counts[metricKey(MetricThrottles, api)])
+	assert.Equal(t, 1, metrics.observations[metricKey(MetricAPICallDuration, api)])
+	assert.Equal(t, 1, metrics.observations[metricKey(MetricResolveDuration, map[string]string{"result": "ok"})])
+	assert.Equal(t, 1, metrics.observations[metricKey(MetricLayerFetchDuration, map[string]string{"result": "ok"})])
+	assert.Equal(t, int64(len(layerData)), metrics.counts[MetricBytesDownloaded])
+	assert.Equal(t, int64(3), metrics.counts[MetricBytesUploaded])
+
+	assert.Equal(t, map[string]string{
+		"ecr.BatchGetImage":          "",
+		"ecr.layer.download":         "",
+		"ecr.GetDownloadUrlForLayer": "ecr.layer.download",
+		"ecr.UploadLayerPart":        "",
+	}, tracer.parents)
+	assert.Len(t, tracer.ended, 4, "every span should be ended")
+	for name, err := range tracer.ended {
+		assert.NoError(t, err, name)
+	}
+}
+
+func TestWithMetricsNil(t *testing.T) {
+	_, err := NewResolver(WithSession(unit.Session), WithMetrics(nil))
+	assert.Error(t, err)
+	_, err = NewResolver(WithSession(unit.Session), WithTracer(nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Mirror is an alternate upstream for the repositories whose names begin with
+// a prefix.  Mirrors are configured with WithMirror.
+type Mirror struct {
+	// Prefix is matched against whole path components of repository names,
+	// such as "mirror/docker".
+	Prefix string
+	// Upstream is the locator to which the remainder of a repository's name
+	// is appended to form the mirror's reference, such as "docker.io".
+	Upstream string
+	// Resolver resolves and fetches references to the mirror.
+	Resolver remotes.Resolver
+}
+
+// matches reports whether the mirror is an upstream for ecrSpec.
+func (m *Mirror) matches(ecrSpec ECRSpec) bool {
+	return strings.HasPrefix(ecrSpec.Repository, m.Prefix+"/")
+}
+
+// ref returns the mirror's reference for ecrSpec.
+func (m *Mirror) ref(ecrSpec ECRSpec) string {
+	return reference.Spec{
+		Locator: m.Upstream + "/" + strings.TrimPrefix(ecrSpec.Repository, m.Prefix+"/"),
+		Object:  ecrSpec.Object,
+	}.String()
+}
+
+func (m *Mirror) resolve(ctx context.Context, ecrSpec ECRSpec) (ocispec.Descriptor, error) {
+	ref := m.ref(ecrSpec)
+	log.G(ctx).
+		WithField("ref", ecrSpec.Canonical()).
+		WithField("mirror", ref).
+		Debug("ecr.resolver.resolve: resolving from mirror")
+	_, desc, err := m.Resolver.Resolve(ctx, ref)
+	return desc, err
+}
+
+// mirrorFor returns the mirror with the longest prefix matching ecrSpec, or
+// nil if no mirror matches.
+func (r *ecrResolver) mirrorFor(ecrSpec ECRSpec) *Mirror {
+	var mirror *Mirror
+	for i := range r.mirrors {
+		m := &r.mirrors[i]
+		if m.matches(ecrSpec) && (mirror == nil || len(m.Prefix) > len(mirror.Prefix)) {
+			mirror = m
+		}
+	}
+	return mirror
+}
+
+// mirrorFetcher fetches content from a mirror, falling back to ECR for content
+// the mirror fails to provide.
+type mirrorFetcher struct {
+	mirror *Mirror
+	ref    string
+	ecr    remotes.Fetcher
+	// schema1 holds the content converted from Docker Schema 1, which is
+	// not in the mirror, and is nil if images are not converted.
+	schema1 *schema1Conversions
+
+	once     sync.Once
+	upstream remotes.Fetcher
+	err      error
+}
+
+var _ remotes.Fetcher = (*mirrorFetcher)(nil)
+
+func (f *mirrorFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if rc, ok := f.schema1.fetch(ctx, desc); ok {
+		return rc, nil
+	}
+	f.once.Do(func() {
+		f.upstream, f.err = f.mirror.Resolver.Fetcher(ctx, f.ref)
+	})
+	err := f.err
+	if err == nil {
+		var rc io.ReadCloser
+		rc, err = f.upstream.Fetch(ctx, desc)
+		if err == nil {
+			return rc, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	log.G(ctx).
+		WithField("desc", desc).
+		WithField("mirror", f.ref).
+		WithError(err).
+		Warn("ecr.fetcher.mirror: failed to fetch from mirror, falling back to ECR")
+	return f.ecr.Fetch(ctx, desc)
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const mirroredRef = "ecr.aws/arn:aws:ecr:fake:123456789012:repository/mirror/docker/library/alpine:3"
+
+// newMirrorTestResolver returns a resolver mirroring "mirror/docker" to
+// mirror, with client as its ECR client.
+func newMirrorTestResolver(t *testing.T, mirror *fakeRegistry, client *fakeECRClient) *ecrResolver {
+	resolver, err := NewResolver(
+		WithSession(unit.Session),
+		WithMirror("mirror/docker/", "docker.io", mirror))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	return resolver.(*ecrResolver)
+}
+
+func TestMirrorRef(t *testing.T) {
+	mirror := &Mirror{Prefix: "mirror/docker", Upstream: "docker.io"}
+	dgst := digest.FromString("alpine")
+	for ref, expected := range map[string]string{
+		mirroredRef: "docker.io/library/alpine:3",
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/mirror/docker/library/alpine@" + dgst.String(): "docker.io/library/alpine@" + dgst.String(),
+	} {
+		ecrSpec, err := ParseRef(ref)
+		require.NoError(t, err)
+		assert.True(t, mirror.matches(ecrSpec))
+		assert.Equal(t, expected, mirror.ref(ecrSpec))
+	}
+
+	ecrSpec, err := ParseRef("ecr.aws/arn:aws:ecr:fake:123456789012:repository/mirror/dockerfile:3")
+	require.NoError(t, err)
+	assert.False(t, mirror.matches(ecrSpec), "prefix should match whole path components")
+}
+
+func TestMirrorResolve(t *testing.T) {
+	mirror := newFakeRegistry()
+	desc := mirror.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	mirror.tag("docker.io/library/alpine:3", desc)
+	resolver := newMirrorTestResolver(t, mirror, &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			t.Error("mirrored reference should not be resolved with ECR")
+			return nil, nil
+		},
+	})
+
+	name, resolved, err := resolver.Resolve(context.Background(), mirroredRef)
+	require.NoError(t, err)
+	assert.Equal(t, mirroredRef, name)
+	assert.Equal(t, desc, resolved)
+}
+
+func TestMirrorResolveFallback(t *testing.T) {
+	const manifest = `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	calls := 0
+	resolver := newMirrorTestResolver(t, newFakeRegistry(), &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			calls++
+			assert.Equal(t, "mirror/docker/library/alpine", aws.StringValue(input.RepositoryName))
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(digest.FromString(manifest).String())},
+				ImageManifest: aws.String(manifest),
+			}}}, nil
+		},
+	})
+
+	_, desc, err := resolver.Resolve(context.Background(), mirroredRef)
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls, "reference missing from the mirror should be resolved with ECR")
+	assert.Equal(t, digest.FromString(manifest), desc.Digest)
+}
+
+func TestMirrorFetchFallback(t *testing.T) {
+	mirror := newFakeRegistry()
+	layer := mirror.put(ocispec.MediaTypeImageLayerGzip, []byte("mirrored layer"))
+	const manifest = "image manifest"
+	resolver := newMirrorTestResolver(t, mirror, &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{
+				Images: []*ecr.Image{{ImageManifest: aws.String(manifest)}},
+			}, nil
+		},
+		GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			t.Error("mirrored layer should not be fetched from ECR")
+			return nil, nil
+		},
+	})
+	fetcher, err := resolver.Fetcher(context.Background(), mirroredRef)
+	require.NoError(t, err)
+
+	rc, err := fetcher.Fetch(context.Background(), layer)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "mirrored layer", string(data))
+
+	rc, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString(manifest),
+		Size:      int64(len(manifest)),
+	})
+	require.NoError(t, err, "manifest missing from the mirror should be fetched from ECR")
+	data, err = ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.Equal(t, manifest, string(data))
+}
+
+func TestMirrorLongestPrefix(t *testing.T) {
+	resolver, err := NewResolver(
+		WithSession(unit.Session),
+		WithMirror("mirror", "example.com", newFakeRegistry()),
+		WithMirror("mirror/docker", "docker.io", newFakeRegistry()))
+	require.NoError(t, err)
+	for ref, expected := range map[string]string{
+		mirroredRef: "docker.io",
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/mirror/quay/foo:latest": "example.com",
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest":         "",
+	} {
+		ecrSpec, err := ParseRef(ref)
+		require.NoError(t, err)
+		mirror := resolver.(*ecrResolver).mirrorFor(ecrSpec)
+		if expected == "" {
+			assert.Nil(t, mirror, ref)
+		} else if assert.NotNil(t, mirror, ref) {
+			assert.Equal(t, expected, mirror.Upstream, ref)
+		}
+	}
+}
+
+func TestWithMirrorInvalid(t *testing.T) {
+	_, err := NewResolver(WithSession(unit.Session), WithMirror("", "docker.io", newFakeRegistry()))
+	assert.Error(t, err, "empty prefix")
+	_, err = NewResolver(WithSession(unit.Session), WithMirror("mirror", "", newFakeRegistry()))
+	assert.Error(t, err, "empty upstream")
+	_, err = NewResolver(WithSession(unit.Session), WithMirror("mirror", "docker.io", nil))
+	assert.Error(t, err, "nil resolver")
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// MissingLayersError is returned when ECR reports layers of an image missing
+// after the image was resolved.  Lifecycle policies which expire an image
+// while it is being pulled cause this: the image resolved, but its layers
+// were deleted before they could be fetched.  The reference is resolved once
+// more to tell the image having been deleted apart from an image which is
+// still present but is missing layers.  The error unwraps to the *FetchError
+// of the failed fetch, so that it is still reported as errdefs.ErrNotFound.
+type MissingLayersError struct {
+	// Ref is the reference of the image being fetched.
+	Ref string
+	// Digests lists the layers found missing, including the one fetched.
+	Digests []digest.Digest
+	// ImageDeleted reports whether the reference no longer names an image.
+	ImageDeleted bool
+	// Current is the digest the reference names when resolved again, unless
+	// the image was deleted.  It differs from the image being pulled when a
+	// tag was moved to another image.
+	Current digest.Digest
+	Err     error
+}
+
+func (e *MissingLayersError) Error() string {
+	digests := make([]string, 0, len(e.Digests))
+	for _, dgst := range e.Digests {
+		digests = append(digests, dgst.String())
+	}
+	if e.ImageDeleted {
+		return fmt.Sprintf("ecr: %s was deleted while being fetched, missing layers %s: %v", e.Ref, strings.Join(digests, ", "), e.Err)
+	}
+	return fmt.Sprintf("ecr: %s (%s) is missing layers %s, which may have been deleted by a lifecycle policy: %v", e.Ref, e.Current, strings.Join(digests, ", "), e.Err)
+}
+
+func (e *MissingLayersError) Unwrap() error {
+	return e.Err
+}
+
+// isLayersNotFound reports whether err is ECR reporting a layer missing from
+// its repository.
+func isLayersNotFound(err error) bool {
+	var fetchErr *FetchError
+	return errors.As(err, &fetchErr) && fetchErr.Code == ecr.ErrCodeLayersNotFoundException
+}
+
+// missingLayersCheck records the result of resolving a fetcher's reference
+// again after a layer was reported missing, so that it is resolved once
+// however many of its layers are missing.
+type missingLayersCheck struct {
+	once   sync.Once
+	result missingLayers
+}
+
+// missingLayers is the state of an image found missing layers.
+type missingLayers struct {
+	deleted bool
+	current digest.Digest
+	digests []digest.Digest
+	err     error
+}
+
+// missingLayersError returns the *MissingLayersError for fetchErr, ECR
+// reporting the layer dgst missing, or fetchErr itself if the reference could
+// not be resolved again.
+func (f *ecrFetcher) missingLayersError(ctx context.Context, dgst digest.Digest, fetchErr error) error {
+	if f.ecrSpec.Object == "" {
+		return fetchErr
+	}
+	var result missingLayers
+	if f.missing == nil {
+		result = f.checkMissingLayers(ctx)
+	} else {
+		f.missing.once.Do(func() {
+			f.missing.result = f.checkMissingLayers(ctx)
+		})
+		result = f.missing.result
+	}
+	if result.err != nil {
+		log.G(ctx).WithError(result.err).Warn("ecr.fetcher.layer: unable to resolve image with missing layer")
+		return fetchErr
+	}
+
+	digests := []digest.Digest{dgst}
+	for _, missing := range result.digests {
+		if missing != dgst {
+			digests = append(digests, missing)
+		}
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i] < digests[j] })
+	log.G(ctx).
+		WithField("deleted", result.deleted).
+		WithField("current", result.current).
+		WithField("missing", len(digests)).
+		Warn("ecr.fetcher.layer: image is missing layers")
+	return &MissingLayersError{
+		Ref:          f.ecrSpec.Canonical(),
+		Digests:      digests,
+		ImageDeleted: result.deleted,
+		Current:      result.current,
+		Err:          fetchErr,
+	}
+}
+
+// checkMissingLayers resolves the fetcher's reference again and lists the
+// layers and config of its image which are missing from the repository.
+// Indexes are not descended into.
+func (f *ecrFetcher) checkMissingLayers(ctx context.Context) missingLayers {
+	image, err := f.getImage(ctx)
+	if errors.Is(err, errImageNotFound) {
+		return missingLayers{deleted: true}
+	}
+	if err != nil {
+		return missingLayers{err: err}
+	}
+	result := missingLayers{current: digest.Digest(aws.StringValue(image.ImageId.ImageDigest))}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal([]byte(aws.StringValue(image.ImageManifest)), &manifest); err != nil {
+		return result
+	}
+	var blobs []digest.Digest
+	if manifest.Config.Digest != "" {
+		blobs = append(blobs, manifest.Config.Digest)
+	}
+	for _, layer := range manifest.Layers {
+		if !images.IsNonDistributable(layer.MediaType) {
+			blobs = append(blobs, layer.Digest)
+		}
+	}
+	if len(blobs) == 0 {
+		return result
+	}
+	sizes, err := layerSizes(ctx, f.client, f.ecrSpec, blobs)
+	if err != nil {
+		return missingLayers{err: err}
+	}
+	for _, dgst := range blobs {
+		if _, ok := sizes[dgst]; !ok {
+			result.digests = append(result.digests, dgst)
+		}
+	}
+	return result
+}
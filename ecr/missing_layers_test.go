@@ -0,0 +1,120 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// missingLayersFixture is an image whose first and last layers were deleted
+// from its repository.
+func missingLayersFixture(t *testing.T, deleted bool) (*ecrFetcher, []ocispec.Descriptor, *int) {
+	layers := []ocispec.Descriptor{
+		{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("a")},
+		{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("b")},
+		{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("c")},
+	}
+	config := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromString("config")}
+	manifest, err := json.Marshal(ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Config: config, Layers: layers})
+	require.NoError(t, err)
+	available := map[string]bool{config.Digest.String(): true, layers[1].Digest.String(): true}
+
+	resolves := 0
+	client := &fakeECRClient{
+		GetDownloadUrlForLayerFn: func(_ aws.Context, input *ecr.GetDownloadUrlForLayerInput, _ ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			return nil, awserr.New(ecr.ErrCodeLayersNotFoundException, "not found", nil)
+		},
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			resolves++
+			assert.Equal(t, "latest", aws.StringValue(input.ImageIds[0].ImageTag))
+			if deleted {
+				return &ecr.BatchGetImageOutput{Failures: []*ecr.ImageFailure{{
+					FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound),
+				}}}, nil
+			}
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(digest.FromBytes(manifest).String())},
+				ImageManifest: aws.String(string(manifest)),
+			}}}, nil
+		},
+		BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			output := &ecr.BatchCheckLayerAvailabilityOutput{}
+			for _, dgst := range aws.StringValueSlice(input.LayerDigests) {
+				if available[dgst] {
+					output.Layers = append(output.Layers, &ecr.Layer{
+						LayerDigest:       aws.String(dgst),
+						LayerAvailability: aws.String(ecr.LayerAvailabilityAvailable),
+					})
+				} else {
+					output.Failures = append(output.Failures, &ecr.LayerFailure{
+						LayerDigest: aws.String(dgst),
+						FailureCode: aws.String(ecr.LayerFailureCodeMissingLayerDigest),
+					})
+				}
+			}
+			return output, nil
+		},
+	}
+	spec, err := ParseRef("ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{client: client, ecrSpec: spec},
+		missing: &missingLayersCheck{},
+	}
+	return fetcher, layers, &resolves
+}
+
+func TestFetchMissingLayers(t *testing.T) {
+	fetcher, layers, resolves := missingLayersFixture(t, false)
+
+	for _, layer := range []ocispec.Descriptor{layers[0], layers[2]} {
+		_, err := fetcher.Fetch(context.Background(), layer)
+		var missingErr *MissingLayersError
+		require.True(t, errors.As(err, &missingErr), "error should name the missing layers: %v", err)
+		assert.False(t, missingErr.ImageDeleted)
+		assert.NotEmpty(t, missingErr.Current)
+		assert.ElementsMatch(t, []digest.Digest{layers[0].Digest, layers[2].Digest}, missingErr.Digests)
+		assert.True(t, errdefs.IsNotFound(err))
+		var fetchErr *FetchError
+		require.True(t, errors.As(err, &fetchErr))
+		assert.Equal(t, layer.Digest, fetchErr.Digest)
+	}
+	assert.Equal(t, 1, *resolves, "the image should be resolved again once")
+}
+
+func TestFetchMissingLayersImageDeleted(t *testing.T) {
+	fetcher, layers, _ := missingLayersFixture(t, true)
+
+	_, err := fetcher.Fetch(context.Background(), layers[0])
+	var missingErr *MissingLayersError
+	require.True(t, errors.As(err, &missingErr), "error should name the missing layers: %v", err)
+	assert.True(t, missingErr.ImageDeleted)
+	assert.Equal(t, []digest.Digest{layers[0].Digest}, missingErr.Digests)
+	assert.True(t, errdefs.IsNotFound(err))
+}
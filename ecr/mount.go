@@ -0,0 +1,166 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// distributionSourceLabel prefixes the annotations listing the repositories
+// of a registry host from which a blob was pulled.  containerd records them as
+// labels on pulled content and copies them to the descriptors it pushes.
+const distributionSourceLabel = "containerd.io/distribution.source."
+
+// mountSource returns a repository in the registry of the push, other than
+// the repository being pushed to, from which desc was pulled according to its
+// distribution source annotations.  The repository sharing the most leading
+// path components with the repository being pushed to is preferred.
+func (p ecrPusher) mountSource(desc ocispec.Descriptor) (ECRSpec, bool) {
+	sources := desc.Annotations[distributionSourceLabel+strings.TrimSuffix(refPrefix, "/")]
+	if sources == "" {
+		return ECRSpec{}, false
+	}
+	var (
+		source ECRSpec
+		found  bool
+		best   int
+	)
+	target := strings.Split(p.ecrSpec.Repository, "/")
+	for _, candidate := range strings.Split(sources, ",") {
+		spec, err := parseARN(candidate)
+		if err != nil ||
+			spec.Repository == p.ecrSpec.Repository ||
+			spec.Partition() != p.ecrSpec.Partition() ||
+			spec.Region() != p.ecrSpec.Region() ||
+			spec.Registry() != p.ecrSpec.Registry() {
+			continue
+		}
+		common := 0
+		for i, component := range strings.Split(spec.Repository, "/") {
+			if i >= len(target) || target[i] != component {
+				break
+			}
+			common++
+		}
+		if !found || common > best {
+			source, found, best = spec, true, common
+		}
+	}
+	return source, found
+}
+
+// layerSource returns the first of the repositories configured with
+// WithLayerSourceRepositories, other than the repository being pushed to, in
+// which desc is available.  Repositories which cannot be checked are logged
+// and skipped.
+func (p ecrPusher) layerSource(ctx context.Context, desc ocispec.Descriptor) (ECRSpec, bool) {
+	for _, repository := range p.layerSources {
+		if repository == p.ecrSpec.Repository {
+			continue
+		}
+		source := ECRSpec{arn: p.ecrSpec.arn, Repository: repository}
+		source.arn.Resource = repositoryPrefix + repository
+		sizes, err := layerSizes(ctx, p.client, source, []digest.Digest{desc.Digest})
+		if err != nil {
+			log.G(ctx).
+				WithField("source", repository).
+				WithError(err).
+				Warn("ecr.pusher.blob.mount: failed to check source repository")
+			continue
+		}
+		if _, ok := sizes[desc.Digest]; ok {
+			return source, true
+		}
+	}
+	return ECRSpec{}, false
+}
+
+// blobMounter mounts blobs from other repositories of a registry through the
+// registry's Docker Registry HTTP API, as ECR's API has no operation to share
+// layers between repositories.
+type blobMounter struct {
+	*registryAPI
+}
+
+// mount asks the registry to mount desc into the repository being pushed to
+// from source, and reports whether it did.  A registry which does not mount
+// the blob starts an upload instead, which is cancelled so that the blob is
+// uploaded through ECR's API as usual.
+func (m *blobMounter) mount(ctx context.Context, p ecrPusher, desc ocispec.Descriptor, source ECRSpec) (bool, error) {
+	endpoint, token, err := m.authorize(ctx, p.client, p.ecrSpec)
+	if err != nil {
+		return false, err
+	}
+	mountURL := fmt.Sprintf("%s/v2/%s/blobs/uploads/?mount=%s&from=%s",
+		endpoint, p.ecrSpec.Repository, url.QueryEscape(desc.Digest.String()), url.QueryEscape(source.Repository))
+	req, err := http.NewRequest(http.MethodPost, mountURL, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := m.do(ctx, req, token)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusAccepted:
+		if location, err := resp.Location(); err == nil {
+			if req, err := http.NewRequest(http.MethodDelete, location.String(), nil); err == nil {
+				if resp, err := m.do(ctx, req, token); err == nil {
+					resp.Body.Close()
+				}
+			}
+		}
+		return false, nil
+	default:
+		return false, fmt.Errorf("ecr.pusher.blob.mount: unexpected status code %v: %v", mountURL, resp.Status)
+	}
+}
+
+// tryMount mounts desc from the repository it was pulled from, if that
+// repository is in the registry of the push.  Failures are logged and
+// reported as the blob not being mounted, so that it is uploaded instead.
+func (p ecrPusher) tryMount(ctx context.Context, desc ocispec.Descriptor) bool {
+	if p.mounter == nil {
+		return false
+	}
+	source, ok := p.mountSource(desc)
+	if !ok {
+		source, ok = p.layerSource(ctx, desc)
+	}
+	if !ok {
+		return false
+	}
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("source", source.Repository))
+	mounted, err := p.mounter.mount(ctx, p, desc, source)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("ecr.pusher.blob.mount: failed to mount, uploading")
+		return false
+	}
+	log.G(ctx).WithField("mounted", mounted).Debug("ecr.pusher.blob.mount")
+	return mounted
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const mountSourceAnnotation = distributionSourceLabel + "ecr.aws"
+
+func newMountTestPusher(t *testing.T, client *fakeECRClient) ecrPusher {
+	ecrSpec, err := ParseRef("ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/team/b@" + testdata.ImageDigest.String())
+	require.NoError(t, err)
+	return ecrPusher{
+		ecrBase: ecrBase{
+			client:  client,
+			ecrSpec: ecrSpec,
+		},
+		tracker: docker.NewInMemoryTracker(),
+		mounter: &blobMounter{registryAPI: &registryAPI{}},
+	}
+}
+
+func TestMountSource(t *testing.T) {
+	pusher := newMountTestPusher(t, &fakeECRClient{})
+	for name, test := range map[string]struct {
+		sources  string
+		expected string
+	}{
+		"none": {},
+		"same repository": {
+			sources: "arn:aws:ecr:us-west-2:123456789012:repository/team/b",
+		},
+		"other registries": {
+			sources: "arn:aws:ecr:us-east-1:123456789012:repository/team/a," +
+				"arn:aws:ecr:us-west-2:210987654321:repository/team/a",
+		},
+		"longest common prefix": {
+			sources: "arn:aws:ecr:us-west-2:123456789012:repository/other," +
+				"arn:aws:ecr:us-west-2:123456789012:repository/team/a," +
+				"invalid",
+			expected: "team/a",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			desc := ocispec.Descriptor{Annotations: map[string]string{mountSourceAnnotation: test.sources}}
+			source, ok := pusher.mountSource(desc)
+			assert.Equal(t, test.expected != "", ok)
+			assert.Equal(t, test.expected, source.Repository)
+		})
+	}
+}
+
+// newMountTestClient returns a client reporting that layers are missing from
+// the repository and authorizing requests to registry.
+func newMountTestClient(registry *httptest.Server) *fakeECRClient {
+	return &fakeECRClient{
+		BatchCheckLayerAvailabilityFn: func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			return &ecr.BatchCheckLayerAvailabilityOutput{
+				Layers: []*ecr.Layer{{LayerAvailability: aws.String(ecr.LayerAvailabilityUnavailable)}},
+			}, nil
+		},
+		GetAuthorizationTokenFn: func(_ aws.Context, input *ecr.GetAuthorizationTokenInput, _ ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+			return &ecr.GetAuthorizationTokenOutput{AuthorizationData: []*ecr.AuthorizationData{{
+				AuthorizationToken: aws.String("token"),
+				ProxyEndpoint:      aws.String(registry.URL),
+			}}}, nil
+		},
+	}
+}
+
+var mountTestLayer = ocispec.Descriptor{
+	MediaType: ocispec.MediaTypeImageLayerGzip,
+	Digest:    testdata.LayerDigest,
+	Annotations: map[string]string{
+		mountSourceAnnotation: "arn:aws:ecr:us-west-2:123456789012:repository/team/a",
+	},
+}
+
+func TestPushBlobMounted(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/v2/team/b/blobs/uploads/", r.URL.Path)
+		assert.Equal(t, testdata.LayerDigest.String(), r.URL.Query().Get("mount"))
+		assert.Equal(t, "team/a", r.URL.Query().Get("from"))
+		assert.Equal(t, "Basic token", r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer registry.Close()
+	client := newMountTestClient(registry)
+	client.InitiateLayerUploadFn = func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+		t.Error("mounted layer should not be uploaded")
+		return nil, errors.New("unexpected upload")
+	}
+	pusher := newMountTestPusher(t, client)
+
+	_, err := pusher.Push(context.Background(), mountTestLayer)
+	assert.True(t, errors.Is(err, errdefs.ErrAlreadyExists), "mounted layer should already exist: %v", err)
+}
+
+func TestPushBlobMountFallback(t *testing.T) {
+	var requests []string
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodPost {
+			// The registry starts an upload rather than mounting.
+			w.Header().Set("Location", "/v2/team/b/blobs/uploads/session")
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer registry.Close()
+	client := newMountTestClient(registry)
+	uploads := 0
+	client.InitiateLayerUploadFn = func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+		uploads++
+		return &ecr.InitiateLayerUploadOutput{}, nil
+	}
+	pusher := newMountTestPusher(t, client)
+
+	writer, err := pusher.Push(context.Background(), mountTestLayer)
+	require.NoError(t, err)
+	writer.Close()
+	assert.Equal(t, 1, uploads, "layer should be uploaded")
+	assert.Equal(t, []string{
+		"POST /v2/team/b/blobs/uploads/",
+		"DELETE /v2/team/b/blobs/uploads/session",
+	}, requests, "upload started by the registry should be cancelled")
+
+	// Layers without a source in the registry are uploaded without
+	// attempting a mount.
+	requests = nil
+	writer, err = pusher.Push(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    testdata.LayerDigest,
+	})
+	require.NoError(t, err)
+	writer.Close()
+	assert.Empty(t, requests)
+}
+
+func TestPushBlobMountedFromLayerSource(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/team/b/blobs/uploads/", r.URL.Path)
+		assert.Equal(t, "base/images", r.URL.Query().Get("from"))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer registry.Close()
+	client := newMountTestClient(registry)
+	var checked []string
+	client.BatchCheckLayerAvailabilityFn = func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+		repository := aws.StringValue(input.RepositoryName)
+		checked = append(checked, repository)
+		availability := ecr.LayerAvailabilityUnavailable
+		if repository == "base/images" {
+			availability = ecr.LayerAvailabilityAvailable
+		}
+		return &ecr.BatchCheckLayerAvailabilityOutput{
+			Layers: []*ecr.Layer{{
+				LayerDigest:       input.LayerDigests[0],
+				LayerAvailability: aws.String(availability),
+			}},
+		}, nil
+	}
+	client.InitiateLayerUploadFn = func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+		t.Error("mounted layer should not be uploaded")
+		return nil, errors.New("unexpected upload")
+	}
+	pusher := newMountTestPusher(t, client)
+	pusher.layerSources = []string{"team/b", "base/other", "base/images", "base/last"}
+
+	_, err := pusher.Push(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    testdata.LayerDigest,
+	})
+	assert.True(t, errors.Is(err, errdefs.ErrAlreadyExists), "mounted layer should already exist: %v", err)
+	assert.Equal(t, []string{"team/b", "base/other", "base/images"}, checked,
+		"source repositories should be checked in order until the layer is found")
+}
+
+func TestWithLayerSourceRepositories(t *testing.T) {
+	resolver, err := NewResolver(WithLayerSourceRepositories("base/images"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"base/images"}, resolver.(*ecrResolver).layerSourceRepositories)
+
+	_, err = NewResolver(WithLayerSourceRepositories("base/images:latest"))
+	assert.Error(t, err, "references should not be accepted as repositories")
+}
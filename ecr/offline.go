@@ -0,0 +1,59 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// ErrOffline is returned by offline resolvers for operations which need
+// network access and cannot be served from the resolver's caches or mirrors.
+var ErrOffline = errors.New("ecr: network access disabled in offline mode")
+
+// addOfflineHandler adds a handler to an ECR client's handlers failing every
+// call with ErrOffline before it is signed or sent, so that no credentials
+// are requested and the call is not retried.
+func addOfflineHandler(handlers *request.Handlers) {
+	handlers.Validate.PushFrontNamed(request.NamedHandler{
+		Name: "ecr.offline",
+		Fn: func(r *request.Request) {
+			r.Error = fmt.Errorf("%s: %w", r.Operation.Name, ErrOffline)
+		},
+	})
+}
+
+// offlineTransport is an http.RoundTripper failing every request with
+// ErrOffline.  It is installed on the HTTP client of offline resolvers, so
+// that layer downloads and other requests outside of the ECR API fail
+// without reaching the network.
+type offlineTransport struct{}
+
+var _ http.RoundTripper = offlineTransport{}
+
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL.Host, ErrOffline)
+}
+
+// withOffline returns a shallow copy of client which sends no requests.
+func withOffline(client *http.Client) *http.Client {
+	wrapped := *client
+	wrapped.Transport = offlineTransport{}
+	return &wrapped
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// MinimumLayerPartSize is the smallest part, other than the last, that
+	// ECR accepts when uploading a layer.
+	MinimumLayerPartSize = 5 << 20
+	// partSizeIncrement is the granularity of adaptive part sizes.
+	partSizeIncrement = 1 << 20
+	// targetPartDuration is the time adaptive part sizes aim for each part to
+	// take to upload.
+	targetPartDuration = 5 * time.Second
+)
+
+// partSizer chooses the size of the parts of a layer upload from the
+// throughput measured while uploading earlier parts.  Parts are sized to
+// upload in about targetPartDuration, so that slow connections upload small
+// parts which complete well within request timeouts, and fast connections
+// upload large parts which amortize the overhead of each request.
+type partSizer struct {
+	lock       sync.Mutex
+	min        int64
+	max        int64
+	size       int64
+	throughput float64
+}
+
+// newPartSizer returns a partSizer starting at initial, bounded by min and
+// max.
+func newPartSizer(initial, min, max int64) *partSizer {
+	return &partSizer{
+		min:  min,
+		max:  max,
+		size: clampPartSize(initial, min, max),
+	}
+}
+
+// next returns the size of the next part to be read.
+func (s *partSizer) next() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.size
+}
+
+// observe records that bytes were uploaded in elapsed, adjusting the size of
+// subsequent parts.  Throughput is smoothed between parts, and the size at
+// most doubles or halves with each observation, so that a single slow or
+// fast request does not swing the size between its bounds.
+func (s *partSizer) observe(bytes int64, elapsed time.Duration) {
+	if bytes <= 0 || elapsed <= 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	rate := float64(bytes) / elapsed.Seconds()
+	if s.throughput == 0 {
+		s.throughput = rate
+	} else {
+		s.throughput = (s.throughput + rate) / 2
+	}
+
+	target := int64(s.throughput * targetPartDuration.Seconds())
+	switch {
+	case target > 2*s.size:
+		target = 2 * s.size
+	case target < s.size/2:
+		target = s.size / 2
+	}
+	s.size = clampPartSize(target, s.min, s.max)
+}
+
+// clampPartSize rounds size down to a multiple of partSizeIncrement within
+// min and max.
+func clampPartSize(size, min, max int64) int64 {
+	size -= size % partSizeIncrement
+	if size > max {
+		size = max
+	}
+	if size < min {
+		size = min
+	}
+	return size
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const mib = 1 << 20
+
+func TestPartSizerStartsWithinBounds(t *testing.T) {
+	assert.Equal(t, int64(10*mib), newPartSizer(10*mib, 5*mib, 20*mib).next())
+	assert.Equal(t, int64(20*mib), newPartSizer(100*mib, 5*mib, 20*mib).next())
+	assert.Equal(t, int64(5*mib), newPartSizer(0, 5*mib, 20*mib).next())
+}
+
+func TestPartSizerGrowsOnFastLinks(t *testing.T) {
+	sizer := newPartSizer(10*mib, 5*mib, 100*mib)
+	// 100 MiB/s sustains 500 MiB parts, so the size doubles with each part
+	// until reaching the maximum.
+	sizer.observe(10*mib, 100*time.Millisecond)
+	assert.Equal(t, int64(20*mib), sizer.next())
+	sizer.observe(20*mib, 200*time.Millisecond)
+	assert.Equal(t, int64(40*mib), sizer.next())
+	for i := 0; i < 5; i++ {
+		sizer.observe(sizer.next(), time.Duration(sizer.next()/mib)*10*time.Millisecond)
+	}
+	assert.Equal(t, int64(100*mib), sizer.next())
+}
+
+func TestPartSizerShrinksOnSlowLinks(t *testing.T) {
+	sizer := newPartSizer(20*mib, 5*mib, 20*mib)
+	// 1.2 MiB/s sustains 6 MiB parts in the target duration.
+	sizer.observe(20*mib, 16666*time.Millisecond)
+	assert.Equal(t, int64(10*mib), sizer.next(), "should halve at most")
+	sizer.observe(10*mib, 8333*time.Millisecond)
+	assert.Equal(t, int64(6*mib), sizer.next())
+	// Slower still is bounded by the minimum.
+	sizer.observe(6*mib, time.Minute)
+	sizer.observe(5*mib, time.Minute)
+	assert.Equal(t, int64(5*mib), sizer.next())
+}
+
+func TestPartSizerIgnoresEmptyObservations(t *testing.T) {
+	sizer := newPartSizer(10*mib, 5*mib, 20*mib)
+	sizer.observe(0, time.Second)
+	sizer.observe(mib, 0)
+	assert.Equal(t, int64(10*mib), sizer.next())
+}
+
+func TestWithAdaptivePartSize(t *testing.T) {
+	_, err := NewResolver(WithSession(unit.Session), WithAdaptivePartSize(mib, 20*mib))
+	assert.Error(t, err, "minimum below ECR's minimum part size")
+	_, err = NewResolver(WithSession(unit.Session), WithAdaptivePartSize(10*mib, 5*mib))
+	assert.Error(t, err, "maximum below minimum")
+
+	resolver, err := NewResolver(WithSession(unit.Session), WithAdaptivePartSize(5*mib, 20*mib))
+	require.NoError(t, err)
+	pusher, err := resolver.Pusher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest@sha256:"+
+		"0000000000000000000000000000000000000000000000000000000000000000")
+	require.NoError(t, err)
+	layerUpload := pusher.(*ecrPusher).layerUpload
+	assert.Equal(t, int64(5*mib), layerUpload.minPartSize)
+	assert.Equal(t, int64(20*mib), layerUpload.maxPartSize)
+}
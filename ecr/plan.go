@@ -0,0 +1,199 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+)
+
+// TransferStatus describes whether planned content is already present at the
+// destination.
+type TransferStatus string
+
+const (
+	// TransferPresent is the status of content already at the destination.
+	TransferPresent TransferStatus = "present"
+	// TransferMissing is the status of content to be transferred.
+	TransferMissing TransferStatus = "missing"
+	// TransferUnknown is the status of content whose presence the
+	// destination cannot report without transferring it.
+	TransferUnknown TransferStatus = "unknown"
+)
+
+// PlannedTransfer is a manifest, index, or blob in a TransferPlan.
+type PlannedTransfer struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	Size      int64         `json:"size"`
+	// Manifest is true for manifests and indexes.
+	Manifest bool           `json:"manifest"`
+	Status   TransferStatus `json:"status"`
+}
+
+// TransferPlan describes the content a copy would transfer, so that pipelines
+// can review the cost of a copy before executing it.  It is encoded as JSON
+// for machine consumption.
+type TransferPlan struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// Digest of the root manifest or index to be copied.
+	Digest digest.Digest `json:"digest"`
+	// Transfers lists the planned content, with children ahead of their
+	// parents and referrers last.
+	Transfers []PlannedTransfer `json:"transfers"`
+	// TransferSize is the total size in bytes of the content to be pushed
+	// which is not known to be present at the destination.
+	TransferSize int64 `json:"transferSize"`
+}
+
+// PlanCopy plans the copy of sourceRef to destinationRef as Copy would with
+// the same options, without pushing anything.  Manifests and indexes are
+// fetched from the source to walk the image, and blobs are checked at the
+// destination if it implements BlobProber; otherwise their status is
+// TransferUnknown.  Manifests are checked by resolving them by digest.
+func PlanCopy(ctx context.Context, source remotes.Resolver, sourceRef string, destination remotes.Resolver, destinationRef string, opts ...CopyOption) (*TransferPlan, error) {
+	options, err := newCopyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	name, desc, err := source.Resolve(ctx, sourceRef)
+	if err != nil {
+		return nil, err
+	}
+	fetcher, err := source.Fetcher(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newCopier(options, fetcher)
+	root, err := c.plan(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	nodes := c.nodes
+	if !options.SkipReferrers {
+		referrers, err := c.referrers(ctx, source, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range referrers {
+			// Sharing seen plans content common to several referrers once.
+			referrer := newCopier(CopyOptions{
+				SkipReferrers: true,
+				Lenient:       options.Lenient,
+				ManifestsOnly: options.ManifestsOnly,
+			}, fetcher)
+			referrer.seen = c.seen
+			if _, err := referrer.plan(ctx, r.desc); err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, referrer.nodes...)
+		}
+	}
+
+	plan := &TransferPlan{
+		Source:      sourceRef,
+		Destination: destinationRef,
+		Digest:      root.Digest,
+	}
+	statuses, err := transferStatuses(ctx, destination, destinationRef, nodes)
+	if err != nil {
+		return nil, err
+	}
+	for i, node := range nodes {
+		transfer := PlannedTransfer{
+			Digest:    node.desc.Digest,
+			MediaType: node.desc.MediaType,
+			Size:      node.desc.Size,
+			Manifest:  node.content != nil,
+			Status:    statuses[i],
+		}
+		plan.Transfers = append(plan.Transfers, transfer)
+		if transfer.Status != TransferPresent && (transfer.Manifest || !options.ManifestsOnly) {
+			plan.TransferSize += transfer.Size
+		}
+	}
+	log.G(ctx).
+		WithField("destination", destinationRef).
+		WithField("transfers", len(plan.Transfers)).
+		WithField("size", plan.TransferSize).
+		Debug("ecr.copy: planned copy")
+	return plan, nil
+}
+
+// transferStatuses reports whether each of nodes is present at
+// destinationRef.  Content of a repository which does not exist is missing.
+func transferStatuses(ctx context.Context, destination remotes.Resolver, destinationRef string, nodes []copyNode) ([]TransferStatus, error) {
+	statuses := make([]TransferStatus, len(nodes))
+	var blobs []digest.Digest
+	for i, node := range nodes {
+		if node.content != nil {
+			continue
+		}
+		statuses[i] = TransferUnknown
+		blobs = append(blobs, node.desc.Digest)
+	}
+
+	if prober, ok := destination.(BlobProber); ok && len(blobs) > 0 {
+		missing, err := prober.MissingBlobs(ctx, destinationRef, blobs)
+		if err != nil && !isDestinationNotFound(err) {
+			return nil, err
+		}
+		absent := map[digest.Digest]bool{}
+		for _, dgst := range missing {
+			absent[dgst] = true
+		}
+		for i, node := range nodes {
+			if node.content != nil {
+				continue
+			}
+			if err != nil || absent[node.desc.Digest] {
+				statuses[i] = TransferMissing
+			} else {
+				statuses[i] = TransferPresent
+			}
+		}
+	}
+
+	name, _ := splitTag(destinationRef)
+	for i, node := range nodes {
+		if node.content == nil {
+			continue
+		}
+		_, _, err := destination.Resolve(ctx, name+"@"+node.desc.Digest.String())
+		switch {
+		case err == nil:
+			statuses[i] = TransferPresent
+		case isDestinationNotFound(err):
+			statuses[i] = TransferMissing
+		default:
+			return nil, err
+		}
+	}
+	return statuses, nil
+}
+
+// isDestinationNotFound reports whether err shows that content or its
+// repository is absent.
+func isDestinationNotFound(err error) bool {
+	return errdefs.IsNotFound(err) || errors.Is(err, ErrRepositoryNotFound) || isRepositoryNotFound(err)
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanCopy(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	index, manifests := putMultiArchImage(source, "example.com/source:latest")
+	signature := putSignature(source, "example.com/source", index)
+	present := digest.FromString("layer for amd64")
+	destination.put("", source.get(present))
+	destination.put("", source.get(manifests[1].Digest))
+
+	plan, err := PlanCopy(context.Background(), source, "example.com/source:latest", destination, "example.com/destination:latest")
+	require.NoError(t, err)
+	assert.Equal(t, index.Digest, plan.Digest)
+	assert.Empty(t, destination.pushes, "planning should push nothing")
+
+	statuses := map[digest.Digest]TransferStatus{}
+	var size int64
+	for _, transfer := range plan.Transfers {
+		statuses[transfer.Digest] = transfer.Status
+		if transfer.Status == TransferMissing {
+			size += transfer.Size
+		}
+	}
+	assert.Len(t, statuses, len(source.blob), "every piece of content should be planned once")
+	assert.Equal(t, TransferPresent, statuses[present])
+	assert.Equal(t, TransferPresent, statuses[manifests[1].Digest])
+	assert.Equal(t, TransferMissing, statuses[manifests[0].Digest])
+	assert.Equal(t, TransferMissing, statuses[index.Digest])
+	assert.Equal(t, TransferMissing, statuses[signature.Digest], "referrers should be planned")
+	assert.Equal(t, size, plan.TransferSize)
+
+	_, err = json.Marshal(plan)
+	require.NoError(t, err)
+}
+
+func TestPlanCopyUnknownBlobs(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	source.tag("source", source.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"}))
+
+	// The destination cannot probe blobs once hidden behind the interface.
+	plan, err := PlanCopy(context.Background(), source, "source", struct{ remotes.Resolver }{destination}, "destination")
+	require.NoError(t, err)
+	require.Len(t, plan.Transfers, 3)
+	for _, transfer := range plan.Transfers {
+		if transfer.Manifest {
+			assert.Equal(t, TransferMissing, transfer.Status)
+		} else {
+			assert.Equal(t, TransferUnknown, transfer.Status)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// selectPlatform returns the descriptor of the manifest of the index desc
+// which best matches the resolver's platform.  The index is read from ECR if
+// manifest is nil.
+func (r *ecrResolver) selectPlatform(ctx context.Context, ecrSpec ECRSpec, desc ocispec.Descriptor, manifest []byte) (ocispec.Descriptor, error) {
+	if manifest == nil {
+		base := ecrBase{
+			client:     r.getClient(ecrSpec.Region(), ecrSpec.Registry()),
+			ecrSpec:    ecrSpec,
+			mediaTypes: r.acceptedMediaTypes,
+		}
+		image, err := base.getImageByDescriptor(ctx, desc)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		manifest = []byte(aws.StringValue(image.ImageManifest))
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(manifest, &index); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to parse index %v: %w", desc.Digest, ErrInvalidManifest)
+	}
+
+	var selected *ocispec.Descriptor
+	for i, child := range index.Manifests {
+		if child.Platform == nil || !r.resolvePlatform.Match(*child.Platform) {
+			continue
+		}
+		if selected == nil || r.resolvePlatform.Less(*child.Platform, *selected.Platform) {
+			selected = &index.Manifests[i]
+		}
+	}
+	if selected == nil {
+		return ocispec.Descriptor{}, fmt.Errorf("no manifest in index %v matches the resolver's platform: %w", desc.Digest, errdefs.ErrNotFound)
+	}
+	log.G(ctx).
+		WithField("index", desc.Digest).
+		WithField("manifest", selected.Digest).
+		WithField("platform", selected.Platform).
+		Debug("ecr.resolver.resolve: resolved manifest for platform")
+	return *selected, nil
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIndexClient returns a client serving an index of linux/amd64 and
+// linux/arm64 manifests, counting its BatchGetImage calls.
+func fakeIndexClient(t *testing.T, calls *int) (*fakeECRClient, ocispec.Index) {
+	index := ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{
+			{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    digest.FromString("amd64"),
+				Size:      100,
+				Platform:  &ocispec.Platform{OS: "linux", Architecture: "amd64"},
+			},
+			{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    digest.FromString("arm64"),
+				Size:      200,
+				Platform:  &ocispec.Platform{OS: "linux", Architecture: "arm64"},
+			},
+		},
+	}
+	index.SchemaVersion = 2
+	data, err := json.Marshal(index)
+	require.NoError(t, err)
+	return &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			*calls++
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(digest.FromBytes(data).String())},
+				ImageManifestMediaType: aws.String(ocispec.MediaTypeImageIndex),
+				ImageManifest:          aws.String(string(data)),
+			}}}, nil
+		},
+	}, index
+}
+
+func TestResolvePlatform(t *testing.T) {
+	calls := 0
+	client, index := fakeIndexClient(t, &calls)
+	resolver, err := NewResolver(WithResolvePlatform("linux/arm64"))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	name, desc, err := resolver.Resolve(context.Background(), ref)
+	require.NoError(t, err)
+	assert.Equal(t, ref, name)
+	assert.Equal(t, index.Manifests[1], desc, "index should resolve to the manifest for the platform")
+	assert.Equal(t, 1, calls, "index should be read from the response resolving it")
+
+	resolver, err = NewResolver(WithResolvePlatform("windows/amd64"))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	_, _, err = resolver.Resolve(context.Background(), ref)
+	assert.True(t, errdefs.IsNotFound(err), "unexpected error %v", err)
+
+	_, err = NewResolver(WithResolvePlatform("not a platform"))
+	assert.Error(t, err)
+}
+
+func TestResolvePlatformCached(t *testing.T) {
+	calls := 0
+	client, index := fakeIndexClient(t, &calls)
+	cache := NewMemoryDescriptorCache(10)
+	resolver, err := NewResolver(WithResolvePlatform("linux/amd64"), WithDescriptorCache(cache))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	_, indexDesc, err := (&ecrResolver{clients: map[string]ecrAPI{"fake": client}}).Resolve(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar@" + indexDesc.Digest.String()
+
+	for i := 0; i < 2; i++ {
+		_, desc, err := resolver.Resolve(context.Background(), ref)
+		require.NoError(t, err)
+		assert.Equal(t, index.Manifests[0], desc)
+	}
+	cached, ok, err := cache.Get(context.Background(), ref)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, indexDesc.Digest, cached.Digest, "the index should be cached rather than the selected manifest")
+}
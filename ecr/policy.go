@@ -0,0 +1,67 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+// PushPolicy validates a reference before it is pushed.  Returning an error,
+// typically a *PolicyViolationError, prevents the push.
+type PushPolicy func(ctx context.Context, ecrSpec ECRSpec) error
+
+// PolicyViolationError is returned when a reference to be pushed does not
+// conform to a PushPolicy.
+type PolicyViolationError struct {
+	// Ref is the reference that was to be pushed.
+	Ref string
+	// Reason describes the violated rule.
+	Reason string
+}
+
+func (e *PolicyViolationError) Error() string {
+	return fmt.Sprintf("ecr: push of %s violates policy: %s", e.Ref, e.Reason)
+}
+
+// NamingPolicy returns a PushPolicy requiring repository names to match
+// repository and tags to match tag.  Either pattern may be nil to allow any
+// value.  Pushes by digest alone have no tag and are not checked against tag.
+//
+// For example, to require repositories of the form "team/service" and
+// semantic version tags:
+//
+//	ecr.NamingPolicy(
+//		regexp.MustCompile(`^[a-z0-9-]+/[a-z0-9-]+$`),
+//		regexp.MustCompile(`^v?\d+\.\d+\.\d+$`))
+func NamingPolicy(repository, tag *regexp.Regexp) PushPolicy {
+	return func(_ context.Context, ecrSpec ECRSpec) error {
+		if repository != nil && !repository.MatchString(ecrSpec.Repository) {
+			return &PolicyViolationError{
+				Ref:    ecrSpec.Canonical(),
+				Reason: fmt.Sprintf("repository %q does not match %q", ecrSpec.Repository, repository),
+			}
+		}
+		if t, _ := ecrSpec.TagDigest(); tag != nil && t != "" && !tag.MatchString(t) {
+			return &PolicyViolationError{
+				Ref:    ecrSpec.Canonical(),
+				Reason: fmt.Sprintf("tag %q does not match %q", t, tag),
+			}
+		}
+		return nil
+	}
+}
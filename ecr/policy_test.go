@@ -0,0 +1,75 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPusherNamingPolicy(t *testing.T) {
+	const digest = "@sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b"
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{"fake": &fakeECRClient{}},
+		pushPolicies: []PushPolicy{NamingPolicy(
+			regexp.MustCompile(`^[a-z]+/[a-z]+$`),
+			regexp.MustCompile(`^v\d+\.\d+\.\d+$`))},
+	}
+
+	for ref, allowed := range map[string]bool{
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/team/service:v1.2.3" + digest: true,
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/team/service" + digest:        true,
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/team/service:latest" + digest: false,
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/service:v1.2.3" + digest:      false,
+	} {
+		_, err := resolver.Pusher(context.Background(), ref)
+		if allowed {
+			assert.NoError(t, err, ref)
+			continue
+		}
+		var violation *PolicyViolationError
+		if assert.True(t, errors.As(err, &violation), ref) {
+			assert.Equal(t, ref, violation.Ref)
+		}
+	}
+}
+
+func TestPusherPolicyOrder(t *testing.T) {
+	expected := errors.New("expected")
+	var calls []string
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{"fake": &fakeECRClient{}},
+		pushPolicies: []PushPolicy{
+			func(_ context.Context, ecrSpec ECRSpec) error {
+				calls = append(calls, "first")
+				assert.Equal(t, "foo/bar", ecrSpec.Repository)
+				return expected
+			},
+			func(context.Context, ECRSpec) error {
+				calls = append(calls, "second")
+				return nil
+			},
+		},
+	}
+	_, err := resolver.Pusher(context.Background(),
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest@sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b")
+	assert.Equal(t, expected, err)
+	assert.Equal(t, []string{"first"}, calls)
+}
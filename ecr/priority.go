@@ -0,0 +1,96 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayerPriority returns the priority of the download of a layer or config.
+// When layer downloads are limited with WithLayerDownloadLimit, waiting
+// downloads with lower values start first.  position is the position of the
+// blob in the order in which its image is unpacked, as read from the image
+// manifest fetched by the same fetcher: 0 for the config, which is needed
+// first, then 1 for the base layer and so on.  position is -1 if the blob is
+// not listed by a manifest fetched by the fetcher.
+type LayerPriority func(ctx context.Context, desc ocispec.Descriptor, position int) int
+
+// UnpackOrderPriority is the default LayerPriority.  It downloads blobs in the
+// order in which they are unpacked, so that unpacking can begin before all of
+// an image's layers have been downloaded.  Blobs with an unknown position are
+// downloaded last.
+func UnpackOrderPriority(_ context.Context, _ ocispec.Descriptor, position int) int {
+	if position < 0 {
+		return math.MaxInt32
+	}
+	return position
+}
+
+// unpackOrder records the positions of blobs in the unpack order of the image
+// manifests fetched by a fetcher.
+type unpackOrder struct {
+	lock      sync.Mutex
+	positions map[digest.Digest]int
+}
+
+func newUnpackOrder() *unpackOrder {
+	return &unpackOrder{positions: map[digest.Digest]int{}}
+}
+
+// record records the positions of the config and layers listed by manifest.
+// Indexes and manifests which cannot be parsed are ignored.
+func (o *unpackOrder) record(manifest string) {
+	var parsed ocispec.Manifest
+	if err := json.Unmarshal([]byte(manifest), &parsed); err != nil || parsed.Config.Digest == "" {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.positions[parsed.Config.Digest] = 0
+	for i, layer := range parsed.Layers {
+		if _, ok := o.positions[layer.Digest]; !ok {
+			o.positions[layer.Digest] = i + 1
+		}
+	}
+}
+
+// position returns the recorded position of dgst, or -1 if it is unknown.
+func (o *unpackOrder) position(dgst digest.Digest) int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if position, ok := o.positions[dgst]; ok {
+		return position
+	}
+	return -1
+}
+
+// layerPriority returns the priority of the download of desc.
+func (f *ecrFetcher) layerPriority(ctx context.Context, desc ocispec.Descriptor) int {
+	if f.order == nil {
+		return 0
+	}
+	priority := f.priority
+	if priority == nil {
+		priority = UnpackOrderPriority
+	}
+	return priority(ctx, desc, f.order.position(desc.Digest))
+}
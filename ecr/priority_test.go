@@ -0,0 +1,111 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func priorityTestManifest() (ocispec.Manifest, string) {
+	blob := func(mediaType, data string) ocispec.Descriptor {
+		return ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromString(data), Size: int64(len(data))}
+	}
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    blob(ocispec.MediaTypeImageConfig, "config"),
+		Layers: []ocispec.Descriptor{
+			blob(ocispec.MediaTypeImageLayerGzip, "base"),
+			blob(ocispec.MediaTypeImageLayerGzip, "middle"),
+			blob(ocispec.MediaTypeImageLayerGzip, "top"),
+		},
+	}
+	data, _ := json.Marshal(manifest)
+	return manifest, string(data)
+}
+
+func TestUnpackOrder(t *testing.T) {
+	manifest, data := priorityTestManifest()
+	order := newUnpackOrder()
+	order.record(`{"schemaVersion":2,"manifests":[]}`)
+	order.record("not a manifest")
+	order.record(data)
+
+	assert.Equal(t, 0, order.position(manifest.Config.Digest))
+	for i, layer := range manifest.Layers {
+		assert.Equal(t, i+1, order.position(layer.Digest))
+	}
+	assert.Equal(t, -1, order.position(digest.FromString("unknown")))
+	assert.Equal(t, math.MaxInt32, UnpackOrderPriority(context.Background(), ocispec.Descriptor{}, -1))
+}
+
+func TestFetcherLayerPriority(t *testing.T) {
+	manifest, data := priorityTestManifest()
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{ImageManifest: aws.String(data)}}}, nil
+		},
+	}
+	const ref = "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	for name, test := range map[string]struct {
+		options  []ResolverOption
+		expected []int
+	}{
+		"unlimited": {expected: []int{0, 0, 0, 0}},
+		"unpack order": {
+			options:  []ResolverOption{WithLayerDownloadLimit(1, SchedulingGreedy)},
+			expected: []int{0, 1, 2, 3},
+		},
+		"hook": {
+			options: []ResolverOption{
+				WithLayerDownloadLimit(1, SchedulingGreedy),
+				WithLayerPriority(func(_ context.Context, _ ocispec.Descriptor, position int) int {
+					return -position
+				}),
+			},
+			expected: []int{0, -1, -2, -3},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			resolver, err := NewResolver(append([]ResolverOption{WithSession(unit.Session)}, test.options...)...)
+			require.NoError(t, err)
+			resolver.(*ecrResolver).clients["fake"] = fakeClient
+			fetcher, err := resolver.Fetcher(context.Background(), ref)
+			require.NoError(t, err)
+			rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest})
+			require.NoError(t, err)
+			rc.Close()
+
+			var priorities []int
+			for _, desc := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+				priorities = append(priorities, fetcher.(*ecrFetcher).layerPriority(context.Background(), desc))
+			}
+			assert.Equal(t, test.expected, priorities)
+		})
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"fmt"
+	"time"
+)
+
+// Profile names a preset of resolver settings suited to a common
+// environment, selected with WithProfile.
+type Profile string
+
+const (
+	// ProfileHighThroughput favors the speed of pulls and pushes on hosts
+	// with ample memory and bandwidth.  Layers are downloaded in 8 parallel
+	// 8 MiB ranges, up to 16 at once shared fairly between images, and are
+	// decompressed in a pipeline ahead of unpacking.  Blobs of up to 1 MiB skip the
+	// download queue.  Upload parts adapt up to the largest size ECR
+	// accepts, and resolved tags are cached for 30 seconds.
+	ProfileHighThroughput Profile = "high-throughput"
+	// ProfileLowMemory keeps the memory buffered by transfers small.  Layers
+	// are downloaded as a single stream, at most 2 at once, and are
+	// decompressed in step with unpacking.  Layers are uploaded in the part
+	// size requested by ECR.
+	ProfileLowMemory Profile = "low-memory"
+	// ProfileConstrainedNetwork suits slow or unreliable connections.  Layers
+	// are downloaded as a single stream, at most 2 at once shared fairly
+	// between images, and blobs of up to 256 KiB skip the download queue.
+	// Downloads receiving no data for a minute are restarted where they
+	// stopped, and failed downloads are retried after 1 second, doubling with
+	// each attempt.  Upload parts adapt to the measured throughput.  Resolved
+	// tags are cached for a minute and served for 10 minutes more while they
+	// are refreshed, and missing tags are remembered for 10 seconds.
+	ProfileConstrainedNetwork Profile = "constrained-network"
+)
+
+// maximumLayerPartSize is the largest part ECR accepts by default when
+// uploading a layer.
+const maximumLayerPartSize = 10 << 20
+
+// profileCacheSize is the number of tags cached by the profiles which cache
+// resolved tags.
+const profileCacheSize = 1024
+
+// profileOptions returns the ResolverOptions making up profile.
+func profileOptions(profile Profile) ([]ResolverOption, error) {
+	switch profile {
+	case ProfileHighThroughput:
+		return []ResolverOption{
+			WithLayerDownloadParallelism(8),
+			WithLayerDownloadChunkSize(8 << 20),
+			WithLayerDownloadLimit(16, SchedulingFairShare),
+			WithPipelinedDecompression(16),
+			WithSmallBlobThreshold(1 << 20),
+			WithAdaptivePartSize(MinimumLayerPartSize, maximumLayerPartSize),
+			WithResolveCache(NewMemoryResolveCache(profileCacheSize), 30*time.Second),
+		}, nil
+	case ProfileLowMemory:
+		return []ResolverOption{
+			WithLayerDownloadParallelism(0),
+			WithLayerDownloadLimit(2, SchedulingGreedy),
+			WithPipelinedDecompression(0),
+		}, nil
+	case ProfileConstrainedNetwork:
+		return []ResolverOption{
+			WithLayerDownloadParallelism(0),
+			WithLayerDownloadLimit(2, SchedulingFairShare),
+			WithSmallBlobThreshold(256 << 10),
+			WithLayerStallTimeout(time.Minute),
+			WithBackoff(ExponentialBackoff(time.Second)),
+			WithAdaptivePartSize(MinimumLayerPartSize, maximumLayerPartSize),
+			WithResolveCache(NewMemoryResolveCache(profileCacheSize), time.Minute),
+			WithResolveCacheStaleness(10 * time.Minute),
+			WithNotFoundCache(10 * time.Second),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown resolver profile %q", profile)
+}
+
+// WithProfile is a ResolverOption to apply the settings of profile, such as
+// ProfileHighThroughput, rather than tuning each of them.  Options given
+// after WithProfile override the profile's settings, so a profile may be
+// adjusted for a particular workload.
+func WithProfile(profile Profile) ResolverOption {
+	return func(options *ResolverOptions) error {
+		opts, err := profileOptions(profile)
+		if err != nil {
+			return err
+		}
+		for _, opt := range opts {
+			if err := opt(options); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithProfile(t *testing.T) {
+	for _, profile := range []Profile{ProfileHighThroughput, ProfileLowMemory, ProfileConstrainedNetwork} {
+		t.Run(string(profile), func(t *testing.T) {
+			_, err := NewResolver(WithSession(unit.Session), WithProfile(profile))
+			assert.NoError(t, err)
+		})
+	}
+
+	options := &ResolverOptions{}
+	require.NoError(t, WithProfile(ProfileHighThroughput)(options))
+	assert.Equal(t, 8, options.LayerDownloadParallelism)
+	assert.Equal(t, 16, options.LayerDownloadLimit)
+	assert.Equal(t, SchedulingFairShare, options.LayerDownloadPolicy)
+	assert.NotNil(t, options.ResolveCache)
+	assert.Equal(t, int64(maximumLayerPartSize), options.MaxLayerPartSize)
+
+	options = &ResolverOptions{}
+	require.NoError(t, WithProfile(ProfileConstrainedNetwork)(options))
+	assert.Equal(t, time.Minute, options.LayerStallTimeout)
+	assert.NotNil(t, options.Backoff)
+	assert.Equal(t, 10*time.Second, options.NotFoundTTL)
+}
+
+func TestWithProfileOverride(t *testing.T) {
+	options := &ResolverOptions{}
+	for _, opt := range []ResolverOption{
+		WithProfile(ProfileLowMemory),
+		WithLayerDownloadLimit(4, SchedulingFairShare),
+	} {
+		require.NoError(t, opt(options))
+	}
+	assert.Equal(t, 4, options.LayerDownloadLimit)
+	assert.Equal(t, SchedulingFairShare, options.LayerDownloadPolicy)
+}
+
+func TestWithProfileUnknown(t *testing.T) {
+	_, err := NewResolver(WithSession(unit.Session), WithProfile("fastest"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ProgressDirection is the direction of a transfer reported by Progress.
+type ProgressDirection string
+
+const (
+	// ProgressPull is the direction of layers and configs fetched.
+	ProgressPull ProgressDirection = "pull"
+	// ProgressPush is the direction of layers uploaded.
+	ProgressPush ProgressDirection = "push"
+)
+
+// ProgressState is the state of a transfer reported by Progress.
+type ProgressState string
+
+const (
+	// ProgressStarted is reported once a transfer has started.
+	ProgressStarted ProgressState = "started"
+	// ProgressTransferring is reported as a transfer progresses.
+	ProgressTransferring ProgressState = "transferring"
+	// ProgressCompleted is reported once all of the content is transferred.
+	ProgressCompleted ProgressState = "completed"
+	// ProgressFailed is reported if a transfer fails.
+	ProgressFailed ProgressState = "failed"
+)
+
+// progressInterval is the number of bytes transferred between Progress events
+// reporting ProgressTransferring, so that handlers are not called for every
+// read.
+const progressInterval = 1 << 20
+
+// errProgressIncomplete is reported by Progress for blobs closed before all
+// of their content was transferred.
+var errProgressIncomplete = errors.New("closed before all content was transferred")
+
+// Progress is delivered as the layers and configs of an image are fetched, and
+// as layers are pushed.  Its fields hold only strings and integers and are
+// named for JSON, so services embedding the resolver may marshal it, or copy
+// it into a message of their own, to stream progress to remote clients.
+type Progress struct {
+	// Image is the reference of the image transferred.
+	Image string `json:"image"`
+	// Layer is the digest of the layer or config transferred.
+	Layer     digest.Digest     `json:"layer"`
+	MediaType string            `json:"mediaType,omitempty"`
+	Direction ProgressDirection `json:"direction"`
+	// Offset is the number of bytes transferred.
+	Offset int64 `json:"offset"`
+	// Total is the size of the layer or config in bytes.
+	Total int64         `json:"total"`
+	State ProgressState `json:"state"`
+	// Error describes the failure of a transfer reported as ProgressFailed.
+	Error string `json:"error,omitempty"`
+}
+
+func (*Progress) isEvent() {}
+
+// progressReporter emits the Progress events of the transfer of a blob.
+type progressReporter struct {
+	ctx      context.Context
+	events   EventHandler
+	progress Progress
+
+	mu       sync.Mutex
+	reported int64
+	done     bool
+}
+
+func newProgressReporter(ctx context.Context, events EventHandler, image string, desc ocispec.Descriptor, direction ProgressDirection) *progressReporter {
+	r := &progressReporter{
+		ctx:    ctx,
+		events: events,
+		progress: Progress{
+			Image:     image,
+			Layer:     desc.Digest,
+			MediaType: desc.MediaType,
+			Direction: direction,
+			Total:     desc.Size,
+		},
+	}
+	r.emit(ProgressStarted, nil)
+	return r
+}
+
+// add records n more bytes transferred, reporting ProgressTransferring once
+// progressInterval bytes have been transferred since it was last reported.
+// Reporters may be nil, in which case nothing is reported.
+func (r *progressReporter) add(n int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.progress.Offset += n
+	report := !r.done && r.progress.Offset-r.reported >= progressInterval
+	if report {
+		r.reported = r.progress.Offset
+	}
+	r.mu.Unlock()
+	if report {
+		r.emit(ProgressTransferring, nil)
+	}
+}
+
+// finish reports the transfer completed, or failed with err.  Only the first
+// call reports.
+func (r *progressReporter) finish(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	done := r.done
+	r.done = true
+	r.mu.Unlock()
+	if done {
+		return
+	}
+	if err != nil {
+		r.emit(ProgressFailed, err)
+		return
+	}
+	r.emit(ProgressCompleted, nil)
+}
+
+// close finishes the report, if not already finished, according to whether
+// the whole of the blob was transferred.
+func (r *progressReporter) close() {
+	r.mu.Lock()
+	offset := r.progress.Offset
+	r.mu.Unlock()
+	if offset < r.progress.Total {
+		r.finish(errProgressIncomplete)
+		return
+	}
+	r.finish(nil)
+}
+
+func (r *progressReporter) emit(state ProgressState, err error) {
+	r.mu.Lock()
+	progress := r.progress
+	r.mu.Unlock()
+	progress.State = state
+	if err != nil {
+		progress.Error = err.Error()
+	}
+	r.events.emit(r.ctx, &progress)
+}
+
+// progressReader reports the progress of reading a fetched blob.
+type progressReader struct {
+	io.ReadCloser
+	reporter *progressReporter
+}
+
+// withProgress returns rc wrapped to report the progress of fetching desc.
+func (f *ecrFetcher) withProgress(ctx context.Context, desc ocispec.Descriptor, rc io.ReadCloser) io.ReadCloser {
+	return &progressReader{
+		ReadCloser: rc,
+		reporter:   newProgressReporter(ctx, f.events, f.ecrSpec.Canonical(), desc, ProgressPull),
+	}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	p.reporter.add(int64(n))
+	p.observe(err)
+	return n, err
+}
+
+// WriteTo preserves the WriteTo method of the wrapped ReadCloser, if any.
+func (p *progressReader) WriteTo(w io.Writer) (int64, error) {
+	n, err := copyPooled(progressWriter{Writer: w, reporter: p.reporter}, p.ReadCloser)
+	if err == nil {
+		err = io.EOF
+	}
+	p.observe(err)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Close finishes the report if the blob was not read to its end, as when it
+// is read through an io.LimitReader, reporting the transfer failed unless all
+// of its content was read.
+func (p *progressReader) Close() error {
+	p.reporter.close()
+	return p.ReadCloser.Close()
+}
+
+// observe finishes the report once the blob has been read or failed.
+func (p *progressReader) observe(err error) {
+	switch {
+	case err == io.EOF:
+		p.reporter.finish(nil)
+	case err != nil:
+		p.reporter.finish(err)
+	}
+}
+
+// progressWriter reports the bytes written through it.
+type progressWriter struct {
+	io.Writer
+	reporter *progressReporter
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.reporter.add(int64(n))
+	return n, err
+}
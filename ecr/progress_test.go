@@ -0,0 +1,158 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// progressRecorder is an EventHandler recording Progress events.
+type progressRecorder struct {
+	mu     sync.Mutex
+	events []Progress
+}
+
+func (r *progressRecorder) handle(_ context.Context, event Event) {
+	if progress, ok := event.(*Progress); ok {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.events = append(r.events, *progress)
+	}
+}
+
+func (r *progressRecorder) states() []ProgressState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var states []ProgressState
+	for _, event := range r.events {
+		states = append(states, event.State)
+	}
+	return states
+}
+
+func TestProgressPull(t *testing.T) {
+	layerData := bytes.Repeat([]byte("x"), 2*progressInterval+1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(layerData)
+	}))
+	defer server.Close()
+	client := &fakeECRClient{
+		GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(server.URL)}, nil
+		},
+	}
+	recorder := &progressRecorder{}
+	resolver, err := NewResolver(WithEventHandler(recorder.handle))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(layerData),
+		Size:      int64(len(layerData)),
+	}
+
+	fetcher, err := resolver.Fetcher(context.Background(), ref)
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+
+	states := recorder.states()
+	require.GreaterOrEqual(t, len(states), 3)
+	assert.Equal(t, ProgressStarted, states[0])
+	for i, event := range recorder.events[1 : len(states)-1] {
+		assert.Equal(t, ProgressTransferring, event.State)
+		assert.Greater(t, event.Offset, recorder.events[i].Offset, "offsets should increase")
+	}
+	last := recorder.events[len(recorder.events)-1]
+	assert.Equal(t, Progress{
+		Image:     ref,
+		Layer:     desc.Digest,
+		MediaType: desc.MediaType,
+		Direction: ProgressPull,
+		Offset:    desc.Size,
+		Total:     desc.Size,
+		State:     ProgressCompleted,
+	}, last)
+
+	encoded, err := json.Marshal(last)
+	require.NoError(t, err)
+	var decoded Progress
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+	assert.Equal(t, last, decoded, "progress should round-trip through JSON")
+
+	// Blobs closed before being read entirely are reported as failed.
+	recorder.events = nil
+	rc, err = fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, []ProgressState{ProgressStarted, ProgressFailed}, recorder.states())
+	assert.NotEmpty(t, recorder.events[1].Error)
+}
+
+func TestProgressPush(t *testing.T) {
+	layerData := "layer"
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{UploadId: aws.String("upload"), PartSize: aws.Int64(1)}, nil
+		},
+		UploadLayerPartFn: func(*ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+			return nil, nil
+		},
+		CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+			return &ecr.CompleteLayerUploadOutput{LayerDigest: aws.String(digest.FromString(layerData).String())}, nil
+		},
+	}
+	recorder := &progressRecorder{}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString(layerData),
+		Size:      int64(len(layerData)),
+	}
+	tracker := docker.NewInMemoryTracker()
+	tracker.SetStatus("refKey", docker.Status{})
+
+	lw, err := newLayerWriter(&ecrBase{client: client, events: recorder.handle}, tracker, "refKey", desc, layerUploadOptions{})
+	require.NoError(t, err)
+	_, err = lw.Write([]byte(layerData))
+	require.NoError(t, err)
+	require.NoError(t, lw.Commit(context.Background(), desc.Size, desc.Digest))
+
+	assert.Equal(t, []ProgressState{ProgressStarted, ProgressCompleted}, recorder.states())
+	last := recorder.events[len(recorder.events)-1]
+	assert.Equal(t, ProgressPush, last.Direction)
+	assert.Equal(t, desc.Size, last.Offset)
+	assert.Equal(t, desc.Size, last.Total)
+}
@@ -0,0 +1,276 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecrpublic"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PublicRegistryHost is the host of the Amazon ECR Public registry.
+const PublicRegistryHost = "public.ecr.aws"
+
+// publicRefPrefix prefixes references to ECR Public accepted in the style of
+// the "ecr.aws/" references of private repositories.
+const publicRefPrefix = "ecr-public.aws/"
+
+const (
+	// publicAuthRegion is the only region serving ECR Public authorization
+	// tokens.
+	publicAuthRegion = "us-east-1"
+	// publicTokenRefresh is how long before it expires a cached token is
+	// replaced.
+	publicTokenRefresh = 5 * time.Minute
+	// publicAnonymousRecheck is how long requests are made anonymously after
+	// no credentials were found before looking for credentials again.
+	publicAnonymousRecheck = 10 * time.Minute
+)
+
+// PublicRateLimitError is returned when Amazon ECR Public rejects a request
+// for exceeding its rate limits.  Anonymous requests are allowed a lower
+// rate than authenticated requests, so configuring AWS credentials raises the
+// limit.
+type PublicRateLimitError struct {
+	// URL of the rejected request, whose query is redacted: the request
+	// may have been redirected to a presigned URL.
+	URL string
+	// Anonymous reports whether the request was made without credentials.
+	Anonymous bool
+	// RetryAfter is the delay requested by the registry before retrying, or
+	// zero if none was given.
+	RetryAfter time.Duration
+}
+
+func (e *PublicRateLimitError) Error() string {
+	access := "authenticated"
+	if e.Anonymous {
+		access = "anonymous"
+	}
+	return fmt.Sprintf("ecr: %s request to %s exceeded Amazon ECR Public rate limits", access, e.URL)
+}
+
+// NewPublicResolver returns a resolver for images in Amazon ECR Public,
+// referenced as by docker, such as "public.ecr.aws/docker/library/alpine:3",
+// or with the "ecr-public.aws/" prefix, such as
+// "ecr-public.aws/docker/library/alpine:3".
+// ECR Public has no API for pulling images, so only the authorization token
+// is requested with the AWS SDK; images are resolved and fetched through the
+// registry API by containerd's docker resolver, which does not retry as the
+// SDK does.  Requests are authorized with an ECR Public authorization token
+// when AWS credentials are available, and are anonymous otherwise.  Tokens are cached
+// and refreshed before they expire.  Requests rejected by rate limits fail
+// with a *PublicRateLimitError.
+//
+// Of the resolver options, only WithSession, WithTracker, WithHTTPClient,
+// WithUserAgent, WithHeaders, WithHeaderFunc, WithOffline, and WithClock
+// apply.
+func NewPublicResolver(options ...ResolverOption) (remotes.Resolver, error) {
+	resolverOptions := &ResolverOptions{}
+	for _, option := range options {
+		if err := option(resolverOptions); err != nil {
+			return nil, err
+		}
+	}
+	if resolverOptions.Session == nil {
+		awsSession, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		resolverOptions.Session = awsSession
+	}
+	clock := resolverOptions.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	httpClient := resolverOptions.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	if resolverOptions.UserAgent != "" {
+		httpClient = withUserAgent(httpClient, resolverOptions.UserAgent)
+	}
+	if len(resolverOptions.Headers) > 0 || resolverOptions.HeaderFunc != nil {
+		httpClient = withHeaders(httpClient, resolverOptions.Headers, resolverOptions.HeaderFunc)
+	}
+	if resolverOptions.Offline {
+		httpClient = withOffline(httpClient)
+	}
+
+	client := ecrpublic.New(resolverOptions.Session, &aws.Config{
+		Region:     aws.String(publicAuthRegion),
+		HTTPClient: httpClient,
+	})
+	if resolverOptions.Offline {
+		addOfflineHandler(&client.Handlers)
+	}
+	credentials := &publicCredentials{
+		client: client,
+		now:    clock.Now,
+	}
+	registryClient := *httpClient
+	registryClient.Transport = &publicRateLimitTransport{
+		base:        httpClient.Transport,
+		credentials: credentials,
+	}
+	authorizer := docker.NewDockerAuthorizer(
+		docker.WithAuthClient(&registryClient),
+		docker.WithAuthCreds(credentials.get))
+	return &publicResolver{docker.NewResolver(docker.ResolverOptions{
+		Hosts: docker.ConfigureDefaultRegistries(
+			docker.WithAuthorizer(authorizer),
+			docker.WithClient(&registryClient)),
+		Tracker: resolverOptions.Tracker,
+	})}, nil
+}
+
+// publicResolver resolves references with the "ecr-public.aws/" prefix as
+// references to PublicRegistryHost.
+type publicResolver struct {
+	remotes.Resolver
+}
+
+func (r *publicResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	return r.Resolver.Resolve(ctx, publicRef(ref))
+}
+
+func (r *publicResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	return r.Resolver.Fetcher(ctx, publicRef(ref))
+}
+
+func (r *publicResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	return r.Resolver.Pusher(ctx, publicRef(ref))
+}
+
+// publicRef returns ref with the "ecr-public.aws/" prefix replaced by
+// PublicRegistryHost.  Other references are returned unchanged.
+func publicRef(ref string) string {
+	if strings.HasPrefix(ref, publicRefPrefix) {
+		return PublicRegistryHost + "/" + ref[len(publicRefPrefix):]
+	}
+	return ref
+}
+
+type ecrPublicAPI interface {
+	GetAuthorizationTokenWithContext(aws.Context, *ecrpublic.GetAuthorizationTokenInput, ...request.Option) (*ecrpublic.GetAuthorizationTokenOutput, error)
+}
+
+// publicCredentials provides the credentials used to obtain bearer tokens from
+// ECR Public.  The credentials are taken from an authorization token, which is
+// cached until shortly before it expires.  When no AWS credentials are
+// configured, empty credentials are provided so that requests are anonymous.
+type publicCredentials struct {
+	client ecrPublicAPI
+	now    func() time.Time
+
+	lock      sync.Mutex
+	username  string
+	password  string
+	anonymous bool
+	// refresh is the time after which the credentials are obtained again.
+	refresh time.Time
+}
+
+// get returns the credentials for host, which are empty for hosts other than
+// ECR Public.
+func (c *publicCredentials) get(host string) (string, string, error) {
+	if host != PublicRegistryHost {
+		return "", "", nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	if now.Before(c.refresh) {
+		return c.username, c.password, nil
+	}
+
+	ctx := aws.BackgroundContext()
+	output, err := c.client.GetAuthorizationTokenWithContext(ctx, &ecrpublic.GetAuthorizationTokenInput{})
+	if isAWSErrorCode(err, "NoCredentialProviders") {
+		log.G(ctx).Debug("ecr.public: no credentials, requesting anonymously")
+		c.username, c.password, c.anonymous = "", "", true
+		c.refresh = now.Add(publicAnonymousRecheck)
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	data := output.AuthorizationData
+	if data == nil {
+		return "", "", fmt.Errorf("ecr.public: no authorization data")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(aws.StringValue(data.AuthorizationToken))
+	if err != nil {
+		return "", "", fmt.Errorf("ecr.public: invalid authorization token: %w", err)
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("ecr.public: invalid authorization token")
+	}
+	c.username, c.password, c.anonymous = parts[0], parts[1], false
+	c.refresh = aws.TimeValue(data.ExpiresAt).Add(-publicTokenRefresh)
+	log.G(ctx).WithField("expiresAt", data.ExpiresAt).Debug("ecr.public: obtained authorization token")
+	return c.username, c.password, nil
+}
+
+// isAnonymous reports whether requests are being made anonymously.
+func (c *publicCredentials) isAnonymous() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.anonymous
+}
+
+// publicRateLimitTransport fails requests rejected by rate limits with a
+// *PublicRateLimitError, rather than returning the response to be retried
+// immediately.
+type publicRateLimitTransport struct {
+	base        http.RoundTripper
+	credentials *publicCredentials
+}
+
+func (t *publicRateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+	resp.Body.Close()
+	rateErr := &PublicRateLimitError{
+		URL:       redactURL(req.URL.String()),
+		Anonymous: t.credentials.isAnonymous(),
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		rateErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return nil, rateErr
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/ecrpublic"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeECRPublicClient struct {
+	calls int
+	err   error
+	now   time.Time
+}
+
+func (c *fakeECRPublicClient) GetAuthorizationTokenWithContext(aws.Context, *ecrpublic.GetAuthorizationTokenInput, ...request.Option) (*ecrpublic.GetAuthorizationTokenOutput, error) {
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &ecrpublic.GetAuthorizationTokenOutput{AuthorizationData: &ecrpublic.AuthorizationData{
+		AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("AWS:password"))),
+		ExpiresAt:          aws.Time(c.now.Add(12 * time.Hour)),
+	}}, nil
+}
+
+func TestPublicCredentialsCached(t *testing.T) {
+	now := time.Now()
+	client := &fakeECRPublicClient{now: now}
+	credentials := &publicCredentials{client: client, now: func() time.Time { return now }}
+
+	for i := 0; i < 2; i++ {
+		username, password, err := credentials.get(PublicRegistryHost)
+		require.NoError(t, err)
+		assert.Equal(t, "AWS", username)
+		assert.Equal(t, "password", password)
+	}
+	assert.Equal(t, 1, client.calls, "token should be cached")
+	assert.False(t, credentials.isAnonymous())
+
+	// The token is replaced shortly before it expires.
+	now = now.Add(12*time.Hour - time.Minute)
+	_, _, err := credentials.get(PublicRegistryHost)
+	require.NoError(t, err)
+	assert.Equal(t, 2, client.calls, "token should be refreshed")
+
+	username, password, err := credentials.get("registry-1.docker.io")
+	require.NoError(t, err)
+	assert.Empty(t, username+password, "other registries should not be sent the token")
+}
+
+func TestPublicCredentialsAnonymous(t *testing.T) {
+	now := time.Now()
+	client := &fakeECRPublicClient{err: awserr.New("NoCredentialProviders", "no valid providers in chain", nil)}
+	credentials := &publicCredentials{client: client, now: func() time.Time { return now }}
+
+	username, password, err := credentials.get(PublicRegistryHost)
+	require.NoError(t, err)
+	assert.Empty(t, username+password)
+	assert.True(t, credentials.isAnonymous())
+	_, _, err = credentials.get(PublicRegistryHost)
+	require.NoError(t, err)
+	assert.Equal(t, 1, client.calls, "anonymous access should be remembered")
+
+	// Credentials configured later are used.
+	client.err = nil
+	client.now = now
+	now = now.Add(publicAnonymousRecheck)
+	username, _, err = credentials.get(PublicRegistryHost)
+	require.NoError(t, err)
+	assert.Equal(t, "AWS", username)
+	assert.False(t, credentials.isAnonymous())
+
+	client.err = awserr.New("AccessDeniedException", "", nil)
+	now = now.Add(12 * time.Hour)
+	_, _, err = credentials.get(PublicRegistryHost)
+	assert.Error(t, err, "failures other than missing credentials should be returned")
+}
+
+func TestPublicRateLimit(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer registry.Close()
+	credentials := &publicCredentials{anonymous: true}
+	client := &http.Client{Transport: &publicRateLimitTransport{credentials: credentials}}
+
+	_, err := client.Get(registry.URL + "/v2/?" + presignedSecret)
+	var rateErr *PublicRateLimitError
+	require.True(t, errors.As(err, &rateErr), "rate limited request should fail with a PublicRateLimitError: %v", err)
+	assert.Equal(t, registry.URL+"/v2/?REDACTED", rateErr.URL)
+	assert.NotContains(t, rateErr.Error(), presignedSecret)
+	assert.True(t, rateErr.Anonymous)
+	assert.Equal(t, 30*time.Second, rateErr.RetryAfter)
+	assert.Equal(t, ErrorCategoryThrottled, Categorize(err))
+}
+
+func TestNewPublicResolver(t *testing.T) {
+	resolver, err := NewPublicResolver(WithSession(unit.Session), WithUserAgent("test", "1.0"))
+	require.NoError(t, err)
+	assert.NotNil(t, resolver)
+}
+
+func TestPublicResolverRefPrefix(t *testing.T) {
+	registry := newFakeRegistry()
+	manifest := registry.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	registry.tag("public.ecr.aws/docker/library/alpine:3", manifest)
+	resolver := &publicResolver{registry}
+
+	for _, ref := range []string{
+		"ecr-public.aws/docker/library/alpine:3",
+		"public.ecr.aws/docker/library/alpine:3",
+	} {
+		name, desc, err := resolver.Resolve(context.Background(), ref)
+		require.NoError(t, err, ref)
+		assert.Equal(t, "public.ecr.aws/docker/library/alpine:3", name)
+		assert.Equal(t, manifest.Digest, desc.Digest)
+	}
+}
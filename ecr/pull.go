@@ -0,0 +1,342 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// PullImage is an image or index fetched by PullAll.
+type PullImage struct {
+	// Source resolves and fetches the image.
+	Source remotes.Resolver
+	// Ref is the reference of the image in Source.
+	Ref string
+}
+
+// PullAll fetches the content of a set of images into ingester, such as a
+// containerd content store, for jobs warming nodes with many images ahead of
+// their use.  The manifests of every image are fetched first, so that layers
+// and configs shared by several images are found before any is downloaded;
+// each is then downloaded once and referenced by all of the images sharing
+// it.  Content already present in ingester is not downloaded.
+//
+// Options are applied to each image as with Copy, except that referrers are
+// not fetched.  WithCopyConcurrency bounds the number of blobs, and then of
+// image manifests, ingested at once.  The descriptors of the fetched root manifests or indexes are
+// returned in the order of images, ready to be recorded as images.  Use
+// WithPullVerification to confirm that their content is complete first.
+// Content which cannot be fetched does not stop the rest from being fetched;
+// the failures are returned together in an *AggregateError.  Gzip layers
+// fetched with a resolver created with WithPipelinedDecompression are
+// decompressed as they are ingested, as described there.
+func PullAll(ctx context.Context, ingester content.Ingester, images []PullImage, opts ...CopyOption) ([]ocispec.Descriptor, error) {
+	options, err := newCopyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	var manager content.Manager
+	if options.VerifyPull {
+		var ok bool
+		if manager, ok = ingester.(content.Manager); !ok {
+			return nil, fmt.Errorf("pull verification requires an ingester managing its content: %w", errdefs.ErrNotImplemented)
+		}
+	}
+
+	var (
+		nodes    []copyNode
+		fetchers = map[digest.Digest]remotes.Fetcher{}
+		roots    = make([]ocispec.Descriptor, len(images))
+		// seen is shared by the images' copiers so that content planned
+		// for an earlier image, including its manifests, is not fetched
+		// or planned again.
+		seen = map[digest.Digest]ocispec.Descriptor{}
+	)
+	for i, image := range images {
+		ctx := log.WithLogger(ctx, log.G(ctx).WithField("ref", image.Ref))
+		name, desc, err := image.Source.Resolve(ctx, image.Ref)
+		if err != nil {
+			return nil, err
+		}
+		fetcher, err := image.Source.Fetcher(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		c := newCopier(options, fetcher)
+		c.seen = seen
+		roots[i], err = c.plan(ctx, desc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pull %s: %w", image.Ref, err)
+		}
+		// Children precede their parents in each image's nodes, and content
+		// shared with an earlier image is planned with it, so parents are
+		// always ingested after their children.
+		for _, node := range c.nodes {
+			fetchers[node.desc.Digest] = fetcher
+		}
+		nodes = append(nodes, c.nodes...)
+	}
+	log.G(ctx).
+		WithField("images", len(images)).
+		WithField("content", len(nodes)).
+		Debug("ecr.pull: planned images")
+
+	if err := ingestAll(ctx, ingester, fetchers, nodes, options); err != nil {
+		return nil, err
+	}
+	if manager != nil {
+		if err := verifyIngested(ctx, manager, nodes); err != nil {
+			return nil, err
+		}
+	}
+	return roots, nil
+}
+
+// ingestAll ingests nodes, which list children ahead of their parents, with
+// the fetchers of their digests.  Up to the configured concurrency of blobs
+// are ingested at once, then of image manifests, and then indexes one at a
+// time in order, so that no content is ingested before its children.  A
+// failed ingest does not stop the others, so that every failure is returned
+// in an *AggregateError.
+func ingestAll(ctx context.Context, ingester content.Ingester, fetchers map[digest.Digest]remotes.Fetcher, nodes []copyNode, options CopyOptions) error {
+	concurrency := options.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var failed aggregateErrors
+	blobs, manifests, indexes := splitNodes(nodes)
+	for _, stage := range []struct {
+		nodes       []copyNode
+		concurrency int
+	}{
+		{nodes: blobs, concurrency: concurrency},
+		{nodes: manifests, concurrency: concurrency},
+		{nodes: indexes, concurrency: 1},
+	} {
+		limiter := semaphore.NewWeighted(int64(stage.concurrency))
+		var group errgroup.Group
+		for _, node := range stage.nodes {
+			node := node
+			if ctx.Err() != nil {
+				break
+			}
+			if err := limiter.Acquire(ctx, 1); err != nil {
+				break
+			}
+			group.Go(func() error {
+				defer limiter.Release(1)
+				if err := ingest(ctx, ingester, fetchers[node.desc.Digest], node, options.Transfers); err != nil {
+					failed.add("pull", node.desc.Digest, err)
+				}
+				return nil
+			})
+		}
+		group.Wait()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return failed.err()
+}
+
+// IncompletePullError is returned by PullAll with WithPullVerification when
+// content of the pulled images is not in the ingester once ingested.
+type IncompletePullError struct {
+	// Missing lists the digests of content not found.
+	Missing []digest.Digest
+	// Mismatched lists the digests of content whose size differs from
+	// its descriptor.
+	Mismatched []digest.Digest
+}
+
+func (e *IncompletePullError) Error() string {
+	var problems []string
+	for _, dgst := range e.Missing {
+		problems = append(problems, dgst.String()+" missing")
+	}
+	for _, dgst := range e.Mismatched {
+		problems = append(problems, dgst.String()+" of the wrong size")
+	}
+	return fmt.Sprintf("ecr: pulled content incomplete: %s", strings.Join(problems, ", "))
+}
+
+// Unwrap returns errdefs.ErrFailedPrecondition so that incomplete pulls are
+// categorized as a verification failure.
+func (e *IncompletePullError) Unwrap() error {
+	return errdefs.ErrFailedPrecondition
+}
+
+// verifyIngested checks that the content of every node is in manager with the
+// size of its descriptor.
+func verifyIngested(ctx context.Context, manager content.Manager, nodes []copyNode) error {
+	var incomplete IncompletePullError
+	for _, node := range nodes {
+		stored, err := manager.Info(ctx, node.desc.Digest)
+		switch {
+		case errdefs.IsNotFound(err):
+			incomplete.Missing = append(incomplete.Missing, node.desc.Digest)
+		case err != nil:
+			return err
+		case stored.Size != node.desc.Size:
+			incomplete.Mismatched = append(incomplete.Mismatched, node.desc.Digest)
+		}
+	}
+	if len(incomplete.Missing) > 0 || len(incomplete.Mismatched) > 0 {
+		return &incomplete
+	}
+	log.G(ctx).
+		WithField("content", len(nodes)).
+		Debug("ecr.pull: verified ingested content")
+	return nil
+}
+
+// ingest writes node to ingester, fetching it with fetcher unless the content
+// is held by node or is already present.
+func ingest(ctx context.Context, ingester content.Ingester, fetcher remotes.Fetcher, node copyNode, transfers *TransferReport) (err error) {
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("desc", node.desc))
+	ctx, t := transfers.start(ctx, node.desc)
+	defer func() { t.done(err) }()
+	cw, err := content.OpenWriter(ctx, ingester,
+		content.WithRef(remotes.MakeRefKey(ctx, node.desc)),
+		content.WithDescriptor(node.desc))
+	if err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			log.G(ctx).Debug("ecr.pull: content exists")
+			t.existing()
+			return nil
+		}
+		return err
+	}
+	defer cw.Close()
+	cw = t.writer(cw)
+
+	if node.content != nil {
+		log.G(ctx).Debug("ecr.pull: ingesting manifest")
+		return content.Copy(ctx, cw, bytes.NewReader(node.content), node.desc.Size, node.desc.Digest)
+	}
+	log.G(ctx).Debug("ecr.pull: ingesting blob")
+	rc, err := fetcher.Fetch(ctx, node.desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if d, ok := fetcher.(layerDecompressor); ok && d.decompresses(node.desc) {
+		return ingestDecompressed(ctx, ingester, cw, d, node.desc, rc)
+	}
+	return content.Copy(ctx, cw, rc, node.desc.Size, node.desc.Digest)
+}
+
+const (
+	// labelUncompressed labels a layer with the digest of its uncompressed
+	// content, its diff ID, as containerd does when unpacking it.
+	labelUncompressed = "containerd.io/uncompressed"
+	// labelUncompressedRef references the uncompressed content of a layer,
+	// so that it is not garbage collected while the layer is kept.
+	labelUncompressedRef = "containerd.io/gc.ref.content.uncompressed"
+)
+
+// layerDecompressor is implemented by fetchers that decompress the layers they
+// pull, as the resolver's do with WithPipelinedDecompression.
+type layerDecompressor interface {
+	decompresses(desc ocispec.Descriptor) bool
+	decompressLayer(ctx context.Context, compressed io.Reader) (io.ReadCloser, error)
+}
+
+// ingestDecompressed writes the layer desc read from rc to cw, decompressing
+// it with d as it is written so that its uncompressed content is ingested
+// alongside it.  The layer is labelled with the digest of its uncompressed
+// content.  A layer which cannot be decompressed is still ingested, without
+// the label.
+func ingestDecompressed(ctx context.Context, ingester content.Ingester, cw content.Writer, d layerDecompressor, desc ocispec.Descriptor, rc io.Reader) error {
+	// The layer is decompressed from its start, so an interrupted ingest
+	// is not resumed.
+	if status, err := cw.Status(); err != nil {
+		return err
+	} else if status.Offset > 0 {
+		if err := cw.Truncate(0); err != nil {
+			return err
+		}
+	}
+	pr, pw := io.Pipe()
+	uncompressed := make(chan digest.Digest, 1)
+	go func() {
+		dgst, err := ingestUncompressed(ctx, ingester, d, desc, pr)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("ecr.pull: failed to ingest uncompressed layer")
+		}
+		// Whatever remains of the layer is drained, so that it is still
+		// written to cw.
+		io.Copy(ioutil.Discard, pr)
+		uncompressed <- dgst
+	}()
+	_, err := copyPooled(io.MultiWriter(cw, pw), rc)
+	pw.CloseWithError(err)
+	dgst := <-uncompressed
+	if err != nil {
+		return err
+	}
+	var opts []content.Opt
+	if dgst != "" {
+		opts = append(opts, content.WithLabels(map[string]string{
+			labelUncompressed:    dgst.String(),
+			labelUncompressedRef: dgst.String(),
+		}))
+	}
+	if err := cw.Commit(ctx, desc.Size, desc.Digest, opts...); err != nil && !errdefs.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// ingestUncompressed writes the decompressed content of the layer desc, read
+// from compressed, to ingester and returns its digest.
+func ingestUncompressed(ctx context.Context, ingester content.Ingester, d layerDecompressor, desc ocispec.Descriptor, compressed io.Reader) (digest.Digest, error) {
+	uncompressed, err := d.decompressLayer(ctx, compressed)
+	if err != nil {
+		return "", err
+	}
+	defer uncompressed.Close()
+	cw, err := content.OpenWriter(ctx, ingester, content.WithRef("uncompressed-"+remotes.MakeRefKey(ctx, desc)))
+	if err != nil {
+		return "", err
+	}
+	defer cw.Close()
+	if err := cw.Truncate(0); err != nil {
+		return "", err
+	}
+	if _, err := copyPooled(cw, uncompressed); err != nil {
+		return "", err
+	}
+	dgst := cw.Digest()
+	if err := cw.Commit(ctx, 0, dgst); err != nil && !errdefs.IsAlreadyExists(err) {
+		return "", err
+	}
+	return dgst, nil
+}
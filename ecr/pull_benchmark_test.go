@@ -0,0 +1,304 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+// benchmarkRef is the reference pulled by the pull benchmarks using the fake
+// registry.
+const benchmarkRef = "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+// benchmarkImages are representative image shapes, listing the size of each
+// layer.
+var benchmarkImages = []struct {
+	name   string
+	layers []int
+}{
+	{name: "small-layers", layers: repeatSize(32, 256<<10)},
+	{name: "large-layers", layers: repeatSize(3, 48<<20)},
+	{name: "mixed", layers: append([]int{24 << 20, 8 << 20}, append(repeatSize(4, 1<<20), repeatSize(8, 64<<10)...)...)},
+}
+
+// benchmarkConfigs are the resolver options compared by the pull benchmarks.
+var benchmarkConfigs = []struct {
+	name    string
+	options []ResolverOption
+}{
+	{name: "default"},
+	{name: "parallelism=4", options: []ResolverOption{WithLayerDownloadParallelism(4)}},
+	{name: "limit=3", options: []ResolverOption{WithLayerDownloadLimit(3, SchedulingGreedy)}},
+	{name: "parallelism=4,limit=3", options: []ResolverOption{
+		WithLayerDownloadParallelism(4),
+		WithLayerDownloadLimit(3, SchedulingGreedy),
+	}},
+}
+
+func repeatSize(n, size int) []int {
+	sizes := make([]int, n)
+	for i := range sizes {
+		sizes[i] = size
+	}
+	return sizes
+}
+
+// pullBackend serves an image through a fake ECR client, with its blobs served
+// over HTTP as from the download URLs of Amazon S3.
+type pullBackend struct {
+	server *httptest.Server
+	client *fakeECRClient
+	size   int64
+}
+
+func newPullBackend(layers []int) *pullBackend {
+	blobs := map[digest.Digest][]byte{}
+	put := func(mediaType string, data []byte) ocispec.Descriptor {
+		dgst := digest.FromBytes(data)
+		blobs[dgst] = data
+		return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+	}
+
+	random := rand.New(rand.NewSource(1))
+	backend := &pullBackend{}
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    put(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`)),
+	}
+	for _, size := range layers {
+		layer := make([]byte, size)
+		random.Read(layer)
+		manifest.Layers = append(manifest.Layers, put(ocispec.MediaTypeImageLayerGzip, layer))
+		backend.size += int64(size)
+	}
+	manifestJSON, _ := json.Marshal(manifest)
+	manifestDigest := digest.FromBytes(manifestJSON)
+
+	backend.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := blobs[digest.Digest(strings.TrimPrefix(r.URL.Path, "/"))]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	backend.client = &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(manifestDigest.String())},
+				ImageManifest:          aws.String(string(manifestJSON)),
+				ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+			}}}, nil
+		},
+		GetDownloadUrlForLayerFn: func(_ aws.Context, input *ecr.GetDownloadUrlForLayerInput, _ ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			return &ecr.GetDownloadUrlForLayerOutput{
+				DownloadUrl: aws.String(backend.server.URL + "/" + aws.StringValue(input.LayerDigest)),
+			}, nil
+		},
+	}
+	return backend
+}
+
+// resolver returns a resolver pulling from the backend.
+func (p *pullBackend) resolver(options ...ResolverOption) (remotes.Resolver, error) {
+	options = append([]ResolverOption{
+		WithSession(unit.Session),
+		WithHTTPClient(p.server.Client()),
+	}, options...)
+	resolver, err := NewResolver(options...)
+	if err != nil {
+		return nil, err
+	}
+	resolver.(*ecrResolver).clients["fake"] = p.client
+	return resolver, nil
+}
+
+// pullImage resolves ref and fetches its manifest for the default platform,
+// then its config and layers concurrently, as containerd does when pulling an
+// image.
+func pullImage(ctx context.Context, resolver remotes.Resolver, ref string) error {
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return err
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return err
+	}
+	var manifest ocispec.Manifest
+	for manifest.Config.Digest == "" {
+		data, err := fetchAll(ctx, fetcher, desc)
+		if err != nil {
+			return err
+		}
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			var index ocispec.Index
+			if err := json.Unmarshal(data, &index); err != nil {
+				return err
+			}
+			matcher := platforms.Default()
+			desc = ocispec.Descriptor{}
+			for _, m := range index.Manifests {
+				if m.Platform != nil && matcher.Match(*m.Platform) {
+					desc = m
+					break
+				}
+			}
+			if desc.Digest == "" {
+				return fmt.Errorf("%s: no manifest for %s", ref, platforms.DefaultString())
+			}
+		default:
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return err
+			}
+		}
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	for _, blob := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		blob := blob
+		eg.Go(func() error {
+			rc, err := fetcher.Fetch(ctx, blob)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			n, err := io.Copy(ioutil.Discard, rc)
+			if err == nil && n != blob.Size {
+				err = fmt.Errorf("%s: read %d bytes, expected %d", blob.Digest, n, blob.Size)
+			}
+			return err
+		})
+	}
+	return eg.Wait()
+}
+
+func fetchAll(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) ([]byte, error) {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// reportPullStats reports the resolver's Stats per pull.
+func reportPullStats(b *testing.B, resolver remotes.Resolver) {
+	stats := resolver.(StatsProvider).Stats()
+	if stats.BlobFetches > 0 {
+		b.ReportMetric(float64(stats.BlobDuration)/float64(stats.BlobFetches), "ns/blob")
+	}
+	if stats.Resolves > 0 {
+		b.ReportMetric(float64(stats.ResolveDuration)/float64(stats.Resolves), "ns/resolve")
+	}
+}
+
+func TestPullStats(t *testing.T) {
+	backend := newPullBackend([]int{1 << 20, 64 << 10})
+	defer backend.server.Close()
+	resolver, err := backend.resolver()
+	require.NoError(t, err)
+
+	require.NoError(t, pullImage(context.Background(), resolver, benchmarkRef))
+	stats := resolver.(StatsProvider).Stats()
+	assert.Equal(t, int64(1), stats.Resolves)
+	assert.Equal(t, int64(1), stats.ManifestFetches)
+	assert.Equal(t, int64(3), stats.BlobFetches, "config and layers")
+	assert.Equal(t, backend.size+int64(len(`{"architecture":"amd64","os":"linux"}`)), stats.BlobBytes)
+	assert.True(t, stats.BlobDuration > 0)
+}
+
+// BenchmarkPull measures the end-to-end latency of pulling each of
+// benchmarkImages with each of benchmarkConfigs from a local server.  It
+// compares the resolver's options rather than estimating the performance of
+// Amazon ECR; BenchmarkPullECR measures pulls from a real repository.
+func BenchmarkPull(b *testing.B) {
+	for _, image := range benchmarkImages {
+		backend := newPullBackend(image.layers)
+		for _, config := range benchmarkConfigs {
+			b.Run(image.name+"/"+config.name, func(b *testing.B) {
+				resolver, err := backend.resolver(config.options...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(backend.size)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := pullImage(context.Background(), resolver, benchmarkRef); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+				reportPullStats(b, resolver)
+			})
+		}
+		backend.server.Close()
+	}
+}
+
+// BenchmarkPullECR measures pulls of the image named by the ECR_BENCHMARK_REF
+// environment variable from Amazon ECR, with credentials from the
+// environment, for each of benchmarkConfigs.
+func BenchmarkPullECR(b *testing.B) {
+	ref := os.Getenv("ECR_BENCHMARK_REF")
+	if ref == "" {
+		b.Skip("ECR_BENCHMARK_REF is not set")
+	}
+	for _, config := range benchmarkConfigs {
+		b.Run(config.name, func(b *testing.B) {
+			resolver, err := NewResolver(config.options...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < b.N; i++ {
+				if err := pullImage(context.Background(), resolver, ref); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			stats := resolver.(StatsProvider).Stats()
+			b.SetBytes(stats.BlobBytes / int64(b.N))
+			reportPullStats(b, resolver)
+		})
+	}
+}
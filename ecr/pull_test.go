@@ -0,0 +1,324 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullAll(t *testing.T) {
+	ctx := context.Background()
+	source := newFakeRegistry()
+	index, manifests := putMultiArchImage(source, "multi")
+	source.tag("amd64", manifests[0])
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	roots, err := PullAll(ctx, store, []PullImage{
+		{Source: source, Ref: "multi"},
+		{Source: source, Ref: "amd64"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []ocispec.Descriptor{index, manifests[0]}, roots)
+	for dgst, data := range source.blob {
+		stored, err := content.ReadBlob(ctx, store, ocispec.Descriptor{Digest: dgst})
+		require.NoError(t, err)
+		assert.Equal(t, data, stored)
+		assert.Equal(t, 1, source.fetches[dgst], "%s should be fetched once across images", dgst)
+	}
+
+	// Content already stored is not fetched again.
+	other := newFakeRegistry()
+	manifest := other.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	other.tag("amd64", manifest)
+	_, err = PullAll(ctx, store, []PullImage{{Source: other, Ref: "amd64"}})
+	require.NoError(t, err)
+	assert.Equal(t, map[digest.Digest]int{manifest.Digest: 1}, other.fetches, "only the manifest should be fetched, to plan the pull")
+}
+
+// concurrentSource records the most fetches of the embedded registry's content
+// in progress at once.
+type concurrentSource struct {
+	*fakeRegistry
+	lock    sync.Mutex
+	current int
+	max     int
+}
+
+func (s *concurrentSource) Fetcher(context.Context, string) (remotes.Fetcher, error) {
+	return s, nil
+}
+
+func (s *concurrentSource) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	s.lock.Lock()
+	s.current++
+	if s.current > s.max {
+		s.max = s.current
+	}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		s.current--
+		s.lock.Unlock()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	return s.fakeRegistry.Fetch(ctx, desc)
+}
+
+func TestPullAllConcurrency(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name        string
+		opts        []CopyOption
+		concurrency int
+	}{
+		{name: "default", concurrency: 1},
+		{name: "concurrent", opts: []CopyOption{WithCopyConcurrency(3)}, concurrency: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			source := &concurrentSource{fakeRegistry: newFakeRegistry()}
+			var pulls []PullImage
+			for _, arch := range []string{"amd64", "arm64", "386", "ppc64le"} {
+				source.tag(arch, source.putImage(ocispec.Platform{OS: "linux", Architecture: arch}))
+				pulls = append(pulls, PullImage{Source: source, Ref: arch})
+			}
+			store, err := local.NewStore(t.TempDir())
+			require.NoError(t, err)
+
+			_, err = PullAll(ctx, store, pulls, tc.opts...)
+			require.NoError(t, err)
+			for dgst, data := range source.blob {
+				stored, err := content.ReadBlob(ctx, store, ocispec.Descriptor{Digest: dgst})
+				require.NoError(t, err)
+				assert.Equal(t, data, stored)
+			}
+			assert.Equal(t, tc.concurrency, source.max, "blobs should be ingested up to the concurrency at once")
+		})
+	}
+}
+
+func TestPullAllAggregatesFailures(t *testing.T) {
+	ctx := context.Background()
+	source := newFakeRegistry()
+	manifest := source.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	source.tag("amd64", manifest)
+	var image ocispec.Manifest
+	require.NoError(t, json.Unmarshal(source.blob[manifest.Digest], &image))
+	missing := []digest.Digest{image.Config.Digest, image.Layers[0].Digest}
+	for _, dgst := range missing {
+		delete(source.blob, dgst)
+	}
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	_, err = PullAll(ctx, store, []PullImage{{Source: source, Ref: "amd64"}})
+	var aggregate *AggregateError
+	require.True(t, errors.As(err, &aggregate), "expected *AggregateError, got %v", err)
+	var failed []digest.Digest
+	for _, contentErr := range aggregate.Errors {
+		assert.Equal(t, "pull", contentErr.Op)
+		failed = append(failed, contentErr.Digest)
+	}
+	assert.ElementsMatch(t, missing, failed, "every failure should be reported")
+	assert.True(t, errdefs.IsNotFound(err))
+	_, err = content.ReadBlob(ctx, store, manifest)
+	assert.NoError(t, err, "the manifest should be pulled despite the failures")
+}
+
+// lossyStore is a content store which loses the content of dropped once it is
+// committed, and reports the wrong size for resized.
+type lossyStore struct {
+	content.Store
+	dropped digest.Digest
+	resized digest.Digest
+}
+
+func (s *lossyStore) Writer(ctx context.Context, opts ...content.WriterOpt) (content.Writer, error) {
+	w, err := s.Store.Writer(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &lossyWriter{Writer: w, store: s}, nil
+}
+
+func (s *lossyStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	info, err := s.Store.Info(ctx, dgst)
+	if dgst == s.resized {
+		info.Size++
+	}
+	return info, err
+}
+
+type lossyWriter struct {
+	content.Writer
+	store *lossyStore
+}
+
+func (w *lossyWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if err := w.Writer.Commit(ctx, size, expected, opts...); err != nil {
+		return err
+	}
+	if expected == w.store.dropped {
+		return w.store.Delete(ctx, expected)
+	}
+	return nil
+}
+
+// resolvedSource resolves every reference to desc, fetching its content with
+// the embedded resolver.
+type resolvedSource struct {
+	remotes.Resolver
+	desc ocispec.Descriptor
+}
+
+func (s resolvedSource) Resolve(_ context.Context, ref string) (string, ocispec.Descriptor, error) {
+	return ref, s.desc, nil
+}
+
+func TestPullAllPipelinedDecompression(t *testing.T) {
+	ctx := context.Background()
+	uncompressed := []byte("hello, this is dog")
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write(uncompressed)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	registry := newFakeRegistry()
+	layer := registry.put(ocispec.MediaTypeImageLayerGzip, compressed.Bytes())
+	manifest := registry.putJSON(ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    registry.putJSON(ocispec.MediaTypeImageConfig, ocispec.Image{OS: "linux"}),
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(registry.get(digest.Digest(strings.TrimPrefix(r.URL.Path, "/"))))
+	}))
+	defer ts.Close()
+	client := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			dgst := digest.Digest(aws.StringValue(input.ImageIds[0].ImageDigest))
+			return &ecr.BatchGetImageOutput{
+				Images: []*ecr.Image{{ImageManifest: aws.String(string(registry.get(dgst)))}},
+			}, nil
+		},
+		GetDownloadUrlForLayerFn: func(_ aws.Context, input *ecr.GetDownloadUrlForLayerInput, _ ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL + "/" + aws.StringValue(input.LayerDigest))}, nil
+		},
+	}
+
+	for _, tc := range []struct {
+		name   string
+		blocks int
+	}{
+		{name: "pipelined", blocks: 2},
+		{name: "synchronous"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store, err := local.NewLabeledStore(t.TempDir(), &memoryLabelStore{labels: map[digest.Digest]map[string]string{}})
+			require.NoError(t, err)
+			source := resolvedSource{
+				Resolver: &ecrResolver{
+					clients:             map[string]ecrAPI{"fake": client},
+					decompressionBlocks: tc.blocks,
+				},
+				desc: manifest,
+			}
+
+			_, err = PullAll(ctx, store, []PullImage{{
+				Source: source,
+				Ref:    "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest",
+			}})
+			require.NoError(t, err)
+			stored, err := content.ReadBlob(ctx, store, layer)
+			require.NoError(t, err)
+			assert.Equal(t, compressed.Bytes(), stored)
+			info, err := store.Info(ctx, layer.Digest)
+			require.NoError(t, err)
+			diffID := digest.FromBytes(uncompressed)
+			if tc.blocks == 0 {
+				assert.Empty(t, info.Labels, "layers are only decompressed in a pipeline")
+				return
+			}
+			assert.Equal(t, diffID.String(), info.Labels["containerd.io/uncompressed"])
+			stored, err = content.ReadBlob(ctx, store, ocispec.Descriptor{Digest: diffID})
+			require.NoError(t, err)
+			assert.Equal(t, uncompressed, stored)
+		})
+	}
+}
+
+func TestPullAllVerification(t *testing.T) {
+	ctx := context.Background()
+	source := newFakeRegistry()
+	manifest := source.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	source.tag("amd64", manifest)
+	var parsed ocispec.Manifest
+	require.NoError(t, json.Unmarshal(source.blob[manifest.Digest], &parsed))
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	lossy := &lossyStore{
+		Store:   store,
+		dropped: parsed.Layers[0].Digest,
+		resized: parsed.Config.Digest,
+	}
+
+	_, err = PullAll(ctx, lossy, []PullImage{{Source: source, Ref: "amd64"}})
+	require.NoError(t, err, "lost content is not noticed without verification")
+
+	_, err = PullAll(ctx, lossy, []PullImage{{Source: source, Ref: "amd64"}}, WithPullVerification())
+	var incomplete *IncompletePullError
+	require.True(t, errors.As(err, &incomplete), "expected an incomplete pull, got %v", err)
+	assert.Equal(t, []digest.Digest{parsed.Layers[0].Digest}, incomplete.Missing)
+	assert.Equal(t, []digest.Digest{parsed.Config.Digest}, incomplete.Mismatched)
+	assert.True(t, errdefs.IsFailedPrecondition(err))
+
+	lossy.dropped, lossy.resized = "", ""
+	_, err = PullAll(ctx, lossy, []PullImage{{Source: source, Ref: "amd64"}}, WithPullVerification())
+	assert.NoError(t, err, "missing content should be pulled again")
+}
+
+func TestPullAllVerificationRequiresManager(t *testing.T) {
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+	ingester := struct{ content.Ingester }{store}
+
+	_, err = PullAll(context.Background(), ingester, nil, WithPullVerification())
+	assert.True(t, errdefs.IsNotImplemented(err))
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// pullThroughCache pulls images which ECR has not yet cached in the
+// repositories of pull-through cache rules.  ECR's API only serves images
+// once they are cached, while pulls through the registry API cache them from
+// the upstream registry as they are served.
+type pullThroughCache struct {
+	registry *registryAPI
+
+	lock sync.Mutex
+	// prefixes maps registries to the repository prefixes of their
+	// pull-through cache rules.
+	prefixes map[string][]string
+}
+
+func newPullThroughCache(registry *registryAPI) *pullThroughCache {
+	return &pullThroughCache{registry: registry, prefixes: map[string][]string{}}
+}
+
+// isUncached reports whether err, returned by ECR for an image or layer,
+// shows that the content may not have been cached yet.
+func isUncached(err error) bool {
+	return errdefs.IsNotFound(err) ||
+		errors.Is(err, errImageNotFound) ||
+		errors.Is(err, ErrRepositoryNotFound) ||
+		isRepositoryNotFound(err) ||
+		isLayersNotFound(err)
+}
+
+// matches reports whether ecrSpec's repository is created by a pull-through
+// cache rule of its registry.  The rules are listed once per registry.
+func (c *pullThroughCache) matches(ctx context.Context, client ecrAPI, ecrSpec ECRSpec) (bool, error) {
+	key := ecrSpec.Region() + "/" + ecrSpec.Registry()
+	c.lock.Lock()
+	prefixes, ok := c.prefixes[key]
+	c.lock.Unlock()
+	if !ok {
+		var err error
+		prefixes, err = listPullThroughCachePrefixes(ctx, client, ecrSpec.Registry())
+		if err != nil {
+			return false, err
+		}
+		c.lock.Lock()
+		c.prefixes[key] = prefixes
+		c.lock.Unlock()
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(ecrSpec.Repository, prefix+"/") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// listPullThroughCachePrefixes lists the repository prefixes of the
+// pull-through cache rules of registry.
+func listPullThroughCachePrefixes(ctx context.Context, client ecrAPI, registry string) ([]string, error) {
+	prefixes := []string{}
+	input := &ecr.DescribePullThroughCacheRulesInput{RegistryId: aws.String(registry)}
+	for {
+		output, err := client.DescribePullThroughCacheRulesWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range output.PullThroughCacheRules {
+			prefixes = append(prefixes, aws.StringValue(rule.EcrRepositoryPrefix))
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			break
+		}
+		input.NextToken = output.NextToken
+	}
+	log.G(ctx).
+		WithField("registry", registry).
+		WithField("prefixes", prefixes).
+		Debug("ecr.pullthrough: listed pull-through cache rules")
+	return prefixes, nil
+}
+
+// pullsThrough reports whether ecrSpec is to be pulled through the registry
+// API after ECR failed to find it with err: whether err shows that the
+// content may not have been cached yet, and ecrSpec's repository is created by
+// a pull-through cache rule.  c may be nil, in which case nothing is pulled
+// through.
+func (c *pullThroughCache) pullsThrough(ctx context.Context, client ecrAPI, ecrSpec ECRSpec, err error) bool {
+	if c == nil || !isUncached(err) {
+		return false
+	}
+	matches, matchErr := c.matches(ctx, client, ecrSpec)
+	if matchErr != nil {
+		log.G(ctx).
+			WithField("repository", ecrSpec.Repository).
+			WithError(matchErr).
+			Warn("ecr.pullthrough: failed to list pull-through cache rules")
+		return false
+	}
+	return matches
+}
+
+// get requests the content at path in ecrSpec's repository, such as
+// "manifests/latest", from the registry API, accepting the media types in
+// accept.  Content which the upstream registry does not have either fails
+// with an error wrapping errdefs.ErrNotFound.
+func (c *pullThroughCache) get(ctx context.Context, client ecrAPI, ecrSpec ECRSpec, path string, accept []string) (*http.Response, error) {
+	log.G(ctx).
+		WithField("repository", ecrSpec.Repository).
+		WithField("path", path).
+		Debug("ecr.pullthrough: pulling through the registry API")
+	api := c.registry
+	endpoint, token, err := api.authorize(ctx, client, ecrSpec)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/%s/%s", endpoint, ecrSpec.Repository, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(accept) > 0 {
+		req.Header.Set("Accept", strings.Join(accept, ", "))
+	}
+	resp, err := api.do(ctx, req, token)
+	if err != nil {
+		// Blobs are redirected to presigned URLs, which the errors of
+		// requests following the redirect hold.
+		return nil, redactError(ctx, err, req.URL.String())
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s/%s: not found upstream: %w", ecrSpec.Repository, path, errdefs.ErrNotFound)
+	default:
+		resp.Body.Close()
+		return nil, &httpStatusError{url: loggedURL(ctx, resp.Request.URL.String()), statusCode: resp.StatusCode, status: resp.Status}
+	}
+}
+
+// resolvePullThrough resolves ecrSpec through the registry API.
+func (r *ecrResolver) resolvePullThrough(ctx context.Context, ref string, ecrSpec ECRSpec) (ocispec.Descriptor, []byte, error) {
+	object := ecrSpec.Spec().Digest().String()
+	if object == "" {
+		object, _ = ecrSpec.TagDigest()
+	}
+	client := r.getClient(ecrSpec.Region(), ecrSpec.Registry())
+	resp, err := r.pullThroughCache.get(ctx, client, ecrSpec, "manifests/"+object, acceptedMediaTypes(r.acceptedMediaTypes))
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	defer resp.Body.Close()
+	manifest, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	mediaType := resp.Header.Get("Content-Type")
+	if mediaType == "" {
+		if mediaType, err = parseImageManifestMediaType(ctx, string(manifest)); err != nil {
+			return ocispec.Descriptor{}, nil, err
+		}
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	log.G(ctx).
+		WithField("ref", ref).
+		WithField("desc", desc).
+		Debug("ecr.pullthrough: resolved through the registry API")
+	return desc, manifest, nil
+}
+
+// fetchPullThrough fetches the manifest or blob desc through the registry
+// API.
+func (f *ecrFetcher) fetchPullThrough(ctx context.Context, desc ocispec.Descriptor, manifest bool) (io.ReadCloser, error) {
+	path, accept := "blobs/"+desc.Digest.String(), []string(nil)
+	if manifest {
+		path, accept = "manifests/"+desc.Digest.String(), acceptedMediaTypes(f.mediaTypes)
+	}
+	resp, err := f.pullThrough.get(ctx, f.client, f.ecrSpec, path, accept)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPullThroughTestResolver returns a resolver for which ECR has cached
+// nothing in the repositories of the pull-through cache rule with the prefix
+// "ecr-public", with registry serving the registry API.
+func newPullThroughTestResolver(t *testing.T, registry *httptest.Server, ruleLists *int) *ecrResolver {
+	client := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{Failures: []*ecr.ImageFailure{{
+				FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound),
+			}}}, nil
+		},
+		GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			return nil, awserr.New(ecr.ErrCodeLayersNotFoundException, "not found", nil)
+		},
+		DescribePullThroughCacheRulesFn: func(_ aws.Context, input *ecr.DescribePullThroughCacheRulesInput, _ ...request.Option) (*ecr.DescribePullThroughCacheRulesOutput, error) {
+			assert.Equal(t, "123456789012", aws.StringValue(input.RegistryId))
+			*ruleLists++
+			return &ecr.DescribePullThroughCacheRulesOutput{PullThroughCacheRules: []*ecr.PullThroughCacheRule{{
+				EcrRepositoryPrefix: aws.String("ecr-public"),
+				UpstreamRegistryUrl: aws.String("public.ecr.aws"),
+			}}}, nil
+		},
+		GetAuthorizationTokenFn: func(aws.Context, *ecr.GetAuthorizationTokenInput, ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+			return &ecr.GetAuthorizationTokenOutput{AuthorizationData: []*ecr.AuthorizationData{{
+				AuthorizationToken: aws.String("token"),
+				ProxyEndpoint:      aws.String(registry.URL),
+			}}}, nil
+		},
+	}
+	resolver, err := NewResolver(WithPullThroughCache())
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	return resolver.(*ecrResolver)
+}
+
+func TestPullThroughCache(t *testing.T) {
+	layer := []byte("layer")
+	layerDigest := digest.FromBytes(layer)
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`)
+	manifestDigest := digest.FromBytes(manifest)
+	var requests []string
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		assert.Equal(t, "Basic token", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/v2/ecr-public/docker/library/alpine/manifests/latest",
+			"/v2/ecr-public/docker/library/alpine/manifests/" + manifestDigest.String():
+			assert.Contains(t, r.Header.Get("Accept"), ocispec.MediaTypeImageManifest)
+			w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+			w.Write(manifest)
+		case "/v2/ecr-public/docker/library/alpine/blobs/" + layerDigest.String():
+			w.Write(layer)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+	var ruleLists int
+	resolver := newPullThroughTestResolver(t, registry, &ruleLists)
+	ctx := context.Background()
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/ecr-public/docker/library/alpine:latest"
+
+	_, desc, err := resolver.Resolve(ctx, ref)
+	require.NoError(t, err)
+	assert.Equal(t, ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      int64(len(manifest)),
+	}, desc)
+
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(ctx, desc)
+	require.NoError(t, err)
+	fetched, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	rc.Close()
+	assert.Equal(t, manifest, fetched)
+
+	rc, err = fetcher.Fetch(ctx, ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    layerDigest,
+		Size:      int64(len(layer)),
+	})
+	require.NoError(t, err)
+	fetched, err = ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	rc.Close()
+	assert.Equal(t, layer, fetched)
+
+	// Content the upstream registry does not have is not found.
+	_, _, err = resolver.Resolve(ctx, "ecr.aws/arn:aws:ecr:fake:123456789012:repository/ecr-public/docker/library/alpine:missing")
+	assert.True(t, errdefs.IsNotFound(err), "expected not found, got %v", err)
+	assert.Len(t, requests, 4)
+	assert.Equal(t, 1, ruleLists, "pull-through cache rules should be listed once")
+}
+
+func TestPullThroughCacheOtherRepository(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected registry request %s", r.URL.Path)
+	}))
+	defer registry.Close()
+	var ruleLists int
+	resolver := newPullThroughTestResolver(t, registry, &ruleLists)
+
+	_, _, err := resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/ecr-publicity/app:latest")
+	assert.True(t, errdefs.IsNotFound(err), "expected not found, got %v", err)
+	assert.Equal(t, 1, ruleLists)
+}
+
+func TestPullThroughCacheRedactsPresignedURL(t *testing.T) {
+	layerDigest := digest.FromString("layer")
+	// The presigned URL refuses connections once accepted.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	presignedURL := "http://" + listener.Addr().String() + "/layer?" + presignedSecret
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, presignedURL, http.StatusTemporaryRedirect)
+	}))
+	defer registry.Close()
+	var ruleLists int
+	resolver := newPullThroughTestResolver(t, registry, &ruleLists)
+
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	logger.Level = logrus.TraceLevel
+	ctx := log.WithLogger(context.Background(), logrus.NewEntry(logger))
+	fetcher, err := resolver.Fetcher(ctx, "ecr.aws/arn:aws:ecr:fake:123456789012:repository/ecr-public/docker/library/alpine:latest")
+	require.NoError(t, err)
+	_, err = fetcher.Fetch(ctx, ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    layerDigest,
+		Size:      5,
+	})
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), presignedSecret)
+	assert.NotContains(t, out.String(), presignedSecret)
+}
@@ -37,19 +37,69 @@ var (
 	errLayerNotFound = errors.New("ecr: layer not found")
 )
 
+// ForeignLayerPolicy determines how the pusher handles foreign, or
+// non-distributable, layers such as the base layers of Windows images.
+type ForeignLayerPolicy int
+
+const (
+	// ForeignLayerSkip does not upload foreign layers.  Clients pulling the
+	// image fetch them from the URLs listed in their descriptors.
+	ForeignLayerSkip ForeignLayerPolicy = iota
+	// ForeignLayerUpload uploads foreign layers to the repository in the same
+	// way as any other layer, for environments unable to reach the layers'
+	// URLs.  The image's manifests are not modified.
+	ForeignLayerUpload
+)
+
 // ecrPusher implements the containerd remotes.Pusher interface and can be used
 // to push images to Amazon ECR.
 type ecrPusher struct {
 	ecrBase
-	tracker docker.StatusTracker
+	tracker            docker.StatusTracker
+	foreignLayerPolicy ForeignLayerPolicy
+	layerUpload        layerUploadOptions
+	// mounter mounts blobs pulled from other repositories of the registry
+	// instead of uploading them, and is nil if blobs are always uploaded.
+	mounter *blobMounter
+	// layerSources are the repositories of the registry checked for blobs to
+	// mount which were not pulled from another repository of the registry.
+	layerSources []string
+	// invalidate removes the results cached by the resolver for the images
+	// pushed, and is nil if results are not cached.
+	invalidate func(context.Context, ECRSpec)
+	// journal records the content pushed for journalTTL, so that pushes
+	// retried with the same content skip the steps already completed, and is
+	// nil if pushed content is not recorded.
+	journal    ResolveCache
+	journalTTL time.Duration
+	// uploads is shared by the pushers of the resolver, so that blobs pushed
+	// concurrently by several of them are uploaded once.  It is nil if every
+	// push uploads its blobs.
+	uploads *uploadGroup
+	// creator creates the repository if it is found missing, and is nil if
+	// pushes to missing repositories fail.
+	creator *repositoryCreator
+	// checkIndexManifests configures whether the manifests listed by an
+	// index are confirmed to be in the repository before the index is put.
+	checkIndexManifests bool
+	// runtime holds the resolver's settings which may change while pushing,
+	// and is nil if they are the defaults.
+	runtime *runtimeSettings
 }
 
 var _ remotes.Pusher = (*ecrPusher)(nil)
 
 func (p ecrPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	ctx = p.runtime.logContext(ctx)
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("desc", desc))
 	log.G(ctx).Debug("ecr.push")
 
+	if p.journaled(ctx, desc) {
+		log.G(ctx).Debug("ecr.pusher: content pushed earlier")
+		p.markStatusExists(ctx, desc)
+		return nil, fmt.Errorf("content %v pushed earlier: %w", desc.Digest, errdefs.ErrAlreadyExists)
+	}
+
 	switch desc.MediaType {
 	case
 		images.MediaTypeDockerSchema1Manifest,
@@ -59,6 +109,11 @@ func (p ecrPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.W
 		ocispec.MediaTypeImageManifest:
 		return p.pushManifest(ctx, desc)
 	default:
+		if images.IsNonDistributable(desc.MediaType) && p.foreignLayerPolicy == ForeignLayerSkip {
+			log.G(ctx).Debug("ecr.pusher: skipping foreign layer")
+			p.markStatusExists(ctx, desc)
+			return nil, fmt.Errorf("foreign content %v: %w", desc.Digest, errdefs.ErrAlreadyExists)
+		}
 		return p.pushBlob(ctx, desc)
 	}
 }
@@ -74,18 +129,22 @@ func (p ecrPusher) pushManifest(ctx context.Context, desc ocispec.Descriptor) (c
 	if exists {
 		log.G(ctx).Debug("ecr.pusher.manifest: content already on remote")
 		p.markStatusExists(ctx, desc)
+		p.record(ctx, desc)
 		return nil, fmt.Errorf("content %v on remote: %w", desc.Digest, errdefs.ErrAlreadyExists)
 	}
 
 	ref := p.markStatusStarted(ctx, desc)
 
-	return &manifestWriter{
-		ctx:     ctx,
-		base:    &p.ecrBase,
-		desc:    desc,
-		tracker: p.tracker,
-		ref:     ref,
-	}, nil
+	return p.journalWriter(&manifestWriter{
+		ctx:        ctx,
+		base:       &p.ecrBase,
+		desc:       desc,
+		tracker:    p.tracker,
+		ref:        ref,
+		invalidate: p.invalidate,
+		creator:    p.creator,
+		checkIndex: p.checkIndexManifests,
+	}, desc), nil
 }
 
 func (p ecrPusher) checkManifestExistence(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
@@ -94,6 +153,12 @@ func (p ecrPusher) checkManifestExistence(ctx context.Context, desc ocispec.Desc
 		if err == errImageNotFound {
 			return false, nil
 		}
+		// A repository created for the push has no images yet.
+		if created, createErr := p.creator.createMissing(ctx, &p.ecrBase, err); createErr != nil {
+			return false, createErr
+		} else if created {
+			return false, nil
+		}
 		return false, err
 	}
 	if image == nil {
@@ -106,6 +171,31 @@ func (p ecrPusher) checkManifestExistence(ctx context.Context, desc ocispec.Desc
 
 func (p ecrPusher) pushBlob(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
 	log.G(ctx).Debug("ecr.pusher.blob")
+	finish, uploaded, err := p.uploads.start(ctx, p.uploadKey(desc))
+	if err != nil {
+		return nil, err
+	}
+	if uploaded {
+		log.G(ctx).Debug("ecr.pusher.blob: content uploaded by another push")
+		p.markStatusExists(ctx, desc)
+		p.record(ctx, desc)
+		return nil, fmt.Errorf("content %v uploaded by another push: %w", desc.Digest, errdefs.ErrAlreadyExists)
+	}
+
+	writer, err := p.uploadBlob(ctx, desc)
+	if err != nil {
+		finish(errdefs.IsAlreadyExists(err))
+		return nil, err
+	}
+	if p.uploads != nil {
+		writer = &uploadWriter{Writer: writer, finish: finish}
+	}
+	return p.journalWriter(writer, desc), nil
+}
+
+// uploadBlob returns a writer uploading desc, or an error wrapping
+// errdefs.ErrAlreadyExists if the blob is already in the repository.
+func (p ecrPusher) uploadBlob(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
 	exists, err := p.checkBlobExistence(ctx, desc)
 	if err != nil {
 		log.G(ctx).WithError(err).
@@ -115,11 +205,32 @@ func (p ecrPusher) pushBlob(ctx context.Context, desc ocispec.Descriptor) (conte
 	if exists {
 		log.G(ctx).Debug("ecr.pusher.blob: content already on remote")
 		p.markStatusExists(ctx, desc)
+		p.record(ctx, desc)
 		return nil, fmt.Errorf("content %v on remote: %w", desc.Digest, errdefs.ErrAlreadyExists)
 	}
+	if p.tryMount(ctx, desc) {
+		log.G(ctx).Debug("ecr.pusher.blob: content mounted from another repository")
+		p.markStatusExists(ctx, desc)
+		p.record(ctx, desc)
+		return nil, fmt.Errorf("content %v mounted on remote: %w", desc.Digest, errdefs.ErrAlreadyExists)
+	}
 
 	ref := p.markStatusStarted(ctx, desc)
-	return newLayerWriter(&p.ecrBase, p.tracker, ref, desc)
+	if isEmptyBlob(desc) {
+		api := &registryAPI{}
+		if p.mounter != nil {
+			api = p.mounter.registryAPI
+		}
+		return &emptyBlobWriter{
+			ctx:     ctx,
+			base:    &p.ecrBase,
+			api:     api,
+			desc:    desc,
+			tracker: p.tracker,
+			ref:     ref,
+		}, nil
+	}
+	return newLayerWriter(&p.ecrBase, p.tracker, ref, desc, p.layerUpload)
 }
 
 func (p ecrPusher) checkBlobExistence(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
@@ -131,6 +242,12 @@ func (p ecrPusher) checkBlobExistence(ctx context.Context, desc ocispec.Descript
 
 	batchCheckLayerAvailabilityOutput, err := p.client.BatchCheckLayerAvailabilityWithContext(ctx, batchCheckLayerAvailabilityInput)
 	if err != nil {
+		// A repository created for the push has no layers yet.
+		if created, createErr := p.creator.createMissing(ctx, &p.ecrBase, err); createErr != nil {
+			return false, createErr
+		} else if created {
+			return false, nil
+		}
 		log.G(ctx).WithError(err).Error("ecr.pusher.blob: failed to check availability")
 		return false, err
 	}
@@ -162,6 +279,10 @@ func (p ecrPusher) markStatusExists(ctx context.Context, desc ocispec.Descriptor
 
 func (p ecrPusher) markStatusStarted(ctx context.Context, desc ocispec.Descriptor) string {
 	ref := remotes.MakeRefKey(ctx, desc)
+	if status, err := p.tracker.GetStatus(ref); err == nil && resumableUpload(status, desc) {
+		// Keep the interrupted upload for the layer writer to resume.
+		return ref
+	}
 	p.tracker.SetStatus(ref, docker.Status{
 		Status: content.Status{
 			Ref:       ref,
@@ -17,6 +17,7 @@ package ecr
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"testing"
 	"time"
@@ -313,3 +314,107 @@ func TestPushBlobAPIError(t *testing.T) {
 	_, err := pusher.Push(context.Background(), desc)
 	assert.EqualError(t, err, errLayerNotFound.Error())
 }
+
+func TestPushWindowsManifestListPreservesPlatform(t *testing.T) {
+	manifestList := testdata.WindowsManifestList.Content()
+	listDigest := digest.FromString(manifestList)
+	putCount := 0
+	var pushed string
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{
+				Failures: []*ecr.ImageFailure{
+					{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)},
+				},
+			}, nil
+		},
+		PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+			putCount++
+			pushed = aws.StringValue(input.ImageManifest)
+			assert.Equal(t, images.MediaTypeDockerSchema2ManifestList, aws.StringValue(input.ImageManifestMediaType))
+			return &ecr.PutImageOutput{
+				Image: &ecr.Image{
+					ImageId: &ecr.ImageIdentifier{ImageDigest: aws.String(listDigest.String())},
+				},
+			}, nil
+		},
+	}
+	pusher := &ecrPusher{
+		ecrBase: ecrBase{
+			client: fakeClient,
+			ecrSpec: ECRSpec{
+				arn:        arn.ARN{AccountID: "registry"},
+				Repository: "repository",
+				Object:     "tag@" + listDigest.String(),
+			},
+		},
+		tracker: docker.NewInMemoryTracker(),
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2ManifestList,
+		Digest:    listDigest,
+		Size:      int64(len(manifestList)),
+	}
+	writer, err := pusher.Push(context.Background(), desc)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte(manifestList))
+	require.NoError(t, err)
+	require.NoError(t, writer.Commit(context.Background(), desc.Size, desc.Digest))
+	assert.Equal(t, 1, putCount)
+
+	assert.Equal(t, manifestList, pushed, "manifest list should be pushed unmodified")
+	var index ocispec.Index
+	require.NoError(t, json.Unmarshal([]byte(pushed), &index))
+	var platforms []ocispec.Platform
+	for _, manifest := range index.Manifests {
+		require.NotNil(t, manifest.Platform)
+		platforms = append(platforms, *manifest.Platform)
+	}
+	assert.Equal(t, []ocispec.Platform{
+		{Architecture: "amd64", OS: "windows", OSVersion: "10.0.17763.3650", OSFeatures: []string{"win32k"}},
+		{Architecture: "amd64", OS: "windows", OSVersion: "10.0.20348.1249", OSFeatures: []string{"win32k"}},
+	}, platforms, "pushed manifest list should keep the Windows platforms")
+}
+
+func TestPushForeignLayer(t *testing.T) {
+	var manifest ocispec.Manifest
+	require.NoError(t, json.Unmarshal([]byte(testdata.WindowsManifest.Content()), &manifest))
+	foreign := manifest.Layers[0]
+	require.True(t, images.IsNonDistributable(foreign.MediaType))
+
+	t.Run("skip", func(t *testing.T) {
+		// Any ECR API call would panic with the empty fake.
+		pusher := &ecrPusher{
+			ecrBase: ecrBase{client: &fakeECRClient{}},
+			tracker: docker.NewInMemoryTracker(),
+		}
+		_, err := pusher.Push(context.Background(), foreign)
+		assert.True(t, errdefs.IsAlreadyExists(err), "foreign layer should be skipped")
+	})
+
+	t.Run("upload", func(t *testing.T) {
+		checkCount := 0
+		pusher := &ecrPusher{
+			ecrBase: ecrBase{
+				client: &fakeECRClient{
+					BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+						checkCount++
+						assert.Equal(t, []string{foreign.Digest.String()}, aws.StringValueSlice(input.LayerDigests))
+						return &ecr.BatchCheckLayerAvailabilityOutput{
+							Layers: []*ecr.Layer{{
+								LayerDigest:       aws.String(foreign.Digest.String()),
+								LayerAvailability: aws.String(ecr.LayerAvailabilityAvailable),
+							}},
+						}, nil
+					},
+				},
+			},
+			tracker:            docker.NewInMemoryTracker(),
+			foreignLayerPolicy: ForeignLayerUpload,
+		}
+		_, err := pusher.Push(context.Background(), foreign)
+		assert.True(t, errdefs.IsAlreadyExists(err))
+		assert.Equal(t, 1, checkCount, "foreign layer should be handled as a blob")
+	})
+}
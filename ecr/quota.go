@@ -0,0 +1,258 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+	"github.com/containerd/containerd/log"
+)
+
+// quotaServiceCode identifies ECR to the Service Quotas API.
+const quotaServiceCode = "ecr"
+
+// Names under which Service Quotas reports the ECR quotas of interest.
+const (
+	quotaNameRepositories         = "Registered repositories"
+	quotaNameImagesPerRepository  = "Images per repository"
+	quotaNameLayerParts           = "Layer parts"
+	quotaNameMinimumLayerPartSize = "Minimum layer part size"
+	quotaNameMaximumLayerPartSize = "Maximum layer part size"
+)
+
+// serviceQuotasAPI contains only the Service Quotas API calls used by the
+// resolver.
+type serviceQuotasAPI interface {
+	ListServiceQuotasPagesWithContext(aws.Context, *servicequotas.ListServiceQuotasInput, func(*servicequotas.ListServiceQuotasOutput, bool) bool, ...request.Option) error
+	ListAWSDefaultServiceQuotasPagesWithContext(aws.Context, *servicequotas.ListAWSDefaultServiceQuotasInput, func(*servicequotas.ListAWSDefaultServiceQuotasOutput, bool) bool, ...request.Option) error
+}
+
+// QuotaInspector is implemented by resolvers able to report the ECR service
+// quotas limiting pushes and how much of each is in use.  The resolver
+// returned by NewResolver implements it.
+type QuotaInspector interface {
+	InspectQuotas(ctx context.Context, ref string) (*QuotaUsage, error)
+}
+
+var _ QuotaInspector = (*ecrResolver)(nil)
+
+// Quota is a single ECR service quota.
+type Quota struct {
+	// Name of the quota as reported by Service Quotas.
+	Name string
+	// Code of the quota, used to request an increase.
+	Code string
+	// Value is the quota applied to the account, or the AWS default if no
+	// value has been applied.  Value is zero if the quota was not reported.
+	Value float64
+	// Unit of Value, such as "None" for counts or "Megabytes" for sizes.
+	Unit string
+	// Usage is the amount of the quota in use.  It is only meaningful when
+	// Counted is set.
+	Usage float64
+	// Counted indicates whether Usage was determined.  Usage is not counted
+	// for quotas applying to individual requests, such as layer part sizes.
+	Counted bool
+}
+
+// NearLimit reports whether the counted usage of the quota has reached the
+// fraction threshold of its value, such as 0.9 for 90%.
+func (q Quota) NearLimit(threshold float64) bool {
+	return q.Counted && q.Value > 0 && q.Usage >= q.Value*threshold
+}
+
+// QuotaUsage reports the ECR service quotas relevant to pushing to a
+// repository.  Service quotas are those of the caller's account in the
+// repository's region, so usage is only counted when the repository belongs
+// to the caller's own registry.
+type QuotaUsage struct {
+	// Region whose quotas are reported.
+	Region string
+	// RegistryID of the caller's registry.
+	RegistryID string
+	// Repositories is the number of repositories in the registry.
+	Repositories Quota
+	// ImagesPerRepository is the number of images in the repository.
+	ImagesPerRepository Quota
+	// LayerParts is the number of parts a layer may be uploaded in.
+	LayerParts Quota
+	// MinimumLayerPartSize and MaximumLayerPartSize bound the size of each
+	// part of a layer upload other than the last.
+	MinimumLayerPartSize Quota
+	MaximumLayerPartSize Quota
+}
+
+// InspectQuotas reports the ECR service quotas of the caller's account in the
+// region of the repository named by ref, along with the number of
+// repositories in the registry and images in the repository.  Applied quota
+// values are reported where set and AWS defaults otherwise.  Inspecting
+// quotas requires permission to list service quotas in addition to
+// describing repositories and images.
+func (r *ecrResolver) InspectQuotas(ctx context.Context, ref string) (*QuotaUsage, error) {
+	ecrSpec, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	quotas, err := r.listQuotas(ctx, ecrSpec.Region(), ecrSpec.Registry())
+	if err != nil {
+		return nil, err
+	}
+	usage := &QuotaUsage{
+		Region:               ecrSpec.Region(),
+		Repositories:         quotas[quotaNameRepositories],
+		ImagesPerRepository:  quotas[quotaNameImagesPerRepository],
+		LayerParts:           quotas[quotaNameLayerParts],
+		MinimumLayerPartSize: quotas[quotaNameMinimumLayerPartSize],
+		MaximumLayerPartSize: quotas[quotaNameMaximumLayerPartSize],
+	}
+
+	client := r.getClient(ecrSpec.Region(), ecrSpec.Registry())
+	registryOutput, err := client.DescribeRegistryWithContext(ctx, &ecr.DescribeRegistryInput{})
+	if err != nil {
+		return nil, err
+	}
+	usage.RegistryID = aws.StringValue(registryOutput.RegistryId)
+	// Repositories in other accounts count against their owner's quotas,
+	// which the caller cannot see.
+	if usage.RegistryID == ecrSpec.Registry() {
+		repositories, err := countRepositories(ctx, client, ecrSpec.Registry())
+		if err != nil {
+			return nil, err
+		}
+		usage.Repositories.Usage, usage.Repositories.Counted = float64(repositories), true
+
+		images, err := r.describeImages(ctx, ecrSpec, nil)
+		if err != nil {
+			return nil, err
+		}
+		usage.ImagesPerRepository.Usage, usage.ImagesPerRepository.Counted = float64(len(images)), true
+	}
+
+	log.G(ctx).
+		WithField("repository", ecrSpec.Repository).
+		WithField("quotas", usage).
+		Debug("ecr.resolver.quota: inspected quotas")
+	return usage, nil
+}
+
+// listQuotas lists the ECR service quotas in region by name.  Service Quotas
+// only reports applied values for some quotas, so the AWS defaults are listed
+// for any not found among them.
+func (r *ecrResolver) listQuotas(ctx context.Context, region, registryID string) (map[string]Quota, error) {
+	client := r.getQuotaClient(region, registryID)
+	quotas := map[string]Quota{}
+	add := func(serviceQuotas []*servicequotas.ServiceQuota) {
+		for _, serviceQuota := range serviceQuotas {
+			quota := Quota{
+				Name:  aws.StringValue(serviceQuota.QuotaName),
+				Code:  aws.StringValue(serviceQuota.QuotaCode),
+				Value: aws.Float64Value(serviceQuota.Value),
+				Unit:  aws.StringValue(serviceQuota.Unit),
+			}
+			name := quotaName(quota.Name)
+			if _, ok := quotas[name]; name != "" && !ok {
+				quotas[name] = quota
+			}
+		}
+	}
+
+	err := client.ListServiceQuotasPagesWithContext(ctx, &servicequotas.ListServiceQuotasInput{
+		ServiceCode: aws.String(quotaServiceCode),
+	}, func(output *servicequotas.ListServiceQuotasOutput, _ bool) bool {
+		add(output.Quotas)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(quotas) == len(quotaNames) {
+		return quotas, nil
+	}
+	err = client.ListAWSDefaultServiceQuotasPagesWithContext(ctx, &servicequotas.ListAWSDefaultServiceQuotasInput{
+		ServiceCode: aws.String(quotaServiceCode),
+	}, func(output *servicequotas.ListAWSDefaultServiceQuotasOutput, _ bool) bool {
+		add(output.Quotas)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return quotas, nil
+}
+
+var quotaNames = []string{
+	quotaNameRepositories,
+	quotaNameImagesPerRepository,
+	quotaNameLayerParts,
+	quotaNameMinimumLayerPartSize,
+	quotaNameMaximumLayerPartSize,
+}
+
+// quotaName returns the known quota name matching name regardless of case, or
+// "" if name is not a quota of interest.
+func quotaName(name string) string {
+	for _, known := range quotaNames {
+		if strings.EqualFold(name, known) {
+			return known
+		}
+	}
+	return ""
+}
+
+// countRepositories counts the repositories in registry, following every page
+// of results.
+func countRepositories(ctx context.Context, client ecrAPI, registry string) (int, error) {
+	input := &ecr.DescribeRepositoriesInput{
+		RegistryId: aws.String(registry),
+	}
+	count := 0
+	for {
+		output, err := client.DescribeRepositoriesWithContext(ctx, input)
+		if err != nil {
+			return 0, err
+		}
+		count += len(output.Repositories)
+		if aws.StringValue(output.NextToken) == "" {
+			return count, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+func (r *ecrResolver) getQuotaClient(region, registryID string) serviceQuotasAPI {
+	key, config := r.clientKey(region, registryID)
+	r.quotaClientsLock.Lock()
+	defer r.quotaClientsLock.Unlock()
+	if _, ok := r.quotaClients[key]; !ok {
+		client := servicequotas.New(r.session, &aws.Config{
+			Region:     aws.String(region),
+			HTTPClient: r.httpClient}, config)
+		r.stats.addAPIHandlers(&client.Handlers, r.apiCallBudget)
+		if r.offline {
+			addOfflineHandler(&client.Handlers)
+		}
+		for _, option := range r.apiOptions {
+			option(&client.Handlers)
+		}
+		r.quotaClients[key] = client
+	}
+	return r.quotaClients[key]
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeServiceQuotasClient struct {
+	applied  []*servicequotas.ServiceQuota
+	defaults []*servicequotas.ServiceQuota
+}
+
+var _ serviceQuotasAPI = (*fakeServiceQuotasClient)(nil)
+
+func (f *fakeServiceQuotasClient) ListServiceQuotasPagesWithContext(_ aws.Context, input *servicequotas.ListServiceQuotasInput, fn func(*servicequotas.ListServiceQuotasOutput, bool) bool, _ ...request.Option) error {
+	for i, quota := range f.applied {
+		if !fn(&servicequotas.ListServiceQuotasOutput{Quotas: []*servicequotas.ServiceQuota{quota}}, i == len(f.applied)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeServiceQuotasClient) ListAWSDefaultServiceQuotasPagesWithContext(_ aws.Context, input *servicequotas.ListAWSDefaultServiceQuotasInput, fn func(*servicequotas.ListAWSDefaultServiceQuotasOutput, bool) bool, _ ...request.Option) error {
+	fn(&servicequotas.ListAWSDefaultServiceQuotasOutput{Quotas: f.defaults}, true)
+	return nil
+}
+
+func serviceQuota(name, code string, value float64, unit string) *servicequotas.ServiceQuota {
+	return &servicequotas.ServiceQuota{
+		QuotaName: aws.String(name),
+		QuotaCode: aws.String(code),
+		Value:     aws.Float64(value),
+		Unit:      aws.String(unit),
+	}
+}
+
+func TestInspectQuotas(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	quotaClient := &fakeServiceQuotasClient{
+		applied: []*servicequotas.ServiceQuota{
+			serviceQuota("Registered repositories", "L-1", 3, "None"),
+			serviceQuota("Images per repository", "L-2", 2, "None"),
+			serviceQuota("Rate of PutImage requests", "L-3", 10, "None"),
+		},
+		defaults: []*servicequotas.ServiceQuota{
+			serviceQuota("Registered repositories", "L-1", 10000, "None"),
+			serviceQuota("Layer parts", "L-4", 4200, "None"),
+			serviceQuota("Minimum layer part size", "L-5", 5, "Megabytes"),
+			serviceQuota("Maximum layer part size", "L-6", 10, "Megabytes"),
+		},
+	}
+	fakeClient := &fakeECRClient{
+		DescribeRegistryFn: func(aws.Context, *ecr.DescribeRegistryInput, ...request.Option) (*ecr.DescribeRegistryOutput, error) {
+			return &ecr.DescribeRegistryOutput{RegistryId: aws.String("123456789012")}, nil
+		},
+		DescribeRepositoriesFn: func(_ aws.Context, input *ecr.DescribeRepositoriesInput, _ ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+			assert.Equal(t, "123456789012", aws.StringValue(input.RegistryId))
+			assert.Empty(t, input.RepositoryNames)
+			if input.NextToken == nil {
+				return &ecr.DescribeRepositoriesOutput{
+					Repositories: []*ecr.Repository{{}, {}},
+					NextToken:    aws.String("next"),
+				}, nil
+			}
+			return &ecr.DescribeRepositoriesOutput{Repositories: []*ecr.Repository{{}}}, nil
+		},
+		DescribeImagesFn: func(_ aws.Context, input *ecr.DescribeImagesInput, _ ...request.Option) (*ecr.DescribeImagesOutput, error) {
+			assert.Equal(t, "foo/bar", aws.StringValue(input.RepositoryName))
+			return &ecr.DescribeImagesOutput{ImageDetails: []*ecr.ImageDetail{{}}}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients:      map[string]ecrAPI{"fake": fakeClient},
+		quotaClients: map[string]serviceQuotasAPI{"fake": quotaClient},
+	}
+
+	usage, err := resolver.InspectQuotas(context.Background(), ref)
+	require.NoError(t, err)
+	assert.Equal(t, &QuotaUsage{
+		Region:               "fake",
+		RegistryID:           "123456789012",
+		Repositories:         Quota{Name: "Registered repositories", Code: "L-1", Value: 3, Unit: "None", Usage: 3, Counted: true},
+		ImagesPerRepository:  Quota{Name: "Images per repository", Code: "L-2", Value: 2, Unit: "None", Usage: 1, Counted: true},
+		LayerParts:           Quota{Name: "Layer parts", Code: "L-4", Value: 4200, Unit: "None"},
+		MinimumLayerPartSize: Quota{Name: "Minimum layer part size", Code: "L-5", Value: 5, Unit: "Megabytes"},
+		MaximumLayerPartSize: Quota{Name: "Maximum layer part size", Code: "L-6", Value: 10, Unit: "Megabytes"},
+	}, usage)
+	assert.True(t, usage.Repositories.NearLimit(1))
+	assert.False(t, usage.ImagesPerRepository.NearLimit(0.9))
+	assert.False(t, usage.LayerParts.NearLimit(0))
+}
+
+func TestInspectQuotasOtherRegistry(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	quotaClient := &fakeServiceQuotasClient{
+		defaults: []*servicequotas.ServiceQuota{
+			serviceQuota("Registered repositories", "L-1", 10000, "None"),
+		},
+	}
+	// Usage of another account's registry is not counted, so neither
+	// repositories nor images are described.
+	fakeClient := &fakeECRClient{
+		DescribeRegistryFn: func(aws.Context, *ecr.DescribeRegistryInput, ...request.Option) (*ecr.DescribeRegistryOutput, error) {
+			return &ecr.DescribeRegistryOutput{RegistryId: aws.String("210987654321")}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients:      map[string]ecrAPI{"fake": fakeClient},
+		quotaClients: map[string]serviceQuotasAPI{"fake": quotaClient},
+	}
+
+	usage, err := resolver.InspectQuotas(context.Background(), ref)
+	require.NoError(t, err)
+	assert.Equal(t, "210987654321", usage.RegistryID)
+	assert.Equal(t, float64(10000), usage.Repositories.Value)
+	assert.False(t, usage.Repositories.Counted)
+	assert.False(t, usage.Repositories.NearLimit(0))
+}
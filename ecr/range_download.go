@@ -0,0 +1,243 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// rangeReader downloads a layer in chunks of chunkSize fetched with up to
+// parallelism concurrent range requests, once it is first read.  The first
+// chunk is requested before any other; if the server answers it with the
+// whole layer rather than the range, the layer is streamed from that response
+// instead.  At most parallelism chunks are buffered at once.
+//
+// Like htcatReader, the layer is written directly to the destination when
+// copied with io.Copy, and otherwise read through a pipe.
+type rangeReader struct {
+	ctx         context.Context
+	client      *http.Client
+	url         string
+	parallelism int
+	chunkSize   int64
+
+	once sync.Once
+	// pipe is set if the download was started by Read.
+	pipe *io.PipeReader
+}
+
+var errRangeConsumed = errors.New("ecr.fetcher.layer.range: layer already written or closed")
+
+func (r *rangeReader) startPipe() {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := r.download(pw)
+		if err != nil {
+			log.G(r.ctx).
+				WithError(err).
+				WithField("url", loggedURL(r.ctx, r.url)).
+				Error("ecr.fetcher.layer.range: failed to download layer")
+		}
+		pw.CloseWithError(err)
+	}()
+	r.pipe = pr
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	r.once.Do(r.startPipe)
+	if r.pipe == nil {
+		return 0, errRangeConsumed
+	}
+	return r.pipe.Read(p)
+}
+
+func (r *rangeReader) WriteTo(w io.Writer) (int64, error) {
+	direct := false
+	r.once.Do(func() { direct = true })
+	if direct {
+		return r.download(w)
+	}
+	if r.pipe == nil {
+		return 0, errRangeConsumed
+	}
+	return copyPooled(w, r.pipe)
+}
+
+// Close stops a download being read through the pipe.  A download written
+// directly by WriteTo stops when the destination returns an error.
+func (r *rangeReader) Close() error {
+	r.once.Do(func() {})
+	if r.pipe != nil {
+		return r.pipe.Close()
+	}
+	return nil
+}
+
+// rangeChunk is a downloaded chunk, or the error downloading it.
+type rangeChunk struct {
+	data []byte
+	err  error
+}
+
+// download writes the layer to w.  Its errors are redacted as the errors of
+// layer downloads are.
+func (r *rangeReader) download(w io.Writer) (int64, error) {
+	n, err := r.transfer(w)
+	return n, redactError(r.ctx, err, r.url)
+}
+
+func (r *rangeReader) transfer(w io.Writer) (int64, error) {
+	ctx, cancel := context.WithCancel(r.ctx)
+	defer cancel()
+
+	resp, err := r.get(ctx, 0, r.chunkSize-1)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		log.G(ctx).
+			WithField("url", loggedURL(ctx, r.url)).
+			Debug("ecr.fetcher.layer.range: ranges not supported, downloading as a single stream")
+		return copyPooled(w, resp.Body)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, &httpStatusError{url: loggedURL(r.ctx, r.url), statusCode: resp.StatusCode, status: resp.Status}
+	}
+	total, err := contentRangeTotal(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return 0, err
+	}
+
+	// Each later chunk is fetched once a slot is free, and its slot is
+	// released once it has been written, bounding the chunks buffered.
+	chunks := int((total + r.chunkSize - 1) / r.chunkSize)
+	slots := make(chan struct{}, r.parallelism)
+	results := make([]chan rangeChunk, chunks)
+	for i := range results {
+		results[i] = make(chan rangeChunk, 1)
+	}
+	slots <- struct{}{}
+	go func() {
+		for i := 1; i < chunks; i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(i int) {
+				start := int64(i) * r.chunkSize
+				end := start + r.chunkSize - 1
+				if end >= total {
+					end = total - 1
+				}
+				data, err := r.getChunk(ctx, start, end)
+				results[i] <- rangeChunk{data: data, err: err}
+			}(i)
+		}
+	}()
+
+	written, err := copyPooled(w, resp.Body)
+	if err != nil {
+		return written, err
+	}
+	first := r.chunkSize
+	if total < first {
+		first = total
+	}
+	if written != first {
+		return written, fmt.Errorf("ecr.fetcher.layer.range: chunk at 0 was %d bytes, expected %d: %w", written, first, io.ErrUnexpectedEOF)
+	}
+	<-slots
+	for i := 1; i < chunks; i++ {
+		var chunk rangeChunk
+		select {
+		case chunk = <-results[i]:
+		case <-ctx.Done():
+			return written, ctx.Err()
+		}
+		if chunk.err != nil {
+			return written, chunk.err
+		}
+		n, err := w.Write(chunk.data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		<-slots
+	}
+	return written, nil
+}
+
+// get requests the bytes from start to end, inclusive, of the layer.
+func (r *rangeReader) get(ctx context.Context, start, end int64) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := ctxhttp.Do(ctx, r.client, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to do request: %w", err)
+	}
+	return resp, nil
+}
+
+// getChunk downloads the bytes from start to end, inclusive, of the layer.
+// Only a partial response of exactly the range requested is accepted.
+func (r *rangeReader) getChunk(ctx context.Context, start, end int64) ([]byte, error) {
+	resp, err := r.get(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, &httpStatusError{url: loggedURL(r.ctx, r.url), statusCode: resp.StatusCode, status: resp.Status}
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != end-start+1 {
+		return nil, fmt.Errorf("ecr.fetcher.layer.range: chunk at %d was %d bytes, expected %d: %w", start, len(data), end-start+1, io.ErrUnexpectedEOF)
+	}
+	return data, nil
+}
+
+// contentRangeTotal returns the complete length given by a Content-Range
+// header, such as "bytes 0-1023/4096".
+func contentRangeTotal(contentRange string) (int64, error) {
+	i := strings.LastIndex(contentRange, "/")
+	if i < 0 || !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, fmt.Errorf("ecr.fetcher.layer.range: invalid Content-Range %q", contentRange)
+	}
+	total, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil || total <= 0 {
+		return 0, fmt.Errorf("ecr.fetcher.layer.range: invalid Content-Range %q", contentRange)
+	}
+	return total, nil
+}
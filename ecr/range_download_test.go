@@ -0,0 +1,124 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchLayerChunked(t *testing.T) {
+	expectedBody := make([]byte, 5<<20+123)
+	rand.Read(expectedBody)
+	var ranged int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&ranged, 1)
+		}
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(expectedBody))
+	}))
+	defer ts.Close()
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+				},
+			},
+		},
+		parallelism: 3,
+		chunkSize:   1 << 20,
+	}
+	desc := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2Layer,
+		Digest:    digest.FromBytes(expectedBody),
+		Size:      int64(len(expectedBody)),
+	}
+
+	reader, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	reader.Close()
+	assert.Equal(t, expectedBody, body)
+	assert.Equal(t, int32(6), atomic.LoadInt32(&ranged), "every chunk should be requested as a range")
+
+	reader, err = fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	defer reader.Close()
+	var written bytes.Buffer
+	n, err := io.Copy(&written, reader)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(expectedBody)), n)
+	assert.Equal(t, expectedBody, written.Bytes())
+}
+
+func TestRangeReaderNoRangeSupport(t *testing.T) {
+	expectedBody := make([]byte, 3<<20)
+	rand.Read(expectedBody)
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(expectedBody)
+	}))
+	defer ts.Close()
+	reader := &rangeReader{ctx: context.Background(), url: ts.URL, parallelism: 2, chunkSize: 1 << 20}
+	defer reader.Close()
+
+	body, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, expectedBody, body, "layer should be streamed from the whole response")
+	assert.Equal(t, 1, requests)
+}
+
+func TestRangeReaderShortChunk(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "bytes 0-3/8")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("abc"))
+	}))
+	defer ts.Close()
+	reader := &rangeReader{ctx: context.Background(), url: ts.URL, parallelism: 2, chunkSize: 4}
+	defer reader.Close()
+
+	_, err := ioutil.ReadAll(reader)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestWithLayerDownloadChunkSize(t *testing.T) {
+	_, err := NewResolver(WithLayerDownloadChunkSize(0))
+	assert.Error(t, err)
+	resolver, err := NewResolver(WithLayerDownloadParallelism(2), WithLayerDownloadChunkSize(8<<20))
+	require.NoError(t, err)
+	assert.Equal(t, int64(8<<20), resolver.(*ecrResolver).layerDownloadChunkSize)
+}
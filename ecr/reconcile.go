@@ -0,0 +1,394 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+)
+
+// defaultReconcileInterval is the time between the passes of a Reconciler if
+// no other interval is configured.
+const defaultReconcileInterval = 5 * time.Minute
+
+// MirrorRepository names a repository mirrored by a Reconciler and the
+// repository its images are copied to.  Both are references without a tag or
+// digest, such as
+// "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/app".
+type MirrorRepository struct {
+	Source      string
+	Destination string
+}
+
+// ReconcilerOption represents a functional option for configuring a
+// Reconciler.
+type ReconcilerOption func(*ReconcilerOptions) error
+
+// ReconcilerOptions represents available options for configuring a
+// Reconciler.
+type ReconcilerOptions struct {
+	// Interval is the time between the passes of Run.  If not specified,
+	// repositories are reconciled every five minutes.
+	Interval time.Duration
+	// Clock provides the time to Run.  If not specified, SystemClock is used.
+	Clock Clock
+	// CopyOptions configure the copy of each image.  If not specified,
+	// images are copied with their referrers.
+	CopyOptions []CopyOption
+	// Handler receives the results of each pass of Run.  If not specified,
+	// results are only logged.
+	Handler func(ctx context.Context, results []ReconcileResult)
+}
+
+// WithReconcileInterval is a ReconcilerOption to wait interval between the
+// passes of Run.
+func WithReconcileInterval(interval time.Duration) ReconcilerOption {
+	return func(options *ReconcilerOptions) error {
+		if interval <= 0 {
+			return errors.New("reconcile interval must be positive")
+		}
+		options.Interval = interval
+		return nil
+	}
+}
+
+// WithReconcileClock is a ReconcilerOption to time the passes of Run with
+// clock.
+func WithReconcileClock(clock Clock) ReconcilerOption {
+	return func(options *ReconcilerOptions) error {
+		if clock == nil {
+			return errors.New("clock must not be nil")
+		}
+		options.Clock = clock
+		return nil
+	}
+}
+
+// WithReconcileCopyOptions is a ReconcilerOption to copy images with opts,
+// such as WithCopyPlatforms.
+func WithReconcileCopyOptions(opts ...CopyOption) ReconcilerOption {
+	return func(options *ReconcilerOptions) error {
+		options.CopyOptions = append(options.CopyOptions, opts...)
+		return nil
+	}
+}
+
+// WithReconcileHandler is a ReconcilerOption to pass the results of each pass
+// of Run to handler, such as to update the status of a mirror resource.
+func WithReconcileHandler(handler func(ctx context.Context, results []ReconcileResult)) ReconcilerOption {
+	return func(options *ReconcilerOptions) error {
+		if handler == nil {
+			return errors.New("reconcile handler must not be nil")
+		}
+		options.Handler = handler
+		return nil
+	}
+}
+
+// ReconcileResult reports the reconciliation of a MirrorRepository.
+type ReconcileResult struct {
+	Repository MirrorRepository
+	// Copied lists the tags copied to the destination.
+	Copied []string
+	// Unchanged is the number of tags already at the destination with the
+	// digest of the image copying them would push.
+	Unchanged int
+	// Failed holds the errors of the tags which failed to copy.
+	Failed map[string]error
+	// Err is the error listing the tags of either repository, if any.
+	Err error
+}
+
+// Reconciler mirrors repositories into a destination registry, so that it can
+// serve as the engine of a mirror operator.  Each pass lists the tags of the
+// source repositories with DescribeImages and copies those which are missing
+// from their destination or name another digest there.  Images without tags
+// are not mirrored, and tags removed from the source are left at the
+// destination.
+//
+// Copies filtered by the copy options, such as with WithCopyPlatforms, push
+// a rewritten index with a digest of its own.  A tag is unchanged if its
+// destination digest is that of the image the copy would push.
+type Reconciler struct {
+	source       remotes.Resolver
+	inspector    ImageInspector
+	destination  remotes.Resolver
+	repositories []MirrorRepository
+	options      ReconcilerOptions
+	copyOptions  CopyOptions
+
+	mu sync.Mutex
+	// copied maps the digest of each source image copied or planned to the
+	// digest of the image pushed for it.
+	copied map[digest.Digest]digest.Digest
+}
+
+// NewReconciler returns a Reconciler mirroring repositories from source,
+// which must implement ImageInspector as the resolver returned by NewResolver
+// does, to destination.  Destinations implementing ImageInspector are listed
+// with a single pass over their images; the tags of other destinations are
+// resolved one by one.
+func NewReconciler(source, destination remotes.Resolver, repositories []MirrorRepository, opts ...ReconcilerOption) (*Reconciler, error) {
+	inspector, ok := source.(ImageInspector)
+	if !ok {
+		return nil, fmt.Errorf("reconcile source must implement ImageInspector: %w", errdefs.ErrInvalidArgument)
+	}
+	for _, repository := range repositories {
+		if repository.Source == "" || repository.Destination == "" {
+			return nil, fmt.Errorf("mirrored repositories must have a source and destination: %w", errdefs.ErrInvalidArgument)
+		}
+	}
+	options := ReconcilerOptions{
+		Interval: defaultReconcileInterval,
+		Clock:    SystemClock,
+	}
+	for _, opt := range opts {
+		if err := opt(&options); err != nil {
+			return nil, err
+		}
+	}
+	copyOptions, err := newCopyOptions(options.CopyOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &Reconciler{
+		source:       source,
+		inspector:    inspector,
+		destination:  destination,
+		repositories: repositories,
+		options:      options,
+		copyOptions:  copyOptions,
+		copied:       map[digest.Digest]digest.Digest{},
+	}, nil
+}
+
+// Run reconciles the repositories every interval until ctx is done, and
+// returns the context's error.  Failures are reported in the results passed
+// to the handler, and retried on the next pass.
+func (r *Reconciler) Run(ctx context.Context) error {
+	for {
+		results, err := r.Reconcile(ctx)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("ecr.reconcile: pass failed")
+		}
+		if r.options.Handler != nil {
+			r.options.Handler(ctx, results)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.options.Clock.After(r.options.Interval):
+		}
+	}
+}
+
+// Reconcile makes a single pass over the repositories, returning the result
+// of each.  An error is returned if any repository failed to reconcile,
+// wrapping the first failure.
+func (r *Reconciler) Reconcile(ctx context.Context) ([]ReconcileResult, error) {
+	results := make([]ReconcileResult, 0, len(r.repositories))
+	var failures int
+	var first error
+	for _, repository := range r.repositories {
+		result := r.reconcile(ctx, repository)
+		results = append(results, result)
+		err := result.Err
+		if err == nil && len(result.Failed) > 0 {
+			tags := make([]string, 0, len(result.Failed))
+			for tag := range result.Failed {
+				tags = append(tags, tag)
+			}
+			sort.Strings(tags)
+			err = fmt.Errorf("%s:%s: %w", repository.Source, tags[0], result.Failed[tags[0]])
+		}
+		if err != nil {
+			failures++
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if failures > 0 {
+		return results, fmt.Errorf("%d of %d repositories failed to reconcile: %w", failures, len(r.repositories), first)
+	}
+	return results, nil
+}
+
+// reconcile copies the tags of repository's source which its destination
+// lacks.
+func (r *Reconciler) reconcile(ctx context.Context, repository MirrorRepository) ReconcileResult {
+	result := ReconcileResult{Repository: repository}
+	sourceTags, err := r.sourceTags(ctx, repository.Source)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	destinationTags, err := r.destinationTags(ctx, repository.Destination, sourceTags)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	tags := make([]string, 0, len(sourceTags))
+	for tag := range sourceTags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		if r.unchanged(ctx, repository.Source+":"+tag, sourceTags[tag], destinationTags[tag]) {
+			result.Unchanged++
+			continue
+		}
+		root, err := Copy(ctx, r.source, repository.Source+":"+tag, r.destination, repository.Destination+":"+tag, r.options.CopyOptions...)
+		if err != nil {
+			log.G(ctx).
+				WithError(err).
+				WithField("source", repository.Source).
+				WithField("tag", tag).
+				Warn("ecr.reconcile: failed to copy tag")
+			if result.Failed == nil {
+				result.Failed = map[string]error{}
+			}
+			result.Failed[tag] = err
+			continue
+		}
+		r.mu.Lock()
+		r.copied[sourceTags[tag]] = root.Digest
+		r.mu.Unlock()
+		result.Copied = append(result.Copied, tag)
+	}
+	log.G(ctx).
+		WithField("source", repository.Source).
+		WithField("destination", repository.Destination).
+		WithField("copied", len(result.Copied)).
+		WithField("unchanged", result.Unchanged).
+		WithField("failed", len(result.Failed)).
+		Debug("ecr.reconcile: reconciled repository")
+	return result
+}
+
+// unchanged reports whether the destination digest of the tag ref, whose
+// digest at the source is source, is that of the image copying ref would
+// push.  Images which the copy would rewrite are planned, without pushing
+// them, the first time they are compared.
+func (r *Reconciler) unchanged(ctx context.Context, ref string, source, destination digest.Digest) bool {
+	if destination == "" {
+		return false
+	}
+	if destination == source {
+		return true
+	}
+	r.mu.Lock()
+	copied, ok := r.copied[source]
+	r.mu.Unlock()
+	if ok {
+		return destination == copied
+	}
+
+	planned, err := r.plan(ctx, ref, source)
+	if err != nil {
+		log.G(ctx).
+			WithError(err).
+			WithField("ref", ref).
+			Debug("ecr.reconcile: failed to plan copy")
+		return false
+	}
+	r.mu.Lock()
+	r.copied[source] = planned
+	r.mu.Unlock()
+	return destination == planned
+}
+
+// plan returns the digest of the image copying ref, whose digest is source,
+// would push.
+func (r *Reconciler) plan(ctx context.Context, ref string, source digest.Digest) (digest.Digest, error) {
+	name, desc, err := r.source.Resolve(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	if desc.Digest != source {
+		return "", fmt.Errorf("%s moved from %s to %s", ref, source, desc.Digest)
+	}
+	fetcher, err := r.source.Fetcher(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	root, err := newCopier(r.copyOptions, fetcher).plan(ctx, desc)
+	if err != nil {
+		return "", err
+	}
+	return root.Digest, nil
+}
+
+// sourceTags returns the digest of each tag of the source repository.
+func (r *Reconciler) sourceTags(ctx context.Context, repository string) (map[string]digest.Digest, error) {
+	images, err := r.inspector.InspectImages(ctx, repository)
+	if err != nil {
+		return nil, err
+	}
+	return imageTags(images), nil
+}
+
+// destinationTags returns the digest of each tag of the destination
+// repository, listing its images if the destination can, and otherwise
+// resolving the tags of the source.  A missing repository has no tags.
+func (r *Reconciler) destinationTags(ctx context.Context, repository string, sourceTags map[string]digest.Digest) (map[string]digest.Digest, error) {
+	if inspector, ok := r.destination.(ImageInspector); ok {
+		images, err := inspector.InspectImages(ctx, repository)
+		if errors.Is(err, ErrRepositoryNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return imageTags(images), nil
+	}
+	tags := map[string]digest.Digest{}
+	for tag := range sourceTags {
+		_, desc, err := r.destination.Resolve(ctx, repository+":"+tag)
+		if errdefs.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tags[tag] = desc.Digest
+	}
+	return tags, nil
+}
+
+// imageTags returns the digest of each tag of images.
+func imageTags(images []ImageInfo) map[string]digest.Digest {
+	tags := map[string]digest.Digest{}
+	for _, image := range images {
+		for _, tag := range image.Tags {
+			tags[tag] = image.Digest
+		}
+	}
+	return tags
+}
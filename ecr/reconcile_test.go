@@ -0,0 +1,191 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// inspectableRegistry is a fakeRegistry listing the tags of its repositories
+// as ECR's DescribeImages does.
+type inspectableRegistry struct {
+	*fakeRegistry
+}
+
+var _ ImageInspector = inspectableRegistry{}
+
+func (r inspectableRegistry) InspectImage(ctx context.Context, ref string) (*ImageInfo, error) {
+	_, desc, err := r.Resolve(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageInfo{Digest: desc.Digest, MediaType: desc.MediaType}, nil
+}
+
+func (r inspectableRegistry) InspectImages(_ context.Context, ref string) ([]ImageInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var images []ImageInfo
+	byDigest := map[digest.Digest]int{}
+	for name, desc := range r.refs {
+		if !strings.HasPrefix(name, ref+":") {
+			continue
+		}
+		i, ok := byDigest[desc.Digest]
+		if !ok {
+			i = len(images)
+			byDigest[desc.Digest] = i
+			images = append(images, ImageInfo{Digest: desc.Digest, MediaType: desc.MediaType})
+		}
+		images[i].Tags = append(images[i].Tags, strings.TrimPrefix(name, ref+":"))
+	}
+	return images, nil
+}
+
+func TestReconcile(t *testing.T) {
+	source, destination := inspectableRegistry{newFakeRegistry()}, newFakeRegistry()
+	index, _ := putMultiArchImage(source.fakeRegistry, "app:v2")
+	v1 := source.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	source.tag("app:v1", v1)
+	source.tag("app:latest", index)
+	// The destination already holds v1.
+	destination.tag("mirror/app:v1", v1)
+
+	reconciler, err := NewReconciler(source, destination, []MirrorRepository{{Source: "app", Destination: "mirror/app"}})
+	require.NoError(t, err)
+	results, err := reconciler.Reconcile(context.Background())
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, []string{"latest", "v2"}, results[0].Copied)
+	assert.Equal(t, 1, results[0].Unchanged)
+	for _, tag := range []string{"latest", "v2"} {
+		_, desc, err := destination.Resolve(context.Background(), "mirror/app:"+tag)
+		require.NoError(t, err)
+		assert.Equal(t, index.Digest, desc.Digest, tag)
+	}
+
+	results, err = reconciler.Reconcile(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, results[0].Copied, "tags already mirrored should not be copied again")
+	assert.Equal(t, 3, results[0].Unchanged)
+
+	// Moving a tag at the source copies it again.
+	source.tag("app:v1", index)
+	results, err = reconciler.Reconcile(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v1"}, results[0].Copied)
+}
+
+func TestReconcilePlatforms(t *testing.T) {
+	source, destination := inspectableRegistry{newFakeRegistry()}, inspectableRegistry{newFakeRegistry()}
+	index, _ := putMultiArchImage(source.fakeRegistry, "app:v1")
+	repositories := []MirrorRepository{{Source: "app", Destination: "mirror/app"}}
+
+	reconciler, err := NewReconciler(source, destination, repositories,
+		WithReconcileCopyOptions(WithCopyPlatforms("linux/amd64")))
+	require.NoError(t, err)
+	results, err := reconciler.Reconcile(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v1"}, results[0].Copied)
+	_, desc, err := destination.Resolve(context.Background(), "mirror/app:v1")
+	require.NoError(t, err)
+	require.NotEqual(t, index.Digest, desc.Digest, "filtered index should be rewritten")
+
+	results, err = reconciler.Reconcile(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, results[0].Copied, "filtered tags already mirrored should not be copied again")
+	assert.Equal(t, 1, results[0].Unchanged)
+
+	// A new reconciler plans the copy to compare the destination with.
+	reconciler, err = NewReconciler(source, destination, repositories,
+		WithReconcileCopyOptions(WithCopyPlatforms("linux/amd64")))
+	require.NoError(t, err)
+	results, err = reconciler.Reconcile(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, results[0].Copied, "filtered tags already mirrored should not be copied again")
+	assert.Equal(t, 1, results[0].Unchanged)
+
+	// Mirroring another platform copies the tag again.
+	reconciler, err = NewReconciler(source, destination, repositories,
+		WithReconcileCopyOptions(WithCopyPlatforms("linux/arm64")))
+	require.NoError(t, err)
+	results, err = reconciler.Reconcile(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v1"}, results[0].Copied)
+}
+
+func TestReconcileFailure(t *testing.T) {
+	source, destination := inspectableRegistry{newFakeRegistry()}, inspectableRegistry{newFakeRegistry()}
+	good := source.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	source.tag("app:good", good)
+	// The broken image's manifest cannot be fetched.
+	broken := source.putImage(ocispec.Platform{OS: "linux", Architecture: "s390x"})
+	source.tag("app:broken", broken)
+	delete(source.blob, broken.Digest)
+
+	reconciler, err := NewReconciler(source, destination, []MirrorRepository{{Source: "app", Destination: "app"}})
+	require.NoError(t, err)
+	results, err := reconciler.Reconcile(context.Background())
+	require.Error(t, err)
+	assert.True(t, errdefs.IsNotFound(err), "error should be that of the failed copy: %v", err)
+	assert.Equal(t, []string{"good"}, results[0].Copied, "other tags should still be copied")
+	require.Contains(t, results[0].Failed, "broken")
+	assert.True(t, errdefs.IsNotFound(results[0].Failed["broken"]))
+}
+
+func TestReconcilerRun(t *testing.T) {
+	source, destination := inspectableRegistry{newFakeRegistry()}, newFakeRegistry()
+	source.tag("app:v1", source.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"}))
+	clock := &fakeClock{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var passes [][]ReconcileResult
+	reconciler, err := NewReconciler(source, destination,
+		[]MirrorRepository{{Source: "app", Destination: "app"}},
+		WithReconcileClock(clock),
+		WithReconcileHandler(func(_ context.Context, results []ReconcileResult) {
+			passes = append(passes, results)
+			if len(passes) == 2 {
+				cancel()
+			}
+		}))
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, reconciler.Run(ctx), context.Canceled)
+	require.Len(t, passes, 2)
+	assert.Equal(t, []string{"v1"}, passes[0][0].Copied)
+	assert.Equal(t, 1, passes[1][0].Unchanged)
+	assert.Contains(t, clock.waits, defaultReconcileInterval)
+}
+
+func TestNewReconcilerInvalid(t *testing.T) {
+	_, err := NewReconciler(newFakeRegistry(), newFakeRegistry(), nil)
+	assert.True(t, errdefs.IsInvalidArgument(err), "source should be required to list its images")
+
+	source := inspectableRegistry{newFakeRegistry()}
+	_, err = NewReconciler(source, newFakeRegistry(), []MirrorRepository{{Source: "app"}})
+	assert.True(t, errdefs.IsInvalidArgument(err))
+	_, err = NewReconciler(source, newFakeRegistry(), nil, WithReconcileInterval(0))
+	assert.Error(t, err)
+}
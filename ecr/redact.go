@@ -0,0 +1,125 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// redacted replaces the queries of URLs written to logs and errors.
+const redacted = "REDACTED"
+
+type urlLoggingKey struct{}
+
+// withURLLogging returns a context in which the URLs that layers are
+// downloaded from are written to logs and errors as they are.
+func withURLLogging(ctx context.Context) context.Context {
+	return context.WithValue(ctx, urlLoggingKey{}, true)
+}
+
+// logsURLs reports whether download URLs are written to logs and errors in
+// ctx as they are.
+func logsURLs(ctx context.Context) bool {
+	logs, _ := ctx.Value(urlLoggingKey{}).(bool)
+	return logs
+}
+
+// loggedURL returns rawURL as it may be written to logs and errors in ctx.
+// The query of a presigned URL holds the credentials authorizing the
+// download, so it is redacted unless URLs are logged.
+func loggedURL(ctx context.Context, rawURL string) string {
+	if logsURLs(ctx) {
+		return rawURL
+	}
+	return redactURL(rawURL)
+}
+
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redacted
+	}
+	if u.RawQuery == "" && u.User == nil && u.Fragment == "" {
+		return rawURL
+	}
+	u.User = nil
+	u.Fragment = ""
+	if u.RawQuery != "" {
+		u.RawQuery = redacted
+	}
+	return u.String()
+}
+
+// redactError returns err with the query of rawURL redacted from its message
+// unless URLs are logged in ctx.  The URLs of *url.Error in its chain, as
+// returned by HTTP clients, are redacted in place.
+func redactError(ctx context.Context, err error, rawURL string) error {
+	if err == nil || logsURLs(ctx) {
+		return err
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = redactURL(urlErr.URL)
+	}
+	// The query is found in the URL as given, which may not parse.
+	i := strings.IndexByte(rawURL, '?')
+	if i < 0 {
+		return err
+	}
+	query := rawURL[i+1:]
+	if j := strings.IndexByte(query, '#'); j >= 0 {
+		query = query[:j]
+	}
+	if query == "" || !strings.Contains(err.Error(), query) {
+		return err
+	}
+	return &redactedError{err: err, query: query}
+}
+
+// redactedError is an error whose message held the query of a presigned URL.
+type redactedError struct {
+	err   error
+	query string
+}
+
+func (e *redactedError) Error() string {
+	return strings.ReplaceAll(e.err.Error(), e.query, redacted)
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// withoutBodyLogging keeps the AWS SDK from logging the body of the response
+// to a request, such as the presigned URL returned by GetDownloadUrlForLayer.
+func withoutBodyLogging(r *request.Request) {
+	level := r.Config.LogLevel.Value()
+	if level.Matches(aws.LogDebugWithHTTPBody) {
+		r.Config.LogLevel = aws.LogLevel(level &^ (aws.LogDebugWithHTTPBody &^ aws.LogDebug))
+	}
+}
+
+// withoutLogging keeps the AWS SDK from logging a request sent to a presigned
+// URL, whose request line holds the URL's credentials.
+func withoutLogging(r *request.Request) {
+	r.Config.LogLevel = aws.LogLevel(aws.LogOff)
+}
@@ -40,14 +40,18 @@ var (
 	// Expecting to match ECR image names of the form:
 	// Example 1: 777777777777.dkr.ecr.us-west-2.amazonaws.com/my_image:latest
 	// Example 2: 777777777777.dkr.ecr.cn-north-1.amazonaws.com.cn/my_image:latest
-	// TODO: Support ECR FIPS endpoints, i.e "ecr-fips" in the URL instead of "ecr"
-	ecrRegex           = regexp.MustCompile(`(^[a-zA-Z0-9][a-zA-Z0-9-_]*)\.dkr\.ecr\.([a-zA-Z0-9][a-zA-Z0-9-_]*)\.amazonaws\.com(\.cn)?.*`)
+	// Example 3 (FIPS): 777777777777.dkr.ecr-fips.us-east-1.amazonaws.com/my_image:latest
+	// Example 4 (dual-stack): 777777777777.dkr-ecr.us-west-2.on.aws/my_image:latest
+	// Example 5 (FIPS dual-stack): 777777777777.dkr-ecr-fips.us-east-1.on.aws/my_image:latest
+	ecrRegex           = regexp.MustCompile(`^([a-zA-Z0-9][a-zA-Z0-9-_]*)\.(?:dkr\.ecr(?:-fips)?\.([a-zA-Z0-9][a-zA-Z0-9-_]*)\.amazonaws\.com(?:\.cn)?|dkr-ecr(?:-fips)?\.([a-zA-Z0-9][a-zA-Z0-9-_]*)\.on\.aws)/`)
 	errInvalidImageURI = errors.New("ecrspec: invalid image URI")
 )
 
 // ECRSpec represents a parsed reference.
 //
-// Valid references are of the form "ecr.aws/arn:aws:ecr:<region>:<account>:repository/<name>:<tag>".
+// Valid references are of the form "ecr.aws/arn:aws:ecr:<region>:<account>:repository/<name>:<tag>",
+// or name the image by its registry's hostname, such as
+// "<account>.dkr.ecr.<region>.amazonaws.com/<name>:<tag>".
 type ECRSpec struct {
 	// Repository name for this reference.
 	Repository string
@@ -58,9 +62,14 @@ type ECRSpec struct {
 	arn arn.ARN
 }
 
-// ParseRef parses an ECR reference into its constituent parts
+// ParseRef parses an ECR reference into its constituent parts.  References
+// naming images by their registry's hostname, including FIPS and dual-stack
+// hostnames, are parsed with ParseImageURI and so converted to the ARN form.
 func ParseRef(ref string) (ECRSpec, error) {
 	if !strings.HasPrefix(ref, refPrefix) {
+		if ecrRegex.MatchString(ref) {
+			return ParseImageURI(ref)
+		}
 		return ECRSpec{}, invalidARN
 	}
 	stripped := ref[len(refPrefix):]
@@ -73,11 +82,15 @@ func ParseImageURI(input string) (ECRSpec, error) {
 
 	// Matching on account, region
 	matches := ecrRegex.FindStringSubmatch(input)
-	if len(matches) < 3 {
+	if len(matches) < 4 {
 		return ECRSpec{}, errInvalidImageURI
 	}
 	account := matches[1]
 	region := matches[2]
+	if region == "" {
+		// Dual-stack hostname.
+		region = matches[3]
+	}
 
 	// Get the correct partition given its region
 	partition, found := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
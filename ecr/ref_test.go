@@ -224,6 +224,21 @@ func TestParseImageURIValid(t *testing.T) {
 			"777777777777.dkr.ecr.us-gov-east-1.amazonaws.com/my_image:latest",
 			"ecr.aws/arn:aws-us-gov:ecr:us-gov-east-1:777777777777:repository/my_image:latest",
 		},
+		{
+			"FIPS",
+			"777777777777.dkr.ecr-fips.us-east-1.amazonaws.com/my_image:latest",
+			"ecr.aws/arn:aws:ecr:us-east-1:777777777777:repository/my_image:latest",
+		},
+		{
+			"Dual-stack",
+			"777777777777.dkr-ecr.us-west-2.on.aws/foo/my_image:latest",
+			"ecr.aws/arn:aws:ecr:us-west-2:777777777777:repository/foo/my_image:latest",
+		},
+		{
+			"FIPS dual-stack",
+			"777777777777.dkr-ecr-fips.us-gov-west-1.on.aws/my_image:latest",
+			"ecr.aws/arn:aws-us-gov:ecr:us-gov-west-1:777777777777:repository/my_image:latest",
+		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -257,6 +272,14 @@ func TestParseImageURIInvalid(t *testing.T) {
 			"not an ecr image",
 			"docker.io/library/hello-world",
 		},
+		{
+			"dual-stack name on IPv4 domain",
+			"777777777777.dkr-ecr.us-west-2.amazonaws.com/repo-name:latest",
+		},
+		{
+			"registry hostname within path",
+			"example.com/777777777777.dkr.ecr.us-west-2.amazonaws.com/repo-name:latest",
+		},
 		{
 			"missing repository",
 			"777777777777.dkr.ecr.us-west-2.amazonaws.com/",
@@ -291,3 +314,20 @@ func TestParseImageURIInvalid(t *testing.T) {
 		})
 	}
 }
+
+func TestParseRefImageURI(t *testing.T) {
+	for _, ref := range []string{
+		"777777777777.dkr.ecr.us-west-2.amazonaws.com/foo/bar:latest",
+		"777777777777.dkr.ecr-fips.us-west-2.amazonaws.com/foo/bar:latest",
+		"777777777777.dkr-ecr.us-west-2.on.aws/foo/bar:latest",
+	} {
+		spec, err := ParseRef(ref)
+		require.NoError(t, err, ref)
+		assert.Equal(t, "ecr.aws/arn:aws:ecr:us-west-2:777777777777:repository/foo/bar:latest", spec.Canonical(), ref)
+	}
+
+	_, err := ParseRef("docker.io/library/hello-world:latest")
+	assert.Equal(t, invalidARN, err)
+	_, err = ParseRef("777777777777.dkr.ecr.us-west-2.amazonaws.com/foo:")
+	assert.Error(t, err)
+}
@@ -0,0 +1,296 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ReferrerLister is implemented by resolvers able to list the artifacts, such
+// as signatures, SBOMs, and attestations, which refer to a manifest.
+// containerd's Resolver interface offers no way to discover them.  The
+// resolver returned by NewResolver implements it.
+type ReferrerLister interface {
+	// Referrers returns the artifacts referring to desc in the repository
+	// named by ref, ignoring its tag or digest.
+	Referrers(ctx context.Context, ref string, desc ocispec.Descriptor) ([]Referrer, error)
+}
+
+var _ ReferrerLister = (*ecrResolver)(nil)
+
+// Referrer is the descriptor of an artifact referring to a manifest, along
+// with the artifact's type.
+type Referrer struct {
+	ocispec.Descriptor
+	// ArtifactType is the type of the artifact, such as
+	// application/vnd.dev.cosign.simplesigning.v1+json for cosign
+	// signatures.
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// referrerTagSuffixes are appended to the tag derived from a digest by tools
+// that attach artifacts to images in registries without a referrers API.  The
+// empty suffix is the OCI referrers tag schema, used for SOCI indexes and
+// other OCI artifacts; the others are used by cosign for signatures,
+// attestations, and SBOMs.
+var referrerTagSuffixes = []string{"", ".sig", ".att", ".sbom"}
+
+// referrerTags returns the tags under which artifacts referring to dgst may
+// be stored.
+func referrerTags(dgst digest.Digest) []string {
+	base := dgst.Algorithm().String() + "-" + dgst.Encoded()
+	tags := make([]string, 0, len(referrerTagSuffixes))
+	for _, suffix := range referrerTagSuffixes {
+		tags = append(tags, base+suffix)
+	}
+	return tags
+}
+
+// splitTag splits ref into its name and tag, discarding any digest.  The ref
+// is split textually rather than with reference.Parse, which does not accept
+// the colons of an ARN.
+func splitTag(ref string) (name, tag string) {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// withTag returns ref with its tag and digest replaced by tag.
+func withTag(ref, tag string) string {
+	name, _ := splitTag(ref)
+	return name + ":" + tag
+}
+
+// withDigest returns ref with its tag and digest replaced by dgst.
+func withDigest(ref string, dgst digest.Digest) string {
+	name, _ := splitTag(ref)
+	return name + "@" + dgst.String()
+}
+
+// isReferrerTag reports whether tag is one of the tags returned by
+// referrerTags.
+func isReferrerTag(tag string) bool {
+	for _, suffix := range referrerTagSuffixes {
+		if suffix != "" && !strings.HasSuffix(tag, suffix) {
+			continue
+		}
+		dgst := digest.Digest(strings.Replace(strings.TrimSuffix(tag, suffix), "-", ":", 1))
+		if dgst.Validate() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// referrerArtifactType returns the artifact type of the referrer manifest or
+// index in data of the given media type: its artifactType, or the media type
+// of its config unless that is a plain image config, or the media type of its
+// first layer, or failing all of those mediaType itself.
+func referrerArtifactType(ctx context.Context, data []byte, mediaType string, lenient bool) (string, error) {
+	var artifact struct {
+		ArtifactType string               `json:"artifactType"`
+		Config       *ocispec.Descriptor  `json:"config"`
+		Layers       []ocispec.Descriptor `json:"layers"`
+	}
+	if err := decodeManifest(ctx, data, &artifact, lenient); err != nil {
+		return "", err
+	}
+	switch {
+	case artifact.ArtifactType != "":
+		return artifact.ArtifactType, nil
+	case artifact.Config != nil && artifact.Config.MediaType != "" && artifact.Config.MediaType != ocispec.MediaTypeImageConfig:
+		return artifact.Config.MediaType, nil
+	case len(artifact.Layers) > 0:
+		return artifact.Layers[0].MediaType, nil
+	}
+	return mediaType, nil
+}
+
+// containsString reports whether values contains value.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Referrers lists the artifacts referring to desc through their subject
+// field, using the registry's OCI referrers API.  Registries without the API
+// are searched for artifacts stored under the tags of the OCI referrers tag
+// schema and of cosign instead.
+func (r *ecrResolver) Referrers(ctx context.Context, ref string, desc ocispec.Descriptor) ([]Referrer, error) {
+	ecrSpec, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	referrers, err := r.listReferrers(ctx, ecrSpec, desc.Digest)
+	if errdefs.IsNotImplemented(err) {
+		log.G(ctx).WithError(err).Debug("ecr.resolver.referrers: listing tagged referrers")
+		referrers, err = r.taggedReferrers(ctx, ecrSpec, desc.Digest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.G(ctx).
+		WithField("subject", desc.Digest).
+		WithField("referrers", len(referrers)).
+		Debug("ecr.resolver.referrers: listed referrers")
+	return referrers, nil
+}
+
+// listReferrers lists the referrers of dgst in ecrSpec's repository with the
+// OCI referrers API, following every page of results.  An error wrapping
+// errdefs.ErrNotImplemented is returned if the registry does not offer the
+// API.
+func (r *ecrResolver) listReferrers(ctx context.Context, ecrSpec ECRSpec, dgst digest.Digest) ([]Referrer, error) {
+	api := r.getRegistryAPI()
+	endpoint, token, err := api.authorize(ctx, r.getClient(ecrSpec.Region(), ecrSpec.Registry()), ecrSpec)
+	if err != nil {
+		return nil, err
+	}
+	referrers := []Referrer{}
+	target := fmt.Sprintf("%s/v2/%s/referrers/%s", endpoint, ecrSpec.Repository, dgst)
+	for target != "" {
+		req, err := http.NewRequest(http.MethodGet, target, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", ocispec.MediaTypeImageIndex)
+		resp, err := api.do(ctx, req, token)
+		if err != nil {
+			return nil, err
+		}
+		var page []Referrer
+		page, target, err = readReferrersPage(resp)
+		if err != nil {
+			return nil, err
+		}
+		referrers = append(referrers, page...)
+	}
+	return referrers, nil
+}
+
+// linkNext matches the URL of the next page of results in a Link header.
+var linkNext = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// readReferrersPage returns the referrers listed in resp and the URL of the
+// next page of results, if any.
+func readReferrersPage(resp *http.Response) ([]Referrer, string, error) {
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, "", fmt.Errorf("referrers API: %v: %w", resp.Status, errdefs.ErrNotImplemented)
+	default:
+		statusErr := &httpStatusError{url: resp.Request.URL.String(), statusCode: resp.StatusCode, status: resp.Status}
+		return nil, "", statusErr
+	}
+	var index struct {
+		Manifests []Referrer `json:"manifests"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, "", fmt.Errorf("failed to decode referrers: %v: %w", err, ErrInvalidManifest)
+	}
+	var next string
+	if match := linkNext.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+		nextURL, err := resp.Request.URL.Parse(match[1])
+		if err != nil {
+			return nil, "", err
+		}
+		next = nextURL.String()
+	}
+	return index.Manifests, next, nil
+}
+
+// taggedReferrers lists the referrers of dgst stored in ecrSpec's repository
+// under the tags returned by referrerTags: the index of the OCI referrers tag
+// schema, whose manifests are the referrers, and the artifacts tagged by
+// cosign.
+func (r *ecrResolver) taggedReferrers(ctx context.Context, ecrSpec ECRSpec, dgst digest.Digest) ([]Referrer, error) {
+	name := refPrefix + ecrSpec.ARN()
+	tagSchema := referrerTags(dgst)[0]
+	referrers := []Referrer{}
+	seen := map[digest.Digest]bool{}
+	for _, tag := range referrerTags(dgst) {
+		ref := withTag(name, tag)
+		_, desc, err := r.Resolve(ctx, ref)
+		if errdefs.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.fetchReferrer(ctx, ref, desc)
+		if err != nil {
+			return nil, err
+		}
+		if tag == tagSchema && desc.MediaType == ocispec.MediaTypeImageIndex {
+			var index struct {
+				Manifests []Referrer `json:"manifests"`
+			}
+			if err := json.Unmarshal(data, &index); err != nil {
+				return nil, fmt.Errorf("failed to parse referrers index %s: %v: %w", tag, err, ErrInvalidManifest)
+			}
+			for _, referrer := range index.Manifests {
+				if !seen[referrer.Digest] {
+					seen[referrer.Digest] = true
+					referrers = append(referrers, referrer)
+				}
+			}
+			continue
+		}
+		artifactType, err := referrerArtifactType(ctx, data, desc.MediaType, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse referrer %s: %v: %w", tag, err, ErrInvalidManifest)
+		}
+		if !seen[desc.Digest] {
+			seen[desc.Digest] = true
+			referrers = append(referrers, Referrer{Descriptor: desc, ArtifactType: artifactType})
+		}
+	}
+	return referrers, nil
+}
+
+// fetchReferrer returns the content of the referrer desc resolved from ref.
+func (r *ecrResolver) fetchReferrer(ctx context.Context, ref string, desc ocispec.Descriptor) ([]byte, error) {
+	fetcher, err := r.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newReferrersTestResolver returns a resolver sending requests for the
+// registry's HTTP API to registry and ECR API requests to client.
+func newReferrersTestResolver(t *testing.T, registry *httptest.Server, client *fakeECRClient) ReferrerLister {
+	client.GetAuthorizationTokenFn = func(aws.Context, *ecr.GetAuthorizationTokenInput, ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+		return &ecr.GetAuthorizationTokenOutput{AuthorizationData: []*ecr.AuthorizationData{{
+			AuthorizationToken: aws.String("token"),
+			ProxyEndpoint:      aws.String(registry.URL),
+		}}}, nil
+	}
+	resolver, err := NewResolver()
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	return resolver.(ReferrerLister)
+}
+
+func TestReferrers(t *testing.T) {
+	subject := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("image")}
+	signature := Referrer{
+		Descriptor:   ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("signature"), Size: 10},
+		ArtifactType: "application/vnd.dev.cosign.artifact.sig.v1+json",
+	}
+	sbom := Referrer{
+		Descriptor:   ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("sbom"), Size: 20},
+		ArtifactType: "application/spdx+json",
+	}
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/foo/bar/referrers/"+subject.Digest.String(), r.URL.Path)
+		assert.Equal(t, ocispec.MediaTypeImageIndex, r.Header.Get("Accept"))
+		assert.Equal(t, "Basic token", r.Header.Get("Authorization"))
+		page := []Referrer{signature}
+		if r.URL.Query().Get("last") == "" {
+			w.Header().Set("Link", `<`+r.URL.Path+`?last=signature>; rel="next"`)
+		} else {
+			page = []Referrer{sbom}
+		}
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     ocispec.MediaTypeImageIndex,
+			"manifests":     page,
+		})
+	}))
+	defer registry.Close()
+	lister := newReferrersTestResolver(t, registry, &fakeECRClient{})
+
+	referrers, err := lister.Referrers(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest", subject)
+	require.NoError(t, err)
+	assert.Equal(t, []Referrer{signature, sbom}, referrers, "every page should be listed")
+}
+
+func TestReferrersTagFallback(t *testing.T) {
+	subject := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("image")}
+	signatureTag := "sha256-" + subject.Digest.Encoded() + ".sig"
+	signatureManifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",` +
+		`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"` + digest.FromString("config").String() + `","size":2},` +
+		`"layers":[{"mediaType":"application/vnd.dev.cosign.simplesigning.v1+json","digest":"` + digest.FromString("payload").String() + `","size":7}]}`
+	signatureDigest := digest.FromString(signatureManifest)
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer registry.Close()
+	var tags []string
+	client := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			id := input.ImageIds[0]
+			if id.ImageTag != nil {
+				tags = append(tags, aws.StringValue(id.ImageTag))
+			}
+			if aws.StringValue(id.ImageTag) != signatureTag && aws.StringValue(id.ImageDigest) != signatureDigest.String() {
+				return &ecr.BatchGetImageOutput{Failures: []*ecr.ImageFailure{
+					{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)},
+				}}, nil
+			}
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(signatureDigest.String())},
+				ImageManifest: aws.String(signatureManifest),
+			}}}, nil
+		},
+	}
+	lister := newReferrersTestResolver(t, registry, client)
+
+	referrers, err := lister.Referrers(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest", subject)
+	require.NoError(t, err)
+	require.Len(t, referrers, 1)
+	assert.Equal(t, signatureDigest, referrers[0].Digest)
+	assert.Equal(t, "application/vnd.dev.cosign.simplesigning.v1+json", referrers[0].ArtifactType)
+	assert.Equal(t, referrerTags(subject.Digest), tags, "every referrer tag should be resolved")
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/log"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// registryTokenRefresh is how long before its expiry a registry's
+// authorization token is refreshed, so that requests are not sent with a
+// token about to expire.
+const registryTokenRefresh = 5 * time.Minute
+
+// registryTokenLifetime is how long an authorization token is used for if ECR
+// does not return its expiry.  ECR's tokens are valid for 12 hours.
+const registryTokenLifetime = 12 * time.Hour
+
+// registryAPI sends requests to the Docker Registry HTTP API of ECR
+// registries, for the operations which ECR's API does not offer.  The
+// authorization token of each registry is kept until it expires, so that the
+// requests of a resolver share it.
+type registryAPI struct {
+	httpClient *http.Client
+	clock      Clock
+
+	lock   sync.Mutex
+	tokens map[string]registryToken
+}
+
+func newRegistryAPI(httpClient *http.Client, clock Clock) *registryAPI {
+	return &registryAPI{httpClient: httpClient, clock: clock, tokens: map[string]registryToken{}}
+}
+
+// registryToken is an authorization token for a registry's endpoint.
+type registryToken struct {
+	endpoint string
+	token    string
+	expires  time.Time
+}
+
+// authorize returns the endpoint of ecrSpec's registry and an authorization
+// token for it, requesting them from ECR unless a token which has not expired
+// is kept.  Failures to request a token are not kept, so the next request
+// tries again.
+func (a *registryAPI) authorize(ctx context.Context, client ecrAPI, ecrSpec ECRSpec) (string, string, error) {
+	clock := a.clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	key := ecrSpec.Region() + "/" + ecrSpec.Registry()
+	a.lock.Lock()
+	cached, ok := a.tokens[key]
+	a.lock.Unlock()
+	if ok && clock.Now().Before(cached.expires.Add(-registryTokenRefresh)) {
+		return cached.endpoint, cached.token, nil
+	}
+
+	output, err := client.GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{
+		RegistryIds: []*string{aws.String(ecrSpec.Registry())},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if len(output.AuthorizationData) == 0 {
+		return "", "", errors.New("ecr.registry: no authorization data")
+	}
+	data := output.AuthorizationData[0]
+	token := registryToken{
+		endpoint: strings.TrimSuffix(aws.StringValue(data.ProxyEndpoint), "/"),
+		token:    aws.StringValue(data.AuthorizationToken),
+		expires:  aws.TimeValue(data.ExpiresAt),
+	}
+	if data.ExpiresAt == nil {
+		token.expires = clock.Now().Add(registryTokenLifetime)
+	}
+	log.G(ctx).
+		WithField("registry", ecrSpec.Registry()).
+		WithField("expires", token.expires).
+		Debug("ecr.registry: authorized")
+	a.lock.Lock()
+	if a.tokens == nil {
+		a.tokens = map[string]registryToken{}
+	}
+	a.tokens[key] = token
+	a.lock.Unlock()
+	return token.endpoint, token.token, nil
+}
+
+// do sends req authorized with token.
+func (a *registryAPI) do(ctx context.Context, req *http.Request, token string) (*http.Response, error) {
+	req.Header.Set("Authorization", "Basic "+token)
+	return ctxhttp.Do(ctx, a.httpClient, req)
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryAPIAuthorize(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	requests := 0
+	var failure error
+	client := &fakeECRClient{
+		GetAuthorizationTokenFn: func(_ aws.Context, input *ecr.GetAuthorizationTokenInput, _ ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+			requests++
+			if failure != nil {
+				return nil, failure
+			}
+			return &ecr.GetAuthorizationTokenOutput{AuthorizationData: []*ecr.AuthorizationData{{
+				AuthorizationToken: aws.String(aws.StringValue(input.RegistryIds[0])),
+				ProxyEndpoint:      aws.String("https://registry.example.com/"),
+				ExpiresAt:          aws.Time(clock.Now().Add(time.Hour)),
+			}}}, nil
+		},
+	}
+	api := newRegistryAPI(nil, clock)
+	spec := func(registry string) ECRSpec {
+		spec, err := ParseRef("ecr.aws/arn:aws:ecr:fake:" + registry + ":repository/foo/bar:latest")
+		require.NoError(t, err)
+		return spec
+	}
+
+	failure = errors.New("expected")
+	_, _, err := api.authorize(ctx, client, spec("123456789012"))
+	assert.EqualError(t, err, "expected")
+
+	failure = nil
+	endpoint, token, err := api.authorize(ctx, client, spec("123456789012"))
+	require.NoError(t, err)
+	assert.Equal(t, "https://registry.example.com", endpoint)
+	assert.Equal(t, "123456789012", token)
+	assert.Equal(t, 2, requests, "a failure should not be kept")
+
+	_, _, err = api.authorize(ctx, client, spec("123456789012"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, requests, "the token should be kept until it expires")
+
+	_, token, err = api.authorize(ctx, client, spec("210987654321"))
+	require.NoError(t, err)
+	assert.Equal(t, "210987654321", token, "each registry should have its own token")
+	assert.Equal(t, 3, requests)
+
+	clock.advance(time.Hour - registryTokenRefresh)
+	_, _, err = api.authorize(ctx, client, spec("123456789012"))
+	require.NoError(t, err)
+	assert.Equal(t, 4, requests, "a token about to expire should be refreshed")
+}
+
+func TestReferrersShareRegistryToken(t *testing.T) {
+	subject := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("image")}
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     ocispec.MediaTypeImageIndex,
+			"manifests":     []Referrer{},
+		})
+	}))
+	defer registry.Close()
+	requests := 0
+	client := &fakeECRClient{
+		GetAuthorizationTokenFn: func(aws.Context, *ecr.GetAuthorizationTokenInput, ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+			requests++
+			return &ecr.GetAuthorizationTokenOutput{AuthorizationData: []*ecr.AuthorizationData{{
+				AuthorizationToken: aws.String("token"),
+				ProxyEndpoint:      aws.String(registry.URL),
+			}}}, nil
+		},
+	}
+	resolver, err := NewResolver()
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+
+	for i := 0; i < 3; i++ {
+		_, err := resolver.(ReferrerLister).Referrers(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest", subject)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, requests, "listings should share the registry's token")
+}
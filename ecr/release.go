@@ -0,0 +1,124 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ReleaseImage is an image or index pushed by Release.
+type ReleaseImage struct {
+	// Source resolves and fetches the image.
+	Source remotes.Resolver
+	// SourceRef is the reference of the image in Source.
+	SourceRef string
+	// Ref is the reference the image is pushed to.  Its tag, if any, is
+	// applied only once every image of the release has been pushed.
+	Ref string
+}
+
+// ReleaseError is returned by Release when an image of the release could not
+// be tagged.  All of the release's content was pushed, but only the tags
+// listed in Tagged were applied.
+type ReleaseError struct {
+	// Ref is the reference which could not be tagged.
+	Ref string
+	// Tagged lists the references tagged before the failure.
+	Tagged []string
+	Err    error
+}
+
+func (e *ReleaseError) Error() string {
+	return fmt.Sprintf("ecr: failed to tag %s after tagging %v: %v", e.Ref, e.Tagged, e.Err)
+}
+
+func (e *ReleaseError) Unwrap() error {
+	return e.Err
+}
+
+// Release copies a set of images to destination as a single release.  The
+// content of every image, along with its referrers, is pushed by digest
+// first; the tags of the images' references are applied only after all of
+// the content has been pushed.  A release which fails to push leaves the
+// destination's tags untouched, so that a partially pushed release is never
+// pulled by tag.  Options are applied to each image as with Copy.
+//
+// The descriptors of the pushed root manifests or indexes are returned in the
+// order of images.
+func Release(ctx context.Context, destination remotes.Resolver, images []ReleaseImage, opts ...CopyOption) ([]ocispec.Descriptor, error) {
+	options, err := newCopyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	copiers := make([]*copier, len(images))
+	roots := make([]ocispec.Descriptor, len(images))
+	for i, image := range images {
+		ctx := log.WithLogger(ctx, log.G(ctx).WithField("ref", image.Ref))
+		name, desc, err := image.Source.Resolve(ctx, image.SourceRef)
+		if err != nil {
+			return nil, err
+		}
+		fetcher, err := image.Source.Fetcher(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		log.G(ctx).Debug("ecr.release: pushing content")
+		untagged, _ := splitTag(image.Ref)
+		copiers[i] = newCopier(options, fetcher)
+		roots[i], err = copiers[i].copy(ctx, desc, destination, untagged)
+		if err != nil {
+			return nil, fmt.Errorf("failed to push %s: %w", image.Ref, err)
+		}
+		if !options.SkipReferrers {
+			if err := copiers[i].copyReferrers(ctx, image.Source, name, destination, untagged); err != nil {
+				return nil, fmt.Errorf("failed to push %s: %w", image.Ref, err)
+			}
+		}
+	}
+
+	var tagged []string
+	for i, image := range images {
+		if _, tag := splitTag(image.Ref); tag == "" {
+			continue
+		}
+		ctx := log.WithLogger(ctx, log.G(ctx).WithField("ref", image.Ref))
+		log.G(ctx).WithField("digest", roots[i].Digest).Debug("ecr.release: tagging")
+		if err := copiers[i].tag(ctx, destination, image.Ref); err != nil {
+			return nil, &ReleaseError{Ref: image.Ref, Tagged: tagged, Err: err}
+		}
+		tagged = append(tagged, image.Ref)
+	}
+	return roots, nil
+}
+
+// tag pushes the root copied by c to ref, applying ref's tag to it.
+func (c *copier) tag(ctx context.Context, destination remotes.Resolver, ref string) error {
+	root := c.nodes[len(c.nodes)-1]
+	name, tag := splitTag(ref)
+	var err error
+	c.pusher, err = destination.Pusher(ctx, name+":"+tag+"@"+root.desc.Digest.String())
+	if err != nil {
+		return err
+	}
+	return c.push(ctx, root)
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelease(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	index, _ := putMultiArchImage(source, "app")
+	sidecar := source.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	source.tag("sidecar", sidecar)
+	// The destination's tags point at the previous release.
+	previous := destination.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	destination.tag("app:v1", previous)
+
+	roots, err := Release(context.Background(), destination, []ReleaseImage{
+		{Source: source, SourceRef: "app", Ref: "app:v1"},
+		{Source: source, SourceRef: "sidecar", Ref: "sidecar:v1"},
+	})
+	require.NoError(t, err)
+	require.Len(t, roots, 2)
+	assert.Equal(t, index.Digest, roots[0].Digest)
+	assert.Equal(t, sidecar.Digest, roots[1].Digest)
+
+	for ref, expected := range map[string]ocispec.Descriptor{"app:v1": index, "sidecar:v1": sidecar} {
+		_, tagged, err := destination.Resolve(context.Background(), ref)
+		require.NoError(t, err)
+		assert.Equal(t, expected.Digest, tagged.Digest, ref)
+	}
+}
+
+func TestReleaseFailureLeavesTags(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	index, _ := putMultiArchImage(source, "app")
+	// The sidecar's manifest cannot be fetched, failing the release.
+	sidecar := source.putImage(ocispec.Platform{OS: "linux", Architecture: "s390x"})
+	source.tag("sidecar", sidecar)
+	delete(source.blob, sidecar.Digest)
+	previous := destination.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	destination.tag("app:v1", previous)
+
+	_, err := Release(context.Background(), destination, []ReleaseImage{
+		{Source: source, SourceRef: "app", Ref: "app:v1"},
+		{Source: source, SourceRef: "sidecar", Ref: "sidecar:v1"},
+	})
+	require.Error(t, err)
+	assert.True(t, errdefs.IsNotFound(err), "error should be that of the failed push: %v", err)
+
+	assert.True(t, destination.has(index.Digest), "content should be pushed ahead of tags")
+	_, tagged, err := destination.Resolve(context.Background(), "app:v1")
+	require.NoError(t, err)
+	assert.Equal(t, previous.Digest, tagged.Digest, "tags should not move when the release fails")
+	_, _, err = destination.Resolve(context.Background(), "sidecar:v1")
+	assert.True(t, errdefs.IsNotFound(err))
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// VerificationReport records the content verified while pulling or copying
+// images, for audit trails.  Content fetched through a resolver returned by
+// Resolver is checked against the digest and size of its descriptor as it is
+// read, and recorded once it has been read in full.  Content which does not
+// match fails to be read with an error wrapping errdefs.ErrFailedPrecondition.
+//
+// The report is encoded as JSON with its images and blobs sorted, so that the
+// same content produces the same report, which callers may sign.
+type VerificationReport struct {
+	lock    sync.Mutex
+	images  map[string]VerifiedImage
+	blobs   map[digest.Digest]VerifiedBlob
+	retries map[digest.Digest]int
+}
+
+// VerifiedImage is an image reference resolved for a VerificationReport.
+type VerifiedImage struct {
+	Ref       string        `json:"ref"`
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+}
+
+// VerifiedBlob is content verified for a VerificationReport.
+type VerifiedBlob struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	// Size is the number of bytes verified.
+	Size int64 `json:"size"`
+	// Retries is the number of failed attempts to fetch the content which
+	// were retried.
+	Retries int `json:"retries"`
+}
+
+// NewVerificationReport returns an empty VerificationReport.
+func NewVerificationReport() *VerificationReport {
+	return &VerificationReport{
+		images:  map[string]VerifiedImage{},
+		blobs:   map[digest.Digest]VerifiedBlob{},
+		retries: map[digest.Digest]int{},
+	}
+}
+
+// Resolver returns resolver wrapped to record the images it resolves and to
+// verify and record the content fetched with its fetchers.  Pushers are
+// returned unmodified.
+func (r *VerificationReport) Resolver(resolver remotes.Resolver) remotes.Resolver {
+	return &reportResolver{Resolver: resolver, report: r}
+}
+
+// Images returns the images resolved, sorted by reference.
+func (r *VerificationReport) Images() []VerifiedImage {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	images := make([]VerifiedImage, 0, len(r.images))
+	for _, image := range r.images {
+		images = append(images, image)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Ref < images[j].Ref })
+	return images
+}
+
+// Blobs returns the content verified, sorted by digest.
+func (r *VerificationReport) Blobs() []VerifiedBlob {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	blobs := make([]VerifiedBlob, 0, len(r.blobs))
+	for _, blob := range r.blobs {
+		blob.Retries = r.retries[blob.Digest]
+		blobs = append(blobs, blob)
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Digest < blobs[j].Digest })
+	return blobs
+}
+
+// MarshalJSON encodes the report as an object listing its "images" and
+// "blobs".
+func (r *VerificationReport) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Images []VerifiedImage `json:"images"`
+		Blobs  []VerifiedBlob  `json:"blobs"`
+	}{r.Images(), r.Blobs()})
+}
+
+func (r *VerificationReport) resolved(ref string, desc ocispec.Descriptor) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.images[ref] = VerifiedImage{Ref: ref, Digest: desc.Digest, MediaType: desc.MediaType}
+}
+
+func (r *VerificationReport) verified(desc ocispec.Descriptor, size int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.blobs[desc.Digest] = VerifiedBlob{Digest: desc.Digest, MediaType: desc.MediaType, Size: size}
+}
+
+// observe counts the retried fetches of the report's fetchers.
+func (r *VerificationReport) observe(_ context.Context, event Event) {
+	if retry, ok := event.(*LayerFetchRetry); ok {
+		r.lock.Lock()
+		r.retries[retry.Digest]++
+		r.lock.Unlock()
+	}
+}
+
+type reportResolver struct {
+	remotes.Resolver
+	report *VerificationReport
+}
+
+func (r *reportResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	name, desc, err := r.Resolver.Resolve(ctx, ref)
+	if err == nil {
+		r.report.resolved(ref, desc)
+	}
+	return name, desc, err
+}
+
+func (r *reportResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	fetcher, err := r.Resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &reportFetcher{fetcher: fetcher, report: r.report}, nil
+}
+
+type reportFetcher struct {
+	fetcher remotes.Fetcher
+	report  *VerificationReport
+}
+
+func (f *reportFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	rc, err := f.fetcher.Fetch(withEventHandler(ctx, f.report.observe), desc)
+	if err != nil || desc.Digest.Validate() != nil {
+		// Content fetched without a digest cannot be verified.
+		return rc, err
+	}
+	digester := desc.Digest.Algorithm().Digester()
+	return &verifyingReader{
+		ReadCloser: rc,
+		desc:       desc,
+		digester:   digester,
+		counter:    &countingWriter{Writer: digester.Hash()},
+		report:     f.report,
+	}, nil
+}
+
+// verifyingReader verifies content against its descriptor once it has been
+// read in full.
+type verifyingReader struct {
+	io.ReadCloser
+	desc     ocispec.Descriptor
+	digester digest.Digester
+	// counter counts the bytes written to digester.
+	counter *countingWriter
+	report  *VerificationReport
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.counter.Write(p[:n])
+	if err == io.EOF {
+		if verr := v.verify(); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// WriteTo writes the content with the underlying reader's WriteTo, if it has
+// one, so that layers downloaded in parallel are still written directly to w.
+func (v *verifyingReader) WriteTo(w io.Writer) (int64, error) {
+	var (
+		n   int64
+		err error
+	)
+	if wt, ok := v.ReadCloser.(io.WriterTo); ok {
+		n, err = wt.WriteTo(io.MultiWriter(w, v.counter))
+	} else {
+		n, err = copyPooled(io.MultiWriter(w, v.counter), v.ReadCloser)
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, v.verify()
+}
+
+func (v *verifyingReader) verify() error {
+	actual := v.digester.Digest()
+	if actual != v.desc.Digest || v.counter.n != v.desc.Size {
+		return fmt.Errorf("content %s: read %d bytes with digest %s, expected %d bytes: %w",
+			v.desc.Digest, v.counter.n, actual, v.desc.Size, errdefs.ErrFailedPrecondition)
+	}
+	v.report.verified(v.desc, v.counter.n)
+	return nil
+}
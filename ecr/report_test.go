@@ -0,0 +1,120 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerificationReportCopy(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	index, _ := putMultiArchImage(source, "source")
+	report := NewVerificationReport()
+
+	_, err := Copy(context.Background(), report.Resolver(source), "source", destination, "destination")
+	require.NoError(t, err)
+
+	assert.Equal(t, []VerifiedImage{{Ref: "source", Digest: index.Digest, MediaType: ocispec.MediaTypeImageIndex}}, report.Images())
+	blobs := report.Blobs()
+	require.Len(t, blobs, len(source.blob), "every copied blob should be verified")
+	for i, blob := range blobs {
+		assert.Equal(t, int64(len(source.get(blob.Digest))), blob.Size)
+		assert.Zero(t, blob.Retries)
+		if i > 0 {
+			assert.Less(t, string(blobs[i-1].Digest), string(blob.Digest), "blobs should be sorted")
+		}
+	}
+
+	encoded, err := json.Marshal(report)
+	require.NoError(t, err)
+	again, err := json.Marshal(report)
+	require.NoError(t, err)
+	assert.Equal(t, encoded, again, "report should be encoded deterministically")
+}
+
+func TestVerificationReportMismatch(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	manifest := source.putImage(ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	source.tag("source", manifest)
+	layer := digest.FromString("layer for amd64")
+	source.blob[layer] = []byte("tampered layer")
+	report := NewVerificationReport()
+
+	_, err := Copy(context.Background(), report.Resolver(source), "source", destination, "destination")
+	assert.True(t, errdefs.IsFailedPrecondition(err), "tampered layer should fail verification: %v", err)
+	assert.Equal(t, ErrorCategoryVerification, Categorize(err))
+	for _, blob := range report.Blobs() {
+		assert.NotEqual(t, layer, blob.Digest, "tampered layer should not be reported as verified")
+	}
+}
+
+func TestVerificationReportRetries(t *testing.T) {
+	const layerData = "layer"
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, layerData)
+	}))
+	defer server.Close()
+	client := &fakeECRClient{
+		GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(server.URL)}, nil
+		},
+	}
+	resolver, err := NewResolver()
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	report := NewVerificationReport()
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString(layerData),
+		Size:      int64(len(layerData)),
+	}
+
+	fetcher, err := report.Resolver(resolver).Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	rc.Close()
+
+	assert.Equal(t, []VerifiedBlob{{
+		Digest:    desc.Digest,
+		MediaType: desc.MediaType,
+		Size:      desc.Size,
+		Retries:   1,
+	}}, report.Blobs())
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+)
+
+// ErrRepositoryNotFound is returned when the repository named by a reference
+// does not exist in the registry.  It wraps errdefs.ErrNotFound, so that
+// callers checking errdefs.IsNotFound treat a missing repository like a
+// missing image.
+var ErrRepositoryNotFound = fmt.Errorf("ecr: repository not found: %w", errdefs.ErrNotFound)
+
+// checkRepository confirms that the repository named by ecrSpec exists.
+// Repositories found to exist are remembered for the lifetime of the resolver
+// so that the check costs a single DescribeRepositories call per repository.
+// Missing repositories are not remembered, allowing a newly created repository
+// to be used immediately.
+func (r *ecrResolver) checkRepository(ctx context.Context, client ecrAPI, ecrSpec ECRSpec) error {
+	key := ecrSpec.ARN()
+	r.repositoriesLock.Lock()
+	_, known := r.repositories[key]
+	r.repositoriesLock.Unlock()
+	if known {
+		return nil
+	}
+
+	_, err := client.DescribeRepositoriesWithContext(ctx, &ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String(ecrSpec.Registry()),
+		RepositoryNames: []*string{aws.String(ecrSpec.Repository)},
+	})
+	if err != nil {
+		if isRepositoryNotFound(err) {
+			log.G(ctx).
+				WithField("repository", ecrSpec.Repository).
+				Debug("ecr.resolver.repository: repository does not exist")
+			return fmt.Errorf("%s: %w", ecrSpec.Repository, ErrRepositoryNotFound)
+		}
+		return err
+	}
+
+	r.repositoriesLock.Lock()
+	if r.repositories == nil {
+		r.repositories = map[string]struct{}{}
+	}
+	r.repositories[key] = struct{}{}
+	r.repositoriesLock.Unlock()
+	return nil
+}
+
+// isRepositoryNotFound reports whether err is ECR's repository not found
+// error.
+func isRepositoryNotFound(err error) bool {
+	return isAWSErrorCode(err, ecr.ErrCodeRepositoryNotFoundException)
+}
+
+// isAWSErrorCode reports whether err is an AWS error with the given code.
+func isAWSErrorCode(err error, code string) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == code
+}
+
+// RepositoryInspector is implemented by resolvers able to describe the
+// configuration of the repository named by a ref.  The resolver returned by
+// NewResolver implements it.
+type RepositoryInspector interface {
+	InspectRepository(ctx context.Context, ref string) (*RepositoryInfo, error)
+}
+
+var _ RepositoryInspector = (*ecrResolver)(nil)
+
+// RepositoryInfo describes the configuration of a repository affecting the
+// images pushed to it.  Inspecting a repository before a push can explain why
+// the push would fail, such as when a tag is immutable, or why it may have
+// surprising effects, such as replication to other regions.
+type RepositoryInfo struct {
+	// ARN of the repository.
+	ARN string
+	// URI of the repository, as used by docker.
+	URI string
+	// ImageTagMutability is either ecr.ImageTagMutabilityMutable or
+	// ecr.ImageTagMutabilityImmutable.  Existing tags of immutable
+	// repositories cannot be pushed again.
+	ImageTagMutability string
+	// EncryptionType is either ecr.EncryptionTypeAes256 or
+	// ecr.EncryptionTypeKms.
+	EncryptionType string
+	// KMSKey is the key used when EncryptionType is ecr.EncryptionTypeKms.
+	// Pushing requires permission to use the key.
+	KMSKey string
+	// ScanOnPush indicates whether images are scanned when pushed.
+	ScanOnPush bool
+	// Policy is the repository's policy document, or empty if the
+	// repository has no policy.
+	Policy string
+	// Replication lists the destinations to which images pushed to the
+	// repository are replicated.  Replication is only reported for
+	// repositories in the caller's own registry, and is empty if the
+	// caller may not describe its registry.
+	Replication []ReplicationDestination
+}
+
+// ReplicationDestination is a registry to which a repository is replicated.
+type ReplicationDestination struct {
+	Region     string
+	RegistryID string
+}
+
+// InspectRepository describes the configuration of the repository named by
+// ref.  ErrRepositoryNotFound is returned if the repository does not exist.
+// As the repository policy and registry replication configuration each
+// require their own permissions, an error is returned if the caller is not
+// allowed to read them.
+func (r *ecrResolver) InspectRepository(ctx context.Context, ref string) (*RepositoryInfo, error) {
+	ecrSpec, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	client := r.getClient(ecrSpec.Region(), ecrSpec.Registry())
+
+	describeOutput, err := client.DescribeRepositoriesWithContext(ctx, &ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String(ecrSpec.Registry()),
+		RepositoryNames: []*string{aws.String(ecrSpec.Repository)},
+	})
+	if err != nil {
+		if isRepositoryNotFound(err) {
+			return nil, fmt.Errorf("%s: %w", ecrSpec.Repository, ErrRepositoryNotFound)
+		}
+		return nil, err
+	}
+	if len(describeOutput.Repositories) == 0 {
+		return nil, fmt.Errorf("%s: %w", ecrSpec.Repository, ErrRepositoryNotFound)
+	}
+	repository := describeOutput.Repositories[0]
+	info := &RepositoryInfo{
+		ARN:                aws.StringValue(repository.RepositoryArn),
+		URI:                aws.StringValue(repository.RepositoryUri),
+		ImageTagMutability: aws.StringValue(repository.ImageTagMutability),
+	}
+	if encryption := repository.EncryptionConfiguration; encryption != nil {
+		info.EncryptionType = aws.StringValue(encryption.EncryptionType)
+		info.KMSKey = aws.StringValue(encryption.KmsKey)
+	}
+	if scanning := repository.ImageScanningConfiguration; scanning != nil {
+		info.ScanOnPush = aws.BoolValue(scanning.ScanOnPush)
+	}
+
+	policyOutput, err := client.GetRepositoryPolicyWithContext(ctx, &ecr.GetRepositoryPolicyInput{
+		RegistryId:     aws.String(ecrSpec.Registry()),
+		RepositoryName: aws.String(ecrSpec.Repository),
+	})
+	switch {
+	case isAWSErrorCode(err, ecr.ErrCodeRepositoryPolicyNotFoundException):
+	case err != nil:
+		return nil, err
+	default:
+		info.Policy = aws.StringValue(policyOutput.PolicyText)
+	}
+
+	// Replication is reported when it can be, so that the repository of
+	// another account, or a caller without ecr:DescribeRegistry, is still
+	// inspected.
+	registryOutput, err := client.DescribeRegistryWithContext(ctx, &ecr.DescribeRegistryInput{})
+	if err != nil {
+		log.G(ctx).
+			WithField("repository", ecrSpec.Repository).
+			WithError(err).
+			Warn("ecr.resolver.repository: failed to describe registry, not reporting replication")
+	}
+	// DescribeRegistry describes the caller's registry, whose replication
+	// rules do not apply to repositories in other accounts.
+	if err == nil && aws.StringValue(registryOutput.RegistryId) == ecrSpec.Registry() && registryOutput.ReplicationConfiguration != nil {
+		for _, rule := range registryOutput.ReplicationConfiguration.Rules {
+			if !replicationRuleMatches(rule, ecrSpec.Repository) {
+				continue
+			}
+			for _, destination := range rule.Destinations {
+				info.Replication = append(info.Replication, ReplicationDestination{
+					Region:     aws.StringValue(destination.Region),
+					RegistryID: aws.StringValue(destination.RegistryId),
+				})
+			}
+		}
+	}
+
+	log.G(ctx).
+		WithField("repository", ecrSpec.Repository).
+		WithField("info", info).
+		Debug("ecr.resolver.repository: inspected repository")
+	return info, nil
+}
+
+// replicationRuleMatches reports whether rule applies to repository.  Rules
+// without filters apply to all repositories.
+func replicationRuleMatches(rule *ecr.ReplicationRule, repository string) bool {
+	if len(rule.RepositoryFilters) == 0 {
+		return true
+	}
+	for _, filter := range rule.RepositoryFilters {
+		if aws.StringValue(filter.FilterType) == ecr.RepositoryFilterTypePrefixMatch &&
+			strings.HasPrefix(repository, aws.StringValue(filter.Filter)) {
+			return true
+		}
+	}
+	return false
+}
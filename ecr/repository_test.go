@@ -0,0 +1,237 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/internal/testdata"
+)
+
+func TestResolveRepositoryCheck(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	describeCount, batchGetCount := 0, 0
+	fakeClient := &fakeECRClient{
+		DescribeRepositoriesFn: func(_ aws.Context, input *ecr.DescribeRepositoriesInput, _ ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+			describeCount++
+			assert.Equal(t, "123456789012", aws.StringValue(input.RegistryId))
+			assert.Equal(t, []string{"foo/bar"}, aws.StringValueSlice(input.RepositoryNames))
+			return &ecr.DescribeRepositoriesOutput{}, nil
+		},
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			batchGetCount++
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(testdata.ImageDigest.String())},
+				ImageManifest: aws.String(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`),
+			}}}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients:         map[string]ecrAPI{"fake": fakeClient},
+		repositoryCheck: true,
+	}
+
+	for i := 0; i < 2; i++ {
+		_, _, err := resolver.Resolve(context.Background(), ref)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, describeCount, "repository existence should be cached")
+	assert.Equal(t, 2, batchGetCount)
+}
+
+func TestResolveRepositoryCheckNotFound(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	describeCount := 0
+	fakeClient := &fakeECRClient{
+		DescribeRepositoriesFn: func(aws.Context, *ecr.DescribeRepositoriesInput, ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+			describeCount++
+			return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "not found", nil)
+		},
+	}
+	resolver := &ecrResolver{
+		clients:         map[string]ecrAPI{"fake": fakeClient},
+		repositoryCheck: true,
+	}
+
+	for i := 0; i < 2; i++ {
+		_, _, err := resolver.Resolve(context.Background(), ref)
+		assert.True(t, errors.Is(err, ErrRepositoryNotFound))
+		assert.True(t, errdefs.IsNotFound(err), "missing repositories should be reported as not found")
+	}
+	assert.Equal(t, 2, describeCount, "missing repositories should not be cached")
+}
+
+func TestResolveRepositoryCheckError(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	expected := errors.New("expected")
+	fakeClient := &fakeECRClient{
+		DescribeRepositoriesFn: func(aws.Context, *ecr.DescribeRepositoriesInput, ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+			return nil, expected
+		},
+	}
+	resolver := &ecrResolver{
+		clients:         map[string]ecrAPI{"fake": fakeClient},
+		repositoryCheck: true,
+	}
+
+	_, _, err := resolver.Resolve(context.Background(), ref)
+	assert.Equal(t, expected, err)
+}
+
+func TestInspectRepository(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	policy := `{"Version":"2012-10-17","Statement":[]}`
+	fakeClient := &fakeECRClient{
+		DescribeRepositoriesFn: func(aws.Context, *ecr.DescribeRepositoriesInput, ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+			return &ecr.DescribeRepositoriesOutput{Repositories: []*ecr.Repository{{
+				RepositoryArn:      aws.String("arn:aws:ecr:fake:123456789012:repository/foo/bar"),
+				RepositoryUri:      aws.String("123456789012.dkr.ecr.fake.amazonaws.com/foo/bar"),
+				ImageTagMutability: aws.String(ecr.ImageTagMutabilityImmutable),
+				EncryptionConfiguration: &ecr.EncryptionConfiguration{
+					EncryptionType: aws.String(ecr.EncryptionTypeKms),
+					KmsKey:         aws.String("arn:aws:kms:fake:123456789012:key/key"),
+				},
+				ImageScanningConfiguration: &ecr.ImageScanningConfiguration{ScanOnPush: aws.Bool(true)},
+			}}}, nil
+		},
+		GetRepositoryPolicyFn: func(_ aws.Context, input *ecr.GetRepositoryPolicyInput, _ ...request.Option) (*ecr.GetRepositoryPolicyOutput, error) {
+			assert.Equal(t, "foo/bar", aws.StringValue(input.RepositoryName))
+			return &ecr.GetRepositoryPolicyOutput{PolicyText: aws.String(policy)}, nil
+		},
+		DescribeRegistryFn: func(aws.Context, *ecr.DescribeRegistryInput, ...request.Option) (*ecr.DescribeRegistryOutput, error) {
+			return &ecr.DescribeRegistryOutput{
+				RegistryId: aws.String("123456789012"),
+				ReplicationConfiguration: &ecr.ReplicationConfiguration{Rules: []*ecr.ReplicationRule{
+					{
+						Destinations: []*ecr.ReplicationDestination{{Region: aws.String("us-east-1"), RegistryId: aws.String("123456789012")}},
+					},
+					{
+						Destinations: []*ecr.ReplicationDestination{{Region: aws.String("eu-west-1"), RegistryId: aws.String("210987654321")}},
+						RepositoryFilters: []*ecr.RepositoryFilter{{
+							Filter:     aws.String("foo/"),
+							FilterType: aws.String(ecr.RepositoryFilterTypePrefixMatch),
+						}},
+					},
+					{
+						Destinations: []*ecr.ReplicationDestination{{Region: aws.String("ap-south-1"), RegistryId: aws.String("123456789012")}},
+						RepositoryFilters: []*ecr.RepositoryFilter{{
+							Filter:     aws.String("baz"),
+							FilterType: aws.String(ecr.RepositoryFilterTypePrefixMatch),
+						}},
+					},
+				}},
+			}, nil
+		},
+	}
+	resolver := &ecrResolver{clients: map[string]ecrAPI{"fake": fakeClient}}
+
+	info, err := resolver.InspectRepository(context.Background(), ref)
+	require.NoError(t, err)
+	assert.Equal(t, &RepositoryInfo{
+		ARN:                "arn:aws:ecr:fake:123456789012:repository/foo/bar",
+		URI:                "123456789012.dkr.ecr.fake.amazonaws.com/foo/bar",
+		ImageTagMutability: ecr.ImageTagMutabilityImmutable,
+		EncryptionType:     ecr.EncryptionTypeKms,
+		KMSKey:             "arn:aws:kms:fake:123456789012:key/key",
+		ScanOnPush:         true,
+		Policy:             policy,
+		Replication: []ReplicationDestination{
+			{Region: "us-east-1", RegistryID: "123456789012"},
+			{Region: "eu-west-1", RegistryID: "210987654321"},
+		},
+	}, info)
+}
+
+func TestInspectRepositoryWithoutPolicy(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	fakeClient := &fakeECRClient{
+		DescribeRepositoriesFn: func(aws.Context, *ecr.DescribeRepositoriesInput, ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+			return &ecr.DescribeRepositoriesOutput{Repositories: []*ecr.Repository{{
+				ImageTagMutability: aws.String(ecr.ImageTagMutabilityMutable),
+			}}}, nil
+		},
+		GetRepositoryPolicyFn: func(aws.Context, *ecr.GetRepositoryPolicyInput, ...request.Option) (*ecr.GetRepositoryPolicyOutput, error) {
+			return nil, awserr.New(ecr.ErrCodeRepositoryPolicyNotFoundException, "no policy", nil)
+		},
+		DescribeRegistryFn: func(aws.Context, *ecr.DescribeRegistryInput, ...request.Option) (*ecr.DescribeRegistryOutput, error) {
+			// Replication rules of another registry do not apply.
+			return &ecr.DescribeRegistryOutput{
+				RegistryId: aws.String("210987654321"),
+				ReplicationConfiguration: &ecr.ReplicationConfiguration{Rules: []*ecr.ReplicationRule{{
+					Destinations: []*ecr.ReplicationDestination{{Region: aws.String("us-east-1"), RegistryId: aws.String("210987654321")}},
+				}}},
+			}, nil
+		},
+	}
+	resolver := &ecrResolver{clients: map[string]ecrAPI{"fake": fakeClient}}
+
+	info, err := resolver.InspectRepository(context.Background(), ref)
+	require.NoError(t, err)
+	assert.Equal(t, ecr.ImageTagMutabilityMutable, info.ImageTagMutability)
+	assert.Empty(t, info.Policy)
+	assert.Empty(t, info.Replication)
+}
+
+func TestInspectRepositoryRegistryAccessDenied(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:210987654321:repository/foo/bar:latest"
+	policy := `{"Version":"2012-10-17","Statement":[]}`
+	fakeClient := &fakeECRClient{
+		DescribeRepositoriesFn: func(aws.Context, *ecr.DescribeRepositoriesInput, ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+			return &ecr.DescribeRepositoriesOutput{Repositories: []*ecr.Repository{{
+				RepositoryArn:      aws.String("arn:aws:ecr:fake:210987654321:repository/foo/bar"),
+				ImageTagMutability: aws.String(ecr.ImageTagMutabilityMutable),
+			}}}, nil
+		},
+		GetRepositoryPolicyFn: func(aws.Context, *ecr.GetRepositoryPolicyInput, ...request.Option) (*ecr.GetRepositoryPolicyOutput, error) {
+			return &ecr.GetRepositoryPolicyOutput{PolicyText: aws.String(policy)}, nil
+		},
+		DescribeRegistryFn: func(aws.Context, *ecr.DescribeRegistryInput, ...request.Option) (*ecr.DescribeRegistryOutput, error) {
+			return nil, awserr.New("AccessDeniedException", "not authorized to perform ecr:DescribeRegistry", nil)
+		},
+	}
+	resolver := &ecrResolver{clients: map[string]ecrAPI{"fake": fakeClient}}
+
+	info, err := resolver.InspectRepository(context.Background(), ref)
+	require.NoError(t, err, "failing to describe the registry should not fail the inspection")
+	assert.Equal(t, &RepositoryInfo{
+		ARN:                "arn:aws:ecr:fake:210987654321:repository/foo/bar",
+		ImageTagMutability: ecr.ImageTagMutabilityMutable,
+		Policy:             policy,
+	}, info)
+}
+
+func TestInspectRepositoryNotFound(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	fakeClient := &fakeECRClient{
+		DescribeRepositoriesFn: func(aws.Context, *ecr.DescribeRepositoriesInput, ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+			return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "not found", nil)
+		},
+	}
+	resolver := &ecrResolver{clients: map[string]ecrAPI{"fake": fakeClient}}
+
+	_, err := resolver.InspectRepository(context.Background(), ref)
+	assert.True(t, errors.Is(err, ErrRepositoryNotFound))
+}
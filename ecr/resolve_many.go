@@ -0,0 +1,176 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// batchGetImageLimit is the maximum number of image identifiers accepted by
+// a BatchGetImage request.
+const batchGetImageLimit = 100
+
+// BatchResolver is implemented by resolvers able to resolve many references
+// with fewer requests than resolving each of them.  The resolver returned by
+// NewResolver implements it.
+type BatchResolver interface {
+	// ResolveMany resolves refs, returning a result for each of them in the
+	// order given.
+	ResolveMany(ctx context.Context, refs []string) []ResolveResult
+}
+
+var _ BatchResolver = (*ecrResolver)(nil)
+
+// ResolveResult is the result of resolving a reference with ResolveMany, as
+// it would be returned by Resolve.
+type ResolveResult struct {
+	Ref        string
+	Name       string
+	Descriptor ocispec.Descriptor
+	Err        error
+}
+
+// ResolveMany resolves refs as Resolve would, for controllers reconciling
+// many images at once.  The images of references without a mirror are first
+// requested with one BatchGetImage call per repository for up to 100
+// references at a time, and each reference is then resolved from them.
+// Results are returned in the order of refs; the failure to resolve a
+// reference is reported in its result's Err.
+func (r *ecrResolver) ResolveMany(ctx context.Context, refs []string) []ResolveResult {
+	prefetched := &prefetchedImages{images: map[string]*ecr.Image{}, missing: map[string]bool{}}
+	groups := map[string][]ECRSpec{}
+	var order []string
+	for _, ref := range refs {
+		ecrSpec, err := ParseRef(ref)
+		if err != nil || ecrSpec.Object == "" || r.mirrorFor(ecrSpec) != nil {
+			continue
+		}
+		repository := ecrSpec.ARN()
+		if _, ok := groups[repository]; !ok {
+			order = append(order, repository)
+		}
+		groups[repository] = append(groups[repository], ecrSpec)
+	}
+	for _, repository := range order {
+		specs := groups[repository]
+		for start := 0; start < len(specs); start += batchGetImageLimit {
+			end := start + batchGetImageLimit
+			if end > len(specs) {
+				end = len(specs)
+			}
+			r.prefetchImages(ctx, specs[start:end], prefetched)
+		}
+	}
+
+	ctx = context.WithValue(ctx, prefetchedImagesKey{}, prefetched)
+	results := make([]ResolveResult, len(refs))
+	for i, ref := range refs {
+		name, desc, err := r.Resolve(ctx, ref)
+		results[i] = ResolveResult{Ref: ref, Name: name, Descriptor: desc, Err: err}
+	}
+	return results
+}
+
+// prefetchedImages holds the images requested by ResolveMany, keyed by the
+// canonical references they were requested for.
+type prefetchedImages struct {
+	images map[string]*ecr.Image
+	// missing records the references ECR reported as not found.
+	missing map[string]bool
+}
+
+type prefetchedImagesKey struct{}
+
+// prefetchedImage returns the image prefetched for ecrSpec by ResolveMany, or
+// reports that it was not found.  ok is false if the image was not
+// prefetched, in which case it must be requested.
+func prefetchedImage(ctx context.Context, ecrSpec ECRSpec) (image *ecr.Image, found bool, ok bool) {
+	prefetched, _ := ctx.Value(prefetchedImagesKey{}).(*prefetchedImages)
+	if prefetched == nil {
+		return nil, false, false
+	}
+	key := ecrSpec.Canonical()
+	if image, found := prefetched.images[key]; found {
+		return image, true, true
+	}
+	if prefetched.missing[key] {
+		return nil, false, true
+	}
+	return nil, false, false
+}
+
+// prefetchImages requests the images of specs, which must be of the same
+// repository, with a single BatchGetImage call, adding them to prefetched.
+// Images which cannot be requested are left out, so that their references
+// are resolved individually and report the error.
+func (r *ecrResolver) prefetchImages(ctx context.Context, specs []ECRSpec, prefetched *prefetchedImages) {
+	imageIDs := make([]*ecr.ImageIdentifier, 0, len(specs))
+	requested := map[string]bool{}
+	for _, spec := range specs {
+		if key := spec.Canonical(); !requested[key] {
+			requested[key] = true
+			imageIDs = append(imageIDs, spec.ImageID())
+		}
+	}
+	output, err := r.getClient(specs[0].Region(), specs[0].Registry()).BatchGetImageWithContext(ctx, &ecr.BatchGetImageInput{
+		RegistryId:         aws.String(specs[0].Registry()),
+		RepositoryName:     aws.String(specs[0].Repository),
+		ImageIds:           imageIDs,
+		AcceptedMediaTypes: aws.StringSlice(acceptedMediaTypes(r.acceptedMediaTypes)),
+	})
+	if err != nil {
+		log.G(ctx).
+			WithField("repository", specs[0].Repository).
+			WithError(err).
+			Debug("ecr.resolver.resolve: failed to prefetch images")
+		return
+	}
+	for _, spec := range specs {
+		tag, dgst := spec.TagDigest()
+		key := spec.Canonical()
+		for _, image := range output.Images {
+			if image.ImageId == nil {
+				continue
+			}
+			if (tag == "" || aws.StringValue(image.ImageId.ImageTag) == tag) &&
+				(dgst == "" || aws.StringValue(image.ImageId.ImageDigest) == dgst.String()) {
+				prefetched.images[key] = image
+				break
+			}
+		}
+		if _, ok := prefetched.images[key]; ok {
+			continue
+		}
+		for _, failure := range output.Failures {
+			if failure.ImageId != nil &&
+				aws.StringValue(failure.FailureCode) == ecr.ImageFailureCodeImageNotFound &&
+				aws.StringValue(failure.ImageId.ImageTag) == tag &&
+				aws.StringValue(failure.ImageId.ImageDigest) == dgst.String() {
+				prefetched.missing[key] = true
+			}
+		}
+	}
+	log.G(ctx).
+		WithField("repository", specs[0].Repository).
+		WithField("requested", len(imageIDs)).
+		WithField("images", len(output.Images)).
+		Debug("ecr.resolver.resolve: prefetched images")
+}
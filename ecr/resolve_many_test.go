@@ -0,0 +1,112 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveMany(t *testing.T) {
+	const manifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`
+	var batches []int
+	client := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			batches = append(batches, len(input.ImageIds))
+			output := &ecr.BatchGetImageOutput{}
+			for _, id := range input.ImageIds {
+				tag := aws.StringValue(id.ImageTag)
+				if !strings.HasPrefix(tag, "t") {
+					output.Failures = append(output.Failures, &ecr.ImageFailure{
+						ImageId:     id,
+						FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound),
+					})
+					continue
+				}
+				output.Images = append(output.Images, &ecr.Image{
+					ImageId: &ecr.ImageIdentifier{
+						ImageTag:    id.ImageTag,
+						ImageDigest: aws.String(digest.FromString(aws.StringValue(input.RepositoryName) + tag).String()),
+					},
+					ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+					ImageManifest:          aws.String(manifest),
+				})
+			}
+			return output, nil
+		},
+	}
+	resolver := &ecrResolver{clients: map[string]ecrAPI{"fake": client}}
+
+	const prefix = "ecr.aws/arn:aws:ecr:fake:123456789012:repository/"
+	var refs []string
+	for i := 0; i < 150; i++ {
+		refs = append(refs, fmt.Sprintf("%sfoo/bar:t%d", prefix, i))
+	}
+	refs = append(refs, prefix+"foo/bar:missing", prefix+"foo/baz:t0", "invalid")
+
+	results := resolver.ResolveMany(context.Background(), refs)
+	require.Len(t, results, len(refs))
+	assert.Equal(t, []int{100, 51, 1}, batches, "images should be requested in batches per repository")
+	for i := 0; i < 150; i++ {
+		require.NoError(t, results[i].Err)
+		assert.Equal(t, refs[i], results[i].Ref)
+		assert.Equal(t, refs[i], results[i].Name)
+		assert.Equal(t, digest.FromString(fmt.Sprintf("foo/bart%d", i)), results[i].Descriptor.Digest)
+		assert.Equal(t, int64(len(manifest)), results[i].Descriptor.Size)
+	}
+	assert.True(t, errdefs.IsNotFound(results[150].Err), "unexpected error %v", results[150].Err)
+	require.NoError(t, results[151].Err)
+	assert.Equal(t, digest.FromString("foo/bazt0"), results[151].Descriptor.Digest)
+	assert.Error(t, results[152].Err)
+}
+
+func TestResolveManyFallback(t *testing.T) {
+	calls := 0
+	client := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			calls++
+			if len(input.ImageIds) > 1 {
+				return nil, fmt.Errorf("batch failed")
+			}
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(digest.FromString("manifest").String())},
+				ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+				ImageManifest:          aws.String("{}"),
+			}}}, nil
+		},
+	}
+	resolver := &ecrResolver{clients: map[string]ecrAPI{"fake": client}}
+
+	results := resolver.ResolveMany(context.Background(), []string{
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:a",
+		"ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:b",
+	})
+	for _, result := range results {
+		assert.NoError(t, result.Err, "references should be resolved individually when the batch fails")
+	}
+	assert.Equal(t, 3, calls)
+}
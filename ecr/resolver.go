@@ -21,15 +21,19 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	ecrsdk "github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
@@ -42,13 +46,91 @@ var (
 	unimplemented      = errors.New("unimplemented")
 )
 
+// notFoundCacheSize bounds the number of references recorded as not found by
+// a resolver configured with WithNotFoundCache.
+const notFoundCacheSize = 1024
+
 type ecrResolver struct {
-	session                  *session.Session
-	clients                  map[string]ecrAPI
-	clientsLock              sync.Mutex
-	tracker                  docker.StatusTracker
-	layerDownloadParallelism int
-	httpClient               *http.Client
+	session                 *session.Session
+	clients                 map[string]ecrAPI
+	clientsLock             sync.Mutex
+	quotaClients            map[string]serviceQuotasAPI
+	quotaClientsLock        sync.Mutex
+	tracker                 docker.StatusTracker
+	layerDownloadChunkSize  int64
+	httpClient              *http.Client
+	repositoryCheck         bool
+	repositories            map[string]struct{}
+	repositoriesLock        sync.Mutex
+	decompressionBlocks     int
+	descriptorHook          DescriptorHook
+	foreignLayerPolicy      ForeignLayerPolicy
+	layerSourceRepositories []string
+	pushPolicies            []PushPolicy
+	descriptorCache         DescriptorCache
+	resolveCache            ResolveCache
+	resolveCacheTTL         time.Duration
+	clock                   Clock
+	backoff                 Backoff
+	// revalidator refreshes stale resolve cache entries, and is nil if they
+	// are not served.
+	revalidator *revalidator
+	// notFound records the references recently found not to exist, and is
+	// nil if they are not cached.
+	notFound           *memoryDescriptorCache
+	notFoundTTL        time.Duration
+	pushJournal        ResolveCache
+	pushJournalTTL     time.Duration
+	uploads            *uploadGroup
+	fetches            *fetchGroup
+	offline            bool
+	acceptedMediaTypes []string
+	resolvePlatform    platforms.MatchComparer
+	uploadChecksums    bool
+	minLayerPartSize   int64
+	maxLayerPartSize   int64
+	eventHandler       EventHandler
+	apiOptions         []func(*request.Handlers)
+	stats              *statsRecorder
+	mirrors            []Mirror
+	layerPriority      LayerPriority
+	schedulingKey      SchedulingKey
+	smallBlobThreshold int64
+	sizeBackfill       bool
+	layerStallTimeout  time.Duration
+	apiCallBudget      map[string]int64
+	blobTransport      BlobTransport
+	registryConfig     RegistryConfigFunc
+	// registryConfigs holds the configuration returned by registryConfig
+	// for each region and registry, nil for the registries sharing the
+	// clients of their region.
+	registryConfigs     map[string]*aws.Config
+	registryConfigsLock sync.Mutex
+	createRepository    *CreateRepositoryOptions
+	indexManifestCheck  bool
+	// schema1 holds the images converted from Docker Schema 1, and is nil
+	// if they are not converted.
+	schema1 *schema1Conversions
+	// runtime holds the settings changed with Update.
+	runtime *runtimeSettings
+	// telemetry reports metrics and spans, and is nil if neither is
+	// configured.
+	telemetry *telemetry
+	// apiConfig configures the retries of ECR API calls, and is nil if the
+	// session's retryer is used.
+	apiConfig *aws.Config
+	// apiLimiter paces ECR API calls, and is nil if they are not limited.
+	apiLimiter *apiRateLimiter
+	// pullThroughCache pulls images not yet cached by pull-through cache
+	// rules, and is nil if they are not pulled.
+	pullThroughCache *pullThroughCache
+	// registry sends requests to the registries' Docker Registry HTTP API,
+	// keeping their authorization tokens until they expire.
+	registry        *registryAPI
+	hostCoordinator *HostCoordinator
+	scanPolicy      *ScanPolicy
+	blobCache       *BlobCache
+	logURLs         bool
 }
 
 // ResolverOption represents a functional option for configuring the ECR
@@ -60,18 +142,235 @@ type ResolverOptions struct {
 	// Session is used for configuring the ECR client.  If not specified, a
 	// generic session is used.
 	Session *session.Session
-	// Tracker is used to track uploads to ECR.  If not specified, an in-memory
-	// tracker is used instead.
+	// Tracker is used to track uploads to ECR, and records the layer uploads
+	// which are resumed when a push is retried.  If not specified, an
+	// in-memory tracker is used instead.
 	Tracker docker.StatusTracker
 	// LayerDownloadParallelism configures whether layer parts should be
 	// downloaded in parallel.  If not specified, parallelism is currently
 	// disabled.
 	LayerDownloadParallelism int
+	// LayerDownloadChunkSize is the size of the ranges in which layers are
+	// downloaded when LayerDownloadParallelism is set.  If not specified,
+	// layers are downloaded with the htcat library in chunks of between 1 MiB
+	// and 20 MiB.
+	LayerDownloadChunkSize int64
 	// HTTPClient configures the HTTP client the resolver internally use for fetching.
 	// If not specified, http.DefaultClient is used.
 	HTTPClient *http.Client
+	// UserAgent is appended to the User-Agent of all requests made to ECR and
+	// to the layer download URLs.  If not specified, the default User-Agent is
+	// sent unmodified.
+	UserAgent string
+	// Headers are added to all requests made to ECR and to the layer download
+	// URLs, along with those returned by HeaderFunc.  If not specified, no
+	// headers are added.
+	Headers    http.Header
+	HeaderFunc HeaderFunc
+	// RepositoryCheck configures whether Resolve confirms that the repository
+	// exists before requesting the image.  If not specified, the repository is
+	// not checked.
+	RepositoryCheck bool
+	// LayerDownloadLimit bounds the number of layers downloaded concurrently
+	// across all images pulled with the resolver.  If not specified, layer
+	// downloads are not limited.
+	LayerDownloadLimit int
+	// LayerDownloadPolicy configures how LayerDownloadLimit is shared between
+	// images.  If not specified, SchedulingGreedy is used.
+	LayerDownloadPolicy SchedulingPolicy
+	// PipelinedDecompressionBlocks configures how many blocks of a layer are
+	// buffered between download, decompression, and the caller when layers
+	// are fetched with FetchUncompressed or pulled with PullAll.  Each layer
+	// is still decompressed by a single gzip reader.  If not specified,
+	// layers are decompressed synchronously as they are read, and PullAll
+	// does not decompress them.
+	PipelinedDecompressionBlocks int
+	// DescriptorHook is applied to the descriptor returned by Resolve.  If not
+	// specified, descriptors are returned unmodified.
+	DescriptorHook DescriptorHook
+	// ForeignLayerPolicy configures whether foreign layers are uploaded when
+	// pushing.  If not specified, ForeignLayerSkip is used.
+	ForeignLayerPolicy ForeignLayerPolicy
+	// LayerSourceRepositories are repositories of the registry pushed to
+	// which are checked for the layers being pushed, so that layers found in
+	// them are mounted rather than uploaded.  If not specified, layers are
+	// only mounted from the repositories containerd recorded pulling them
+	// from.
+	LayerSourceRepositories []string
+	// PushPolicies are checked, in order, against each reference before it is
+	// pushed.  If not specified, any reference may be pushed.
+	PushPolicies []PushPolicy
+	// DescriptorCache stores the descriptors resolved for references by
+	// digest.  If not specified, every reference is resolved with ECR.
+	DescriptorCache DescriptorCache
+	// ResolveCache stores the descriptors resolved for references by tag for
+	// ResolveCacheTTL.  If not specified, references by tag are resolved
+	// with ECR.
+	ResolveCache    ResolveCache
+	ResolveCacheTTL time.Duration
+	// ResolveCacheStaleness is how long after ResolveCacheTTL passes the
+	// descriptors of the resolve cache are still returned while being
+	// refreshed in the background.  If not specified, expired descriptors
+	// are resolved again with ECR before being returned.
+	ResolveCacheStaleness time.Duration
+	// Clock provides the time to the resolver's caches and retries.  If not
+	// specified, SystemClock is used.
+	Clock Clock
+	// Backoff delays the retries of layer downloads.  If not specified, the
+	// first retry is delayed by 100ms, doubling with each further retry.
+	// Retries of ECR API requests are delayed by APIBackoff.
+	Backoff Backoff
+	// NotFoundTTL is how long references found not to exist are reported as
+	// not found without resolving them again.  If not specified, every
+	// resolution of a missing reference is sent to ECR.
+	NotFoundTTL time.Duration
+	// PushJournal records the content pushed for PushJournalTTL, so that
+	// pushes retried with the same content skip the steps already completed.
+	// If not specified, the existence of all content pushed is checked with
+	// ECR.
+	PushJournal    ResolveCache
+	PushJournalTTL time.Duration
+	// Offline disables network access.  Operations which cannot be served
+	// from the resolver's caches or mirrors fail with ErrOffline.  If not
+	// specified, the resolver uses the network.
+	Offline bool
+	// AcceptedMediaTypes are the manifest media types accepted from ECR when
+	// resolving references and fetching manifests.  If not specified, every
+	// media type supported by the resolver is accepted.
+	AcceptedMediaTypes []string
+	// ResolvePlatform selects the manifest returned by Resolve for
+	// references to image indexes.  If not specified, the index itself is
+	// returned.
+	ResolvePlatform platforms.MatchComparer
+	// UploadChecksums configures whether each part of an uploaded layer is
+	// verified with a checksum.  If not specified, only the digest of the
+	// complete layer is verified.
+	UploadChecksums bool
+	// MinLayerPartSize and MaxLayerPartSize bound the size of the parts of
+	// uploaded layers, which is adapted to the measured throughput.  If
+	// MaxLayerPartSize is not specified, the part size requested by ECR is
+	// used for every part.
+	MinLayerPartSize int64
+	MaxLayerPartSize int64
+	// EventHandler receives the events of the resolver and its fetchers and
+	// pushers.  If not specified, events are discarded.
+	EventHandler EventHandler
+	// APIOptions are applied to the request handlers of each ECR client
+	// created by the resolver.  If not specified, the AWS SDK's handlers are
+	// used unmodified.
+	APIOptions []func(*request.Handlers)
+	// Mirrors resolve and fetch the repositories whose names begin with
+	// their prefixes through alternate upstreams.  If not specified, all
+	// repositories are resolved with ECR.
+	Mirrors []Mirror
+	// LayerPriority orders the layer downloads waiting for a slot when
+	// LayerDownloadLimit is set.  If not specified, UnpackOrderPriority is
+	// used.
+	LayerPriority LayerPriority
+	// LayerDownloadKey groups the layer downloads sharing LayerDownloadLimit
+	// under SchedulingFairShare.  If not specified, ImageSchedulingKey is
+	// used.
+	LayerDownloadKey SchedulingKey
+	// SmallBlobThreshold is the size at or below which layers and configs
+	// are fetched without waiting for a slot of LayerDownloadLimit or being
+	// downloaded in parallel.  If not specified, all layers and configs are
+	// fetched alike.
+	SmallBlobThreshold int64
+	// SizeBackfill configures whether the sizes of layers and configs
+	// fetched without one are looked up before they are downloaded.  If not
+	// specified, they are downloaded without a known size.
+	SizeBackfill bool
+	// LayerStallTimeout is how long layer downloads may receive no data
+	// before they are abandoned and retried.  If not specified, downloads
+	// wait for data until the context of the fetch is done.
+	LayerStallTimeout time.Duration
+	// APICallBudget limits the number of requests the resolver sends for
+	// each ECR API operation.  If not specified, requests are not limited.
+	APICallBudget map[string]int64
+	// BlobTransport transfers the content of layers and configs.  If not
+	// specified, blobs are downloaded from the URLs returned by ECR and
+	// uploaded with ECR's UploadLayerPart API.
+	BlobTransport BlobTransport
+	// RegistryConfig returns the AWS configuration of the API calls made to
+	// each registry.  If not specified, the configuration of Session is used
+	// for every registry.
+	RegistryConfig RegistryConfigFunc
+	// CreateRepositoryOnPush configures the repositories created when
+	// pushing to a repository which does not exist.  If not specified,
+	// pushes to missing repositories fail.
+	CreateRepositoryOnPush *CreateRepositoryOptions
+	// IndexManifestCheck configures whether pushing an image index or
+	// manifest list confirms that the manifests it lists are in the
+	// repository before the index is put.  If not specified, indexes are put
+	// without checking their manifests.
+	IndexManifestCheck bool
+	// ConvertSchema1 configures whether images with Docker Schema 1
+	// manifests are converted to OCI images as they are resolved.  If not
+	// specified, Docker Schema 1 manifests are returned as they are.
+	ConvertSchema1 bool
+	// LayerDownloadBandwidth caps the bytes per second read by all layer
+	// downloads of the resolver together.  If not specified, downloads are
+	// not capped.
+	LayerDownloadBandwidth int64
+	// DebugLogging configures whether the resolver logs its operations at
+	// debug level whatever the level of the logger in their contexts.  If
+	// not specified, the logger's level applies.
+	DebugLogging bool
+	// Metrics receives the metrics of the resolver, such as the latency of
+	// ECR API calls and the bytes downloaded.  If not specified, metrics are
+	// not reported.
+	Metrics Metrics
+	// Tracer starts spans around ECR API calls and layer downloads.  If not
+	// specified, no spans are started.
+	Tracer Tracer
+	// APIMaxAttempts bounds the attempts of each ECR API call, including
+	// the first.  If not specified, the session's retryer decides.
+	APIMaxAttempts int
+	// APIBackoff delays the retries of ECR API calls.  If not specified, the
+	// session's retryer delays them.
+	APIBackoff Backoff
+	// APIRateLimit is the rate, in calls per second, at which the resolver
+	// sends ECR API calls, with bursts of up to APIRateBurst calls.  If not
+	// specified, calls are not limited.
+	APIRateLimit float64
+	APIRateBurst int
+	// AdaptiveRetry configures whether the rate of ECR API calls is reduced
+	// when ECR throttles them.  If not specified, throttled calls are retried
+	// without slowing other calls.
+	AdaptiveRetry bool
+	// PullThroughCache configures whether images and layers which ECR has
+	// not yet cached in the repositories of pull-through cache rules are
+	// pulled through the registry API, which caches them from the upstream
+	// registry.  If not specified, they are not found until cached by a
+	// pull with another client.
+	PullThroughCache bool
+	// HostCoordinator coordinates the layer downloads of the resolver with
+	// those of other processes on the host.  If not specified, downloads are
+	// only coordinated within the resolver.
+	HostCoordinator *HostCoordinator
+	// BlobCache keeps the layers and configs downloaded by the resolver, to
+	// be read by later fetches rather than downloaded again.  If not
+	// specified, every fetch downloads its blob.
+	BlobCache *BlobCache
+	// LogPresignedURLs writes the presigned URLs that layers are downloaded
+	// from to logs and errors as they are, for debugging.  If not specified,
+	// their queries, which hold the credentials authorizing the downloads,
+	// are redacted.
+	LogPresignedURLs bool
+	// ScanPolicy refuses to resolve images which ECR has not finished
+	// scanning or whose scans found severe vulnerabilities.  If not
+	// specified, images are resolved whatever their scans found.
+	ScanPolicy *ScanPolicy
 }
 
+// RegistryConfigFunc returns the configuration applied on top of the
+// resolver's session for API calls to the registry of account registryID in
+// region, such as the credentials of a role assumed in that account.  A nil
+// configuration leaves the session's configuration unchanged, as for
+// registries whose repository policies grant the session's identity access:
+// their API calls share the clients of their region.
+type RegistryConfigFunc func(registryID, region string) *aws.Config
+
 // WithSession is a ResolverOption to use a specific AWS session.Session
 func WithSession(session *session.Session) ResolverOption {
 	return func(options *ResolverOptions) error {
@@ -80,6 +379,21 @@ func WithSession(session *session.Session) ResolverOption {
 	}
 }
 
+// WithRegistryConfig is a ResolverOption to configure the API calls made to
+// each registry separately, so that a single resolver can reach registries in
+// accounts requiring different credentials.  The ECR clients used for a
+// registry are created with the configuration returned by config the first
+// time the registry is used, and are kept for the lifetime of the resolver.
+func WithRegistryConfig(config RegistryConfigFunc) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if config == nil {
+			return errors.New("registry config must not be nil")
+		}
+		options.RegistryConfig = config
+		return nil
+	}
+}
+
 // WithTracker is a ResolverOption to use a specific docker.Tracker
 func WithTracker(tracker docker.StatusTracker) ResolverOption {
 	return func(options *ResolverOptions) error {
@@ -100,6 +414,22 @@ func WithLayerDownloadParallelism(parallelism int) ResolverOption {
 	}
 }
 
+// WithLayerDownloadChunkSize is a ResolverOption to download layers in
+// ranges of size bytes, fetched with the parallelism set by
+// WithLayerDownloadParallelism.  At most that many ranges are buffered in
+// memory at once.  Unlike the default htcat downloads, each range is checked
+// to be the part requested, and layers are downloaded as a single stream from
+// servers which do not support range requests.
+func WithLayerDownloadChunkSize(size int64) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if size <= 0 {
+			return errors.New("layer download chunk size must be positive")
+		}
+		options.LayerDownloadChunkSize = size
+		return nil
+	}
+}
+
 // WithHTTPClient is a ResolverOption to use a specific http.Client.
 func WithHTTPClient(client *http.Client) ResolverOption {
 	return func(options *ResolverOptions) error {
@@ -108,6 +438,718 @@ func WithHTTPClient(client *http.Client) ResolverOption {
 	}
 }
 
+// WithUserAgent is a ResolverOption to identify the calling application in the
+// User-Agent of requests made by the resolver.  The token is formatted as
+// "name/version" and appended to the User-Agent of both ECR API requests and
+// layer downloads, allowing registry access logs to distinguish callers.
+func WithUserAgent(name, version string) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if name == "" {
+			return errors.New("user agent name must not be empty")
+		}
+		options.UserAgent = name
+		if version != "" {
+			options.UserAgent += "/" + version
+		}
+		return nil
+	}
+}
+
+// WithHeaders is a ResolverOption to add headers to the requests made by the
+// resolver, such as the tenant identification required by some egress
+// proxies.  Headers are added to both ECR API requests and layer downloads,
+// except for headers the request already sets and the Authorization and
+// X-Amz-* headers, which would invalidate request signatures and presigned
+// URLs.  Headers are not signed, so ECR itself does not rely on them.
+func WithHeaders(headers http.Header) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if options.Headers == nil {
+			options.Headers = http.Header{}
+		}
+		for name, values := range headers {
+			if !addableHeader(http.CanonicalHeaderKey(name)) {
+				return fmt.Errorf("header %s cannot be added to signed requests", name)
+			}
+			for _, value := range values {
+				options.Headers.Add(name, value)
+			}
+		}
+		return nil
+	}
+}
+
+// WithHeaderFunc is a ResolverOption to add the headers returned by fn to
+// each request made by the resolver, as with WithHeaders.  fn is called for
+// every request, including retries, and may derive headers from the
+// request's context.
+func WithHeaderFunc(fn HeaderFunc) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if fn == nil {
+			return errors.New("header function must not be nil")
+		}
+		options.HeaderFunc = fn
+		return nil
+	}
+}
+
+// WithRepositoryCheck is a ResolverOption to confirm that a reference's
+// repository exists when it is first resolved.  A missing repository is
+// reported as ErrRepositoryNotFound from Resolve rather than as a failure
+// from a later operation.  Repositories found to exist are cached, so the
+// check adds a single DescribeRepositories call per repository.
+func WithRepositoryCheck() ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.RepositoryCheck = true
+		return nil
+	}
+}
+
+// WithLayerDownloadLimit is a ResolverOption to bound the number of layers
+// downloaded concurrently by all fetchers created by the resolver.  The policy
+// determines how the limit is shared when several images are pulled at once;
+// SchedulingFairShare prevents an image with very large layers from starving
+// smaller images pulled alongside it.  A download holds its slot until the
+// reader returned by Fetch is closed.
+func WithLayerDownloadLimit(limit int, policy SchedulingPolicy) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.LayerDownloadLimit = limit
+		options.LayerDownloadPolicy = policy
+		return nil
+	}
+}
+
+// WithPipelinedDecompression is a ResolverOption to decompress layers fetched
+// with UncompressedFetcher.FetchUncompressed in a pipeline.  Downloading,
+// decompressing, and consuming the layer proceed in separate goroutines with
+// up to blocks 1 MiB blocks buffered between each stage, trading memory for
+// faster unpacking on nodes bound by disk or network I/O.  A gzip stream
+// cannot be split, so decompression itself is not parallelized: each layer
+// is decompressed by a single gzip reader, using at most one core.  PullAll
+// decompresses the gzip layers it pulls as they are ingested, writing their
+// uncompressed content alongside them and labelling each layer with its
+// digest as containerd.io/uncompressed.
+func WithPipelinedDecompression(blocks int) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.PipelinedDecompressionBlocks = blocks
+		return nil
+	}
+}
+
+// WithDescriptorHook is a ResolverOption to modify the descriptors returned by
+// Resolve, for example to add annotations.  Use DescriptorHookWrapper to
+// apply the same hook to the descriptors of the resolved image's children.
+func WithDescriptorHook(hook DescriptorHook) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.DescriptorHook = hook
+		return nil
+	}
+}
+
+// WithForeignLayerPolicy is a ResolverOption to configure how foreign layers,
+// such as the base layers of Windows images, are handled when pushing.
+func WithForeignLayerPolicy(policy ForeignLayerPolicy) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.ForeignLayerPolicy = policy
+		return nil
+	}
+}
+
+// WithLayerSourceRepositories is a ResolverOption to check repositories of
+// the registry pushed to, such as those holding common base images, for the
+// layers of pushed images which are not in the repository being pushed to.
+// Layers found are mounted from the first repository, in the order given,
+// which has them rather than uploaded again, in the same way as those pulled
+// from another repository of the registry.  Each layer checked costs a
+// BatchCheckLayerAvailability request per repository until it is found.
+func WithLayerSourceRepositories(repositories ...string) ResolverOption {
+	return func(options *ResolverOptions) error {
+		for _, repository := range repositories {
+			if repository == "" || strings.ContainsAny(repository, ":@") {
+				return fmt.Errorf("invalid layer source repository %q", repository)
+			}
+		}
+		options.LayerSourceRepositories = append(options.LayerSourceRepositories, repositories...)
+		return nil
+	}
+}
+
+// WithPushPolicy is a ResolverOption to validate references before they are
+// pushed, such as with NamingPolicy to enforce naming conventions.  The
+// policies are checked when a Pusher is created, before any content is
+// uploaded.  WithPushPolicy may be given more than once.
+func WithPushPolicy(policies ...PushPolicy) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.PushPolicies = append(options.PushPolicies, policies...)
+		return nil
+	}
+}
+
+// WithDescriptorCache is a ResolverOption to look up references by digest in
+// cache before resolving them with ECR, and to store the descriptors resolved
+// for them.  References including a tag are always resolved with ECR, as are
+// all references if the cache returns an error.
+func WithDescriptorCache(cache DescriptorCache) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.DescriptorCache = cache
+		return nil
+	}
+}
+
+// WithResolveCache is a ResolverOption to look up references by tag in cache
+// before resolving them with ECR, and to store the descriptors resolved for
+// them for ttl.  A tag moved to another image by a different client may
+// resolve to its previous image until ttl passes.  Tags pushed or moved with
+// the resolver are invalidated in the cache.  All references are resolved
+// with ECR if the cache returns an error.
+func WithResolveCache(cache ResolveCache, ttl time.Duration) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if ttl <= 0 {
+			return fmt.Errorf("resolve cache TTL must be positive, got %s", ttl)
+		}
+		options.ResolveCache = cache
+		options.ResolveCacheTTL = ttl
+		return nil
+	}
+}
+
+// WithResolveCacheStaleness is a ResolverOption to keep returning the
+// descriptors of the cache configured with WithResolveCache for window after
+// their TTL passes, while refreshing them with ECR in the background.  Pulls
+// of cached tags are then not delayed by ECR latency, and still converge on
+// the images tags are moved to within the TTL and one refresh.  Tags found no
+// longer to exist during a refresh are removed from the cache.
+func WithResolveCacheStaleness(window time.Duration) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if window <= 0 {
+			return fmt.Errorf("resolve cache staleness must be positive, got %s", window)
+		}
+		options.ResolveCacheStaleness = window
+		return nil
+	}
+}
+
+// WithClock is a ResolverOption to provide the time to the resolver's caches
+// and retries with clock, so that tests of integrations can advance it
+// deterministically past TTLs and retry delays.  Caches configured with
+// WithResolveCache keep their own clock, such as the one given to
+// NewMemoryResolveCacheWithClock or NewFileResolveCacheWithClock.
+func WithClock(clock Clock) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if clock == nil {
+			return errors.New("clock must not be nil")
+		}
+		options.Clock = clock
+		return nil
+	}
+}
+
+// WithBackoff is a ResolverOption to delay the retries of layer downloads
+// failing with transient errors by the durations backoff returns.
+func WithBackoff(backoff Backoff) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if backoff == nil {
+			return errors.New("backoff must not be nil")
+		}
+		options.Backoff = backoff
+		return nil
+	}
+}
+
+// WithNotFoundCache is a ResolverOption to report references found not to
+// exist as not found for ttl without resolving them again, protecting ECR
+// from the retries of orchestrators repeatedly pulling a missing tag.  ttl
+// should be short, such as a few seconds, as images pushed by other clients
+// are not visible until it passes; images pushed or tags moved with the
+// resolver are visible immediately.
+func WithNotFoundCache(ttl time.Duration) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if ttl <= 0 {
+			return fmt.Errorf("not found cache TTL must be positive, got %s", ttl)
+		}
+		options.NotFoundTTL = ttl
+		return nil
+	}
+}
+
+// WithPushJournal is a ResolverOption to record the blobs and manifests
+// pushed in journal for ttl, keyed by repository, digest, and tag.  Pushes
+// retried with identical content, such as by CI jobs with at-least-once
+// semantics, skip the content the journal records as pushed instead of
+// checking its existence with ECR again.  Content deleted from ECR by another
+// client may be skipped until ttl passes, so ttl should be no longer than a
+// retried push is expected to take.  journal should not be shared with
+// WithResolveCache.
+func WithPushJournal(journal ResolveCache, ttl time.Duration) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if ttl <= 0 {
+			return fmt.Errorf("push journal TTL must be positive, got %s", ttl)
+		}
+		options.PushJournal = journal
+		options.PushJournalTTL = ttl
+		return nil
+	}
+}
+
+// WithOffline is a ResolverOption to disable network access, for building
+// deterministic air-gapped environments around the resolver.  References are
+// resolved only from the caches configured with WithDescriptorCache,
+// WithResolveCache, and WithNotFoundCache, and content is fetched only from
+// mirrors.  Every other operation fails immediately with ErrOffline, without
+// requesting credentials or retrying.
+func WithOffline() ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.Offline = true
+		return nil
+	}
+}
+
+// WithAcceptedMediaTypes is a ResolverOption to accept only mediaTypes as
+// the manifest media types of images resolved and fetched, controlling the
+// acceptedMediaTypes sent to BatchGetImage.  ECR converts images stored in
+// another format to an accepted one where it can, such as Docker schema 2
+// images to schema 1, and otherwise reports that the image was not found.
+func WithAcceptedMediaTypes(mediaTypes ...string) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if len(mediaTypes) == 0 {
+			return errors.New("at least one accepted media type must be given")
+		}
+		for _, mediaType := range mediaTypes {
+			if mediaType == "" {
+				return errors.New("accepted media types must not be empty")
+			}
+		}
+		options.AcceptedMediaTypes = mediaTypes
+		return nil
+	}
+}
+
+// WithResolvePlatform is a ResolverOption to resolve references to image
+// indexes to the manifest for platform, such as "linux/arm64", so that only
+// that manifest is pulled and the index is neither fetched again nor stored.
+// The index's manifest is read from the response which resolved it, so no
+// further requests are made.  Resolve fails with errdefs.ErrNotFound if the
+// index has no manifest for the platform.  References to single manifests
+// are resolved as usual.
+func WithResolvePlatform(platform string) ResolverOption {
+	return func(options *ResolverOptions) error {
+		p, err := platforms.Parse(platform)
+		if err != nil {
+			return err
+		}
+		options.ResolvePlatform = platforms.Only(p)
+		return nil
+	}
+}
+
+// WithUploadChecksums is a ResolverOption to verify each part of the layers
+// uploaded when pushing.  The SHA-256 of each part is computed when the part
+// is read and checked before it is sent, and the byte range acknowledged by
+// ECR is checked after, so that corruption is reported as a
+// *LayerCorruptionError identifying the part instead of only as a mismatched
+// digest once the whole layer has been uploaded.
+func WithUploadChecksums() ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.UploadChecksums = true
+		return nil
+	}
+}
+
+// WithAdaptivePartSize is a ResolverOption to adapt the size of the parts of
+// uploaded layers to the throughput measured while uploading them.  Uploads
+// start with the part size requested by ECR, bounded by min and max, and
+// adjust it after each part so that parts take a few seconds to upload:
+// larger parts make better use of fast connections, while smaller parts avoid
+// request timeouts on slow connections.  ECR requires the parts of an upload
+// to be sent in order, so parts are not uploaded in parallel.  min must be at
+// least MinimumLayerPartSize.
+func WithAdaptivePartSize(min, max int64) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if min < MinimumLayerPartSize {
+			return fmt.Errorf("minimum part size %d is less than %d", min, MinimumLayerPartSize)
+		}
+		if max < min {
+			return fmt.Errorf("maximum part size %d is less than minimum %d", max, min)
+		}
+		options.MinLayerPartSize = min
+		options.MaxLayerPartSize = max
+		return nil
+	}
+}
+
+// WithEventHandler is a ResolverOption to receive typed events as images are
+// resolved, fetched, and pushed, such as to report telemetry or progress.
+// See Event for the events delivered.
+func WithEventHandler(handler EventHandler) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.EventHandler = handler
+		return nil
+	}
+}
+
+// WithAPIOptions is a ResolverOption to customize the request handlers of the
+// ECR clients created by the resolver, such as to add headers, adjust
+// signing, or mirror requests.  The options are applied in order to the
+// client for each region when it is created.  WithAPIOptions may be given
+// more than once.
+func WithAPIOptions(options ...func(*request.Handlers)) ResolverOption {
+	return func(resolverOptions *ResolverOptions) error {
+		resolverOptions.APIOptions = append(resolverOptions.APIOptions, options...)
+		return nil
+	}
+}
+
+// WithLayerPriority is a ResolverOption to order the layer downloads waiting
+// for one of the slots of WithLayerDownloadLimit, which has no effect without
+// a limit.  By default, layers are downloaded in the order in which they are
+// unpacked so that unpacking can begin earlier.
+func WithLayerPriority(priority LayerPriority) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.LayerPriority = priority
+		return nil
+	}
+}
+
+// WithLayerDownloadKey is a ResolverOption to choose what the slots of
+// WithLayerDownloadLimit are shared fairly between under SchedulingFairShare,
+// which has no effect under other policies.  RepositorySchedulingKey and
+// TenantSchedulingKey keep one repository's or tenant's very large images
+// from monopolizing the downloads of a resolver shared by a multi-tenant
+// service.
+func WithLayerDownloadKey(key SchedulingKey) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.LayerDownloadKey = key
+		return nil
+	}
+}
+
+// WithSmallBlobThreshold is a ResolverOption to fetch layers and configs of
+// at most size bytes, such as image configs and signature payloads, along a
+// path suited to their size.  Fetching a small blob is dominated by the
+// latency of its requests rather than by its transfer, so small blobs do not
+// wait behind larger layers for a slot of WithLayerDownloadLimit and are
+// fetched with a single request rather than with
+// WithLayerDownloadParallelism.  Blobs whose content is embedded in their
+// descriptor are returned without being fetched regardless of size.
+func WithSmallBlobThreshold(size int64) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.SmallBlobThreshold = size
+		return nil
+	}
+}
+
+// WithSizeBackfill is a ResolverOption to look up the size recorded by ECR of
+// layers and configs fetched with descriptors which have no size, as found in
+// some older manifests, so that their downloads report progress against the
+// total.  Each such fetch costs a BatchCheckLayerAvailability request.  Use
+// SizeBackfillWrapper to also fill in the sizes seen by containerd.
+func WithSizeBackfill() ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.SizeBackfill = true
+		return nil
+	}
+}
+
+// WithIndexManifestCheck is a ResolverOption to confirm that the manifests
+// listed by an image index or manifest list are in the repository before the
+// index is pushed.  An index whose manifests were not all pushed, such as when
+// pushing an image pulled for a single platform, fails with a
+// *MissingManifestsError instead of producing a tag which cannot be pulled
+// for the missing platforms.  The check adds a BatchGetImage call for every
+// 100 manifests of each index pushed.
+func WithIndexManifestCheck() ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.IndexManifestCheck = true
+		return nil
+	}
+}
+
+// WithSchema1Conversion is a ResolverOption to convert images with Docker
+// Schema 1 manifests, which containerd no longer unpacks, to OCI images as
+// they are resolved.  Resolving such an image fetches each of its layers to
+// find the diff IDs and sizes that Schema 1 manifests do not record, and the
+// descriptor returned is that of an OCI manifest generated with an image
+// configuration built from the manifest's history.  The generated manifest
+// and configuration are held in memory to be fetched by the resolver's
+// fetchers; the layers are fetched from ECR under their original digests.
+func WithSchema1Conversion() ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.ConvertSchema1 = true
+		return nil
+	}
+}
+
+// WithLayerDownloadBandwidth is a ResolverOption to cap the bytes per second
+// read by all layer downloads of the resolver together, so that pulls leave
+// bandwidth for the workloads of a node.  The cap may be changed while the
+// resolver is in use with Update.
+func WithLayerDownloadBandwidth(bytesPerSecond int64) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if bytesPerSecond <= 0 {
+			return fmt.Errorf("layer download bandwidth must be positive, got %d", bytesPerSecond)
+		}
+		options.LayerDownloadBandwidth = bytesPerSecond
+		return nil
+	}
+}
+
+// WithDebugLogging is a ResolverOption to log the operations of the resolver
+// and its fetchers and pushers at debug level, without raising the level of
+// the process's logger.  It may be turned on and off while the resolver is in
+// use with Update.
+func WithDebugLogging() ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.DebugLogging = true
+		return nil
+	}
+}
+
+// WithMetrics is a ResolverOption to report the metrics of the resolver and
+// the fetchers and pushers created by it to metrics, such as an adapter to
+// Prometheus collectors or OpenTelemetry instruments.  The metrics reported
+// are listed by the Metric constants, such as MetricAPICalls.
+func WithMetrics(metrics Metrics) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if metrics == nil {
+			return errors.New("metrics must not be nil")
+		}
+		options.Metrics = metrics
+		return nil
+	}
+}
+
+// WithTracer is a ResolverOption to start spans with tracer around the ECR
+// API calls and layer downloads of the resolver and the fetchers and pushers
+// created by it.  Spans are children of the spans in the contexts of the
+// operations, so that a pull is traced end to end.
+func WithTracer(tracer Tracer) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if tracer == nil {
+			return errors.New("tracer must not be nil")
+		}
+		options.Tracer = tracer
+		return nil
+	}
+}
+
+// WithAPIMaxAttempts is a ResolverOption to make at most attempts attempts of
+// each ECR API call, including the first, whatever the retries configured in
+// the session.
+func WithAPIMaxAttempts(attempts int) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if attempts < 1 {
+			return errors.New("API max attempts must be at least 1")
+		}
+		options.APIMaxAttempts = attempts
+		return nil
+	}
+}
+
+// WithAPIBackoff is a ResolverOption to delay the retries of ECR API calls by
+// the durations backoff returns rather than with the session's retryer.
+// Throttled calls are delayed alike, whatever Retry-After ECR returns.
+func WithAPIBackoff(backoff Backoff) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if backoff == nil {
+			return errors.New("API backoff must not be nil")
+		}
+		options.APIBackoff = backoff
+		return nil
+	}
+}
+
+// WithAPIRateLimit is a ResolverOption to send ECR API calls, such as
+// BatchGetImage, GetDownloadUrlForLayer, and UploadLayerPart, at no more than
+// rate calls per second, with bursts of up to burst calls.  The limit is
+// shared by all the calls of the resolver, including retries, so that a fleet
+// of nodes pulling at once can keep below ECR's request rate quotas.
+func WithAPIRateLimit(rate float64, burst int) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if rate <= 0 {
+			return errors.New("API rate limit must be positive")
+		}
+		if burst < 1 {
+			return errors.New("API rate burst must be at least 1")
+		}
+		options.APIRateLimit = rate
+		options.APIRateBurst = burst
+		return nil
+	}
+}
+
+// WithAdaptiveRetry is a ResolverOption to reduce the rate of ECR API calls
+// when ECR throttles them.  The rate is halved with each throttled call and
+// recovers by about one call per second every second while calls succeed, up
+// to the rate set with WithAPIRateLimit.  Without a rate limit, calls are
+// not limited until one is throttled, nor once the rate recovers to the rate
+// measured then.
+func WithAdaptiveRetry() ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.AdaptiveRetry = true
+		return nil
+	}
+}
+
+// WithCreateRepositoryOnPush is a ResolverOption to create the repository
+// pushed to if it does not exist, configured by opts, rather than failing the
+// push.  The repository is created when ECR first reports it missing, which
+// is normally when checking whether the first blob or manifest is already
+// present, and the failed call is then made again.  Creating repositories
+// requires the ecr:CreateRepository permission, and ecr:TagResource if opts
+// includes tags.
+func WithCreateRepositoryOnPush(opts CreateRepositoryOptions) ResolverOption {
+	return func(options *ResolverOptions) error {
+		switch opts.ImageTagMutability {
+		case "", ecrsdk.ImageTagMutabilityMutable, ecrsdk.ImageTagMutabilityImmutable:
+		default:
+			return fmt.Errorf("unknown image tag mutability %q", opts.ImageTagMutability)
+		}
+		switch opts.EncryptionType {
+		case "", ecrsdk.EncryptionTypeAes256, ecrsdk.EncryptionTypeKms:
+		default:
+			return fmt.Errorf("unknown encryption type %q", opts.EncryptionType)
+		}
+		if opts.KMSKey != "" && opts.EncryptionType != ecrsdk.EncryptionTypeKms {
+			return errors.New("kms key requires the KMS encryption type")
+		}
+		options.CreateRepositoryOnPush = &opts
+		return nil
+	}
+}
+
+// WithLayerStallTimeout is a ResolverOption to abandon layer downloads which
+// receive no data for timeout, such as downloads from connections which hang
+// without being closed.  Downloads which stall before returning any of the
+// layer are retried as a whole; those which stall part way are started
+// again, skipping the data already read.  Downloads which keep stalling fail
+// with an error wrapping ErrTransferStalled, which is told apart from the
+// expiry of the context's deadline.  Stalls are detected by reading layers
+// through a separate reader, so parallel downloads are no longer written
+// directly to their destination.
+func WithLayerStallTimeout(timeout time.Duration) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if timeout <= 0 {
+			return errors.New("layer stall timeout must be positive")
+		}
+		options.LayerStallTimeout = timeout
+		return nil
+	}
+}
+
+// WithAPICallBudget is a ResolverOption to limit the ECR API requests sent by
+// the resolver for operation, such as "GetDownloadUrlForLayer", to calls over
+// the resolver's lifetime, including retries.  Further calls fail with
+// ErrAPICallBudgetExceeded without being sent.  A resolver may be created for
+// each pull or push to bound the quota consumed by each.  The requests sent
+// for each operation are reported by Stats.
+func WithAPICallBudget(operation string, calls int64) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if calls < 0 {
+			return fmt.Errorf("API call budget for %s must not be negative", operation)
+		}
+		if options.APICallBudget == nil {
+			options.APICallBudget = map[string]int64{}
+		}
+		options.APICallBudget[operation] = calls
+		return nil
+	}
+}
+
+// WithBlobTransport is a ResolverOption to transfer the content of layers and
+// configs with transport rather than with HTTP requests to the URLs returned
+// by ECR and ECR's UploadLayerPart API.  Options configuring downloads, such
+// as WithLayerDownloadParallelism and WithHTTPClient, apply only to the
+// default transport.
+func WithBlobTransport(transport BlobTransport) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.BlobTransport = transport
+		return nil
+	}
+}
+
+// WithMirror is a ResolverOption to resolve and fetch the repositories whose
+// names begin with prefix through resolver, such as a registry mirror or a
+// pull-through cache, with ECR as the fallback.  The mirror's reference for a
+// repository is upstream followed by the remainder of the repository's name,
+// so that with the prefix "mirror/docker" and the upstream "docker.io", the
+// repository "mirror/docker/library/alpine" is mirrored by
+// "docker.io/library/alpine".  References resolved or content fetched from
+// the mirror which it fails to provide are resolved or fetched with ECR
+// instead, allowing a mirror to be adopted gradually.  Content is only pushed
+// to ECR.  WithMirror may be given more than once; the longest matching prefix
+// is used.
+func WithMirror(prefix, upstream string, resolver remotes.Resolver) ResolverOption {
+	return func(options *ResolverOptions) error {
+		prefix = strings.Trim(prefix, "/")
+		upstream = strings.TrimSuffix(upstream, "/")
+		if prefix == "" || upstream == "" {
+			return errors.New("mirror prefix and upstream must not be empty")
+		}
+		if resolver == nil {
+			return errors.New("mirror resolver must not be nil")
+		}
+		options.Mirrors = append(options.Mirrors, Mirror{
+			Prefix:   prefix,
+			Upstream: upstream,
+			Resolver: resolver,
+		})
+		return nil
+	}
+}
+
+// WithPullThroughCache is a ResolverOption to pull images not yet cached in
+// repositories created by pull-through cache rules, such as
+// "ecr-public/docker/library/alpine", so that their first pull succeeds.
+// When ECR does not find an image or layer, the registry's pull-through cache
+// rules are listed once with DescribePullThroughCacheRules; content in the
+// repositories they create is then pulled through the registry API, which
+// caches it from the upstream registry.
+func WithPullThroughCache() ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.PullThroughCache = true
+		return nil
+	}
+}
+
+// WithHostCoordinator is a ResolverOption to coordinate layer downloads with
+// the other processes on the host given the same directory for a
+// HostCoordinator, so that they share the host's bandwidth and download each
+// layer one at a time.  Layers at or below the small blob threshold are not
+// coordinated.
+func WithHostCoordinator(coordinator *HostCoordinator) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if coordinator == nil {
+			return errors.New("host coordinator must not be nil")
+		}
+		options.HostCoordinator = coordinator
+		return nil
+	}
+}
+
+// WithBlobCache is a ResolverOption to keep the layers and configs downloaded
+// by the resolver in cache, so that later fetches of them, such as pulls of
+// other images sharing their base layers, read them from the cache without
+// requesting their download URLs from ECR.
+func WithBlobCache(cache *BlobCache) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if cache == nil {
+			return errors.New("blob cache must not be nil")
+		}
+		options.BlobCache = cache
+		return nil
+	}
+}
+
+// WithPresignedURLLogging is a ResolverOption to write the presigned URLs that
+// layers are downloaded from to logs and errors as they are.  Presigned URLs
+// are bearer credentials for the layers, so this is only meant for debugging
+// downloads.
+func WithPresignedURLLogging() ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.LogPresignedURLs = true
+		return nil
+	}
+}
+
 // NewResolver creates a new remotes.Resolver capable of interacting with Amazon
 // ECR.  NewResolver can be called with no arguments for default configuration,
 // or can be customized by specifying ResolverOptions.  By default, NewResolver
@@ -135,13 +1177,113 @@ func NewResolver(options ...ResolverOption) (remotes.Resolver, error) {
 	if resolverOptions.HTTPClient == nil {
 		resolverOptions.HTTPClient = http.DefaultClient
 	}
+	if resolverOptions.UserAgent != "" {
+		resolverOptions.HTTPClient = withUserAgent(resolverOptions.HTTPClient, resolverOptions.UserAgent)
+	}
+	if len(resolverOptions.Headers) > 0 || resolverOptions.HeaderFunc != nil {
+		resolverOptions.HTTPClient = withHeaders(resolverOptions.HTTPClient, resolverOptions.Headers, resolverOptions.HeaderFunc)
+	}
+	if resolverOptions.Offline {
+		resolverOptions.HTTPClient = withOffline(resolverOptions.HTTPClient)
+	}
+
+	if resolverOptions.Clock == nil {
+		resolverOptions.Clock = SystemClock
+	}
+	if resolverOptions.Backoff == nil {
+		resolverOptions.Backoff = defaultBackoff
+	}
+
+	var revalidator *revalidator
+	if resolverOptions.ResolveCacheStaleness > 0 {
+		if resolverOptions.ResolveCache == nil {
+			return nil, errors.New("resolve cache staleness requires a resolve cache")
+		}
+		revalidator = newRevalidator(resolverOptions.ResolveCacheStaleness, resolverOptions.Clock)
+	}
+
+	var notFound *memoryDescriptorCache
+	if resolverOptions.NotFoundTTL > 0 {
+		notFound = newMemoryDescriptorCache(notFoundCacheSize, resolverOptions.Clock)
+	}
+
+	var schema1 *schema1Conversions
+	if resolverOptions.ConvertSchema1 {
+		schema1 = newSchema1Conversions()
+	}
+
+	runtime := newRuntimeSettings(RuntimeOptions{
+		LayerDownloadLimit:       resolverOptions.LayerDownloadLimit,
+		LayerDownloadParallelism: resolverOptions.LayerDownloadParallelism,
+		LayerDownloadBandwidth:   resolverOptions.LayerDownloadBandwidth,
+		DebugLogging:             resolverOptions.DebugLogging,
+	}, resolverOptions.LayerDownloadPolicy, resolverOptions.Clock)
+
+	telemetry := newTelemetry(resolverOptions.Metrics, resolverOptions.Tracer)
+
+	registry := newRegistryAPI(resolverOptions.HTTPClient, resolverOptions.Clock)
+	var pullThrough *pullThroughCache
+	if resolverOptions.PullThroughCache {
+		pullThrough = newPullThroughCache(registry)
+	}
 
 	return &ecrResolver{
-		session:                  resolverOptions.Session,
-		clients:                  map[string]ecrAPI{},
-		tracker:                  resolverOptions.Tracker,
-		layerDownloadParallelism: resolverOptions.LayerDownloadParallelism,
-		httpClient:               resolverOptions.HTTPClient,
+		session:                 resolverOptions.Session,
+		clients:                 map[string]ecrAPI{},
+		quotaClients:            map[string]serviceQuotasAPI{},
+		tracker:                 resolverOptions.Tracker,
+		layerDownloadChunkSize:  resolverOptions.LayerDownloadChunkSize,
+		httpClient:              resolverOptions.HTTPClient,
+		repositoryCheck:         resolverOptions.RepositoryCheck,
+		repositories:            map[string]struct{}{},
+		decompressionBlocks:     resolverOptions.PipelinedDecompressionBlocks,
+		descriptorHook:          resolverOptions.DescriptorHook,
+		foreignLayerPolicy:      resolverOptions.ForeignLayerPolicy,
+		layerSourceRepositories: resolverOptions.LayerSourceRepositories,
+		pushPolicies:            resolverOptions.PushPolicies,
+		descriptorCache:         resolverOptions.DescriptorCache,
+		resolveCache:            resolverOptions.ResolveCache,
+		resolveCacheTTL:         resolverOptions.ResolveCacheTTL,
+		revalidator:             revalidator,
+		clock:                   resolverOptions.Clock,
+		backoff:                 resolverOptions.Backoff,
+		notFound:                notFound,
+		notFoundTTL:             resolverOptions.NotFoundTTL,
+		pushJournal:             resolverOptions.PushJournal,
+		pushJournalTTL:          resolverOptions.PushJournalTTL,
+		uploads:                 newUploadGroup(),
+		fetches:                 newFetchGroup(),
+		offline:                 resolverOptions.Offline,
+		acceptedMediaTypes:      resolverOptions.AcceptedMediaTypes,
+		resolvePlatform:         resolverOptions.ResolvePlatform,
+		uploadChecksums:         resolverOptions.UploadChecksums,
+		minLayerPartSize:        resolverOptions.MinLayerPartSize,
+		maxLayerPartSize:        resolverOptions.MaxLayerPartSize,
+		eventHandler:            telemetry.eventHandler(resolverOptions.EventHandler),
+		apiOptions:              resolverOptions.APIOptions,
+		stats:                   &statsRecorder{},
+		mirrors:                 resolverOptions.Mirrors,
+		layerPriority:           resolverOptions.LayerPriority,
+		schedulingKey:           resolverOptions.LayerDownloadKey,
+		smallBlobThreshold:      resolverOptions.SmallBlobThreshold,
+		sizeBackfill:            resolverOptions.SizeBackfill,
+		layerStallTimeout:       resolverOptions.LayerStallTimeout,
+		apiCallBudget:           resolverOptions.APICallBudget,
+		blobTransport:           resolverOptions.BlobTransport,
+		registryConfig:          resolverOptions.RegistryConfig,
+		createRepository:        resolverOptions.CreateRepositoryOnPush,
+		indexManifestCheck:      resolverOptions.IndexManifestCheck,
+		schema1:                 schema1,
+		runtime:                 runtime,
+		telemetry:               telemetry,
+		apiConfig:               apiRetryConfig(resolverOptions.Session, resolverOptions.APIMaxAttempts, resolverOptions.APIBackoff),
+		apiLimiter:              newAPIRateLimiter(resolverOptions.APIRateLimit, resolverOptions.APIRateBurst, resolverOptions.AdaptiveRetry, resolverOptions.Clock),
+		pullThroughCache:        pullThrough,
+		registry:                registry,
+		hostCoordinator:         resolverOptions.HostCoordinator,
+		blobCache:               resolverOptions.BlobCache,
+		logURLs:                 resolverOptions.LogPresignedURLs,
+		scanPolicy:              resolverOptions.ScanPolicy,
 	}, nil
 }
 
@@ -150,6 +1292,30 @@ func NewResolver(options ...ResolverOption) (remotes.Resolver, error) {
 //
 // Valid references are of the form "ecr.aws/arn:aws:ecr:<region>:<account>:repository/<name>:<tag>".
 func (r *ecrResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	ctx = r.runtime.logContext(ctx)
+	if r.logURLs {
+		ctx = withURLLogging(ctx)
+	}
+	r.eventHandler.emit(ctx, &ResolveStarted{Ref: ref})
+	clock := r.clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	start := clock.Now()
+	name, desc, err := r.resolve(ctx, ref)
+	duration := clock.Now().Sub(start)
+	r.stats.resolved(duration)
+	r.eventHandler.emit(ctx, &ResolveCompleted{
+		Ref:        ref,
+		Name:       name,
+		Descriptor: desc,
+		Err:        err,
+		Duration:   duration,
+	})
+	return name, desc, err
+}
+
+func (r *ecrResolver) resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
 	ecrSpec, err := ParseRef(ref)
 	if err != nil {
 		return "", ocispec.Descriptor{}, err
@@ -159,14 +1325,180 @@ func (r *ecrResolver) Resolve(ctx context.Context, ref string) (string, ocispec.
 		return "", ocispec.Descriptor{}, reference.ErrObjectRequired
 	}
 
+	if r.notFound == nil {
+		return r.resolveSpec(ctx, ref, ecrSpec)
+	}
+	key := ecrSpec.Canonical()
+	if _, ok, _ := r.notFound.Get(ctx, key); ok {
+		log.G(ctx).
+			WithField("ref", ref).
+			Debug("ecr.resolver.resolve: recently found not to exist")
+		return "", ocispec.Descriptor{}, fmt.Errorf("%s: recently found not to exist: %w", ref, errdefs.ErrNotFound)
+	}
+	name, desc, err := r.resolveSpec(ctx, ref, ecrSpec)
+	// Missing repositories are not remembered, as in checkRepository.
+	if errdefs.IsNotFound(err) && !errors.Is(err, ErrRepositoryNotFound) {
+		r.notFound.put(key, ocispec.Descriptor{}, r.clock.Now().Add(r.notFoundTTL))
+	}
+	return name, desc, err
+}
+
+// resolveSpec resolves the parsed reference ecrSpec from the caches, its
+// mirror, or ECR.
+func (r *ecrResolver) resolveSpec(ctx context.Context, ref string, ecrSpec ECRSpec) (string, ocispec.Descriptor, error) {
+	if tag, dgst := ecrSpec.TagDigest(); r.resolveCache != nil && tag != "" && dgst == "" {
+		return r.resolveTag(ctx, ref, ecrSpec)
+	}
+
+	// Digests identify immutable content, so references by digest alone
+	// may be resolved from the cache.
+	var cacheKey string
+	if tag, dgst := ecrSpec.TagDigest(); r.descriptorCache != nil && tag == "" && dgst != "" {
+		cacheKey = ecrSpec.Canonical()
+		desc, ok, err := r.descriptorCache.Get(ctx, cacheKey)
+		if err != nil {
+			log.G(ctx).
+				WithField("ref", ref).
+				WithError(err).
+				Warn("ecr.resolver.resolve: failed to read descriptor cache")
+		} else if ok {
+			log.G(ctx).
+				WithField("ref", ref).
+				Debug("ecr.resolver.resolve: resolved from cache")
+			return r.resolved(ctx, ecrSpec, desc, nil)
+		}
+	}
+
+	desc, manifest, err := r.resolveUncached(ctx, ref, ecrSpec)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+
+	if cacheKey != "" {
+		if err := r.descriptorCache.Put(ctx, cacheKey, desc); err != nil {
+			log.G(ctx).
+				WithField("ref", ref).
+				WithError(err).
+				Warn("ecr.resolver.resolve: failed to write descriptor cache")
+		}
+	}
+
+	return r.resolved(ctx, ecrSpec, desc, manifest)
+}
+
+// resolveUncached resolves ecrSpec with its mirror, if any, or with ECR.  The
+// manifest of the image is also returned if it was read, or nil if it was
+// not.
+func (r *ecrResolver) resolveUncached(ctx context.Context, ref string, ecrSpec ECRSpec) (ocispec.Descriptor, []byte, error) {
+	var (
+		desc     ocispec.Descriptor
+		manifest []byte
+		err      error
+	)
+	mirror := r.mirrorFor(ecrSpec)
+	if mirror != nil {
+		desc, err = mirror.resolve(ctx, ecrSpec)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ocispec.Descriptor{}, nil, err
+			}
+			log.G(ctx).
+				WithField("ref", ref).
+				WithField("mirror", mirror.Upstream).
+				WithError(err).
+				Warn("ecr.resolver.resolve: failed to resolve from mirror, falling back to ECR")
+		}
+	}
+	if mirror == nil || err != nil {
+		desc, manifest, err = r.resolveImage(ctx, ref, ecrSpec)
+		if r.pullThroughCache.pullsThrough(ctx, r.getClient(ecrSpec.Region(), ecrSpec.Registry()), ecrSpec, err) {
+			desc, manifest, err = r.resolvePullThrough(ctx, ref, ecrSpec)
+		}
+		if err != nil {
+			return ocispec.Descriptor{}, nil, err
+		}
+	}
+	// assert matching digest if the provided ref includes one.
+	if expectedDigest := ecrSpec.Spec().Digest().String(); expectedDigest != "" &&
+		desc.Digest.String() != expectedDigest {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("resolved image digest mismatch: %w", errdefs.ErrFailedPrecondition)
+	}
+	return desc, manifest, nil
+}
+
+// resolveTag resolves a reference by tag alone from the resolve cache, or
+// with resolveUncached, storing the descriptor found.
+func (r *ecrResolver) resolveTag(ctx context.Context, ref string, ecrSpec ECRSpec) (string, ocispec.Descriptor, error) {
+	cacheKey := ecrSpec.Canonical()
+	desc, ok, err := r.resolveCache.Get(ctx, cacheKey)
+	if err != nil {
+		log.G(ctx).
+			WithField("ref", ref).
+			WithError(err).
+			Warn("ecr.resolver.resolve: failed to read resolve cache")
+	} else if ok {
+		log.G(ctx).
+			WithField("ref", ref).
+			Debug("ecr.resolver.resolve: resolved tag from cache")
+		if r.revalidator != nil && !r.offline && !r.revalidator.isFresh(ctx, cacheKey) {
+			r.revalidate(ctx, ref, ecrSpec)
+		}
+		return r.resolved(ctx, ecrSpec, desc, nil)
+	}
+
+	desc, manifest, err := r.resolveUncached(ctx, ref, ecrSpec)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	r.cacheTag(ctx, ref, cacheKey, desc)
+	return r.resolved(ctx, ecrSpec, desc, manifest)
+}
+
+// invalidate removes the results cached for resolving ecrSpec, after the
+// image it names is pushed or its tag is moved.
+func (r *ecrResolver) invalidate(ctx context.Context, ecrSpec ECRSpec) {
+	key := ecrSpec.Canonical()
+	if r.notFound != nil {
+		r.notFound.invalidate(key)
+	}
+	if r.revalidator != nil {
+		r.revalidator.fresh.invalidate(key)
+	}
+	if r.resolveCache == nil {
+		return
+	}
+	if err := r.resolveCache.Invalidate(ctx, key); err != nil {
+		log.G(ctx).
+			WithField("ref", key).
+			WithError(err).
+			Warn("ecr.resolver: failed to invalidate resolve cache")
+	}
+}
+
+// resolveImage resolves ecrSpec with ECR, returning the manifest of the
+// image as well as its descriptor.
+func (r *ecrResolver) resolveImage(ctx context.Context, ref string, ecrSpec ECRSpec) (ocispec.Descriptor, []byte, error) {
 	batchGetImageInput := &ecr.BatchGetImageInput{
 		RegistryId:         aws.String(ecrSpec.Registry()),
 		RepositoryName:     aws.String(ecrSpec.Repository),
 		ImageIds:           []*ecr.ImageIdentifier{ecrSpec.ImageID()},
-		AcceptedMediaTypes: aws.StringSlice(supportedImageMediaTypes),
+		AcceptedMediaTypes: aws.StringSlice(acceptedMediaTypes(r.acceptedMediaTypes)),
 	}
 
-	client := r.getClient(ecrSpec.Region())
+	if image, found, ok := prefetchedImage(ctx, ecrSpec); ok {
+		if !found {
+			return ocispec.Descriptor{}, nil, fmt.Errorf("%s: %w", ref, errdefs.ErrNotFound)
+		}
+		return imageDescriptor(ctx, ref, image, batchGetImageInput.AcceptedMediaTypes)
+	}
+
+	client := r.getClient(ecrSpec.Region(), ecrSpec.Registry())
+
+	if r.repositoryCheck {
+		if err := r.checkRepository(ctx, client, ecrSpec); err != nil {
+			return ocispec.Descriptor{}, nil, err
+		}
+	}
 
 	batchGetImageOutput, err := client.BatchGetImageWithContext(ctx, batchGetImageInput)
 	if err != nil {
@@ -174,7 +1506,7 @@ func (r *ecrResolver) Resolve(ctx context.Context, ref string) (string, ocispec.
 			WithField("ref", ref).
 			WithError(err).
 			Warn("Failed while calling BatchGetImage")
-		return "", ocispec.Descriptor{}, err
+		return ocispec.Descriptor{}, nil, err
 	}
 	log.G(ctx).
 		WithField("ref", ref).
@@ -182,10 +1514,20 @@ func (r *ecrResolver) Resolve(ctx context.Context, ref string) (string, ocispec.
 		Debug("ecr.resolver.resolve")
 
 	if len(batchGetImageOutput.Images) == 0 {
-		return "", ocispec.Descriptor{}, reference.ErrInvalid
+		for _, failure := range batchGetImageOutput.Failures {
+			if aws.StringValue(failure.FailureCode) == ecr.ImageFailureCodeImageNotFound {
+				return ocispec.Descriptor{}, nil, fmt.Errorf("%s: %w", ref, errdefs.ErrNotFound)
+			}
+		}
+		return ocispec.Descriptor{}, nil, reference.ErrInvalid
 	}
-	ecrImage := batchGetImageOutput.Images[0]
+	return imageDescriptor(ctx, ref, batchGetImageOutput.Images[0], batchGetImageInput.AcceptedMediaTypes)
+}
 
+// imageDescriptor returns the descriptor and manifest of ecrImage, resolved
+// for ref by a BatchGetImage request accepting acceptedMediaTypes.
+func imageDescriptor(ctx context.Context, ref string, ecrImage *ecr.Image, acceptedMediaTypes []*string) (ocispec.Descriptor, []byte, error) {
+	var err error
 	mediaType := aws.StringValue(ecrImage.ImageManifestMediaType)
 	if mediaType == "" {
 		manifestBody := aws.StringValue(ecrImage.ImageManifest)
@@ -195,7 +1537,7 @@ func (r *ecrResolver) Resolve(ctx context.Context, ref string) (string, ocispec.
 			Trace("ecr.resolver.resolve: parsing mediaType from manifest")
 		mediaType, err = parseImageManifestMediaType(ctx, manifestBody)
 		if err != nil {
-			return "", ocispec.Descriptor{}, err
+			return ocispec.Descriptor{}, nil, err
 		}
 	}
 	log.G(ctx).
@@ -204,11 +1546,11 @@ func (r *ecrResolver) Resolve(ctx context.Context, ref string) (string, ocispec.
 		Debug("ecr.resolver.resolve")
 	// check resolved image's mediaType, it should be one of the specified in
 	// the request.
-	for i, accepted := range aws.StringValueSlice(batchGetImageInput.AcceptedMediaTypes) {
+	for i, accepted := range aws.StringValueSlice(acceptedMediaTypes) {
 		if mediaType == accepted {
 			break
 		}
-		if i+1 == len(batchGetImageInput.AcceptedMediaTypes) {
+		if i+1 == len(acceptedMediaTypes) {
 			log.G(ctx).
 				WithField("ref", ref).
 				WithField("mediaType", mediaType).
@@ -216,29 +1558,113 @@ func (r *ecrResolver) Resolve(ctx context.Context, ref string) (string, ocispec.
 		}
 	}
 
-	desc := ocispec.Descriptor{
+	return ocispec.Descriptor{
 		Digest:    digest.Digest(aws.StringValue(ecrImage.ImageId.ImageDigest)),
 		MediaType: mediaType,
 		Size:      int64(len(aws.StringValue(ecrImage.ImageManifest))),
+	}, []byte(aws.StringValue(ecrImage.ImageManifest)), nil
+}
+
+// resolved returns the result of Resolve for the descriptor found for
+// ecrSpec, whose manifest is given if it has already been read.
+func (r *ecrResolver) resolved(ctx context.Context, ecrSpec ECRSpec, desc ocispec.Descriptor, manifest []byte) (string, ocispec.Descriptor, error) {
+	if r.resolvePlatform != nil && images.IsIndexType(desc.MediaType) {
+		var err error
+		desc, err = r.selectPlatform(ctx, ecrSpec, desc, manifest)
+		if err != nil {
+			return "", ocispec.Descriptor{}, err
+		}
+		manifest = nil
 	}
-	// assert matching digest if the provided ref includes one.
-	if expectedDigest := ecrSpec.Spec().Digest().String(); expectedDigest != "" &&
-		desc.Digest.String() != expectedDigest {
-		return "", ocispec.Descriptor{}, fmt.Errorf("resolved image digest mismatch: %w", errdefs.ErrFailedPrecondition)
+	if r.scanPolicy != nil {
+		if err := r.checkScan(ctx, ecrSpec.Canonical(), ecrSpec, desc, manifest); err != nil {
+			return "", ocispec.Descriptor{}, err
+		}
+	}
+	if r.schema1 != nil && desc.MediaType == images.MediaTypeDockerSchema1Manifest {
+		var err error
+		desc, err = r.convertSchema1(ctx, ecrSpec, desc, manifest)
+		if err != nil {
+			return "", ocispec.Descriptor{}, err
+		}
+	}
+	if r.descriptorHook != nil {
+		var err error
+		desc, err = r.descriptorHook(ctx, ecrSpec.Canonical(), desc)
+		if err != nil {
+			return "", ocispec.Descriptor{}, err
+		}
 	}
-
 	return ecrSpec.Canonical(), desc, nil
 }
 
-func (r *ecrResolver) getClient(region string) ecrAPI {
+// getRegistryAPI returns the resolver's client of the registries' Docker
+// Registry HTTP API.  Resolvers not created with NewResolver get a client of
+// their own for each call, which does not share its tokens.
+func (r *ecrResolver) getRegistryAPI() *registryAPI {
+	if r.registry == nil {
+		return &registryAPI{httpClient: r.httpClient, clock: r.clock}
+	}
+	return r.registry
+}
+
+// getClient returns the ECR client for the registry of account registryID in
+// region.  Clients are shared by all registries in a region unless the
+// resolver is configured per registry.  An empty registryID selects the
+// region's client with the session's configuration.
+func (r *ecrResolver) getClient(region, registryID string) ecrAPI {
+	key, config := r.clientKey(region, registryID)
 	r.clientsLock.Lock()
 	defer r.clientsLock.Unlock()
-	if _, ok := r.clients[region]; !ok {
-		r.clients[region] = ecrsdk.New(r.session, &aws.Config{
+	if _, ok := r.clients[key]; !ok {
+		client := ecrsdk.New(r.session, &aws.Config{
 			Region:     aws.String(region),
-			HTTPClient: r.httpClient})
+			HTTPClient: r.httpClient}, r.apiConfig, config)
+		// Events are also delivered to handlers set in the context of
+		// requests, so the handler is added even if r.eventHandler is nil.
+		client.Handlers.Retry.PushBackNamed(request.NamedHandler{
+			Name: "ecr.events",
+			Fn:   r.eventHandler.retryHandler,
+		})
+		r.stats.addAPIHandlers(&client.Handlers, r.apiCallBudget)
+		r.telemetry.addAPIHandlers(&client.Handlers)
+		r.apiLimiter.addAPIHandlers(&client.Handlers)
+		if r.offline {
+			addOfflineHandler(&client.Handlers)
+		}
+		for _, option := range r.apiOptions {
+			option(&client.Handlers)
+		}
+		r.clients[key] = client
+	}
+	return r.clients[key]
+}
+
+// clientKey returns the key under which the clients for the registry of
+// account registryID in region are kept, and the configuration with which
+// they are created.  Registries for which registryConfig returns nil, such as
+// those whose repository policies grant the session's identity access, share
+// the clients of their region, created with the session's configuration.
+// Their API calls still name their registry.
+func (r *ecrResolver) clientKey(region, registryID string) (string, *aws.Config) {
+	if r.registryConfig == nil || registryID == "" {
+		return region, nil
+	}
+	key := region + "/" + registryID
+	r.registryConfigsLock.Lock()
+	defer r.registryConfigsLock.Unlock()
+	config, ok := r.registryConfigs[key]
+	if !ok {
+		config = r.registryConfig(registryID, region)
+		if r.registryConfigs == nil {
+			r.registryConfigs = map[string]*aws.Config{}
+		}
+		r.registryConfigs[key] = config
+	}
+	if config == nil {
+		return region, nil
 	}
-	return r.clients[region]
+	return key, config
 }
 
 // manifestProbe provides a structure to parse and then probe a given manifest
@@ -300,14 +1726,52 @@ func (r *ecrResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher,
 	if err != nil {
 		return nil, err
 	}
-	return &ecrFetcher{
+	parallelism, scheduler := r.runtime.fetchSettings()
+	fetcher := &ecrFetcher{
 		ecrBase: ecrBase{
-			client:  r.getClient(ecrSpec.Region()),
-			ecrSpec: ecrSpec,
+			client:     r.getClient(ecrSpec.Region(), ecrSpec.Registry()),
+			ecrSpec:    ecrSpec,
+			events:     r.eventHandler,
+			transport:  r.blobTransport,
+			mediaTypes: r.acceptedMediaTypes,
 		},
-		parallelism: r.layerDownloadParallelism,
-		httpClient:  r.httpClient,
-	}, nil
+		parallelism:         parallelism,
+		chunkSize:           r.layerDownloadChunkSize,
+		httpClient:          r.httpClient,
+		scheduler:           scheduler,
+		decompressionBlocks: r.decompressionBlocks,
+		stats:               r.stats,
+		getClient:           r.getClient,
+		priority:            r.layerPriority,
+		schedulingKey:       r.schedulingKey,
+		smallBlobThreshold:  r.smallBlobThreshold,
+		sizeBackfill:        r.sizeBackfill,
+		stallTimeout:        r.layerStallTimeout,
+		clock:               r.clock,
+		backoff:             r.backoff,
+		kms:                 newKMSDenials(),
+		schema1:             r.schema1,
+		runtime:             r.runtime,
+		telemetry:           r.telemetry,
+		missing:             &missingLayersCheck{},
+		pullThrough:         r.pullThroughCache,
+		host:                r.hostCoordinator,
+		blobCache:           r.blobCache,
+		fetches:             r.fetches,
+		logURLs:             r.logURLs,
+	}
+	if scheduler != nil {
+		fetcher.order = newUnpackOrder()
+	}
+	if mirror := r.mirrorFor(ecrSpec); mirror != nil {
+		return &mirrorFetcher{
+			mirror:  mirror,
+			ref:     mirror.ref(ecrSpec),
+			ecr:     fetcher,
+			schema1: r.schema1,
+		}, nil
+	}
+	return fetcher, nil
 }
 
 func (r *ecrResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
@@ -331,11 +1795,49 @@ func (r *ecrResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, e
 		return nil, errors.New("pusher: root descriptor missing from push reference")
 	}
 
+	for _, policy := range r.pushPolicies {
+		if err := policy(ctx, ecrSpec); err != nil {
+			log.G(ctx).WithField("ref", ref).WithError(err).Debug("ecr.resolver.pusher: rejected by policy")
+			return nil, err
+		}
+	}
+
+	creator := r.repositoryCreator()
 	return &ecrPusher{
 		ecrBase: ecrBase{
-			client:  r.getClient(ecrSpec.Region()),
-			ecrSpec: ecrSpec,
+			client:     r.getClient(ecrSpec.Region(), ecrSpec.Registry()),
+			ecrSpec:    ecrSpec,
+			events:     r.eventHandler,
+			transport:  r.blobTransport,
+			mediaTypes: r.acceptedMediaTypes,
+		},
+		tracker:            r.tracker,
+		foreignLayerPolicy: r.foreignLayerPolicy,
+		layerUpload: layerUploadOptions{
+			checksums:   r.uploadChecksums,
+			minPartSize: r.minLayerPartSize,
+			maxPartSize: r.maxLayerPartSize,
+			clock:       r.clock,
+			backoff:     r.backoff,
+			creator:     creator,
 		},
-		tracker: r.tracker,
+		mounter:             &blobMounter{registryAPI: r.getRegistryAPI()},
+		layerSources:        r.layerSourceRepositories,
+		invalidate:          r.invalidate,
+		journal:             r.pushJournal,
+		journalTTL:          r.pushJournalTTL,
+		uploads:             r.uploads,
+		creator:             creator,
+		checkIndexManifests: r.indexManifestCheck,
+		runtime:             r.runtime,
 	}, nil
 }
+
+// repositoryCreator returns the creator of the repositories pushed to, or nil
+// if missing repositories are not created.
+func (r *ecrResolver) repositoryCreator() *repositoryCreator {
+	if r.createRepository == nil {
+		return nil
+	}
+	return &repositoryCreator{options: *r.createRepository}
+}
@@ -18,12 +18,17 @@ package ecr
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/awstesting/unit"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/reference"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -45,6 +50,9 @@ func TestParseImageManifestMediaType(t *testing.T) {
 		// OCI Image Spec
 		testdata.OCIImageIndex,
 		testdata.OCIImageManifest,
+		// Windows
+		testdata.WindowsManifestList,
+		testdata.WindowsManifest,
 		// Edge case
 		testdata.EmptySample,
 	} {
@@ -183,3 +191,181 @@ func TestResolvePusherAllowTagDigest(t *testing.T) {
 		})
 	}
 }
+
+func TestResolveNotFound(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{
+				Failures: []*ecr.ImageFailure{
+					{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)},
+				},
+			}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ecrAPI{
+			"fake": fakeClient,
+		},
+	}
+	_, _, err := resolver.Resolve(context.Background(), ref)
+	assert.True(t, errdefs.IsNotFound(err))
+}
+
+func TestWithAcceptedMediaTypes(t *testing.T) {
+	manifest := `{"schemaVersion": 2, "mediaType": "` + ocispec.MediaTypeImageManifest + `"}`
+	var accepted [][]string
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			accepted = append(accepted, aws.StringValueSlice(input.AcceptedMediaTypes))
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(digest.FromString(manifest).String())},
+				ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+				ImageManifest:          aws.String(manifest),
+			}}}, nil
+		},
+	}
+	resolver, err := NewResolver(WithAcceptedMediaTypes(ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageIndex))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = fakeClient
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	_, _, err = resolver.Resolve(context.Background(), ref)
+	require.NoError(t, err)
+	fetcher, err := resolver.Fetcher(context.Background(), ref)
+	require.NoError(t, err)
+	// Manifests fetched without a digest accept the configured types.
+	rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest})
+	require.NoError(t, err)
+	rc.Close()
+
+	expected := []string{ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageIndex}
+	assert.Equal(t, [][]string{expected, expected}, accepted)
+
+	_, err = NewResolver(WithAcceptedMediaTypes())
+	assert.Error(t, err, "some media type should be accepted")
+	_, err = NewResolver(WithAcceptedMediaTypes(""))
+	assert.Error(t, err, "media types should not be empty")
+}
+
+func TestWithAPIOptions(t *testing.T) {
+	var header string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("X-Test")
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		fmt.Fprint(w, `{"images":[],"failures":[]}`)
+	}))
+	defer ts.Close()
+
+	var applied []string
+	resolver, err := NewResolver(
+		WithSession(unit.Session.Copy(&aws.Config{Endpoint: aws.String(ts.URL)})),
+		WithAPIOptions(func(handlers *request.Handlers) {
+			applied = append(applied, "first")
+			handlers.Build.PushBack(func(r *request.Request) {
+				r.HTTPRequest.Header.Set("X-Test", "value")
+			})
+		}),
+		WithAPIOptions(func(*request.Handlers) {
+			applied = append(applied, "second")
+		}))
+	require.NoError(t, err)
+
+	_, _, err = resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	assert.ErrorIs(t, err, reference.ErrInvalid)
+	assert.Equal(t, "value", header, "should send header added by option")
+	assert.Equal(t, []string{"first", "second"}, applied, "should apply options in order")
+
+	_, _, err = resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:other")
+	assert.ErrorIs(t, err, reference.ErrInvalid)
+	assert.Len(t, applied, 2, "should apply options once per client")
+}
+
+func TestWithAPICallBudget(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if r.Header.Get("X-Amz-Target") == "AmazonEC2ContainerRegistry_V20150921.GetDownloadUrlForLayer" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"__type":"ServerException"}`)
+			return
+		}
+		fmt.Fprint(w, `{"images":[],"failures":[]}`)
+	}))
+	defer ts.Close()
+
+	resolver, err := NewResolver(
+		WithSession(unit.Session.Copy(&aws.Config{
+			Endpoint:   aws.String(ts.URL),
+			SleepDelay: func(time.Duration) {},
+		})),
+		WithAPICallBudget("BatchGetImage", 1),
+		WithAPICallBudget("GetDownloadUrlForLayer", 2))
+	require.NoError(t, err)
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	_, _, err = resolver.Resolve(context.Background(), ref)
+	assert.ErrorIs(t, err, reference.ErrInvalid)
+	_, _, err = resolver.Resolve(context.Background(), ref)
+	assert.ErrorIs(t, err, ErrAPICallBudgetExceeded)
+	assert.Equal(t, 1, requests, "should not send calls over budget")
+
+	// Retries count towards the budget.
+	fetcher, err := resolver.Fetcher(context.Background(), ref)
+	require.NoError(t, err)
+	_, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("layer"),
+		Size:      5,
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, requests, "should stop retrying when the budget is used")
+
+	stats := resolver.(StatsProvider).Stats()
+	assert.Equal(t, map[string]int64{"BatchGetImage": 1, "GetDownloadUrlForLayer": 2}, stats.APICalls)
+
+	_, err = NewResolver(WithAPICallBudget("BatchGetImage", -1))
+	assert.Error(t, err, "negative budgets should be rejected")
+}
+
+func TestWithOffline(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer ts.Close()
+
+	cache := NewMemoryDescriptorCache(10)
+	resolver, err := NewResolver(
+		WithSession(unit.Session.Copy(&aws.Config{Endpoint: aws.String(ts.URL)})),
+		WithDescriptorCache(cache),
+		WithOffline())
+	require.NoError(t, err)
+
+	_, _, err = resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	assert.ErrorIs(t, err, ErrOffline)
+
+	dgst := digest.FromString("manifest")
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar@" + dgst.String()
+	cached := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: dgst, Size: 8}
+	require.NoError(t, cache.Put(context.Background(), ref, cached))
+	_, desc, err := resolver.Resolve(context.Background(), ref)
+	require.NoError(t, err, "cached references should be resolved offline")
+	assert.Equal(t, cached, desc)
+
+	fetcher, err := resolver.Fetcher(context.Background(), ref)
+	require.NoError(t, err)
+	_, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("layer"),
+		Size:      5,
+	})
+	assert.ErrorIs(t, err, ErrOffline)
+	assert.False(t, IsTransientError(err), "offline failures should not be retried")
+
+	_, err = resolver.(*ecrResolver).httpClient.Get(ts.URL)
+	assert.ErrorIs(t, err, ErrOffline)
+	assert.Zero(t, requests, "no requests should be sent offline")
+}
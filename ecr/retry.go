@@ -0,0 +1,240 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const (
+	// adaptiveRateDecrease is the factor by which adaptive retry reduces the
+	// rate of ECR API calls when a call is throttled.
+	adaptiveRateDecrease = 0.5
+	// minAdaptiveRate is the lowest rate, in calls per second, to which
+	// adaptive retry reduces the rate of ECR API calls.
+	minAdaptiveRate = 1
+)
+
+// apiRetryConfig returns the configuration of the retries of the ECR clients
+// created by a resolver, or nil to use the session's retryer.  A maxAttempts
+// of zero keeps the session's number of retries.
+func apiRetryConfig(sess *session.Session, maxAttempts int, backoff Backoff) *aws.Config {
+	if maxAttempts == 0 && backoff == nil {
+		return nil
+	}
+	retries := maxAttempts - 1
+	if maxAttempts == 0 {
+		retries = client.DefaultRetryerMaxNumRetries
+		if sess != nil && sess.Config.MaxRetries != nil && *sess.Config.MaxRetries >= 0 {
+			retries = *sess.Config.MaxRetries
+		}
+	}
+	cfg := aws.NewConfig().WithMaxRetries(retries)
+	if backoff == nil {
+		return cfg
+	}
+	return request.WithRetryer(cfg, apiRetryer{
+		DefaultRetryer: client.DefaultRetryer{NumMaxRetries: retries},
+		backoff:        backoff,
+	})
+}
+
+// apiRetryer retries ECR API calls as the AWS SDK's default retryer does,
+// delaying them by the durations its backoff returns.
+type apiRetryer struct {
+	client.DefaultRetryer
+	backoff Backoff
+}
+
+func (r apiRetryer) RetryRules(req *request.Request) time.Duration {
+	return r.backoff(req.RetryCount + 1)
+}
+
+// apiRateLimiter paces the ECR API calls of a resolver with a token bucket
+// shared by all of its clients.  When adaptive, the rate is halved whenever a
+// call is throttled and raised by about one call per second every second
+// while calls succeed, until it is back to the configured rate.  Adaptive
+// limiters without a configured rate leave calls unlimited until one is
+// throttled, and again once the rate recovers to the rate measured then.
+type apiRateLimiter struct {
+	clock    Clock
+	adaptive bool
+	maxRate  float64
+	burst    float64
+
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	// ceiling is the rate at which an adaptive limiter without a
+	// configured rate stops limiting calls.
+	ceiling float64
+	// sent counts the calls admitted since windowStart, from which the
+	// rate of the last complete second is measured.
+	sent        int
+	windowStart time.Time
+	measured    float64
+}
+
+// newAPIRateLimiter returns the limiter of a resolver's ECR API calls, or nil
+// if they are not limited.
+func newAPIRateLimiter(rate float64, burst int, adaptive bool, clock Clock) *apiRateLimiter {
+	if rate <= 0 && !adaptive {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &apiRateLimiter{
+		clock:    clock,
+		adaptive: adaptive,
+		maxRate:  rate,
+		burst:    float64(burst),
+		rate:     rate,
+		tokens:   float64(burst),
+	}
+}
+
+// addAPIHandlers adds handlers to an ECR client's handlers delaying each
+// attempt of its calls until the limiter admits it and, for adaptive
+// limiters, adapting the rate to the outcome of each attempt.
+func (l *apiRateLimiter) addAPIHandlers(handlers *request.Handlers) {
+	if l == nil {
+		return
+	}
+	handlers.Sign.PushFrontNamed(request.NamedHandler{
+		Name: "ecr.ratelimit.wait",
+		Fn: func(r *request.Request) {
+			if err := l.wait(r.Context()); err != nil {
+				r.Error = fmt.Errorf("%s: waiting for API rate limit: %w", r.Operation.Name, err)
+			}
+		},
+	})
+	if !l.adaptive {
+		return
+	}
+	handlers.CompleteAttempt.PushBackNamed(request.NamedHandler{
+		Name: "ecr.ratelimit.adapt",
+		Fn: func(r *request.Request) {
+			switch {
+			case r.Error == nil:
+				l.succeeded()
+			case r.IsErrorThrottle():
+				l.throttled()
+			}
+		},
+	})
+}
+
+// wait blocks until the limiter admits a call or ctx is done.
+func (l *apiRateLimiter) wait(ctx context.Context) error {
+	for {
+		delay, ok := l.take()
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.clock.After(delay):
+		}
+	}
+}
+
+// take admits a call if a token is available, and otherwise returns how long
+// until one is.
+func (l *apiRateLimiter) take() (time.Duration, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.clock.Now()
+	l.measure(now)
+	if l.rate > 0 {
+		l.refill(now)
+		if l.tokens < 1 {
+			return time.Duration((1 - l.tokens) / l.rate * float64(time.Second)), false
+		}
+		l.tokens--
+	}
+	l.sent++
+	return 0, true
+}
+
+// refill adds the tokens accrued at the current rate since the last refill.
+func (l *apiRateLimiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+}
+
+// measure records the rate of the calls admitted in each second.
+func (l *apiRateLimiter) measure(now time.Time) {
+	if l.windowStart.IsZero() {
+		l.windowStart = now
+	}
+	if elapsed := now.Sub(l.windowStart); elapsed >= time.Second {
+		l.measured = float64(l.sent) / elapsed.Seconds()
+		l.sent = 0
+		l.windowStart = now
+	}
+}
+
+// throttled reduces the rate after a throttled call.
+func (l *apiRateLimiter) throttled() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.clock.Now()
+	rate := l.rate
+	if rate > 0 {
+		l.refill(now)
+	} else {
+		rate = l.measured
+		if elapsed := now.Sub(l.windowStart).Seconds(); elapsed > 0 {
+			rate = math.Max(rate, float64(l.sent)/elapsed)
+		}
+		rate = math.Max(rate, minAdaptiveRate)
+		l.ceiling = rate
+		l.tokens = 0
+		l.last = now
+	}
+	l.rate = math.Max(rate*adaptiveRateDecrease, minAdaptiveRate)
+}
+
+// succeeded raises the rate after a successful call, so that it increases by
+// about one call per second every second.
+func (l *apiRateLimiter) succeeded() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate <= 0 {
+		return
+	}
+	l.refill(l.clock.Now())
+	l.rate += 1 / l.rate
+	if l.maxRate > 0 && l.rate >= l.maxRate {
+		l.rate = l.maxRate
+	} else if l.maxRate <= 0 && l.rate >= l.ceiling {
+		l.rate = 0
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// advancingClock is a fakeClock whose waits advance it.
+type advancingClock struct {
+	*fakeClock
+}
+
+func (c advancingClock) After(d time.Duration) <-chan time.Time {
+	ch := c.fakeClock.After(d)
+	c.advance(d)
+	return ch
+}
+
+func TestAPIRetryPolicy(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"__type":"ThrottlingException"}`)
+	}))
+	defer ts.Close()
+
+	var attempts []int
+	clock := advancingClock{&fakeClock{now: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}}
+	resolver, err := NewResolver(
+		WithSession(unit.Session.Copy(&aws.Config{
+			Endpoint:   aws.String(ts.URL),
+			SleepDelay: func(time.Duration) {},
+		})),
+		WithClock(clock),
+		WithAPIMaxAttempts(3),
+		WithAPIBackoff(func(attempt int) time.Duration {
+			attempts = append(attempts, attempt)
+			return time.Second
+		}),
+		WithAPIRateLimit(10, 1),
+		WithAdaptiveRetry())
+	require.NoError(t, err)
+
+	_, _, err = resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.Error(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	assert.Equal(t, []int{1, 2}, attempts)
+	limiter := resolver.(*ecrResolver).apiLimiter
+	assert.Equal(t, 1.25, limiter.rate, "rate should be halved for each throttled call")
+}
+
+func TestAPIRateLimiter(t *testing.T) {
+	clock := advancingClock{&fakeClock{now: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}}
+	limiter := newAPIRateLimiter(2, 2, false, clock)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, limiter.wait(context.Background()))
+	}
+	assert.Equal(t, []time.Duration{500 * time.Millisecond}, clock.waits, "calls beyond the burst should wait for a token")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	limiter = newAPIRateLimiter(1, 1, false, &fakeClock{})
+	require.NoError(t, limiter.wait(ctx))
+	assert.ErrorIs(t, limiter.wait(ctx), context.Canceled)
+
+	assert.Nil(t, newAPIRateLimiter(0, 0, false, clock), "calls should not be limited without a rate")
+}
+
+func TestAdaptiveRetryWithoutRateLimit(t *testing.T) {
+	clock := advancingClock{&fakeClock{now: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}}
+	limiter := newAPIRateLimiter(0, 0, true, clock)
+	for i := 0; i < 8; i++ {
+		require.NoError(t, limiter.wait(context.Background()))
+	}
+	clock.advance(time.Second)
+	require.NoError(t, limiter.wait(context.Background()))
+	assert.Empty(t, clock.waits, "calls should not be limited before one is throttled")
+
+	limiter.throttled()
+	assert.Equal(t, 4.0, limiter.rate)
+	limiter.throttled()
+	assert.Equal(t, 2.0, limiter.rate)
+	for i := 0; i < 100 && limiter.rate > 0; i++ {
+		limiter.succeeded()
+	}
+	assert.Equal(t, 0.0, limiter.rate, "calls should not be limited once the rate recovers")
+}
+
+func TestWithAPIRetryOptionsInvalid(t *testing.T) {
+	for _, option := range []ResolverOption{
+		WithAPIMaxAttempts(0),
+		WithAPIBackoff(nil),
+		WithAPIRateLimit(0, 1),
+		WithAPIRateLimit(1, 0),
+	} {
+		_, err := NewResolver(WithSession(unit.Session), option)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// revalidateCacheSize bounds the number of tags a resolver configured with
+// WithResolveCacheStaleness records as freshly resolved.  Tags evicted are
+// only refreshed earlier than necessary.
+const revalidateCacheSize = 1024
+
+// revalidator serves the descriptors of the resolve cache for a staleness
+// window after their TTL passes, refreshing them in the background.
+type revalidator struct {
+	window time.Duration
+	// fresh records the tags resolved within the resolve cache TTL.  The
+	// resolve cache may be shared or persisted, so tags resolved by another
+	// resolver are refreshed the first time they are served.
+	fresh *memoryDescriptorCache
+
+	mu       sync.Mutex
+	inflight map[string]struct{}
+}
+
+func newRevalidator(window time.Duration, clock Clock) *revalidator {
+	return &revalidator{
+		window:   window,
+		fresh:    newMemoryDescriptorCache(revalidateCacheSize, clock),
+		inflight: map[string]struct{}{},
+	}
+}
+
+// isFresh reports whether the tag cached for key was resolved within the
+// resolve cache TTL.
+func (v *revalidator) isFresh(ctx context.Context, key string) bool {
+	_, ok, _ := v.fresh.Get(ctx, key)
+	return ok
+}
+
+// start reports whether a refresh of key should be started, which is false
+// if one is already in flight.  done must be called when a refresh started
+// completes.
+func (v *revalidator) start(key string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.inflight[key]; ok {
+		return false
+	}
+	v.inflight[key] = struct{}{}
+	return true
+}
+
+func (v *revalidator) done(key string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.inflight, key)
+}
+
+// cacheTag stores desc in the resolve cache for the tag named by key.  With a
+// staleness window, the descriptor is kept for the window beyond the TTL and
+// recorded as fresh until the TTL passes.
+func (r *ecrResolver) cacheTag(ctx context.Context, ref, key string, desc ocispec.Descriptor) {
+	ttl := r.resolveCacheTTL
+	if r.revalidator != nil {
+		ttl += r.revalidator.window
+		r.revalidator.fresh.put(key, desc, r.clock.Now().Add(r.resolveCacheTTL))
+	}
+	if err := r.resolveCache.Set(ctx, key, desc, ttl); err != nil {
+		log.G(ctx).
+			WithField("ref", ref).
+			WithError(err).
+			Warn("ecr.resolver.resolve: failed to write resolve cache")
+	}
+}
+
+// revalidate resolves the stale tag ecrSpec with ECR in the background,
+// updating the resolve cache with the descriptor found, or removing the tag
+// from it if it no longer exists.  Only one refresh of a tag is in flight at
+// a time.
+func (r *ecrResolver) revalidate(ctx context.Context, ref string, ecrSpec ECRSpec) {
+	key := ecrSpec.Canonical()
+	if !r.revalidator.start(key) {
+		return
+	}
+	// The refresh outlives the resolution serving the stale descriptor, so
+	// it must not be canceled with it.
+	ctx = log.WithLogger(context.Background(), log.G(ctx))
+	go func() {
+		defer r.revalidator.done(key)
+		desc, _, err := r.resolveUncached(ctx, ref, ecrSpec)
+		switch {
+		case errdefs.IsNotFound(err):
+			log.G(ctx).
+				WithField("ref", ref).
+				Debug("ecr.resolver.revalidate: tag no longer exists")
+			r.invalidate(ctx, ecrSpec)
+		case err != nil:
+			log.G(ctx).
+				WithField("ref", ref).
+				WithError(err).
+				Warn("ecr.resolver.revalidate: failed to refresh stale tag")
+		default:
+			log.G(ctx).
+				WithField("ref", ref).
+				WithField("digest", desc.Digest).
+				Debug("ecr.resolver.revalidate: refreshed stale tag")
+			r.cacheTag(ctx, ref, key, desc)
+		}
+	}()
+}
@@ -0,0 +1,270 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/sirupsen/logrus"
+)
+
+// RuntimeOptions are the settings of a resolver which may be changed with
+// Update while the resolver is in use.
+type RuntimeOptions struct {
+	// LayerDownloadLimit bounds the number of layers downloaded concurrently
+	// across all images pulled with the resolver, or is zero if downloads are
+	// not limited.  Lowering it holds back new downloads until those in
+	// progress fall below the limit; raising it starts waiting downloads
+	// immediately.
+	LayerDownloadLimit int
+	// LayerDownloadParallelism is the number of parallel requests with which
+	// each layer is downloaded by the fetchers created after it is set.
+	LayerDownloadParallelism int
+	// LayerDownloadBandwidth caps the bytes per second read by all of the
+	// resolver's layer downloads together, or is zero if they are not capped.
+	LayerDownloadBandwidth int64
+	// DebugLogging logs the operations of the resolver and its fetchers and
+	// pushers at debug level, whatever the level of the logger in their
+	// contexts.
+	DebugLogging bool
+}
+
+// Updater is implemented by resolvers whose RuntimeOptions may be changed
+// while they are in use, so that long-running agents can be tuned without
+// being restarted or draining the pulls in progress.
+type Updater interface {
+	// RuntimeOptions returns the resolver's current settings.
+	RuntimeOptions() RuntimeOptions
+	// Update calls update with the resolver's current settings and applies
+	// the settings it leaves.  Updates are serialized, so concurrent callers
+	// each see the changes of those before them.  If the updated settings
+	// are invalid, none of them are applied.
+	Update(ctx context.Context, update func(options *RuntimeOptions)) error
+}
+
+var _ Updater = (*ecrResolver)(nil)
+
+// runtimeSettings holds the RuntimeOptions of a resolver, shared with its
+// fetchers and pushers.
+type runtimeSettings struct {
+	lock    sync.Mutex
+	options RuntimeOptions
+	// policy is the SchedulingPolicy of the scheduler created when a limit
+	// is first set.
+	policy SchedulingPolicy
+	// scheduler bounds layer downloads, and is nil if no limit was ever set.
+	scheduler *transferScheduler
+	bandwidth *bandwidthLimiter
+}
+
+func newRuntimeSettings(options RuntimeOptions, policy SchedulingPolicy, clock Clock) *runtimeSettings {
+	s := &runtimeSettings{
+		options:   options,
+		policy:    policy,
+		bandwidth: &bandwidthLimiter{clock: clock, rate: options.LayerDownloadBandwidth},
+	}
+	if options.LayerDownloadLimit > 0 {
+		s.scheduler = newTransferScheduler(options.LayerDownloadLimit, policy)
+	}
+	return s
+}
+
+func (s *runtimeSettings) get() RuntimeOptions {
+	if s == nil {
+		return RuntimeOptions{}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.options
+}
+
+// fetchSettings returns the layer download parallelism and scheduler of a new
+// fetcher.
+func (s *runtimeSettings) fetchSettings() (int, *transferScheduler) {
+	if s == nil {
+		return 0, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.options.LayerDownloadParallelism, s.scheduler
+}
+
+func (s *runtimeSettings) update(ctx context.Context, update func(options *RuntimeOptions)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	options := s.options
+	update(&options)
+	if err := validateRuntimeOptions(options); err != nil {
+		return err
+	}
+	if options == s.options {
+		return nil
+	}
+
+	if options.LayerDownloadLimit != s.options.LayerDownloadLimit {
+		if s.scheduler == nil {
+			s.scheduler = newTransferScheduler(options.LayerDownloadLimit, s.policy)
+		} else {
+			s.scheduler.setLimit(options.LayerDownloadLimit)
+		}
+	}
+	s.bandwidth.setRate(options.LayerDownloadBandwidth)
+	s.options = options
+	log.G(ctx).
+		WithField("layerDownloadLimit", options.LayerDownloadLimit).
+		WithField("layerDownloadParallelism", options.LayerDownloadParallelism).
+		WithField("layerDownloadBandwidth", options.LayerDownloadBandwidth).
+		WithField("debugLogging", options.DebugLogging).
+		Info("ecr.resolver.update: runtime options updated")
+	return nil
+}
+
+func validateRuntimeOptions(options RuntimeOptions) error {
+	if options.LayerDownloadLimit < 0 {
+		return fmt.Errorf("layer download limit must not be negative, got %d", options.LayerDownloadLimit)
+	}
+	if options.LayerDownloadParallelism < 0 {
+		return fmt.Errorf("layer download parallelism must not be negative, got %d", options.LayerDownloadParallelism)
+	}
+	if options.LayerDownloadBandwidth < 0 {
+		return fmt.Errorf("layer download bandwidth must not be negative, got %d", options.LayerDownloadBandwidth)
+	}
+	return nil
+}
+
+// logContext returns ctx with a logger at debug level if DebugLogging is set
+// and the logger of ctx does not already log debug messages.
+func (s *runtimeSettings) logContext(ctx context.Context) context.Context {
+	if !s.get().DebugLogging {
+		return ctx
+	}
+	entry := log.G(ctx)
+	if entry.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return ctx
+	}
+	logger := &logrus.Logger{
+		Out:          entry.Logger.Out,
+		Hooks:        entry.Logger.Hooks,
+		Formatter:    entry.Logger.Formatter,
+		ReportCaller: entry.Logger.ReportCaller,
+		Level:        logrus.DebugLevel,
+		ExitFunc:     entry.Logger.ExitFunc,
+	}
+	debug := logrus.NewEntry(logger).WithFields(entry.Data)
+	debug.Context = entry.Context
+	return log.WithLogger(ctx, debug)
+}
+
+// limitReader returns rc throttled to the resolver's layer download
+// bandwidth.  Downloads started while the bandwidth is not capped are not
+// throttled; downloads started under a cap follow later changes to it.
+func (s *runtimeSettings) limitReader(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	if s == nil || s.bandwidth.getRate() <= 0 {
+		return rc
+	}
+	return &throttledReader{ReadCloser: rc, ctx: ctx, limiter: s.bandwidth}
+}
+
+// bandwidthLimiter paces reads so that the bytes read by all of its readers
+// together do not exceed rate bytes per second.
+type bandwidthLimiter struct {
+	clock Clock
+
+	lock sync.Mutex
+	rate int64
+	// next is the time by which the bytes already read are paid for.
+	next time.Time
+}
+
+func (l *bandwidthLimiter) getRate() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
+
+func (l *bandwidthLimiter) setRate(rate int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rate = rate
+}
+
+// wait blocks until the n bytes just read are paid for at the current rate,
+// or ctx is done.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.lock.Lock()
+	if l.rate <= 0 {
+		l.lock.Unlock()
+		return nil
+	}
+	now := l.clock.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.lock.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-l.clock.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledReadSize bounds the bytes read by each read of a throttledReader,
+// so that downloads are paced smoothly rather than in bursts.
+const throttledReadSize = 64 << 10
+
+// throttledReader paces the reads of a download with a bandwidthLimiter.
+type throttledReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *bandwidthLimiter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttledReadSize {
+		p = p[:throttledReadSize]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// RuntimeOptions returns the resolver's current RuntimeOptions.
+func (r *ecrResolver) RuntimeOptions() RuntimeOptions {
+	return r.runtime.get()
+}
+
+// Update changes the resolver's RuntimeOptions.  Layer download limits and
+// bandwidth caps apply to downloads in progress as well as those started
+// later; layer download parallelism applies to the fetchers created after the
+// update.
+func (r *ecrResolver) Update(ctx context.Context, update func(options *RuntimeOptions)) error {
+	return r.runtime.update(ctx, update)
+}
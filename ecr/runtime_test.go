@@ -0,0 +1,139 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/containerd/containerd/log"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdate(t *testing.T) {
+	resolver, err := NewResolver(WithSession(unit.Session), WithLayerDownloadParallelism(4))
+	require.NoError(t, err)
+	updater := resolver.(Updater)
+	assert.Equal(t, RuntimeOptions{LayerDownloadParallelism: 4}, updater.RuntimeOptions())
+
+	require.NoError(t, updater.Update(context.Background(), func(options *RuntimeOptions) {
+		options.LayerDownloadLimit = 2
+		options.LayerDownloadBandwidth = 1 << 20
+	}))
+	assert.Equal(t, RuntimeOptions{
+		LayerDownloadLimit:       2,
+		LayerDownloadParallelism: 4,
+		LayerDownloadBandwidth:   1 << 20,
+	}, updater.RuntimeOptions())
+
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	assert.NotNil(t, fetcher.(*ecrFetcher).scheduler, "fetchers created after a limit is set should be scheduled")
+
+	err = updater.Update(context.Background(), func(options *RuntimeOptions) {
+		options.LayerDownloadLimit = 8
+		options.LayerDownloadParallelism = -1
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 2, updater.RuntimeOptions().LayerDownloadLimit, "invalid updates should not be applied")
+}
+
+func TestUpdateLayerDownloadLimit(t *testing.T) {
+	settings := newRuntimeSettings(RuntimeOptions{LayerDownloadLimit: 1}, SchedulingGreedy, SystemClock)
+	_, scheduler := settings.fetchSettings()
+	release, err := scheduler.acquire(context.Background(), "image", 0)
+	require.NoError(t, err)
+	defer release()
+
+	acquired := make(chan func())
+	go func() {
+		release, err := scheduler.acquire(context.Background(), "image", 0)
+		assert.NoError(t, err)
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("download should wait for a slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, settings.update(context.Background(), func(options *RuntimeOptions) {
+		options.LayerDownloadLimit = 2
+	}))
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("raising the limit should start the waiting download")
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	clock := &fakeClock{}
+	settings := newRuntimeSettings(RuntimeOptions{LayerDownloadBandwidth: 100 << 10}, SchedulingGreedy, clock)
+	rc := settings.limitReader(context.Background(), ioutil.NopCloser(bytes.NewReader(make([]byte, 200<<10))))
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Len(t, data, 200<<10)
+
+	var waited time.Duration
+	for _, wait := range clock.waits {
+		waited += wait
+	}
+	// The fake clock does not advance, so each read waits for the bytes read
+	// before it as well as its own.
+	require.NotEmpty(t, clock.waits)
+	assert.Equal(t, 2*time.Second, clock.waits[len(clock.waits)-1])
+	assert.True(t, waited > 2*time.Second)
+
+	settings.bandwidth.setRate(0)
+	clock.waits = nil
+	_, err = ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Empty(t, clock.waits)
+
+	uncapped := newRuntimeSettings(RuntimeOptions{}, SchedulingGreedy, clock)
+	plain := ioutil.NopCloser(strings.NewReader("layer"))
+	assert.Equal(t, plain, uncapped.limitReader(context.Background(), plain))
+}
+
+func TestDebugLogging(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	logger.Level = logrus.InfoLevel
+	ctx := log.WithLogger(context.Background(), logrus.NewEntry(logger).WithField("component", "test"))
+
+	settings := newRuntimeSettings(RuntimeOptions{}, SchedulingGreedy, SystemClock)
+	log.G(settings.logContext(ctx)).Debug("hidden")
+	assert.Empty(t, out.String())
+
+	require.NoError(t, settings.update(ctx, func(options *RuntimeOptions) {
+		options.DebugLogging = true
+	}))
+	out.Reset()
+	log.G(settings.logContext(ctx)).Debug("shown")
+	assert.Contains(t, out.String(), "shown")
+	assert.Contains(t, out.String(), "component=test")
+	assert.Equal(t, logrus.InfoLevel, logger.Level, "the context's logger should not change")
+}
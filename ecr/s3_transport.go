@@ -0,0 +1,347 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// S3TransportOptions configures the BlobTransport returned by
+// NewS3BlobTransport.
+type S3TransportOptions struct {
+	// Session is used for configuring the S3 clients.  If not specified, a
+	// generic session is used.
+	Session *session.Session
+	// HTTPClient is used for the requests to S3.  If not specified, the
+	// session's HTTP client is used.
+	HTTPClient *http.Client
+	// Concurrency is the number of parts of a layer downloaded at once.  If
+	// not specified, s3manager.DefaultDownloadConcurrency is used.
+	Concurrency int
+	// PartSize is the size of the parts of a layer requested from S3.  If not
+	// specified, s3manager.DefaultDownloadPartSize is used.
+	PartSize int64
+	// UseCredentials configures whether layers are requested with the AWS
+	// credentials of the session from the bucket and key of the download URL
+	// returned by ECR.  This is only permitted for buckets the credentials
+	// may read, such as those of a proxy or cache.  If not specified, layers
+	// are requested with the presigned download URL.
+	UseCredentials bool
+}
+
+// NewS3BlobTransport returns a BlobTransport which downloads layers with the
+// Amazon S3 transfer manager, which requests the parts of each layer in
+// parallel and retries the parts which fail.  The parts are returned in order
+// as they are downloaded, buffering at most Concurrency parts.  Foreign layers,
+// and download URLs the transport cannot request, are downloaded as if no
+// BlobTransport had been given, and layers are uploaded with ECR's API.
+func NewS3BlobTransport(options S3TransportOptions) (BlobTransport, error) {
+	if options.Session == nil {
+		awsSession, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		options.Session = awsSession
+	}
+	if options.Concurrency <= 0 {
+		options.Concurrency = s3manager.DefaultDownloadConcurrency
+	}
+	if options.PartSize <= 0 {
+		options.PartSize = s3manager.DefaultDownloadPartSize
+	}
+	return &s3BlobTransport{
+		options: options,
+		clients: map[string]*s3.S3{},
+	}, nil
+}
+
+// s3BlobTransport downloads layers with s3manager.Downloader.
+type s3BlobTransport struct {
+	options S3TransportOptions
+
+	clientsLock sync.Mutex
+	clients     map[string]*s3.S3
+}
+
+var _ BlobTransport = (*s3BlobTransport)(nil)
+
+// s3DefaultRegion is the region of S3 clients requesting URLs which do not
+// identify a region.
+const s3DefaultRegion = "us-east-1"
+
+func (t *s3BlobTransport) Download(ctx context.Context, desc ocispec.Descriptor, downloadURL string) (io.ReadCloser, error) {
+	if images.IsNonDistributable(desc.MediaType) {
+		return nil, fmt.Errorf("download foreign layer with S3 transfer manager: %w", errdefs.ErrNotImplemented)
+	}
+	parsedURL, err := url.Parse(downloadURL)
+	if err != nil {
+		return nil, redactError(ctx, err, downloadURL)
+	}
+	object, ok := parseS3URL(parsedURL)
+	var requestOptions []request.Option
+	if !t.options.UseCredentials {
+		if !ok {
+			// Each request is sent to the presigned URL itself, so the
+			// bucket and key only satisfy the validation of the input.
+			object = s3Object{bucket: parsedURL.Host, key: parsedURL.Path}
+		}
+		requestOptions = append(requestOptions, withPresignedURL(parsedURL))
+		if !logsURLs(ctx) {
+			requestOptions = append(requestOptions, withoutLogging)
+		}
+	} else if !ok {
+		return nil, fmt.Errorf("download %s from S3 with credentials: %w", parsedURL.Host, errdefs.ErrNotImplemented)
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(object.bucket),
+		Key:    aws.String(object.key),
+	}
+	downloader := s3manager.NewDownloaderWithClient(t.client(object.region), func(d *s3manager.Downloader) {
+		d.Concurrency = t.options.Concurrency
+		d.PartSize = t.options.PartSize
+		d.RequestOptions = requestOptions
+	})
+
+	log.G(ctx).
+		WithField("url", loggedURL(ctx, downloadURL)).
+		WithField("concurrency", t.options.Concurrency).
+		WithField("partSize", t.options.PartSize).
+		Debug("ecr.transport.s3: downloading layer")
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	writer := newOrderedWriterAt(pw, int64(t.options.Concurrency)*t.options.PartSize)
+	go func() {
+		_, err := downloader.DownloadWithContext(ctx, writer, input)
+		if err != nil {
+			err = redactError(ctx, err, downloadURL)
+			log.G(ctx).
+				WithError(err).
+				WithField("url", loggedURL(ctx, downloadURL)).
+				Error("ecr.transport.s3: failed to download layer")
+		}
+		writer.close(err)
+	}()
+	return &cancelReadCloser{ReadCloser: pr, cancel: cancel}, nil
+}
+
+func (t *s3BlobTransport) UploadPart(context.Context, string, *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+	return nil, fmt.Errorf("upload with S3 transfer manager: %w", errdefs.ErrNotImplemented)
+}
+
+// client returns the S3 client for region, creating it if needed.
+func (t *s3BlobTransport) client(region string) *s3.S3 {
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	t.clientsLock.Lock()
+	defer t.clientsLock.Unlock()
+	if _, ok := t.clients[region]; !ok {
+		config := &aws.Config{Region: aws.String(region)}
+		if t.options.HTTPClient != nil {
+			config.HTTPClient = t.options.HTTPClient
+		}
+		t.clients[region] = s3.New(t.options.Session, config)
+	}
+	return t.clients[region]
+}
+
+// withPresignedURL sends requests, unsigned, to a presigned URL.  The range of
+// each part is requested with a header, which is not covered by the URL's
+// signature.
+func withPresignedURL(presigned *url.URL) request.Option {
+	return func(r *request.Request) {
+		r.Config.Credentials = credentials.AnonymousCredentials
+		r.Handlers.Build.PushBack(func(r *request.Request) {
+			target := *presigned
+			r.HTTPRequest.URL = &target
+			r.HTTPRequest.Host = ""
+		})
+	}
+}
+
+// s3Object identifies an object in S3.
+type s3Object struct {
+	bucket string
+	key    string
+	region string
+}
+
+// parseS3URL returns the object addressed by an S3 URL, as either
+// "https://bucket.s3.region.amazonaws.com/key" or
+// "https://s3.region.amazonaws.com/bucket/key".
+func parseS3URL(u *url.URL) (s3Object, bool) {
+	host := u.Hostname()
+	if !strings.HasSuffix(host, ".amazonaws.com") && !strings.HasSuffix(host, ".amazonaws.com.cn") {
+		return s3Object{}, false
+	}
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		var region string
+		switch {
+		case label == "s3":
+			next := labels[i+1]
+			if next == "dualstack" {
+				next = labels[i+2]
+			}
+			if next != "amazonaws" {
+				region = next
+			}
+		case strings.HasPrefix(label, "s3-"):
+			region = strings.TrimPrefix(label, "s3-")
+		default:
+			continue
+		}
+		object := s3Object{region: region}
+		path := strings.TrimPrefix(u.Path, "/")
+		if i == 0 {
+			parts := strings.SplitN(path, "/", 2)
+			if len(parts) != 2 {
+				return s3Object{}, false
+			}
+			object.bucket, object.key = parts[0], parts[1]
+		} else {
+			object.bucket, object.key = strings.Join(labels[:i], "."), path
+		}
+		if object.bucket == "" || object.key == "" {
+			return s3Object{}, false
+		}
+		return object, true
+	}
+	return s3Object{}, false
+}
+
+// orderedWriterAt writes the parts written to it at any offset to w in order.
+// Parts beyond the next offset to be written are buffered, and writers of
+// parts more than window bytes ahead wait for the parts before them.  Parts
+// written again, as when the download of a part is retried, are skipped.
+type orderedWriterAt struct {
+	w      *io.PipeWriter
+	window int64
+
+	lock    sync.Mutex
+	ready   *sync.Cond
+	written int64
+	pending map[int64][]byte
+	err     error
+}
+
+func newOrderedWriterAt(w *io.PipeWriter, window int64) *orderedWriterAt {
+	o := &orderedWriterAt{
+		w:       w,
+		window:  window,
+		pending: map[int64][]byte{},
+	}
+	o.ready = sync.NewCond(&o.lock)
+	return o
+}
+
+func (o *orderedWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	n := len(p)
+	for o.err == nil && off-o.written > o.window {
+		o.ready.Wait()
+	}
+	if o.err != nil {
+		return 0, o.err
+	}
+	if end := off + int64(n); end <= o.written {
+		return n, nil
+	} else if off < o.written {
+		p = p[o.written-off:]
+		off = o.written
+	}
+	if off > o.written {
+		// The caller reuses p.
+		o.pending[off] = append([]byte(nil), p...)
+		return n, nil
+	}
+	if err := o.write(p); err != nil {
+		return 0, err
+	}
+	for {
+		part, ok := o.pending[o.written]
+		if !ok {
+			break
+		}
+		delete(o.pending, o.written)
+		if err := o.write(part); err != nil {
+			return 0, err
+		}
+	}
+	// Parts left behind by retries are no longer needed.
+	for offset := range o.pending {
+		if offset < o.written {
+			delete(o.pending, offset)
+		}
+	}
+	o.ready.Broadcast()
+	return n, nil
+}
+
+// write writes p to w, which must be called with lock held.
+func (o *orderedWriterAt) write(p []byte) error {
+	if _, err := o.w.Write(p); err != nil {
+		o.err = err
+		o.ready.Broadcast()
+		return err
+	}
+	o.written += int64(len(p))
+	return nil
+}
+
+// close closes the underlying pipe with err, stopping any waiting writers.
+func (o *orderedWriterAt) close(err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.err == nil {
+		o.err = io.ErrClosedPipe
+		if err == nil && len(o.pending) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	o.ready.Broadcast()
+	o.w.CloseWithError(err)
+}
+
+// cancelReadCloser cancels a download when it is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	c.cancel()
+	return c.ReadCloser.Close()
+}
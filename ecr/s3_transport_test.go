@@ -0,0 +1,199 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseS3URL(t *testing.T) {
+	for _, tc := range []struct {
+		url    string
+		object s3Object
+		ok     bool
+	}{
+		{
+			url:    "https://prod-us-west-2-starport-layer-bucket.s3.us-west-2.amazonaws.com/c1b2-123456789012-abcd/sha256:0123",
+			object: s3Object{bucket: "prod-us-west-2-starport-layer-bucket", key: "c1b2-123456789012-abcd/sha256:0123", region: "us-west-2"},
+			ok:     true,
+		},
+		{
+			url:    "https://s3.eu-west-1.amazonaws.com/bucket/path/layer",
+			object: s3Object{bucket: "bucket", key: "path/layer", region: "eu-west-1"},
+			ok:     true,
+		},
+		{
+			url:    "https://my.bucket.s3-ap-south-1.amazonaws.com/layer",
+			object: s3Object{bucket: "my.bucket", key: "layer", region: "ap-south-1"},
+			ok:     true,
+		},
+		{
+			url:    "https://bucket.s3.dualstack.us-east-2.amazonaws.com/layer",
+			object: s3Object{bucket: "bucket", key: "layer", region: "us-east-2"},
+			ok:     true,
+		},
+		{
+			url:    "https://bucket.s3.amazonaws.com/layer",
+			object: s3Object{bucket: "bucket", key: "layer"},
+			ok:     true,
+		},
+		{url: "https://s3.us-west-2.amazonaws.com/bucket"},
+		{url: "https://layers.example.com/layer"},
+		{url: "https://ecr.us-west-2.amazonaws.com/layer"},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			u, err := url.Parse(tc.url)
+			require.NoError(t, err)
+			object, ok := parseS3URL(u)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.object, object)
+		})
+	}
+}
+
+// newS3LayerServer returns a server of layer supporting range requests, and
+// records the requests made to it.
+func newS3LayerServer(t *testing.T, layer []byte) (*httptest.Server, *[]*http.Request) {
+	var (
+		lock     sync.Mutex
+		requests []*http.Request
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests = append(requests, r)
+		lock.Unlock()
+		http.ServeContent(w, r, "layer", time.Time{}, bytes.NewReader(layer))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestS3BlobTransportPresigned(t *testing.T) {
+	layer := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(layer)
+	server, requests := newS3LayerServer(t, layer)
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	}
+
+	transport, err := NewS3BlobTransport(S3TransportOptions{
+		Session:     unit.Session,
+		Concurrency: 4,
+		PartSize:    1000,
+	})
+	require.NoError(t, err)
+	rc, err := transport.Download(context.Background(), desc, server.URL+"/layer?X-Amz-Signature=signature")
+	require.NoError(t, err)
+	defer rc.Close()
+	content, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, layer, content)
+
+	require.Len(t, *requests, 10, "should request each part")
+	for _, r := range *requests {
+		assert.Equal(t, "/layer", r.URL.Path)
+		assert.Equal(t, "signature", r.URL.Query().Get("X-Amz-Signature"), "should request the presigned URL")
+		assert.NotEmpty(t, r.Header.Get("Range"))
+		assert.Empty(t, r.Header.Get("Authorization"), "should not sign presigned requests")
+	}
+
+	desc.MediaType = images.MediaTypeDockerSchema2LayerForeignGzip
+	_, err = transport.Download(context.Background(), desc, server.URL+"/layer")
+	assert.True(t, errdefs.IsNotImplemented(err), "foreign layers should be downloaded by the default transport")
+}
+
+func TestS3BlobTransportCredentials(t *testing.T) {
+	layer := []byte("layer")
+	server, requests := newS3LayerServer(t, layer)
+	transport, err := NewS3BlobTransport(S3TransportOptions{
+		Session: unit.Session.Copy(&aws.Config{
+			Endpoint:         aws.String(server.URL),
+			S3ForcePathStyle: aws.Bool(true),
+		}),
+		UseCredentials: true,
+	})
+	require.NoError(t, err)
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+	}
+
+	rc, err := transport.Download(context.Background(), desc, "https://bucket.s3.us-west-2.amazonaws.com/path/layer?X-Amz-Signature=signature")
+	require.NoError(t, err)
+	defer rc.Close()
+	content, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, layer, content)
+	require.Len(t, *requests, 1)
+	assert.Equal(t, "/bucket/path/layer", (*requests)[0].URL.Path)
+	assert.Contains(t, (*requests)[0].Header.Get("Authorization"), "/us-west-2/s3/", "should sign requests for the bucket's region")
+
+	_, err = transport.Download(context.Background(), desc, "https://layers.example.com/layer")
+	assert.True(t, errdefs.IsNotImplemented(err), "URLs outside S3 should be downloaded by the default transport")
+}
+
+func TestOrderedWriterAt(t *testing.T) {
+	pr, pw := io.Pipe()
+	writer := newOrderedWriterAt(pw, 4)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, part := range []struct {
+			data string
+			off  int64
+		}{
+			{"ef", 4},
+			{"cd", 2},
+			// A part retried after being partly written.
+			{"c", 2},
+			{"ab", 0},
+			{"cd", 2},
+			{"gh", 6},
+		} {
+			n, err := writer.WriteAt([]byte(part.data), part.off)
+			assert.NoError(t, err)
+			assert.Equal(t, len(part.data), n)
+		}
+		writer.close(nil)
+	}()
+	content, err := ioutil.ReadAll(pr)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefgh", string(content))
+	wg.Wait()
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// scanSeverities ranks the severities of the findings of image scans, from
+// least to most severe.  Findings whose severity ECR leaves undefined rank
+// with informational findings.
+var scanSeverities = map[string]int{
+	ecr.FindingSeverityUndefined:     0,
+	ecr.FindingSeverityInformational: 0,
+	ecr.FindingSeverityLow:           1,
+	ecr.FindingSeverityMedium:        2,
+	ecr.FindingSeverityHigh:          3,
+	ecr.FindingSeverityCritical:      4,
+}
+
+// ScanPolicy refuses to resolve images which ECR has not finished scanning,
+// or whose scans found vulnerabilities more severe than permitted.  It is set
+// with WithScanPolicy.
+type ScanPolicy struct {
+	// MaxSeverity is the most severe finding permitted, such as "MEDIUM".
+	// Images with findings of a greater severity are refused.  The
+	// severities are those of ECR: "INFORMATIONAL", "LOW", "MEDIUM",
+	// "HIGH", and "CRITICAL".
+	MaxSeverity string
+}
+
+// ScanPolicyError is returned by Resolve when the resolver's ScanPolicy
+// refuses an image.  It wraps errdefs.ErrFailedPrecondition.
+type ScanPolicyError struct {
+	// Ref is the reference being resolved.
+	Ref string
+	// Digest is the digest of the refused image manifest, which is one of
+	// the manifests of the index resolved for Ref if Ref names an index.
+	Digest digest.Digest
+	// Status is the status of the image's scan, such as "IN_PROGRESS", or
+	// empty if the image has not been scanned.
+	Status string
+	// Findings counts the findings more severe than permitted, by severity.
+	Findings map[string]int64
+}
+
+func (e *ScanPolicyError) Error() string {
+	if e.Status == "" {
+		return fmt.Sprintf("ecr: image %s of %s refused by scan policy: not scanned", e.Digest, e.Ref)
+	}
+	if len(e.Findings) == 0 {
+		return fmt.Sprintf("ecr: image %s of %s refused by scan policy: scan status %s", e.Digest, e.Ref, e.Status)
+	}
+	severities := make([]string, 0, len(e.Findings))
+	for severity := range e.Findings {
+		severities = append(severities, severity)
+	}
+	sort.Slice(severities, func(i, j int) bool { return scanSeverities[severities[i]] > scanSeverities[severities[j]] })
+	counts := make([]string, len(severities))
+	for i, severity := range severities {
+		counts[i] = fmt.Sprintf("%d %s", e.Findings[severity], severity)
+	}
+	return fmt.Sprintf("ecr: image %s of %s refused by scan policy: findings %s", e.Digest, e.Ref, strings.Join(counts, ", "))
+}
+
+func (e *ScanPolicyError) Unwrap() error {
+	return errdefs.ErrFailedPrecondition
+}
+
+// WithScanPolicy is a ResolverOption to refuse images, as they are resolved,
+// which ECR has not finished scanning or whose scans found vulnerabilities
+// more severe than policy permits, so that pulls are blocked by the resolver
+// itself.  Resolve then returns a *ScanPolicyError.  Each image resolved adds
+// a DescribeImageScanFindings call, and one for each image manifest of a
+// resolved index.  The scan of an image pushed moments ago may not have
+// completed, so images are best scanned on push and resolved once scanned.
+func WithScanPolicy(policy ScanPolicy) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if _, ok := scanSeverities[policy.MaxSeverity]; !ok || policy.MaxSeverity == ecr.FindingSeverityUndefined {
+			return fmt.Errorf("unknown scan finding severity %q", policy.MaxSeverity)
+		}
+		options.ScanPolicy = &policy
+		return nil
+	}
+}
+
+// checkScan confirms that the scan policy permits desc, resolved for ref.
+// The manifests of an index are checked in its place, except for those of
+// attestations.  manifest is the content of desc if it was read, or nil.
+func (r *ecrResolver) checkScan(ctx context.Context, ref string, ecrSpec ECRSpec, desc ocispec.Descriptor, manifest []byte) error {
+	client := r.getClient(ecrSpec.Region(), ecrSpec.Registry())
+	if !images.IsIndexType(desc.MediaType) {
+		return r.checkImageScan(ctx, client, ref, ecrSpec, desc.Digest)
+	}
+	if manifest == nil {
+		base := ecrBase{client: client, ecrSpec: ecrSpec, mediaTypes: r.acceptedMediaTypes}
+		image, err := base.getImageByDescriptor(ctx, desc)
+		if err != nil {
+			return err
+		}
+		manifest = []byte(aws.StringValue(image.ImageManifest))
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(manifest, &index); err != nil {
+		return fmt.Errorf("failed to parse index %v: %w", desc.Digest, ErrInvalidManifest)
+	}
+	for _, child := range index.Manifests {
+		if child.Platform != nil && child.Platform.OS == "unknown" {
+			continue
+		}
+		if err := r.checkImageScan(ctx, client, ref, ecrSpec, child.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkImageScan confirms that the scan policy permits the image manifest
+// dgst.
+func (r *ecrResolver) checkImageScan(ctx context.Context, client ecrAPI, ref string, ecrSpec ECRSpec, dgst digest.Digest) error {
+	output, err := client.DescribeImageScanFindingsWithContext(ctx, &ecr.DescribeImageScanFindingsInput{
+		RegistryId:     aws.String(ecrSpec.Registry()),
+		RepositoryName: aws.String(ecrSpec.Repository),
+		ImageId:        &ecr.ImageIdentifier{ImageDigest: aws.String(dgst.String())},
+		MaxResults:     aws.Int64(1),
+	})
+	if isAWSErrorCode(err, ecr.ErrCodeScanNotFoundException) {
+		return &ScanPolicyError{Ref: ref, Digest: dgst}
+	}
+	if err != nil {
+		return err
+	}
+	status := ""
+	if output.ImageScanStatus != nil {
+		status = aws.StringValue(output.ImageScanStatus.Status)
+	}
+	if status != ecr.ScanStatusComplete && status != ecr.ScanStatusActive {
+		return &ScanPolicyError{Ref: ref, Digest: dgst, Status: status}
+	}
+	findings := map[string]int64{}
+	if output.ImageScanFindings != nil {
+		max := scanSeverities[r.scanPolicy.MaxSeverity]
+		for severity, count := range output.ImageScanFindings.FindingSeverityCounts {
+			if rank, ok := scanSeverities[severity]; ok && rank <= max || aws.Int64Value(count) == 0 {
+				continue
+			}
+			findings[severity] = aws.Int64Value(count)
+		}
+	}
+	if len(findings) > 0 {
+		return &ScanPolicyError{Ref: ref, Digest: dgst, Status: status, Findings: findings}
+	}
+	log.G(ctx).
+		WithField("ref", ref).
+		WithField("digest", dgst).
+		Debug("ecr.resolver.scan: image permitted by scan policy")
+	return nil
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scanFindings returns the findings of a completed scan counting findings by
+// severity.
+func scanFindings(counts map[string]int64) *ecr.DescribeImageScanFindingsOutput {
+	return &ecr.DescribeImageScanFindingsOutput{
+		ImageScanStatus:   &ecr.ImageScanStatus{Status: aws.String(ecr.ScanStatusComplete)},
+		ImageScanFindings: &ecr.ImageScanFindings{FindingSeverityCounts: aws.Int64Map(counts)},
+	}
+}
+
+func TestScanPolicy(t *testing.T) {
+	calls := 0
+	client, index := fakeIndexClient(t, &calls)
+	scans := map[digest.Digest]*ecr.DescribeImageScanFindingsOutput{}
+	client.DescribeImageScanFindingsFn = func(_ aws.Context, input *ecr.DescribeImageScanFindingsInput, _ ...request.Option) (*ecr.DescribeImageScanFindingsOutput, error) {
+		assert.Equal(t, "foo/bar", aws.StringValue(input.RepositoryName))
+		scan, ok := scans[digest.Digest(aws.StringValue(input.ImageId.ImageDigest))]
+		if !ok {
+			return nil, awserr.New(ecr.ErrCodeScanNotFoundException, "no scan", nil)
+		}
+		return scan, nil
+	}
+	resolver, err := NewResolver(WithScanPolicy(ScanPolicy{MaxSeverity: ecr.FindingSeverityMedium}))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	amd64, arm64 := index.Manifests[0].Digest, index.Manifests[1].Digest
+
+	for _, tc := range []struct {
+		name   string
+		scans  map[digest.Digest]*ecr.DescribeImageScanFindingsOutput
+		refuse *ScanPolicyError
+	}{
+		{
+			name: "permitted",
+			scans: map[digest.Digest]*ecr.DescribeImageScanFindingsOutput{
+				amd64: scanFindings(map[string]int64{ecr.FindingSeverityMedium: 3, ecr.FindingSeverityLow: 5}),
+				arm64: scanFindings(nil),
+			},
+		},
+		{
+			name: "not scanned",
+			scans: map[digest.Digest]*ecr.DescribeImageScanFindingsOutput{
+				amd64: scanFindings(nil),
+			},
+			refuse: &ScanPolicyError{Ref: ref, Digest: arm64},
+		},
+		{
+			name: "in progress",
+			scans: map[digest.Digest]*ecr.DescribeImageScanFindingsOutput{
+				amd64: {ImageScanStatus: &ecr.ImageScanStatus{Status: aws.String(ecr.ScanStatusInProgress)}},
+			},
+			refuse: &ScanPolicyError{Ref: ref, Digest: amd64, Status: ecr.ScanStatusInProgress},
+		},
+		{
+			name: "severe findings",
+			scans: map[digest.Digest]*ecr.DescribeImageScanFindingsOutput{
+				amd64: scanFindings(nil),
+				arm64: scanFindings(map[string]int64{ecr.FindingSeverityCritical: 1, ecr.FindingSeverityHigh: 2, ecr.FindingSeverityLow: 4}),
+			},
+			refuse: &ScanPolicyError{
+				Ref:      ref,
+				Digest:   arm64,
+				Status:   ecr.ScanStatusComplete,
+				Findings: map[string]int64{ecr.FindingSeverityCritical: 1, ecr.FindingSeverityHigh: 2},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			scans = tc.scans
+			_, _, err := resolver.Resolve(context.Background(), ref)
+			if tc.refuse == nil {
+				assert.NoError(t, err)
+				return
+			}
+			var refused *ScanPolicyError
+			require.True(t, errors.As(err, &refused), "unexpected error %v", err)
+			assert.Equal(t, tc.refuse, refused)
+			assert.True(t, errdefs.IsFailedPrecondition(err))
+		})
+	}
+}
+
+func TestScanPolicyErrorMessage(t *testing.T) {
+	err := &ScanPolicyError{
+		Ref:      "ref",
+		Digest:   digest.FromString("image"),
+		Status:   ecr.ScanStatusComplete,
+		Findings: map[string]int64{ecr.FindingSeverityHigh: 2, ecr.FindingSeverityCritical: 1},
+	}
+	assert.Contains(t, err.Error(), "findings 1 CRITICAL, 2 HIGH")
+	err = &ScanPolicyError{Ref: "ref", Digest: digest.FromString("image")}
+	assert.Contains(t, err.Error(), "refused by scan policy: not scanned")
+	err.Status = ecr.ScanStatusInProgress
+	assert.Contains(t, err.Error(), "scan status IN_PROGRESS")
+}
+
+func TestWithScanPolicyInvalid(t *testing.T) {
+	for _, severity := range []string{"", "SEVERE", ecr.FindingSeverityUndefined} {
+		_, err := NewResolver(WithScanPolicy(ScanPolicy{MaxSeverity: severity}))
+		assert.Error(t, err, severity)
+	}
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// SchedulingPolicy determines how the layer download concurrency budget of a
+// resolver is shared between the images it is pulling.
+type SchedulingPolicy int
+
+const (
+	// SchedulingGreedy grants a download slot to any waiting layer download.
+	// An image with many large layers may occupy every slot while other
+	// images wait.
+	SchedulingGreedy SchedulingPolicy = iota
+	// SchedulingFairShare divides download slots evenly between the images
+	// with pending downloads.  Slots that an image does not need are lent to
+	// other images, so the budget is never left idle while work is waiting.
+	SchedulingFairShare
+)
+
+// SchedulingKey returns the key under which the layer downloads of a fetcher
+// for spec share the slots of WithLayerDownloadLimit.  Under
+// SchedulingFairShare, slots are divided evenly between the keys with pending
+// downloads, so the key determines what is treated fairly: images,
+// repositories, or the tenants of a service pulling through a shared
+// resolver.
+type SchedulingKey func(ctx context.Context, spec ECRSpec) string
+
+// ImageSchedulingKey is the default SchedulingKey.  It shares download slots
+// between images.
+func ImageSchedulingKey(_ context.Context, spec ECRSpec) string {
+	return spec.Canonical()
+}
+
+// RepositorySchedulingKey is a SchedulingKey sharing download slots between
+// repositories, so that pulling many images from one repository does not
+// starve the images of other repositories.
+func RepositorySchedulingKey(_ context.Context, spec ECRSpec) string {
+	return spec.ARN()
+}
+
+// TenantSchedulingKey is a SchedulingKey sharing download slots between the
+// tenants set with WithTenant on the contexts of the downloads.  Downloads
+// without a tenant are shared by repository.
+func TenantSchedulingKey(ctx context.Context, spec ECRSpec) string {
+	if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+		return "tenant:" + tenant
+	}
+	return RepositorySchedulingKey(ctx, spec)
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a context whose layer downloads are attributed to tenant
+// by TenantSchedulingKey.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// layerSchedulingKey returns the key under which the layer downloads of the
+// fetcher are scheduled.
+func (f *ecrFetcher) layerSchedulingKey(ctx context.Context) string {
+	key := f.schedulingKey
+	if key == nil {
+		key = ImageSchedulingKey
+	}
+	return key(ctx, f.ecrSpec)
+}
+
+// transferScheduler bounds the number of concurrent transfers and divides
+// them between keys, typically one key per image, according to a
+// SchedulingPolicy.
+type transferScheduler struct {
+	limit  int
+	policy SchedulingPolicy
+
+	mu      sync.Mutex
+	running int
+	active  map[string]int
+	waiting map[string]int
+	// priorities counts the waiting transfers of each key by priority.
+	priorities map[string]map[int]int
+	// wake is closed and replaced whenever a slot is released or a waiter
+	// leaves, prompting waiters to reevaluate.
+	wake chan struct{}
+}
+
+func newTransferScheduler(limit int, policy SchedulingPolicy) *transferScheduler {
+	return &transferScheduler{
+		limit:      limit,
+		policy:     policy,
+		active:     map[string]int{},
+		waiting:    map[string]int{},
+		priorities: map[string]map[int]int{},
+		wake:       make(chan struct{}),
+	}
+}
+
+// acquire blocks until a transfer for key may start or ctx is done.  Waiting
+// transfers with lower priority values start first.  The returned function
+// releases the slot and is safe to call more than once.
+func (s *transferScheduler) acquire(ctx context.Context, key string, priority int) (func(), error) {
+	s.mu.Lock()
+	s.waiting[key]++
+	s.addPriority(key, priority, 1)
+	for !s.admit(key, priority) {
+		wake := s.wake
+		s.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.decrement(s.waiting, key)
+			s.addPriority(key, priority, -1)
+			s.broadcast()
+			s.mu.Unlock()
+			return nil, ctx.Err()
+		}
+		s.mu.Lock()
+	}
+	s.decrement(s.waiting, key)
+	s.addPriority(key, priority, -1)
+	s.active[key]++
+	s.running++
+	// Transfers outranked by this one may now start.
+	s.broadcast()
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			s.decrement(s.active, key)
+			s.running--
+			s.broadcast()
+			s.mu.Unlock()
+		})
+	}, nil
+}
+
+// setLimit changes the number of concurrent transfers, starting waiting
+// transfers if it is raised.  Transfers in progress are not stopped if it is
+// lowered.  A limit of zero admits every transfer.
+func (s *transferScheduler) setLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.broadcast()
+}
+
+// admit reports whether a transfer for key may start.  It must be called with
+// the lock held.
+func (s *transferScheduler) admit(key string, priority int) bool {
+	if s.limit <= 0 {
+		return true
+	}
+	if s.running >= s.limit || s.outranked(key, priority) {
+		return false
+	}
+	if s.policy != SchedulingFairShare {
+		return true
+	}
+	share := s.share()
+	if s.active[key] < share {
+		return true
+	}
+	// Lend the slot unless another key is waiting below its share.
+	for other, waiting := range s.waiting {
+		if other != key && waiting > 0 && s.active[other] < share {
+			return false
+		}
+	}
+	return true
+}
+
+// outranked reports whether another transfer with a lower priority value is
+// waiting to start.  Under SchedulingFairShare, slots are divided between keys
+// first, so only the transfers for the same key are compared.  It must be
+// called with the lock held.
+func (s *transferScheduler) outranked(key string, priority int) bool {
+	for other, counts := range s.priorities {
+		if s.policy == SchedulingFairShare && other != key {
+			continue
+		}
+		for p := range counts {
+			if p < priority {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addPriority adjusts the count of waiting transfers for key with priority by
+// delta.  It must be called with the lock held.
+func (s *transferScheduler) addPriority(key string, priority, delta int) {
+	counts := s.priorities[key]
+	if counts == nil {
+		counts = map[int]int{}
+		s.priorities[key] = counts
+	}
+	counts[priority] += delta
+	if counts[priority] <= 0 {
+		delete(counts, priority)
+	}
+	if len(counts) == 0 {
+		delete(s.priorities, key)
+	}
+}
+
+// share returns the number of slots each key with pending or running
+// transfers is entitled to.  It must be called with the lock held.
+func (s *transferScheduler) share() int {
+	keys := len(s.active)
+	for key := range s.waiting {
+		if _, ok := s.active[key]; !ok {
+			keys++
+		}
+	}
+	if keys == 0 || s.limit/keys < 1 {
+		return 1
+	}
+	return s.limit / keys
+}
+
+func (s *transferScheduler) decrement(counts map[string]int, key string) {
+	counts[key]--
+	if counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
+
+func (s *transferScheduler) broadcast() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// releaseOnClose invokes release once the wrapped ReadCloser is closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	defer r.release()
+	return r.ReadCloser.Close()
+}
+
+// WriteTo copies the wrapped ReadCloser to w, preserving its own WriteTo
+// method, if any, which would otherwise be hidden by the wrapper.
+func (r *releaseOnClose) WriteTo(w io.Writer) (int64, error) {
+	return copyPooled(w, r.ReadCloser)
+}
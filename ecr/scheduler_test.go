@@ -0,0 +1,208 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// acquireAsync requests a slot in the background, delivering the release
+// function once granted.
+func acquireAsync(t *testing.T, s *transferScheduler, key string) <-chan func() {
+	granted := make(chan func(), 1)
+	go func() {
+		release, err := s.acquire(context.Background(), key, 0)
+		assert.NoError(t, err)
+		granted <- release
+	}()
+	return granted
+}
+
+func TestTransferSchedulerFairShare(t *testing.T) {
+	s := newTransferScheduler(2, SchedulingFairShare)
+
+	// A single image may use the whole budget.
+	releaseA1, err := s.acquire(context.Background(), "a", 0)
+	require.NoError(t, err)
+	releaseA2, err := s.acquire(context.Background(), "a", 0)
+	require.NoError(t, err)
+
+	waitingB := acquireAsync(t, s, "b")
+	// Allow b to register as waiting before a requests another slot.
+	time.Sleep(10 * time.Millisecond)
+	waitingA := acquireAsync(t, s, "a")
+	time.Sleep(10 * time.Millisecond)
+
+	releaseA1()
+	select {
+	case releaseB := <-waitingB:
+		defer releaseB()
+	case <-time.After(time.Second):
+		t.Fatal("b should be granted the released slot")
+	}
+	select {
+	case <-waitingA:
+		t.Fatal("a should not exceed its share while b is running")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	releaseA2()
+	select {
+	case releaseA3 := <-waitingA:
+		releaseA3()
+	case <-time.After(time.Second):
+		t.Fatal("a should be granted its share")
+	}
+}
+
+func TestTransferSchedulerLendsIdleSlots(t *testing.T) {
+	s := newTransferScheduler(4, SchedulingFairShare)
+
+	releaseB, err := s.acquire(context.Background(), "b", 0)
+	require.NoError(t, err)
+	defer releaseB()
+
+	// b needs only one of its two slots, so a may borrow the other.
+	for i := 0; i < 3; i++ {
+		release, err := s.acquire(context.Background(), "a", 0)
+		require.NoError(t, err)
+		defer release()
+	}
+}
+
+func TestTransferSchedulerLimit(t *testing.T) {
+	s := newTransferScheduler(1, SchedulingGreedy)
+	release, err := s.acquire(context.Background(), "a", 0)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.acquire(ctx, "b", 0)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// Releasing twice must not free more than one slot.
+	release()
+	release()
+	release, err = s.acquire(context.Background(), "b", 0)
+	require.NoError(t, err)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.acquire(ctx, "a", 0)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	release()
+}
+
+func TestTransferSchedulerPriority(t *testing.T) {
+	s := newTransferScheduler(1, SchedulingGreedy)
+	release, err := s.acquire(context.Background(), "a", 0)
+	require.NoError(t, err)
+
+	granted := make(chan int, 3)
+	for _, priority := range []int{3, 1, 2} {
+		priority := priority
+		go func() {
+			release, err := s.acquire(context.Background(), "a", priority)
+			assert.NoError(t, err)
+			granted <- priority
+			release()
+		}()
+	}
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.waiting["a"] == 3
+	}, time.Second, time.Millisecond)
+
+	release()
+	for _, expected := range []int{1, 2, 3} {
+		select {
+		case priority := <-granted:
+			assert.Equal(t, expected, priority, "lower values should start first")
+		case <-time.After(time.Second):
+			t.Fatal("waiting transfers should start")
+		}
+	}
+}
+
+func TestTransferSchedulerPriorityFairShare(t *testing.T) {
+	s := newTransferScheduler(2, SchedulingFairShare)
+	releaseA1, err := s.acquire(context.Background(), "a", 0)
+	require.NoError(t, err)
+	releaseA2, err := s.acquire(context.Background(), "a", 0)
+	require.NoError(t, err)
+	defer releaseA2()
+
+	// Priorities order the transfers of a key, but do not take slots from
+	// other keys below their share.
+	waitingB := acquireAsync(t, s, "b")
+	time.Sleep(10 * time.Millisecond)
+	go s.acquire(context.Background(), "a", -1)
+	time.Sleep(10 * time.Millisecond)
+
+	releaseA1()
+	select {
+	case releaseB := <-waitingB:
+		releaseB()
+	case <-time.After(time.Second):
+		t.Fatal("b should be granted the released slot")
+	}
+}
+
+func TestSchedulingKeys(t *testing.T) {
+	latest, err := ParseRef("ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	stable, err := ParseRef("ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:stable")
+	require.NoError(t, err)
+	other, err := ParseRef("ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/baz:latest")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	assert.NotEqual(t, ImageSchedulingKey(ctx, latest), ImageSchedulingKey(ctx, stable))
+	assert.Equal(t, RepositorySchedulingKey(ctx, latest), RepositorySchedulingKey(ctx, stable))
+	assert.NotEqual(t, RepositorySchedulingKey(ctx, latest), RepositorySchedulingKey(ctx, other))
+
+	tenant := WithTenant(ctx, "tenant-a")
+	assert.Equal(t, TenantSchedulingKey(tenant, latest), TenantSchedulingKey(tenant, other),
+		"downloads of a tenant should share a key across repositories")
+	assert.NotEqual(t, TenantSchedulingKey(tenant, latest), TenantSchedulingKey(WithTenant(ctx, "tenant-b"), latest))
+	assert.Equal(t, RepositorySchedulingKey(ctx, latest), TenantSchedulingKey(ctx, latest),
+		"downloads without a tenant should be shared by repository")
+}
+
+func TestLayerDownloadKey(t *testing.T) {
+	resolver, err := NewResolver(
+		WithLayerDownloadLimit(2, SchedulingFairShare),
+		WithLayerDownloadKey(TenantSchedulingKey))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = &fakeECRClient{}
+
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	assert.Equal(t, "tenant:tenant-a", fetcher.(*ecrFetcher).layerSchedulingKey(WithTenant(context.Background(), "tenant-a")))
+
+	resolver, err = NewResolver(WithLayerDownloadLimit(2, SchedulingFairShare))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = &fakeECRClient{}
+	fetcher, err = resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	assert.Equal(t, fetcher.(*ecrFetcher).ecrSpec.Canonical(), fetcher.(*ecrFetcher).layerSchedulingKey(context.Background()),
+		"downloads should be shared by image by default")
+}
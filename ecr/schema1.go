@@ -0,0 +1,335 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// schema1Manifest is the part of a Docker Schema 1 manifest needed to
+// convert it.  Layers and history are listed from the top of the image down.
+type schema1Manifest struct {
+	FSLayers []struct {
+		BlobSum digest.Digest `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// schema1History is the part of a layer's v1Compatibility history needed to
+// convert it.
+type schema1History struct {
+	Author          string    `json:"author,omitempty"`
+	Created         time.Time `json:"created"`
+	Comment         string    `json:"comment,omitempty"`
+	ThrowAway       *bool     `json:"throwaway,omitempty"`
+	Size            *int64    `json:"Size,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd,omitempty"`
+	} `json:"container_config,omitempty"`
+}
+
+// empty reports whether the history marks its layer as empty.  Layers not
+// marked empty may still be, which is found when they are fetched.
+func (h *schema1History) empty() bool {
+	if h.ThrowAway != nil {
+		return *h.ThrowAway
+	}
+	return h.Size != nil && *h.Size == 0
+}
+
+// schema1Layer is a layer of a Docker Schema 1 image, as found by fetching
+// it.
+type schema1Layer struct {
+	desc   ocispec.Descriptor
+	diffID digest.Digest
+	// empty is whether the layer changes no files, so that it is omitted
+	// from the converted manifest.
+	empty bool
+}
+
+// schema1Conversions holds the manifests and configs of the images converted
+// from Docker Schema 1, so that they are fetched by the digests of the
+// converted descriptors.
+type schema1Conversions struct {
+	lock sync.Mutex
+	// converted is the descriptor of the converted manifest by the digest of
+	// the Docker Schema 1 manifest.
+	converted map[digest.Digest]ocispec.Descriptor
+	content   map[digest.Digest][]byte
+}
+
+func newSchema1Conversions() *schema1Conversions {
+	return &schema1Conversions{
+		converted: map[digest.Digest]ocispec.Descriptor{},
+		content:   map[digest.Digest][]byte{},
+	}
+}
+
+func (c *schema1Conversions) lookup(dgst digest.Digest) (ocispec.Descriptor, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	desc, ok := c.converted[dgst]
+	return desc, ok
+}
+
+func (c *schema1Conversions) store(source digest.Digest, desc ocispec.Descriptor, manifest, config []byte, configDigest digest.Digest) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.converted[source] = desc
+	c.content[desc.Digest] = manifest
+	c.content[configDigest] = config
+}
+
+// fetch returns the converted manifest or config described by desc, if it is
+// one.  A nil *schema1Conversions holds nothing.
+func (c *schema1Conversions) fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.lock.Lock()
+	data, ok := c.content[desc.Digest]
+	c.lock.Unlock()
+	if !ok {
+		return nil, false
+	}
+	log.G(ctx).Debug("ecr.fetcher: returning content converted from schema 1")
+	return ioutil.NopCloser(bytes.NewReader(data)), true
+}
+
+// convertSchema1 converts the Docker Schema 1 image desc, whose manifest is
+// fetched unless it is given, to an OCI image.  The layers of the image are
+// fetched to find their diff IDs and sizes, which Schema 1 manifests do not
+// list, and the converted manifest and config are held by r.schema1 to be
+// fetched.
+func (r *ecrResolver) convertSchema1(ctx context.Context, ecrSpec ECRSpec, desc ocispec.Descriptor, manifest []byte) (ocispec.Descriptor, error) {
+	if converted, ok := r.schema1.lookup(desc.Digest); ok {
+		return converted, nil
+	}
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("desc", desc))
+	log.G(ctx).Debug("ecr.resolver.schema1: converting")
+
+	fetcher, err := r.Fetcher(ctx, ecrSpec.Canonical())
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if manifest == nil {
+		rc, err := fetcher.Fetch(ctx, desc)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		manifest, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+
+	var m schema1Manifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to unmarshal schema 1 manifest: %w", err)
+	}
+	if len(m.History) == 0 || len(m.FSLayers) != len(m.History) {
+		return ocispec.Descriptor{}, fmt.Errorf("schema 1 manifest lists %d layers and %d history entries: %w",
+			len(m.FSLayers), len(m.History), ErrInvalidManifest)
+	}
+	history := make([]schema1History, len(m.History))
+	for i := range m.History {
+		if err := json.Unmarshal([]byte(m.History[i].V1Compatibility), &history[i]); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to unmarshal schema 1 history: %w", err)
+		}
+	}
+
+	layers, err := fetchSchema1Layers(ctx, fetcher, &m, history)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	// The image configuration of Schema 1 manifests is the history of their
+	// top layer, to which the history and diff IDs of the layers below are
+	// added from the base of the image up.
+	var image ocispec.Image
+	if err := json.Unmarshal([]byte(m.History[0].V1Compatibility), &image); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to unmarshal image from schema 1 history: %w", err)
+	}
+	image.History = nil
+	image.RootFS = ocispec.RootFS{Type: "layers"}
+	converted := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+	}
+	for i := len(m.FSLayers) - 1; i >= 0; i-- {
+		h := history[i]
+		layer := layers[m.FSLayers[i].BlobSum]
+		created := h.Created
+		image.History = append(image.History, ocispec.History{
+			Author:     h.Author,
+			Comment:    h.Comment,
+			Created:    &created,
+			CreatedBy:  strings.Join(h.ContainerConfig.Cmd, " "),
+			EmptyLayer: layer.empty,
+		})
+		if !layer.empty {
+			image.RootFS.DiffIDs = append(image.RootFS.DiffIDs, layer.diffID)
+			converted.Layers = append(converted.Layers, layer.desc)
+		}
+	}
+
+	config, err := json.Marshal(image)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	converted.Config = ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.Canonical.FromBytes(config),
+		Size:      int64(len(config)),
+	}
+	data, err := json.Marshal(converted)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	convertedDesc := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Digest:      digest.Canonical.FromBytes(data),
+		Size:        int64(len(data)),
+		Annotations: desc.Annotations,
+	}
+	r.schema1.store(desc.Digest, convertedDesc, data, config, converted.Config.Digest)
+	log.G(ctx).
+		WithField("converted", convertedDesc.Digest).
+		Debug("ecr.resolver.schema1: converted")
+	return convertedDesc, nil
+}
+
+// fetchSchema1Layers fetches the layers of the Docker Schema 1 manifest m
+// which its history does not mark empty, returning them by digest.
+func fetchSchema1Layers(ctx context.Context, fetcher remotes.Fetcher, m *schema1Manifest, history []schema1History) (map[digest.Digest]schema1Layer, error) {
+	var (
+		lock   sync.Mutex
+		layers = map[digest.Digest]schema1Layer{}
+	)
+	group, groupCtx := errgroup.WithContext(ctx)
+	for i := range m.FSLayers {
+		dgst := m.FSLayers[i].BlobSum
+		if _, ok := layers[dgst]; ok {
+			continue
+		}
+		if history[i].empty() {
+			layers[dgst] = schema1Layer{empty: true}
+			continue
+		}
+		layers[dgst] = schema1Layer{}
+		group.Go(func() error {
+			layer, err := fetchSchema1Layer(groupCtx, fetcher, dgst)
+			if err != nil {
+				return err
+			}
+			lock.Lock()
+			layers[dgst] = layer
+			lock.Unlock()
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return layers, nil
+}
+
+// fetchSchema1Layer fetches the Docker Schema 1 layer dgst to find its size,
+// compression, and diff ID, and whether it is empty.
+func fetchSchema1Layer(ctx context.Context, fetcher remotes.Fetcher, dgst digest.Digest) (schema1Layer, error) {
+	rc, err := fetcher.Fetch(ctx, ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2LayerGzip,
+		Digest:    dgst,
+	})
+	if err != nil {
+		return schema1Layer{}, err
+	}
+	defer rc.Close()
+
+	verifier := dgst.Verifier()
+	compressed := &countingWriter{Writer: verifier}
+	uncompressed, err := compression.DecompressStream(io.TeeReader(rc, compressed))
+	if err != nil {
+		return schema1Layer{}, fmt.Errorf("schema 1 layer %s: %w", dgst, err)
+	}
+	defer uncompressed.Close()
+	calc := &diffIDCalculator{empty: true, digester: digest.Canonical.Digester()}
+	if _, err := copyPooled(calc, uncompressed); err != nil {
+		return schema1Layer{}, fmt.Errorf("schema 1 layer %s: %w", dgst, err)
+	}
+	// Drain any padding after the end of the compressed stream, so that the
+	// whole blob is verified.
+	if _, err := io.Copy(compressed, rc); err != nil {
+		return schema1Layer{}, err
+	}
+	if !verifier.Verified() {
+		return schema1Layer{}, fmt.Errorf("schema 1 layer %s: digest mismatch: %w", dgst, errdefs.ErrFailedPrecondition)
+	}
+
+	mediaType := ocispec.MediaTypeImageLayerGzip
+	if uncompressed.GetCompression() == compression.Uncompressed {
+		mediaType = ocispec.MediaTypeImageLayer
+	}
+	return schema1Layer{
+		desc: ocispec.Descriptor{
+			MediaType: mediaType,
+			Digest:    dgst,
+			Size:      compressed.n,
+		},
+		diffID: calc.digester.Digest(),
+		empty:  calc.empty,
+	}, nil
+}
+
+// diffIDCalculator digests an uncompressed layer, noting whether it is made
+// only of zero bytes as the archive of a layer without files is.
+type diffIDCalculator struct {
+	empty    bool
+	digester digest.Digester
+}
+
+func (c *diffIDCalculator) Write(p []byte) (int, error) {
+	if c.empty {
+		for _, b := range p {
+			if b != 0 {
+				c.empty = false
+				break
+			}
+		}
+	}
+	return c.digester.Hash().Write(p)
+}
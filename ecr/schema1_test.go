@@ -0,0 +1,177 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// schema1Fixture serves a Docker Schema 1 image with a layer containing a
+// file and an empty layer above it.
+type schema1Fixture struct {
+	manifest []byte
+	layer    []byte
+	diffID   digest.Digest
+	emptyID  digest.Digest
+	fetched  map[digest.Digest]int
+}
+
+func newSchema1Fixture(t *testing.T) *schema1Fixture {
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: 5}))
+	_, err := tw.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	var layer bytes.Buffer
+	gz := gzip.NewWriter(&layer)
+	_, err = gz.Write(tarball.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	f := &schema1Fixture{
+		layer:   layer.Bytes(),
+		diffID:  digest.FromBytes(tarball.Bytes()),
+		emptyID: digest.FromString("empty"),
+		fetched: map[digest.Digest]int{},
+	}
+	f.manifest = []byte(fmt.Sprintf(`{
+		"schemaVersion": 1,
+		"name": "foo/bar",
+		"tag": "latest",
+		"fsLayers": [{"blobSum": %q}, {"blobSum": %q}],
+		"history": [
+			{"v1Compatibility": %q},
+			{"v1Compatibility": %q}
+		],
+		"signatures": [{}]
+	}`, f.emptyID, digest.FromBytes(f.layer),
+		`{"id":"2","architecture":"amd64","os":"linux","config":{"Cmd":["/hello"]},"created":"2016-01-02T00:00:00Z","container_config":{"Cmd":["CMD /hello"]},"throwaway":true}`,
+		`{"id":"1","created":"2016-01-01T00:00:00Z","container_config":{"Cmd":["ADD hello /"]}}`))
+	return f
+}
+
+func (f *schema1Fixture) resolver(t *testing.T, options ...ResolverOption) *ecrResolver {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(f.layer)
+	}))
+	t.Cleanup(server.Close)
+	client := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(digest.FromBytes(f.manifest).String())},
+				ImageManifest:          aws.String(string(f.manifest)),
+				ImageManifestMediaType: aws.String(images.MediaTypeDockerSchema1Manifest),
+			}}}, nil
+		},
+		GetDownloadUrlForLayerFn: func(_ aws.Context, input *ecr.GetDownloadUrlForLayerInput, _ ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			f.fetched[digest.Digest(aws.StringValue(input.LayerDigest))]++
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(server.URL)}, nil
+		},
+	}
+	resolver, err := NewResolver(options...)
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+	return resolver.(*ecrResolver)
+}
+
+func TestResolveSchema1Conversion(t *testing.T) {
+	const ref = "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	fixture := newSchema1Fixture(t)
+	resolver := fixture.resolver(t, WithSchema1Conversion())
+
+	_, desc, err := resolver.Resolve(context.Background(), ref)
+	require.NoError(t, err)
+	assert.Equal(t, ocispec.MediaTypeImageManifest, desc.MediaType)
+	assert.Equal(t, map[digest.Digest]int{digest.FromBytes(fixture.layer): 1}, fixture.fetched,
+		"only the layer not marked empty should be fetched")
+
+	fetcher, err := resolver.Fetcher(context.Background(), ref)
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, desc.Digest, digest.FromBytes(data))
+	var manifest ocispec.Manifest
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	assert.Equal(t, []ocispec.Descriptor{{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(fixture.layer),
+		Size:      int64(len(fixture.layer)),
+	}}, manifest.Layers)
+
+	rc, err = fetcher.Fetch(context.Background(), manifest.Config)
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, manifest.Config.Digest, digest.FromBytes(data))
+	var image ocispec.Image
+	require.NoError(t, json.Unmarshal(data, &image))
+	assert.Equal(t, "amd64", image.Architecture)
+	assert.Equal(t, []string{"/hello"}, image.Config.Cmd)
+	assert.Equal(t, []digest.Digest{fixture.diffID}, image.RootFS.DiffIDs)
+	require.Len(t, image.History, 2)
+	assert.Equal(t, "ADD hello /", image.History[0].CreatedBy)
+	assert.False(t, image.History[0].EmptyLayer)
+	assert.True(t, image.History[1].EmptyLayer)
+
+	// Images already converted are not fetched again.
+	_, again, err := resolver.Resolve(context.Background(), ref)
+	require.NoError(t, err)
+	assert.Equal(t, desc, again)
+	assert.Equal(t, 1, fixture.fetched[digest.FromBytes(fixture.layer)])
+}
+
+func TestResolveSchema1WithoutConversion(t *testing.T) {
+	fixture := newSchema1Fixture(t)
+	resolver := fixture.resolver(t)
+
+	_, desc, err := resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	assert.Equal(t, images.MediaTypeDockerSchema1Manifest, desc.MediaType)
+	assert.Empty(t, fixture.fetched)
+}
+
+func TestResolveSchema1ConversionDigestMismatch(t *testing.T) {
+	fixture := newSchema1Fixture(t)
+	resolver := fixture.resolver(t, WithSchema1Conversion())
+	fixture.manifest = []byte(strings.Replace(string(fixture.manifest),
+		digest.FromBytes(fixture.layer).String(), digest.FromString("other").String(), 1))
+
+	_, _, err := resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	assert.True(t, errdefs.IsFailedPrecondition(err), "expected failed precondition, got %v", err)
+}
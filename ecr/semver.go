@@ -0,0 +1,402 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// SemverResolver is implemented by resolvers able to resolve the highest
+// version tagged in a repository which satisfies a constraint.  The resolver
+// returned by NewResolver implements it.
+type SemverResolver interface {
+	ResolveLatestSemver(ctx context.Context, repoRef, constraint string) (string, ocispec.Descriptor, error)
+}
+
+var _ SemverResolver = (*ecrResolver)(nil)
+
+// ResolveLatestSemver lists the tags of the repository named by repoRef and
+// resolves the highest semantic version among them satisfying constraint,
+// returning the name and descriptor of the tag as Resolve does.  Tags are
+// versions of the form 1.2.3, optionally prefixed with "v" or followed by a
+// pre-release such as "-rc.1"; other tags are ignored.
+//
+// A constraint is a list of comparisons separated by commas or spaces, all of
+// which must hold, and several such lists may be joined with "||".  A
+// comparison is a version, partial version, or wildcard, such as "1.2.x",
+// "1.2", or "*", optionally preceded by one of =, !=, <, <=, >, >=, ~ (the
+// same minor version, such as ~1.2.3 for >=1.2.3 <1.3.0), or ^ (no change to
+// the leftmost non-zero component, such as ^1.2.3 for >=1.2.3 <2.0.0).
+// Pre-releases only satisfy constraints naming a pre-release of the same
+// version, so "1.2.x" never resolves to 1.2.4-rc.1.
+//
+// An error wrapping errdefs.ErrInvalidArgument is returned if constraint
+// cannot be parsed, and errdefs.ErrNotFound if no tag satisfies it.
+func (r *ecrResolver) ResolveLatestSemver(ctx context.Context, repoRef, constraint string) (string, ocispec.Descriptor, error) {
+	ecrSpec, err := ParseRef(repoRef)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	c, err := parseSemverConstraint(constraint)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	images, err := r.describeImages(ctx, ecrSpec, nil)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+
+	var (
+		best    *semver
+		bestTag string
+	)
+	for _, image := range images {
+		for _, tag := range image.Tags {
+			v, ok := parseSemver(tag)
+			if !ok || !c.allows(v) {
+				continue
+			}
+			// Tags of equal precedence, such as 1.2.3 and v1.2.3, are
+			// ordered by name so the choice is stable.
+			if best == nil || v.compare(best) > 0 || (v.compare(best) == 0 && tag < bestTag) {
+				best, bestTag = v, tag
+			}
+		}
+	}
+	if best == nil {
+		return "", ocispec.Descriptor{}, fmt.Errorf("%s: no tag satisfies %q: %w", ecrSpec.Repository, constraint, errdefs.ErrNotFound)
+	}
+	log.G(ctx).
+		WithField("repository", ecrSpec.Repository).
+		WithField("constraint", constraint).
+		WithField("tag", bestTag).
+		Debug("ecr.resolver.semver: selected tag")
+
+	ecrSpec.Object = bestTag
+	return r.Resolve(ctx, ecrSpec.Canonical())
+}
+
+// semver is a semantic version.  Build metadata is not supported, as "+" is
+// not allowed in tags.
+type semver struct {
+	major, minor, patch uint64
+	pre                 []string
+}
+
+// parseSemver parses a full version, optionally prefixed with "v".
+func parseSemver(s string) (*semver, bool) {
+	s = strings.TrimPrefix(s, "v")
+	core, pre, hasPre := s, "", false
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		core, pre, hasPre = s[:i], s[i+1:], true
+	}
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	var numbers [3]uint64
+	for i, part := range parts {
+		n, ok := parseSemverNumber(part)
+		if !ok {
+			return nil, false
+		}
+		numbers[i] = n
+	}
+	v := &semver{major: numbers[0], minor: numbers[1], patch: numbers[2]}
+	if hasPre {
+		v.pre = strings.Split(pre, ".")
+		for _, id := range v.pre {
+			if id == "" {
+				return nil, false
+			}
+		}
+	}
+	return v, true
+}
+
+// parseSemverNumber parses a numeric version component, which may not have
+// leading zeros.
+func parseSemverNumber(s string) (uint64, bool) {
+	if s == "" || (len(s) > 1 && s[0] == '0') {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	return n, err == nil
+}
+
+// compare returns -1, 0, or 1 as v has lower, equal, or higher precedence
+// than o.
+func (v *semver) compare(o *semver) int {
+	if c := v.compareCore(o); c != 0 {
+		return c
+	}
+	// A version without a pre-release has higher precedence than its
+	// pre-releases.
+	switch {
+	case len(v.pre) == 0 && len(o.pre) == 0:
+		return 0
+	case len(v.pre) == 0:
+		return 1
+	case len(o.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		if c := comparePrerelease(v.pre[i], o.pre[i]); c != 0 {
+			return c
+		}
+	}
+	return compareUint(uint64(len(v.pre)), uint64(len(o.pre)))
+}
+
+func (v *semver) compareCore(o *semver) int {
+	if c := compareUint(v.major, o.major); c != 0 {
+		return c
+	}
+	if c := compareUint(v.minor, o.minor); c != 0 {
+		return c
+	}
+	return compareUint(v.patch, o.patch)
+}
+
+// comparePrerelease compares pre-release identifiers: numeric identifiers
+// numerically, others lexically, and numeric identifiers before others.
+func comparePrerelease(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareUint(an, bn)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// semverComparison compares versions with version using op, one of "=",
+// "!=", "<", "<=", ">", and ">=".
+type semverComparison struct {
+	op      string
+	version *semver
+}
+
+func (c semverComparison) allows(v *semver) bool {
+	cmp := v.compare(c.version)
+	switch c.op {
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return cmp == 0
+}
+
+// semverConstraint is satisfied by versions satisfying all of the
+// comparisons of any of its alternatives.
+type semverConstraint [][]semverComparison
+
+func (c semverConstraint) allows(v *semver) bool {
+	for _, comparisons := range c {
+		if allowsAll(comparisons, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func allowsAll(comparisons []semverComparison, v *semver) bool {
+	prereleaseNamed := false
+	for _, comparison := range comparisons {
+		if !comparison.allows(v) {
+			return false
+		}
+		if len(comparison.version.pre) > 0 && v.compareCore(comparison.version) == 0 {
+			prereleaseNamed = true
+		}
+	}
+	return len(v.pre) == 0 || prereleaseNamed
+}
+
+// semverOperators are the operators of a comparison, longest first so that
+// "<=" is not read as "<".
+var semverOperators = []string{"!=", ">=", "<=", "=", ">", "<", "~", "^"}
+
+func parseSemverConstraint(s string) (semverConstraint, error) {
+	var constraint semverConstraint
+	for _, alternative := range strings.Split(s, "||") {
+		var comparisons []semverComparison
+		for _, field := range strings.FieldsFunc(alternative, func(r rune) bool { return r == ',' || r == ' ' }) {
+			parsed, err := parseSemverComparison(field)
+			if err != nil {
+				return nil, fmt.Errorf("semver constraint %q: %v: %w", s, err, errdefs.ErrInvalidArgument)
+			}
+			comparisons = append(comparisons, parsed...)
+		}
+		if len(comparisons) == 0 {
+			return nil, fmt.Errorf("semver constraint %q: empty range: %w", s, errdefs.ErrInvalidArgument)
+		}
+		constraint = append(constraint, comparisons)
+	}
+	return constraint, nil
+}
+
+// parseSemverComparison parses a comparison into the comparisons it stands
+// for, expanding partial versions and the ~ and ^ operators into ranges.
+func parseSemverComparison(s string) ([]semverComparison, error) {
+	op := ""
+	for _, candidate := range semverOperators {
+		if strings.HasPrefix(s, candidate) {
+			op = candidate
+			break
+		}
+	}
+	version := strings.TrimPrefix(strings.TrimPrefix(s, op), "v")
+
+	// Parse the components given, stopping at the first wildcard.
+	core, pre := version, ""
+	if i := strings.IndexByte(version, '-'); i >= 0 {
+		core, pre = version[:i], version[i+1:]
+	}
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("invalid version %q", version)
+	}
+	var numbers []uint64
+	for _, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		n, ok := parseSemverNumber(part)
+		if !ok {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
+		numbers = append(numbers, n)
+	}
+	if pre != "" && len(numbers) != 3 {
+		return nil, fmt.Errorf("invalid version %q: pre-release of a partial version", version)
+	}
+	lower := &semver{}
+	for i, n := range numbers {
+		switch i {
+		case 0:
+			lower.major = n
+		case 1:
+			lower.minor = n
+		case 2:
+			lower.patch = n
+		}
+	}
+	if pre != "" {
+		lower.pre = strings.Split(pre, ".")
+	}
+
+	// upper returns the first version after those matching the first n
+	// components of lower, or nil if there is none.
+	upper := func(n int) *semver {
+		switch n {
+		case 0:
+			return nil
+		case 1:
+			return &semver{major: lower.major + 1, pre: []string{"0"}}
+		case 2:
+			return &semver{major: lower.major, minor: lower.minor + 1, pre: []string{"0"}}
+		}
+		return &semver{major: lower.major, minor: lower.minor, patch: lower.patch + 1, pre: []string{"0"}}
+	}
+	// between returns the comparisons for lower up to, but excluding, next.
+	between := func(next *semver) []semverComparison {
+		comparisons := []semverComparison{{op: ">=", version: lower}}
+		if next != nil {
+			comparisons = append(comparisons, semverComparison{op: "<", version: next})
+		}
+		return comparisons
+	}
+
+	switch op {
+	case "~":
+		if len(numbers) <= 1 {
+			return between(upper(len(numbers))), nil
+		}
+		return between(upper(2)), nil
+	case "^":
+		// The range ends at the next change to the leftmost non-zero
+		// component of those given.
+		n := 1
+		switch {
+		case lower.major == 0 && len(numbers) >= 2 && lower.minor == 0 && len(numbers) == 3:
+			n = 3
+		case lower.major == 0 && len(numbers) >= 2:
+			n = 2
+		}
+		if len(numbers) < n {
+			n = len(numbers)
+		}
+		return between(upper(n)), nil
+	}
+
+	if len(numbers) == 3 {
+		if op == "" {
+			op = "="
+		}
+		return []semverComparison{{op: op, version: lower}}, nil
+	}
+	// A partial version stands for the range of versions it matches.
+	next := upper(len(numbers))
+	switch op {
+	case "", "=":
+		return between(next), nil
+	case "!=":
+		return nil, fmt.Errorf("%q: != requires a full version", s)
+	case ">":
+		if next == nil {
+			return nil, fmt.Errorf("%q: no version is greater", s)
+		}
+		return []semverComparison{{op: ">=", version: next}}, nil
+	case ">=":
+		return []semverComparison{{op: ">=", version: lower}}, nil
+	case "<":
+		return []semverComparison{{op: "<", version: lower}}, nil
+	}
+	// "<=" a partial version allows every version it matches.
+	if next == nil {
+		return []semverComparison{{op: ">=", version: lower}}, nil
+	}
+	return []semverComparison{{op: "<", version: next}}, nil
+}
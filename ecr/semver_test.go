@@ -0,0 +1,143 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSemverConstraint(t *testing.T) {
+	for _, tc := range []struct {
+		constraint string
+		allowed    []string
+		denied     []string
+	}{
+		{"1.2.x", []string{"1.2.0", "1.2.9", "v1.2.3"}, []string{"1.3.0", "1.1.9", "1.2.4-rc.1"}},
+		{"1.2", []string{"1.2.0", "1.2.9"}, []string{"1.3.0"}},
+		{"*", []string{"0.0.1", "9.9.9"}, []string{"1.0.0-beta"}},
+		{"~1.2.3", []string{"1.2.3", "1.2.9"}, []string{"1.2.2", "1.3.0"}},
+		{"^1.2.3", []string{"1.2.3", "1.9.0"}, []string{"2.0.0", "1.2.2", "2.0.0-rc.1"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{">=1.2.0, <2", []string{"1.2.0", "1.99.0"}, []string{"2.0.0", "1.1.0"}},
+		{">1.2", []string{"1.3.0"}, []string{"1.2.9"}},
+		{"<=1.2", []string{"1.2.9", "0.1.0"}, []string{"1.3.0"}},
+		{"1.x || >=3.0.0", []string{"1.5.0", "3.1.0"}, []string{"2.0.0"}},
+		{"!=1.2.3 1.2.x", []string{"1.2.4"}, []string{"1.2.3"}},
+		{">=1.2.4-rc.1 <1.3", []string{"1.2.4-rc.2", "1.2.4", "1.2.9"}, []string{"1.2.4-beta", "1.2.5-rc.1"}},
+	} {
+		t.Run(tc.constraint, func(t *testing.T) {
+			c, err := parseSemverConstraint(tc.constraint)
+			require.NoError(t, err)
+			for _, s := range tc.allowed {
+				v, ok := parseSemver(s)
+				require.True(t, ok, s)
+				assert.True(t, c.allows(v), "%s should satisfy %s", s, tc.constraint)
+			}
+			for _, s := range tc.denied {
+				v, ok := parseSemver(s)
+				require.True(t, ok, s)
+				assert.False(t, c.allows(v), "%s should not satisfy %s", s, tc.constraint)
+			}
+		})
+	}
+
+	for _, constraint := range []string{"", "1.2.3.4", "a.b", "1.2 ||", "!=1.2", "01.2.3"} {
+		_, err := parseSemverConstraint(constraint)
+		assert.True(t, errdefs.IsInvalidArgument(err), "%q should be invalid, got %v", constraint, err)
+	}
+}
+
+func TestSemverCompare(t *testing.T) {
+	// Ordered by precedence, as in the semantic versioning specification.
+	ordered := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta",
+		"1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.1.0", "2.0.0"}
+	for i := 1; i < len(ordered); i++ {
+		a, _ := parseSemver(ordered[i-1])
+		b, _ := parseSemver(ordered[i])
+		assert.Equal(t, -1, a.compare(b), "%s < %s", ordered[i-1], ordered[i])
+		assert.Equal(t, 1, b.compare(a), "%s > %s", ordered[i], ordered[i-1])
+	}
+	for _, s := range []string{"latest", "1.2", "1.2.3.4", "1.02.3", "1.2.3-", "1.2.3-a..b"} {
+		_, ok := parseSemver(s)
+		assert.False(t, ok, s)
+	}
+}
+
+func TestResolveLatestSemver(t *testing.T) {
+	const repoRef = "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar"
+	manifest := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	digests := map[string]digest.Digest{}
+	details := []*ecr.ImageDetail{}
+	for i, tags := range [][]string{{"1.2.3", "stable"}, {"v1.2.10"}, {"1.3.0"}, {"1.2.11-rc.1"}, {"latest"}} {
+		dgst := digest.FromString(manifest + string(rune('a'+i)))
+		for _, tag := range tags {
+			digests[tag] = dgst
+		}
+		details = append(details, &ecr.ImageDetail{
+			ImageDigest: aws.String(dgst.String()),
+			ImageTags:   aws.StringSlice(tags),
+		})
+	}
+	client := &fakeECRClient{
+		DescribeImagesFn: func(_ aws.Context, input *ecr.DescribeImagesInput, _ ...request.Option) (*ecr.DescribeImagesOutput, error) {
+			assert.Equal(t, "foo/bar", aws.StringValue(input.RepositoryName))
+			// Return the images over two pages.
+			if input.NextToken == nil {
+				return &ecr.DescribeImagesOutput{ImageDetails: details[:2], NextToken: aws.String("next")}, nil
+			}
+			return &ecr.DescribeImagesOutput{ImageDetails: details[2:]}, nil
+		},
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			tag := aws.StringValue(input.ImageIds[0].ImageTag)
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(digests[tag].String()), ImageTag: aws.String(tag)},
+				ImageManifest:          aws.String(manifest),
+				ImageManifestMediaType: aws.String(ocispec.MediaTypeImageManifest),
+			}}}, nil
+		},
+	}
+	resolver := &ecrResolver{clients: map[string]ecrAPI{"fake": client}}
+
+	name, desc, err := resolver.ResolveLatestSemver(context.Background(), repoRef, "1.2.x")
+	require.NoError(t, err)
+	assert.Equal(t, repoRef+":v1.2.10", name)
+	assert.Equal(t, digests["v1.2.10"], desc.Digest)
+
+	name, _, err = resolver.ResolveLatestSemver(context.Background(), repoRef, "^1")
+	require.NoError(t, err)
+	assert.Equal(t, repoRef+":1.3.0", name)
+
+	name, _, err = resolver.ResolveLatestSemver(context.Background(), repoRef, ">=1.2.11-rc.0 <1.3")
+	require.NoError(t, err)
+	assert.Equal(t, repoRef+":1.2.11-rc.1", name)
+
+	_, _, err = resolver.ResolveLatestSemver(context.Background(), repoRef, "2.x")
+	assert.True(t, errdefs.IsNotFound(err), "expected not found, got %v", err)
+
+	_, _, err = resolver.ResolveLatestSemver(context.Background(), repoRef, "latest")
+	assert.True(t, errdefs.IsInvalidArgument(err), "expected invalid argument, got %v", err)
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// SizeBackfillWrapper returns an image handler wrapper that fills in the
+// sizes of the layers and configs among the children of each descriptor
+// visited by the wrapped handler which have no size, as found in some older
+// manifests.  Sizes are looked up with sizer, such as the resolver returned
+// by NewResolver, in the repository named by ref, with one request for each
+// batch of children.  With the sizes filled in, containerd verifies the size
+// of the content it ingests and reports progress against the total.
+//
+// Manifests and indexes are left without a size, as ECR records only the
+// size of the image as a whole.  Sizes which cannot be looked up are logged
+// and left unset rather than failing the pull.
+func SizeBackfillWrapper(sizer BlobSizer, ref string) func(images.Handler) images.Handler {
+	return func(handler images.Handler) images.Handler {
+		return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			children, err := handler.Handle(ctx, desc)
+			if err != nil {
+				return children, err
+			}
+			var unsized []digest.Digest
+			for _, child := range children {
+				if needsSize(child) {
+					unsized = append(unsized, child.Digest)
+				}
+			}
+			if len(unsized) == 0 {
+				return children, nil
+			}
+			sizes, err := sizer.BlobSizes(ctx, ref, unsized)
+			if err != nil {
+				log.G(ctx).
+					WithError(err).
+					WithField("digest", desc.Digest).
+					Warn("ecr.size: failed to look up sizes of children")
+				return children, nil
+			}
+			for i := range children {
+				if size, ok := sizes[children[i].Digest]; ok && needsSize(children[i]) {
+					children[i].Size = size
+				}
+			}
+			log.G(ctx).
+				WithField("digest", desc.Digest).
+				WithField("backfilled", len(sizes)).
+				Debug("ecr.size: backfilled sizes of children")
+			return children, nil
+		})
+	}
+}
+
+// needsSize reports whether desc is a blob without a size.
+func needsSize(desc ocispec.Descriptor) bool {
+	return desc.Size == 0 && !isEmptyBlob(desc) && !images.IsManifestType(desc.MediaType) && !images.IsIndexType(desc.MediaType)
+}
+
+// backfillSize returns desc with its size set from the layer's size recorded
+// by ECR if it has none and sizes are backfilled, so that downloads report
+// progress against the total.
+func (f *ecrFetcher) backfillSize(ctx context.Context, desc ocispec.Descriptor) ocispec.Descriptor {
+	if !f.sizeBackfill || !needsSize(desc) {
+		return desc
+	}
+	sizes, err := layerSizes(ctx, f.client, f.ecrSpec, []digest.Digest{desc.Digest})
+	if err != nil {
+		log.G(ctx).WithError(err).Debug("ecr.fetcher.layer: failed to look up size")
+		return desc
+	}
+	if size, ok := sizes[desc.Digest]; ok {
+		log.G(ctx).WithField("size", size).Debug("ecr.fetcher.layer: backfilled size")
+		desc.Size = size
+	}
+	return desc
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blobSizerFunc is a BlobSizer calling itself.
+type blobSizerFunc func(ctx context.Context, ref string, digests []digest.Digest) (map[digest.Digest]int64, error)
+
+func (f blobSizerFunc) BlobSizes(ctx context.Context, ref string, digests []digest.Digest) (map[digest.Digest]int64, error) {
+	return f(ctx, ref, digests)
+}
+
+func TestSizeBackfillWrapper(t *testing.T) {
+	config := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromString("config")}
+	layer := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer"), Size: 5}
+	manifest := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("manifest")}
+	var requested []digest.Digest
+	sizer := blobSizerFunc(func(_ context.Context, ref string, digests []digest.Digest) (map[digest.Digest]int64, error) {
+		assert.Equal(t, "ref", ref)
+		requested = append(requested, digests...)
+		return map[digest.Digest]int64{config.Digest: 42}, nil
+	})
+	handler := SizeBackfillWrapper(sizer, "ref")(images.HandlerFunc(func(context.Context, ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		return []ocispec.Descriptor{config, layer, manifest}, nil
+	}))
+
+	children, err := handler.Handle(context.Background(), ocispec.Descriptor{})
+	require.NoError(t, err)
+	assert.Equal(t, []digest.Digest{config.Digest}, requested, "only blobs without a size should be looked up")
+	assert.Equal(t, int64(42), children[0].Size)
+	assert.Equal(t, int64(5), children[1].Size)
+	assert.Zero(t, children[2].Size)
+}
+
+func TestFetchLayerSizeBackfill(t *testing.T) {
+	layerData := []byte("layer")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(layerData)
+	}))
+	defer server.Close()
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(layerData),
+	}
+	client := &fakeECRClient{
+		BatchCheckLayerAvailabilityFn: func(_ aws.Context, input *ecr.BatchCheckLayerAvailabilityInput, _ ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			require.Len(t, input.LayerDigests, 1)
+			return &ecr.BatchCheckLayerAvailabilityOutput{Layers: []*ecr.Layer{{
+				LayerDigest:       input.LayerDigests[0],
+				LayerAvailability: aws.String(ecr.LayerAvailabilityAvailable),
+				LayerSize:         aws.Int64(int64(len(layerData))),
+			}}}, nil
+		},
+		GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(server.URL)}, nil
+		},
+	}
+	recorder := &progressRecorder{}
+	resolver, err := NewResolver(WithSizeBackfill(), WithEventHandler(recorder.handle))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	rc.Close()
+
+	require.NotEmpty(t, recorder.events)
+	for _, event := range recorder.events {
+		assert.Equal(t, int64(len(layerData)), event.Total, "progress should be reported against the backfilled size")
+	}
+}
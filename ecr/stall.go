@@ -0,0 +1,264 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrTransferStalled is wrapped by the errors of layer downloads which
+// received no data for longer than the timeout set with
+// WithLayerStallTimeout.  Stalled downloads are transient failures, retried
+// like dropped connections, and are told apart from the expiry of the
+// caller's deadline, which is not retried.
+var ErrTransferStalled = errors.New("ecr: layer transfer stalled")
+
+// stallWatchdog cancels the context of a transfer once no progress has been
+// reported for timeout.
+type stallWatchdog struct {
+	clock   Clock
+	timeout time.Duration
+	cancel  context.CancelFunc
+
+	// last is the time of the last progress, in nanoseconds since the Unix
+	// epoch, and fired is set once the transfer is found stalled.
+	last  int64
+	fired int32
+
+	once sync.Once
+	done chan struct{}
+}
+
+// newStallWatchdog returns a context derived from ctx for a transfer, which
+// is cancelled if the returned watchdog is not told of progress for timeout.
+// The watchdog must be stopped once the transfer completes.
+func newStallWatchdog(ctx context.Context, clock Clock, timeout time.Duration) (context.Context, *stallWatchdog) {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &stallWatchdog{
+		clock:   clock,
+		timeout: timeout,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	w.progress()
+	go w.watch()
+	return ctx, w
+}
+
+func (w *stallWatchdog) watch() {
+	wait := w.timeout
+	for {
+		select {
+		case <-w.clock.After(wait):
+		case <-w.done:
+			return
+		}
+		idle := w.clock.Now().Sub(time.Unix(0, atomic.LoadInt64(&w.last)))
+		if idle >= w.timeout {
+			atomic.StoreInt32(&w.fired, 1)
+			w.cancel()
+			return
+		}
+		wait = w.timeout - idle
+	}
+}
+
+func (w *stallWatchdog) progress() {
+	atomic.StoreInt64(&w.last, w.clock.Now().UnixNano())
+}
+
+// stalled reports whether the transfer was cancelled for lack of progress.
+func (w *stallWatchdog) stalled() bool {
+	return atomic.LoadInt32(&w.fired) == 1
+}
+
+func (w *stallWatchdog) stop() {
+	w.once.Do(func() {
+		close(w.done)
+		w.cancel()
+	})
+}
+
+// watchedReader reports the data read from a transfer to its watchdog.
+type watchedReader struct {
+	io.ReadCloser
+	watchdog *stallWatchdog
+}
+
+func (r *watchedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.watchdog.progress()
+	}
+	return n, err
+}
+
+// stallReader reads a layer downloaded with a stall timeout.  Downloads which
+// stall after returning some of the layer are started again, skipping the
+// data already read, up to layerFetchAttempts times.
+type stallReader struct {
+	ctx     context.Context
+	f       *ecrFetcher
+	desc    ocispec.Descriptor
+	open    func(ctx context.Context) (io.ReadCloser, error)
+	timeout time.Duration
+
+	rc       io.ReadCloser
+	watchdog *stallWatchdog
+	offset   int64
+	attempt  int
+	closed   bool
+}
+
+var errStallReaderClosed = errors.New("ecr.fetcher.layer: download closed")
+
+// downloadWithStallTimeout downloads desc with open, aborting attempts which
+// receive no data for the fetcher's stall timeout.  Attempts are not
+// abandoned if the fetcher has no stall timeout.
+func (f *ecrFetcher) downloadWithStallTimeout(ctx context.Context, desc ocispec.Descriptor, open func(ctx context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if f.stallTimeout <= 0 {
+		return open(ctx)
+	}
+	r := &stallReader{
+		ctx:     ctx,
+		f:       f,
+		desc:    desc,
+		open:    open,
+		timeout: f.stallTimeout,
+		attempt: 1,
+	}
+	if err := r.start(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// start starts an attempt to download the layer, skipping the data already
+// read.
+func (r *stallReader) start() error {
+	clock := r.f.clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	ctx, watchdog := newStallWatchdog(r.ctx, clock, r.timeout)
+	rc, err := r.open(ctx)
+	if err != nil {
+		watchdog.stop()
+		return r.stallError(watchdog, err)
+	}
+	r.rc, r.watchdog = &watchedReader{ReadCloser: rc, watchdog: watchdog}, watchdog
+	if r.offset > 0 {
+		if _, err := io.CopyN(ioutil.Discard, r.rc, r.offset); err != nil {
+			r.closeAttempt()
+			return r.stallError(watchdog, err)
+		}
+	}
+	return nil
+}
+
+// stallError returns ErrTransferStalled in place of err if watchdog aborted
+// the attempt failing with err.
+func (r *stallReader) stallError(watchdog *stallWatchdog, err error) error {
+	if !watchdog.stalled() {
+		return err
+	}
+	return fmt.Errorf("no data received for %v after %d bytes: %w", r.timeout, r.offset, ErrTransferStalled)
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	for {
+		if r.closed {
+			return 0, errStallReaderClosed
+		}
+		if r.rc == nil {
+			if err := r.start(); err != nil {
+				if !errors.Is(err, ErrTransferStalled) {
+					return 0, newFetchError(r.desc.Digest, err)
+				}
+				if err := r.retry(err); err != nil {
+					return 0, err
+				}
+				continue
+			}
+		}
+		n, err := r.rc.Read(p)
+		r.offset += int64(n)
+		if err == nil || !r.watchdog.stalled() {
+			return n, err
+		}
+		err = r.stallError(r.watchdog, err)
+		r.closeAttempt()
+		if retryErr := r.retry(err); retryErr != nil {
+			return n, retryErr
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// retry waits before the next attempt after the current attempt stalled
+// with err, or returns the error to fail the download with if no attempts
+// remain.
+func (r *stallReader) retry(err error) error {
+	if r.attempt >= layerFetchAttempts {
+		return newFetchError(r.desc.Digest, err)
+	}
+	log.G(r.ctx).
+		WithError(err).
+		WithField("attempt", r.attempt).
+		WithField("offset", r.offset).
+		Warn("ecr.fetcher.layer: restarting stalled download")
+	r.f.events.emit(r.ctx, &LayerFetchRetry{
+		Repository: r.f.ecrSpec.Repository,
+		Digest:     r.desc.Digest,
+		Attempt:    r.attempt,
+		Err:        err,
+	})
+	select {
+	case <-r.f.retryAfter(r.attempt):
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+	r.attempt++
+	return nil
+}
+
+// closeAttempt closes the current attempt to download the layer, if any.
+func (r *stallReader) closeAttempt() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.watchdog.stop()
+	r.rc, r.watchdog = nil, nil
+	return err
+}
+
+func (r *stallReader) Close() error {
+	r.closed = true
+	return r.closeAttempt()
+}
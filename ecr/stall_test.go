@@ -0,0 +1,130 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newStallTestFetcher returns a fetcher with a short stall timeout, fetching
+// layers from server.
+func newStallTestFetcher(t *testing.T, server *httptest.Server, retries *[]error) *ecrFetcher {
+	resolver, err := NewResolver(
+		WithLayerStallTimeout(50*time.Millisecond),
+		WithBackoff(ExponentialBackoff(time.Millisecond)),
+		WithEventHandler(func(_ context.Context, event Event) {
+			if retry, ok := event.(*LayerFetchRetry); ok {
+				*retries = append(*retries, retry.Err)
+			}
+		}))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = &fakeECRClient{
+		GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(server.URL)}, nil
+		},
+	}
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	return fetcher.(*ecrFetcher)
+}
+
+func TestLayerStallTimeoutRestarts(t *testing.T) {
+	const layerData = "stalled layer data"
+	hang := make(chan struct{})
+	defer close(hang)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// Send part of the layer, then stop sending data without
+			// closing the connection.
+			w.Header().Set("Content-Length", fmt.Sprint(len(layerData)))
+			fmt.Fprint(w, layerData[:5])
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-hang:
+			}
+			return
+		}
+		fmt.Fprint(w, layerData)
+	}))
+	defer server.Close()
+	var retries []error
+	fetcher := newStallTestFetcher(t, server, &retries)
+
+	rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString(layerData),
+		Size:      int64(len(layerData)),
+	})
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, layerData, string(data), "restarted download should skip the data already read")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	require.Len(t, retries, 1)
+	assert.True(t, errors.Is(retries[0], ErrTransferStalled), "unexpected retry error %v", retries[0])
+}
+
+func TestLayerStallTimeoutFails(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		select {
+		case <-r.Context().Done():
+		case <-hang:
+		}
+	}))
+	defer server.Close()
+	var retries []error
+	fetcher := newStallTestFetcher(t, server, &retries)
+
+	_, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("layer"),
+		Size:      5,
+	})
+	assert.True(t, errors.Is(err, ErrTransferStalled), "unexpected error %v", err)
+	assert.False(t, errors.Is(err, context.DeadlineExceeded), "stalls should be told apart from deadlines")
+	assert.True(t, IsTransientError(err))
+	assert.Equal(t, ErrorCategoryTimeout, Categorize(err))
+	assert.Equal(t, int32(layerFetchAttempts), atomic.LoadInt32(&requests), "stalled downloads should be retried")
+	assert.Len(t, retries, layerFetchAttempts-1)
+}
+
+func TestWithLayerStallTimeout(t *testing.T) {
+	_, err := NewResolver(WithLayerStallTimeout(0))
+	assert.Error(t, err)
+}
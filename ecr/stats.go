@@ -0,0 +1,192 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// ErrAPICallBudgetExceeded is returned for ECR API calls which would exceed
+// the budget set with WithAPICallBudget.
+var ErrAPICallBudgetExceeded = errors.New("ecr: API call budget exceeded")
+
+// Stats summarizes the work done by a resolver and the fetchers created by it
+// since the resolver was created.
+type Stats struct {
+	// Resolves is the number of calls to Resolve, and ResolveDuration their
+	// total duration.
+	Resolves        int64
+	ResolveDuration time.Duration
+	// ManifestFetches is the number of manifests and indexes fetched.
+	ManifestFetches int64
+	// BlobFetches is the number of layers and configs fetched and closed.
+	// BlobBytes is the number of bytes read from them, and BlobDuration the
+	// total time from each call to Fetch until the blob was closed.
+	BlobFetches  int64
+	BlobBytes    int64
+	BlobDuration time.Duration
+	// APICalls is the number of ECR API requests sent for each operation,
+	// such as "BatchGetImage" or "GetDownloadUrlForLayer", including retries.
+	APICalls map[string]int64
+}
+
+// StatsProvider is implemented by resolvers which record Stats.  The resolver
+// returned by NewResolver implements it.
+type StatsProvider interface {
+	Stats() Stats
+}
+
+var _ StatsProvider = (*ecrResolver)(nil)
+
+// Stats returns the resolver's Stats, for example to compare the throughput
+// of pulls made with different options.
+func (r *ecrResolver) Stats() Stats {
+	return r.stats.snapshot()
+}
+
+// statsRecorder accumulates Stats.  A nil statsRecorder records nothing.
+type statsRecorder struct {
+	lock  sync.Mutex
+	stats Stats
+}
+
+func (s *statsRecorder) snapshot() Stats {
+	if s == nil {
+		return Stats{}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := s.stats
+	stats.APICalls = make(map[string]int64, len(s.stats.APICalls))
+	for operation, calls := range s.stats.APICalls {
+		stats.APICalls[operation] = calls
+	}
+	return stats
+}
+
+func (s *statsRecorder) resolved(elapsed time.Duration) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stats.Resolves++
+	s.stats.ResolveDuration += elapsed
+}
+
+func (s *statsRecorder) manifestFetched() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stats.ManifestFetches++
+}
+
+// addAPIHandlers adds handlers to an ECR client's handlers counting the
+// requests sent for each operation.  Calls to operations which have sent as
+// many requests as their budget allows fail with ErrAPICallBudgetExceeded
+// before being sent, and calls which exhaust the budget are not retried.
+func (s *statsRecorder) addAPIHandlers(handlers *request.Handlers, budgets map[string]int64) {
+	if s == nil {
+		return
+	}
+	handlers.Validate.PushFrontNamed(request.NamedHandler{
+		Name: "ecr.stats.budget",
+		Fn: func(r *request.Request) {
+			if calls, exhausted := s.apiBudgetExhausted(r.Operation.Name, budgets); exhausted {
+				r.Error = fmt.Errorf("%s: %d calls: %w", r.Operation.Name, calls, ErrAPICallBudgetExceeded)
+			}
+		},
+	})
+	handlers.Send.PushFrontNamed(request.NamedHandler{
+		Name: "ecr.stats.calls",
+		Fn: func(r *request.Request) {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			if s.stats.APICalls == nil {
+				s.stats.APICalls = map[string]int64{}
+			}
+			s.stats.APICalls[r.Operation.Name]++
+		},
+	})
+	handlers.Retry.PushBackNamed(request.NamedHandler{
+		Name: "ecr.stats.budgetRetry",
+		Fn: func(r *request.Request) {
+			if _, exhausted := s.apiBudgetExhausted(r.Operation.Name, budgets); exhausted {
+				r.Retryable = aws.Bool(false)
+			}
+		},
+	})
+}
+
+// apiBudgetExhausted returns the requests sent for operation and whether they
+// have used up its budget.
+func (s *statsRecorder) apiBudgetExhausted(operation string, budgets map[string]int64) (int64, bool) {
+	budget, ok := budgets[operation]
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	calls := s.stats.APICalls[operation]
+	return calls, ok && calls >= budget
+}
+
+// blob returns rc wrapped to record the blob's Stats when it is closed.
+func (s *statsRecorder) blob(rc io.ReadCloser) io.ReadCloser {
+	if s == nil {
+		return rc
+	}
+	return &blobStatsReader{ReadCloser: rc, stats: s, start: time.Now()}
+}
+
+// blobStatsReader counts the bytes read from a blob.
+type blobStatsReader struct {
+	io.ReadCloser
+	stats *statsRecorder
+	start time.Time
+	bytes int64
+	once  sync.Once
+}
+
+func (b *blobStatsReader) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+// WriteTo preserves the WriteTo method of the wrapped ReadCloser, if any.
+func (b *blobStatsReader) WriteTo(w io.Writer) (int64, error) {
+	n, err := copyPooled(w, b.ReadCloser)
+	b.bytes += n
+	return n, err
+}
+
+func (b *blobStatsReader) Close() error {
+	b.once.Do(func() {
+		b.stats.lock.Lock()
+		defer b.stats.lock.Unlock()
+		b.stats.stats.BlobFetches++
+		b.stats.stats.BlobBytes += b.bytes
+		b.stats.stats.BlobDuration += time.Since(b.start)
+	})
+	return b.ReadCloser.Close()
+}
@@ -19,8 +19,11 @@ package stream
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"time"
+
+	"github.com/opencontainers/go-digest"
 )
 
 // Chunk represents a single part of a full io stream.
@@ -30,6 +33,7 @@ type Chunk struct {
 	BytesBegin int64         // beginning byte range
 	BytesEnd   int64         // ending byte range
 	ReadTime   time.Duration // time spent reading buffer
+	Checksum   digest.Digest // SHA-256 of Bytes when read, if requested
 }
 
 type chunkedProcessor struct {
@@ -38,8 +42,9 @@ type chunkedProcessor struct {
 	readChannel  chan *Chunk
 	errorChannel chan error
 	reader       io.Reader
-	chunkSize    int64
+	chunkSize    func() int64
 	queueSize    int64
+	checksum     bool
 }
 
 // readCallbackFunc represents a callback function for processing chunks
@@ -67,6 +72,32 @@ type readCallbackFunc func(*Chunk) error
 //
 // readCallback - the callback function to invoke for each chunk.
 func ChunkedProcessor(reader io.Reader, chunkSize int64, queueSize int64, readCallback readCallbackFunc) (int64, error) {
+	return chunkedProcess(reader, fixedChunkSize(chunkSize), queueSize, false, readCallback)
+}
+
+// ChunkedProcessorWithChecksums is ChunkedProcessor, additionally setting
+// the Checksum of each Chunk as it is read.  Callbacks may compare the
+// checksum with the Chunk's Bytes to detect corruption of the buffered data
+// before it is processed.
+func ChunkedProcessorWithChecksums(reader io.Reader, chunkSize int64, queueSize int64, readCallback readCallbackFunc) (int64, error) {
+	return chunkedProcess(reader, fixedChunkSize(chunkSize), queueSize, true, readCallback)
+}
+
+// ChunkedProcessorWithSizer is ChunkedProcessor, calling chunkSize for the
+// size of each Chunk as it is read so that the size can be adjusted while the
+// reader is processed.  Chunks are read ahead of the callback, so a change in
+// size applies to the Chunks read after the queued Chunks.  chunkSize is
+// called from a separate goroutine to readCallback.  When checksums is set,
+// the Checksum of each Chunk is set as with ChunkedProcessorWithChecksums.
+func ChunkedProcessorWithSizer(reader io.Reader, chunkSize func() int64, queueSize int64, checksums bool, readCallback readCallbackFunc) (int64, error) {
+	return chunkedProcess(reader, chunkSize, queueSize, checksums, readCallback)
+}
+
+func fixedChunkSize(size int64) func() int64 {
+	return func() int64 { return size }
+}
+
+func chunkedProcess(reader io.Reader, chunkSize func() int64, queueSize int64, checksum bool, readCallback readCallbackFunc) (int64, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	bufferedReader := &chunkedProcessor{
 		ctx:          ctx,
@@ -76,6 +107,7 @@ func ChunkedProcessor(reader io.Reader, chunkSize int64, queueSize int64, readCa
 		reader:       reader,
 		chunkSize:    chunkSize,
 		queueSize:    queueSize,
+		checksum:     checksum,
 	}
 	defer close(bufferedReader.errorChannel)
 
@@ -164,7 +196,11 @@ func (processor *chunkedProcessor) processChunks(readCallback readCallbackFunc)
 // the proper offsets. Will return nil Chunk if reader is empty.
 func (processor *chunkedProcessor) readChunk(bytesBegin int64, part int64) (*Chunk, error) {
 	startTime := time.Now()
-	buffer := make([]byte, processor.chunkSize)
+	chunkSize := processor.chunkSize()
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("stream: invalid chunk size %d", chunkSize)
+	}
+	buffer := make([]byte, chunkSize)
 	size, err := io.ReadFull(processor.reader, buffer)
 	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
 		return nil, err
@@ -180,6 +216,9 @@ func (processor *chunkedProcessor) readChunk(bytesBegin int64, part int64) (*Chu
 			Bytes:      buffer[0:size],
 			ReadTime:   time.Since(startTime),
 		}
+		if processor.checksum {
+			chunk.Checksum = digest.SHA256.FromBytes(chunk.Bytes)
+		}
 	}
 
 	if err == io.ErrUnexpectedEOF {
@@ -16,11 +16,14 @@
 package stream
 
 import (
+	"bytes"
 	"errors"
 	"strings"
 	"testing"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var testBufferString = []string{"A", "B", "C", "D", "E", "F", "G"}
@@ -96,3 +99,52 @@ func TestChunkedProcessorEmptySuccess(t *testing.T) {
 	assert.Equal(t, int64(0), size)
 	assert.Equal(t, 0, index)
 }
+
+func TestChunkedProcessorWithChecksums(t *testing.T) {
+	data := []byte("abcdefg")
+	var checksums []digest.Digest
+	_, err := ChunkedProcessorWithChecksums(bytes.NewReader(data), 3, 1, func(chunk *Chunk) error {
+		assert.Equal(t, digest.FromBytes(chunk.Bytes), chunk.Checksum)
+		checksums = append(checksums, chunk.Checksum)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Len(t, checksums, 3)
+
+	_, err = ChunkedProcessor(bytes.NewReader(data), 3, 1, func(chunk *Chunk) error {
+		assert.Empty(t, chunk.Checksum, "checksums should only be computed when requested")
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestChunkedProcessorWithSizer(t *testing.T) {
+	sizes := []int64{1, 2, 3}
+	calls := 0
+	sizer := func() int64 {
+		size := sizes[calls%len(sizes)]
+		calls++
+		return size
+	}
+	var chunks []string
+	var begins []int64
+	size, err := ChunkedProcessorWithSizer(strings.NewReader(testReaderString), sizer, 1, false, func(chunk *Chunk) error {
+		chunks = append(chunks, string(chunk.Bytes))
+		begins = append(begins, chunk.BytesBegin)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), size)
+	assert.Equal(t, []string{"A", "BC", "DEF", "G"}, chunks)
+	assert.Equal(t, []int64{0, 1, 3, 6}, begins)
+}
+
+func TestChunkedProcessorInvalidChunkSize(t *testing.T) {
+	for _, chunkSize := range []int64{0, -1} {
+		_, err := ChunkedProcessor(strings.NewReader(testReaderString), chunkSize, 1, func(*Chunk) error {
+			t.Error("no chunk should be read")
+			return nil
+		})
+		assert.Error(t, err, "chunk size %d", chunkSize)
+	}
+}
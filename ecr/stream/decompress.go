@@ -0,0 +1,228 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package stream
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+)
+
+// DefaultBlockSize is the size of blocks buffered by ReadAhead and
+// PipelinedGzipReader when a size is not specified.
+const DefaultBlockSize = 1 << 20
+
+var errReaderClosed = errors.New("stream: read from closed reader")
+
+// blockPool recycles the blocks of readers created by ReadAhead once their
+// content has been consumed, avoiding an allocation for each block read.
+var blockPool sync.Pool
+
+func getBlock(size int) []byte {
+	if block, ok := blockPool.Get().(*[]byte); ok && cap(*block) >= size {
+		return (*block)[:size]
+	}
+	return make([]byte, size)
+}
+
+func putBlock(block []byte) {
+	block = block[:cap(block)]
+	blockPool.Put(&block)
+}
+
+type readAhead struct {
+	source    io.Reader
+	blocks    chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	// err is written by the reading goroutine before blocks is closed.
+	err error
+	// block is the block being consumed, of which current is the unread
+	// remainder.
+	block   []byte
+	current []byte
+}
+
+// ReadAhead returns a reader that reads from source in a separate goroutine,
+// buffering up to blocks blocks of blockSize bytes ahead of the caller.  This
+// allows slow sources, such as network connections, to be read concurrently
+// with the processing of previously read data.
+//
+// The returned reader implements io.WriterTo, writing the buffered blocks
+// directly to the destination of io.Copy without copying them, and
+// io.ByteReader, allowing it to be decompressed without further buffering.
+//
+// Closing the returned reader stops the goroutine and closes source if it is
+// an io.Closer.  source must therefore allow Close to be called while a Read
+// is in progress, as is the case for HTTP response bodies.
+func ReadAhead(source io.Reader, blockSize int, blocks int) io.ReadCloser {
+	return newReadAhead(source, blockSize, blocks)
+}
+
+func newReadAhead(source io.Reader, blockSize int, blocks int) *readAhead {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	if blocks <= 0 {
+		blocks = 1
+	}
+	r := &readAhead{
+		source: source,
+		blocks: make(chan []byte, blocks),
+		done:   make(chan struct{}),
+	}
+	go r.fill(blockSize)
+	return r
+}
+
+func (r *readAhead) fill(blockSize int) {
+	defer close(r.blocks)
+	for {
+		buffer := getBlock(blockSize)
+		n, err := io.ReadFull(r.source, buffer)
+		if n > 0 {
+			select {
+			case r.blocks <- buffer[:n]:
+			case <-r.done:
+				return
+			}
+		} else {
+			putBlock(buffer)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return
+		}
+		if err != nil {
+			r.err = err
+			return
+		}
+	}
+}
+
+// next recycles the consumed block and waits for the next, returning io.EOF
+// once source has been read.
+func (r *readAhead) next() error {
+	if r.block != nil {
+		putBlock(r.block)
+		r.block, r.current = nil, nil
+	}
+	select {
+	case <-r.done:
+		return errReaderClosed
+	case block, ok := <-r.blocks:
+		if !ok {
+			if r.err != nil {
+				return r.err
+			}
+			return io.EOF
+		}
+		r.block, r.current = block, block
+		return nil
+	}
+}
+
+func (r *readAhead) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+func (r *readAhead) ReadByte() (byte, error) {
+	for len(r.current) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	b := r.current[0]
+	r.current = r.current[1:]
+	return b, nil
+}
+
+// WriteTo writes the remaining blocks to w as they are read.  Writers must
+// not retain the slices passed to Write, so each block is recycled once
+// written.
+func (r *readAhead) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for {
+		if len(r.current) > 0 {
+			n, err := w.Write(r.current)
+			written += int64(n)
+			r.current = r.current[n:]
+			if err != nil {
+				return written, err
+			}
+			if len(r.current) > 0 {
+				return written, io.ErrShortWrite
+			}
+		}
+		if err := r.next(); err == io.EOF {
+			return written, nil
+		} else if err != nil {
+			return written, err
+		}
+	}
+}
+
+func (r *readAhead) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.done)
+		if closer, ok := r.source.(io.Closer); ok {
+			err = closer.Close()
+		}
+	})
+	return err
+}
+
+// PipelinedGzipReader returns a reader of the decompressed content of the gzip
+// stream read from source.  Reading the compressed source, decompressing it,
+// and consuming the decompressed output form a pipeline of goroutines, with
+// up to blocks blocks of blockSize bytes buffered between each stage.  The
+// stream is decompressed by a single gzip.Reader, so this trades memory for
+// throughput when the source or the consumer is I/O bound, but does not speed
+// up decompression itself.
+//
+// Closing the returned reader closes source if it is an io.Closer.
+func PipelinedGzipReader(source io.Reader, blockSize int, blocks int) (io.ReadCloser, error) {
+	compressed := newReadAhead(source, blockSize, blocks)
+	gz, err := gzip.NewReader(compressed)
+	if err != nil {
+		compressed.Close()
+		return nil, err
+	}
+	return &gzipReader{
+		// gz is hidden behind an io.Reader as it cannot be closed while
+		// being read.  Closing compressed terminates any read in progress.
+		readAhead:  newReadAhead(struct{ io.Reader }{gz}, blockSize, blocks),
+		compressed: compressed,
+	}, nil
+}
+
+type gzipReader struct {
+	*readAhead
+	compressed io.ReadCloser
+}
+
+func (r *gzipReader) Close() error {
+	r.readAhead.Close()
+	return r.compressed.Close()
+}
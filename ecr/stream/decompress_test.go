@@ -0,0 +1,193 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package stream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadAheadSuccess(t *testing.T) {
+	r := ReadAhead(strings.NewReader(testReaderString), 2, 2)
+	defer r.Close()
+	output, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, testReaderString, string(output))
+}
+
+func TestReadAheadFail(t *testing.T) {
+	expected := errors.New("error")
+	r := ReadAhead(io.MultiReader(strings.NewReader(testReaderString), &errReader{expected}), 2, 2)
+	defer r.Close()
+	output, err := ioutil.ReadAll(r)
+	assert.Equal(t, expected, err)
+	assert.Equal(t, testReaderString, string(output), "data read before the error should be returned")
+}
+
+func TestReadAheadClose(t *testing.T) {
+	source := &closeRecorder{Reader: strings.NewReader(testReaderString)}
+	r := ReadAhead(source, 1, 1)
+	assert.NoError(t, r.Close())
+	assert.NoError(t, r.Close())
+	assert.Equal(t, 1, source.closed, "source should be closed once")
+
+	_, err := r.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestPipelinedGzipReaderSuccess(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	expected := strings.Repeat(testReaderString, 1000)
+	_, err := gz.Write([]byte(expected))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	source := &closeRecorder{Reader: &compressed}
+	r, err := PipelinedGzipReader(source, 16, 4)
+	require.NoError(t, err)
+	output, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(output))
+	assert.NoError(t, r.Close())
+	assert.Equal(t, 1, source.closed)
+}
+
+func TestPipelinedGzipReaderInvalid(t *testing.T) {
+	source := &closeRecorder{Reader: strings.NewReader(testReaderString)}
+	_, err := PipelinedGzipReader(source, 16, 4)
+	assert.Error(t, err)
+	assert.Equal(t, 1, source.closed, "source should be closed on error")
+}
+
+func TestReadAheadWriteTo(t *testing.T) {
+	expected := strings.Repeat(testReaderString, 100)
+	r := ReadAhead(strings.NewReader(expected), 16, 2)
+	defer r.Close()
+
+	// Start reading part of a block before writing the remainder.
+	partial := make([]byte, 3)
+	_, err := io.ReadFull(r, partial)
+	require.NoError(t, err)
+
+	var output bytes.Buffer
+	n, err := r.(io.WriterTo).WriteTo(&output)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(expected)-3), n)
+	assert.Equal(t, expected, string(partial)+output.String())
+}
+
+func TestReadAheadWriteToFail(t *testing.T) {
+	expected := errors.New("error")
+	r := ReadAhead(io.MultiReader(strings.NewReader(testReaderString), &errReader{expected}), 2, 2)
+	defer r.Close()
+	var output bytes.Buffer
+	_, err := r.(io.WriterTo).WriteTo(&output)
+	assert.Equal(t, expected, err)
+	assert.Equal(t, testReaderString, output.String())
+}
+
+func TestReadAheadReadByte(t *testing.T) {
+	r := ReadAhead(strings.NewReader(testReaderString), 2, 2)
+	defer r.Close()
+	var output []byte
+	for {
+		b, err := r.(io.ByteReader).ReadByte()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		output = append(output, b)
+	}
+	assert.Equal(t, testReaderString, string(output))
+}
+
+func BenchmarkReadAhead(b *testing.B) {
+	data := make([]byte, 64<<20)
+	rand.Read(data)
+	for _, tc := range []struct {
+		name string
+		copy func(io.Writer, io.Reader) (int64, error)
+	}{
+		// Read hides WriteTo, so that io.Copy copies each block into its
+		// own buffer.
+		{name: "Read", copy: func(w io.Writer, r io.Reader) (int64, error) {
+			return io.Copy(w, struct{ io.Reader }{r})
+		}},
+		{name: "WriteTo", copy: io.Copy},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r := ReadAhead(bytes.NewReader(data), DefaultBlockSize, 4)
+				if _, err := tc.copy(struct{ io.Writer }{ioutil.Discard}, r); err != nil {
+					b.Fatal(err)
+				}
+				r.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkPipelinedGzipReader(b *testing.B) {
+	data := make([]byte, 64<<20)
+	rand.Read(data[:len(data)/2])
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(data)
+	gz.Close()
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r, err := PipelinedGzipReader(bytes.NewReader(compressed.Bytes()), DefaultBlockSize, 4)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			b.Fatal(err)
+		}
+		r.Close()
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed int
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed++
+	return nil
+}
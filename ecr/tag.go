@@ -0,0 +1,180 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+)
+
+// TagMover is implemented by resolvers able to move a tag to another image of
+// its repository.  The resolver returned by NewResolver implements it.
+type TagMover interface {
+	MoveTag(ctx context.Context, repoRef, tag string, newDigest digest.Digest) (*TagMove, error)
+}
+
+var _ TagMover = (*ecrResolver)(nil)
+
+// TagMove is a tag moved by MoveTag.  It records the image tagged before the
+// move so that the move can be rolled back.
+type TagMove struct {
+	// Ref is the reference of the moved tag.
+	Ref string
+	// Previous is the digest of the image tagged before the move, or empty if
+	// the tag did not exist.
+	Previous digest.Digest
+	// Current is the digest of the image tagged by the move.
+	Current digest.Digest
+
+	base     ecrBase
+	tag      string
+	previous *ecr.Image
+	// invalidate removes the results cached by the resolver for the tag when
+	// it is moved.
+	invalidate func(context.Context, ECRSpec)
+
+	lock       sync.Mutex
+	rolledBack bool
+}
+
+// MoveTag points tag in the repository named by repoRef at the image with
+// newDigest, which must already be in the repository.  The image previously
+// tagged is recorded in the returned TagMove, whose Rollback method restores
+// it, such as when a blue/green deployment of the new image fails.  If the
+// move fails after ECR may have applied it, the previous image is restored
+// before the error is returned.
+func (r *ecrResolver) MoveTag(ctx context.Context, repoRef, tag string, newDigest digest.Digest) (*TagMove, error) {
+	ecrSpec, err := ParseRef(repoRef)
+	if err != nil {
+		return nil, err
+	}
+	ecrSpec.Object = tag
+	move := &TagMove{
+		Ref:     ecrSpec.Canonical(),
+		Current: newDigest,
+		base: ecrBase{
+			client:  r.getClient(ecrSpec.Region(), ecrSpec.Registry()),
+			ecrSpec: ecrSpec,
+		},
+		tag:        tag,
+		invalidate: r.invalidate,
+	}
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("ref", move.Ref))
+
+	image, err := move.base.runGetImage(ctx, ecr.BatchGetImageInput{
+		ImageIds:           []*ecr.ImageIdentifier{{ImageDigest: aws.String(newDigest.String())}},
+		AcceptedMediaTypes: aws.StringSlice(supportedImageMediaTypes),
+	})
+	if err == errImageNotFound {
+		return nil, fmt.Errorf("%s@%s: %w", ecrSpec.Repository, newDigest, errdefs.ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	move.previous, err = move.base.runGetImage(ctx, ecr.BatchGetImageInput{
+		ImageIds:           []*ecr.ImageIdentifier{{ImageTag: aws.String(tag)}},
+		AcceptedMediaTypes: aws.StringSlice(supportedImageMediaTypes),
+	})
+	switch {
+	case err == errImageNotFound:
+		move.previous = nil
+	case err != nil:
+		return nil, err
+	default:
+		move.Previous = digest.Digest(aws.StringValue(move.previous.ImageId.ImageDigest))
+	}
+
+	log.G(ctx).
+		WithField("previous", move.Previous).
+		WithField("current", move.Current).
+		Debug("ecr.tag.move: moving tag")
+	if err := move.put(ctx, image); err != nil {
+		// A failed request may still have moved the tag.  Rollback only
+		// restores the previous image if the tag was moved.
+		if move.Previous != "" {
+			if rollbackErr := move.Rollback(ctx); rollbackErr != nil && !errdefs.IsFailedPrecondition(rollbackErr) {
+				log.G(ctx).WithError(rollbackErr).Warn("ecr.tag.move: failed to restore previous image")
+			}
+		}
+		return nil, fmt.Errorf("ecr: failed to move tag %s: %w", move.Ref, err)
+	}
+	return move, nil
+}
+
+// Rollback points the moved tag back at the image it tagged before the move.
+// The tag is only restored if it still tags the image it was moved to; if
+// it has since been moved again, errdefs.ErrFailedPrecondition is returned
+// and the tag is left unchanged.  Moves which created the tag cannot be
+// rolled back, as ECR deletes images whose last tag is removed.
+// Rolling back a move more than once has no further effect.
+func (m *TagMove) Rollback(ctx context.Context) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.rolledBack {
+		return nil
+	}
+	if m.previous == nil {
+		return fmt.Errorf("tag %s did not exist before the move: %w", m.Ref, errdefs.ErrNotImplemented)
+	}
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("ref", m.Ref))
+
+	current, err := m.base.runGetImage(ctx, ecr.BatchGetImageInput{
+		ImageIds:           []*ecr.ImageIdentifier{{ImageTag: aws.String(m.tag)}},
+		AcceptedMediaTypes: aws.StringSlice(supportedImageMediaTypes),
+	})
+	if err != nil && err != errImageNotFound {
+		return err
+	}
+	if err == errImageNotFound || digest.Digest(aws.StringValue(current.ImageId.ImageDigest)) != m.Current {
+		return fmt.Errorf("tag %s no longer tags %s: %w", m.Ref, m.Current, errdefs.ErrFailedPrecondition)
+	}
+
+	log.G(ctx).
+		WithField("previous", m.Previous).
+		WithField("current", m.Current).
+		Debug("ecr.tag.rollback: restoring previous image")
+	if err := m.put(ctx, m.previous); err != nil {
+		return fmt.Errorf("ecr: failed to roll back tag %s: %w", m.Ref, err)
+	}
+	m.rolledBack = true
+	return nil
+}
+
+// put tags image with the moved tag.  Putting an image already carrying the
+// tag succeeds.
+func (m *TagMove) put(ctx context.Context, image *ecr.Image) error {
+	_, err := m.base.client.PutImageWithContext(ctx, &ecr.PutImageInput{
+		RegistryId:             aws.String(m.base.ecrSpec.Registry()),
+		RepositoryName:         aws.String(m.base.ecrSpec.Repository),
+		ImageManifest:          image.ImageManifest,
+		ImageManifestMediaType: image.ImageManifestMediaType,
+		ImageDigest:            image.ImageId.ImageDigest,
+		ImageTag:               aws.String(m.tag),
+	})
+	// A failed request may still have moved the tag.
+	m.invalidate(ctx, m.base.ecrSpec)
+	if isAWSErrorCode(err, ecr.ErrCodeImageAlreadyExistsException) {
+		return nil
+	}
+	return err
+}
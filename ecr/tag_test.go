@@ -0,0 +1,156 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/unit"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const tagTestRepository = "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar"
+
+// fakeTagRepository is a repository of images and tags served through a
+// fakeECRClient.
+type fakeTagRepository struct {
+	manifests map[digest.Digest]string
+	tags      map[string]digest.Digest
+	puts      int
+	// putErr, if set, is returned by PutImage after the image is put.
+	putErr error
+}
+
+func newFakeTagRepository(manifests ...string) *fakeTagRepository {
+	repository := &fakeTagRepository{
+		manifests: map[digest.Digest]string{},
+		tags:      map[string]digest.Digest{},
+	}
+	for _, manifest := range manifests {
+		repository.manifests[digest.FromString(manifest)] = manifest
+	}
+	return repository
+}
+
+func (r *fakeTagRepository) client() *fakeECRClient {
+	return &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			id := input.ImageIds[0]
+			dgst := digest.Digest(aws.StringValue(id.ImageDigest))
+			if id.ImageTag != nil {
+				dgst = r.tags[aws.StringValue(id.ImageTag)]
+			}
+			manifest, ok := r.manifests[dgst]
+			if !ok {
+				return &ecr.BatchGetImageOutput{Failures: []*ecr.ImageFailure{{
+					FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound),
+				}}}, nil
+			}
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:                &ecr.ImageIdentifier{ImageDigest: aws.String(dgst.String())},
+				ImageManifest:          aws.String(manifest),
+				ImageManifestMediaType: aws.String("application/vnd.oci.image.manifest.v1+json"),
+			}}}, nil
+		},
+		PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+			r.puts++
+			tag, dgst := aws.StringValue(input.ImageTag), digest.Digest(aws.StringValue(input.ImageDigest))
+			if r.tags[tag] == dgst {
+				return nil, awserr.New(ecr.ErrCodeImageAlreadyExistsException, "image already exists", nil)
+			}
+			r.tags[tag] = dgst
+			return &ecr.PutImageOutput{}, r.putErr
+		},
+	}
+}
+
+func newTagTestResolver(t *testing.T, repository *fakeTagRepository) TagMover {
+	resolver, err := NewResolver(WithSession(unit.Session))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = repository.client()
+	return resolver.(TagMover)
+}
+
+func TestMoveTagRollback(t *testing.T) {
+	repository := newFakeTagRepository("blue", "green")
+	blue, green := digest.FromString("blue"), digest.FromString("green")
+	repository.tags["live"] = blue
+	mover := newTagTestResolver(t, repository)
+
+	move, err := mover.MoveTag(context.Background(), tagTestRepository, "live", green)
+	require.NoError(t, err)
+	assert.Equal(t, tagTestRepository+":live", move.Ref)
+	assert.Equal(t, blue, move.Previous)
+	assert.Equal(t, green, move.Current)
+	assert.Equal(t, green, repository.tags["live"])
+
+	require.NoError(t, move.Rollback(context.Background()))
+	assert.Equal(t, blue, repository.tags["live"])
+	puts := repository.puts
+	require.NoError(t, move.Rollback(context.Background()))
+	assert.Equal(t, puts, repository.puts, "rolling back again should have no effect")
+}
+
+func TestMoveTagRollbackAfterMove(t *testing.T) {
+	repository := newFakeTagRepository("blue", "green", "red")
+	repository.tags["live"] = digest.FromString("blue")
+	mover := newTagTestResolver(t, repository)
+
+	move, err := mover.MoveTag(context.Background(), tagTestRepository, "live", digest.FromString("green"))
+	require.NoError(t, err)
+	repository.tags["live"] = digest.FromString("red")
+
+	err = move.Rollback(context.Background())
+	assert.True(t, errdefs.IsFailedPrecondition(err), "tag moved since should not be rolled back: %v", err)
+	assert.Equal(t, digest.FromString("red"), repository.tags["live"])
+}
+
+func TestMoveTagFailureRestores(t *testing.T) {
+	repository := newFakeTagRepository("blue", "green")
+	blue := digest.FromString("blue")
+	repository.tags["live"] = blue
+	// The tag is moved, but the response is lost.
+	repository.putErr = errors.New("connection reset")
+	mover := newTagTestResolver(t, repository)
+
+	_, err := mover.MoveTag(context.Background(), tagTestRepository, "live", digest.FromString("green"))
+	assert.Error(t, err)
+	assert.Equal(t, blue, repository.tags["live"], "previous image should be restored")
+}
+
+func TestMoveTagMissing(t *testing.T) {
+	repository := newFakeTagRepository("green")
+	mover := newTagTestResolver(t, repository)
+
+	_, err := mover.MoveTag(context.Background(), tagTestRepository, "live", digest.FromString("blue"))
+	assert.True(t, errdefs.IsNotFound(err), "missing image should not be tagged: %v", err)
+
+	move, err := mover.MoveTag(context.Background(), tagTestRepository, "live", digest.FromString("green"))
+	require.NoError(t, err)
+	assert.Empty(t, move.Previous)
+	err = move.Rollback(context.Background())
+	assert.True(t, errdefs.IsNotImplemented(err), "new tag should not be removed: %v", err)
+	assert.Equal(t, digest.FromString("green"), repository.tags["live"])
+}
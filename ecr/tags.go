@@ -0,0 +1,80 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/log"
+)
+
+// TagLister is implemented by resolvers able to list the tags of a
+// repository, as the tags endpoint of the Docker Registry HTTP API does for
+// docker.Resolver users.  The resolver returned by NewResolver implements it.
+type TagLister interface {
+	// Tags returns the tags of the repository named by ref, ignoring its
+	// tag or digest, in lexical order.
+	Tags(ctx context.Context, ref string) ([]string, error)
+}
+
+var _ TagLister = (*ecrResolver)(nil)
+
+// Tags lists the tags of the repository named by ref with ECR's ListImages
+// API, following every page of results, for tools such as garbage collectors
+// built on the resolver.  ErrRepositoryNotFound is returned if the repository
+// does not exist.
+func (r *ecrResolver) Tags(ctx context.Context, ref string) ([]string, error) {
+	ecrSpec, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	client := r.getClient(ecrSpec.Region(), ecrSpec.Registry())
+	input := &ecr.ListImagesInput{
+		RegistryId:     aws.String(ecrSpec.Registry()),
+		RepositoryName: aws.String(ecrSpec.Repository),
+		Filter:         &ecr.ListImagesFilter{TagStatus: aws.String(ecr.TagStatusTagged)},
+	}
+	tags := []string{}
+	for {
+		output, err := client.ListImagesWithContext(ctx, input)
+		if err != nil {
+			if isRepositoryNotFound(err) {
+				return nil, fmt.Errorf("%s: %w", ecrSpec.Repository, ErrRepositoryNotFound)
+			}
+			return nil, err
+		}
+		for _, imageID := range output.ImageIds {
+			if tag := aws.StringValue(imageID.ImageTag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			break
+		}
+		input.NextToken = output.NextToken
+	}
+	sort.Strings(tags)
+
+	log.G(ctx).
+		WithField("repository", ecrSpec.Repository).
+		WithField("tags", len(tags)).
+		Debug("ecr.resolver.tags: listed tags")
+	return tags, nil
+}
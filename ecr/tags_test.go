@@ -0,0 +1,73 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTags(t *testing.T) {
+	calls := 0
+	client := &fakeECRClient{
+		ListImagesFn: func(_ aws.Context, input *ecr.ListImagesInput, _ ...request.Option) (*ecr.ListImagesOutput, error) {
+			calls++
+			assert.Equal(t, "123456789012", aws.StringValue(input.RegistryId))
+			assert.Equal(t, "foo/bar", aws.StringValue(input.RepositoryName))
+			assert.Equal(t, ecr.TagStatusTagged, aws.StringValue(input.Filter.TagStatus))
+			// Return the tags over two pages.
+			if input.NextToken == nil {
+				return &ecr.ListImagesOutput{
+					ImageIds: []*ecr.ImageIdentifier{
+						{ImageDigest: aws.String("sha256:1"), ImageTag: aws.String("v2")},
+						{ImageDigest: aws.String("sha256:1"), ImageTag: aws.String("latest")},
+					},
+					NextToken: aws.String("next"),
+				}, nil
+			}
+			assert.Equal(t, "next", aws.StringValue(input.NextToken))
+			return &ecr.ListImagesOutput{ImageIds: []*ecr.ImageIdentifier{
+				{ImageDigest: aws.String("sha256:2"), ImageTag: aws.String("v1")},
+			}}, nil
+		},
+	}
+	resolver := &ecrResolver{clients: map[string]ecrAPI{"fake": client}}
+
+	tags, err := resolver.Tags(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:ignored")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"latest", "v1", "v2"}, tags)
+	assert.Equal(t, 2, calls)
+}
+
+func TestTagsRepositoryNotFound(t *testing.T) {
+	client := &fakeECRClient{
+		ListImagesFn: func(aws.Context, *ecr.ListImagesInput, ...request.Option) (*ecr.ListImagesOutput, error) {
+			return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "not found", nil)
+		},
+	}
+	resolver := &ecrResolver{clients: map[string]ecrAPI{"fake": client}}
+
+	_, err := resolver.Tags(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar")
+	assert.True(t, errors.Is(err, ErrRepositoryNotFound), "unexpected error %v", err)
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TransferReport records the content transferred by Copy, PullAll, and
+// Release, so that callers can log the cost of each layer of their images.
+// Pass it to them with WithTransferReport.  A report may be shared by several
+// calls, concurrently or in turn; content transferred more than once is
+// recorded as last transferred.
+type TransferReport struct {
+	lock      sync.Mutex
+	transfers map[digest.Digest]Transfer
+}
+
+// Transfer is content pushed or ingested for a TransferReport.
+type Transfer struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	// Size is the size of the content given by its descriptor.
+	Size int64 `json:"size"`
+	// Bytes is the number of bytes written to the destination, which is
+	// less than Size when an earlier transfer is resumed and zero when
+	// Existing is set.
+	Bytes int64 `json:"bytes"`
+	// Duration is the time taken to transfer the content, including fetching
+	// it from the source.
+	Duration time.Duration `json:"duration"`
+	// Retries is the number of failed attempts to fetch the content which
+	// were retried.
+	Retries int `json:"retries"`
+	// Existing is set when the content was skipped as already present at
+	// the destination.
+	Existing bool `json:"existing"`
+}
+
+// NewTransferReport returns an empty TransferReport.
+func NewTransferReport() *TransferReport {
+	return &TransferReport{transfers: map[digest.Digest]Transfer{}}
+}
+
+// Transfers returns the content transferred, sorted by digest.
+func (r *TransferReport) Transfers() []Transfer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	transfers := make([]Transfer, 0, len(r.transfers))
+	for _, transfer := range r.transfers {
+		transfers = append(transfers, transfer)
+	}
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].Digest < transfers[j].Digest })
+	return transfers
+}
+
+// MarshalJSON encodes the report as an object listing its "transfers".
+func (r *TransferReport) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Transfers []Transfer `json:"transfers"`
+	}{r.Transfers()})
+}
+
+// start begins recording the transfer of desc.  The returned context
+// delivers the retries of fetches made with it to the transfer.  r may be
+// nil, in which case nothing is recorded.
+func (r *TransferReport) start(ctx context.Context, desc ocispec.Descriptor) (context.Context, *transfer) {
+	if r == nil {
+		return ctx, nil
+	}
+	t := &transfer{
+		report:  r,
+		started: time.Now(),
+		Transfer: Transfer{
+			Digest:    desc.Digest,
+			MediaType: desc.MediaType,
+			Size:      desc.Size,
+		},
+	}
+	return withEventHandler(ctx, t.observe), t
+}
+
+// transfer is a Transfer being recorded.
+type transfer struct {
+	Transfer
+	report  *TransferReport
+	started time.Time
+	lock    sync.Mutex
+}
+
+// observe counts the retried fetches of the transfer's content.
+func (t *transfer) observe(_ context.Context, event Event) {
+	if retry, ok := event.(*LayerFetchRetry); ok && retry.Digest == t.Digest {
+		t.lock.Lock()
+		t.Retries++
+		t.lock.Unlock()
+	}
+}
+
+// writer returns cw counting the bytes written to it for the transfer.
+func (t *transfer) writer(cw content.Writer) content.Writer {
+	if t == nil {
+		return cw
+	}
+	return &transferWriter{Writer: cw, t: t}
+}
+
+// existing records the content as skipped.
+func (t *transfer) existing() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	t.Existing = true
+	t.lock.Unlock()
+}
+
+// done adds the transfer to its report unless err is set.
+func (t *transfer) done(err error) {
+	if t == nil || err != nil {
+		return
+	}
+	t.lock.Lock()
+	recorded := t.Transfer
+	t.lock.Unlock()
+	recorded.Duration = time.Since(t.started)
+
+	t.report.lock.Lock()
+	defer t.report.lock.Unlock()
+	t.report.transfers[recorded.Digest] = recorded
+}
+
+type transferWriter struct {
+	content.Writer
+	t *transfer
+}
+
+func (w *transferWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.t.lock.Lock()
+	w.t.Bytes += int64(n)
+	w.t.lock.Unlock()
+	return n, err
+}
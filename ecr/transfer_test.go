@@ -0,0 +1,124 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// retryingRegistry is a fakeRegistry whose fetches each report a retry, as
+// the fetchers of a resolver do.
+type retryingRegistry struct {
+	*fakeRegistry
+}
+
+func (r *retryingRegistry) Fetcher(context.Context, string) (remotes.Fetcher, error) {
+	return r, nil
+}
+
+func (r *retryingRegistry) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	EventHandler(nil).emit(ctx, &LayerFetchRetry{Digest: desc.Digest, Attempt: 1})
+	return r.fakeRegistry.Fetch(ctx, desc)
+}
+
+func TestTransferReportPullAll(t *testing.T) {
+	ctx := context.Background()
+	source := newFakeRegistry()
+	putMultiArchImage(source, "multi")
+	store, err := local.NewStore(t.TempDir())
+	require.NoError(t, err)
+
+	report := NewTransferReport()
+	_, err = PullAll(ctx, store, []PullImage{{Source: &retryingRegistry{source}, Ref: "multi"}}, WithTransferReport(report))
+	require.NoError(t, err)
+	transfers := report.Transfers()
+	require.Len(t, transfers, len(source.blob))
+	for i, transfer := range transfers {
+		if i > 0 {
+			assert.Less(t, string(transfers[i-1].Digest), string(transfer.Digest), "transfers should be sorted")
+		}
+		assert.Equal(t, int64(len(source.blob[transfer.Digest])), transfer.Size)
+		assert.Equal(t, transfer.Size, transfer.Bytes)
+		assert.False(t, transfer.Existing)
+		// Manifests are fetched to plan the pull, not while transferred.
+		retries := 1
+		if images.IsManifestType(transfer.MediaType) || images.IsIndexType(transfer.MediaType) {
+			retries = 0
+		}
+		assert.Equal(t, retries, transfer.Retries, "%s", transfer.Digest)
+	}
+
+	// Content already stored is recorded as skipped.
+	report = NewTransferReport()
+	_, err = PullAll(ctx, store, []PullImage{{Source: source, Ref: "multi"}}, WithTransferReport(report))
+	require.NoError(t, err)
+	transfers = report.Transfers()
+	require.Len(t, transfers, len(source.blob))
+	for _, transfer := range transfers {
+		assert.True(t, transfer.Existing, "%s should be skipped", transfer.Digest)
+		assert.Zero(t, transfer.Bytes)
+		assert.Zero(t, transfer.Retries)
+	}
+}
+
+func TestTransferReportCopy(t *testing.T) {
+	source, destination := newFakeRegistry(), newFakeRegistry()
+	_, manifests := putMultiArchImage(source, "source")
+	existing := source.get(manifests[0].Digest)
+	destination.put(manifests[0].MediaType, existing)
+
+	report := NewTransferReport()
+	_, err := Copy(context.Background(), source, "source", destination, "destination", WithTransferReport(report))
+	require.NoError(t, err)
+	transfers := map[digest.Digest]Transfer{}
+	for _, transfer := range report.Transfers() {
+		transfers[transfer.Digest] = transfer
+	}
+	require.Len(t, transfers, len(source.blob))
+	for dgst, transfer := range transfers {
+		if dgst == manifests[0].Digest {
+			assert.True(t, transfer.Existing, "manifest present at the destination should be skipped")
+			assert.Zero(t, transfer.Bytes)
+			continue
+		}
+		assert.False(t, transfer.Existing, "%s", dgst)
+		assert.Equal(t, int64(len(source.blob[dgst])), transfer.Bytes, "%s", dgst)
+	}
+
+	encoded, err := json.Marshal(report)
+	require.NoError(t, err)
+	var decoded struct {
+		Transfers []Transfer `json:"transfers"`
+	}
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+	assert.Equal(t, report.Transfers(), decoded.Transfers)
+}
+
+func TestWithTransferReportInvalid(t *testing.T) {
+	_, err := newCopyOptions([]CopyOption{WithTransferReport(nil)})
+	assert.Error(t, err)
+}
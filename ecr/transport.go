@@ -0,0 +1,155 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// BlobTransport moves the content of layers and configs to and from Amazon
+// ECR.  The resolver locates blobs and starts and completes uploads with the
+// ECR API, and uses a BlobTransport to transfer the bytes in between, so that
+// downloads and uploads can be accelerated or faked without changing how
+// images are resolved, fetched, or pushed.  Transfers which fail with an error
+// wrapping errdefs.ErrNotImplemented are made by the default transport
+// instead.
+type BlobTransport interface {
+	// Download returns the content of the blob described by desc from
+	// downloadURL, a presigned URL returned by ECR or the URL of a foreign
+	// layer.  Downloads which fail transiently, such as with a network
+	// error, are retried by the caller.
+	Download(ctx context.Context, desc ocispec.Descriptor, downloadURL string) (io.ReadCloser, error)
+	// UploadPart uploads a part of a layer to an upload started with ECR in
+	// region.
+	UploadPart(ctx context.Context, region string, input *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error)
+}
+
+// defaultBlobTransport downloads blobs over HTTP, in parallel parts if
+// parallelism is set, and uploads them with ECR's UploadLayerPart API.
+type defaultBlobTransport struct {
+	client      ecrAPI
+	httpClient  *http.Client
+	parallelism int
+	// chunkSize is the size of the ranges in which blobs are downloaded in
+	// parallel, or zero if they are downloaded with htcat.
+	chunkSize int64
+	// smallBlobThreshold is the size at or below which blobs are not
+	// downloaded in parallel.
+	smallBlobThreshold int64
+}
+
+var _ BlobTransport = (*defaultBlobTransport)(nil)
+
+func (t *defaultBlobTransport) Download(ctx context.Context, desc ocispec.Descriptor, downloadURL string) (io.ReadCloser, error) {
+	if t.parallelism > 0 && !isSmallBlob(desc, t.smallBlobThreshold) && !images.IsNonDistributable(desc.MediaType) {
+		if t.chunkSize > 0 {
+			log.G(ctx).WithField("url", loggedURL(ctx, downloadURL)).Debug("ecr.fetcher.layer.range")
+			return &rangeReader{
+				ctx:         ctx,
+				client:      t.httpClient,
+				url:         downloadURL,
+				parallelism: t.parallelism,
+				chunkSize:   t.chunkSize,
+			}, nil
+		}
+		return t.downloadHtcat(ctx, downloadURL)
+	}
+	req, err := http.NewRequest(http.MethodGet, downloadURL, nil)
+	if err != nil {
+		log.G(ctx).
+			WithError(err).
+			WithField("url", loggedURL(ctx, downloadURL)).
+			Error("ecr.fetcher.layer.url: failed to create HTTP request")
+		return nil, redactError(ctx, err, downloadURL)
+	}
+	log.G(ctx).WithField("url", loggedURL(ctx, downloadURL)).Debug("ecr.fetcher.layer.url")
+
+	req.Header.Set("Accept", strings.Join([]string{desc.MediaType, `*`}, ", "))
+	resp, err := ctxhttp.Do(ctx, t.httpClient, req)
+	if err != nil {
+		return nil, redactError(ctx, fmt.Errorf("failed to do request: %w", err), downloadURL)
+	}
+	if resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("content at %v not found: %w", loggedURL(ctx, downloadURL), errdefs.ErrNotFound)
+		}
+		statusErr := &httpStatusError{url: loggedURL(ctx, downloadURL), statusCode: resp.StatusCode, status: resp.Status}
+		statusErr.code, statusErr.message = readS3Error(resp.Body)
+		return nil, statusErr
+	}
+	log.G(ctx).WithField("desc", desc).Debug("ecr.fetcher.layer.url: returning body")
+	return resp.Body, nil
+}
+
+func (t *defaultBlobTransport) downloadHtcat(ctx context.Context, downloadURL string) (io.ReadCloser, error) {
+	log.G(ctx).WithField("url", loggedURL(ctx, downloadURL)).Debug("ecr.fetcher.layer.htcat")
+	parsedURL, err := url.Parse(downloadURL)
+	if err != nil {
+		err = redactError(ctx, err, downloadURL)
+		log.G(ctx).
+			WithError(err).
+			WithField("url", loggedURL(ctx, downloadURL)).
+			Error("ecr.fetcher.layer.htcat: failed to parse URL")
+		return nil, err
+	}
+	return &htcatReader{
+		ctx:         ctx,
+		client:      contextClient(ctx, t.httpClient),
+		url:         parsedURL,
+		parallelism: t.parallelism,
+	}, nil
+}
+
+func (t *defaultBlobTransport) UploadPart(ctx context.Context, region string, input *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+	return t.client.UploadLayerPart(input)
+}
+
+// fallbackBlobTransport makes the transfers which transport does not
+// implement with fallback.
+type fallbackBlobTransport struct {
+	transport BlobTransport
+	fallback  BlobTransport
+}
+
+func (t *fallbackBlobTransport) Download(ctx context.Context, desc ocispec.Descriptor, downloadURL string) (io.ReadCloser, error) {
+	rc, err := t.transport.Download(ctx, desc, downloadURL)
+	if errdefs.IsNotImplemented(err) {
+		log.G(ctx).WithError(err).Debug("ecr.transport: downloading with default transport")
+		return t.fallback.Download(ctx, desc, downloadURL)
+	}
+	return rc, err
+}
+
+func (t *fallbackBlobTransport) UploadPart(ctx context.Context, region string, input *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+	output, err := t.transport.UploadPart(ctx, region, input)
+	if errdefs.IsNotImplemented(err) {
+		return t.fallback.UploadPart(ctx, region, input)
+	}
+	return output, err
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBlobTransport is a BlobTransport backed by the functions contained in
+// the struct.
+type fakeBlobTransport struct {
+	DownloadFn   func(context.Context, ocispec.Descriptor, string) (io.ReadCloser, error)
+	UploadPartFn func(context.Context, string, *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error)
+}
+
+var _ BlobTransport = (*fakeBlobTransport)(nil)
+
+func (f *fakeBlobTransport) Download(ctx context.Context, desc ocispec.Descriptor, downloadURL string) (io.ReadCloser, error) {
+	return f.DownloadFn(ctx, desc, downloadURL)
+}
+
+func (f *fakeBlobTransport) UploadPart(ctx context.Context, region string, input *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+	return f.UploadPartFn(ctx, region, input)
+}
+
+func TestBlobTransportDownload(t *testing.T) {
+	const (
+		downloadURL = "https://layers.example.com/layer"
+		layerData   = "layer"
+	)
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString(layerData),
+		Size:      int64(len(layerData)),
+	}
+	var downloaded []string
+	transport := &fakeBlobTransport{
+		DownloadFn: func(_ context.Context, d ocispec.Descriptor, u string) (io.ReadCloser, error) {
+			assert.Equal(t, desc.Digest, d.Digest)
+			downloaded = append(downloaded, u)
+			return ioutil.NopCloser(strings.NewReader(layerData)), nil
+		},
+	}
+	client := &fakeECRClient{
+		GetDownloadUrlForLayerFn: func(_ aws.Context, input *ecr.GetDownloadUrlForLayerInput, _ ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			assert.Equal(t, desc.Digest.String(), aws.StringValue(input.LayerDigest))
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(downloadURL)}, nil
+		},
+	}
+	resolver, err := NewResolver(WithBlobTransport(transport), WithLayerDownloadParallelism(4))
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err)
+	defer rc.Close()
+	content, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, layerData, string(content))
+	assert.Equal(t, []string{downloadURL}, downloaded, "layer should be downloaded with the transport")
+}
+
+func TestBlobTransportUpload(t *testing.T) {
+	const layerData = "layer"
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString(layerData),
+		Size:      int64(len(layerData)),
+	}
+	var uploaded []byte
+	transport := &fakeBlobTransport{
+		UploadPartFn: func(_ context.Context, region string, input *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+			assert.Equal(t, "fake", region)
+			assert.Equal(t, "upload", aws.StringValue(input.UploadId))
+			uploaded = append(uploaded, input.LayerPartBlob...)
+			return &ecr.UploadLayerPartOutput{
+				UploadId:         input.UploadId,
+				LastByteReceived: input.PartLastByte,
+			}, nil
+		},
+	}
+	client := &fakeECRClient{
+		BatchCheckLayerAvailabilityFn: func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			return &ecr.BatchCheckLayerAvailabilityOutput{Layers: []*ecr.Layer{{
+				LayerDigest:       aws.String(desc.Digest.String()),
+				LayerAvailability: aws.String(ecr.LayerAvailabilityUnavailable),
+			}}}, nil
+		},
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{UploadId: aws.String("upload"), PartSize: aws.Int64(2)}, nil
+		},
+		UploadLayerPartFn: func(*ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+			t.Error("parts should be uploaded with the transport")
+			return nil, nil
+		},
+		CompleteLayerUploadFn: func(input *ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+			return &ecr.CompleteLayerUploadOutput{LayerDigest: input.LayerDigests[0]}, nil
+		},
+	}
+	resolver, err := NewResolver(WithBlobTransport(transport), WithUploadChecksums())
+	require.NoError(t, err)
+	resolver.(*ecrResolver).clients["fake"] = client
+
+	pusher, err := resolver.Pusher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest@"+desc.Digest.String())
+	require.NoError(t, err)
+	writer, err := pusher.Push(context.Background(), desc)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte(layerData))
+	require.NoError(t, err)
+	require.NoError(t, writer.Commit(context.Background(), desc.Size, desc.Digest))
+	assert.Equal(t, layerData, string(uploaded))
+}
+
+func TestBlobTransportFallback(t *testing.T) {
+	const layerData = "layer"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, layerData)
+	}))
+	defer server.Close()
+	transport := &fakeBlobTransport{
+		DownloadFn: func(context.Context, ocispec.Descriptor, string) (io.ReadCloser, error) {
+			return nil, fmt.Errorf("download: %w", errdefs.ErrNotImplemented)
+		},
+	}
+	fetcher := &ecrFetcher{
+		ecrBase:    ecrBase{transport: transport},
+		httpClient: server.Client(),
+	}
+
+	rc, err := fetcher.blobTransport().Download(context.Background(), ocispec.Descriptor{}, server.URL)
+	require.NoError(t, err)
+	defer rc.Close()
+	content, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, layerData, string(content), "should download with the default transport")
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// uploadGroup tracks the blobs being uploaded by the pushers of a resolver,
+// so that a blob referenced by several manifests pushed at once, such as the
+// manifests of an index or the images of a release, is uploaded once.
+type uploadGroup struct {
+	mu       sync.Mutex
+	inflight map[string]*upload
+}
+
+// upload is a blob upload in progress.  done is closed once it finishes,
+// after which uploaded reports whether the blob is in the repository.
+type upload struct {
+	done     chan struct{}
+	uploaded bool
+}
+
+func newUploadGroup() *uploadGroup {
+	return &uploadGroup{inflight: map[string]*upload{}}
+}
+
+// start begins uploading the blob identified by key.  If the blob is already
+// being uploaded, start waits for that upload to finish, and reports true if
+// it succeeded; a failed upload is started again.  Otherwise finish must be
+// called with whether the blob was uploaded once the upload is over.  A nil
+// group starts every upload.
+func (g *uploadGroup) start(ctx context.Context, key string) (finish func(uploaded bool), uploaded bool, err error) {
+	if g == nil {
+		return func(bool) {}, false, nil
+	}
+	for {
+		g.mu.Lock()
+		u, ok := g.inflight[key]
+		if !ok {
+			u = &upload{done: make(chan struct{})}
+			g.inflight[key] = u
+			g.mu.Unlock()
+			var once sync.Once
+			return func(uploaded bool) {
+				once.Do(func() {
+					g.mu.Lock()
+					delete(g.inflight, key)
+					u.uploaded = uploaded
+					g.mu.Unlock()
+					close(u.done)
+				})
+			}, false, nil
+		}
+		g.mu.Unlock()
+
+		select {
+		case <-u.done:
+			if u.uploaded {
+				return nil, true, nil
+			}
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// uploadKey returns the key identifying the upload of desc to the pusher's
+// repository.
+func (p ecrPusher) uploadKey(desc ocispec.Descriptor) string {
+	spec := p.ecrSpec
+	spec.Object = "@" + desc.Digest.String()
+	return spec.Canonical()
+}
+
+// uploadWriter finishes its upload once committed or closed.
+type uploadWriter struct {
+	content.Writer
+	finish func(uploaded bool)
+}
+
+func (w *uploadWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	err := w.Writer.Commit(ctx, size, expected, opts...)
+	w.finish(err == nil)
+	return err
+}
+
+func (w *uploadWriter) Close() error {
+	err := w.Writer.Close()
+	w.finish(false)
+	return err
+}
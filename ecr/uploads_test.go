@@ -0,0 +1,147 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadGroup(t *testing.T) {
+	g := newUploadGroup()
+	finish, uploaded, err := g.start(context.Background(), "blob")
+	require.NoError(t, err)
+	assert.False(t, uploaded)
+
+	type result struct {
+		finish   func(bool)
+		uploaded bool
+	}
+	waiter := func() chan result {
+		results := make(chan result, 1)
+		go func() {
+			finish, uploaded, err := g.start(context.Background(), "blob")
+			assert.NoError(t, err)
+			results <- result{finish, uploaded}
+		}()
+		return results
+	}
+
+	results := waiter()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-results:
+		t.Fatal("upload should wait for the upload in progress")
+	default:
+	}
+	finish(false)
+	r := <-results
+	assert.False(t, r.uploaded, "failed upload should be started again")
+	require.NotNil(t, r.finish)
+
+	results = waiter()
+	time.Sleep(10 * time.Millisecond)
+	r.finish(true)
+	r.finish(false)
+	assert.True(t, (<-results).uploaded, "upload should be shared once finished")
+
+	_, uploaded, err = g.start(context.Background(), "other")
+	require.NoError(t, err)
+	assert.False(t, uploaded, "other blobs should be uploaded independently")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = g.start(ctx, "other")
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	var nilGroup *uploadGroup
+	finish, uploaded, err = nilGroup.start(context.Background(), "blob")
+	require.NoError(t, err)
+	assert.False(t, uploaded)
+	finish(true)
+}
+
+func TestPushBlobSharedUpload(t *testing.T) {
+	const layerData = "layer"
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString(layerData),
+		Size:      int64(len(layerData)),
+	}
+	checks, initiates := 0, 0
+	client := &fakeECRClient{
+		BatchCheckLayerAvailabilityFn: func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			checks++
+			return &ecr.BatchCheckLayerAvailabilityOutput{
+				Layers: []*ecr.Layer{{LayerAvailability: aws.String(ecr.LayerAvailabilityUnavailable)}},
+			}, nil
+		},
+		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+			initiates++
+			return &ecr.InitiateLayerUploadOutput{UploadId: aws.String("upload"), PartSize: aws.Int64(1024)}, nil
+		},
+		UploadLayerPartFn: func(*ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+			return nil, nil
+		},
+		CompleteLayerUploadFn: func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+			return &ecr.CompleteLayerUploadOutput{LayerDigest: aws.String(desc.Digest.String())}, nil
+		},
+	}
+	uploads := newUploadGroup()
+	newPusher := func(tag string) ecrPusher {
+		return ecrPusher{
+			ecrBase: ecrBase{
+				client: client,
+				ecrSpec: ECRSpec{
+					arn:        arn.ARN{AccountID: "registry"},
+					Repository: "repository",
+					Object:     tag,
+				},
+			},
+			tracker: docker.NewInMemoryTracker(),
+			uploads: uploads,
+		}
+	}
+
+	writer, err := newPusher("first").Push(context.Background(), desc)
+	require.NoError(t, err)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := newPusher("second").Push(context.Background(), desc)
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	_, err = writer.Write([]byte(layerData))
+	require.NoError(t, err)
+	require.NoError(t, writer.Commit(context.Background(), desc.Size, desc.Digest))
+	err = <-errs
+	assert.True(t, errors.Is(err, errdefs.ErrAlreadyExists), "unexpected error %v", err)
+	assert.Equal(t, 1, checks, "blob uploaded by another push should not be checked again")
+	assert.Equal(t, 1, initiates, "blob should be uploaded once")
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"net/url"
+	"strings"
+)
+
+// parseURLSource returns the ECR repository referenced by a descriptor URL.
+// Both Docker Registry HTTP API blob URLs of ECR registries, such as
+// https://123456789012.dkr.ecr.us-west-2.amazonaws.com/v2/foo/blobs/sha256:...,
+// and references of the form ecr.aws/arn:aws:ecr:...:repository/foo, as
+// recorded by tools assembling images from several repositories, are
+// recognized.
+func parseURLSource(rawURL string) (ECRSpec, bool) {
+	if strings.HasPrefix(rawURL, refPrefix) {
+		spec, err := ParseRef(rawURL)
+		if err != nil {
+			return ECRSpec{}, false
+		}
+		spec.Object = ""
+		return spec, true
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || !strings.HasPrefix(u.Path, "/v2/") {
+		return ECRSpec{}, false
+	}
+	i := strings.LastIndex(u.Path, "/blobs/")
+	if i <= len("/v2/") {
+		return ECRSpec{}, false
+	}
+	spec, err := ParseImageURI(u.Host + "/" + u.Path[len("/v2/"):i])
+	if err != nil {
+		return ECRSpec{}, false
+	}
+	return spec, true
+}
+
+// urlSource returns the ECR repository referenced by a descriptor URL along
+// with the client for its registry, so that the layer may be fetched through
+// ECR with the fetcher's credentials instead of an unauthenticated request.
+func (f *ecrFetcher) urlSource(rawURL string) (ECRSpec, ecrAPI, bool) {
+	spec, ok := parseURLSource(rawURL)
+	if !ok {
+		return ECRSpec{}, nil, false
+	}
+	switch {
+	case spec.Region() == f.ecrSpec.Region() && spec.Registry() == f.ecrSpec.Registry():
+		return spec, f.client, true
+	case f.getClient != nil:
+		return spec, f.getClient(spec.Region(), spec.Registry()), true
+	}
+	return ECRSpec{}, nil, false
+}
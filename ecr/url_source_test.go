@@ -0,0 +1,129 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseURLSource(t *testing.T) {
+	dgst := digest.FromString("layer").String()
+	for _, tc := range []struct {
+		url        string
+		repository string
+		region     string
+	}{
+		{url: "https://123456789012.dkr.ecr.us-west-2.amazonaws.com/v2/foo/bar/blobs/" + dgst, repository: "foo/bar", region: "us-west-2"},
+		{url: "https://123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn/v2/foo/blobs/" + dgst, repository: "foo", region: "cn-north-1"},
+		{url: "ecr.aws/arn:aws:ecr:us-east-1:123456789012:repository/foo@" + dgst, repository: "foo", region: "us-east-1"},
+		{url: "https://example.com/v2/foo/blobs/" + dgst},
+		{url: "http://123456789012.dkr.ecr.us-west-2.amazonaws.com/v2/foo/blobs/" + dgst},
+		{url: "https://123456789012.dkr.ecr.us-west-2.amazonaws.com/v2/foo/manifests/latest"},
+		{url: "https://123456789012.dkr.ecr.us-west-2.amazonaws.com/v2/blobs/" + dgst},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			spec, ok := parseURLSource(tc.url)
+			if tc.repository == "" {
+				assert.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			assert.Equal(t, tc.repository, spec.Repository)
+			assert.Equal(t, tc.region, spec.Region())
+			assert.Equal(t, "123456789012", spec.Registry())
+			assert.Empty(t, spec.Object)
+		})
+	}
+}
+
+func TestFetchLayerFromURLRepository(t *testing.T) {
+	const layerData = "layer"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, layerData)
+	}))
+	defer ts.Close()
+
+	var requested []string
+	newClient := func(region string) *fakeECRClient {
+		return &fakeECRClient{
+			GetDownloadUrlForLayerFn: func(_ aws.Context, input *ecr.GetDownloadUrlForLayerInput, _ ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+				requested = append(requested, region+"/"+aws.StringValue(input.RepositoryName))
+				if aws.StringValue(input.RepositoryName) == "app" {
+					return nil, awserr.New(ecr.ErrCodeLayersNotFoundException, "not found", nil)
+				}
+				return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+			},
+		}
+	}
+	spec, err := ParseRef("ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/app:latest")
+	require.NoError(t, err)
+	fetcher := &ecrFetcher{
+		ecrBase:   ecrBase{client: newClient("us-west-2"), ecrSpec: spec},
+		getClient: func(region, _ string) ecrAPI { return newClient(region) },
+	}
+	dgst := digest.FromString(layerData)
+
+	for _, tc := range []struct {
+		name      string
+		mediaType string
+		url       string
+		requested []string
+	}{
+		{
+			name:      "missing layer",
+			mediaType: ocispec.MediaTypeImageLayerGzip,
+			url:       "https://123456789012.dkr.ecr.us-west-2.amazonaws.com/v2/base/blobs/" + dgst.String(),
+			requested: []string{"us-west-2/app", "us-west-2/base"},
+		},
+		{
+			name:      "foreign layer",
+			mediaType: images.MediaTypeDockerSchema2LayerForeignGzip,
+			url:       "ecr.aws/arn:aws:ecr:us-east-1:123456789012:repository/windows@" + dgst.String(),
+			requested: []string{"us-east-1/windows"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			requested = nil
+			rc, err := fetcher.Fetch(context.Background(), ocispec.Descriptor{
+				MediaType: tc.mediaType,
+				Digest:    dgst,
+				Size:      int64(len(layerData)),
+				URLs:      []string{tc.url},
+			})
+			require.NoError(t, err)
+			defer rc.Close()
+			data, err := ioutil.ReadAll(rc)
+			require.NoError(t, err)
+			assert.Equal(t, layerData, string(data))
+			assert.Equal(t, tc.requested, requested)
+		})
+	}
+}
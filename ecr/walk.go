@@ -0,0 +1,167 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// WalkNode is a descriptor of an image graph visited by Walk.
+type WalkNode struct {
+	ocispec.Descriptor
+	// Parent is the digest of the index or manifest listing the node, or of
+	// the manifest or index a referrer refers to.  It is empty for the
+	// image's root.
+	Parent digest.Digest
+	// Depth is the number of edges between the node and the image's root.
+	Depth int
+	// Referrer reports whether the node is an artifact referring to Parent,
+	// such as a signature or SBOM, rather than content Parent lists.
+	Referrer bool
+	// ArtifactType is the type of the artifact of referrers, if known.
+	ArtifactType string
+}
+
+// WalkFunc is called by Walk for each node of an image graph.  Returning
+// images.ErrSkipDesc skips the node's children and referrers; any other error
+// stops the walk and is returned by Walk.
+type WalkFunc func(ctx context.Context, node WalkNode) error
+
+// Walk traverses the descriptor graph of the image referenced by ref,
+// resolved with resolver, calling visit for each node: indexes, the manifests
+// they list, the configs and layers of manifests, and, if resolver implements
+// ReferrerLister, the artifacts referring to each index and manifest along
+// with their own graphs.  Nodes are visited depth first, each before its
+// children.  Only indexes and manifests are fetched, so size accounting and
+// media type audits need not download any layer.  Content reachable through
+// more than one path, such as layers shared by the manifests of an index, is
+// visited once, from the first path found.
+//
+// The descriptor of the image's root is returned.
+func Walk(ctx context.Context, resolver remotes.Resolver, ref string, visit WalkFunc) (ocispec.Descriptor, error) {
+	name, root, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	lister, _ := resolver.(ReferrerLister)
+	w := &walker{
+		name:    name,
+		fetcher: fetcher,
+		lister:  lister,
+		visit:   visit,
+		seen:    map[digest.Digest]bool{},
+	}
+	if err := w.walk(ctx, WalkNode{Descriptor: root}); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return root, nil
+}
+
+// walker holds the state of a Walk.
+type walker struct {
+	name    string
+	fetcher remotes.Fetcher
+	lister  ReferrerLister
+	visit   WalkFunc
+	seen    map[digest.Digest]bool
+}
+
+// walk visits node and then the nodes it leads to.
+func (w *walker) walk(ctx context.Context, node WalkNode) error {
+	if w.seen[node.Digest] {
+		return nil
+	}
+	w.seen[node.Digest] = true
+	if err := w.visit(ctx, node); err != nil {
+		if errors.Is(err, images.ErrSkipDesc) {
+			return nil
+		}
+		return err
+	}
+	if !images.IsIndexType(node.MediaType) && !images.IsManifestType(node.MediaType) {
+		return nil
+	}
+
+	children, err := w.children(ctx, node.Descriptor)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := w.walk(ctx, WalkNode{Descriptor: child, Parent: node.Digest, Depth: node.Depth + 1}); err != nil {
+			return err
+		}
+	}
+	if w.lister == nil {
+		return nil
+	}
+	referrers, err := w.lister.Referrers(ctx, w.name, node.Descriptor)
+	if err != nil {
+		return fmt.Errorf("failed to list referrers of %v: %w", node.Digest, err)
+	}
+	for _, referrer := range referrers {
+		if err := w.walk(ctx, WalkNode{
+			Descriptor:   referrer.Descriptor,
+			Parent:       node.Digest,
+			Depth:        node.Depth + 1,
+			Referrer:     true,
+			ArtifactType: referrer.ArtifactType,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// children returns the descriptors listed by the index or manifest desc.
+func (w *walker) children(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	rc, err := w.fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	log.G(ctx).WithField("digest", desc.Digest).Debug("ecr.walk: fetched manifest")
+
+	if images.IsIndexType(desc.MediaType) {
+		var index ocispec.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("failed to parse index %v: %w", desc.Digest, ErrInvalidManifest)
+		}
+		return index.Manifests, nil
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %v: %w", desc.Digest, ErrInvalidManifest)
+	}
+	return append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...), nil
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2017-2020 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalk(t *testing.T) {
+	source := newFakeRegistry()
+	index, manifests := putMultiArchImage(source, "example.com/app:latest")
+	signature := putSignature(source, "example.com/app", index)
+	lister := referrerListingRegistry{fakeRegistry: source, referrers: map[digest.Digest][]Referrer{
+		index.Digest: {{Descriptor: signature, ArtifactType: "application/vnd.dev.cosign.simplesigning.v1+json"}},
+	}}
+
+	var nodes []WalkNode
+	root, err := Walk(context.Background(), lister, "example.com/app:latest", func(_ context.Context, node WalkNode) error {
+		nodes = append(nodes, node)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, index.Digest, root.Digest)
+	require.Len(t, nodes, 10, "index, two manifests with a config and layer each, and a signature with its config and payload")
+
+	assert.Equal(t, WalkNode{Descriptor: index}, nodes[0])
+	assert.Equal(t, manifests[0].Digest, nodes[1].Digest)
+	assert.Equal(t, index.Digest, nodes[1].Parent)
+	assert.Equal(t, 1, nodes[1].Depth)
+	assert.Equal(t, ocispec.MediaTypeImageConfig, nodes[2].MediaType)
+	assert.Equal(t, 2, nodes[2].Depth)
+	assert.Equal(t, manifests[0].Digest, nodes[3].Parent)
+
+	referrer := nodes[7]
+	assert.Equal(t, signature.Digest, referrer.Digest)
+	assert.True(t, referrer.Referrer)
+	assert.Equal(t, index.Digest, referrer.Parent)
+	assert.Equal(t, "application/vnd.dev.cosign.simplesigning.v1+json", referrer.ArtifactType)
+	assert.Equal(t, signature.Digest, nodes[9].Parent)
+
+	for _, node := range nodes {
+		if !images.IsIndexType(node.MediaType) && !images.IsManifestType(node.MediaType) {
+			assert.Zero(t, source.fetches[node.Digest], "blob %v should not be fetched", node.Digest)
+		}
+	}
+}
+
+func TestWalkSkip(t *testing.T) {
+	source := newFakeRegistry()
+	index, _ := putMultiArchImage(source, "example.com/app:latest")
+
+	var visited []digest.Digest
+	_, err := Walk(context.Background(), source, "example.com/app:latest", func(_ context.Context, node WalkNode) error {
+		visited = append(visited, node.Digest)
+		if node.Depth == 1 {
+			return images.ErrSkipDesc
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Len(t, visited, 3, "children of skipped manifests should not be visited")
+	assert.Equal(t, index.Digest, visited[0])
+
+	expected := errors.New("expected")
+	_, err = Walk(context.Background(), source, "example.com/app:latest", func(context.Context, WalkNode) error {
+		return expected
+	})
+	assert.Equal(t, expected, err)
+}
@@ -17,11 +17,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr"
-	"github.com/containerd/containerd"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/example/internal/cli"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/sirupsen/logrus"
@@ -50,38 +53,104 @@ func main() {
 		log.L.Logger.SetLevel(logrus.TraceLevel)
 	}
 
-	client, err := containerd.New("/run/containerd/containerd.sock")
-	if err != nil {
-		log.G(ctx).WithError(err).Fatal("Failed to connect to containerd")
+	skipReferrers := 0
+	parseEnvInt(ctx, "ECR_COPY_SKIP_REFERRERS", &skipReferrers)
+	lenient := 0
+	parseEnvInt(ctx, "ECR_COPY_LENIENT", &lenient)
+	manifestsOnly := 0
+	parseEnvInt(ctx, "ECR_COPY_MANIFESTS_ONLY", &manifestsOnly)
+	dryRun := 0
+	parseEnvInt(ctx, "ECR_COPY_DRY_RUN", &dryRun)
+	concurrency := 0
+	parseEnvInt(ctx, "ECR_COPY_CONCURRENCY", &concurrency)
+
+	var copyOpts []ecr.CopyOption
+	if skipReferrers == 1 {
+		copyOpts = append(copyOpts, ecr.WithoutCopyReferrers())
+	}
+	if lenient == 1 {
+		copyOpts = append(copyOpts, ecr.WithLenientManifests())
+	}
+	if manifestsOnly == 1 {
+		copyOpts = append(copyOpts, ecr.WithManifestsOnly())
+	}
+	if concurrency > 0 {
+		copyOpts = append(copyOpts, ecr.WithCopyConcurrency(concurrency))
+	}
+	if platforms := os.Getenv("ECR_COPY_PLATFORMS"); platforms != "" {
+		copyOpts = append(copyOpts, ecr.WithCopyPlatforms(strings.Split(platforms, ",")...))
+	}
+	if types := os.Getenv("ECR_COPY_REFERRER_TYPES"); types != "" {
+		copyOpts = append(copyOpts, ecr.WithCopyReferrerTypes(strings.Split(types, ",")...))
+	}
+	if types := os.Getenv("ECR_COPY_EXCLUDE_REFERRER_TYPES"); types != "" {
+		copyOpts = append(copyOpts, ecr.WithoutCopyReferrerTypes(strings.Split(types, ",")...))
 	}
-	defer client.Close()
 
 	resolver, err := ecr.NewResolver()
 	if err != nil {
 		log.G(ctx).WithError(err).Fatal("Failed to create resolver")
 	}
 
-	log.G(ctx).WithField("sourceRef", sourceRef).Info("Pulling from Amazon ECR")
-	img, err := client.Fetch(
-		ctx,
-		sourceRef,
-		containerd.WithResolver(resolver),
-	)
+	if dryRun == 1 {
+		plan, err := ecr.PlanCopy(ctx, resolver, sourceRef, resolver, destRef, copyOpts...)
+		if err != nil {
+			cli.Fatal(log.G(ctx).WithField("destRef", destRef), err, "Failed to plan copy")
+		}
+		if err := writePlan(plan); err != nil {
+			log.G(ctx).WithError(err).Fatal("Failed to write plan")
+		}
+		return
+	}
+
+	source := resolver
+	var report *ecr.VerificationReport
+	reportPath := os.Getenv("ECR_COPY_REPORT")
+	if reportPath != "" {
+		report = ecr.NewVerificationReport()
+		source = report.Resolver(resolver)
+	}
+
+	transfers := ecr.NewTransferReport()
+	copyOpts = append(copyOpts, ecr.WithTransferReport(transfers))
+
+	log.G(ctx).WithField("sourceRef", sourceRef).WithField("destRef", destRef).Info("Copying within Amazon ECR")
+	desc, err := ecr.Copy(ctx, source, sourceRef, resolver, destRef, copyOpts...)
 	if err != nil {
-		log.G(ctx).WithError(err).WithField("sourceRef", sourceRef).Fatal("Failed to pull")
+		cli.Fatal(log.G(ctx).WithField("destRef", destRef), err, "Failed to copy")
+	}
+	for _, transfer := range transfers.Transfers() {
+		log.G(ctx).
+			WithField("digest", transfer.Digest).
+			WithField("bytes", transfer.Bytes).
+			WithField("duration", transfer.Duration).
+			WithField("retries", transfer.Retries).
+			WithField("existing", transfer.Existing).
+			Debug("Transferred content")
 	}
-	log.G(ctx).WithField("img", img.Name).Info("Pulled successfully!")
 
-	log.G(ctx).WithField("sourceRef", sourceRef).WithField("destRef", destRef).Info("Pushing to Amazon ECR")
-	desc := img.Target
-	err = client.Push(ctx, destRef, desc,
-		containerd.WithResolver(resolver),
-	)
+	log.G(ctx).WithField("destRef", destRef).WithField("digest", desc.Digest).Info("Copied successfully!")
+	if report != nil {
+		if err := writeReport(reportPath, report); err != nil {
+			log.G(ctx).WithError(err).WithField("path", reportPath).Fatal("Failed to write verification report")
+		}
+	}
+}
+
+// writeReport writes report to path as JSON.
+func writeReport(path string, report *ecr.VerificationReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
 	if err != nil {
-		log.G(ctx).WithError(err).WithField("destRef", destRef).Fatal("Failed to push")
+		return err
 	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
 
-	log.G(ctx).WithField("destRef", destRef).Info("Pushed successfully!")
+// writePlan writes plan to stdout as JSON.
+func writePlan(plan *ecr.TransferPlan) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plan)
 }
 
 func parseEnvInt(ctx context.Context, varname string, val *int) {
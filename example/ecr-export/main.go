@@ -0,0 +1,117 @@
+/*
+ * Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/example/internal/cli"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Default to no debug logging.
+	defaultEnableDebug = 0
+)
+
+func main() {
+	ctx := namespaces.NamespaceFromEnv(context.Background())
+
+	if len(os.Args) < 3 {
+		log.G(ctx).Fatal("Must provide image and S3 URL as arguments")
+	} else if len(os.Args) > 3 {
+		log.G(ctx).Fatal("Must provide only the image and S3 URL as arguments")
+	}
+
+	ref := os.Args[1]
+	destURL, err := url.Parse(os.Args[2])
+	if err != nil || destURL.Scheme != "s3" || destURL.Host == "" {
+		log.G(ctx).WithField("url", os.Args[2]).Fatal("S3 URL must be of the form s3://bucket/key")
+	}
+	bucket := destURL.Host
+	key := strings.TrimPrefix(destURL.Path, "/")
+
+	enableDebug := defaultEnableDebug
+	parseEnvInt(ctx, "ECR_EXPORT_DEBUG", &enableDebug)
+	if enableDebug == 1 {
+		log.L.Logger.SetLevel(logrus.TraceLevel)
+	}
+
+	skipReferrers := 0
+	parseEnvInt(ctx, "ECR_EXPORT_SKIP_REFERRERS", &skipReferrers)
+
+	var exportOpts []ecr.CopyOption
+	if skipReferrers == 1 {
+		exportOpts = append(exportOpts, ecr.WithoutCopyReferrers())
+	}
+	if platforms := os.Getenv("ECR_EXPORT_PLATFORMS"); platforms != "" {
+		exportOpts = append(exportOpts, ecr.WithCopyPlatforms(strings.Split(platforms, ",")...))
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("Failed to create session")
+	}
+	resolver, err := ecr.NewResolver(ecr.WithSession(sess))
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("Failed to create resolver")
+	}
+
+	// The archive is streamed into a multipart upload without being staged
+	// on disk.
+	reader, writer := io.Pipe()
+	exported := make(chan ocispec.Descriptor, 1)
+	go func() {
+		desc, err := ecr.Export(ctx, resolver, ref, writer, exportOpts...)
+		exported <- desc
+		writer.CloseWithError(err)
+	}()
+
+	log.G(ctx).WithField("ref", ref).WithField("url", destURL).Info("Exporting to Amazon S3")
+	uploader := s3manager.NewUploader(sess)
+	_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   reader,
+	})
+	if err != nil {
+		cli.Fatal(log.G(ctx).WithField("ref", ref), err, "Failed to export")
+	}
+
+	log.G(ctx).WithField("url", destURL).WithField("digest", (<-exported).Digest).Info("Exported successfully!")
+}
+
+func parseEnvInt(ctx context.Context, varname string, val *int) {
+	if varval := os.Getenv(varname); varval != "" {
+		parsed, err := strconv.Atoi(varval)
+		if err != nil {
+			log.G(ctx).WithError(err).Fatalf("Failed to parse %s", varname)
+		}
+		*val = parsed
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/example/internal/cli"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	dockerremote "github.com/containerd/containerd/remotes/docker"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Default to no debug logging.
+	defaultEnableDebug = 0
+)
+
+func main() {
+	ctx := namespaces.NamespaceFromEnv(context.Background())
+
+	if len(os.Args) < 3 {
+		log.G(ctx).Fatal("Must provide source and destination as arguments")
+	} else if len(os.Args) > 3 {
+		log.G(ctx).Fatal("Must provide only the source and destination as arguments")
+	}
+
+	sourceArg := os.Args[1]
+	destRef := os.Args[2]
+
+	enableDebug := defaultEnableDebug
+	parseEnvInt(ctx, "ECR_IMPORT_DEBUG", &enableDebug)
+	if enableDebug == 1 {
+		log.L.Logger.SetLevel(logrus.TraceLevel)
+	}
+
+	skipReferrers := 0
+	parseEnvInt(ctx, "ECR_IMPORT_SKIP_REFERRERS", &skipReferrers)
+
+	var copyOpts []ecr.CopyOption
+	if skipReferrers == 1 {
+		copyOpts = append(copyOpts, ecr.WithoutCopyReferrers())
+	}
+	if platforms := os.Getenv("ECR_IMPORT_PLATFORMS"); platforms != "" {
+		copyOpts = append(copyOpts, ecr.WithCopyPlatforms(strings.Split(platforms, ",")...))
+	}
+
+	source, sourceRef, err := newSource(ctx, sourceArg)
+	if err != nil {
+		cli.Fatal(log.G(ctx), err, "Failed to open source")
+	}
+
+	destination, err := ecr.NewResolver()
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("Failed to create resolver")
+	}
+
+	log.G(ctx).WithField("sourceRef", sourceRef).WithField("destRef", destRef).Info("Importing into Amazon ECR")
+	desc, err := ecr.Copy(ctx, source, sourceRef, destination, destRef, copyOpts...)
+	if err != nil {
+		cli.Fatal(log.G(ctx).WithField("sourceRef", sourceRef), err, "Failed to import")
+	}
+
+	log.G(ctx).WithField("destRef", destRef).WithField("digest", desc.Digest).Info("Imported successfully!")
+}
+
+// newSource returns the resolver and ref for the source argument, which is
+// either the s3://bucket/key[#tag] URL of an OCI layout archive, such as one
+// written by ecr-export, or a reference to a public registry in the form
+// accepted by docker pull, such as "alpine:3.16" or
+// "public.ecr.aws/docker/library/alpine".
+func newSource(ctx context.Context, source string) (remotes.Resolver, string, error) {
+	if strings.HasPrefix(source, "s3://") {
+		return newS3LayoutResolver(ctx, source)
+	}
+	named, err := docker.ParseDockerRef(source)
+	if err != nil {
+		return nil, "", err
+	}
+	if docker.Domain(named) == ecr.PublicRegistryHost {
+		resolver, err := ecr.NewPublicResolver()
+		return resolver, named.String(), err
+	}
+	// Other public registries are accessed anonymously.
+	return dockerremote.NewResolver(dockerremote.ResolverOptions{}), named.String(), nil
+}
+
+func parseEnvInt(ctx context.Context, varname string, val *int) {
+	if varval := os.Getenv(varname); varval != "" {
+		parsed, err := strconv.Atoi(varval)
+		if err != nil {
+			log.G(ctx).WithError(err).Fatalf("Failed to parse %s", varname)
+		}
+		*val = parsed
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr"
+	"github.com/containerd/containerd/remotes"
+)
+
+// s3ReaderAt reads an S3 object with ranged requests.
+type s3ReaderAt struct {
+	ctx    context.Context
+	client *s3.S3
+	bucket string
+	key    string
+}
+
+func (r *s3ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	output, err := r.client.GetObjectWithContext(r.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer output.Body.Close()
+	n, err := io.ReadFull(output.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// newS3LayoutResolver returns a resolver for the OCI layout archive at an
+// s3://bucket/key URL, along with the ref to resolve.  The ref is taken from
+// the URL's fragment, if any.
+func newS3LayoutResolver(ctx context.Context, source string) (remotes.Resolver, string, error) {
+	sourceURL, err := url.Parse(source)
+	if err != nil || sourceURL.Host == "" {
+		return nil, "", fmt.Errorf("S3 URL must be of the form s3://bucket/key[#tag]: %s", source)
+	}
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, "", err
+	}
+	r := &s3ReaderAt{
+		ctx:    ctx,
+		client: s3.New(sess),
+		bucket: sourceURL.Host,
+		key:    strings.TrimPrefix(sourceURL.Path, "/"),
+	}
+	head, err := r.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	resolver, err := ecr.NewLayoutResolver(r, aws.Int64Value(head.ContentLength))
+	if err != nil {
+		return nil, "", err
+	}
+	ref := "layout"
+	if sourceURL.Fragment != "" {
+		ref += ":" + sourceURL.Fragment
+	}
+	return resolver, ref, nil
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// pullDelta measures how much of an image a pull downloads.  containerd
+// fetches only the content missing from its content store, so re-pulling a
+// tag whose digest changed downloads only the layers which changed.  The
+// layers and config already present are recorded as the pull reaches them,
+// before they would be fetched.
+type pullDelta struct {
+	cs content.Store
+
+	mu   sync.Mutex
+	seen map[digest.Digest]struct{}
+	// blobs and size count the image's layers and config, and fetched and
+	// fetchedSize those of them missing from the content store.
+	blobs, fetched    int
+	size, fetchedSize int64
+}
+
+func newPullDelta(cs content.Store) *pullDelta {
+	return &pullDelta{
+		cs:   cs,
+		seen: map[digest.Digest]struct{}{},
+	}
+}
+
+// record counts desc, if it is a layer or config, as present or missing.
+func (d *pullDelta) record(ctx context.Context, desc ocispec.Descriptor) {
+	if images.IsIndexType(desc.MediaType) || images.IsManifestType(desc.MediaType) ||
+		desc.MediaType == images.MediaTypeDockerSchema1Manifest {
+		return
+	}
+	_, err := d.cs.Info(ctx, desc.Digest)
+	if err != nil && !errdefs.IsNotFound(err) {
+		log.G(ctx).WithError(err).WithField("digest", desc.Digest).Warn("Failed to check for existing content")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.seen[desc.Digest]; ok {
+		return
+	}
+	d.seen[desc.Digest] = struct{}{}
+	d.blobs++
+	d.size += desc.Size
+	if err != nil {
+		d.fetched++
+		d.fetchedSize += desc.Size
+	}
+}
+
+func (d *pullDelta) String() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return fmt.Sprintf("downloaded %s of %s (%d of %d layers and config)",
+		units.HumanSize(float64(d.fetchedSize)), units.HumanSize(float64(d.size)), d.fetched, d.blobs)
+}
@@ -17,14 +17,23 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/example/internal/cli"
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 )
@@ -34,19 +43,30 @@ const (
 	defaultParallelism = 0
 	// Default to no debug logging.
 	defaultEnableDebug = 0
+	// Default to no deadline for the pull.
+	defaultTimeoutSeconds = 0
+	// Default to downloading layers without the S3 transfer manager.
+	defaultS3Concurrency = 0
 )
 
 func main() {
 	ctx := namespaces.NamespaceFromEnv(context.Background())
 
-	if len(os.Args) < 2 {
+	var ref, watchPath string
+	switch {
+	case len(os.Args) < 2:
 		log.G(ctx).Fatal("Must provide image to pull as argument")
-	} else if len(os.Args) > 2 {
+	case os.Args[1] == "--watch":
+		if len(os.Args) != 3 {
+			log.G(ctx).Fatal("Must provide only the file listing the images to watch")
+		}
+		watchPath = os.Args[2]
+	case len(os.Args) > 2:
 		log.G(ctx).Fatal("Must provide only the image to pull")
+	default:
+		ref = os.Args[1]
 	}
 
-	ref := os.Args[1]
-
 	parallelism := defaultParallelism
 	parseEnvInt(ctx, "ECR_PULL_PARALLEL", &parallelism)
 
@@ -56,6 +76,17 @@ func main() {
 		log.L.Logger.SetLevel(logrus.TraceLevel)
 	}
 
+	timeoutSeconds := defaultTimeoutSeconds
+	parseEnvInt(ctx, "ECR_PULL_TIMEOUT", &timeoutSeconds)
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	// pullCtx bounds both pulling and unpacking the image.
+	pullCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		pullCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	address := "/run/containerd/containerd.sock"
 	if newAddress := os.Getenv("CONTAINERD_ADDRESS"); newAddress != "" {
 		address = newAddress
@@ -66,6 +97,120 @@ func main() {
 	}
 	defer client.Close()
 
+	s3Concurrency := defaultS3Concurrency
+	parseEnvInt(ctx, "ECR_PULL_S3_CONCURRENCY", &s3Concurrency)
+	var resolverOptions []ecr.ResolverOption
+	profile := os.Getenv("ECR_PULL_PROFILE")
+	if profile != "" {
+		resolverOptions = append(resolverOptions, ecr.WithProfile(ecr.Profile(profile)))
+	}
+	if profile == "" || os.Getenv("ECR_PULL_PARALLEL") != "" {
+		resolverOptions = append(resolverOptions, ecr.WithLayerDownloadParallelism(parallelism))
+	}
+	if os.Getenv("ECR_PULL_CONVERT_SCHEMA1") == "1" {
+		resolverOptions = append(resolverOptions, ecr.WithSchema1Conversion())
+	}
+	apiRate := 0
+	parseEnvInt(ctx, "ECR_PULL_API_RATE", &apiRate)
+	if apiRate > 0 {
+		resolverOptions = append(resolverOptions, ecr.WithAPIRateLimit(float64(apiRate), apiRate))
+	}
+	if os.Getenv("ECR_PULL_ADAPTIVE_RETRY") == "1" {
+		resolverOptions = append(resolverOptions, ecr.WithAdaptiveRetry())
+	}
+	if os.Getenv("ECR_PULL_PULL_THROUGH_CACHE") == "1" {
+		resolverOptions = append(resolverOptions, ecr.WithPullThroughCache())
+	}
+	if severity := os.Getenv("ECR_PULL_SCAN_MAX_SEVERITY"); severity != "" {
+		resolverOptions = append(resolverOptions, ecr.WithScanPolicy(ecr.ScanPolicy{MaxSeverity: severity}))
+	}
+	if lockDir := os.Getenv("ECR_PULL_HOST_LOCK_DIR"); lockDir != "" {
+		slots := 0
+		parseEnvInt(ctx, "ECR_PULL_HOST_SLOTS", &slots)
+		coordinator, err := ecr.NewHostCoordinator(ecr.HostCoordinatorOptions{
+			Dir:     lockDir,
+			Slots:   slots,
+			Content: client.ContentStore(),
+		})
+		if err != nil {
+			log.G(ctx).WithError(err).Fatal("Failed to create host coordinator")
+		}
+		resolverOptions = append(resolverOptions, ecr.WithHostCoordinator(coordinator))
+	}
+	if cacheDir := os.Getenv("ECR_PULL_BLOB_CACHE_DIR"); cacheDir != "" {
+		cacheSize, cacheTTLSeconds := 0, 0
+		parseEnvInt(ctx, "ECR_PULL_BLOB_CACHE_SIZE", &cacheSize)
+		parseEnvInt(ctx, "ECR_PULL_BLOB_CACHE_TTL", &cacheTTLSeconds)
+		cache, err := ecr.NewBlobCache(ecr.BlobCacheOptions{
+			Dir:           cacheDir,
+			MaxSize:       int64(cacheSize),
+			TTL:           time.Duration(cacheTTLSeconds) * time.Second,
+			Verify:        os.Getenv("ECR_PULL_BLOB_CACHE_VERIFY") == "1",
+			QuarantineDir: os.Getenv("ECR_PULL_BLOB_CACHE_QUARANTINE"),
+		})
+		if err != nil {
+			log.G(ctx).WithError(err).Fatal("Failed to create blob cache")
+		}
+		resolverOptions = append(resolverOptions, ecr.WithBlobCache(cache))
+	}
+	if s3Concurrency > 0 {
+		transport, err := ecr.NewS3BlobTransport(ecr.S3TransportOptions{Concurrency: s3Concurrency})
+		if err != nil {
+			log.G(ctx).WithError(err).Fatal("Failed to create S3 transport")
+		}
+		resolverOptions = append(resolverOptions, ecr.WithBlobTransport(transport))
+	}
+
+	resolver, err := ecr.NewResolver(resolverOptions...)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("Failed to create resolver")
+	}
+
+	if watchPath != "" {
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		w := &watcher{
+			client:   client,
+			resolver: resolver,
+			path:     watchPath,
+			pull: func(ctx context.Context, ref string) (containerd.Image, error) {
+				if timeout > 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, timeout)
+					defer cancel()
+				}
+				delta := newPullDelta(client.ContentStore())
+				opts := []containerd.RemoteOpt{
+					containerd.WithResolver(resolver),
+					containerd.WithSchema1Conversion,
+					containerd.WithImageHandler(images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+						delta.record(ctx, desc)
+						return nil, nil
+					})),
+				}
+				if os.Getenv("ECR_SKIP_UNPACK") == "" {
+					opts = append(opts, containerd.WithPullUnpack, containerd.WithPullSnapshotter(snapshotterFromEnv()))
+				}
+				img, err := client.Pull(ctx, ref, opts...)
+				if err == nil {
+					log.G(ctx).WithField("ref", ref).Info(delta)
+				}
+				return img, err
+			},
+			pulled: map[string]digest.Digest{},
+		}
+		log.G(ctx).WithField("path", watchPath).Info("Watching images in Amazon ECR")
+		w.run(ctx)
+		return
+	}
+
+	// The digest pulled before, if any, shows whether the tag moved.
+	var previous digest.Digest
+	if img, err := client.ImageService().Get(ctx, ref); err == nil {
+		previous = img.Target.Digest
+	}
+	delta := newPullDelta(client.ContentStore())
+
 	ongoing := newJobs(ref)
 	pctx, stopProgress := context.WithCancel(ctx)
 	progress := make(chan struct{})
@@ -78,40 +223,84 @@ func main() {
 		if desc.MediaType != images.MediaTypeDockerSchema1Manifest {
 			ongoing.add(desc)
 		}
+		delta.record(ctx, desc)
 		return nil, nil
 	})
 
-	resolver, err := ecr.NewResolver(ecr.WithLayerDownloadParallelism(parallelism))
-	if err != nil {
-		log.G(ctx).WithError(err).Fatal("Failed to create resolver")
+	pullResolver := resolver
+	var report *ecr.VerificationReport
+	reportPath := os.Getenv("ECR_PULL_REPORT")
+	if reportPath != "" {
+		report = ecr.NewVerificationReport()
+		pullResolver = report.Resolver(resolver)
 	}
 
 	log.G(ctx).WithField("ref", ref).Info("Pulling from Amazon ECR")
-	img, err := client.Pull(ctx, ref,
-		containerd.WithResolver(resolver),
+	img, err := client.Pull(pullCtx, ref,
+		containerd.WithResolver(pullResolver),
 		containerd.WithImageHandler(h),
 		containerd.WithSchema1Conversion)
 	stopProgress()
+	if err != nil && errors.Is(pullCtx.Err(), context.DeadlineExceeded) {
+		err = &timeoutError{
+			ref:        ref,
+			stage:      "pull",
+			timeout:    timeout,
+			inProgress: abortIngests(ctx, client.ContentStore(), ongoing),
+		}
+	}
 	if err != nil {
-		log.G(ctx).WithError(err).WithField("ref", ref).Fatal("Failed to pull")
+		cli.Fatal(log.G(ctx).WithField("ref", ref), err, "Failed to pull")
 	}
 	<-progress
-	log.G(ctx).WithField("img", img.Name()).Info("Pulled successfully!")
+	entry := log.G(ctx).WithField("img", img.Name()).WithField("digest", img.Target().Digest)
+	if previous != "" && previous != img.Target().Digest {
+		entry = entry.WithField("previous", previous)
+	}
+	entry.Info("Pulled successfully!")
+	fmt.Println(delta)
+	if report != nil {
+		if err := writeReport(reportPath, report); err != nil {
+			log.G(ctx).WithError(err).WithField("path", reportPath).Fatal("Failed to write verification report")
+		}
+	}
 	if skipUnpack := os.Getenv("ECR_SKIP_UNPACK"); skipUnpack != "" {
 		return
 	}
-	snapshotter := containerd.DefaultSnapshotter
-	if newSnapshotter := os.Getenv("CONTAINERD_SNAPSHOTTER"); newSnapshotter != "" {
-		snapshotter = newSnapshotter
-	}
+	snapshotter := snapshotterFromEnv()
 	log.G(ctx).
 		WithField("img", img.Name()).
 		WithField("snapshotter", snapshotter).
 		Info("unpacking...")
-	err = img.Unpack(ctx, snapshotter)
+	unpacking := &unpackProgress{}
+	err = img.Unpack(pullCtx, snapshotter, unpacking.opt())
+	if err != nil && errors.Is(pullCtx.Err(), context.DeadlineExceeded) {
+		err = &timeoutError{
+			ref:        ref,
+			stage:      "unpack",
+			timeout:    timeout,
+			inProgress: unpacking.inProgress(),
+		}
+	}
+	if err != nil {
+		cli.Fatal(log.G(ctx).WithField("img", img.Name), err, "Failed to unpack")
+	}
+}
+
+func snapshotterFromEnv() string {
+	if snapshotter := os.Getenv("CONTAINERD_SNAPSHOTTER"); snapshotter != "" {
+		return snapshotter
+	}
+	return containerd.DefaultSnapshotter
+}
+
+// writeReport writes report to path as JSON.
+func writeReport(path string, report *ecr.VerificationReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
 	if err != nil {
-		log.G(ctx).WithError(err).WithField("img", img.Name).Fatal("Failed to unpack")
+		return err
 	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
 }
 
 func parseEnvInt(ctx context.Context, varname string, val *int) {
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/go-units"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// cleanupTimeout bounds the requests made to containerd after the pull's
+// deadline has passed.
+const cleanupTimeout = 10 * time.Second
+
+// timeoutError is returned when pulling or unpacking an image does not
+// complete within the time set by ECR_PULL_TIMEOUT.  It lists the layers which
+// were in progress when the deadline passed.
+type timeoutError struct {
+	ref        string
+	stage      string
+	timeout    time.Duration
+	inProgress []string
+}
+
+func (e *timeoutError) Error() string {
+	msg := fmt.Sprintf("%s of %s did not complete within %s", e.stage, e.ref, e.timeout)
+	if len(e.inProgress) > 0 {
+		msg += "; in progress: " + strings.Join(e.inProgress, ", ")
+	}
+	return msg
+}
+
+func (e *timeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// abortIngests aborts the ingests of the pull's content which were still
+// active when the pull stopped, so that they are not committed later, and
+// returns a description of each.  Failures are logged rather than returned, as
+// the pull has already failed.
+func abortIngests(ctx context.Context, cs content.Store, ongoing *jobs) []string {
+	ctx, cancel := context.WithTimeout(ctx, cleanupTimeout)
+	defer cancel()
+
+	refs := map[string]ocispec.Descriptor{}
+	for _, desc := range ongoing.jobs() {
+		refs[remotes.MakeRefKey(ctx, desc)] = desc
+	}
+	active, err := cs.ListStatuses(ctx, "")
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("Failed to list active ingests")
+		return nil
+	}
+	var inProgress []string
+	for _, status := range active {
+		if _, ok := refs[status.Ref]; !ok {
+			continue
+		}
+		inProgress = append(inProgress, fmt.Sprintf("%s (%s/%s)",
+			status.Ref,
+			units.HumanSize(float64(status.Offset)),
+			units.HumanSize(float64(status.Total))))
+		if err := cs.Abort(ctx, status.Ref); err != nil {
+			log.G(ctx).WithError(err).WithField("ref", status.Ref).Warn("Failed to abort ingest")
+		}
+	}
+	return inProgress
+}
+
+// unpackProgress records the layer being applied by Unpack.  Layers are
+// applied one at a time, by the goroutine calling Unpack.
+type unpackProgress struct {
+	current ocispec.Descriptor
+}
+
+// opt returns an UnpackOpt recording each layer as it is applied.
+func (u *unpackProgress) opt() containerd.UnpackOpt {
+	return func(_ context.Context, c *containerd.UnpackConfig) error {
+		c.ApplyOpts = append(c.ApplyOpts, func(_ context.Context, desc ocispec.Descriptor, _ *diff.ApplyConfig) error {
+			u.current = desc
+			return nil
+		})
+		return nil
+	}
+}
+
+func (u *unpackProgress) inProgress() []string {
+	if u.current.Digest == "" {
+		return nil
+	}
+	return []string{u.current.Digest.String()}
+}
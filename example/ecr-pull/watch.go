@@ -0,0 +1,215 @@
+/*
+ * Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/example/internal/cli"
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Default to resolving the watched images every five minutes.
+	defaultWatchInterval = 5 * time.Minute
+	// Default to pulling one image at a time.
+	defaultWatchConcurrency = 1
+)
+
+// watchConfig is the file listing the images to keep pulled, such as:
+//
+//	interval: 10m
+//	concurrency: 2
+//	refs:
+//	  - ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/web:live
+//	  - ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/worker:live
+//	resolver:
+//	  downloadLimit: 4
+//	  bandwidth: 52428800
+//	  debug: true
+type watchConfig struct {
+	// Interval between resolving the images.
+	Interval time.Duration `yaml:"interval"`
+	// Concurrency is the number of images pulled at once.
+	Concurrency int `yaml:"concurrency"`
+	// Refs lists the images to pull.
+	Refs []string `yaml:"refs"`
+	// Resolver tunes the resolver while the watcher runs.  Settings not
+	// listed are left as they are.
+	Resolver struct {
+		// DownloadLimit is the number of layers downloaded at once, or zero
+		// for no limit.
+		DownloadLimit *int `yaml:"downloadLimit"`
+		// Bandwidth caps the bytes per second downloaded, or is zero for no
+		// cap.
+		Bandwidth *int64 `yaml:"bandwidth"`
+		// Debug logs the resolver's operations at debug level.
+		Debug *bool `yaml:"debug"`
+	} `yaml:"resolver"`
+}
+
+func loadWatchConfig(path string) (*watchConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &watchConfig{
+		Interval:    defaultWatchInterval,
+		Concurrency: defaultWatchConcurrency,
+	}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if config.Interval <= 0 || config.Concurrency <= 0 {
+		return nil, fmt.Errorf("%s: interval and concurrency must be positive", path)
+	}
+	return config, nil
+}
+
+// watcher keeps the images listed by a watchConfig pulled onto the node, so
+// that they are staged before they are deployed.
+type watcher struct {
+	client   *containerd.Client
+	resolver remotes.Resolver
+	path     string
+	// pull pulls ref onto the node.
+	pull func(ctx context.Context, ref string) (containerd.Image, error)
+
+	lock sync.Mutex
+	// pulled records the digest last pulled for each ref.
+	pulled map[string]digest.Digest
+}
+
+// run pulls the watched images every interval until ctx is done.  The file
+// listing the images is read before each pass, so that it can be changed
+// without restarting the watcher.  A file which cannot be read leaves the
+// previous list in effect.
+func (w *watcher) run(ctx context.Context) {
+	var config *watchConfig
+	for {
+		updated, err := loadWatchConfig(w.path)
+		if err != nil {
+			if config == nil {
+				cli.Fatal(log.G(ctx).WithField("path", w.path), err, "Failed to read watched images")
+			}
+			log.G(ctx).WithError(err).WithField("path", w.path).Warn("Failed to read watched images, using previous list")
+		} else {
+			config = updated
+			w.tune(ctx, config)
+		}
+
+		w.pass(ctx, config)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config.Interval):
+		}
+	}
+}
+
+// tune applies the resolver settings listed by config, so that the watcher
+// can be tuned without restarting it.
+func (w *watcher) tune(ctx context.Context, config *watchConfig) {
+	updater, ok := w.resolver.(ecr.Updater)
+	if !ok {
+		return
+	}
+	err := updater.Update(ctx, func(options *ecr.RuntimeOptions) {
+		if limit := config.Resolver.DownloadLimit; limit != nil {
+			options.LayerDownloadLimit = *limit
+		}
+		if bandwidth := config.Resolver.Bandwidth; bandwidth != nil {
+			options.LayerDownloadBandwidth = *bandwidth
+		}
+		if debug := config.Resolver.Debug; debug != nil {
+			options.DebugLogging = *debug
+		}
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("path", w.path).Warn("Failed to tune resolver")
+	}
+}
+
+// pass resolves each watched image, pulling those whose digest is not yet on
+// the node with at most config.Concurrency pulls at once.
+func (w *watcher) pass(ctx context.Context, config *watchConfig) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, config.Concurrency)
+	for _, ref := range config.Refs {
+		select {
+		case <-ctx.Done():
+			return
+		case slots <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(ref string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			w.update(ctx, ref)
+		}(ref)
+	}
+	wg.Wait()
+}
+
+// update pulls ref if it resolves to a digest other than the one on the node.
+func (w *watcher) update(ctx context.Context, ref string) {
+	entry := log.G(ctx).WithField("ref", ref)
+	_, desc, err := w.resolver.Resolve(ctx, ref)
+	if err != nil {
+		entry.WithError(err).WithField("category", ecr.Categorize(err)).Warn("Failed to resolve watched image")
+		return
+	}
+	entry = entry.WithField("digest", desc.Digest)
+
+	w.lock.Lock()
+	pulled := w.pulled[ref]
+	w.lock.Unlock()
+	if pulled == "" {
+		// Images pulled before the watcher started need not be pulled again.
+		if img, err := w.client.ImageService().Get(ctx, ref); err == nil {
+			pulled = img.Target.Digest
+		}
+	}
+	if pulled == desc.Digest {
+		entry.Debug("Watched image is up to date")
+		return
+	}
+
+	entry.WithField("previous", pulled).Info("Pulling new digest of watched image")
+	start := time.Now()
+	img, err := w.pull(ctx, ref)
+	if err != nil {
+		entry.WithError(err).WithField("category", ecr.Categorize(err)).Warn("Failed to pull watched image")
+		return
+	}
+	// The tag may have moved again since it was resolved.
+	entry.WithField("digest", img.Target().Digest).
+		WithField("duration", time.Since(start)).
+		Info("Pulled watched image")
+	w.lock.Lock()
+	w.pulled[ref] = img.Target().Digest
+	w.lock.Unlock()
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr"
+)
+
+// printRepositoryInfo writes a human readable description of a repository.
+func printRepositoryInfo(w io.Writer, info *ecr.RepositoryInfo) {
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "Repository:\t%s\n", info.URI)
+	fmt.Fprintf(tw, "ARN:\t%s\n", info.ARN)
+	fmt.Fprintf(tw, "Tag mutability:\t%s\n", info.ImageTagMutability)
+	if info.KMSKey != "" {
+		fmt.Fprintf(tw, "Encryption:\t%s (%s)\n", info.EncryptionType, info.KMSKey)
+	} else {
+		fmt.Fprintf(tw, "Encryption:\t%s\n", info.EncryptionType)
+	}
+	fmt.Fprintf(tw, "Scan on push:\t%t\n", info.ScanOnPush)
+	if len(info.Replication) == 0 {
+		fmt.Fprintf(tw, "Replication:\tnone\n")
+	}
+	for i, destination := range info.Replication {
+		label := ""
+		if i == 0 {
+			label = "Replication:"
+		}
+		fmt.Fprintf(tw, "%s\t%s/%s\n", label, destination.RegistryID, destination.Region)
+	}
+	tw.Flush()
+
+	if info.Policy == "" {
+		fmt.Fprintln(w, "Policy: none")
+		return
+	}
+	var policy bytes.Buffer
+	if err := json.Indent(&policy, []byte(info.Policy), "", "  "); err != nil {
+		policy.Reset()
+		policy.WriteString(info.Policy)
+	}
+	fmt.Fprintf(w, "Policy:\n%s\n", policy.String())
+}
+
+// printQuotaUsage writes the service quotas limiting pushes to w, marking
+// those whose usage has reached 90% of the quota.
+func printQuotaUsage(w io.Writer, usage *ecr.QuotaUsage) {
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', 0)
+	for _, quota := range []ecr.Quota{
+		usage.Repositories,
+		usage.ImagesPerRepository,
+		usage.LayerParts,
+		usage.MinimumLayerPartSize,
+		usage.MaximumLayerPartSize,
+	} {
+		if quota.Name == "" {
+			continue
+		}
+		switch {
+		case quota.NearLimit(0.9):
+			fmt.Fprintf(tw, "%s:\t%g of %g (near limit)\n", quota.Name, quota.Usage, quota.Value)
+		case quota.Counted:
+			fmt.Fprintf(tw, "%s:\t%g of %g\n", quota.Name, quota.Usage, quota.Value)
+		default:
+			fmt.Fprintf(tw, "%s:\t%g %s\n", quota.Name, quota.Value, quota.Unit)
+		}
+	}
+	tw.Flush()
+}
@@ -17,13 +17,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
 
 	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/example/internal/cli"
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
@@ -62,6 +65,13 @@ func main() {
 		log.L.Logger.SetLevel(logrus.TraceLevel)
 	}
 
+	inspect := 0
+	parseEnvInt(ctx, "ECR_PUSH_INSPECT", &inspect)
+	dryRun := 0
+	parseEnvInt(ctx, "ECR_PUSH_DRY_RUN", &dryRun)
+	createRepository := 0
+	parseEnvInt(ctx, "ECR_PUSH_CREATE_REPOSITORY", &createRepository)
+
 	client, err := containerd.New("/run/containerd/containerd.sock")
 	if err != nil {
 		log.G(ctx).WithError(err).Fatal("Failed to connect to containerd")
@@ -69,11 +79,46 @@ func main() {
 	defer client.Close()
 
 	tracker := docker.NewInMemoryTracker()
-	resolver, err := ecr.NewResolver(ecr.WithTracker(tracker))
+	resolverOptions := []ecr.ResolverOption{ecr.WithTracker(tracker)}
+	if sources := os.Getenv("ECR_PUSH_LAYER_SOURCES"); sources != "" {
+		resolverOptions = append(resolverOptions, ecr.WithLayerSourceRepositories(strings.Split(sources, ",")...))
+	}
+	if createRepository == 1 {
+		resolverOptions = append(resolverOptions, ecr.WithCreateRepositoryOnPush(ecr.CreateRepositoryOptions{}))
+	}
+	resolver, err := ecr.NewResolver(resolverOptions...)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatal("Failed to create resolver")
 	}
 
+	if inspect == 1 {
+		info, err := resolver.(ecr.RepositoryInspector).InspectRepository(ctx, ref)
+		if err != nil {
+			cli.Fatal(log.G(ctx).WithField("ref", ref), err, "Failed to inspect repository")
+		}
+		printRepositoryInfo(os.Stdout, info)
+
+		usage, err := resolver.(ecr.QuotaInspector).InspectQuotas(ctx, ref)
+		if err != nil {
+			cli.Fatal(log.G(ctx).WithField("ref", ref), err, "Failed to inspect quotas")
+		}
+		printQuotaUsage(os.Stdout, usage)
+	}
+
+	if dryRun == 1 {
+		source := ecr.NewImageStoreResolver(client.ImageService(), client.ContentStore())
+		plan, err := ecr.PlanCopy(ctx, source, local, resolver, ref)
+		if err != nil {
+			cli.Fatal(log.G(ctx).WithField("ref", ref), err, "Failed to plan push")
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(plan); err != nil {
+			log.G(ctx).WithError(err).Fatal("Failed to write plan")
+		}
+		return
+	}
+
 	img, err := client.ImageService().Get(ctx, local)
 	if err != nil {
 		fmt.Println(err)
@@ -103,7 +148,7 @@ func main() {
 
 	err = displayUploadProgress(ctx, ongoing, errs)
 	if err != nil {
-		log.G(ctx).WithError(err).WithField("ref", ref).Fatal("Failed to push")
+		cli.Fatal(log.G(ctx).WithField("ref", ref), err, "Failed to push")
 	}
 	log.G(ctx).WithField("ref", ref).Info("Pushed successfully!")
 }
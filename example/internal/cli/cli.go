@@ -0,0 +1,32 @@
+/*
+ * Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+// Package cli holds the helpers shared by the example programs.
+package cli
+
+import (
+	"os"
+
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr"
+	"github.com/sirupsen/logrus"
+)
+
+// Fatal logs err and exits with the status of its category, so that scripts
+// can tell failures apart.
+func Fatal(entry *logrus.Entry, err error, msg string) {
+	category := ecr.Categorize(err)
+	entry.WithError(err).WithField("category", category).Error(msg)
+	os.Exit(category.ExitCode())
+}